@@ -0,0 +1,398 @@
+/*
+Package benchmarks provides standardized workloads for evaluating LogDB
+implementations. The workloads can be run against any raftio.ILogDB instance,
+each run produces a report in the same format so the impact of tuning changes
+and different storage engines can be compared.
+*/
+package benchmarks
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/coufalja/tugboat/server"
+	"github.com/pkg/errors"
+)
+
+// Factory creates an empty LogDB instance for running a workload. The
+// instance is closed once the workload is completed.
+type Factory func() (raftio.ILogDB, error)
+
+// Options are the options of a workload run.
+type Options struct {
+	// Ops is the number of measured operations.
+	Ops int
+	// Workers is the number of workers saving raft states, it has to match
+	// the number of worker contexts of the LogDB, e.g. the number of shards
+	// of the pebble based LogDB.
+	Workers uint64
+	// Seed is the seed used for generating the workload.
+	Seed int64
+}
+
+// DefaultOptions returns the default workload options.
+func DefaultOptions() Options {
+	return Options{
+		Ops:     1000,
+		Workers: 16,
+		Seed:    1,
+	}
+}
+
+// Workload is a standardized benchmark workload.
+type Workload struct {
+	// Name is the name of the workload.
+	Name string
+	// Description describes the workload.
+	Description string
+	run         func(b *bench) error
+}
+
+var (
+	// SmallEntryAppend appends batches of 16 small entries to a single node.
+	SmallEntryAppend = Workload{
+		Name:        "small-append",
+		Description: "batches of 16 entries of 16 bytes appended to a single node",
+		run:         runSmallEntryAppend,
+	}
+	// LargeEntryAppend appends single large entries to a single node.
+	LargeEntryAppend = Workload{
+		Name:        "large-append",
+		Description: "single entries of 64KBytes appended to a single node",
+		run:         runLargeEntryAppend,
+	}
+	// MixedMultiCluster appends entries of random sizes to many clusters,
+	// updates of all clusters handled by the same worker are saved together.
+	MixedMultiCluster = Workload{
+		Name:        "mixed-multi-cluster",
+		Description: "entries of random sizes appended to 64 clusters",
+		run:         runMixedMultiCluster,
+	}
+	// CatchUpRead reads ranges of entries at random positions of a long log
+	// as done when a lagging follower catches up.
+	CatchUpRead = Workload{
+		Name:        "catch-up-read",
+		Description: "ranges of 64 entries read from a log of 16384 entries",
+		run:         runCatchUpRead,
+	}
+	// TrimHeavy appends entries and removes all but the most recent ones
+	// after each append.
+	TrimHeavy = Workload{
+		Name:        "trim-heavy",
+		Description: "batches of 64 entries appended, older entries trimmed",
+		run:         runTrimHeavy,
+	}
+)
+
+// Workloads returns all standardized workloads.
+func Workloads() []Workload {
+	return []Workload{
+		SmallEntryAppend,
+		LargeEntryAppend,
+		MixedMultiCluster,
+		CatchUpRead,
+		TrimHeavy,
+	}
+}
+
+// Report is the result of a workload run.
+type Report struct {
+	Workload string
+	Ops      int
+	// Bytes is the size of the payload saved or read.
+	Bytes    uint64
+	Duration time.Duration
+	P50      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// OpsPerSecond returns the throughput in operations per second.
+func (r Report) OpsPerSecond() float64 {
+	if r.Duration == 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+// MBPerSecond returns the throughput in MBytes per second.
+func (r Report) MBPerSecond() float64 {
+	if r.Duration == 0 {
+		return 0
+	}
+	return float64(r.Bytes) / (1024 * 1024) / r.Duration.Seconds()
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%-20s %8d ops %12.1f ops/s %10.2f MB/s p50 %-10s p99 %-10s max %s",
+		r.Workload, r.Ops, r.OpsPerSecond(), r.MBPerSecond(), r.P50, r.P99, r.Max)
+}
+
+// WriteReports writes the reports to w, one line per report.
+func WriteReports(w io.Writer, reports []Report) error {
+	for _, r := range reports {
+		if _, err := fmt.Fprintln(w, r.String()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Run runs the workload against a LogDB instance created by f.
+func Run(f Factory, w Workload, opts Options) (r Report, err error) {
+	if opts.Ops <= 0 || opts.Workers == 0 {
+		return Report{}, errors.New("invalid options")
+	}
+	db, err := f()
+	if err != nil {
+		return Report{}, err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	b := &bench{
+		db:          db,
+		opts:        opts,
+		rnd:         rand.New(rand.NewSource(opts.Seed)),
+		partitioner: server.NewDoubleFixedPartitioner(opts.Workers, opts.Workers),
+		nodes:       make(map[uint64]*node),
+		latencies:   make([]time.Duration, 0, opts.Ops),
+	}
+	if err := w.run(b); err != nil {
+		return Report{}, errors.Wrapf(err, "workload %s failed", w.Name)
+	}
+	return b.report(w.Name), nil
+}
+
+// RunAll runs all standardized workloads, each against a new LogDB instance
+// created by f.
+func RunAll(f Factory, opts Options) ([]Report, error) {
+	reports := make([]Report, 0)
+	for _, w := range Workloads() {
+		r, err := Run(f, w, opts)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// Benchmark runs the workload as a Go benchmark using b.N operations.
+func Benchmark(b *testing.B, f Factory, w Workload, opts Options) {
+	opts.Ops = b.N
+	r, err := Run(f, w, opts)
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	if r.Ops == 0 {
+		return
+	}
+	// the benchmark timer also covers the preparation of the workload, only
+	// the measured operations are reported
+	b.ReportMetric(float64(r.Duration.Nanoseconds())/float64(r.Ops), "ns/op")
+	b.ReportMetric(r.MBPerSecond(), "MB/s")
+	b.ReportMetric(float64(r.P99.Nanoseconds()), "p99-ns/op")
+}
+
+type node struct {
+	clusterID uint64
+	lastIndex uint64
+}
+
+type bench struct {
+	db          raftio.ILogDB
+	opts        Options
+	rnd         *rand.Rand
+	partitioner server.IPartitioner
+	nodes       map[uint64]*node
+	latencies   []time.Duration
+	bytes       uint64
+	duration    time.Duration
+}
+
+// measure runs f and records its latency as a single operation.
+func (b *bench) measure(f func() (uint64, error)) error {
+	start := time.Now()
+	bytes, err := f()
+	d := time.Since(start)
+	if err != nil {
+		return err
+	}
+	b.latencies = append(b.latencies, d)
+	b.duration += d
+	b.bytes += bytes
+	return nil
+}
+
+func (b *bench) report(name string) Report {
+	r := Report{
+		Workload: name,
+		Ops:      len(b.latencies),
+		Bytes:    b.bytes,
+		Duration: b.duration,
+	}
+	if len(b.latencies) == 0 {
+		return r
+	}
+	sort.Slice(b.latencies, func(i, j int) bool {
+		return b.latencies[i] < b.latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		return b.latencies[int(p*float64(len(b.latencies)-1))]
+	}
+	r.P50 = percentile(0.5)
+	r.P99 = percentile(0.99)
+	r.Max = b.latencies[len(b.latencies)-1]
+	return r
+}
+
+func (b *bench) node(clusterID uint64) *node {
+	n, ok := b.nodes[clusterID]
+	if !ok {
+		n = &node{clusterID: clusterID}
+		b.nodes[clusterID] = n
+	}
+	return n
+}
+
+// update returns an update appending count entries of the specified size to
+// the log of the cluster.
+func (b *bench) update(clusterID uint64, count int, size func() int) (pb.Update, uint64) {
+	n := b.node(clusterID)
+	ents := make([]pb.Entry, 0, count)
+	bytes := uint64(0)
+	for i := 0; i < count; i++ {
+		n.lastIndex++
+		sz := size()
+		ents = append(ents, pb.Entry{Index: n.lastIndex, Term: 1, Cmd: make([]byte, sz)})
+		bytes += uint64(sz)
+	}
+	return pb.Update{
+		ClusterID:     clusterID,
+		NodeID:        1,
+		State:         pb.State{Term: 1, Vote: 1, Commit: n.lastIndex},
+		EntriesToSave: ents,
+	}, bytes
+}
+
+func (b *bench) workerID(clusterID uint64) uint64 {
+	return b.partitioner.GetPartitionID(clusterID) + 1
+}
+
+func (b *bench) save(updates []pb.Update) error {
+	return b.db.SaveRaftState(updates, b.workerID(updates[0].ClusterID))
+}
+
+func fixedSize(sz int) func() int {
+	return func() int { return sz }
+}
+
+func runAppend(b *bench, count int, size int) error {
+	for i := 0; i < b.opts.Ops; i++ {
+		ud, bytes := b.update(1, count, fixedSize(size))
+		if err := b.measure(func() (uint64, error) {
+			return bytes, b.save([]pb.Update{ud})
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSmallEntryAppend(b *bench) error {
+	return runAppend(b, 16, 16)
+}
+
+func runLargeEntryAppend(b *bench) error {
+	return runAppend(b, 1, 64*1024)
+}
+
+func runMixedMultiCluster(b *bench) error {
+	const clusters = 64
+	size := func() int { return 16 + b.rnd.Intn(4096) }
+	for i := 0; i < b.opts.Ops; i++ {
+		// updates of clusters handled by the same worker are saved together
+		worker := uint64(i) % b.opts.Workers
+		updates := make([]pb.Update, 0)
+		bytes := uint64(0)
+		for cid := uint64(1); cid <= clusters; cid++ {
+			if b.workerID(cid)-1 != worker {
+				continue
+			}
+			ud, sz := b.update(cid, 1+b.rnd.Intn(8), size)
+			updates = append(updates, ud)
+			bytes += sz
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if err := b.measure(func() (uint64, error) {
+			return bytes, b.save(updates)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCatchUpRead(b *bench) error {
+	const entries = 16384
+	const batch = 64
+	for b.node(1).lastIndex < entries {
+		ud, _ := b.update(1, 256, fixedSize(128))
+		if err := b.save([]pb.Update{ud}); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < b.opts.Ops; i++ {
+		low := 1 + uint64(b.rnd.Int63n(entries-batch))
+		if err := b.measure(func() (uint64, error) {
+			ents, _, err := b.db.IterateEntries(nil, 0, 1, 1,
+				low, low+batch, ^uint64(0))
+			if err != nil {
+				return 0, err
+			}
+			if len(ents) != batch {
+				return 0, errors.Errorf("got %d entries, want %d", len(ents), batch)
+			}
+			bytes := uint64(0)
+			for _, e := range ents {
+				bytes += uint64(len(e.Cmd))
+			}
+			return bytes, nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runTrimHeavy(b *bench) error {
+	const retained = 128
+	for i := 0; i < b.opts.Ops; i++ {
+		ud, bytes := b.update(1, 64, fixedSize(128))
+		if err := b.measure(func() (uint64, error) {
+			if err := b.save([]pb.Update{ud}); err != nil {
+				return 0, err
+			}
+			if last := b.node(1).lastIndex; last > retained {
+				if err := b.db.RemoveEntriesTo(1, 1, last-retained); err != nil {
+					return 0, err
+				}
+			}
+			return bytes, nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
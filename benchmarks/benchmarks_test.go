@@ -0,0 +1,48 @@
+package benchmarks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func memFactory() (raftio.ILogDB, error) {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	return pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+}
+
+func TestRunAll(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Ops = 20
+	reports, err := RunAll(memFactory, opts)
+	require.NoError(t, err)
+	require.Len(t, reports, len(Workloads()))
+	for _, r := range reports {
+		require.NotZero(t, r.Ops, r.Workload)
+		require.NotZero(t, r.Bytes, r.Workload)
+		require.LessOrEqual(t, r.P50, r.P99)
+		require.LessOrEqual(t, r.P99, r.Max)
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteReports(buf, reports))
+	require.Equal(t, len(reports), strings.Count(buf.String(), "\n"))
+}
+
+func TestRunRejectsInvalidOptions(t *testing.T) {
+	_, err := Run(memFactory, SmallEntryAppend, Options{})
+	require.Error(t, err)
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	for _, w := range Workloads() {
+		b.Run(w.Name, func(b *testing.B) {
+			Benchmark(b, memFactory, w, DefaultOptions())
+		})
+	}
+}
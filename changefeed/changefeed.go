@@ -0,0 +1,200 @@
+/*
+Package changefeed provides reference implementations of the pebble.Sink
+interface, they publish committed entries of raft nodes to message brokers so
+downstream systems can consume the raft log as an event stream.
+
+Each entry is published as a JSON encoded Message keyed by the node, brokers
+partitioning messages by key keep the entries of each node in index order. The
+sinks don't depend on any broker client library, they are used with a thin
+adapter of the client of choice implementing the Producer or Publisher
+interface. The Publish and Flush methods of *nats.Conn already satisfy the
+Publisher interface.
+
+Delivery is at-least-once, consumers are expected to deduplicate messages using
+the cluster ID, node ID and index of the entry.
+*/
+package changefeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// Message is the published representation of a committed entry.
+type Message struct {
+	ClusterID uint64
+	NodeID    uint64
+	Index     uint64
+	Term      uint64
+	Type      pb.EntryType
+	Key       uint64 `json:",omitempty"`
+	ClientID  uint64 `json:",omitempty"`
+	SeriesID  uint64 `json:",omitempty"`
+	Cmd       []byte `json:",omitempty"`
+}
+
+// NewMessage returns the message of the specified entry.
+func NewMessage(clusterID uint64, nodeID uint64, e pb.Entry) Message {
+	return Message{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		Index:     e.Index,
+		Term:      e.Term,
+		Type:      e.Type,
+		Key:       e.Key,
+		ClientID:  e.ClientID,
+		SeriesID:  e.SeriesID,
+		Cmd:       e.Cmd,
+	}
+}
+
+// MessageKey returns the key of messages of the specified node.
+func MessageKey(clusterID uint64, nodeID uint64) []byte {
+	return []byte(fmt.Sprintf("%d-%d", clusterID, nodeID))
+}
+
+func encode(clusterID uint64,
+	nodeID uint64, entries []pb.Entry) ([][]byte, error) {
+	result := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		data, err := json.Marshal(NewMessage(clusterID, nodeID, e))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, data)
+	}
+	return result, nil
+}
+
+// Producer is the minimal Kafka producer used by the Kafka sink. Produce
+// queues a message for the topic, Flush returns once all queued messages have
+// been acknowledged by the brokers.
+type Producer interface {
+	Produce(topic string, key []byte, value []byte) error
+	Flush() error
+}
+
+// Kafka is a sink publishing entries to a Kafka topic.
+type Kafka struct {
+	name     string
+	topic    string
+	producer Producer
+}
+
+var _ pebble.Sink = (*Kafka)(nil)
+
+// NewKafka returns a sink with the specified name publishing entries to the
+// topic using the producer. The producer is expected to wait for the
+// acknowledgement of all in-sync replicas.
+func NewKafka(name string, topic string, producer Producer) *Kafka {
+	return &Kafka{name: name, topic: topic, producer: producer}
+}
+
+// Name returns the name of the sink.
+func (k *Kafka) Name() string {
+	return k.name
+}
+
+// Write publishes the entries and waits for their acknowledgement.
+func (k *Kafka) Write(clusterID uint64, nodeID uint64, entries []pb.Entry) error {
+	values, err := encode(clusterID, nodeID, entries)
+	if err != nil {
+		return err
+	}
+	key := MessageKey(clusterID, nodeID)
+	for _, v := range values {
+		if err := k.producer.Produce(k.topic, key, v); err != nil {
+			return errors.Wrapf(err, "failed to produce to %s", k.topic)
+		}
+	}
+	return errors.Wrapf(k.producer.Flush(), "failed to flush %s", k.topic)
+}
+
+// Publisher is the minimal NATS client used by the NATS sink.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+	Flush() error
+}
+
+// NATS is a sink publishing entries to NATS subjects.
+type NATS struct {
+	name      string
+	prefix    string
+	publisher Publisher
+}
+
+var _ pebble.Sink = (*NATS)(nil)
+
+// NewNATS returns a sink with the specified name publishing entries of each
+// node to the <prefix>.<clusterID>.<nodeID> subject. Subjects are expected to
+// be captured by a JetStream stream for the delivery to be durable.
+func NewNATS(name string, prefix string, publisher Publisher) *NATS {
+	return &NATS{name: name, prefix: prefix, publisher: publisher}
+}
+
+// Name returns the name of the sink.
+func (n *NATS) Name() string {
+	return n.name
+}
+
+// Subject returns the subject of entries of the specified node.
+func (n *NATS) Subject(clusterID uint64, nodeID uint64) string {
+	return fmt.Sprintf("%s.%d.%d", n.prefix, clusterID, nodeID)
+}
+
+// Write publishes the entries and flushes the connection.
+func (n *NATS) Write(clusterID uint64, nodeID uint64, entries []pb.Entry) error {
+	values, err := encode(clusterID, nodeID, entries)
+	if err != nil {
+		return err
+	}
+	subject := n.Subject(clusterID, nodeID)
+	for _, v := range values {
+		if err := n.publisher.Publish(subject, v); err != nil {
+			return errors.Wrapf(err, "failed to publish to %s", subject)
+		}
+	}
+	return errors.Wrapf(n.publisher.Flush(), "failed to flush %s", subject)
+}
+
+// Writer is a sink writing entries as JSON lines to an io.Writer, e.g. for
+// piping the change feed into other tools.
+type Writer struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+var _ pebble.Sink = (*Writer)(nil)
+
+// NewWriter returns a sink with the specified name writing to w.
+func NewWriter(name string, w io.Writer) *Writer {
+	return &Writer{name: name, w: w}
+}
+
+// Name returns the name of the sink.
+func (w *Writer) Name() string {
+	return w.name
+}
+
+// Write writes one line per entry.
+func (w *Writer) Write(clusterID uint64, nodeID uint64, entries []pb.Entry) error {
+	values, err := encode(clusterID, nodeID, entries)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, v := range values {
+		if _, err := w.w.Write(append(v, '\n')); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
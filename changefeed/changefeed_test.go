@@ -0,0 +1,123 @@
+package changefeed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type record struct {
+	target string
+	key    []byte
+	value  []byte
+}
+
+type fakeBroker struct {
+	queued    []record
+	published []record
+	fail      bool
+}
+
+func (b *fakeBroker) Produce(topic string, key []byte, value []byte) error {
+	b.queued = append(b.queued, record{target: topic, key: key, value: value})
+	return nil
+}
+
+func (b *fakeBroker) Publish(subject string, data []byte) error {
+	b.queued = append(b.queued, record{target: subject, value: data})
+	return nil
+}
+
+func (b *fakeBroker) Flush() error {
+	if b.fail {
+		b.queued = nil
+		return errors.New("broker unavailable")
+	}
+	b.published = append(b.published, b.queued...)
+	b.queued = nil
+	return nil
+}
+
+func testEntries() []pb.Entry {
+	return []pb.Entry{
+		{Index: 5, Term: 2, Cmd: []byte("cmd-5")},
+		{Index: 6, Term: 2, Type: pb.ConfigChangeEntry, Cmd: []byte("cmd-6")},
+	}
+}
+
+func decode(t *testing.T, data []byte) Message {
+	var m Message
+	require.NoError(t, json.Unmarshal(data, &m))
+	return m
+}
+
+func TestKafkaSink(t *testing.T) {
+	b := &fakeBroker{}
+	s := NewKafka("kafka", "raft", b)
+	require.Equal(t, "kafka", s.Name())
+	require.NoError(t, s.Write(1, 2, testEntries()))
+	require.Len(t, b.published, 2)
+	for i, r := range b.published {
+		require.Equal(t, "raft", r.target)
+		require.Equal(t, MessageKey(1, 2), r.key)
+		require.Equal(t, NewMessage(1, 2, testEntries()[i]), decode(t, r.value))
+	}
+	b.fail = true
+	require.Error(t, s.Write(1, 2, testEntries()))
+}
+
+func TestNATSSink(t *testing.T) {
+	b := &fakeBroker{}
+	s := NewNATS("nats", "raft", b)
+	require.Equal(t, "nats", s.Name())
+	require.NoError(t, s.Write(1, 2, testEntries()))
+	require.Len(t, b.published, 2)
+	for i, r := range b.published {
+		require.Equal(t, "raft.1.2", r.target)
+		require.Equal(t, NewMessage(1, 2, testEntries()[i]), decode(t, r.value))
+	}
+	b.fail = true
+	require.Error(t, s.Write(1, 2, testEntries()))
+}
+
+func TestWriterSinkWithFeed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	db, err := pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 2, Commit: 6},
+		EntriesToSave: testEntries(),
+	}
+	require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+	var buf bytes.Buffer
+	s := NewWriter("writer", &buf)
+	f, err := db.StartFeed(s, 1, 2, pebble.FeedOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.Stats().Offset == 6
+	}, 5*time.Second, time.Millisecond)
+	f.Stop()
+	scanner := bufio.NewScanner(&buf)
+	var messages []Message
+	for scanner.Scan() {
+		messages = append(messages, decode(t, scanner.Bytes()))
+	}
+	require.Equal(t, []Message{NewMessage(1, 2, testEntries()[0]),
+		NewMessage(1, 2, testEntries()[1])}, messages)
+}
@@ -0,0 +1,270 @@
+/*
+Package chaos provides a raftio.ILogDB decorator injecting latency and
+transient errors into storage operations, it is intended for game day testing
+of raft behavior under degraded storage. Faults are configured per operation
+type and can be changed, enabled or disabled at runtime.
+*/
+package chaos
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the error returned by operations failed by the chaos LogDB.
+var ErrInjected = errors.New("chaos: injected storage error")
+
+// Op is the type of a storage operation faults can be injected into.
+type Op int
+
+const (
+	// OpWrite covers saving raft states, snapshots and bootstrap info and
+	// importing snapshots.
+	OpWrite Op = iota
+	// OpRead covers reading raft states, entries, snapshots, bootstrap info
+	// and node lists.
+	OpRead
+	// OpRemove covers removing and compacting entries and removing node data.
+	OpRemove
+	numOfOps
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpWrite:
+		return "write"
+	case OpRead:
+		return "read"
+	case OpRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+// Fault describes the faults injected into operations of the same type.
+type Fault struct {
+	// Latency is the delay added to each operation.
+	Latency time.Duration
+	// Jitter is the max random delay added on top of Latency.
+	Jitter time.Duration
+	// ErrorRate is the probability of failing an operation with ErrInjected,
+	// in the range of [0, 1]. Failed operations are not passed to the wrapped
+	// LogDB.
+	ErrorRate float64
+}
+
+func (f Fault) validate() error {
+	if f.Latency < 0 || f.Jitter < 0 {
+		return errors.New("negative latency")
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 {
+		return errors.Errorf("invalid error rate %f", f.ErrorRate)
+	}
+	return nil
+}
+
+// LogDB is a raftio.ILogDB decorator injecting the configured faults. It is
+// created disabled.
+type LogDB struct {
+	raftio.ILogDB
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	faults   [numOfOps]Fault
+	enabled  int32
+	injected [numOfOps]uint64
+}
+
+var _ raftio.ILogDB = (*LogDB)(nil)
+
+// New creates a chaos LogDB wrapping db. The seed makes the injected faults
+// reproducible.
+func New(db raftio.ILogDB, seed int64) *LogDB {
+	return &LogDB{
+		ILogDB: db,
+		rnd:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFault sets the fault injected into operations of the specified type.
+func (l *LogDB) SetFault(op Op, f Fault) error {
+	if op < 0 || op >= numOfOps {
+		return errors.Errorf("invalid op %d", op)
+	}
+	if err := f.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.faults[op] = f
+	return nil
+}
+
+// ClearFaults removes all configured faults.
+func (l *LogDB) ClearFaults() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.faults = [numOfOps]Fault{}
+}
+
+// Enable enables fault injection.
+func (l *LogDB) Enable() {
+	atomic.StoreInt32(&l.enabled, 1)
+}
+
+// Disable disables fault injection, all operations are passed to the wrapped
+// LogDB as is.
+func (l *LogDB) Disable() {
+	atomic.StoreInt32(&l.enabled, 0)
+}
+
+// Enabled returns a boolean value indicating whether fault injection is
+// enabled.
+func (l *LogDB) Enabled() bool {
+	return atomic.LoadInt32(&l.enabled) == 1
+}
+
+// Injected returns the number of errors injected into operations of the
+// specified type so far.
+func (l *LogDB) Injected(op Op) uint64 {
+	return atomic.LoadUint64(&l.injected[op])
+}
+
+// Unwrap returns the wrapped LogDB.
+func (l *LogDB) Unwrap() raftio.ILogDB {
+	return l.ILogDB
+}
+
+// inject delays the operation and returns ErrInjected when the operation is
+// selected to fail.
+func (l *LogDB) inject(op Op) error {
+	if !l.Enabled() {
+		return nil
+	}
+	l.mu.Lock()
+	f := l.faults[op]
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(l.rnd.Int63n(int64(f.Jitter)))
+	}
+	fail := f.ErrorRate > 0 && l.rnd.Float64() < f.ErrorRate
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if fail {
+		atomic.AddUint64(&l.injected[op], 1)
+		return errors.Wrapf(ErrInjected, "%s", op)
+	}
+	return nil
+}
+
+// ListNodeInfo ...
+func (l *LogDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	if err := l.inject(OpRead); err != nil {
+		return nil, err
+	}
+	return l.ILogDB.ListNodeInfo()
+}
+
+// SaveBootstrapInfo ...
+func (l *LogDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	if err := l.inject(OpWrite); err != nil {
+		return err
+	}
+	return l.ILogDB.SaveBootstrapInfo(clusterID, nodeID, bootstrap)
+}
+
+// GetBootstrapInfo ...
+func (l *LogDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	if err := l.inject(OpRead); err != nil {
+		return pb.Bootstrap{}, err
+	}
+	return l.ILogDB.GetBootstrapInfo(clusterID, nodeID)
+}
+
+// SaveRaftState ...
+func (l *LogDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	if err := l.inject(OpWrite); err != nil {
+		return err
+	}
+	return l.ILogDB.SaveRaftState(updates, shardID)
+}
+
+// IterateEntries ...
+func (l *LogDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	if err := l.inject(OpRead); err != nil {
+		return nil, 0, err
+	}
+	return l.ILogDB.IterateEntries(ents,
+		size, clusterID, nodeID, low, high, maxSize)
+}
+
+// ReadRaftState ...
+func (l *LogDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	if err := l.inject(OpRead); err != nil {
+		return raftio.RaftState{}, err
+	}
+	return l.ILogDB.ReadRaftState(clusterID, nodeID, lastIndex)
+}
+
+// RemoveEntriesTo ...
+func (l *LogDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	if err := l.inject(OpRemove); err != nil {
+		return err
+	}
+	return l.ILogDB.RemoveEntriesTo(clusterID, nodeID, index)
+}
+
+// CompactEntriesTo ...
+func (l *LogDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	if err := l.inject(OpRemove); err != nil {
+		return nil, err
+	}
+	return l.ILogDB.CompactEntriesTo(clusterID, nodeID, index)
+}
+
+// SaveSnapshots ...
+func (l *LogDB) SaveSnapshots(updates []pb.Update) error {
+	if err := l.inject(OpWrite); err != nil {
+		return err
+	}
+	return l.ILogDB.SaveSnapshots(updates)
+}
+
+// GetSnapshot ...
+func (l *LogDB) GetSnapshot(clusterID uint64,
+	nodeID uint64) (pb.Snapshot, error) {
+	if err := l.inject(OpRead); err != nil {
+		return pb.Snapshot{}, err
+	}
+	return l.ILogDB.GetSnapshot(clusterID, nodeID)
+}
+
+// RemoveNodeData ...
+func (l *LogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	if err := l.inject(OpRemove); err != nil {
+		return err
+	}
+	return l.ILogDB.RemoveNodeData(clusterID, nodeID)
+}
+
+// ImportSnapshot ...
+func (l *LogDB) ImportSnapshot(snapshot pb.Snapshot, nodeID uint64) error {
+	if err := l.inject(OpWrite); err != nil {
+		return err
+	}
+	return l.ILogDB.ImportSnapshot(snapshot, nodeID)
+}
@@ -0,0 +1,71 @@
+package chaos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogDB(t *testing.T) *LogDB {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	db, err := pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	return New(db, 1)
+}
+
+func TestChaosLogDBInjectsErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	db := newTestLogDB(t)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.SetFault(OpWrite, Fault{ErrorRate: 1}))
+	bs := pb.Bootstrap{Join: true}
+	// faults are not injected until enabled
+	require.NoError(t, db.SaveBootstrapInfo(1, 2, bs))
+	db.Enable()
+	require.True(t, db.Enabled())
+	err := db.SaveBootstrapInfo(1, 3, bs)
+	require.True(t, errors.Is(err, ErrInjected))
+	require.Equal(t, uint64(1), db.Injected(OpWrite))
+	// the failed operation is not passed to the wrapped LogDB
+	_, err = db.GetBootstrapInfo(1, 3)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrInjected))
+	_, err = db.GetBootstrapInfo(1, 2)
+	require.NoError(t, err)
+	db.Disable()
+	require.NoError(t, db.SaveBootstrapInfo(1, 3, bs))
+	db.Enable()
+	db.ClearFaults()
+	require.NoError(t, db.SaveBootstrapInfo(1, 4, bs))
+}
+
+func TestChaosLogDBInjectsLatency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	db := newTestLogDB(t)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.SetFault(OpRead, Fault{Latency: 20 * time.Millisecond}))
+	db.Enable()
+	start := time.Now()
+	_, err := db.ListNodeInfo()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.Zero(t, db.Injected(OpRead))
+}
+
+func TestChaosLogDBRejectsInvalidFaults(t *testing.T) {
+	db := New(nil, 1)
+	require.Error(t, db.SetFault(numOfOps, Fault{}))
+	require.Error(t, db.SetFault(OpRead, Fault{ErrorRate: 2}))
+	require.Error(t, db.SetFault(OpRead, Fault{Latency: -1}))
+}
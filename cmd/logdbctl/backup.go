@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/pkg/errors"
+)
+
+func runBackup(args []string, out io.Writer) (err error) {
+	f := &dbFlags{}
+	var target string
+	var shipped string
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	f.register(fs)
+	fs.StringVar(&target, "out", "", "backup directory to be created")
+	fs.StringVar(&shipped, "shipped", "", "directory of shipped segments, records the shipping sequences")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(target) == 0 {
+		return errors.New("-out not specified")
+	}
+	cfg := f.config()
+	if len(shipped) > 0 {
+		cfg.ShippingStore = pebble.NewFSObjectStore(cfg.FS, shipped)
+	}
+	db, err := f.openWith(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	m, err := db.Backup(target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "backup created in %s, %d shards, %d nodes, %d files\n",
+		target, m.Shards, len(m.Nodes), len(m.Files))
+	return nil
+}
+
+func runRestore(args []string, out io.Writer) error {
+	f := &dbFlags{}
+	var source string
+	var verify bool
+	var shipped string
+	var until string
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	f.register(fs)
+	fs.StringVar(&source, "from", "", "backup directory to restore from")
+	fs.BoolVar(&verify, "verify", true, "verify the restored LogDB")
+	fs.StringVar(&shipped, "shipped", "", "directory of shipped segments to be applied after the backup")
+	fs.StringVar(&until, "until", "", "restore up to the specified RFC3339 time, requires -shipped")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(shipped) > 0 {
+		return runPointInTimeRestore(f, source, shipped, until, out)
+	}
+	if len(until) > 0 {
+		return errors.New("-until requires -shipped")
+	}
+	if len(source) == 0 {
+		return errors.New("-from not specified")
+	}
+	if len(f.dir) == 0 {
+		return errors.New("-dir not specified")
+	}
+	cfg := f.config()
+	m, err := pebble.VerifyBackup(source, cfg.FS)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "backup in %s verified, %d shards, %d nodes, %d files\n",
+		source, m.Shards, len(m.Nodes), len(m.Files))
+	if err := pebble.RestoreBackup(cfg, source, []string{f.dir}, f.lldirs()); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "restored into %s\n", f.dir)
+	if !verify {
+		return nil
+	}
+	if err := pebble.VerifyRestore(cfg, []string{f.dir}, f.lldirs(), m); err != nil {
+		return errors.Wrap(err, "restored LogDB failed verification")
+	}
+	fmt.Fprintf(out, "restored LogDB verified\n")
+	return nil
+}
+
+func runPointInTimeRestore(f *dbFlags,
+	source string, shipped string, until string, out io.Writer) error {
+	if len(source) == 0 {
+		return errors.New("-from not specified")
+	}
+	if len(f.dir) == 0 {
+		return errors.New("-dir not specified")
+	}
+	target := pebble.RestoreTarget{}
+	if len(until) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return errors.Wrapf(err, "invalid -until")
+		}
+		target.Until = t
+	}
+	cfg := f.config()
+	store := pebble.NewFSObjectStore(cfg.FS, shipped)
+	report, err := pebble.RestoreToPointInTime(cfg,
+		source, store, []string{f.dir}, f.lldirs(), target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, report.String())
+	fmt.Fprintf(out, "restored into %s, %d records verified\n", f.dir, report.Verify.Records)
+	return nil
+}
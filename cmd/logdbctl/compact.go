@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/pkg/errors"
+)
+
+// rangeFlags are the flags shared by the trim and compact commands.
+type rangeFlags struct {
+	dbFlags
+	nodeFlags
+	index  uint64
+	dryRun bool
+	force  bool
+}
+
+func (f *rangeFlags) parse(name string, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.dbFlags.register(fs)
+	f.nodeFlags.register(fs)
+	fs.Uint64Var(&f.index, "index", 0, "target index, defaults to the latest snapshot index of each node")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "only print the planned operations")
+	fs.BoolVar(&f.force, "force", false, "allow target index beyond the latest snapshot index")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return f.nodeFlags.validate()
+}
+
+// targetIndex returns the index up to which the specified node should be
+// processed. Zero is returned when there is nothing to do for the node.
+func (f *rangeFlags) targetIndex(db *pebble.ShardedDB, n nodeID) (uint64, error) {
+	ss, err := db.GetSnapshot(n.clusterID, n.nodeID)
+	if err != nil {
+		return 0, err
+	}
+	if f.index == 0 {
+		return ss.Index, nil
+	}
+	if f.index > ss.Index && !f.force {
+		return 0, errors.Errorf("%s: index %d is beyond the latest snapshot index %d, use -force to override",
+			n, f.index, ss.Index)
+	}
+	return f.index, nil
+}
+
+func runTrim(args []string, out io.Writer) error {
+	f := &rangeFlags{}
+	if err := f.parse("trim", args); err != nil {
+		return err
+	}
+	return forEachTarget(f, out, "trim", func(db *pebble.ShardedDB, n nodeID, index uint64) error {
+		return db.RemoveEntriesTo(n.clusterID, n.nodeID, index)
+	})
+}
+
+func runCompact(args []string, out io.Writer) error {
+	f := &rangeFlags{}
+	if err := f.parse("compact", args); err != nil {
+		return err
+	}
+	return forEachTarget(f, out, "compact", func(db *pebble.ShardedDB, n nodeID, index uint64) error {
+		done, err := db.CompactEntriesTo(n.clusterID, n.nodeID, index)
+		if err != nil {
+			return err
+		}
+		<-done
+		return nil
+	})
+}
+
+func forEachTarget(f *rangeFlags, out io.Writer, op string,
+	fn func(*pebble.ShardedDB, nodeID, uint64) error) (err error) {
+	db, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	nodes, err := f.nodes(db)
+	if err != nil {
+		return err
+	}
+	for i, n := range nodes {
+		index, err := f.targetIndex(db, n)
+		if err != nil {
+			return err
+		}
+		progress := fmt.Sprintf("(%d/%d)", i+1, len(nodes))
+		if index == 0 {
+			fmt.Fprintf(out, "%s %s: no snapshot, skipped %s\n", op, n, progress)
+			continue
+		}
+		if f.dryRun {
+			fmt.Fprintf(out, "%s %s: up to index %d, dry run %s\n", op, n, index, progress)
+			continue
+		}
+		if err := fn(db, n, index); err != nil {
+			return errors.Wrapf(err, "%s %s", op, n)
+		}
+		fmt.Fprintf(out, "%s %s: up to index %d, done %s\n", op, n, index, progress)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+func runGolden(args []string, out io.Writer) error {
+	var dir string
+	fs := flag.NewFlagSet("golden", flag.ContinueOnError)
+	fs.StringVar(&dir, "out", "", "directory the golden database is generated in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(dir) == 0 {
+		return errors.New("-out not specified")
+	}
+	target := vfs.Default.PathJoin(dir, pebble.CurrentGoldenFormat().Name())
+	f, err := pebble.GenerateGoldenData(vfs.Default, target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "golden database of binary format %d, key layout %d generated in %s\n",
+		f.BinaryFormat, f.KeyLayout, target)
+	return nil
+}
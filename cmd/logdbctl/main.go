@@ -0,0 +1,164 @@
+// Command logdbctl is a maintenance tool for tugboat LogDB directories. It is
+// expected to be used on stopped nodes only, the LogDB directory must not be
+// opened by any other process while logdbctl is running.
+//
+// Usage:
+//
+//	logdbctl <command> [flags]
+//
+// Run logdbctl help to list all available commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/pkg/errors"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{name: "trim", usage: "remove entries up to the specified index", run: runTrim},
+	{name: "compact", usage: "reclaim storage space used by removed entries", run: runCompact},
+	{name: "backup", usage: "create a backup of the LogDB", run: runBackup},
+	{name: "restore", usage: "restore a backup created by the backup command", run: runRestore},
+	{name: "verify", usage: "check the LogDB for corruptions and invariant violations", run: runVerify},
+	{name: "stats", usage: "print shard metrics and per node statistics", run: runStats},
+	{name: "list-nodes", usage: "list all nodes found in the LogDB", run: runListNodes},
+	{name: "rebuild", usage: "rebuild the log of a node from a healthy peer", run: runRebuild},
+	{name: "golden", usage: "generate a golden database for compatibility tests", run: runGolden},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "logdbctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" {
+		printUsage(out)
+		return nil
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], out)
+		}
+	}
+	printUsage(out)
+	return errors.Errorf("unknown command %q", args[0])
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "usage: logdbctl <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-12s %s\n", c.name, c.usage)
+	}
+}
+
+// dbFlags are the flags shared by all commands opening a LogDB instance.
+type dbFlags struct {
+	dir    string
+	walDir string
+	shards uint64
+}
+
+func (f *dbFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", "", "LogDB directory, usually the NodeHostDir")
+	fs.StringVar(&f.walDir, "wal-dir", "", "low latency LogDB directory, usually the WALDir")
+	fs.Uint64Var(&f.shards, "shards", pebble.GetDefaultLogDBConfig().Shards, "number of LogDB shards")
+}
+
+func (f *dbFlags) config() pebble.LogDBConfig {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.Shards = f.shards
+	return cfg
+}
+
+func (f *dbFlags) lldirs() []string {
+	if len(f.walDir) > 0 {
+		return []string{f.walDir}
+	}
+	return nil
+}
+
+func (f *dbFlags) open() (*pebble.ShardedDB, error) {
+	return f.openWith(f.config())
+}
+
+// openReadOnly opens the LogDB in read-only mode, it should be used by all
+// commands that don't modify the LogDB.
+func (f *dbFlags) openReadOnly() (*pebble.ShardedDB, error) {
+	cfg := f.config()
+	cfg.ReadOnly = true
+	return f.openWith(cfg)
+}
+
+func (f *dbFlags) openWith(cfg pebble.LogDBConfig) (*pebble.ShardedDB, error) {
+	if len(f.dir) == 0 {
+		return nil, errors.New("-dir not specified")
+	}
+	return pebble.NewLogDB(cfg, nil, []string{f.dir}, f.lldirs(), pebble.CheckNone)
+}
+
+// nodeFlags are the flags used by commands targeting one or all nodes.
+type nodeFlags struct {
+	clusterID uint64
+	nodeID    uint64
+	all       bool
+}
+
+func (f *nodeFlags) register(fs *flag.FlagSet) {
+	fs.Uint64Var(&f.clusterID, "cluster", 0, "cluster ID of the target node")
+	fs.Uint64Var(&f.nodeID, "node", 0, "node ID of the target node")
+	fs.BoolVar(&f.all, "all", false, "target all nodes found in the LogDB")
+}
+
+func (f *nodeFlags) validate() error {
+	if f.all && (f.clusterID != 0 || f.nodeID != 0) {
+		return errors.New("-all can not be used together with -cluster or -node")
+	}
+	if !f.all && (f.clusterID == 0 || f.nodeID == 0) {
+		return errors.New("either -all or both -cluster and -node must be specified")
+	}
+	return nil
+}
+
+type nodeID struct {
+	clusterID uint64
+	nodeID    uint64
+}
+
+func (n nodeID) String() string {
+	return fmt.Sprintf("cluster %d node %d", n.clusterID, n.nodeID)
+}
+
+func (f *nodeFlags) nodes(db *pebble.ShardedDB) ([]nodeID, error) {
+	if !f.all {
+		return []nodeID{{clusterID: f.clusterID, nodeID: f.nodeID}}, nil
+	}
+	ni, err := db.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]nodeID, 0, len(ni))
+	for _, n := range ni {
+		result = append(result, nodeID{clusterID: n.ClusterID, nodeID: n.NodeID})
+	}
+	return result, nil
+}
+
+func closeDB(db *pebble.ShardedDB, err *error) {
+	if cerr := db.Close(); cerr != nil && *err == nil {
+		*err = cerr
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat-logdb/replication"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+const testShards = 2
+
+func openTestDB(t *testing.T, dir string) *pebble.ShardedDB {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.Shards = testShards
+	db, err := pebble.NewLogDB(cfg, nil, []string{dir}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	return db
+}
+
+// prepareTestDB creates a LogDB with the specified nodes, each node has 100
+// entries and a snapshot at index 50.
+func prepareTestDB(t *testing.T, dir string, nodes ...nodeID) {
+	db := openTestDB(t, dir)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for _, n := range nodes {
+		require.NoError(t, db.SaveBootstrapInfo(n.clusterID, n.nodeID, pb.Bootstrap{Join: true}))
+		ents := make([]pb.Entry, 0)
+		for i := uint64(1); i <= 100; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 64)})
+		}
+		ud := pb.Update{
+			ClusterID:     n.clusterID,
+			NodeID:        n.nodeID,
+			State:         pb.State{Term: 1, Commit: 100},
+			EntriesToSave: ents,
+			Snapshot:      pb.Snapshot{Index: 50, Term: 1},
+		}
+		require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+	}
+}
+
+func firstIndex(t *testing.T, dir string, n nodeID) uint64 {
+	db := openTestDB(t, dir)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(n.clusterID, n.nodeID, 0)
+	require.NoError(t, err)
+	return rs.FirstIndex
+}
+
+func TestUnknownCommandIsReported(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.Error(t, run([]string{"nosuchcommand"}, out))
+	require.Contains(t, out.String(), "usage")
+}
+
+func TestTrimRemovesEntriesUpToSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	n1 := nodeID{clusterID: 1, nodeID: 1}
+	n2 := nodeID{clusterID: 2, nodeID: 1}
+	prepareTestDB(t, dir, n1, n2)
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"trim", "-dir", dir, "-shards", "2", "-all"}, out))
+	require.Contains(t, out.String(), "(2/2)")
+	require.Equal(t, uint64(50), firstIndex(t, dir, n1))
+	require.Equal(t, uint64(50), firstIndex(t, dir, n2))
+}
+
+func TestTrimDryRunKeepsEntries(t *testing.T) {
+	dir := t.TempDir()
+	n := nodeID{clusterID: 1, nodeID: 1}
+	prepareTestDB(t, dir, n)
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"trim", "-dir", dir, "-shards", "2",
+		"-cluster", "1", "-node", "1", "-dry-run"}, out))
+	require.Contains(t, out.String(), "dry run")
+	require.Equal(t, uint64(1), firstIndex(t, dir, n))
+}
+
+func TestTrimBeyondSnapshotRequiresForce(t *testing.T) {
+	dir := t.TempDir()
+	n := nodeID{clusterID: 1, nodeID: 1}
+	prepareTestDB(t, dir, n)
+	args := []string{"trim", "-dir", dir, "-shards", "2", "-cluster", "1", "-node", "1", "-index", "80"}
+	require.Error(t, run(args, &bytes.Buffer{}))
+	require.NoError(t, run(append(args, "-force"), &bytes.Buffer{}))
+	require.Equal(t, uint64(80), firstIndex(t, dir, n))
+}
+
+func TestCompactCanBeRun(t *testing.T) {
+	dir := t.TempDir()
+	n := nodeID{clusterID: 1, nodeID: 1}
+	prepareTestDB(t, dir, n)
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"compact", "-dir", dir, "-shards", "2", "-all"}, out))
+	require.Contains(t, out.String(), "up to index 50, done")
+}
+
+func TestNodeFlagsAreValidated(t *testing.T) {
+	dir := t.TempDir()
+	require.Error(t, run([]string{"trim", "-dir", dir, "-shards", "2"}, &bytes.Buffer{}))
+	require.Error(t, run([]string{"trim", "-dir", dir, "-shards", "2", "-all", "-cluster", "1"}, &bytes.Buffer{}))
+}
+
+func TestBackupCanBeRestored(t *testing.T) {
+	dir := t.TempDir()
+	n := nodeID{clusterID: 1, nodeID: 1}
+	prepareTestDB(t, dir, n)
+	backupDir := dir + "/backup"
+	restoreDir := t.TempDir()
+	walDir := t.TempDir()
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"backup", "-dir", dir, "-shards", "2", "-out", backupDir}, out))
+	require.NoError(t, run([]string{"restore", "-from", backupDir,
+		"-dir", restoreDir, "-wal-dir", walDir, "-shards", "2"}, out))
+	require.Contains(t, out.String(), "restored LogDB verified")
+	require.Error(t, run([]string{"restore", "-from", backupDir,
+		"-dir", restoreDir, "-wal-dir", walDir, "-shards", "2"}, out))
+}
+
+func TestBackupCanBeRestoredToPointInTime(t *testing.T) {
+	dir := t.TempDir()
+	shipped := t.TempDir()
+	backupDir := dir + "/backup"
+	out := &bytes.Buffer{}
+	prepareTestDB(t, dir, nodeID{clusterID: 1, nodeID: 1})
+	require.NoError(t, run([]string{"backup", "-dir", dir, "-shards", "2",
+		"-out", backupDir, "-shipped", shipped}, out))
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.Shards = testShards
+	cfg.ShippingStore = pebble.NewFSObjectStore(vfs.Default, shipped)
+	db, err := pebble.NewLogDB(cfg, nil, []string{dir}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.RemoveNodeData(1, 1))
+	require.NoError(t, db.Close())
+
+	restoreDir := t.TempDir()
+	require.NoError(t, run([]string{"restore", "-from", backupDir, "-dir", restoreDir,
+		"-shards", "2", "-shipped", shipped}, out))
+	require.Contains(t, out.String(), "records verified")
+	db = openTestDB(t, restoreDir)
+	_, err = db.GetBootstrapInfo(1, 1)
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+	require.Error(t, run([]string{"restore", "-from", backupDir, "-dir", t.TempDir(),
+		"-shards", "2", "-until", "2020-01-01T00:00:00Z"}, out))
+}
+
+func TestVerifyReportsHealthyDB(t *testing.T) {
+	dir := t.TempDir()
+	prepareTestDB(t, dir, nodeID{clusterID: 1, nodeID: 1}, nodeID{clusterID: 2, nodeID: 1})
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"verify", "-dir", dir, "-shards", "2", "-json"}, out))
+	report := pebble.VerifyReport{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Equal(t, uint64(2), report.Nodes)
+	require.Equal(t, uint64(200), report.Entries)
+}
+
+func TestVerifyFailsOnViolations(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        1,
+		State:         pb.State{Term: 1},
+		EntriesToSave: []pb.Entry{{Index: 1, Term: 1}},
+	}
+	require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+	require.NoError(t, db.Close())
+	out := &bytes.Buffer{}
+	err := run([]string{"verify", "-dir", dir, "-shards", "2"}, out)
+	require.True(t, errors.Is(err, errViolationsFound))
+	require.Contains(t, out.String(), "no bootstrap record")
+}
+
+func TestStatsPrintsNodes(t *testing.T) {
+	dir := t.TempDir()
+	prepareTestDB(t, dir, nodeID{clusterID: 1, nodeID: 1}, nodeID{clusterID: 2, nodeID: 1})
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"stats", "-dir", dir, "-shards", "2", "-json"}, out))
+	stats := pebble.Stats{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &stats))
+	require.Len(t, stats.Shards, 2)
+	require.Len(t, stats.Nodes, 2)
+	require.Equal(t, uint64(100), stats.Nodes[1].Entries)
+	require.Equal(t, uint64(50), stats.Nodes[1].SnapshotAge)
+	out.Reset()
+	require.NoError(t, run([]string{"stats", "-dir", dir, "-shards", "2"}, out))
+	require.Contains(t, out.String(), "snapshot age")
+}
+
+func TestListNodesCanBeFilteredAndSorted(t *testing.T) {
+	dir := t.TempDir()
+	prepareTestDB(t, dir, nodeID{clusterID: 1, nodeID: 1},
+		nodeID{clusterID: 2, nodeID: 2}, nodeID{clusterID: 2, nodeID: 1})
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"list-nodes", "-dir", dir, "-shards", "2",
+		"-cluster", "2", "-json"}, out))
+	nodes := []nodeListing{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &nodes))
+	require.Len(t, nodes, 2)
+	require.Equal(t, uint64(1), nodes[0].NodeID)
+	require.Equal(t, uint64(2), nodes[1].NodeID)
+	require.Equal(t, uint64(50), nodes[0].FirstIndex)
+	require.Equal(t, uint64(100), nodes[0].LastIndex)
+	require.Equal(t, uint64(50), nodes[0].SnapshotIndex)
+	require.Error(t, run([]string{"list-nodes", "-dir", dir, "-shards", "2",
+		"-sort", "nosuchorder"}, out))
+}
+
+func TestRebuildCopiesNodeFromPeer(t *testing.T) {
+	dir := t.TempDir()
+	prepareTestDB(t, dir, nodeID{clusterID: 1, nodeID: 1})
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("secret\n"), 0600))
+	healthy := openTestDB(t, dir)
+	defer func() {
+		require.NoError(t, healthy.Close())
+	}()
+	p, err := replication.NewPeerServer(healthy, []byte("secret"))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = p.Serve(l)
+	}()
+	defer func() {
+		require.NoError(t, p.Close())
+	}()
+	target := t.TempDir()
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"rebuild", "-dir", target, "-shards", "2", "-cluster", "1",
+		"-node", "1", "-peer", l.Addr().String(), "-secret-file", secretFile}, out))
+	require.Contains(t, out.String(), "51 entries [50, 100]")
+	require.Equal(t, uint64(50), firstIndex(t, target, nodeID{clusterID: 1, nodeID: 1}))
+	require.Error(t, run([]string{"rebuild", "-dir", target, "-shards", "2", "-cluster", "1",
+		"-node", "1", "-peer", l.Addr().String(), "-secret-file", secretFile}, out))
+}
+
+func TestGoldenGeneratesCheckableDB(t *testing.T) {
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	require.NoError(t, run([]string{"golden", "-out", dir}, out))
+	target := filepath.Join(dir, pebble.CurrentGoldenFormat().Name())
+	require.Contains(t, out.String(), target)
+	db, err := pebble.NewLogDB(pebble.GetGoldenLogDBConfig(vfs.Default),
+		nil, []string{target}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, pebble.CheckGoldenData(db))
+	require.NoError(t, db.Close())
+	require.Error(t, run([]string{"golden", "-out", dir}, out))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/pkg/errors"
+)
+
+// nodeListing is the per node information printed by the list-nodes command.
+type nodeListing struct {
+	ClusterID       uint64
+	NodeID          uint64
+	FirstIndex      uint64
+	LastIndex       uint64
+	LastTerm        uint64
+	SnapshotIndex   uint64
+	ApproximateSize uint64
+}
+
+var nodeListingOrders = map[string]func(a, b nodeListing) bool{
+	"cluster": func(a, b nodeListing) bool {
+		if a.ClusterID != b.ClusterID {
+			return a.ClusterID < b.ClusterID
+		}
+		return a.NodeID < b.NodeID
+	},
+	"first":    func(a, b nodeListing) bool { return a.FirstIndex < b.FirstIndex },
+	"last":     func(a, b nodeListing) bool { return a.LastIndex < b.LastIndex },
+	"snapshot": func(a, b nodeListing) bool { return a.SnapshotIndex < b.SnapshotIndex },
+	"size":     func(a, b nodeListing) bool { return a.ApproximateSize > b.ApproximateSize },
+}
+
+func runListNodes(args []string, out io.Writer) (err error) {
+	f := &dbFlags{}
+	var clusterID uint64
+	var order string
+	var asJSON bool
+	fs := flag.NewFlagSet("list-nodes", flag.ContinueOnError)
+	f.register(fs)
+	fs.Uint64Var(&clusterID, "cluster", 0, "only list nodes of the specified cluster")
+	fs.StringVar(&order, "sort", "cluster", "sort by cluster, first, last, snapshot or size")
+	fs.BoolVar(&asJSON, "json", false, "print the node list in JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	less, ok := nodeListingOrders[order]
+	if !ok {
+		return errors.Errorf("unknown sort order %q", order)
+	}
+	db, err := f.openReadOnly()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	details, err := db.ListNodeDetails()
+	if err != nil {
+		return err
+	}
+	nodes := make([]nodeListing, 0, len(details))
+	for _, d := range details {
+		if clusterID != 0 && d.ClusterID != clusterID {
+			continue
+		}
+		nodes = append(nodes, getNodeListing(d))
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return less(nodes[i], nodes[j])
+	})
+	if asJSON {
+		return printJSON(out, nodes)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "cluster\tnode\tfirst\tlast\tterm\tsnapshot\tsize\t")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", n.ClusterID, n.NodeID,
+			n.FirstIndex, n.LastIndex, n.LastTerm, n.SnapshotIndex, n.ApproximateSize)
+	}
+	return w.Flush()
+}
+
+func getNodeListing(d pebble.NodeDetails) nodeListing {
+	return nodeListing{
+		ClusterID:       d.ClusterID,
+		NodeID:          d.NodeID,
+		FirstIndex:      d.FirstIndex,
+		LastIndex:       d.LastIndex,
+		LastTerm:        d.LastTerm,
+		SnapshotIndex:   d.SnapshotIndex,
+		ApproximateSize: d.EntryBytes,
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/coufalja/tugboat-logdb/replication"
+	"github.com/pkg/errors"
+)
+
+func runRebuild(args []string, out io.Writer) (err error) {
+	f := &dbFlags{}
+	n := nodeID{}
+	var peer, secretFile string
+	var batchSize uint64
+	fs := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	f.register(fs)
+	fs.Uint64Var(&n.clusterID, "cluster", 0, "cluster ID of the node to rebuild")
+	fs.Uint64Var(&n.nodeID, "node", 0, "node ID of the node to rebuild")
+	fs.StringVar(&peer, "peer", "", "address of the peer serving the node data")
+	fs.StringVar(&secretFile, "secret-file", "", "file containing the secret shared with the peer")
+	fs.Uint64Var(&batchSize, "batch-size", 4*1024*1024, "max size in bytes of entries fetched at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if n.clusterID == 0 || n.nodeID == 0 {
+		return errors.New("both -cluster and -node must be specified")
+	}
+	if len(peer) == 0 || len(secretFile) == 0 {
+		return errors.New("both -peer and -secret-file must be specified")
+	}
+	secret, err := os.ReadFile(secretFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	db, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	nc, err := net.Dial("tcp", peer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if cerr := nc.Close(); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	report, err := replication.RebuildFromPeer(db, nc,
+		bytes.TrimSpace(secret), n.clusterID, n.nodeID, batchSize)
+	if err != nil {
+		return errors.Wrapf(err, "rebuild %s", n)
+	}
+	fmt.Fprintf(out, "rebuild %s: %d entries [%d, %d], snapshot index %d, done\n",
+		n, report.Entries, report.FirstIndex, report.LastIndex, report.SnapshotIndex)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+)
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runStats(args []string, out io.Writer) (err error) {
+	f := &dbFlags{}
+	var asJSON bool
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	f.register(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the statistics in JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openReadOnly()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(out, stats)
+	}
+	printShardStats(out, stats.Shards)
+	fmt.Fprintln(out)
+	printNodeStats(out, stats.Nodes)
+	return nil
+}
+
+func hitRate(c pebble.CacheStats) float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return 100 * float64(c.Hits) / float64(c.Hits+c.Misses)
+}
+
+func printShardStats(out io.Writer, shards []pebble.ShardStats) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "shard\tdisk\tmemtable\twal\tl0 files\tread amp\tcompactions\tdebt\tflushes\tblock cache\thit rate\t")
+	for _, s := range shards {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t\n",
+			s.Shard, s.DiskSpaceUsage, s.MemTableSize, s.WALSize, s.L0Files,
+			s.ReadAmp, s.Compactions, s.CompactionDebt, s.Flushes,
+			s.BlockCache.Size, hitRate(s.BlockCache))
+	}
+	w.Flush()
+}
+
+func printNodeStats(out io.Writer, nodes []pebble.NodeStats) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "cluster\tnode\tshard\tentries\tbytes\tfirst\tlast\tmax index\tsnapshot\tsnapshot age\t")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n",
+			n.ClusterID, n.NodeID, n.Shard, n.Entries, n.EntryBytes, n.FirstIndex,
+			n.LastIndex, n.MaxIndex, n.SnapshotIndex, n.SnapshotAge)
+	}
+	w.Flush()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// errViolationsFound is returned by the verify command so logdbctl exits with
+// a non-zero status when the LogDB is corrupted.
+var errViolationsFound = errors.New("violations found")
+
+func runVerify(args []string, out io.Writer) (err error) {
+	f := &dbFlags{}
+	var asJSON bool
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	f.register(fs)
+	fs.BoolVar(&asJSON, "json", false, "print the report in JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := f.openReadOnly()
+	if err != nil {
+		return err
+	}
+	defer closeDB(db, &err)
+	report, err := db.Verify()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if err := printJSON(out, report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(out, "shards: %d, nodes: %d, records: %d, entries: %d\n",
+			report.Shards, report.Nodes, report.Records, report.Entries)
+		for _, v := range report.Violations {
+			fmt.Fprintf(out, "%s\n", v)
+		}
+	}
+	if !report.OK() {
+		return errors.Wrapf(errViolationsFound, "%d", len(report.Violations))
+	}
+	return nil
+}
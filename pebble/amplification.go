@@ -0,0 +1,111 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// ClusterAmplification is the write amplification estimate of a single
+// cluster as returned by ShardedDB.WriteAmplification.
+type ClusterAmplification struct {
+	ClusterID uint64
+	// LogicalBytes is the size of the entries and raft states saved for the
+	// cluster since the LogDB was opened.
+	LogicalBytes uint64
+	// PhysicalBytes is the size of the records of the cluster written to
+	// sstables by flushes and compactions since the LogDB was opened, as
+	// observed by the table property collector before compression. WAL writes
+	// are not included.
+	PhysicalBytes uint64
+	// Amplification is PhysicalBytes divided by LogicalBytes, it is 0 when no
+	// logical bytes were written.
+	Amplification float64
+}
+
+// writeAmp tracks the logical and the physical bytes written for each
+// cluster of a shard.
+type writeAmp struct {
+	mu       sync.Mutex
+	logical  map[uint64]uint64
+	physical map[uint64]uint64
+}
+
+func newWriteAmp() *writeAmp {
+	return &writeAmp{
+		logical:  make(map[uint64]uint64),
+		physical: make(map[uint64]uint64),
+	}
+}
+
+func (w *writeAmp) addLogical(clusterID uint64, n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logical[clusterID] += n
+}
+
+func (w *writeAmp) addPhysical(clusters map[uint64]uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for cid, n := range clusters {
+		w.physical[cid] += n
+	}
+}
+
+func (w *writeAmp) collect(result map[uint64]*ClusterAmplification) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	get := func(cid uint64) *ClusterAmplification {
+		a, ok := result[cid]
+		if !ok {
+			a = &ClusterAmplification{ClusterID: cid}
+			result[cid] = a
+		}
+		return a
+	}
+	for cid, n := range w.logical {
+		get(cid).LogicalBytes += n
+	}
+	for cid, n := range w.physical {
+		get(cid).PhysicalBytes += n
+	}
+}
+
+// keyClusterID returns the cluster ID of the specified key, false is returned
+// when the key contains no cluster ID.
+func keyClusterID(key []byte) (uint64, bool) {
+	if uint64(len(key)) < persistentStateKeySize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(key[4:]), true
+}
+
+// WriteAmplification returns the write amplification estimates of all
+// clusters with records written since the LogDB was opened, sorted by
+// cluster ID. Clusters with high amplification have workloads causing their
+// records to be rewritten by compactions more often than those of others,
+// e.g. due to frequent log trimming or large entries interleaved with small
+// ones. Only shards already opened are included.
+func (s *ShardedDB) WriteAmplification() []ClusterAmplification {
+	clusters := make(map[uint64]*ClusterAmplification)
+	for _, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		shard.kvs.amp.collect(clusters)
+		if shard.kvs.state != nil {
+			shard.kvs.state.amp.collect(clusters)
+		}
+	}
+	result := make([]ClusterAmplification, 0, len(clusters))
+	for _, a := range clusters {
+		if a.LogicalBytes > 0 {
+			a.Amplification = float64(a.PhysicalBytes) / float64(a.LogicalBytes)
+		}
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ClusterID < result[j].ClusterID
+	})
+	return result
+}
@@ -0,0 +1,39 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAmplificationIsTrackedPerCluster(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		require.Empty(t, sdb.WriteAmplification())
+		saveTestNode(t, sdb, 1, 2, 100)
+		saveTestNode(t, sdb, 3, 2, 10)
+		amp := sdb.WriteAmplification()
+		require.Len(t, amp, 2)
+		require.Equal(t, uint64(1), amp[0].ClusterID)
+		require.Equal(t, uint64(3), amp[1].ClusterID)
+		require.Greater(t, amp[0].LogicalBytes, amp[1].LogicalBytes)
+		require.Zero(t, amp[0].PhysicalBytes)
+		require.NoError(t, sdb.Flush())
+		flushed := sdb.WriteAmplification()
+		require.NotZero(t, flushed[0].PhysicalBytes)
+		require.NotZero(t, flushed[0].Amplification)
+		// overlapping sstables are rewritten by the compaction
+		saveTestNode(t, sdb, 1, 2, 100)
+		require.NoError(t, sdb.Flush())
+		flushed = sdb.WriteAmplification()
+		shard, err := sdb.shard(sdb.partitioner.GetPartitionID(1))
+		require.NoError(t, err)
+		require.NoError(t, shard.kvs.FullCompaction())
+		compacted := sdb.WriteAmplification()
+		require.Greater(t, compacted[0].PhysicalBytes, flushed[0].PhysicalBytes)
+		require.Equal(t, flushed[1].PhysicalBytes, compacted[1].PhysicalBytes)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
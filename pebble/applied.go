@@ -0,0 +1,88 @@
+package pebble
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// SaveAppliedIndex records the index of the last entry applied by the state
+// machine of the specified node, allowing the apply loop to be resumed after
+// restart without replaying entries from the snapshot index. The record is
+// written without syncing the WAL, it survives process crashes but the last
+// saved value can be lost on power failures, in which case an earlier applied
+// index is returned by GetAppliedIndex.
+func (s *ShardedDB) SaveAppliedIndex(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.saveAppliedIndex(clusterID, nodeID, index))
+}
+
+// GetAppliedIndex returns the applied index saved for the specified node. 0
+// is returned when no applied index has been saved, or when it is no longer
+// usable because entries following it have been removed or a snapshot has
+// been imported since.
+func (s *ShardedDB) GetAppliedIndex(clusterID uint64,
+	nodeID uint64) (uint64, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return 0, err
+	}
+	index, err := shard.getAppliedIndex(clusterID, nodeID)
+	return index, errors.WithStack(err)
+}
+
+func (r *db) saveAppliedIndex(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	k := newKey(maxKeySize, nil)
+	k.setAppliedIndexKey(clusterID, nodeID)
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, index)
+	return r.kvs.SaveValueNoSync(k.Key(), data)
+}
+
+func (r *db) getAppliedIndex(clusterID uint64, nodeID uint64) (uint64, error) {
+	k := newKey(maxKeySize, nil)
+	k.setAppliedIndexKey(clusterID, nodeID)
+	index := uint64(0)
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if len(data) != 8 {
+			return errors.Wrapf(ErrCorruptedRecord, "applied index size %d", len(data))
+		}
+		index = binary.BigEndian.Uint64(data)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+func (r *db) saveRemoveAppliedIndex(wb *pebbleWriteBatch,
+	clusterID uint64, nodeID uint64) {
+	k := newKey(maxKeySize, nil)
+	k.setAppliedIndexKey(clusterID, nodeID)
+	wb.Delete(k.Key())
+}
+
+// invalidateAppliedIndex removes the applied index of the specified node when
+// removing entries up to the specified index would leave a gap between the
+// applied index and the first remaining entry.
+func (r *db) invalidateAppliedIndex(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	applied, err := r.getAppliedIndex(clusterID, nodeID)
+	if err != nil {
+		return err
+	}
+	if applied == 0 || applied+1 >= index {
+		return nil
+	}
+	k := newKey(maxKeySize, nil)
+	k.setAppliedIndexKey(clusterID, nodeID)
+	return r.kvs.DeleteValue(k.Key())
+}
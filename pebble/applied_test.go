@@ -0,0 +1,58 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppliedIndexCanBeSavedAndRead(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		index, err := sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), index)
+		saveTestNode(t, sdb, 1, 2, 100)
+		require.NoError(t, sdb.SaveAppliedIndex(1, 2, 50))
+		index, err = sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(50), index)
+		// entry 51 is still available
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 51))
+		index, err = sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(50), index)
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 52))
+		index, err = sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), index)
+		require.NoError(t, sdb.SaveAppliedIndex(1, 2, 60))
+		require.NoError(t, db.RemoveNodeData(1, 2))
+		index, err = sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), index)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestAppliedIndexIsRemovedWhenSnapshotIsImported(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		require.NoError(t, sdb.SaveAppliedIndex(1, 2, 50))
+		ss := pb.Snapshot{
+			ClusterId: 1,
+			Index:     200,
+			Term:      2,
+			Type:      pb.RegularStateMachine,
+		}
+		require.NoError(t, db.ImportSnapshot(ss, 2))
+		index, err := sdb.GetAppliedIndex(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), index)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
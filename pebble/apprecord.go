@@ -0,0 +1,175 @@
+package pebble
+
+import (
+	"encoding/binary"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxAppKeySize is the max size of the key of an application record.
+	MaxAppKeySize = 1024
+	// MaxAppValueSize is the max size of the value of an application record.
+	MaxAppValueSize = 64 * 1024
+	// appRecordKeyPrefixSize is the size of the header and the cluster ID
+	// preceding the application key.
+	appRecordKeyPrefixSize = 12
+)
+
+// ErrInvalidAppRecord indicates that the application record has an empty key
+// or a key or value exceeding the max sizes.
+var ErrInvalidAppRecord = errors.New("invalid application record")
+
+// AppRecord is a key/value record stored by the application in the reserved
+// application keyspace of a cluster, e.g. node local metadata the
+// application would otherwise keep in a separate storage engine. Records
+// are kept in the shard of the cluster and are not removed together with
+// the data of its nodes. An empty Value removes the record.
+type AppRecord struct {
+	ClusterID uint64
+	Key       []byte
+	Value     []byte
+}
+
+func (r AppRecord) validate() error {
+	if len(r.Key) == 0 || len(r.Key) > MaxAppKeySize ||
+		len(r.Value) > MaxAppValueSize {
+		return errors.Wrapf(ErrInvalidAppRecord, "cluster %d, key size %d, value size %d",
+			r.ClusterID, len(r.Key), len(r.Value))
+	}
+	return nil
+}
+
+func appRecordKey(clusterID uint64, key []byte) []byte {
+	k := make([]byte, appRecordKeyPrefixSize+len(key))
+	k[0] = appRecordKeyHeader[0]
+	k[1] = appRecordKeyHeader[1]
+	binary.BigEndian.PutUint64(k[4:], clusterID)
+	copy(k[appRecordKeyPrefixSize:], key)
+	return k
+}
+
+// prefixEnd returns the smallest key greater than all keys with the
+// specified prefix, the prefix must contain a byte other than 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	panic("prefix has no end")
+}
+
+// SaveAppRecords saves the specified application records. Records placed in
+// the same shard are saved atomically, records of clusters placed in
+// different shards are not.
+func (s *ShardedDB) SaveAppRecords(records []AppRecord) error {
+	groups := make(map[uint64][]AppRecord)
+	for _, rec := range records {
+		if err := rec.validate(); err != nil {
+			return err
+		}
+		p := s.partitioner.GetPartitionID(rec.ClusterID)
+		groups[p] = append(groups[p], rec)
+	}
+	for p, recs := range groups {
+		shard, err := s.shard(p)
+		if err != nil {
+			return err
+		}
+		if err := shard.saveAppRecordsOnly(recs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// GetAppRecord returns the value of the specified application record, nil
+// is returned when there is no such record.
+func (s *ShardedDB) GetAppRecord(clusterID uint64, key []byte) ([]byte, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	var result []byte
+	if err := shard.kvs.GetValue(appRecordKey(clusterID, key),
+		func(data []byte) error {
+			if len(data) > 0 {
+				result = append([]byte(nil), data...)
+			}
+			return nil
+		}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// IterateAppRecords calls op with the application records of the specified
+// cluster with keys starting with prefix in key order, all records of the
+// cluster are iterated when prefix is empty. The iteration stops once op
+// returns false. The key and value slices are only valid within op.
+func (s *ShardedDB) IterateAppRecords(clusterID uint64, prefix []byte,
+	op func(key []byte, value []byte) (bool, error)) error {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	fk := appRecordKey(clusterID, prefix)
+	lk := prefixEnd(fk)
+	return errors.WithStack(shard.kvs.IterateValue(fk, lk, false,
+		func(key []byte, data []byte) (bool, error) {
+			return op(key[appRecordKeyPrefixSize:], data)
+		}))
+}
+
+// SaveRaftStateWithAppRecords is similar to SaveRaftStateCtx, but the
+// specified application records are saved in the same atomic write batch as
+// the raft state. All updates and records must belong to clusters placed in
+// the same shard.
+func (s *ShardedDB) SaveRaftStateWithAppRecords(updates []pb.Update,
+	records []AppRecord, ctx IContext) error {
+	if len(records) == 0 {
+		return s.SaveRaftStateCtx(updates, ctx)
+	}
+	p := s.partitioner.GetPartitionID(records[0].ClusterID)
+	for _, rec := range records {
+		if err := rec.validate(); err != nil {
+			return err
+		}
+		if s.partitioner.GetPartitionID(rec.ClusterID) != p {
+			return errors.Errorf("application record of cluster %d not in shard %d",
+				rec.ClusterID, p)
+		}
+	}
+	if len(updates) > 0 && s.getParititionID(updates) != p {
+		return errors.Errorf("updates and application records not in the same shard")
+	}
+	shard, err := s.shard(p)
+	if err != nil {
+		return err
+	}
+	saved, err := shard.saveRaftStateWithMetadata(updates, nil, records, ctx)
+	s.watches.committed(saved)
+	return errors.WithStack(err)
+}
+
+func (r *db) saveAppRecordsOnly(records []AppRecord) error {
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	r.saveAppRecords(wb, records)
+	return r.kvs.CommitWriteBatch(wb)
+}
+
+func (r *db) saveAppRecords(wb *pebbleWriteBatch, records []AppRecord) {
+	for _, rec := range records {
+		k := appRecordKey(rec.ClusterID, rec.Key)
+		if len(rec.Value) == 0 {
+			wb.Delete(k)
+		} else {
+			wb.Put(k, rec.Value)
+		}
+	}
+}
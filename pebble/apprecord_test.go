@@ -0,0 +1,73 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte{1, 3}, prefixEnd([]byte{1, 2}))
+	require.Equal(t, []byte{2}, prefixEnd([]byte{1, 0xff}))
+	require.Panics(t, func() { prefixEnd([]byte{0xff}) })
+}
+
+func TestAppRecords(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		require.NoError(t, sdb.SaveAppRecords([]AppRecord{
+			{ClusterID: 1, Key: []byte("a/1"), Value: []byte("v1")},
+			{ClusterID: 1, Key: []byte("a/2"), Value: []byte("v2")},
+			{ClusterID: 1, Key: []byte("b"), Value: []byte("v3")},
+			{ClusterID: 2, Key: []byte("a/1"), Value: []byte("other")},
+		}))
+		v, err := sdb.GetAppRecord(1, []byte("a/1"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v1"), v)
+		v, err = sdb.GetAppRecord(1, []byte("c"))
+		require.NoError(t, err)
+		require.Nil(t, v)
+		iterate := func(clusterID uint64, prefix string) []string {
+			keys := make([]string, 0)
+			require.NoError(t, sdb.IterateAppRecords(clusterID, []byte(prefix),
+				func(key []byte, value []byte) (bool, error) {
+					keys = append(keys, string(key)+"="+string(value))
+					return true, nil
+				}))
+			return keys
+		}
+		require.Equal(t, []string{"a/1=v1", "a/2=v2"}, iterate(1, "a/"))
+		require.Equal(t, []string{"a/1=v1", "a/2=v2", "b=v3"}, iterate(1, ""))
+		require.Equal(t, []string{"a/1=other"}, iterate(2, ""))
+		// records are saved together with the raft state
+		require.NoError(t, sdb.SaveBootstrapInfo(1, 2,
+			pb.Bootstrap{Join: true, Type: pb.RegularStateMachine}))
+		require.NoError(t, sdb.SaveRaftStateWithAppRecords([]pb.Update{{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 1, Vote: 2, Commit: 1},
+			EntriesToSave: []pb.Entry{{Index: 1, Term: 1}},
+		}}, []AppRecord{{ClusterID: 1, Key: []byte("b")}}, sdb.GetLogDBThreadContext()))
+		require.Equal(t, []string{"a/1=v1", "a/2=v2"}, iterate(1, ""))
+		rs, err := sdb.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), rs.EntryCount)
+		// application records are not reported as violations
+		report, err := sdb.Verify()
+		require.NoError(t, err)
+		require.Empty(t, report.Violations)
+		err = sdb.SaveAppRecords([]AppRecord{{ClusterID: 1}})
+		require.True(t, errors.Is(err, ErrInvalidAppRecord))
+		err = sdb.SaveAppRecords([]AppRecord{{
+			ClusterID: 1,
+			Key:       []byte("k"),
+			Value:     make([]byte, MaxAppValueSize+1),
+		}})
+		require.True(t, errors.Is(err, ErrInvalidAppRecord))
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
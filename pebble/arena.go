@@ -0,0 +1,211 @@
+package pebble
+
+import (
+	"sync"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// minEntryArenaChunk is the minimum size of payload chunks allocated by
+	// the EntryArena.
+	minEntryArenaChunk = 64 * 1024
+	// maxEntryArenaRetained is the max size of the payload chunk retained by
+	// the EntryArena across releases.
+	maxEntryArenaRetained = 64 * 1024 * 1024
+)
+
+// EntryArena is a reusable buffer holding the entry slice and the decoded
+// entry payloads returned by IterateEntriesWithArena. Entries returned
+// through the arena are only valid until Release is called, after which
+// both the slice and the payloads are reused by the next iteration. An
+// EntryArena is not safe for concurrent use.
+type EntryArena struct {
+	ents    []pb.Entry
+	buf     []byte
+	used    int
+	scratch []byte
+}
+
+var entryArenaPool = sync.Pool{
+	New: func() interface{} {
+		return NewEntryArena()
+	},
+}
+
+// NewEntryArena creates a new EntryArena instance.
+func NewEntryArena() *EntryArena {
+	return &EntryArena{}
+}
+
+// AcquireEntryArena returns an EntryArena from the package level pool, it
+// must be returned using Free once it is no longer required.
+func AcquireEntryArena() *EntryArena {
+	return entryArenaPool.Get().(*EntryArena)
+}
+
+// Free releases the arena and returns it to the package level pool, the
+// arena must not be used after Free returns.
+func (a *EntryArena) Free() {
+	a.Release()
+	entryArenaPool.Put(a)
+}
+
+// Release makes all entries previously returned through the arena invalid
+// so the arena can be reused.
+func (a *EntryArena) Release() {
+	for i := range a.ents {
+		a.ents[i] = pb.Entry{}
+	}
+	a.ents = a.ents[:0]
+	if a.used > cap(a.buf) && a.used <= maxEntryArenaRetained {
+		a.buf = make([]byte, 0, a.used)
+	} else {
+		a.buf = a.buf[:0]
+	}
+	a.used = 0
+}
+
+// entries returns an empty entry slice backed by the unused part of the
+// arena.
+func (a *EntryArena) entries() []pb.Entry {
+	return a.ents[len(a.ents):len(a.ents)]
+}
+
+// setEntries records the entry slice returned to the caller so its backing
+// array can be reused after Release.
+func (a *EntryArena) setEntries(ents []pb.Entry) {
+	if cap(ents) == cap(a.ents)-len(a.ents) {
+		a.ents = a.ents[:len(a.ents)+len(ents)]
+	} else {
+		a.ents = ents
+	}
+}
+
+func (a *EntryArena) alloc(sz int) []byte {
+	a.used += sz
+	if len(a.buf)+sz > cap(a.buf) {
+		// entries still refer to the current chunk, it is left to the GC
+		csz := 2 * cap(a.buf)
+		if csz < minEntryArenaChunk {
+			csz = minEntryArenaChunk
+		}
+		if csz < sz {
+			csz = sz
+		}
+		a.buf = make([]byte, 0, csz)
+	}
+	n := len(a.buf)
+	a.buf = a.buf[:n+sz]
+	return a.buf[n : n+sz : n+sz]
+}
+
+// decode decodes the entry in data, the payload of the entry is copied into
+// the arena. It is equivalent to unmarshal when the arena is nil.
+func (a *EntryArena) decode(e *pb.Entry, data []byte) error {
+	if a == nil {
+		return unmarshal(e, data)
+	}
+	offset, start, end, ok := locateEntryCmd(data)
+	if !ok {
+		return unmarshal(e, data)
+	}
+	// the payload is the last field of the record, the remaining fields are
+	// decoded from a copy of the record with the payload dropped
+	a.scratch = append(a.scratch[:0], data[:offset]...)
+	a.scratch = append(a.scratch, colferEnd)
+	if err := unmarshal(e, a.scratch); err != nil {
+		return err
+	}
+	if start < end {
+		e.Cmd = a.alloc(end - start)
+		copy(e.Cmd, data[start:end])
+	}
+	return nil
+}
+
+const (
+	colferEnd        = 0x7f
+	colferFlag       = 0x80
+	entryTypeField   = 2
+	entryCmdField    = 7
+	maxVarintFields  = 9
+	fixedUint64Bytes = 8
+)
+
+// locateEntryCmd returns the offset of the Cmd field in the Colfer encoded
+// entry together with the range of its payload. The offset of the end marker
+// is returned when there is no Cmd field. ok is false when the record does
+// not have the expected layout.
+func locateEntryCmd(data []byte) (offset int, start int, end int, ok bool) {
+	i := 0
+	for i < len(data) {
+		h := data[i]
+		if h == colferEnd {
+			return i, 0, 0, i == len(data)-1
+		}
+		field := h &^ colferFlag
+		if h == entryCmdField {
+			sz, n := readVarint(data[i+1:])
+			if n == 0 {
+				return 0, 0, 0, false
+			}
+			start = i + 1 + n
+			end = start + int(sz)
+			if sz > uint64(len(data)) || end != len(data)-1 ||
+				data[end] != colferEnd {
+				return 0, 0, 0, false
+			}
+			return i, start, end, true
+		}
+		if field >= entryCmdField {
+			return 0, 0, 0, false
+		}
+		i++
+		if h&colferFlag != 0 && field != entryTypeField {
+			i += fixedUint64Bytes
+			continue
+		}
+		_, n := readVarint(data[i:])
+		if n == 0 {
+			return 0, 0, 0, false
+		}
+		i += n
+	}
+	return 0, 0, 0, false
+}
+
+// readVarint reads a Colfer varint, it returns the number of bytes read or 0
+// when data is truncated.
+func readVarint(data []byte) (uint64, int) {
+	x := uint64(0)
+	for i := 0; i < len(data) && i < maxVarintFields; i++ {
+		b := uint64(data[i])
+		if b < 0x80 || i == maxVarintFields-1 {
+			return x | b<<(7*uint(i)), i + 1
+		}
+		x |= (b & 0x7f) << (7 * uint(i))
+	}
+	return 0, 0
+}
+
+// IterateEntriesWithArena is similar to IterateEntries, but the returned
+// entry slice and the payloads of the returned entries are allocated from
+// the specified arena. The returned entries are only valid until the arena is
+// released.
+func (s *ShardedDB) IterateEntriesWithArena(arena *EntryArena,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, 0, err
+	}
+	ents, sz, err := shard.iterateEntries(arena, arena.entries(),
+		size, clusterID, nodeID, low, high, maxSize)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	arena.setEntries(ents)
+	return ents, sz, nil
+}
@@ -0,0 +1,69 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryArenaDecode(t *testing.T) {
+	entries := []pb.Entry{
+		{},
+		{Index: 1, Term: 1},
+		{Index: 2, Term: 1, Cmd: []byte("test-data")},
+		{Index: math.MaxUint64, Term: math.MaxUint64, Type: pb.ConfigChangeEntry,
+			Key: 100, ClientID: math.MaxUint64, SeriesID: 200, RespondedTo: 300,
+			Cmd: make([]byte, 1024*1024)},
+		{Index: 1 << 40, Term: 1 << 20, Type: pb.EncodedEntry, Cmd: []byte{0x7f}},
+	}
+	arena := NewEntryArena()
+	for _, e := range entries {
+		data := pb.MustMarshal(&e)
+		var expected pb.Entry
+		require.NoError(t, unmarshal(&expected, data))
+		var decoded pb.Entry
+		require.NoError(t, arena.decode(&decoded, data))
+		require.Equal(t, expected, decoded)
+		_, _, _, ok := locateEntryCmd(data)
+		require.True(t, ok)
+	}
+	var e pb.Entry
+	require.Error(t, arena.decode(&e, []byte{0x1}))
+}
+
+func TestEntriesCanBeIteratedWithArena(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		ents := make([]pb.Entry, 0)
+		for i := uint64(1); i <= 20; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, i)})
+		}
+		require.NoError(t, db.SaveRaftState([]pb.Update{{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 1, Commit: 20},
+			EntriesToSave: ents,
+		}}, 1))
+		expected, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 21, math.MaxUint64)
+		require.NoError(t, err)
+		arena := sdb.GetLogDBThreadContext().GetEntryArena()
+		first, _, err := sdb.IterateEntriesWithArena(arena, 0, 1, 2, 1, 11, math.MaxUint64)
+		require.NoError(t, err)
+		second, _, err := sdb.IterateEntriesWithArena(arena, 0, 1, 2, 11, 21, math.MaxUint64)
+		require.NoError(t, err)
+		require.Equal(t, expected, append(append([]pb.Entry{}, first...), second...))
+		single, _, err := sdb.IterateEntriesWithArena(arena, 0, 1, 2, 5, 6, math.MaxUint64)
+		require.NoError(t, err)
+		require.Equal(t, expected[4:5], single)
+		require.Equal(t, expected[:10], first)
+		arena.Release()
+		result, _, err := sdb.IterateEntriesWithArena(arena, 0, 1, 2, 1, 21, math.MaxUint64)
+		require.NoError(t, err)
+		require.Equal(t, expected, result)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
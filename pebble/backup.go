@@ -0,0 +1,293 @@
+package pebble
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	backupManifestFilename        = "BACKUP"
+	backupManifestVersion  uint32 = 1
+)
+
+// ErrInvalidBackup indicates that the backup directory content doesn't match
+// its manifest.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupFile describes a single file included in a backup.
+type BackupFile struct {
+	// Name is the path of the file relative to the backup directory.
+	Name string
+	Size int64
+}
+
+// BackupManifest describes the content of a LogDB backup created by the
+// ShardedDB.Backup method.
+type BackupManifest struct {
+	Version      uint32
+	Shards       uint64
+	BinaryFormat uint32
+	Nodes        []raftio.NodeInfo
+	Files        []BackupFile
+	// Sequences are the sequence numbers of the first write batch of each
+	// shard not included in the backup, they are only recorded when log
+	// shipping is enabled.
+	Sequences []uint64 `json:",omitempty"`
+}
+
+func isWALFile(name string) bool {
+	return strings.HasSuffix(name, ".log")
+}
+
+// Backup creates a consistent point in time copy of all shards in the
+// specified directory, which must not exist yet. Files are hard linked where
+// possible. The returned manifest is also saved into the backup directory.
+func (s *ShardedDB) Backup(dir string) (BackupManifest, error) {
+	if s.hasSegmentedEntries() {
+		return BackupManifest{}, errors.WithStack(ErrSegmentedEntries)
+	}
+	fs := s.config.FS
+	if _, err := fs.Stat(dir); err == nil {
+		return BackupManifest{}, errors.Errorf("backup dir %s already exist", dir)
+	}
+	nodes, err := s.ListNodeInfo()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return BackupManifest{}, err
+	}
+	m := BackupManifest{
+		Version:      backupManifestVersion,
+		Shards:       s.config.Shards,
+		BinaryFormat: s.BinaryFormat(),
+		Nodes:        nodes,
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	for i, shard := range shards {
+		name := shardDirName(uint64(i))
+		target := fs.PathJoin(dir, name)
+		seq, err := shard.kvs.checkpoint(target)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if shard.kvs.shipper != nil {
+			m.Sequences = append(m.Sequences, seq)
+		}
+		files, err := listBackupFiles(fs, dir, name)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		m.Files = append(m.Files, files...)
+	}
+	if err := saveBackupManifest(dir, m, fs); err != nil {
+		return BackupManifest{}, err
+	}
+	return m, nil
+}
+
+func listBackupFiles(fs vfs.FS, dir string, name string) ([]BackupFile, error) {
+	names, err := fs.List(fs.PathJoin(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	files := make([]BackupFile, 0, len(names))
+	for _, n := range names {
+		fi, err := fs.Stat(fs.PathJoin(dir, name, n))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, BackupFile{Name: name + "/" + n, Size: fi.Size()})
+	}
+	return files, nil
+}
+
+func saveBackupManifest(dir string, m BackupManifest, fs vfs.FS) (err error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := fs.Create(fs.PathJoin(dir, backupManifestFilename))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// ReadBackupManifest reads the manifest of the backup in the specified
+// directory.
+func ReadBackupManifest(dir string, fs vfs.FS) (m BackupManifest, err error) {
+	f, err := fs.Open(fs.PathJoin(dir, backupManifestFilename))
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return BackupManifest{}, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return BackupManifest{}, errors.Wrapf(ErrInvalidBackup, "%v", err)
+	}
+	if m.Version != backupManifestVersion {
+		return BackupManifest{}, errors.Wrapf(ErrInvalidBackup,
+			"unsupported manifest version %d", m.Version)
+	}
+	return m, nil
+}
+
+// VerifyBackup checks that all files listed in the manifest of the specified
+// backup are present with the expected size.
+func VerifyBackup(dir string, fs vfs.FS) (BackupManifest, error) {
+	m, err := ReadBackupManifest(dir, fs)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	for _, f := range m.Files {
+		fi, err := fs.Stat(fs.PathJoin(dir, f.Name))
+		if err != nil {
+			return BackupManifest{}, errors.Wrapf(ErrInvalidBackup, "%s: %v", f.Name, err)
+		}
+		if fi.Size() != f.Size {
+			return BackupManifest{}, errors.Wrapf(ErrInvalidBackup,
+				"%s: size %d, expected %d", f.Name, fi.Size(), f.Size)
+		}
+	}
+	return m, nil
+}
+
+// RestoreBackup restores the backup found in backupDir into the specified
+// LogDB directories, dirs and lldirs have the same meaning as in NewLogDB.
+// The shard directories to be restored must not exist yet. WAL files are
+// placed into the low latency dirs when specified.
+func RestoreBackup(config LogDBConfig,
+	backupDir string, dirs []string, lldirs []string) error {
+	fs := config.FS
+	m, err := VerifyBackup(backupDir, fs)
+	if err != nil {
+		return err
+	}
+	if m.Shards != config.Shards {
+		return errors.Errorf("backup has %d shards, but configured to have %d",
+			m.Shards, config.Shards)
+	}
+	dirs, lldirs = expandDirs(config.Shards, dirs, lldirs)
+	targets := func(i uint64) (string, string) {
+		return restoreTarget(config, dirs, lldirs, i)
+	}
+	for i := uint64(0); i < m.Shards; i++ {
+		dir, walDir := targets(i)
+		for _, d := range []string{dir, walDir} {
+			if _, err := fs.Stat(d); err == nil {
+				return errors.Errorf("restore target %s already exist", d)
+			}
+		}
+	}
+	for i := uint64(0); i < m.Shards; i++ {
+		dir, walDir := targets(i)
+		src := fs.PathJoin(backupDir, shardDirName(i))
+		if err := restoreShard(fs, src, dir, walDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreTarget returns the shard and WAL dirs of the specified shard, dirs
+// and lldirs are expected to be expanded.
+func restoreTarget(config LogDBConfig,
+	dirs []string, lldirs []string, shard uint64) (string, string) {
+	fs := config.FS
+	dir := fs.PathJoin(dirs[shard], shardDirName(shard))
+	if len(lldirs) > 0 {
+		return dir, fs.PathJoin(lldirs[shard], shardDirName(shard))
+	}
+	return dir, dir
+}
+
+func restoreShard(fs vfs.FS, src string, dir string, walDir string) error {
+	for _, d := range []string{dir, walDir} {
+		if err := fileutil.MkdirAll(d, fs); err != nil {
+			return err
+		}
+	}
+	names, err := fs.List(src)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		target := dir
+		if isWALFile(n) {
+			target = walDir
+		}
+		if err := vfs.Copy(fs, fs.PathJoin(src, n), fs.PathJoin(target, n)); err != nil {
+			return err
+		}
+	}
+	if err := fileutil.SyncDir(walDir, fs); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// VerifyRestore opens the LogDB restored from a backup with the specified
+// manifest and checks that all nodes recorded in the manifest are accessible.
+func VerifyRestore(config LogDBConfig,
+	dirs []string, lldirs []string, m BackupManifest) (err error) {
+	db, err := NewLogDB(config, nil, dirs, lldirs, CheckNone)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, db.Close())
+	}()
+	if db.BinaryFormat() != m.BinaryFormat {
+		return errors.Errorf("binary format %d, expected %d",
+			db.BinaryFormat(), m.BinaryFormat)
+	}
+	nodes, err := db.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	found := make(map[raftio.NodeInfo]struct{})
+	for _, n := range nodes {
+		found[n] = struct{}{}
+	}
+	for _, n := range m.Nodes {
+		if _, ok := found[n]; !ok {
+			return errors.Errorf("%s not found in restored LogDB",
+				dn(n.ClusterID, n.NodeID))
+		}
+		ss, err := db.GetSnapshot(n.ClusterID, n.NodeID)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ReadRaftState(n.ClusterID,
+			n.NodeID, ss.Index); err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+			return err
+		}
+	}
+	return nil
+}
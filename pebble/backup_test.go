@@ -0,0 +1,91 @@
+package pebble
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func saveTestNode(t *testing.T, db *ShardedDB, clusterID uint64, nodeID uint64, count uint64) {
+	require.NoError(t, db.SaveBootstrapInfo(clusterID, nodeID, pb.Bootstrap{Join: true}))
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= count; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 16)})
+	}
+	ud := pb.Update{
+		ClusterID:     clusterID,
+		NodeID:        nodeID,
+		State:         pb.State{Term: 1, Vote: 2, Commit: count},
+		EntriesToSave: ents,
+	}
+	require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+}
+
+func TestBackupCanBeRestored(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	backupDir := fs.PathJoin(RDBTestDirectory, "backup")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 3, 4, 20)
+	m, err := db.Backup(backupDir)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Equal(t, cfg.Shards, m.Shards)
+	require.Len(t, m.Nodes, 2)
+	_, err = VerifyBackup(backupDir, fs)
+	require.NoError(t, err)
+
+	rdir := fs.PathJoin(RDBTestDirectory, "restored")
+	rlldir := fs.PathJoin(RDBTestDirectory, "restored-wal")
+	require.NoError(t, RestoreBackup(cfg, backupDir, []string{rdir}, []string{rlldir}))
+	require.Error(t, RestoreBackup(cfg, backupDir, []string{rdir}, []string{rlldir}))
+	require.NoError(t, VerifyRestore(cfg, []string{rdir}, []string{rlldir}, m))
+	rdb, err := NewLogDB(cfg, nil, []string{rdir}, []string{rlldir}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, rdb.Close())
+	}()
+	rs, err := rdb.ReadRaftState(3, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), rs.EntryCount)
+	require.Equal(t, uint64(2), rs.State.Vote)
+}
+
+func TestBackupDirMustNotExist(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		fs := db.(*ShardedDB).config.FS
+		dir := fs.PathJoin(RDBTestDirectory, "backup")
+		require.NoError(t, fs.MkdirAll(dir, 0o755))
+		_, err := db.(*ShardedDB).Backup(dir)
+		require.Error(t, err)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestVerifyBackupDetectsMissingFiles(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		fs := sdb.config.FS
+		saveTestNode(t, sdb, 1, 2, 10)
+		dir := fs.PathJoin(RDBTestDirectory, "backup")
+		m, err := sdb.Backup(dir)
+		require.NoError(t, err)
+		require.NotEmpty(t, m.Files)
+		require.NoError(t, fs.Remove(fs.PathJoin(dir, m.Files[0].Name)))
+		_, err = VerifyBackup(dir, fs)
+		require.True(t, errors.Is(err, ErrInvalidBackup))
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,26 @@
+package pebble
+
+import (
+	"github.com/pkg/errors"
+)
+
+// CompactionBandwidth returns the current limit of the bytes written by
+// compactions per second, 0 is returned when compactions are not limited.
+func (s *ShardedDB) CompactionBandwidth() uint64 {
+	if s.compactionLimiter == nil {
+		return 0
+	}
+	return s.compactionLimiter.Rate()
+}
+
+// SetCompactionBandwidth changes the limit of the bytes written per second by
+// compactions of all shards, compactions are no longer limited when it is 0.
+// The limit can only be changed when the LogDB was opened with a non-zero
+// LogDBConfig.CompactionBandwidth.
+func (s *ShardedDB) SetCompactionBandwidth(bytesPerSecond uint64) error {
+	if s.compactionLimiter == nil {
+		return errors.New("compaction bandwidth limit not enabled")
+	}
+	s.compactionLimiter.SetRate(bytesPerSecond)
+	return nil
+}
@@ -0,0 +1,57 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionBandwidthRequiresLimitAtOpen(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		require.Zero(t, sdb.CompactionBandwidth())
+		require.Error(t, sdb.SetCompactionBandwidth(1024))
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestCompactionBandwidthLimitsCompactions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	cfg.CompactionBandwidth = 1 << 30
+	dirs := []string{RDBTestDirectory}
+	db, err := OpenShardedDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Equal(t, uint64(1<<30), db.CompactionBandwidth())
+	saveTestNode(t, db, 1, 2, 500)
+	require.NoError(t, db.Flush())
+	saveTestNode(t, db, 1, 2, 500)
+	require.NoError(t, db.Flush())
+	shard, err := db.shard(0)
+	require.NoError(t, err)
+	// the compaction output is about half of the flushed sstables as all
+	// entries were saved twice, it takes about two seconds to write
+	tables := uint64(shard.kvs.db.Metrics().Levels[0].Size)
+	rate := tables / 6
+	require.NoError(t, db.SetCompactionBandwidth(rate))
+	require.Equal(t, rate, db.CompactionBandwidth())
+	start := time.Now()
+	require.NoError(t, shard.kvs.FullCompaction())
+	elapsed := time.Since(start)
+	written := shard.kvs.event.engine.getStats().CompactionBytes
+	require.Greater(t, written, 2*rate)
+	expected := float64(written-rate) / float64(rate) * float64(time.Second)
+	require.GreaterOrEqual(t, elapsed, time.Duration(expected*0.8))
+	require.Empty(t, shard.kvs.event.engine.compacting)
+}
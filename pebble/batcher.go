@@ -0,0 +1,112 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+)
+
+// CommitStats contains the statistics of the commit window of a shard.
+type CommitStats struct {
+	// Commits is the number of commits made to the storage engine.
+	Commits uint64
+	// Batches is the number of write batches committed, a commit includes
+	// one or more write batches merged during the commit window.
+	Batches uint64
+	// MaxBatches is the max number of write batches merged into one commit.
+	MaxBatches uint64
+}
+
+type commitRequest struct {
+	wb   *pebbleWriteBatch
+	err  error
+	done chan struct{}
+}
+
+// batcher merges write batches committed concurrently on the same shard into
+// a single commit. The first write batch of a group waits for up to the
+// commit window or until maxBatches write batches have been submitted, the
+// whole group is then committed together.
+type batcher struct {
+	kvs        *KV
+	shard      uint64
+	window     time.Duration
+	maxBatches int
+	mu         sync.Mutex
+	pending    []*commitRequest
+	full       chan struct{}
+	stats      CommitStats
+}
+
+func newBatcher(kvs *KV, window time.Duration, maxBatches uint64) *batcher {
+	return &batcher{
+		kvs:        kvs,
+		window:     window,
+		maxBatches: int(maxBatches),
+	}
+}
+
+func (b *batcher) commit(wb *pebbleWriteBatch) error {
+	if err := b.kvs.gate.enter(); err != nil {
+		return err
+	}
+	defer b.kvs.gate.exit()
+	req := &commitRequest{wb: wb}
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) > 1 {
+		req.done = make(chan struct{})
+		if len(b.pending) == b.maxBatches {
+			close(b.full)
+		}
+		b.mu.Unlock()
+		<-req.done
+		return req.err
+	}
+	full := make(chan struct{})
+	b.full = full
+	b.mu.Unlock()
+	if b.maxBatches != 1 {
+		timer := time.NewTimer(b.window)
+		select {
+		case <-timer.C:
+		case <-full:
+		}
+		timer.Stop()
+	}
+	b.mu.Lock()
+	reqs := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	var err error
+	withShardLabels("committer", b.shard, func() {
+		err = b.commitGroup(reqs)
+	})
+	for _, r := range reqs[1:] {
+		r.err = err
+		close(r.done)
+	}
+	return err
+}
+
+func (b *batcher) commitGroup(reqs []*commitRequest) error {
+	wb := reqs[0].wb
+	for _, r := range reqs[1:] {
+		if err := wb.merge(r.wb); err != nil {
+			return err
+		}
+	}
+	b.mu.Lock()
+	b.stats.Commits++
+	b.stats.Batches += uint64(len(reqs))
+	if uint64(len(reqs)) > b.stats.MaxBatches {
+		b.stats.MaxBatches = uint64(len(reqs))
+	}
+	b.mu.Unlock()
+	return b.kvs.commitWriteBatch(wb)
+}
+
+func (b *batcher) getStats() CommitStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
@@ -0,0 +1,57 @@
+package pebble
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentUpdatesAreCommittedTogether(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		p := sdb.partitioner.GetPartitionID(1)
+		shard := sdb.shards[p]
+		shard.batcher = newBatcher(shard.kvs, time.Hour, 4)
+		var wg sync.WaitGroup
+		for nid := uint64(1); nid <= 4; nid++ {
+			wg.Add(1)
+			go func(nid uint64) {
+				defer wg.Done()
+				ents := []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}
+				ud := pb.Update{
+					ClusterID:     1,
+					NodeID:        nid,
+					State:         pb.State{Term: 1, Vote: nid, Commit: 2},
+					EntriesToSave: ents,
+				}
+				require.NoError(t, sdb.SaveRaftStateCtx([]pb.Update{ud},
+					sdb.GetLogDBThreadContext()))
+			}(nid)
+		}
+		wg.Wait()
+		for nid := uint64(1); nid <= 4; nid++ {
+			rs, err := db.ReadRaftState(1, nid, 0)
+			require.NoError(t, err)
+			require.Equal(t, nid, rs.State.Vote)
+			require.Equal(t, uint64(2), rs.EntryCount)
+			ents, _, err := db.IterateEntries(nil, 0, 1, nid, 1, 3, math.MaxUint64)
+			require.NoError(t, err)
+			require.Len(t, ents, 2)
+		}
+		st, err := sdb.Stats()
+		require.NoError(t, err)
+		require.Equal(t, &CommitStats{Commits: 1, Batches: 4, MaxBatches: 4},
+			st.Shards[p].Commits)
+		require.Nil(t, st.Shards[(p+1)%uint64(len(st.Shards))].Commits)
+		shard.batcher.window = time.Millisecond
+		saveTestNode(t, sdb, 1, 5, 10)
+		require.Equal(t, uint64(2), shard.batcher.getStats().Commits)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
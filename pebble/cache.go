@@ -16,6 +16,7 @@ package pebble
 
 import (
 	"sync"
+	"time"
 
 	"github.com/coufalja/tugboat/raftio"
 	pb "github.com/coufalja/tugboat/raftpb"
@@ -27,6 +28,8 @@ type cache struct {
 	lastEntryBatch map[raftio.NodeInfo]pb.EntryBatch
 	maxIndex       map[raftio.NodeInfo]uint64
 	snapshotIndex  map[raftio.NodeInfo]uint64
+	lastWrite      map[raftio.NodeInfo]time.Time
+	sparse         map[raftio.NodeInfo]*sparseIndex
 	mu             sync.Mutex
 }
 
@@ -37,6 +40,8 @@ func newCache() *cache {
 		lastEntryBatch: make(map[raftio.NodeInfo]pb.EntryBatch),
 		maxIndex:       make(map[raftio.NodeInfo]uint64),
 		snapshotIndex:  make(map[raftio.NodeInfo]uint64),
+		lastWrite:      make(map[raftio.NodeInfo]time.Time),
+		sparse:         make(map[raftio.NodeInfo]*sparseIndex),
 	}
 }
 
@@ -105,6 +110,20 @@ func (r *cache) getMaxIndex(clusterID uint64, nodeID uint64) (uint64, bool) {
 	return v, true
 }
 
+func (r *cache) setLastWrite(clusterID uint64, nodeID uint64, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	r.lastWrite[key] = t
+}
+
+func (r *cache) getLastWrite(clusterID uint64, nodeID uint64) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	return r.lastWrite[key]
+}
+
 func (r *cache) setLastBatch(clusterID uint64,
 	nodeID uint64, eb pb.EntryBatch) {
 	r.mu.Lock()
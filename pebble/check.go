@@ -0,0 +1,93 @@
+package pebble
+
+import "time"
+
+// CheckLevel is the level of the checks performed by NewLogDB and
+// OpenShardedDB once the shards are opened.
+type CheckLevel int
+
+const (
+	// CheckNone opens the LogDB without checking its records.
+	CheckNone CheckLevel = iota
+	// CheckQuick decodes all records other than entries, i.e. raft states,
+	// max indexes, snapshots, bootstrap and other metadata records, and
+	// checks the invariants between them. Its cost depends on the number of
+	// nodes rather than on the number of entries.
+	CheckQuick
+	// CheckFull decodes all records including entries and checks all
+	// invariants, as done by ShardedDB.Verify. CheckQuick is performed
+	// instead when entries are kept in segments, see
+	// LogDBConfig.SegmentedEntries, the level performed is reported by
+	// CheckReport.
+	CheckFull
+)
+
+var checkLevelNames = [...]string{
+	CheckNone:  "none",
+	CheckQuick: "quick",
+	CheckFull:  "full",
+}
+
+func (l CheckLevel) String() string {
+	if l < 0 || int(l) >= len(checkLevelNames) {
+		return "unknown"
+	}
+	return checkLevelNames[l]
+}
+
+// CheckReport describes the checks performed when the LogDB was opened, Level
+// is the level performed, which might be lower than the one requested. The
+// embedded VerifyReport contains the number of checked shards, nodes,
+// records and entries together with the violations found. Only the shards
+// opened by OpenShardedDB are checked, see LogDBConfig.OpenClusters.
+type CheckReport struct {
+	Level CheckLevel
+	VerifyReport
+	Duration time.Duration
+}
+
+// CheckReport returns the report of the checks performed when the LogDB was
+// opened, its level is CheckNone when no check was requested.
+func (s *ShardedDB) CheckReport() CheckReport {
+	return s.check
+}
+
+// startupCheck checks the opened shards at the specified level, violations
+// are logged and reported by CheckReport, only failures to read the shards
+// are returned.
+func (s *ShardedDB) startupCheck(level CheckLevel) error {
+	if level == CheckFull && s.hasSegmentedEntries() {
+		plog.Infof("entries kept in segments, performing %s check instead of %s",
+			CheckQuick, CheckFull)
+		level = CheckQuick
+	}
+	s.check = CheckReport{Level: level}
+	if level == CheckNone {
+		return nil
+	}
+	start := time.Now()
+	report := &s.check.VerifyReport
+	for i, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		report.Shards++
+		var err error
+		if level == CheckFull {
+			err = shard.verify(uint64(i), report)
+		} else {
+			err = shard.verifyMetadata(uint64(i), report)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.check.Duration = time.Since(start)
+	for _, v := range report.Violations {
+		plog.Warningf("%s check: %s", level, v)
+	}
+	plog.Infof("%s check of %d shards completed in %s, %d nodes, %d records, "+
+		"%d entries, %d violations", level, report.Shards, s.check.Duration,
+		report.Nodes, report.Records, report.Entries, len(report.Violations))
+	return nil
+}
@@ -0,0 +1,75 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupCheckLevels(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, nil, CheckNone)
+	require.NoError(t, err)
+	require.Equal(t, CheckReport{Level: CheckNone}, db.CheckReport())
+	saveTestNode(t, db, 1, 2, 10)
+	k := newKey(entryKeySize, nil)
+	k.SetEntryKey(1, 2, 5)
+	shard := db.shards[db.partitioner.GetPartitionID(1)]
+	require.NoError(t, shard.kvs.SaveValue(k.Key(), []byte{0xFF, 0xFF, 0xFF}))
+	require.NoError(t, db.Close())
+
+	db, err = NewLogDB(cfg, nil, dirs, nil, CheckQuick)
+	require.NoError(t, err)
+	report := db.CheckReport()
+	require.NoError(t, db.Close())
+	require.Equal(t, CheckQuick, report.Level)
+	require.True(t, report.OK(), "%v", report.Violations)
+	require.Equal(t, cfg.Shards, report.Shards)
+	require.Equal(t, uint64(1), report.Nodes)
+	require.Equal(t, uint64(0), report.Entries)
+	require.NotZero(t, report.Records)
+
+	db, err = NewLogDB(cfg, nil, dirs, nil, CheckFull)
+	require.NoError(t, err)
+	report = db.CheckReport()
+	require.NoError(t, db.Close())
+	require.Equal(t, CheckFull, report.Level)
+	require.Equal(t, uint64(10), report.Entries)
+	require.Len(t, report.Violations, 1)
+	require.Contains(t, report.Violations[0].Message, "failed to decode entry")
+}
+
+func TestQuickStartupCheckReportsCorruptedMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	k := newKey(maxKeySize, nil)
+	k.SetStateKey(1, 2)
+	shard := db.shards[db.partitioner.GetPartitionID(1)]
+	require.NoError(t, shard.kvs.SaveValue(k.Key(), []byte{0xFF, 0xFF, 0xFF}))
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, dirs, nil, CheckQuick)
+	require.NoError(t, err)
+	report := db.CheckReport()
+	require.NoError(t, db.Close())
+	require.Len(t, report.Violations, 1)
+	require.Contains(t, report.Violations[0].Message, "failed to decode state")
+}
+
+func TestCheckLevelString(t *testing.T) {
+	require.Equal(t, "quick", CheckQuick.String())
+	require.Equal(t, "unknown", CheckLevel(100).String())
+}
@@ -0,0 +1,126 @@
+package pebble
+
+import (
+	goctx "context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClosing indicates that the write was rejected as the LogDB is being
+	// closed.
+	ErrClosing = errors.New("LogDB is closing")
+	// ErrCloseTimeout indicates that CloseWithTimeout gave up waiting for
+	// outstanding operations, the LogDB keeps rejecting writes and has to be
+	// closed again once they complete.
+	ErrCloseTimeout = errors.New("timed out closing LogDB")
+)
+
+// CloseReport describes the operations still outstanding when
+// CloseWithTimeout gave up.
+type CloseReport struct {
+	// PendingWrites is the number of writes in progress on each shard.
+	PendingWrites []int64
+	// PendingJobs is set when background jobs, e.g. compactions of removed
+	// entries, had not stopped yet.
+	PendingJobs bool
+}
+
+// writeGate tracks the writes in progress on a KV store, no write is accepted
+// once the gate is closed.
+type writeGate struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	closing  bool
+	inflight int64
+	// lock is the lock of the directory, writes are rejected once it is lost.
+	lock *lockFS
+}
+
+func (g *writeGate) enter() error {
+	if g.lock != nil {
+		if err := g.lock.check(); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return ErrClosing
+	}
+	g.wg.Add(1)
+	atomic.AddInt64(&g.inflight, 1)
+	return nil
+}
+
+func (g *writeGate) exit() {
+	atomic.AddInt64(&g.inflight, -1)
+	g.wg.Done()
+}
+
+func (g *writeGate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closing = true
+}
+
+func (g *writeGate) wait() {
+	g.wg.Wait()
+}
+
+func (g *writeGate) pending() int64 {
+	return atomic.LoadInt64(&g.inflight)
+}
+
+// CloseWithTimeout closes the LogDB once all writes in progress and all
+// background jobs have completed, new writes are rejected with ErrClosing
+// as soon as CloseWithTimeout is called. Memtables are flushed when
+// LogDBConfig.FlushOnClose is set. When ctx is done first, ErrCloseTimeout is
+// returned together with the report of the outstanding operations and the
+// LogDB is left open, Close or CloseWithTimeout has to be called again.
+func (s *ShardedDB) CloseWithTimeout(ctx goctx.Context) (CloseReport, error) {
+	select {
+	case <-s.drain():
+	case <-ctx.Done():
+		report := CloseReport{PendingJobs: atomic.LoadUint32(&s.jobsStopped) == 0}
+		for _, shard := range s.openedShards() {
+			pending := int64(0)
+			if shard != nil {
+				pending = shard.kvs.gate.pending()
+			}
+			report.PendingWrites = append(report.PendingWrites, pending)
+		}
+		return report, errors.Wrapf(ErrCloseTimeout, "%v", ctx.Err())
+	}
+	return CloseReport{}, s.close()
+}
+
+// drain rejects all new writes and returns a channel closed once all writes
+// in progress and all background jobs have completed.
+func (s *ShardedDB) drain() <-chan struct{} {
+	s.drainOnce.Do(func() {
+		s.drained = make(chan struct{})
+		s.openMu.Lock()
+		s.closing = true
+		s.openMu.Unlock()
+		shards := s.openedShards()
+		for _, shard := range shards {
+			if shard != nil {
+				shard.kvs.gate.close()
+			}
+		}
+		go func() {
+			s.stopper.Stop()
+			atomic.StoreUint32(&s.jobsStopped, 1)
+			for _, shard := range shards {
+				if shard != nil {
+					shard.kvs.gate.wait()
+				}
+			}
+			close(s.drained)
+		}()
+	})
+	return s.drained
+}
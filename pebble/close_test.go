@@ -0,0 +1,39 @@
+package pebble
+
+import (
+	goctx "context"
+	"testing"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseWithTimeoutReportsPendingWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	// a write in progress
+	p := db.partitioner.GetPartitionID(1)
+	require.NoError(t, db.shards[p].kvs.gate.enter())
+	ctx, cancel := goctx.WithTimeout(goctx.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := db.CloseWithTimeout(ctx)
+	require.ErrorIs(t, err, ErrCloseTimeout)
+	require.Len(t, report.PendingWrites, int(cfg.Shards))
+	require.Equal(t, int64(1), report.PendingWrites[p])
+	require.False(t, report.PendingJobs)
+	err = db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true})
+	require.ErrorIs(t, err, ErrClosing)
+	db.shards[p].kvs.gate.exit()
+	report, err = db.CloseWithTimeout(goctx.Background())
+	require.NoError(t, err)
+	require.Empty(t, report.PendingWrites)
+}
@@ -32,6 +32,10 @@ type compactionInfo struct {
 	index uint64
 }
 
+// compactions tracks the pending compactions of removed entries of each node.
+// The ranges are not persisted as pebble range key markers, the pebble
+// version in use only supports range keys experimentally in batches and none
+// of its format major versions allows them to be written to sstables.
 type compactions struct {
 	pendings map[raftio.NodeInfo]compactionInfo
 	mu       sync.Mutex
@@ -16,10 +16,12 @@ package pebble
 
 import (
 	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"github.com/coufalja/tugboat/raftio"
 	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
 )
 
 func TestCompactionTaskCanBeCreated(t *testing.T) {
@@ -141,3 +143,24 @@ func TestMovingCompactionIndexBackWillCausePanic(t *testing.T) {
 	p.addTask(task{clusterID: 1, nodeID: 2, index: 3})
 	p.addTask(task{clusterID: 1, nodeID: 2, index: 2})
 }
+
+func TestLargeRemovalSchedulesCompaction(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		sdb.config.DeletionCompactionThreshold = 10
+		saveTestNode(t, sdb, 1, 2, 100)
+		if err := db.RemoveEntriesTo(1, 2, 5); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if atomic.LoadUint64(&sdb.deletionCompactions) != 0 {
+			t.Fatalf("unexpected compaction")
+		}
+		if err := db.RemoveEntriesTo(1, 2, 51); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if atomic.LoadUint64(&sdb.deletionCompactions) != 1 {
+			t.Fatalf("compaction not scheduled")
+		}
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
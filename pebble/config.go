@@ -2,7 +2,9 @@ package pebble
 
 import (
 	"reflect"
+	"time"
 
+	"github.com/cockroachdb/pebble"
 	"github.com/lni/vfs"
 )
 
@@ -35,11 +37,333 @@ type LogDBConfig struct {
 	KVTargetFileSizeBase               uint64
 	KVTargetFileSizeMultiplier         uint64
 	KVLevelCompactionDynamicLevelBytes uint64
-	KVRecycleLogFileNum                uint64
-	KVNumOfLevels                      uint64
-	KVBlockSize                        uint64
-	SaveBufferSize                     uint64
-	MaxSaveBufferSize                  uint64
+	// KVRecycleLogFileNum is ignored, pebble recycles up to
+	// KVMaxWriteBufferNumber+1 obsolete WAL files and never recycles sstables.
+	KVRecycleLogFileNum uint64
+	KVNumOfLevels       uint64
+	KVBlockSize         uint64
+	// SaveBufferSize is the initial and min size of the value buffer used
+	// for encoding entries. The buffer grows to fit the observed entries,
+	// up to MaxSaveBufferSize, and is shrunk again once it has been mostly
+	// idle for a while. Larger entries use one-off buffers.
+	SaveBufferSize    uint64
+	MaxSaveBufferSize uint64
+	// KeyPoolSize is the number of keys pre-allocated for each shard, keys
+	// are taken from a sync.Pool once all pre-allocated keys are in use.
+	// ContextPoolSize is the number of IContext instances pre-allocated for
+	// each shard and handed out by ShardedDB.AcquireContext. Deployments with
+	// many concurrent workers per shard can size both to avoid allocations
+	// and contention, misses are reported by ShardedDB.Stats.
+	KeyPoolSize     uint64
+	ContextPoolSize uint64
+	// WriteBatchPoolSize is the number of destroyed write batches kept by
+	// each shard to be reused by later commits, misses are reported by
+	// ShardedDB.Stats.
+	WriteBatchPoolSize uint64
+	// ReadOnly opens all shards in read-only mode, any attempt to write to the
+	// LogDB fails. It is intended to be used by tools inspecting the LogDB.
+	ReadOnly bool
+	// IOAccounting enables counting the file operations of each shard and
+	// recording their latency histograms, e.g. of WAL syncs. The collected
+	// statistics are reported by ShardedDB.Stats.
+	IOAccounting bool
+	// ReadAhead makes the storage engine request read-ahead for all opened
+	// sstables rather than only for those read sequentially. It speeds up
+	// compactions and iterate heavy workloads such as recovery at the cost of
+	// reading more data than necessary for point lookups.
+	ReadAhead bool
+	// WALDSync opens WAL files with O_DSYNC so each write is durable once it
+	// returns, giving more predictable sync latency on some devices. TableDSync
+	// does the same for sstables. Both are only supported on Linux and macOS
+	// when FS is vfs.Default and are ignored otherwise. O_DIRECT is not
+	// offered as the storage engine issues writes not aligned to the logical
+	// block size of the device.
+	WALDSync   bool
+	TableDSync bool
+	// MirrorDir enables mirroring, all writes committed to each shard are also
+	// asynchronously applied to a standby copy of the shard in MirrorDir. The
+	// standby is recreated from a point in time copy of the shard each time
+	// the LogDB is opened. Once the primary disk fails, the standby can be
+	// promoted using PromoteStandby and opened as a regular LogDB. MirrorDir
+	// is expected to be on a different disk and is ignored in read-only mode.
+	MirrorDir string
+	// ShippingStore enables log shipping, all write batches committed to each
+	// shard are also uploaded to ShippingStore in segments identified by
+	// their sequence numbers. Combined with backups, shipped segments allow
+	// restoring the LogDB to any point in time. ShippingInterval is the
+	// interval of uploading segments, one second is used when not set.
+	// Shipping is ignored in read-only mode.
+	ShippingStore    ObjectStore
+	ShippingInterval time.Duration
+	// DeleteRangeFlushDelay is the max time a memtable containing removed
+	// entries is kept before being flushed, disk space used by removed
+	// entries can not be reclaimed before the flush. No such flush is forced
+	// when set to 0.
+	DeleteRangeFlushDelay time.Duration
+	// DeletionCompactionThreshold is the number of entries removed at once by
+	// RemoveEntriesTo or RemoveNodeData at which a compaction of the removed
+	// entries is scheduled, so range tombstones do not linger and increase
+	// the read amplification of other nodes on the same shard. Such
+	// compactions are not scheduled when set to 0.
+	DeletionCompactionThreshold uint64
+	// JanitorInterval enables the trim janitor, which periodically removes
+	// entries left behind below the latest snapshot of each node, e.g. when
+	// the process crashed between saving a snapshot and trimming the log.
+	// JanitorRetainedEntries is the number of entries below the latest
+	// snapshot the janitor keeps, it is expected to be no less than the
+	// compaction overhead used when trimming the log after snapshots. The
+	// janitor is disabled when JanitorInterval is 0 and in read-only mode.
+	JanitorInterval        time.Duration
+	JanitorRetainedEntries uint64
+	// StateStore keeps raft states and max index records of each shard in a
+	// small dedicated pebble instance with tiny memtables, placed in the low
+	// latency dir when one is specified, so persisting votes and terms is not
+	// stalled by flushes and compactions of entries. Existing records are
+	// moved when the option is toggled. The state store is not supported
+	// together with mirroring, shipping, backups and published checkpoints.
+	// Write batches are no longer committed atomically, batches with records
+	// of both stores are committed using two synced writes. Such batches are
+	// serialized and their state store records are also kept as a recovery
+	// marker in the KV store, the marker is applied when a crash interrupted
+	// the second write. Until the shard is opened again in read-write mode,
+	// the state store might miss the records of the last such batch.
+	StateStore bool
+	// CommitWindow is the max time a raft state update waits for updates
+	// saved concurrently on the same shard, all such updates are committed
+	// together using a single synced write. CommitWindowBatches is the max
+	// number of updates merged into a single commit, the commit is made as
+	// soon as the number is reached. The commit window trades a bounded
+	// latency increase for a higher throughput when many goroutines save
+	// small updates, it is disabled when CommitWindow is 0.
+	CommitWindow        time.Duration
+	CommitWindowBatches uint64
+	// EntryCompression is the block compression of the sstables of each
+	// shard, which mostly contain large and sequentially read entries, their
+	// block size is KVBlockSize. MetadataCompression and MetadataBlockSize
+	// apply to the state store holding the small and point read raft state
+	// and max index records, they are only used when StateStore is set. A
+	// MetadataBlockSize of 0 selects a 4KB block size.
+	EntryCompression    Compression
+	MetadataCompression Compression
+	MetadataBlockSize   uint64
+	// RelaxedSyncInterval enables the relaxed durability mode when it is not
+	// 0. Writes are then committed without syncing the WAL and the WAL of each
+	// shard is synced in the background every RelaxedSyncInterval. Writes
+	// acknowledged within the last interval survive process crashes but are
+	// lost on OS crashes and power failures, which breaks the guarantees raft
+	// expects from its log, the mode is only meant for test clusters and
+	// caches that can be rebuilt. Once a background sync fails, all further
+	// writes fail. To prevent the mode from being enabled by accident,
+	// RelaxedDurability must be set to AcceptRelaxedDurability, opening the
+	// LogDB fails otherwise. Both are ignored in read-only mode.
+	RelaxedSyncInterval time.Duration
+	RelaxedDurability   string
+	// FormatMajorVersion is the pebble format major version of newly created
+	// shards, existing shards with an older format are upgraded when opened.
+	// It defaults to pebble.FormatMostCompatible, shards upgraded to a newer
+	// format can no longer be opened by older releases, see also
+	// ShardedDB.RatchetFormat.
+	FormatMajorVersion pebble.FormatMajorVersion
+	// EngineEventListener is called with the compaction and flush events of
+	// each shard, allowing background activity to be correlated with latency
+	// changes. Events are also logged and their totals are reported by
+	// ShardedDB.Stats. The pebble version in use reports no table ingestion
+	// events.
+	EngineEventListener EngineEventListener
+	// OpenProgressListener is called with the progress of opening each shard,
+	// e.g. the WAL bytes replayed, so hosts with large LogDBs can report the
+	// progress of their startup. The pebble version in use validates no
+	// sstables when opening shards, the sstables written from the replayed
+	// WAL are reported instead.
+	OpenProgressListener OpenProgressListener
+	// MaxManifestFileSize is the size in bytes at which the MANIFEST file of
+	// each shard is rotated, 0 selects a 128MB limit. Smaller values keep
+	// the MANIFEST small on long running nodes at the cost of more frequent
+	// rotations.
+	MaxManifestFileSize uint64
+	// ObsoleteFileDeletionRate paces the deletion of obsolete sstables to the
+	// specified number of bytes per second, avoiding latency spikes caused by
+	// deleting many files at once after large compactions. Deletions are not
+	// paced when it is 0.
+	ObsoleteFileDeletionRate uint64
+	// FlushOnClose flushes the memtables of all shards when the LogDB is
+	// closed so the next open replays no WAL, shortening planned restarts of
+	// nodes with large write buffers at the cost of a slower close.
+	FlushOnClose bool
+	// IngestImports makes ImportNode write the imported entries into external
+	// sstables ingested into the shard, which is much faster than committing
+	// them in write batches for nodes with many entries. It is ignored when
+	// mirroring or shipping is enabled as both only observe write batches.
+	IngestImports bool
+	// MaxConcurrentCompactions is the max number of concurrent compactions
+	// of each shard. Additional concurrent compactions are started for every
+	// L0CompactionConcurrency L0 sublevels and for every
+	// CompactionDebtConcurrency bytes of compaction debt, so bursts of raft
+	// appends are compacted out of L0 before writes are stalled.
+	// FlushSplitBytes is the target size of each L0 sublevel between the keys
+	// at which flushes split their output, smaller values produce more and
+	// smaller L0 sstables that can be compacted concurrently. Zero values
+	// select the pebble defaults, which are a single compaction, 10
+	// sublevels, 1GB and twice the L0 target file size.
+	MaxConcurrentCompactions  uint64
+	L0CompactionConcurrency   uint64
+	CompactionDebtConcurrency uint64
+	FlushSplitBytes           uint64
+	// OpenClusters makes the LogDB open only the shards hosting the specified
+	// clusters, the remaining shards are opened on first access. Listing all
+	// nodes or other operations covering the whole LogDB open all shards. All
+	// shards are opened when it is empty.
+	OpenClusters []uint64
+	// VerifyReads checks that each entry read belongs to the key it is read
+	// under and that iterated entries are contiguous, ErrCorruptedRecord is
+	// returned with the location of the mismatch otherwise. The checks catch
+	// records written under wrong keys which checksums can not detect.
+	VerifyReads bool
+	// LowFreeSpace and CriticalFreeSpace are watermarks of the free space in
+	// bytes of the file systems holding the directories of each shard,
+	// LowFreeSpacePercent and CriticalFreeSpacePercent are the same
+	// watermarks as a percentage of the total size of the file system, they
+	// are only applied when FS reports its total size, e.g. vfs.Default does.
+	// A watermark is reached once either of its limits is reached. The free
+	// space is checked when each shard is opened and every
+	// FreeSpaceCheckInterval. Below the low watermark, the shard is reported
+	// as busy to the LogDB callback to throttle new proposals. Below the
+	// critical watermark, entries are rejected with ErrFreeSpaceCritical. The
+	// raft states and snapshots of all updates are still saved, with the
+	// commit capped to the saved entries, so raft can keep voting and
+	// applying snapshots. FreeSpaceListener is called with each change of the
+	// level of a shard. The checks are disabled when FreeSpaceCheckInterval
+	// is 0 and in read-only mode.
+	LowFreeSpace             uint64
+	LowFreeSpacePercent      uint64
+	CriticalFreeSpace        uint64
+	CriticalFreeSpacePercent uint64
+	FreeSpaceCheckInterval   time.Duration
+	FreeSpaceListener        FreeSpaceListener
+	// CompactionBandwidth limits the bytes written per second by compactions
+	// of all shards, so compactions triggered by removing entries do not
+	// saturate the disk shared with the WAL. Flushes are not limited as
+	// delaying them would stall writes. The limit can be changed at runtime
+	// using ShardedDB.SetCompactionBandwidth, it is only enforced when the
+	// LogDB was opened with a non-zero value. The limiting FS hides
+	// vfs.Default from the storage engine, so WALDSync and TableDSync are
+	// ignored when it is set. It is ignored in read-only mode.
+	CompactionBandwidth uint64
+	// MaxConcurrentReads is the max number of concurrent heavy reads of each
+	// shard, i.e. entry iterations used by follower catch-ups, exports and
+	// verifications, so a burst of such reads can not starve the write path.
+	// Further reads wait for a running read to complete, waits are reported
+	// by ShardedDB.Stats. The number of concurrent reads is not limited when
+	// it is 0.
+	MaxConcurrentReads uint64
+	// StorageClass is the class of the storage holding the shards, the class
+	// of the directory of each shard is detected when it is opened when set
+	// to StorageClassAuto. Detection is only supported on Linux when FS is
+	// vfs.Default, the class is unknown otherwise. Shards on SSDs, spinning
+	// disks and network storage get different defaults for
+	// MaxConcurrentCompactions, BytesPerSync and WALBytesPerSync, which are
+	// only applied when those are 0, ReadAhead is enabled for spinning disks
+	// and network storage. No defaults are applied when the class is
+	// unknown, set it to StorageClassUnknown to disable the tuning. The class
+	// of each shard is reported by ShardedDB.Stats.
+	StorageClass StorageClass
+	// BytesPerSync is the number of bytes written to an sstable before it is
+	// synced in the background, WALBytesPerSync is the same for WAL files,
+	// syncing in smaller chunks avoids latency spikes of large syncs. Zero
+	// values select the defaults of the storage class, or the pebble defaults
+	// of 512KB and no background WAL syncs when the class is unknown.
+	BytesPerSync    uint64
+	WALBytesPerSync uint64
+	// Namespace allows several LogDB instances, e.g. of NodeHosts running in
+	// tests or in multiple processes on one machine, to share the same
+	// directories. The shards of each namespace are kept in a subdirectory
+	// of each directory the LogDB is opened with, so the node records, node
+	// listings and removals of a namespace never touch other namespaces.
+	// The deployment ID of the NodeHost is a natural choice. It may only
+	// contain ASCII letters, digits, '-', '_' and '.'. MirrorDir and
+	// ShippingStore are not namespaced and must not be shared. See also
+	// NamespaceDirs, ListNamespaces and DestroyNamespace.
+	Namespace string
+	// Engine is the name of the storage engine used by OpenLogDB, see
+	// RegisterEngine. The pebble engine of this package is used when it is
+	// empty, NewLogDB and OpenShardedDB only support the pebble engine.
+	Engine string
+	// SegmentSize is the size in bytes at which the segment files of the
+	// segmented engine are rolled, see SegmentedDB. Entries are removed one
+	// segment at a time, so smaller segments release disk space sooner at
+	// the cost of more files. The default of 64MB is used when it is 0.
+	SegmentSize uint64
+	// SegmentMmap enables reading entries from memory mapped segment files,
+	// which avoids a read syscall per iteration, e.g. when followers catch up
+	// with large amounts of entries. Only segments no longer appended to are
+	// mapped, reads fall back to regular reads on platforms and file systems
+	// not supporting it or when mapping a segment fails.
+	SegmentMmap bool
+	// SegmentedEntries keeps the entries of each shard in segment files, as
+	// done by the segmented engine, while raft states, bootstrap records,
+	// snapshots and max indexes remain in pebble. Shards are migrated between
+	// both layouts when opened with a different setting, the layout found is
+	// used in read-only mode. MirrorDir and ShippingStore are not supported.
+	// Backup, PublishCheckpoints, ExportNode, Verify, VerifyResumable, entry
+	// sizes and Forecast return ErrSegmentedEntries, other statistics do not
+	// see entries kept in segments. CheckFull is performed as CheckQuick.
+	SegmentedEntries bool
+	// LockHeartbeat is the interval at which the owner of the lock file of
+	// each shard refreshes its record, locks of other hosts not refreshed for
+	// three intervals are stale. The owner rejects all writes with
+	// ErrLockLost once its record was not refreshed for two intervals. Locks
+	// are never considered stale when it is 0. All hosts sharing the storage
+	// must use the same interval.
+	LockHeartbeat time.Duration
+	// TakeOverStaleLocks takes over stale lock files of shards, e.g. left on
+	// shared storage by a crashed host, instead of failing with a LockError.
+	// It is safe as the previous owner stopped writing before its lock became
+	// stale.
+	TakeOverStaleLocks bool
+	// ForceUnlock takes over the lock files of shards recorded as owned by
+	// another host, stale or not. Locks owned by this host or with no
+	// recorded owner are never taken over. It must only be set once the
+	// previous owner is known to be gone, two processes writing to the same
+	// LogDB corrupt it.
+	ForceUnlock bool
+	// OpenParallelism is the max number of shards opened concurrently when
+	// the LogDB is opened, opening shards is dominated by replaying their WAL,
+	// so fast disks benefit from opening all shards at once while slow disks
+	// may be overwhelmed. Shards are opened one at a time when it is 1 and
+	// all shards are opened concurrently when it is 0.
+	OpenParallelism uint64
+	// ManualLayoutMigration disables migrating the directory layout when the
+	// LogDB is opened, directories with an older layout which can not be
+	// opened as they are are rejected with ErrLayoutMigrationRequired and
+	// must be migrated using MigrateLayout, e.g. by a tool run during the
+	// upgrade. Directories with a newer layout are always rejected.
+	ManualLayoutMigration bool
+}
+
+// Compression is the block compression algorithm used by the storage engine.
+type Compression int
+
+const (
+	// NoCompression disables the block compression.
+	NoCompression Compression = iota
+	// SnappyCompression compresses blocks using Snappy.
+	SnappyCompression
+	// ZstdCompression compresses blocks using Zstandard.
+	ZstdCompression
+)
+
+func (c Compression) pebbleCompression() pebble.Compression {
+	switch c {
+	case NoCompression:
+		return pebble.NoCompression
+	case SnappyCompression:
+		return pebble.SnappyCompression
+	case ZstdCompression:
+		return pebble.ZstdCompression
+	default:
+		plog.Panicf("unknown compression %d", c)
+	}
+	panic("not suppose to reach here")
 }
 
 // LogDBCallback is a callback function called by the LogDB.
@@ -109,6 +433,9 @@ func getDefaultLogDBConfig() LogDBConfig {
 		KVBlockSize:                        32 * 1024,
 		SaveBufferSize:                     32 * 1024,
 		MaxSaveBufferSize:                  64 * 1024 * 1024,
+		DeleteRangeFlushDelay:              10 * time.Second,
+		DeletionCompactionThreshold:        64 * 1024,
+		WriteBatchPoolSize:                 16,
 	}
 }
 
@@ -15,9 +15,32 @@
 package pebble
 
 import (
+	"sync/atomic"
+
 	pb "github.com/coufalja/tugboat/raftpb"
 )
 
+// bufferShrinkInterval is the number of resets after which the value buffer
+// of a context is shrunk when it was mostly idle since the last check.
+const bufferShrinkInterval = 64
+
+// SaveBufferStats contains the statistics of the value buffer used for saving
+// entries on a shard.
+type SaveBufferStats struct {
+	// Size is the current size of the buffer.
+	Size uint64
+	// Peak is the largest size requested from the buffer since it was last
+	// checked for shrinking, Peak/Size is the occupancy of the buffer.
+	Peak uint64
+	// Grows and Shrinks are the number of times the buffer was reallocated
+	// to a larger or smaller size.
+	Grows   uint64
+	Shrinks uint64
+	// Oversized is the number of one-off buffers allocated for requests
+	// larger than MaxSaveBufferSize.
+	Oversized uint64
+}
+
 // IWriteBatch is the interface representing a write batch capable of
 // atomically writing many key-value pairs to the key-value store.
 type IWriteBatch interface {
@@ -36,20 +59,32 @@ type context struct {
 	eb      pb.EntryBatch
 	lb      pb.EntryBatch
 	val     []byte
+	arena   *EntryArena
+	minSize uint64
 	maxSize uint64
 	size    uint64
+	// peak is the largest size requested since the last shrink check, it is
+	// reset every bufferShrinkInterval resets.
+	peak   uint64
+	resets uint64
+	stats  SaveBufferStats
+	// pool is the pool the context is returned to, it is nil for contexts
+	// not acquired from a pool.
+	pool *contextPool
 }
 
 // newContext creates a new RDB context instance.
 func newContext(size uint64, maxSize uint64) *context {
 	ctx := &context{
 		size:    size,
+		minSize: size,
 		maxSize: maxSize,
 		key:     newKey(maxKeySize, nil),
 		val:     make([]byte, size),
 	}
 	ctx.lb.Entries = make([]pb.Entry, 0, batchSize)
 	ctx.eb.Entries = make([]pb.Entry, 0, batchSize)
+	atomic.StoreUint64(&ctx.stats.Size, size)
 	return ctx
 }
 
@@ -58,6 +93,7 @@ func (c *context) Destroy() {
 		c.wb.Destroy()
 	}
 	c.val = nil
+	c.arena = nil
 	c.lb.Entries = nil
 	c.eb.Entries = nil
 }
@@ -66,6 +102,19 @@ func (c *context) Reset() {
 	if c.wb != nil {
 		c.wb.Clear()
 	}
+	c.resets++
+	if c.resets < bufferShrinkInterval {
+		return
+	}
+	// the buffer is shrunk when less than a quarter of it was used during
+	// the last bufferShrinkInterval resets
+	if c.size > c.minSize && c.peak <= c.size/4 {
+		c.resize(c.bufferSize(c.peak))
+		atomic.AddUint64(&c.stats.Shrinks, 1)
+	}
+	c.resets = 0
+	c.peak = 0
+	atomic.StoreUint64(&c.stats.Peak, 0)
 }
 
 func (c *context) GetKey() IReusableKey {
@@ -73,15 +122,53 @@ func (c *context) GetKey() IReusableKey {
 }
 
 func (c *context) GetValueBuffer(sz uint64) []byte {
+	if sz > c.peak {
+		c.peak = sz
+		atomic.StoreUint64(&c.stats.Peak, sz)
+	}
 	if sz <= c.size {
 		return c.val
 	}
-	val := make([]byte, sz)
-	if sz < c.maxSize {
-		c.size = sz
-		c.val = val
+	if sz > c.maxSize {
+		atomic.AddUint64(&c.stats.Oversized, 1)
+		return make([]byte, sz)
+	}
+	c.resize(c.bufferSize(sz))
+	atomic.AddUint64(&c.stats.Grows, 1)
+	return c.val
+}
+
+// bufferSize returns the buffer size used for requests of sz bytes, it is the
+// next power of two bounded by the configured min and max sizes so growing
+// buffers are not reallocated for every slightly larger request.
+func (c *context) bufferSize(sz uint64) uint64 {
+	size := c.minSize
+	if size == 0 {
+		size = 1
+	}
+	for size < sz {
+		size *= 2
+	}
+	if size > c.maxSize && sz <= c.maxSize {
+		size = c.maxSize
+	}
+	return size
+}
+
+func (c *context) resize(size uint64) {
+	c.size = size
+	c.val = make([]byte, size)
+	atomic.StoreUint64(&c.stats.Size, size)
+}
+
+func (c *context) bufferStats() SaveBufferStats {
+	return SaveBufferStats{
+		Size:      atomic.LoadUint64(&c.stats.Size),
+		Peak:      atomic.LoadUint64(&c.stats.Peak),
+		Grows:     atomic.LoadUint64(&c.stats.Grows),
+		Shrinks:   atomic.LoadUint64(&c.stats.Shrinks),
+		Oversized: atomic.LoadUint64(&c.stats.Oversized),
 	}
-	return val
 }
 
 func (c *context) GetEntryBatch() pb.EntryBatch {
@@ -92,6 +179,13 @@ func (c *context) GetLastEntryBatch() pb.EntryBatch {
 	return c.lb
 }
 
+func (c *context) GetEntryArena() *EntryArena {
+	if c.arena == nil {
+		c.arena = NewEntryArena()
+	}
+	return c.arena
+}
+
 func (c *context) GetWriteBatch() interface{} {
 	return c.wb
 }
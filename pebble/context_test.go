@@ -97,3 +97,45 @@ func TestGetValueBuffer(t *testing.T) {
 		t.Errorf("didn't return a new buffer")
 	}
 }
+
+func TestValueBufferGrowsAndShrinks(t *testing.T) {
+	ctx := newContext(128, 4096)
+	if buf := ctx.GetValueBuffer(300); cap(buf) != 512 {
+		t.Errorf("unexpected buffer size %d", cap(buf))
+	}
+	if buf := ctx.GetValueBuffer(3000); cap(buf) != 4096 {
+		t.Errorf("unexpected buffer size %d", cap(buf))
+	}
+	if buf := ctx.GetValueBuffer(8192); cap(buf) != 8192 {
+		t.Errorf("unexpected buffer size %d", cap(buf))
+	}
+	st := ctx.bufferStats()
+	if st.Size != 4096 || st.Peak != 8192 || st.Grows != 2 || st.Oversized != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	for i := 0; i < bufferShrinkInterval; i++ {
+		ctx.Reset()
+	}
+	if st := ctx.bufferStats(); st.Size != 4096 || st.Shrinks != 0 || st.Peak != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	for i := 0; i < bufferShrinkInterval; i++ {
+		ctx.GetValueBuffer(200)
+		ctx.Reset()
+	}
+	if st := ctx.bufferStats(); st.Size != 256 || st.Shrinks != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	for i := 0; i < bufferShrinkInterval; i++ {
+		ctx.Reset()
+	}
+	if st := ctx.bufferStats(); st.Size != 128 || st.Shrinks != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	for i := 0; i < bufferShrinkInterval; i++ {
+		ctx.Reset()
+	}
+	if st := ctx.bufferStats(); st.Size != 128 || st.Shrinks != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
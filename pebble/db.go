@@ -18,7 +18,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"time"
 
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
 	"github.com/coufalja/tugboat/raftio"
 	pb "github.com/coufalja/tugboat/raftpb"
 	"github.com/coufalja/tugboat/server"
@@ -36,23 +38,47 @@ var batchSize = uint64(server.LogDBEntryBatchSize)
 type entryManager interface {
 	binaryFormat() uint32
 	record(wb *pebbleWriteBatch,
-		clusterID uint64, nodeID uint64, ctx IContext, entries []pb.Entry) uint64
-	iterate(ents []pb.Entry, maxIndex uint64,
+		clusterID uint64, nodeID uint64, ctx IContext, entries []pb.Entry) (uint64, error)
+	iterate(arena *EntryArena, ents []pb.Entry, maxIndex uint64,
 		size uint64, clusterID uint64, nodeID uint64,
 		low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error)
-	getRange(clusterID uint64,
+	getRange(kvs kvReader, clusterID uint64,
 		nodeID uint64, snapshotIndex uint64,
 		maxIndex uint64) (uint64, uint64, error)
 	rangedOp(clusterID uint64,
 		nodeID uint64, index uint64, op func(*Key, *Key) error) error
+	// remove removes entries kept outside of pebble up to index, all entries
+	// of the node are removed when index is math.MaxUint64.
+	remove(clusterID uint64, nodeID uint64, index uint64) error
+	close()
+}
+
+// kvReader is the read interface shared by the KV store and its snapshots.
+type kvReader interface {
+	IterateValue(fk []byte, lk []byte, inc bool,
+		op func(key []byte, data []byte) (bool, error)) error
+	GetValue(key []byte, op func([]byte) error) error
+	MultiGet(keys [][]byte, op func(int, []byte) error) error
 }
 
 // db is the struct used to manage log DB.
 type db struct {
-	cs      *cache
-	keys    *keyPool
-	kvs     *KV
-	entries entryManager
+	cs         *cache
+	keys       *keyPool
+	kvs        *KV
+	entries    entryManager
+	accounting *vfsutil.AccountingFS
+	batcher    *batcher
+	ops        *nodeOps
+	sizes      *entrySizes
+	reads      *readSlots
+	class      StorageClass
+	// fastSaves enables saving single small updates using saveSmallUpdate.
+	fastSaves bool
+	// marker is the directory of the running marker of the shard, it is
+	// empty when the shard is open in read-only mode.
+	marker string
+	fs     vfs.FS
 }
 
 func hasEntryRecord(kvs *KV) (bool, error) {
@@ -71,20 +97,41 @@ func hasEntryRecord(kvs *KV) (bool, error) {
 	return located, nil
 }
 
-func openRDB(config LogDBConfig, callback LogDBCallback, dir string, wal string, fs vfs.FS) (*db, error) {
-	kvs, err := openPebbleDB(config, callback, dir, wal, fs)
+func openRDB(config LogDBConfig, callback LogDBCallback,
+	events *engineEvents, dir string, wal string, fs vfs.FS) (*db, error) {
+	kvs, err := openPebbleDBWithEvents(config, callback, events, dir, wal, fs)
 	if err != nil {
 		return nil, err
 	}
+	sdir := dir
+	if len(wal) > 0 {
+		sdir = wal
+	}
+	if err := kvs.openStateStore(config, sdir, fs); err != nil {
+		return nil, firstError(err, kvs.Close())
+	}
 	cs := newCache()
-	pool := newLogDBKeyPool()
-	em := newPlainEntries(cs, pool, kvs)
-	return &db{
+	pool := newLogDBKeyPool(config.KeyPoolSize)
+	em, err := openEntryManager(config, cs, pool, kvs, sdir, fs)
+	if err != nil {
+		return nil, firstError(err, kvs.Close())
+	}
+	r := &db{
 		cs:      cs,
 		keys:    pool,
 		kvs:     kvs,
 		entries: em,
-	}, nil
+		ops:     newNodeOps(),
+		sizes:   newEntrySizes(),
+		reads:   newReadSlots(config.MaxConcurrentReads),
+	}
+	if _, ok := em.(*plainEntries); ok && kvs.state == nil {
+		r.fastSaves = true
+	}
+	if config.CommitWindow > 0 {
+		r.batcher = newBatcher(kvs, config.CommitWindow, config.CommitWindowBatches)
+	}
+	return r, nil
 }
 
 func (r *db) name() string {
@@ -96,7 +143,14 @@ func (r *db) binaryFormat() uint32 {
 }
 
 func (r *db) close() error {
-	return r.kvs.Close()
+	r.entries.close()
+	if err := r.kvs.Close(); err != nil {
+		return err
+	}
+	if len(r.marker) > 0 {
+		return removeRunningMarker(r.marker, r.fs)
+	}
+	return nil
 }
 
 func (r *db) getWriteBatch(ctx IContext) *pebbleWriteBatch {
@@ -112,31 +166,53 @@ func (r *db) getWriteBatch(ctx IContext) *pebbleWriteBatch {
 }
 
 func (r *db) listNodeInfo() ([]raftio.NodeInfo, error) {
-	fk := newKey(bootstrapKeySize, nil)
-	lk := newKey(bootstrapKeySize, nil)
-	fk.setBootstrapKey(0, 0)
-	lk.setBootstrapKey(math.MaxUint64, math.MaxUint64)
 	ni := make([]raftio.NodeInfo, 0)
-	op := func(key []byte, data []byte) (bool, error) {
-		cid, nid := parseNodeInfoKey(key)
-		ni = append(ni, raftio.GetNodeInfo(cid, nid))
+	op := func(n raftio.NodeInfo) (bool, error) {
+		ni = append(ni, n)
 		return true, nil
 	}
-	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+	if err := r.iterateNodeInfo(0, math.MaxUint64, op); err != nil {
 		return []raftio.NodeInfo{}, err
 	}
 	return ni, nil
 }
 
+func (r *db) iterateNodeInfo(firstClusterID uint64, lastClusterID uint64,
+	op func(raftio.NodeInfo) (bool, error)) error {
+	fk := newKey(bootstrapKeySize, nil)
+	lk := newKey(bootstrapKeySize, nil)
+	fk.setBootstrapKey(firstClusterID, 0)
+	lk.setBootstrapKey(lastClusterID, math.MaxUint64)
+	return r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			cid, nid, err := decodeNodeInfoKey(key)
+			if err != nil {
+				return false, err
+			}
+			return op(raftio.GetNodeInfo(cid, nid))
+		})
+}
+
 func (r *db) readRaftState(clusterID uint64,
 	nodeID uint64, snapshotIndex uint64) (raftio.RaftState, error) {
-	firstIndex, length, err := r.getRange(clusterID, nodeID, snapshotIndex)
+	r.ops.read(clusterID, nodeID)
+	return r.readRaftStateFrom(r.kvs, clusterID, nodeID, snapshotIndex, true)
+}
+
+func (r *db) readRaftStateFrom(kvs kvReader, clusterID uint64,
+	nodeID uint64, snapshotIndex uint64, cached bool) (raftio.RaftState, error) {
+	state, maxIndex, err := r.readStateAndMaxIndex(kvs,
+		clusterID, nodeID, cached)
 	if err != nil {
 		return raftio.RaftState{}, err
 	}
-	state, err := r.getState(clusterID, nodeID)
-	if err != nil {
-		return raftio.RaftState{}, err
+	firstIndex, length := snapshotIndex, uint64(0)
+	if maxIndex > 0 {
+		firstIndex, length, err = r.getRangeTo(kvs,
+			clusterID, nodeID, snapshotIndex, maxIndex, cached)
+		if err != nil {
+			return raftio.RaftState{}, err
+		}
 	}
 	return raftio.RaftState{
 		State:      state,
@@ -145,23 +221,93 @@ func (r *db) readRaftState(clusterID uint64,
 	}, nil
 }
 
-func (r *db) getRange(clusterID uint64,
-	nodeID uint64, snapshotIndex uint64) (uint64, uint64, error) {
-	maxIndex, err := r.getMaxIndex(clusterID, nodeID)
+func (r *db) getRange(kvs kvReader, clusterID uint64,
+	nodeID uint64, snapshotIndex uint64, cached bool) (uint64, uint64, error) {
+	var maxIndex uint64
+	var err error
+	if cached {
+		maxIndex, err = r.getMaxIndex(clusterID, nodeID)
+	} else {
+		maxIndex, err = r.readMaxIndex(kvs, clusterID, nodeID)
+	}
 	if err == raftio.ErrNoSavedLog {
 		return snapshotIndex, 0, nil
 	}
 	if err != nil {
 		return 0, 0, err
 	}
+	return r.getRangeTo(kvs, clusterID, nodeID, snapshotIndex, maxIndex, cached)
+}
+
+// getRangeTo is similar to getRange, but the max index of the node is
+// already known.
+func (r *db) getRangeTo(kvs kvReader, clusterID uint64, nodeID uint64,
+	snapshotIndex uint64, maxIndex uint64, cached bool) (uint64, uint64, error) {
 	if snapshotIndex == maxIndex {
 		return snapshotIndex, 0, nil
 	}
-	return r.entries.getRange(clusterID, nodeID, snapshotIndex, maxIndex)
+	if !cached {
+		return r.entries.getRange(kvs, clusterID, nodeID, snapshotIndex, maxIndex)
+	}
+	if first := r.cs.getFirstIndex(clusterID, nodeID); first > 0 {
+		if first < snapshotIndex {
+			first = snapshotIndex
+		}
+		if first <= maxIndex {
+			return first, maxIndex - first + 1, nil
+		}
+	}
+	firstIndex, length, err := r.entries.getRange(kvs,
+		clusterID, nodeID, snapshotIndex, maxIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	// no entry below snapshotIndex is known to be missing otherwise
+	if firstIndex > snapshotIndex {
+		r.cs.setFirstIndex(clusterID, nodeID, firstIndex)
+	}
+	return firstIndex, length, nil
 }
 
-func (r *db) saveRaftState(updates []pb.Update, ctx IContext) error {
+// saveRaftState returns the saved updates, they differ from the specified
+// updates when entries are rejected with ErrFreeSpaceCritical.
+func (r *db) saveRaftState(updates []pb.Update, ctx IContext) ([]pb.Update, error) {
+	return r.saveRaftStateWithMetadata(updates, nil, nil, ctx)
+}
+
+func (r *db) saveRaftStateWithMetadata(updates []pb.Update, metadata []NodeMetadata,
+	records []AppRecord, ctx IContext) ([]pb.Update, error) {
+	updates, rejected := r.rejectEntries(updates)
+	if rejected != nil && !errors.Is(rejected, ErrFreeSpaceCritical) {
+		return nil, rejected
+	}
+	if len(updates) > 0 || len(metadata) > 0 || len(records) > 0 {
+		if err := r.saveUpdates(updates, nil, metadata, records, ctx); err != nil {
+			return nil, err
+		}
+	}
+	return updates, rejected
+}
+
+// saveMaxIndexes saves updates whose entries are kept outside of the LogDB,
+// e.g. by SegmentedDB. The max index of updates[i] is set to maxIndexes[i]
+// when it is not 0, in the same write batch as its raft state, so the entries
+// are only visible once the raft state referring to them is saved.
+func (r *db) saveMaxIndexes(updates []pb.Update,
+	maxIndexes []uint64, ctx IContext) error {
+	return r.saveUpdates(updates, maxIndexes, nil, nil, ctx)
+}
+
+func (r *db) saveUpdates(updates []pb.Update, maxIndexes []uint64,
+	metadata []NodeMetadata, records []AppRecord, ctx IContext) error {
+	if r.fastSaves && isSmallUpdate(updates, metadata, records) {
+		return r.saveSmallUpdate(updates[0], ctx)
+	}
 	wb := r.getWriteBatch(ctx)
+	for _, md := range metadata {
+		r.saveNodeMetadata(wb, md)
+	}
+	r.saveAppRecords(wb, records)
 	for _, ud := range updates {
 		r.saveState(ud.ClusterID, ud.NodeID, ud.State, wb, ctx)
 		if !pb.IsEmptySnapshot(ud.Snapshot) &&
@@ -175,18 +321,41 @@ func (r *db) saveRaftState(updates []pb.Update, ctx IContext) error {
 				}
 			}
 			if err := r.saveSnapshot(wb, ud); err != nil {
-				return nil
+				return err
 			}
 			r.setMaxIndex(wb, ud, ud.Snapshot.Index, ctx)
 		}
 	}
-	r.saveEntries(updates, wb, ctx)
+	if err := r.saveEntries(updates, wb, ctx); err != nil {
+		return err
+	}
+	for i, mi := range maxIndexes {
+		if mi > 0 {
+			r.setMaxIndex(wb, updates[i], mi, ctx)
+		}
+	}
 	if wb.Count() > 0 {
-		return r.kvs.CommitWriteBatch(wb)
+		if err := r.commitWriteBatch(wb); err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, ud := range updates {
+			r.cs.setLastWrite(ud.ClusterID, ud.NodeID, now)
+		}
+		r.recordSaves(updates)
 	}
 	return nil
 }
 
+// commitWriteBatch commits the write batch, it is merged with write batches
+// committed concurrently on the shard when the commit window is enabled.
+func (r *db) commitWriteBatch(wb *pebbleWriteBatch) error {
+	if r.batcher != nil {
+		return r.batcher.commit(wb)
+	}
+	return r.kvs.CommitWriteBatch(wb)
+}
+
 func (r *db) importSnapshot(ss pb.Snapshot, nodeID uint64) error {
 	if ss.Type == pb.UnknownStateMachine {
 		panic("Unknown state machine type")
@@ -221,6 +390,7 @@ func (r *db) importSnapshot(ss pb.Snapshot, nodeID uint64) error {
 		return err
 	}
 	r.saveMaxIndex(wb, ss.ClusterId, nodeID, ss.Index, nil)
+	r.cs.dropSparseIndex(ss.ClusterId, nodeID)
 	return r.kvs.CommitWriteBatch(wb)
 }
 
@@ -242,22 +412,75 @@ func (r *db) saveSnapshot(wb *pebbleWriteBatch, ud pb.Update) error {
 	if pb.IsEmptySnapshot(ud.Snapshot) {
 		return nil
 	}
-	snapshots, err := r.listSnapshots(ud.ClusterID, ud.NodeID, math.MaxUint64)
+	existing, err := r.snapshotIndexes([]pb.Update{ud})
 	if err != nil {
 		return err
 	}
-	for _, ss := range snapshots {
-		if ud.Snapshot.Index > ss.Index {
-			k := newKey(maxKeySize, nil)
-			k.setSnapshotKey(ud.ClusterID, ud.NodeID, ss.Index)
+	r.replaceSnapshot(wb, ud, existing)
+	return nil
+}
+
+// replaceSnapshot saves the snapshot of the update and removes the older
+// snapshots of the node found in existing, which is updated accordingly.
+func (r *db) replaceSnapshot(wb *pebbleWriteBatch,
+	ud pb.Update, existing map[raftio.NodeInfo][]uint64) {
+	ni := raftio.GetNodeInfo(ud.ClusterID, ud.NodeID)
+	k := newKey(snapshotKeySize, nil)
+	kept := existing[ni][:0]
+	for _, index := range existing[ni] {
+		if ud.Snapshot.Index > index {
+			k.setSnapshotKey(ud.ClusterID, ud.NodeID, index)
 			wb.Delete(k.Key())
+		} else {
+			kept = append(kept, index)
 		}
 	}
-	k := newKey(snapshotKeySize, nil)
+	existing[ni] = append(kept, ud.Snapshot.Index)
 	k.setSnapshotKey(ud.ClusterID, ud.NodeID, ud.Snapshot.Index)
 	data := pb.MustMarshal(&ud.Snapshot)
 	wb.Put(k.Key(), data)
-	return nil
+}
+
+// snapshotIndexes returns the indexes of the saved snapshots of the nodes of
+// the updates. They are resolved using a single scan over the snapshot
+// records of the nodes between the first and the last node of the updates,
+// each node has at most a few snapshot records.
+func (r *db) snapshotIndexes(
+	updates []pb.Update) (map[raftio.NodeInfo][]uint64, error) {
+	result := make(map[raftio.NodeInfo][]uint64, len(updates))
+	first := raftio.GetNodeInfo(math.MaxUint64, math.MaxUint64)
+	last := raftio.GetNodeInfo(0, 0)
+	for _, ud := range updates {
+		ni := raftio.GetNodeInfo(ud.ClusterID, ud.NodeID)
+		result[ni] = nil
+		if nodeInfoLess(ni, first) {
+			first = ni
+		}
+		if nodeInfoLess(last, ni) {
+			last = ni
+		}
+	}
+	fk := r.keys.get()
+	lk := r.keys.get()
+	defer fk.Release()
+	defer lk.Release()
+	fk.setSnapshotKey(first.ClusterID, first.NodeID, 0)
+	lk.setSnapshotKey(last.ClusterID, last.NodeID, math.MaxUint64)
+	op := func(key []byte, data []byte) (bool, error) {
+		clusterID, nodeID, index, err := decodeEntryKey(key)
+		if err != nil {
+			return false, err
+		}
+		ni := raftio.GetNodeInfo(clusterID, nodeID)
+		if indexes, ok := result[ni]; ok {
+			result[ni] = append(indexes, index)
+		}
+		return true, nil
+	}
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (r *db) saveMaxIndex(wb *pebbleWriteBatch,
@@ -310,6 +533,14 @@ func (r *db) saveBootstrapInfo(clusterID uint64,
 	return r.kvs.CommitWriteBatch(wb)
 }
 
+func (r *db) saveBootstrapInfos(records []BootstrapRecord) error {
+	wb := r.getWriteBatch(nil)
+	for _, rec := range records {
+		r.saveBootstrap(wb, rec.ClusterID, rec.NodeID, rec.Bootstrap)
+	}
+	return r.kvs.CommitWriteBatch(wb)
+}
+
 func (r *db) getBootstrapInfo(clusterID uint64,
 	nodeID uint64) (pb.Bootstrap, error) {
 	k := newKey(maxKeySize, nil)
@@ -319,31 +550,37 @@ func (r *db) getBootstrapInfo(clusterID uint64,
 		if len(data) == 0 {
 			return raftio.ErrNoBootstrapInfo
 		}
-		pb.MustUnmarshal(&bootstrap, data)
-		return nil
+		return unmarshal(&bootstrap, data)
 	}); err != nil {
 		return pb.Bootstrap{}, err
 	}
 	return bootstrap, nil
 }
 
+// saveSnapshots saves the snapshots of all updates in a single write batch,
+// the existing snapshots of all nodes are looked up at once, so snapshots of
+// many nodes, e.g. saved after restarting a NodeHost, are saved as a group.
 func (r *db) saveSnapshots(updates []pb.Update) error {
-	wb := r.getWriteBatch(nil)
-	defer wb.Destroy()
-	toSave := false
+	toSave := make([]pb.Update, 0, len(updates))
 	for _, ud := range updates {
 		if !pb.IsEmptySnapshot(ud.Snapshot) &&
 			r.cs.trySaveSnapshot(ud.ClusterID, ud.NodeID, ud.Snapshot.Index) {
-			if err := r.saveSnapshot(wb, ud); err != nil {
-				return nil
-			}
-			toSave = true
+			toSave = append(toSave, ud)
 		}
 	}
-	if toSave {
-		return r.kvs.CommitWriteBatch(wb)
+	if len(toSave) == 0 {
+		return nil
 	}
-	return nil
+	existing, err := r.snapshotIndexes(toSave)
+	if err != nil {
+		return err
+	}
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	for _, ud := range toSave {
+		r.replaceSnapshot(wb, ud, existing)
+	}
+	return r.kvs.CommitWriteBatch(wb)
 }
 
 func (r *db) getSnapshot(clusterID uint64, nodeID uint64) (pb.Snapshot, error) {
@@ -363,6 +600,11 @@ func (r *db) getSnapshot(clusterID uint64, nodeID uint64) (pb.Snapshot, error) {
 // significant part of the key. from v3.4, we only store the latest snapshot in
 // LogDB and the least significant part of the key is set to math.MaxUint64.
 func (r *db) listSnapshots(clusterID uint64,
+	nodeID uint64, index uint64) ([]pb.Snapshot, error) {
+	return r.readSnapshots(r.kvs, clusterID, nodeID, index)
+}
+
+func (r *db) readSnapshots(kvs kvReader, clusterID uint64,
 	nodeID uint64, index uint64) ([]pb.Snapshot, error) {
 	fk := r.keys.get()
 	lk := r.keys.get()
@@ -373,11 +615,13 @@ func (r *db) listSnapshots(clusterID uint64,
 	snapshots := make([]pb.Snapshot, 0)
 	op := func(key []byte, data []byte) (bool, error) {
 		var ss pb.Snapshot
-		pb.MustUnmarshal(&ss, data)
+		if err := unmarshal(&ss, data); err != nil {
+			return false, err
+		}
 		snapshots = append(snapshots, ss)
 		return true, nil
 	}
-	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+	if err := kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
 		return []pb.Snapshot{}, err
 	}
 	return snapshots, nil
@@ -387,33 +631,83 @@ func (r *db) getMaxIndex(clusterID uint64, nodeID uint64) (uint64, error) {
 	if v, ok := r.cs.getMaxIndex(clusterID, nodeID); ok {
 		return v, nil
 	}
+	return r.readMaxIndex(r.kvs, clusterID, nodeID)
+}
+
+func (r *db) readMaxIndex(kvs kvReader,
+	clusterID uint64, nodeID uint64) (uint64, error) {
 	k := r.keys.get()
 	defer k.Release()
 	k.SetMaxIndexKey(clusterID, nodeID)
 	maxIndex := uint64(0)
-	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+	if err := kvs.GetValue(k.Key(), func(data []byte) error {
 		if len(data) == 0 {
 			return raftio.ErrNoSavedLog
 		}
-		maxIndex = binary.BigEndian.Uint64(data)
-		return nil
+		v, err := decodeIndex(data)
+		maxIndex = v
+		return err
 	}); err != nil {
 		return 0, err
 	}
 	return maxIndex, nil
 }
 
+// readStateAndMaxIndex reads the state and the max index of the specified
+// node using a single MultiGet, the max index is taken from the cache when
+// cached is true and the cache has it. The returned max index is 0 when the
+// node has no saved entry.
+func (r *db) readStateAndMaxIndex(kvs kvReader, clusterID uint64,
+	nodeID uint64, cached bool) (pb.State, uint64, error) {
+	if cached {
+		if v, ok := r.cs.getMaxIndex(clusterID, nodeID); ok {
+			state, err := r.readState(kvs, clusterID, nodeID)
+			return state, v, err
+		}
+	}
+	sk := r.keys.get()
+	defer sk.Release()
+	mk := r.keys.get()
+	defer mk.Release()
+	sk.SetStateKey(clusterID, nodeID)
+	mk.SetMaxIndexKey(clusterID, nodeID)
+	hs := pb.State{}
+	maxIndex := uint64(0)
+	if err := kvs.MultiGet([][]byte{sk.Key(), mk.Key()},
+		func(i int, data []byte) error {
+			if i == 0 {
+				if len(data) == 0 {
+					return raftio.ErrNoSavedLog
+				}
+				return unmarshal(&hs, data)
+			}
+			if len(data) == 0 {
+				return nil
+			}
+			v, err := decodeIndex(data)
+			maxIndex = v
+			return err
+		}); err != nil {
+		return pb.State{}, 0, err
+	}
+	return hs, maxIndex, nil
+}
+
 func (r *db) getState(clusterID uint64, nodeID uint64) (pb.State, error) {
+	return r.readState(r.kvs, clusterID, nodeID)
+}
+
+func (r *db) readState(kvs kvReader,
+	clusterID uint64, nodeID uint64) (pb.State, error) {
 	k := r.keys.get()
 	defer k.Release()
 	k.SetStateKey(clusterID, nodeID)
 	hs := pb.State{}
-	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+	if err := kvs.GetValue(k.Key(), func(data []byte) error {
 		if len(data) == 0 {
 			return raftio.ErrNoSavedLog
 		}
-		pb.MustUnmarshal(&hs, data)
-		return nil
+		return unmarshal(&hs, data)
 	}); err != nil {
 		return pb.State{}, err
 	}
@@ -422,25 +716,70 @@ func (r *db) getState(clusterID uint64, nodeID uint64) (pb.State, error) {
 
 func (r *db) removeEntriesTo(clusterID uint64,
 	nodeID uint64, index uint64) error {
+	r.ops.trim(clusterID, nodeID)
+	if err := r.invalidateAppliedIndex(clusterID, nodeID, index); err != nil {
+		return err
+	}
 	op := func(fk *Key, lk *Key) error {
 		return r.kvs.BulkRemoveEntries(fk.Key(), lk.Key())
 	}
-	return r.entries.rangedOp(clusterID, nodeID, index, op)
+	if err := r.entries.rangedOp(clusterID, nodeID, index, op); err != nil {
+		return err
+	}
+	if err := r.entries.remove(clusterID, nodeID, index); err != nil {
+		return err
+	}
+	r.cs.removeEntriesTo(clusterID, nodeID, index)
+	r.sizes.trim(clusterID, nodeID, index)
+	return nil
 }
 
+func (r *db) approximateNodeSize(clusterID uint64, nodeID uint64) (uint64, error) {
+	var sz uint64
+	op := func(fk *Key, lk *Key) (err error) {
+		sz, err = r.kvs.EstimateDiskUsage(fk.Key(), lk.Key())
+		return err
+	}
+	if err := r.entries.rangedOp(clusterID, nodeID, math.MaxUint64, op); err != nil {
+		return 0, err
+	}
+	return sz, nil
+}
+
+// removeNodeData atomically removes all records of the specified node,
+// entries are removed using a range deletion in the same write batch so a
+// crash can not leave entries of a node without its bootstrap record behind.
 func (r *db) removeNodeData(clusterID uint64, nodeID uint64) error {
 	wb := r.getWriteBatch(nil)
-	defer wb.Clear()
+	defer wb.Destroy()
 	snapshots, err := r.listSnapshots(clusterID, nodeID, math.MaxUint64)
 	if err != nil {
 		return err
 	}
 	r.saveRemoveNodeData(wb, snapshots, clusterID, nodeID)
+	mdKey := newKey(maxKeySize, nil)
+	mdKey.setNodeMetadataKey(clusterID, nodeID)
+	wb.Delete(mdKey.Key())
+	if err := r.saveRemoveSinkOffsets(wb, clusterID, nodeID); err != nil {
+		return err
+	}
+	if err := r.entries.rangedOp(clusterID, nodeID, math.MaxUint64,
+		func(fk *Key, lk *Key) error {
+			wb.DeleteRange(fk.Key(), lk.Key())
+			return nil
+		}); err != nil {
+		return err
+	}
 	if err := r.kvs.CommitWriteBatch(wb); err != nil {
 		return err
 	}
+	if err := r.entries.remove(clusterID, nodeID, math.MaxUint64); err != nil {
+		return err
+	}
 	r.cs.setMaxIndex(clusterID, nodeID, 0)
-	return r.removeEntriesTo(clusterID, nodeID, math.MaxUint64)
+	r.cs.dropSparseIndex(clusterID, nodeID)
+	r.sizes.forget(clusterID, nodeID)
+	return nil
 }
 
 func (r *db) saveRemoveNodeData(wb *pebbleWriteBatch,
@@ -454,6 +793,7 @@ func (r *db) saveRemoveNodeData(wb *pebbleWriteBatch,
 	miKey := newKey(maxKeySize, nil)
 	miKey.SetMaxIndexKey(clusterID, nodeID)
 	wb.Delete(miKey.Key())
+	r.saveRemoveAppliedIndex(wb, clusterID, nodeID)
 	for _, ss := range snapshots {
 		k := newKey(maxKeySize, nil)
 		k.setSnapshotKey(clusterID, nodeID, ss.Index)
@@ -468,20 +808,28 @@ func (r *db) compact(clusterID uint64, nodeID uint64, index uint64) error {
 	return r.entries.rangedOp(clusterID, nodeID, index, op)
 }
 
-func (r *db) saveEntries(updates []pb.Update, wb *pebbleWriteBatch, ctx IContext) {
+func (r *db) saveEntries(updates []pb.Update,
+	wb *pebbleWriteBatch, ctx IContext) error {
 	for _, ud := range updates {
 		if len(ud.EntriesToSave) > 0 {
-			mi := r.entries.record(wb, ud.ClusterID, ud.NodeID, ctx, ud.EntriesToSave)
+			mi, err := r.entries.record(wb, ud.ClusterID, ud.NodeID, ctx, ud.EntriesToSave)
+			if err != nil {
+				return err
+			}
 			if mi > 0 {
 				r.setMaxIndex(wb, ud, mi, ctx)
 			}
 		}
 	}
+	return nil
 }
 
-func (r *db) iterateEntries(ents []pb.Entry,
+func (r *db) iterateEntries(arena *EntryArena, ents []pb.Entry,
 	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
 	maxSize uint64) ([]pb.Entry, uint64, error) {
+	r.ops.read(clusterID, nodeID)
+	r.reads.acquire()
+	defer r.reads.release()
 	maxIndex, err := r.getMaxIndex(clusterID, nodeID)
 	if err == raftio.ErrNoSavedLog {
 		return ents, size, nil
@@ -490,13 +838,29 @@ func (r *db) iterateEntries(ents []pb.Entry,
 		err = errors.Wrapf(err, "%s failed to get max index", dn(clusterID, nodeID))
 		return nil, 0, err
 	}
-	entries, sz, err := r.entries.iterate(ents, maxIndex, size,
+	entries, sz, err := r.entries.iterate(arena, ents, maxIndex, size,
 		clusterID, nodeID, low, high, maxSize)
 	err = errors.Wrapf(err, "%s failed to iterate entries, %d, %d, %d, %d",
 		dn(clusterID, nodeID), low, high, maxSize, maxIndex)
 	return entries, sz, err
 }
 
+// unmarshal is similar to pb.MustUnmarshal but returns ErrCorruptedRecord
+// rather than panicking when data read from the storage can not be decoded.
+func unmarshal(m pb.Unmarshaler, data []byte) error {
+	if err := m.Unmarshal(data); err != nil {
+		return errors.Wrapf(ErrCorruptedRecord, "%v", err)
+	}
+	return nil
+}
+
+func decodeIndex(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errors.Wrapf(ErrCorruptedRecord, "index size %d", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
 const mod = 100000
 
 func dn(clusterID uint64, nodeID uint64) string {
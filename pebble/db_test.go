@@ -69,7 +69,7 @@ func getNewTestDB(dir string, lldir string, fs vfs.FS) raftio.ILogDB {
 	cfg.FS = fs
 
 	db, err := NewLogDB(cfg, nil,
-		[]string{d}, []string{lld}, false)
+		[]string{d}, []string{lld}, CheckNone)
 	if err != nil {
 		panic(err)
 	}
@@ -166,6 +166,74 @@ func TestBootstrapInfoCanBeSavedAndChecked(t *testing.T) {
 	runLogDBTest(t, tf, fs)
 }
 
+func TestBootstrapInfosCanBeSavedInBatch(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		records := make([]BootstrapRecord, 0)
+		for cid := uint64(1); cid <= 100; cid++ {
+			records = append(records, BootstrapRecord{
+				ClusterID: cid,
+				NodeID:    cid + 1,
+				Bootstrap: pb.Bootstrap{Addresses: map[uint64]string{cid + 1: "address"}},
+			})
+		}
+		require.NoError(t, sdb.SaveBootstrapInfos(records))
+		for _, rec := range records {
+			bs, err := db.GetBootstrapInfo(rec.ClusterID, rec.NodeID)
+			require.NoError(t, err)
+			require.Equal(t, rec.Bootstrap.Addresses, bs.Addresses)
+		}
+		ni, err := db.ListNodeInfo()
+		require.NoError(t, err)
+		require.Len(t, ni, 100)
+		require.NoError(t, sdb.SaveBootstrapInfos(nil))
+	}
+	fs := vfs.NewMem()
+	runLogDBTest(t, tf, fs)
+}
+
+func TestNodeInfoCanBeIterated(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		for cid := uint64(1); cid <= 20; cid++ {
+			for nid := uint64(1); nid <= 3; nid++ {
+				require.NoError(t, db.SaveBootstrapInfo(cid, nid, pb.Bootstrap{}))
+			}
+		}
+		var all []raftio.NodeInfo
+		require.NoError(t, sdb.IterateNodeInfo(func(ni raftio.NodeInfo) (bool, error) {
+			all = append(all, ni)
+			return true, nil
+		}))
+		ni, err := db.ListNodeInfo()
+		require.NoError(t, err)
+		require.Equal(t, ni, all)
+		count := 0
+		require.NoError(t, sdb.IterateNodeInfo(func(ni raftio.NodeInfo) (bool, error) {
+			count++
+			return count < 5, nil
+		}))
+		require.Equal(t, 5, count)
+		var cluster []raftio.NodeInfo
+		require.NoError(t, sdb.IterateClusterNodeInfo(7, func(ni raftio.NodeInfo) (bool, error) {
+			cluster = append(cluster, ni)
+			return true, nil
+		}))
+		require.Equal(t, []raftio.NodeInfo{
+			raftio.GetNodeInfo(7, 1),
+			raftio.GetNodeInfo(7, 2),
+			raftio.GetNodeInfo(7, 3),
+		}, cluster)
+		opErr := errors.New("stop")
+		err = sdb.IterateClusterNodeInfo(7, func(ni raftio.NodeInfo) (bool, error) {
+			return false, opErr
+		})
+		require.ErrorIs(t, err, opErr)
+	}
+	fs := vfs.NewMem()
+	runLogDBTest(t, tf, fs)
+}
+
 func TestSnapshotHasMaxIndexSet(t *testing.T) {
 	tf := func(t *testing.T, db raftio.ILogDB) {
 		ud1 := pb.Update{
@@ -910,6 +978,68 @@ func TestOldSnapshotIsIgnored(t *testing.T) {
 	runLogDBTest(t, tf, fs)
 }
 
+func TestSnapshotsOfManyNodesCanBeSavedAtOnce(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		for nid := uint64(1); nid <= 6; nid++ {
+			require.NoError(t, db.SaveSnapshots([]pb.Update{{
+				ClusterID: 1,
+				NodeID:    nid,
+				Snapshot:  pb.Snapshot{Index: 10, Term: 1},
+			}}))
+		}
+		updates := make([]pb.Update, 0)
+		for _, nid := range []uint64{5, 1, 3} {
+			updates = append(updates, pb.Update{
+				ClusterID: 1,
+				NodeID:    nid,
+				Snapshot:  pb.Snapshot{Index: 10 + nid, Term: 1},
+			})
+		}
+		updates = append(updates, pb.Update{
+			ClusterID: 1,
+			NodeID:    3,
+			Snapshot:  pb.Snapshot{Index: 20, Term: 1},
+		})
+		require.NoError(t, db.SaveSnapshots(updates))
+		shard, err := sdb.shard(sdb.partitioner.GetPartitionID(1))
+		require.NoError(t, err)
+		for nid, index := range map[uint64]uint64{1: 11, 2: 10, 3: 20, 4: 10, 5: 15, 6: 10} {
+			snapshots, err := shard.listSnapshots(1, nid, math.MaxUint64)
+			require.NoError(t, err)
+			require.Len(t, snapshots, 1)
+			require.Equal(t, index, snapshots[0].Index)
+		}
+	}
+	fs := vfs.NewMem()
+	runLogDBTest(t, tf, fs)
+}
+
+func TestFailedSnapshotIsReported(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		shard, err := sdb.shard(sdb.partitioner.GetPartitionID(1))
+		require.NoError(t, err)
+		// existing snapshots can not be listed once a corrupted snapshot key
+		// is found
+		k := newKey(snapshotKeySize, nil)
+		k.setSnapshotKey(1, 1, 5)
+		require.NoError(t, shard.kvs.SaveValue(append(k.Key(), 0), nil))
+		ud := pb.Update{
+			ClusterID: 1,
+			NodeID:    1,
+			State:     pb.State{Term: 1, Commit: 10},
+			Snapshot:  pb.Snapshot{Index: 10, Term: 1},
+		}
+		err = db.SaveRaftState([]pb.Update{ud}, 1)
+		require.True(t, errors.Is(err, ErrCorruptedRecord))
+		ud.Snapshot.Index = 11
+		require.True(t, errors.Is(db.SaveSnapshots([]pb.Update{ud}), ErrCorruptedRecord))
+	}
+	fs := vfs.NewMem()
+	runLogDBTest(t, tf, fs)
+}
+
 func TestParseNodeInfoKeyPanicOnUnexpectedKeySize(t *testing.T) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -1343,3 +1473,78 @@ func TestImportSnapshot(t *testing.T) {
 	fs := vfs.NewMem()
 	runLogDBTest(t, tf, fs)
 }
+
+func TestFlushAndFlushOnClose(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	var flushes uint64
+	cfg.EngineEventListener = func(ev EngineEvent) {
+		require.NoError(t, ev.Err)
+		if ev.Type == FlushEnd && ev.OutputBytes > 0 {
+			atomic.AddUint64(&flushes, 1)
+		}
+	}
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 100)
+	require.NoError(t, db.Flush())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&flushes))
+	saveTestNode(t, db, 3, 4, 100)
+	require.NoError(t, db.Close())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&flushes))
+
+	cfg.FlushOnClose = true
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	// the WAL written by the previous instance is flushed when replayed
+	atomic.StoreUint64(&flushes, 0)
+	saveTestNode(t, db, 5, 6, 100)
+	require.NoError(t, db.Close())
+	require.Equal(t, uint64(1), atomic.LoadUint64(&flushes))
+
+	cfg.FlushOnClose = false
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for _, cid := range []uint64{1, 3, 5} {
+		rs, err := db.ReadRaftState(cid, cid+1, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), rs.EntryCount)
+	}
+}
+
+func TestFactoryReturnsErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := FactoryWithError(cfg)(nil, RDBTestDirectory, RDBTestDirectory)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	var openErr error
+	db = CaptureFactory(cfg, &openErr)(nil, RDBTestDirectory, RDBTestDirectory)
+	require.NoError(t, openErr)
+	require.NoError(t, db.Close())
+
+	cfg.RelaxedSyncInterval = time.Second
+	db, err = FactoryWithError(cfg)(nil, RDBTestDirectory, RDBTestDirectory)
+	require.ErrorIs(t, err, ErrRelaxedDurabilityNotAccepted)
+	require.Nil(t, db)
+	require.Panics(t, func() {
+		Factory(cfg)(nil, RDBTestDirectory, RDBTestDirectory)
+	})
+	require.Panics(t, func() {
+		MustFactory(cfg)(nil, RDBTestDirectory, RDBTestDirectory)
+	})
+	require.Panics(t, func() {
+		CaptureFactory(cfg, &openErr)(nil, RDBTestDirectory, RDBTestDirectory)
+	})
+	require.ErrorIs(t, openErr, ErrRelaxedDurabilityNotAccepted)
+}
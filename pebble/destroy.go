@@ -0,0 +1,103 @@
+package pebble
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// Destroy closes the ShardedDB instance and removes the directories of all
+// its shards, including their WAL directories, and the layout files. Other
+// content of the directories the LogDB was opened with is left untouched.
+func (s *ShardedDB) Destroy() error {
+	if s.config.ReadOnly {
+		return errors.New("can not destroy a read-only LogDB")
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	fs := s.config.FS
+	parents := make([]string, 0)
+	for i := range s.shards {
+		parents = append(parents, s.dirs[i])
+		if err := fs.RemoveAll(fs.PathJoin(s.dirs[i], shardDirName(uint64(i)))); err != nil {
+			return errors.WithStack(err)
+		}
+		if len(s.lldirs) > 0 {
+			parents = append(parents, s.lldirs[i])
+			if err := fs.RemoveAll(fs.PathJoin(s.lldirs[i], shardDirName(uint64(i)))); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	for _, dir := range uniqueDirs(parents) {
+		err := fs.RemoveAll(fs.PathJoin(dir, layoutFilename))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return syncDirs(parents, fs)
+}
+
+// DestroyLogDB removes all LogDB shard directories and layout files found in
+// dirs and lldirs, which are the directories the LogDB was created with. The
+// LogDB must not be open.
+func DestroyLogDB(dirs []string, lldirs []string, fs vfs.FS) error {
+	parents := make([]string, 0)
+	for _, dir := range uniqueDirs(append(append([]string{}, dirs...), lldirs...)) {
+		exist, err := fileutil.DirExist(dir, fs)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !exist {
+			continue
+		}
+		names, err := fs.List(dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, name := range names {
+			if !isShardDirName(name) && name != layoutFilename {
+				continue
+			}
+			if err := fs.RemoveAll(fs.PathJoin(dir, name)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		parents = append(parents, dir)
+	}
+	return syncDirs(parents, fs)
+}
+
+func isShardDirName(name string) bool {
+	if !strings.HasPrefix(name, shardDirPrefix) {
+		return false
+	}
+	shard, err := strconv.ParseUint(name[len(shardDirPrefix):], 10, 64)
+	return err == nil && shardDirName(shard) == name
+}
+
+func uniqueDirs(dirs []string) []string {
+	seen := make(map[string]struct{})
+	result := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if _, ok := seen[dir]; !ok {
+			seen[dir] = struct{}{}
+			result = append(result, dir)
+		}
+	}
+	return result
+}
+
+// syncDirs makes the removal of shard directories durable.
+func syncDirs(dirs []string, fs vfs.FS) error {
+	for _, dir := range uniqueDirs(dirs) {
+		if err := fileutil.SyncDir(dir, fs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestroyRemovesShardDirs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	other := fs.PathJoin(dir, "other")
+	require.NoError(t, fs.MkdirAll(other, 0o755))
+	require.NoError(t, db.Destroy())
+	names, err := fs.List(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"other"}, names)
+	names, err = fs.List(lldir)
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestDestroyLogDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	require.NoError(t, db.Close())
+	require.NoError(t, fs.MkdirAll(fs.PathJoin(dir, "logdb-x"), 0o755))
+	require.NoError(t, DestroyLogDB([]string{dir}, []string{lldir}, fs))
+	for i := uint64(0); i < cfg.Shards; i++ {
+		exist, err := fileutil.DirExist(fs.PathJoin(dir, shardDirName(i)), fs)
+		require.NoError(t, err)
+		require.False(t, exist)
+	}
+	names, err := fs.List(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"logdb-x"}, names)
+	require.NoError(t, DestroyLogDB([]string{fs.PathJoin(RDBTestDirectory, "missing")}, nil, fs))
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	nodes, err := db.ListNodeInfo()
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+}
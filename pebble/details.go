@@ -0,0 +1,106 @@
+package pebble
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/pkg/errors"
+)
+
+// NodeDetails contains the inventory information of a single node as
+// returned by ListNodeDetails.
+type NodeDetails struct {
+	ClusterID uint64
+	NodeID    uint64
+	// FirstIndex and LastIndex are the indexes of the first and the last
+	// entry available after the latest snapshot, both are 0 when there is no
+	// such entry.
+	FirstIndex uint64
+	LastIndex  uint64
+	// LastTerm is the term of the entry at LastIndex.
+	LastTerm      uint64
+	SnapshotIndex uint64
+	// EntryBytes is the approximate disk space used by entries of the node.
+	EntryBytes uint64
+	// LastWrite is the time of the most recent raft state update of the node
+	// since the LogDB was opened, it is zero when there has been no such
+	// update.
+	LastWrite time.Time
+}
+
+// ListNodeDetails returns the inventory information of all nodes found in
+// the LogDB sorted by ClusterID and NodeID.
+func (s *ShardedDB) ListNodeDetails() ([]NodeDetails, error) {
+	shards, err := s.allShards()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]NodeDetails, 0)
+	for _, shard := range shards {
+		details, err := shard.listNodeDetails()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, details...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return nodeInfoLess(
+			raftio.GetNodeInfo(result[i].ClusterID, result[i].NodeID),
+			raftio.GetNodeInfo(result[j].ClusterID, result[j].NodeID))
+	})
+	return result, nil
+}
+
+func (r *db) listNodeDetails() ([]NodeDetails, error) {
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]NodeDetails, 0, len(ni))
+	for _, n := range ni {
+		d, err := r.getNodeDetails(n.ClusterID, n.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+func (r *db) getNodeDetails(clusterID uint64, nodeID uint64) (NodeDetails, error) {
+	d := NodeDetails{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		LastWrite: r.cs.getLastWrite(clusterID, nodeID),
+	}
+	snapshots, err := r.listSnapshots(clusterID, nodeID, math.MaxUint64)
+	if err != nil {
+		return NodeDetails{}, err
+	}
+	if len(snapshots) > 0 {
+		d.SnapshotIndex = snapshots[len(snapshots)-1].Index
+	}
+	firstIndex, length, err := r.getRange(r.kvs,
+		clusterID, nodeID, d.SnapshotIndex, true)
+	if err != nil {
+		return NodeDetails{}, err
+	}
+	if length > 0 {
+		d.FirstIndex = firstIndex
+		d.LastIndex = firstIndex + length - 1
+		ents, _, err := r.entries.iterate(nil, nil, d.LastIndex, 0,
+			clusterID, nodeID, d.LastIndex, d.LastIndex+1, math.MaxUint64)
+		if err != nil {
+			return NodeDetails{}, err
+		}
+		if len(ents) > 0 {
+			d.LastTerm = ents[0].Term
+		}
+	}
+	if d.EntryBytes, err = r.approximateNodeSize(clusterID, nodeID); err != nil {
+		return NodeDetails{}, err
+	}
+	return d, nil
+}
@@ -0,0 +1,42 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListNodeDetails(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		before := time.Now()
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 17, 2, 20)
+		require.NoError(t, db.SaveBootstrapInfo(3, 4, pb.Bootstrap{}))
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 17,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 15, Term: 1},
+		}}))
+		details, err := sdb.ListNodeDetails()
+		require.NoError(t, err)
+		require.Len(t, details, 3)
+		require.Equal(t, uint64(1), details[0].ClusterID)
+		require.Equal(t, uint64(1), details[0].FirstIndex)
+		require.Equal(t, uint64(10), details[0].LastIndex)
+		require.Equal(t, uint64(1), details[0].LastTerm)
+		require.Equal(t, uint64(0), details[0].SnapshotIndex)
+		require.False(t, details[0].LastWrite.Before(before))
+		require.Equal(t, NodeDetails{ClusterID: 3, NodeID: 4}, details[1])
+		require.Equal(t, uint64(17), details[2].ClusterID)
+		require.Equal(t, uint64(15), details[2].FirstIndex)
+		require.Equal(t, uint64(20), details[2].LastIndex)
+		require.Equal(t, uint64(15), details[2].SnapshotIndex)
+		require.False(t, details[2].LastWrite.IsZero())
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,98 @@
+package pebble
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// digestBatchSize is the max total size of entries loaded at once when
+// computing range digests.
+const digestBatchSize = 4 * 1024 * 1024
+
+// RangeDigest is the digest of entries of a node with indexes in the range
+// of [Low, High). Digests of the same range computed by two LogDBs are equal
+// only when both hold identical entries in the range.
+type RangeDigest struct {
+	Low  uint64
+	High uint64
+	// Entries is the number of entries found in the range, entries already
+	// removed from the LogDB are not covered by the digest.
+	Entries uint64
+	// Sum is the SHA-256 of the entries found in the range.
+	Sum []byte
+}
+
+// Equal returns a boolean value indicating whether both digests cover the
+// same range with identical entries.
+func (d RangeDigest) Equal(other RangeDigest) bool {
+	return d.Low == other.Low && d.High == other.High &&
+		d.Entries == other.Entries && bytes.Equal(d.Sum, other.Sum)
+}
+
+// GetRangeDigests returns digests of entries of the specified node with
+// indexes in the range of [low, high), one digest for every step entries.
+// The whole range is covered by a single digest when step is 0. Comparing
+// digests computed by a primary LogDB and by its copy allows to locate
+// diverged entries without transferring them.
+func (s *ShardedDB) GetRangeDigests(clusterID uint64, nodeID uint64,
+	low uint64, high uint64, step uint64) ([]RangeDigest, error) {
+	if low >= high {
+		return nil, errors.Errorf("invalid range [%d, %d)", low, high)
+	}
+	if step == 0 {
+		step = high - low
+	}
+	var result []RangeDigest
+	next := low
+	buf := make([]byte, binary.MaxVarintLen64)
+	for start := low; start < high; start += step {
+		end := start + step
+		if end > high || end < start {
+			end = high
+		}
+		d := RangeDigest{Low: start, High: end}
+		h := sha256.New()
+		for next < end {
+			ents, _, err := s.IterateEntries(nil, 0,
+				clusterID, nodeID, next, end, digestBatchSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(ents) == 0 {
+				break
+			}
+			for i := range ents {
+				data, err := ents[i].Marshal()
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				n := binary.PutUvarint(buf, uint64(len(data)))
+				h.Write(buf[:n])
+				h.Write(data)
+			}
+			d.Entries += uint64(len(ents))
+			next = ents[len(ents)-1].Index + 1
+		}
+		next = end
+		d.Sum = h.Sum(nil)
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// FirstDivergence returns the first digest of a which is not equal to the
+// digest of the same range in b, ok is false when no such digest is found.
+// Both a and b are expected to be returned by GetRangeDigests called with the
+// same range and step.
+func FirstDivergence(a []RangeDigest,
+	b []RangeDigest) (d RangeDigest, ok bool) {
+	for i := range a {
+		if i >= len(b) || !a[i].Equal(b[i]) {
+			return a[i], true
+		}
+	}
+	return RangeDigest{}, false
+}
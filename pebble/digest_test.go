@@ -0,0 +1,65 @@
+package pebble
+
+import (
+	"testing"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeDigestsLocateDivergedEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	primary, err := NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, primary.Close())
+	}()
+	copied, err := NewLogDB(cfg, nil, []string{"copy"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, copied.Close())
+	}()
+	saveWatchTestEntries(t, primary, 1, 100, 100)
+	saveWatchTestEntries(t, copied, 1, 100, 100)
+
+	_, err = primary.GetRangeDigests(1, 2, 10, 10, 0)
+	require.Error(t, err)
+	a, err := primary.GetRangeDigests(1, 2, 1, 101, 0)
+	require.NoError(t, err)
+	require.Len(t, a, 1)
+	require.Equal(t, uint64(100), a[0].Entries)
+	b, err := copied.GetRangeDigests(1, 2, 1, 101, 0)
+	require.NoError(t, err)
+	_, diverged := FirstDivergence(a, b)
+	require.False(t, diverged)
+
+	// entry 57 overwritten with a different term
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 2, Commit: 100},
+		EntriesToSave: []pb.Entry{{Index: 57, Term: 2}},
+	}
+	require.NoError(t, copied.SaveRaftStateCtx([]pb.Update{ud}, copied.GetLogDBThreadContext()))
+	saveWatchTestEntries(t, copied, 58, 100, 100)
+	a, err = primary.GetRangeDigests(1, 2, 1, 101, 10)
+	require.NoError(t, err)
+	require.Len(t, a, 10)
+	b, err = copied.GetRangeDigests(1, 2, 1, 101, 10)
+	require.NoError(t, err)
+	d, diverged := FirstDivergence(a, b)
+	require.True(t, diverged)
+	require.Equal(t, uint64(51), d.Low)
+	require.Equal(t, uint64(61), d.High)
+
+	// removed entries are not covered
+	require.NoError(t, primary.RemoveEntriesTo(1, 2, 20))
+	a, err = primary.GetRangeDigests(1, 2, 1, 31, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), a[0].Entries)
+	require.Equal(t, uint64(10), a[2].Entries)
+}
@@ -0,0 +1,146 @@
+package pebble
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// dragonboatFlagFilename is the name of the flag file written by NodeHosts
+// into the directories holding their LogDB shards.
+const dragonboatFlagFilename = "dragonboat.ds"
+
+// ErrIncompatibleDragonboat indicates that the directory contains a LogDB
+// created by dragonboat which can not be opened in place.
+var ErrIncompatibleDragonboat = errors.New("incompatible dragonboat LogDB")
+
+// DragonboatLayout describes a LogDB directory created by a dragonboat
+// NodeHost as returned by DetectDragonboat.
+type DragonboatLayout struct {
+	// Shards is the number of shard directories found in the directory, it is
+	// the highest shard number plus one.
+	Shards uint64
+	// BinVer is the LogDB binary format recorded in the flag file of the
+	// NodeHost.
+	BinVer       uint32
+	Hostname     string
+	DeploymentID uint64
+}
+
+// Compatible returns nil when the LogDB can be opened in place using the
+// specified config. The plain binary format and the key layout of
+// dragonboat's pebble based LogDB are the ones used by this package, so such
+// directories are opened directly, without importing their records. LogDBs
+// using the batched binary format and configs with a number of shards other
+// than the one found in the directory are rejected, clusters are assigned to
+// shards by their cluster ID modulo the number of shards, so their records
+// would not be found.
+func (l DragonboatLayout) Compatible(config LogDBConfig) error {
+	if l.BinVer != raftio.PlainLogDBBinVersion {
+		return errors.Wrapf(ErrIncompatibleDragonboat,
+			"binary format %d not supported", l.BinVer)
+	}
+	if l.Shards != config.Shards {
+		return errors.Wrapf(ErrIncompatibleDragonboat,
+			"%d shards found, %d configured", l.Shards, config.Shards)
+	}
+	return nil
+}
+
+// DetectDragonboat inspects the specified LogDB directory, false is returned
+// when it does not contain the flag file of a NodeHost. The flag file is
+// written by dragonboat and Tugboat NodeHosts alike, so directories of both
+// are detected.
+func DetectDragonboat(dir string, fs vfs.FS) (DragonboatLayout, bool, error) {
+	status, ok, err := readDragonboatFlagFile(dir, fs)
+	if err != nil || !ok {
+		return DragonboatLayout{}, false, err
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return DragonboatLayout{}, false, errors.WithStack(err)
+	}
+	layout := DragonboatLayout{
+		BinVer:       status.BinVer,
+		Hostname:     status.Hostname,
+		DeploymentID: status.DeploymentId,
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, shardDirPrefix) {
+			continue
+		}
+		shard, err := strconv.ParseUint(name[len(shardDirPrefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+		if shard+1 > layout.Shards {
+			layout.Shards = shard + 1
+		}
+	}
+	return layout, true, nil
+}
+
+// readDragonboatFlagFile reads the flag file in dir, it starts with the last 8
+// bytes of the MD5 hash of the marshaled RaftDataStatus that follows.
+func readDragonboatFlagFile(dir string,
+	fs vfs.FS) (pb.RaftDataStatus, bool, error) {
+	f, err := fs.Open(fs.PathJoin(dir, dragonboatFlagFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return pb.RaftDataStatus{}, false, nil
+		}
+		return pb.RaftDataStatus{}, false, errors.WithStack(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return pb.RaftDataStatus{}, false, errors.WithStack(err)
+	}
+	if len(data) < 8 {
+		return pb.RaftDataStatus{}, false, errors.Errorf("corrupted flag file in %s", dir)
+	}
+	h := md5.Sum(data[8:])
+	if !bytes.Equal(data[:8], h[8:]) {
+		return pb.RaftDataStatus{}, false, errors.Errorf("corrupted flag file in %s", dir)
+	}
+	var status pb.RaftDataStatus
+	if err := status.Unmarshal(data[8:]); err != nil {
+		return pb.RaftDataStatus{}, false, errors.WithStack(err)
+	}
+	return status, true, nil
+}
+
+// checkDragonboat verifies that the LogDBs created by dragonboat in dirs can
+// be opened in place using the specified config. Directories with a layout
+// file were already opened by this package, their shards might not all have
+// been created yet, see LogDBConfig.OpenClusters, so they are not checked.
+func checkDragonboat(config LogDBConfig, dirs []string) error {
+	for _, dir := range uniqueDirs(dirs) {
+		_, versioned, err := readLayoutVersion(dir, config.FS)
+		if err != nil {
+			return err
+		}
+		if versioned {
+			continue
+		}
+		layout, ok, err := DetectDragonboat(dir, config.FS)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := layout.Compatible(config); err != nil {
+			return errors.Wrapf(err, "%s", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package pebble
+
+import (
+	"crypto/md5"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDragonboatFlagFile(t *testing.T,
+	dir string, status pb.RaftDataStatus, fs vfs.FS) {
+	data, err := status.Marshal()
+	require.NoError(t, err)
+	h := md5.Sum(data)
+	f, err := fs.Create(fs.PathJoin(dir, dragonboatFlagFilename))
+	require.NoError(t, err)
+	_, err = f.Write(append(h[8:], data...))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestDragonboatLogDBIsOpenedInPlace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	dirs := []string{RDBTestDirectory}
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 4
+	db, err := NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 3, 4, 10)
+	require.NoError(t, db.Close())
+	_, ok, err := DetectDragonboat(RDBTestDirectory, fs)
+	require.NoError(t, err)
+	require.False(t, ok)
+	// dragonboat does not write layout files
+	require.NoError(t, fs.Remove(fs.PathJoin(RDBTestDirectory, layoutFilename)))
+	writeDragonboatFlagFile(t, RDBTestDirectory, pb.RaftDataStatus{
+		BinVer:       raftio.PlainLogDBBinVersion,
+		Hostname:     "host",
+		DeploymentId: 5,
+	}, fs)
+	layout, ok, err := DetectDragonboat(RDBTestDirectory, fs)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, DragonboatLayout{
+		Shards:       4,
+		BinVer:       raftio.PlainLogDBBinVersion,
+		Hostname:     "host",
+		DeploymentID: 5,
+	}, layout)
+	for _, shards := range []uint64{2, 8} {
+		cfg.Shards = shards
+		_, err = NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+		require.True(t, errors.Is(err, ErrIncompatibleDragonboat))
+	}
+	cfg.Shards = 4
+	db, err = NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	ni, err := db.ListNodeInfo()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []raftio.NodeInfo{
+		{ClusterID: 1, NodeID: 2}, {ClusterID: 3, NodeID: 4}}, ni)
+	rs, err := db.ReadRaftState(3, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.NoError(t, db.Close())
+}
+
+func TestBatchedDragonboatLogDBIsRejected(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	require.NoError(t, fs.MkdirAll(RDBTestDirectory, 0755))
+	writeDragonboatFlagFile(t, RDBTestDirectory,
+		pb.RaftDataStatus{BinVer: raftio.LogDBBinVersion}, fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	_, err := NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.True(t, errors.Is(err, ErrIncompatibleDragonboat))
+}
+
+func TestCorruptedDragonboatFlagFile(t *testing.T) {
+	fs := vfs.NewMem()
+	require.NoError(t, fs.MkdirAll(RDBTestDirectory, 0755))
+	f, err := fs.Create(fs.PathJoin(RDBTestDirectory, dragonboatFlagFilename))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, _, err = DetectDragonboat(RDBTestDirectory, fs)
+	require.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package pebble
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func getFileFlags(t *testing.T, f interface{}) int {
+	fd := f.(*os.File).Fd()
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	require.Zero(t, errno)
+	return int(flags)
+}
+
+func TestPebbleFSOpensWALWithDSync(t *testing.T) {
+	dir := t.TempDir()
+	pfs := newPebbleFS(vfs.Default, LogDBConfig{WALDSync: true})
+	wal, err := pfs.Create(filepath.Join(dir, "000001.log"))
+	require.NoError(t, err)
+	defer wal.Close()
+	require.NotZero(t, getFileFlags(t, wal)&syscall.O_DSYNC)
+	sst, err := pfs.Create(filepath.Join(dir, "000002.sst"))
+	require.NoError(t, err)
+	defer sst.Close()
+	require.Zero(t, getFileFlags(t, sst)&syscall.O_DSYNC)
+	reused, err := pfs.ReuseForWrite(filepath.Join(dir, "000001.log"), filepath.Join(dir, "000003.log"))
+	require.NoError(t, err)
+	defer reused.Close()
+	require.NotZero(t, getFileFlags(t, reused)&syscall.O_DSYNC)
+}
+
+func TestLogDBWithDSync(t *testing.T) {
+	cfg := GetTinyMemLogDBConfig()
+	cfg.Shards = 2
+	cfg.WALDSync = true
+	cfg.TableDSync = true
+	dir := t.TempDir()
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+}
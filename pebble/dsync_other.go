@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package pebble
+
+import (
+	"github.com/lni/vfs"
+)
+
+const dsyncSupported = false
+
+func openDSync(name string, flag int) (vfs.File, error) {
+	panic("O_DSYNC not supported")
+}
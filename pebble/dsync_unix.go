@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package pebble
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const dsyncSupported = true
+
+func openDSync(name string, flag int) (vfs.File, error) {
+	f, err := os.OpenFile(name,
+		os.O_RDWR|os.O_CREATE|syscall.O_CLOEXEC|syscall.O_DSYNC|flag, 0666)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
@@ -0,0 +1,117 @@
+package pebble
+
+import (
+	"math"
+	"sort"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+)
+
+// NodeState is the persistent raft state of a single node as returned by
+// DumpStates.
+type NodeState struct {
+	ClusterID     uint64
+	NodeID        uint64
+	State         pb.State
+	MaxIndex      uint64
+	SnapshotIndex uint64
+}
+
+// DumpStates returns the persistent raft state, max index and latest snapshot
+// index of all nodes found in the LogDB. Each shard is scanned once per record
+// type rather than issuing separate reads for each node.
+func (s *ShardedDB) DumpStates() ([]NodeState, error) {
+	shards, err := s.allShards()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]NodeState, 0)
+	for _, shard := range shards {
+		states, err := shard.dumpStates()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, states...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return nodeInfoLess(
+			raftio.GetNodeInfo(result[i].ClusterID, result[i].NodeID),
+			raftio.GetNodeInfo(result[j].ClusterID, result[j].NodeID))
+	})
+	return result, nil
+}
+
+func (r *db) dumpStates() ([]NodeState, error) {
+	nodes := make(map[raftio.NodeInfo]*NodeState)
+	get := func(clusterID uint64, nodeID uint64) *NodeState {
+		key := raftio.GetNodeInfo(clusterID, nodeID)
+		n, ok := nodes[key]
+		if !ok {
+			n = &NodeState{ClusterID: clusterID, NodeID: nodeID}
+			nodes[key] = n
+		}
+		return n
+	}
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range ni {
+		get(n.ClusterID, n.NodeID)
+	}
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	fk.SetStateKey(0, 0)
+	lk.SetStateKey(math.MaxUint64, math.MaxUint64)
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			clusterID, nodeID, err := decodeNodeInfoKey(key)
+			if err != nil {
+				return false, err
+			}
+			n := get(clusterID, nodeID)
+			if err := unmarshal(&n.State, data); err != nil {
+				return false, err
+			}
+			return true, nil
+		}); err != nil {
+		return nil, err
+	}
+	fk.SetMaxIndexKey(0, 0)
+	lk.SetMaxIndexKey(math.MaxUint64, math.MaxUint64)
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			clusterID, nodeID, err := decodeNodeInfoKey(key)
+			if err != nil {
+				return false, err
+			}
+			n := get(clusterID, nodeID)
+			n.MaxIndex, err = decodeIndex(data)
+			return err == nil, err
+		}); err != nil {
+		return nil, err
+	}
+	fk.setSnapshotKey(0, 0, 0)
+	lk.setSnapshotKey(math.MaxUint64, math.MaxUint64, math.MaxUint64)
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			// snapshot keys share the layout of entry keys
+			clusterID, nodeID, index, err := decodeEntryKey(key)
+			if err != nil {
+				return false, err
+			}
+			n := get(clusterID, nodeID)
+			if index > n.SnapshotIndex {
+				n.SnapshotIndex = index
+			}
+			return true, nil
+		}); err != nil {
+		return nil, err
+	}
+	result := make([]NodeState, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, *n)
+	}
+	return result, nil
+}
@@ -0,0 +1,36 @@
+package pebble
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpStates(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 17, 2, 20)
+		require.NoError(t, db.SaveBootstrapInfo(3, 4, pb.Bootstrap{}))
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 17,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 15, Term: 1},
+		}}))
+		states, err := sdb.DumpStates()
+		require.NoError(t, err)
+		require.Equal(t, []NodeState{
+			{ClusterID: 1, NodeID: 2, State: pb.State{Term: 1, Vote: 2, Commit: 10}, MaxIndex: 10},
+			{ClusterID: 3, NodeID: 4},
+			{ClusterID: 17, NodeID: 2, State: pb.State{Term: 1, Vote: 2, Commit: 20},
+				MaxIndex: 20, SnapshotIndex: 15},
+		}, states)
+		_, err = json.Marshal(states)
+		require.NoError(t, err)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
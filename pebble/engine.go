@@ -0,0 +1,114 @@
+package pebble
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/coufalja/tugboat/logdb"
+	"github.com/pkg/errors"
+)
+
+// PebbleEngine is the name of the storage engine implemented by this package,
+// it is used when LogDBConfig.Engine is empty.
+const PebbleEngine = "pebble"
+
+// ErrUnknownEngine indicates that no storage engine was registered with the
+// requested name.
+var ErrUnknownEngine = errors.New("unknown storage engine")
+
+// LogDBFactory creates LogDB instances backed by a storage engine. Engines
+// register their factory using RegisterEngine, usually from an init function,
+// so engines implemented in other modules are available to OpenLogDB by
+// importing their package, without this package importing them.
+type LogDBFactory interface {
+	// Create creates a LogDB instance in the specified dirs, with the low
+	// latency data placed in lldirs.
+	Create(config LogDBConfig, callback logdb.LogDBCallback,
+		dirs []string, lldirs []string) (ILogDB, error)
+	// Name returns the name of the storage engine.
+	Name() string
+}
+
+var engines = struct {
+	sync.RWMutex
+	factories map[string]LogDBFactory
+}{factories: make(map[string]LogDBFactory)}
+
+func init() {
+	RegisterEngine(pebbleFactory{})
+}
+
+// RegisterEngine makes the storage engine of the specified factory available
+// by its name. It panics when the name is empty or already registered.
+func RegisterEngine(f LogDBFactory) {
+	name := f.Name()
+	if len(name) == 0 {
+		panic("empty storage engine name")
+	}
+	engines.Lock()
+	defer engines.Unlock()
+	if _, ok := engines.factories[name]; ok {
+		plog.Panicf("storage engine %s registered twice", name)
+	}
+	engines.factories[name] = f
+}
+
+// Engines returns the sorted names of the registered storage engines.
+func Engines() []string {
+	engines.RLock()
+	defer engines.RUnlock()
+	result := make([]string, 0, len(engines.factories))
+	for name := range engines.factories {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func getEngine(name string) (LogDBFactory, error) {
+	if len(name) == 0 {
+		name = PebbleEngine
+	}
+	engines.RLock()
+	defer engines.RUnlock()
+	f, ok := engines.factories[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownEngine, "%q", name)
+	}
+	return f, nil
+}
+
+// OpenLogDB creates a LogDB instance using the storage engine selected by
+// config.Engine.
+func OpenLogDB(config LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (ILogDB, error) {
+	f, err := getEngine(config.Engine)
+	if err != nil {
+		return nil, err
+	}
+	return f.Create(config, callback, dirs, lldirs)
+}
+
+// EngineFactory is similar to FactoryWithError, but the returned function
+// creates the LogDB instance using the storage engine selected by
+// config.Engine.
+func EngineFactory(config LogDBConfig) func(logdb.LogDBCallback, string, string) (ILogDB, error) {
+	return func(callback logdb.LogDBCallback, nhPath string, walPath string) (ILogDB, error) {
+		return OpenLogDB(config, callback, []string{nhPath}, []string{walPath})
+	}
+}
+
+type pebbleFactory struct{}
+
+func (pebbleFactory) Create(config LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (ILogDB, error) {
+	db, err := NewLogDB(config, callback, dirs, lldirs, CheckNone)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (pebbleFactory) Name() string {
+	return PebbleEngine
+}
@@ -0,0 +1,63 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/logdb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testEngine struct {
+	name    string
+	created int
+}
+
+func (e *testEngine) Create(config LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (ILogDB, error) {
+	e.created++
+	return nil, errors.New("not implemented")
+}
+
+func (e *testEngine) Name() string {
+	return e.name
+}
+
+func TestOpenLogDBSelectsEngine(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	engine := &testEngine{name: "test-engine"}
+	RegisterEngine(engine)
+	defer func() {
+		engines.Lock()
+		delete(engines.factories, engine.name)
+		engines.Unlock()
+	}()
+	require.Contains(t, Engines(), PebbleEngine)
+	require.Contains(t, Engines(), engine.name)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := OpenLogDB(cfg, nil, dirs, dirs)
+	require.NoError(t, err)
+	_, ok := db.(*ShardedDB)
+	require.True(t, ok)
+	require.NoError(t, db.Close())
+	cfg.Engine = engine.name
+	_, err = OpenLogDB(cfg, nil, dirs, dirs)
+	require.Error(t, err)
+	require.Equal(t, 1, engine.created)
+	_, err = NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.Error(t, err)
+	cfg.Engine = "missing"
+	_, err = OpenLogDB(cfg, nil, dirs, dirs)
+	require.True(t, errors.Is(err, ErrUnknownEngine))
+}
+
+func TestRegisterEngineTwicePanics(t *testing.T) {
+	require.Panics(t, func() { RegisterEngine(pebbleFactory{}) })
+	require.Panics(t, func() { RegisterEngine(&testEngine{}) })
+}
@@ -0,0 +1,246 @@
+package pebble
+
+import (
+	"math"
+	"sync"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// entrySize is the running total of the stored entries of a node.
+type entrySize struct {
+	first uint64
+	last  uint64
+	count uint64
+	bytes uint64
+}
+
+// remove removes the specified number of entries from the total, their size
+// is estimated using the average size of the counted entries.
+func (e *entrySize) remove(n uint64) {
+	if n >= e.count {
+		e.count, e.bytes = 0, 0
+		return
+	}
+	e.bytes -= e.bytes / e.count * n
+	e.count -= n
+}
+
+// entrySizes keeps the approximate size of the stored entries of the nodes of
+// a shard. A node is tracked once its entries have been scanned, the total is
+// then updated on appends and trims without further scans. Overwritten and
+// trimmed entries are assumed to be of the average size, so the total drifts
+// from the stored size until it is reconciled by another scan.
+type entrySizes struct {
+	mu    sync.Mutex
+	nodes map[raftio.NodeInfo]*entrySize
+}
+
+func newEntrySizes() *entrySizes {
+	return &entrySizes{nodes: make(map[raftio.NodeInfo]*entrySize)}
+}
+
+func (s *entrySizes) get(clusterID uint64, nodeID uint64) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nodes[raftio.GetNodeInfo(clusterID, nodeID)]
+	if !ok {
+		return 0, false
+	}
+	return e.bytes, true
+}
+
+func (s *entrySizes) set(ni raftio.NodeInfo, e entrySize) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[ni] = &e
+}
+
+func (s *entrySizes) forget(clusterID uint64, nodeID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.nodes, raftio.GetNodeInfo(clusterID, nodeID))
+}
+
+// append adds the saved entries to the total of the node, entries at or
+// above the first saved index are considered overwritten.
+func (s *entrySizes) append(clusterID uint64, nodeID uint64, entries []pb.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nodes[raftio.GetNodeInfo(clusterID, nodeID)]
+	if !ok {
+		return
+	}
+	first := entries[0].Index
+	if e.count > 0 && first <= e.last {
+		if first <= e.first {
+			e.remove(e.count)
+		} else {
+			e.remove(e.last - first + 1)
+		}
+	}
+	if e.count == 0 {
+		e.first = first
+	}
+	for i := range entries {
+		e.bytes += uint64(entries[i].Size())
+	}
+	e.count += uint64(len(entries))
+	e.last = entries[len(entries)-1].Index
+}
+
+// trim removes the entries below the specified index from the total of the
+// node.
+func (s *entrySizes) trim(clusterID uint64, nodeID uint64, index uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nodes[raftio.GetNodeInfo(clusterID, nodeID)]
+	if !ok || e.count == 0 || index <= e.first {
+		return
+	}
+	e.remove(index - e.first)
+	e.first = index
+}
+
+// scanEntrySizes scans the stored entries of the nodes within the specified
+// key range.
+func (r *db) scanEntrySizes(fk *Key,
+	lk *Key) (map[raftio.NodeInfo]*entrySize, error) {
+	result := make(map[raftio.NodeInfo]*entrySize)
+	op := func(key []byte, data []byte) (bool, error) {
+		clusterID, nodeID, index, err := decodeEntryKey(key)
+		if err != nil {
+			return false, err
+		}
+		ni := raftio.GetNodeInfo(clusterID, nodeID)
+		e, ok := result[ni]
+		if !ok {
+			e = &entrySize{first: index}
+			result[ni] = e
+		}
+		e.last = index
+		e.count++
+		e.bytes += uint64(len(data))
+		return true, nil
+	}
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// entryBytes returns the approximate size of the stored entries of the
+// specified node, the entries of the node are scanned when it is not tracked
+// yet.
+func (r *db) entryBytes(clusterID uint64, nodeID uint64) (uint64, error) {
+	if bytes, ok := r.sizes.get(clusterID, nodeID); ok {
+		return bytes, nil
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(clusterID, nodeID, 0)
+	lk.SetEntryKey(clusterID, nodeID, math.MaxUint64)
+	scanned, err := r.scanEntrySizes(fk, lk)
+	if err != nil {
+		return 0, err
+	}
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	var e entrySize
+	if v, ok := scanned[ni]; ok {
+		e = *v
+	}
+	r.sizes.set(ni, e)
+	return e.bytes, nil
+}
+
+// reconcileEntrySizes replaces the totals of all nodes with the scanned size
+// of their stored entries.
+func (r *db) reconcileEntrySizes() error {
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(0, 0, 0)
+	lk.SetEntryKey(math.MaxUint64, math.MaxUint64, math.MaxUint64)
+	scanned, err := r.scanEntrySizes(fk, lk)
+	if err != nil {
+		return err
+	}
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return err
+	}
+	for _, n := range ni {
+		if _, ok := scanned[n]; !ok {
+			scanned[n] = &entrySize{}
+		}
+	}
+	r.sizes.mu.Lock()
+	defer r.sizes.mu.Unlock()
+	r.sizes.nodes = scanned
+	return nil
+}
+
+// EntryBytes returns the approximate size in bytes of the stored entries of
+// the specified node. The entries of a node are scanned on its first query,
+// the returned size is then maintained as entries are saved and removed
+// without further scans. Use ReconcileEntryBytes to correct the drift caused
+// by overwritten and removed entries.
+func (s *ShardedDB) EntryBytes(clusterID uint64, nodeID uint64) (uint64, error) {
+	if s.hasSegmentedEntries() {
+		return 0, errors.WithStack(ErrSegmentedEntries)
+	}
+	p := s.partitioner.GetPartitionID(clusterID)
+	shard, err := s.shard(p)
+	if err != nil {
+		return 0, err
+	}
+	return shard.entryBytes(clusterID, nodeID)
+}
+
+// ClusterEntryBytes returns the approximate size in bytes of the stored
+// entries of all nodes of the specified cluster.
+func (s *ShardedDB) ClusterEntryBytes(clusterID uint64) (uint64, error) {
+	if s.hasSegmentedEntries() {
+		return 0, errors.WithStack(ErrSegmentedEntries)
+	}
+	p := s.partitioner.GetPartitionID(clusterID)
+	shard, err := s.shard(p)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	op := func(ni raftio.NodeInfo) (bool, error) {
+		bytes, err := shard.entryBytes(ni.ClusterID, ni.NodeID)
+		if err != nil {
+			return false, err
+		}
+		total += bytes
+		return true, nil
+	}
+	if err := shard.iterateNodeInfo(clusterID, clusterID, op); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// ReconcileEntryBytes scans the stored entries of all shards and resets the
+// sizes returned by EntryBytes and ClusterEntryBytes to the scanned values.
+func (s *ShardedDB) ReconcileEntryBytes() error {
+	if s.hasSegmentedEntries() {
+		return errors.WithStack(ErrSegmentedEntries)
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if err := shard.reconcileEntrySizes(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntrySizesAppendAndTrim(t *testing.T) {
+	s := newEntrySizes()
+	entries := func(first uint64, last uint64) []pb.Entry {
+		ents := make([]pb.Entry, 0)
+		for i := first; i <= last; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 10)})
+		}
+		return ents
+	}
+	size := uint64(entries(1, 1)[0].Size())
+	s.append(1, 2, entries(1, 10))
+	_, ok := s.get(1, 2)
+	require.False(t, ok)
+	s.set(raftio.GetNodeInfo(1, 2), entrySize{})
+	s.append(1, 2, entries(1, 10))
+	bytes, ok := s.get(1, 2)
+	require.True(t, ok)
+	require.Equal(t, 10*size, bytes)
+	s.append(1, 2, entries(6, 12))
+	bytes, _ = s.get(1, 2)
+	require.Equal(t, 12*size, bytes)
+	s.trim(1, 2, 5)
+	bytes, _ = s.get(1, 2)
+	require.Equal(t, 8*size, bytes)
+	s.append(1, 2, entries(3, 4))
+	bytes, _ = s.get(1, 2)
+	require.Equal(t, 2*size, bytes)
+	s.forget(1, 2)
+	_, ok = s.get(1, 2)
+	require.False(t, ok)
+}
+
+func TestEntryBytesMatchesScannedSize(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		saveTestNode(t, sdb, 1, 3, 50)
+		shard := sdb.partitioner.GetPartitionID(1)
+		scanned := func() map[raftio.NodeInfo]uint64 {
+			stats, err := sdb.Stats()
+			require.NoError(t, err)
+			result := make(map[raftio.NodeInfo]uint64)
+			for _, n := range stats.Nodes {
+				if n.Shard == shard {
+					result[raftio.GetNodeInfo(n.ClusterID, n.NodeID)] = n.EntryBytes
+				}
+			}
+			return result
+		}
+		bytes, err := sdb.EntryBytes(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, scanned()[raftio.GetNodeInfo(1, 2)], bytes)
+		require.NoError(t, db.SaveRaftState([]pb.Update{{
+			ClusterID:     1,
+			NodeID:        2,
+			EntriesToSave: []pb.Entry{{Index: 101, Term: 1}, {Index: 102, Term: 1}},
+		}}, 1))
+		bytes, err = sdb.EntryBytes(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, scanned()[raftio.GetNodeInfo(1, 2)], bytes)
+		total, err := sdb.ClusterEntryBytes(1)
+		require.NoError(t, err)
+		s := scanned()
+		require.Equal(t, s[raftio.GetNodeInfo(1, 2)]+s[raftio.GetNodeInfo(1, 3)], total)
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 51))
+		bytes, err = sdb.EntryBytes(1, 2)
+		require.NoError(t, err)
+		require.Less(t, bytes, s[raftio.GetNodeInfo(1, 2)])
+		require.NoError(t, sdb.ReconcileEntryBytes())
+		bytes, err = sdb.EntryBytes(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, scanned()[raftio.GetNodeInfo(1, 2)], bytes)
+		require.NoError(t, db.RemoveNodeData(1, 3))
+		bytes, err = sdb.EntryBytes(1, 3)
+		require.NoError(t, err)
+		require.Zero(t, bytes)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
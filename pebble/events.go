@@ -0,0 +1,200 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// EngineEventType is the type of a background activity event of the storage
+// engine.
+type EngineEventType int
+
+const (
+	// CompactionBegin is the event of a compaction being started.
+	CompactionBegin EngineEventType = iota
+	// CompactionEnd is the event of a compaction being completed or failed.
+	CompactionEnd
+	// FlushBegin is the event of a memtable flush being started.
+	FlushBegin
+	// FlushEnd is the event of a memtable flush being completed or failed.
+	FlushEnd
+)
+
+var engineEventTypeNames = [...]string{
+	CompactionBegin: "compaction-begin",
+	CompactionEnd:   "compaction-end",
+	FlushBegin:      "flush-begin",
+	FlushEnd:        "flush-end",
+}
+
+func (t EngineEventType) String() string {
+	if t < 0 || int(t) >= len(engineEventTypeNames) {
+		return "unknown"
+	}
+	return engineEventTypeNames[t]
+}
+
+// EngineEvent is a background activity event of the storage engine of a
+// shard, including events of its state store.
+type EngineEvent struct {
+	Shard uint64
+	Type  EngineEventType
+	// JobID identifies the compaction or flush, the begin and end events of
+	// the same job have the same JobID.
+	JobID  int
+	Reason string
+	// InputBytes is the total size of the input sstables of a compaction.
+	// OutputBytes is the total size of the sstables written by a compaction or
+	// a flush, it is only set on end events.
+	InputBytes  uint64
+	OutputBytes uint64
+	// Duration is the time spent by the job, it is only set on end events.
+	Duration time.Duration
+	Err      error
+}
+
+// EngineEventListener is the function called with the background activity
+// events of the storage engine. It is called synchronously from background
+// goroutines of the storage engine and must not block.
+type EngineEventListener func(EngineEvent)
+
+// EngineEventStats contains the totals of the completed background jobs of
+// the storage engine of a shard since the LogDB was opened.
+type EngineEventStats struct {
+	CompactionBytes    uint64
+	CompactionDuration time.Duration
+	CompactionErrors   uint64
+	FlushBytes         uint64
+	FlushDuration      time.Duration
+	FlushErrors        uint64
+}
+
+// engineEvents forwards events of the storage engine of a shard to the
+// configured listener and logs them.
+type engineEvents struct {
+	shard    uint64
+	listener EngineEventListener
+	mu       sync.Mutex
+	stats    EngineEventStats
+	// compacting contains the paths of the sstables written by running
+	// compactions mapped to the compaction job IDs.
+	compacting map[string]int
+	// progress reports the progress of opening the shard, it is nil when no
+	// OpenProgressListener is configured.
+	progress *openProgress
+}
+
+func newEngineEvents(shard uint64, listener EngineEventListener) *engineEvents {
+	return &engineEvents{
+		shard:      shard,
+		listener:   listener,
+		compacting: make(map[string]int),
+	}
+}
+
+func (e *engineEvents) getStats() EngineEventStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+func (e *engineEvents) emit(ev EngineEvent) {
+	ev.Shard = e.shard
+	if ev.Err != nil {
+		plog.Warningf("shard %d %s job %d failed: %v", e.shard, ev.Type, ev.JobID, ev.Err)
+	} else if ev.Type == CompactionEnd || ev.Type == FlushEnd {
+		plog.Debugf("shard %d %s job %d (%s), %d bytes in, %d bytes out, took %s",
+			e.shard, ev.Type, ev.JobID, ev.Reason,
+			ev.InputBytes, ev.OutputBytes, ev.Duration)
+	}
+	if e.listener != nil {
+		e.listener(ev)
+	}
+}
+
+func (e *engineEvents) onCompaction(info pebble.CompactionInfo) {
+	ev := EngineEvent{
+		Type:   CompactionBegin,
+		JobID:  info.JobID,
+		Reason: info.Reason,
+		Err:    info.Err,
+	}
+	for _, l := range info.Input {
+		ev.InputBytes += tablesSize(l.Tables)
+	}
+	if info.Done {
+		ev.Type = CompactionEnd
+		ev.OutputBytes = tablesSize(info.Output.Tables)
+		ev.Duration = info.TotalDuration
+		e.mu.Lock()
+		e.stats.CompactionBytes += ev.OutputBytes
+		e.stats.CompactionDuration += ev.Duration
+		if ev.Err != nil {
+			e.stats.CompactionErrors++
+		}
+		for path, jobID := range e.compacting {
+			if jobID == info.JobID {
+				delete(e.compacting, path)
+			}
+		}
+		e.mu.Unlock()
+	}
+	e.emit(ev)
+}
+
+func (e *engineEvents) onTableCreated(info pebble.TableCreateInfo) {
+	if info.Reason != "compacting" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.compacting[info.Path] = info.JobID
+}
+
+// compactionOutput returns a boolean value indicating whether the specified
+// file is an sstable being written by a running compaction of the shard.
+func (e *engineEvents) compactionOutput(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.compacting[name]
+	return ok
+}
+
+// emptyFlushError is the error reported by pebble for flushes of memtables
+// without any live data, such flushes succeed.
+const emptyFlushError = "pebble: empty table"
+
+func (e *engineEvents) onFlush(info pebble.FlushInfo) {
+	if info.Err != nil && info.Err.Error() == emptyFlushError {
+		info.Err = nil
+	}
+	ev := EngineEvent{
+		Type:   FlushBegin,
+		JobID:  info.JobID,
+		Reason: info.Reason,
+		Err:    info.Err,
+	}
+	if info.Done {
+		ev.Type = FlushEnd
+		ev.OutputBytes = tablesSize(info.Output)
+		ev.Duration = info.TotalDuration
+		e.mu.Lock()
+		e.stats.FlushBytes += ev.OutputBytes
+		e.stats.FlushDuration += ev.Duration
+		if ev.Err != nil {
+			e.stats.FlushErrors++
+		}
+		e.mu.Unlock()
+	}
+	e.emit(ev)
+}
+
+func tablesSize(tables []pebble.TableInfo) uint64 {
+	sz := uint64(0)
+	for _, t := range tables {
+		sz += t.Size
+	}
+	return sz
+}
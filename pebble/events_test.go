@@ -0,0 +1,56 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngineEventsAreReported(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	var mu sync.Mutex
+	var events []EngineEvent
+	cfg.EngineEventListener = func(ev EngineEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 2, 100)
+	p := db.partitioner.GetPartitionID(1)
+	require.NoError(t, db.shards[p].kvs.FullCompaction())
+	mu.Lock()
+	seen := make(map[EngineEventType]int)
+	for _, ev := range events {
+		require.Equal(t, p, ev.Shard)
+		require.NoError(t, ev.Err)
+		if ev.Type == FlushEnd || ev.Type == CompactionEnd {
+			require.True(t, ev.Duration > 0)
+		}
+		seen[ev.Type]++
+	}
+	mu.Unlock()
+	require.Equal(t, seen[FlushBegin], seen[FlushEnd])
+	require.Equal(t, seen[CompactionBegin], seen[CompactionEnd])
+	require.True(t, seen[FlushEnd] > 0)
+	require.True(t, seen[CompactionEnd] > 0)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	es := stats.Shards[p].Events
+	require.True(t, es.FlushBytes > 0)
+	require.True(t, es.FlushDuration > 0)
+	require.True(t, es.CompactionBytes > 0)
+	require.Zero(t, es.FlushErrors)
+	require.Equal(t, "flush-end", FlushEnd.String())
+}
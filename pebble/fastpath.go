@@ -0,0 +1,63 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+)
+
+// smallEntrySize is the max size of the payload of entries saved by the fast
+// path of saveRaftState.
+const smallEntrySize = 1024
+
+// isSmallUpdate returns a boolean value indicating whether the saved records
+// are a single update with a single small entry and no snapshot, the most
+// common update of busy nodes. Such updates are saved by saveSmallUpdate.
+func isSmallUpdate(updates []pb.Update,
+	metadata []NodeMetadata, records []AppRecord) bool {
+	if len(updates) != 1 || len(metadata) > 0 || len(records) > 0 {
+		return false
+	}
+	ud := &updates[0]
+	return len(ud.EntriesToSave) == 1 &&
+		len(ud.EntriesToSave[0].Cmd) <= smallEntrySize &&
+		pb.IsEmptySnapshot(ud.Snapshot)
+}
+
+// saveSmallUpdate saves an update selected by isSmallUpdate. Records are
+// marshaled in place into the write batch of the context, which keeps its
+// capacity between saves, using a single key acquired from the key pool. It
+// requires the entries to be kept in pebble and the state store to be
+// disabled, records are not routed to the state store.
+func (r *db) saveSmallUpdate(ud pb.Update, ctx IContext) error {
+	wb := r.getWriteBatch(ctx)
+	k := r.keys.get()
+	defer k.Release()
+	if !pb.IsEmptyState(ud.State) && r.cs.setState(ud.ClusterID, ud.NodeID, ud.State) {
+		k.SetStateKey(ud.ClusterID, ud.NodeID)
+		op := wb.wb.SetDeferred(len(k.Key()), ud.State.Size())
+		copy(op.Key, k.Key())
+		pb.MustMarshalTo(&ud.State, op.Value)
+		op.Finish()
+	}
+	e := &ud.EntriesToSave[0]
+	k.SetEntryKey(ud.ClusterID, ud.NodeID, e.Index)
+	op := wb.wb.SetDeferred(len(k.Key()), e.Size())
+	copy(op.Key, k.Key())
+	pb.MustMarshalTo(e, op.Value)
+	op.Finish()
+	r.cs.recordEntries(ud.ClusterID, ud.NodeID, ud.EntriesToSave)
+	r.cs.setMaxIndex(ud.ClusterID, ud.NodeID, e.Index)
+	k.SetMaxIndexKey(ud.ClusterID, ud.NodeID)
+	op = wb.wb.SetDeferred(len(k.Key()), 8)
+	copy(op.Key, k.Key())
+	binary.BigEndian.PutUint64(op.Value, e.Index)
+	op.Finish()
+	if err := r.commitWriteBatch(wb); err != nil {
+		return err
+	}
+	r.cs.setLastWrite(ud.ClusterID, ud.NodeID, time.Now())
+	r.recordSaves([]pb.Update{ud})
+	return nil
+}
@@ -0,0 +1,112 @@
+package pebble
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func smallTestUpdate(index uint64, cmd []byte) pb.Update {
+	return pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 5, Vote: 2, Commit: index},
+		EntriesToSave: []pb.Entry{{Index: index, Term: 5, Cmd: cmd}},
+	}
+}
+
+func TestSmallUpdatesAreDetected(t *testing.T) {
+	ud := smallTestUpdate(1, make([]byte, 16))
+	require.True(t, isSmallUpdate([]pb.Update{ud}, nil, nil))
+	require.False(t, isSmallUpdate([]pb.Update{ud, ud}, nil, nil))
+	require.False(t, isSmallUpdate([]pb.Update{ud}, []NodeMetadata{{}}, nil))
+	require.False(t, isSmallUpdate([]pb.Update{ud}, nil, []AppRecord{{}}))
+	large := smallTestUpdate(1, make([]byte, smallEntrySize+1))
+	require.False(t, isSmallUpdate([]pb.Update{large}, nil, nil))
+	ss := ud
+	ss.Snapshot = pb.Snapshot{Index: 1, Term: 5}
+	require.False(t, isSmallUpdate([]pb.Update{ss}, nil, nil))
+	ud.EntriesToSave = append(ud.EntriesToSave, pb.Entry{Index: 2, Term: 5})
+	require.False(t, isSmallUpdate([]pb.Update{ud}, nil, nil))
+}
+
+func TestSmallUpdatesAreSavedAsByTheGeneralPath(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	save := func(fast bool) [][]byte {
+		fs := vfs.NewMem()
+		defer deleteTestDB(fs)
+		cfg := getDefaultLogDBConfig()
+		cfg.FS = fs
+		db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+		require.NoError(t, err)
+		defer db.Close()
+		shard, err := db.shard(db.partitioner.GetPartitionID(1))
+		require.NoError(t, err)
+		require.True(t, shard.fastSaves)
+		shard.fastSaves = fast
+		for i := uint64(1); i <= 10; i++ {
+			ud := smallTestUpdate(i, bytes.Repeat([]byte{byte(i)}, int(i*50)))
+			if i%3 == 0 {
+				ud.State = pb.State{}
+			}
+			require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+		}
+		rs, err := db.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, pb.State{Term: 5, Vote: 2, Commit: 10}, rs.State)
+		require.Equal(t, uint64(1), rs.FirstIndex)
+		require.Equal(t, uint64(10), rs.EntryCount)
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 11, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, 10)
+		ops := db.NodeOperations()
+		require.Len(t, ops, 1)
+		require.Equal(t, uint64(10), ops[raftio.GetNodeInfo(1, 2)].Saves)
+		var records [][]byte
+		require.NoError(t, shard.kvs.IterateValue([]byte{0}, bytes.Repeat([]byte{0xff}, 64), true,
+			func(key []byte, data []byte) (bool, error) {
+				records = append(records, append(append([]byte(nil), key...), data...))
+				return true, nil
+			}))
+		return records
+	}
+	require.Equal(t, save(false), save(true))
+}
+
+func BenchmarkSaveSmallUpdate(b *testing.B) {
+	for _, fast := range []bool{false, true} {
+		name := "general"
+		if fast {
+			name = "fast"
+		}
+		b.Run(name, func(b *testing.B) {
+			fs := vfs.NewMem()
+			defer deleteTestDB(fs)
+			cfg := getDefaultLogDBConfig()
+			cfg.FS = fs
+			db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+			require.NoError(b, err)
+			defer db.Close()
+			shard, err := db.shard(db.partitioner.GetPartitionID(1))
+			require.NoError(b, err)
+			shard.fastSaves = fast
+			cmd := make([]byte, 128)
+			updates := []pb.Update{smallTestUpdate(0, cmd)}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				updates[0].State.Commit = uint64(i + 1)
+				updates[0].EntriesToSave[0].Index = uint64(i + 1)
+				if err := db.SaveRaftState(updates, 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
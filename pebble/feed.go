@@ -0,0 +1,266 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/syncutil"
+	"github.com/pkg/errors"
+)
+
+// Sink is the destination of a change feed, e.g. a message broker topic. It
+// receives committed entries of a node in index order with at-least-once
+// semantics, entries written before a crash or a failed Write can be written
+// again once the feed is restarted or retries.
+type Sink interface {
+	// Name returns the name of the sink, the delivery offsets of each sink
+	// are persisted in the LogDB under its name.
+	Name() string
+	// Write writes the entries of the specified node, it returns once all
+	// entries have been durably accepted by the sink.
+	Write(clusterID uint64, nodeID uint64, entries []pb.Entry) error
+}
+
+// FeedOptions are the options of a change feed.
+type FeedOptions struct {
+	// MaxBatchSize is the max total size in bytes of entries passed to a
+	// single Sink.Write call, at least one entry is always passed.
+	MaxBatchSize uint64
+	// RetryInterval is the interval between retries of a failed Sink.Write.
+	RetryInterval time.Duration
+}
+
+// FeedStats contains the statistics of a change feed.
+type FeedStats struct {
+	// Offset is the index of the last entry accepted by the sink.
+	Offset  uint64
+	Batches uint64
+	Entries uint64
+	Retries uint64
+	// Error is the last error returned by the sink, cleared once a write
+	// succeeds.
+	Error string `json:",omitempty"`
+}
+
+// Feed delivers committed entries of a single node to a Sink, it is started
+// by the ShardedDB.StartFeed method.
+type Feed struct {
+	db      *ShardedDB
+	sink    Sink
+	sub     *Subscription
+	opts    FeedOptions
+	stopper *syncutil.Stopper
+	mu      sync.Mutex
+	stats   FeedStats
+	err     error
+}
+
+// StartFeed starts delivering committed entries of the specified node to the
+// sink. Delivery resumes after the offset persisted for the sink, it
+// starts from the first available entry when no offset has been persisted
+// yet.
+func (s *ShardedDB) StartFeed(sink Sink, clusterID uint64,
+	nodeID uint64, opts FeedOptions) (*Feed, error) {
+	if opts.MaxBatchSize == 0 {
+		opts.MaxBatchSize = s.config.MaxSaveBufferSize
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	offset, err := s.GetSinkOffset(sink.Name(), clusterID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	from := offset + 1
+	if offset == 0 {
+		rs, err := s.ReadRaftState(clusterID, nodeID, 0)
+		if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+			return nil, err
+		}
+		if rs.EntryCount > 0 {
+			from = rs.FirstIndex
+		}
+	}
+	sub, err := s.Subscribe(clusterID, nodeID, from)
+	if err != nil {
+		return nil, err
+	}
+	f := &Feed{
+		db:      s,
+		sink:    sink,
+		sub:     sub,
+		opts:    opts,
+		stopper: syncutil.NewStopper(),
+		stats:   FeedStats{Offset: offset},
+	}
+	p := s.partitioner.GetPartitionID(clusterID)
+	f.stopper.RunWorker(func() {
+		withShardLabels("feed", p, f.workerMain)
+	})
+	return f, nil
+}
+
+func (f *Feed) workerMain() {
+	stopc := f.stopper.ShouldStop()
+	for {
+		ents, err := f.sub.Next(stopc, f.opts.MaxBatchSize)
+		if err != nil {
+			f.fail(err)
+			return
+		}
+		if ents == nil {
+			return
+		}
+		if !f.deliver(ents) {
+			return
+		}
+	}
+}
+
+// deliver writes the entries to the sink until accepted and persists the new
+// offset, it returns false when the feed is stopped or failed.
+func (f *Feed) deliver(ents []pb.Entry) bool {
+	ni := f.sub.ni
+	for {
+		err := f.sink.Write(ni.ClusterID, ni.NodeID, ents)
+		if err == nil {
+			break
+		}
+		plog.Warningf("%s sink %s write failed, %v",
+			dn(ni.ClusterID, ni.NodeID), f.sink.Name(), err)
+		f.mu.Lock()
+		f.stats.Retries++
+		f.stats.Error = err.Error()
+		f.mu.Unlock()
+		select {
+		case <-f.stopper.ShouldStop():
+			return false
+		case <-time.After(f.opts.RetryInterval):
+		}
+	}
+	offset := ents[len(ents)-1].Index
+	if err := f.db.SaveSinkOffset(f.sink.Name(),
+		ni.ClusterID, ni.NodeID, offset); err != nil {
+		f.fail(err)
+		return false
+	}
+	f.mu.Lock()
+	f.stats.Offset = offset
+	f.stats.Batches++
+	f.stats.Entries += uint64(len(ents))
+	f.stats.Error = ""
+	f.mu.Unlock()
+	return true
+}
+
+func (f *Feed) fail(err error) {
+	if errors.Is(err, ErrSubscriptionClosed) {
+		return
+	}
+	plog.Errorf("%s sink %s stopped, %v",
+		dn(f.sub.ni.ClusterID, f.sub.ni.NodeID), f.sink.Name(), err)
+	f.mu.Lock()
+	f.err = err
+	f.stats.Error = err.Error()
+	f.mu.Unlock()
+}
+
+// Stats returns the statistics of the feed.
+func (f *Feed) Stats() FeedStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+// Err returns the error which stopped the feed, e.g. ErrEntriesUnavailable
+// when entries were removed before being delivered.
+func (f *Feed) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Stop stops the feed, entries accepted by the sink have their offset
+// persisted once Stop returns. Feeds must be stopped before closing the
+// ShardedDB.
+func (f *Feed) Stop() {
+	f.stopper.Stop()
+	f.sub.Close()
+}
+
+// GetSinkOffset returns the index of the last entry of the specified node
+// accepted by the named sink, 0 is returned when no offset has been persisted.
+func (s *ShardedDB) GetSinkOffset(name string,
+	clusterID uint64, nodeID uint64) (uint64, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return 0, err
+	}
+	return shard.getSinkOffset(name, clusterID, nodeID)
+}
+
+// SaveSinkOffset persists the index of the last entry of the specified node
+// accepted by the named sink. Offsets are removed together with the node data.
+func (s *ShardedDB) SaveSinkOffset(name string,
+	clusterID uint64, nodeID uint64, offset uint64) error {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.saveSinkOffset(name, clusterID, nodeID, offset))
+}
+
+func (r *db) getSinkOffset(name string,
+	clusterID uint64, nodeID uint64) (uint64, error) {
+	k := newKey(maxKeySize, nil)
+	k.setSinkOffsetKey(clusterID, nodeID, name)
+	offset := uint64(0)
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if len(data) < 8 {
+			return errors.Wrapf(ErrCorruptedRecord, "sink offset size %d", len(data))
+		}
+		// the name is stored to detect names with the same hash
+		if string(data[8:]) != name {
+			return errors.Errorf("sink %s clashes with sink %s", name, data[8:])
+		}
+		offset = binary.BigEndian.Uint64(data)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (r *db) saveSinkOffset(name string,
+	clusterID uint64, nodeID uint64, offset uint64) error {
+	k := newKey(maxKeySize, nil)
+	k.setSinkOffsetKey(clusterID, nodeID, name)
+	data := make([]byte, 8+len(name))
+	binary.BigEndian.PutUint64(data, offset)
+	copy(data[8:], name)
+	return r.kvs.SaveValue(k.Key(), data)
+}
+
+// saveRemoveSinkOffsets adds the removal of all sink offsets of the specified
+// node to the write batch.
+func (r *db) saveRemoveSinkOffsets(wb *pebbleWriteBatch,
+	clusterID uint64, nodeID uint64) error {
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	fk.setSinkOffsetKey(clusterID, nodeID, "")
+	lk.setSinkOffsetKey(clusterID, nodeID, "")
+	for i := 20; i < int(sinkOffsetKeySize); i++ {
+		fk.key[i], lk.key[i] = 0, 0xFF
+	}
+	return r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			wb.Delete(key)
+			return true, nil
+		})
+}
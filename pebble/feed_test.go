@@ -0,0 +1,142 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testSink struct {
+	mu       sync.Mutex
+	failures int
+	indexes  []uint64
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Write(clusterID uint64, nodeID uint64, entries []pb.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	for _, e := range entries {
+		s.indexes = append(s.indexes, e.Index)
+	}
+	return nil
+}
+
+func (s *testSink) delivered() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint64(nil), s.indexes...)
+}
+
+func TestFeedDeliversCommittedEntriesAtLeastOnce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true}))
+	saveWatchTestEntries(t, db, 1, 10, 5)
+	sink := &testSink{failures: 2}
+	opts := FeedOptions{RetryInterval: time.Millisecond}
+	f, err := db.StartFeed(sink, 1, 2, opts)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.Stats().Offset == 5
+	}, 5*time.Second, time.Millisecond)
+	saveWatchTestEntries(t, db, 11, 12, 12)
+	require.Eventually(t, func() bool {
+		return f.Stats().Offset == 12
+	}, 5*time.Second, time.Millisecond)
+	f.Stop()
+	require.NoError(t, f.Err())
+	st := f.Stats()
+	require.Equal(t, uint64(2), st.Retries)
+	require.Equal(t, uint64(12), st.Entries)
+	require.Empty(t, st.Error)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, sink.delivered())
+	offset, err := db.GetSinkOffset("test", 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), offset)
+
+	// resumed after the persisted offset
+	saveWatchTestEntries(t, db, 13, 14, 14)
+	sink = &testSink{}
+	f, err = db.StartFeed(sink, 1, 2, opts)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.Stats().Offset == 14
+	}, 5*time.Second, time.Millisecond)
+	f.Stop()
+	require.Equal(t, []uint64{13, 14}, sink.delivered())
+
+	report, err := db.Verify()
+	require.NoError(t, err)
+	require.Empty(t, report.Violations)
+	require.NoError(t, db.RemoveNodeData(1, 2))
+	offset, err = db.GetSinkOffset("test", 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func TestFeedStopsWhenEntriesAreUnavailable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveWatchTestEntries(t, db, 1, 10, 10)
+	require.NoError(t, db.SaveSinkOffset("test", 1, 2, 3))
+	require.NoError(t, db.RemoveEntriesTo(1, 2, 8))
+	f, err := db.StartFeed(&testSink{}, 1, 2, FeedOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return f.Err() != nil
+	}, 5*time.Second, time.Millisecond)
+	f.Stop()
+	require.True(t, errors.Is(f.Err(), ErrEntriesUnavailable))
+}
+
+func TestSinkOffsetNameIsChecked(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.SaveSinkOffset("a", 1, 2, 3))
+	require.NoError(t, db.SaveSinkOffset("b", 1, 2, 4))
+	offset, err := db.GetSinkOffset("a", 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	// simulates a hash collision of sink names
+	r := db.shards[db.partitioner.GetPartitionID(1)]
+	k := newKey(maxKeySize, nil)
+	k.setSinkOffsetKey(1, 2, "a")
+	require.NoError(t, r.kvs.SaveValue(k.Key(), append(make([]byte, 8), 'c')))
+	_, err = db.GetSinkOffset("a", 1, 2)
+	require.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// forecastRateWindow is the period of time over which the write rate used
+// by Forecast is measured.
+var forecastRateWindow = time.Hour
+
+// ShardForecast is the estimated disk usage of a single shard as returned by
+// ShardedDB.Forecast.
+type ShardForecast struct {
+	Shard uint64
+	// DiskSpaceUsage is the current disk usage of the shard in bytes.
+	DiskSpaceUsage uint64
+	// WriteRate is the rate of bytes written to the WAL per second measured
+	// over the last hour, or since the shard was opened when it was opened
+	// more recently.
+	WriteRate uint64
+	// CompactionDebt is the number of bytes compactions are expected to
+	// rewrite, compactions temporarily need up to that much additional space.
+	CompactionDebt uint64
+	// Reclaimable is the estimated disk usage of the entries to be removed
+	// according to the retention policy, i.e. entries below the latest
+	// snapshot of each node minus JanitorRetainedEntries.
+	Reclaimable uint64
+	// Projected is the estimated disk usage at the end of the forecast
+	// period assuming the write rate is sustained and reclaimable entries are
+	// removed, Peak additionally includes the compaction debt. The estimates
+	// are upper bounds as written bytes are not reduced by compression.
+	Projected uint64
+	Peak      uint64
+	// Free is the current free space of the file system holding the shard,
+	// FreeAtPeak is the free space left once the disk usage reaches Peak.
+	// Level is the free space level of FreeAtPeak relative to the configured
+	// free space watermarks. All three are zero values when the FS does not
+	// report the free space.
+	Free       uint64
+	FreeAtPeak uint64
+	Level      FreeSpaceLevel
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes uint64
+}
+
+// rateSampler keeps samples of the number of bytes written to the WAL of a
+// shard within the rate window.
+type rateSampler struct {
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+func (r *rateSampler) record(now time.Time, bytes uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, rateSample{at: now, bytes: bytes})
+	// keep the latest sample taken before the window as the start of the
+	// measured period
+	cutoff := now.Add(-forecastRateWindow)
+	first := 0
+	for first+1 < len(r.samples) && !r.samples[first+1].at.After(cutoff) {
+		first++
+	}
+	r.samples = append(r.samples[:0], r.samples[first:]...)
+}
+
+// rate returns the bytes written per second between the oldest and the
+// latest sample.
+func (r *rateSampler) rate() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.samples) < 2 {
+		return 0
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 || last.bytes < first.bytes {
+		return 0
+	}
+	return uint64(float64(last.bytes-first.bytes) / elapsed)
+}
+
+func (r *KV) sampleWriteRate() {
+	r.rate.record(time.Now(), r.db.Metrics().WAL.BytesIn)
+}
+
+// Forecast estimates the disk usage of all shards after the specified period
+// of time by combining their recent write rate, their compaction debt and
+// the entries to be removed according to the retention policy. Write rates
+// are sampled when shards are opened, when memtables are flushed and when
+// Forecast is called.
+func (s *ShardedDB) Forecast(d time.Duration) ([]ShardForecast, error) {
+	if s.hasSegmentedEntries() {
+		return nil, errors.WithStack(ErrSegmentedEntries)
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return nil, err
+	}
+	fs := s.config.FS
+	result := make([]ShardForecast, 0, len(shards))
+	for i, shard := range shards {
+		f, err := shard.forecast(uint64(i), d, s.config.JanitorRetainedEntries)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		free, total, err := getDiskUsage(fs.PathJoin(s.dirs[i],
+			shardDirName(uint64(i))), fs)
+		if err == nil {
+			f.Free = free
+			if available := free + f.DiskSpaceUsage; available > f.Peak {
+				f.FreeAtPeak = available - f.Peak
+			}
+			f.Level = freeSpaceLevel(s.config, f.FreeAtPeak, total)
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+func (r *db) forecast(shard uint64,
+	d time.Duration, retained uint64) (ShardForecast, error) {
+	r.kvs.sampleWriteRate()
+	m := r.kvs.db.Metrics()
+	f := ShardForecast{
+		Shard:          shard,
+		DiskSpaceUsage: m.DiskSpaceUsage(),
+		WriteRate:      r.kvs.rate.rate(),
+		CompactionDebt: m.Compact.EstimatedDebt,
+	}
+	if r.kvs.state != nil {
+		f.DiskSpaceUsage += r.kvs.state.db.Metrics().DiskSpaceUsage()
+	}
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return ShardForecast{}, err
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	for _, n := range ni {
+		index, err := r.getJanitorTrimIndex(n.ClusterID, n.NodeID, retained)
+		if err != nil {
+			return ShardForecast{}, err
+		}
+		if index == 0 {
+			continue
+		}
+		fk.SetEntryKey(n.ClusterID, n.NodeID, 0)
+		lk.SetEntryKey(n.ClusterID, n.NodeID, index)
+		size, err := r.kvs.EstimateDiskUsage(fk.Key(), lk.Key())
+		if err != nil {
+			return ShardForecast{}, err
+		}
+		f.Reclaimable += size
+	}
+	f.Projected = f.DiskSpaceUsage + uint64(float64(f.WriteRate)*d.Seconds())
+	if f.Projected > f.Reclaimable {
+		f.Projected -= f.Reclaimable
+	} else {
+		f.Projected = 0
+	}
+	f.Peak = f.Projected + f.CompactionDebt
+	return f, nil
+}
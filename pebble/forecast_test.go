@@ -0,0 +1,58 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateSamplerKeepsSamplesWithinWindow(t *testing.T) {
+	r := &rateSampler{}
+	now := time.Now()
+	r.record(now, 0)
+	require.Zero(t, r.rate())
+	r.record(now.Add(10*time.Second), 1000)
+	require.Equal(t, uint64(100), r.rate())
+	r.record(now.Add(forecastRateWindow+20*time.Second), 2000)
+	require.Len(t, r.samples, 2)
+	require.Equal(t, uint64(1000)/uint64(forecastRateWindow.Seconds()+10), r.rate())
+	r.record(now.Add(2*forecastRateWindow+30*time.Second), 2000)
+	require.Len(t, r.samples, 2)
+	require.Zero(t, r.rate())
+}
+
+func TestForecastIncludesReclaimableEntries(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		sdb.config.JanitorRetainedEntries = 10
+		sdb.config.LowFreeSpace = 1
+		saveTestNode(t, sdb, 1, 2, 1000)
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 1,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 900, Term: 1},
+		}}))
+		require.NoError(t, sdb.Flush())
+		forecasts, err := sdb.Forecast(time.Hour)
+		require.NoError(t, err)
+		require.Len(t, forecasts, int(sdb.config.Shards))
+		shard := sdb.partitioner.GetPartitionID(1)
+		f := forecasts[shard]
+		require.Equal(t, shard, f.Shard)
+		require.NotZero(t, f.DiskSpaceUsage)
+		require.NotZero(t, f.Reclaimable)
+		require.Equal(t, f.Projected+f.CompactionDebt, f.Peak)
+		require.LessOrEqual(t, f.Projected,
+			f.DiskSpaceUsage+f.WriteRate*3600-f.Reclaimable)
+		for i, f := range forecasts {
+			if uint64(i) != shard {
+				require.Zero(t, f.Reclaimable)
+			}
+		}
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
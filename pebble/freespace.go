@@ -0,0 +1,223 @@
+package pebble
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// ErrFreeSpaceCritical indicates that entries were rejected as the free
+// space of the shard is below the critical watermark.
+var ErrFreeSpaceCritical = errors.New("free space below critical watermark")
+
+// FreeSpaceLevel is the free space level of a shard relative to the free
+// space watermarks.
+type FreeSpaceLevel uint32
+
+const (
+	// FreeSpaceOK is the level of shards above the low watermark.
+	FreeSpaceOK FreeSpaceLevel = iota
+	// FreeSpaceLow is the level of shards below the low watermark.
+	FreeSpaceLow
+	// FreeSpaceCritical is the level of shards below the critical watermark.
+	FreeSpaceCritical
+)
+
+var freeSpaceLevelNames = [...]string{
+	FreeSpaceOK:       "ok",
+	FreeSpaceLow:      "low",
+	FreeSpaceCritical: "critical",
+}
+
+func (l FreeSpaceLevel) String() string {
+	if int(l) >= len(freeSpaceLevelNames) {
+		return "unknown"
+	}
+	return freeSpaceLevelNames[l]
+}
+
+// FreeSpaceInfo describes a change of the free space level of a shard.
+type FreeSpaceInfo struct {
+	Shard uint64
+	Level FreeSpaceLevel
+	// Dir is the directory of the shard with the least free space, Free is
+	// its free space in bytes and Total is the total size of its file system,
+	// Total is 0 when it is not reported by the FS.
+	Dir   string
+	Free  uint64
+	Total uint64
+}
+
+// FreeSpaceListener is the function called with the changes of the free
+// space levels of shards. It is called from the background goroutine
+// checking the free space and must not block.
+type FreeSpaceListener func(FreeSpaceInfo)
+
+// diskUsageFS is implemented by file systems reporting their total size.
+type diskUsageFS interface {
+	GetDiskUsage(path string) (pvfs.DiskUsage, error)
+}
+
+func freeSpaceEnabled(config LogDBConfig) bool {
+	return config.FreeSpaceCheckInterval > 0 && !config.ReadOnly
+}
+
+// getDiskUsage returns the free space and the total size of the file system
+// of the specified dir, the total size is 0 when it is not reported by fs.
+func getDiskUsage(dir string, fs vfs.FS) (uint64, uint64, error) {
+	if fs == vfs.Default {
+		du, err := pvfs.Default.GetDiskUsage(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		return du.AvailBytes, du.TotalBytes, nil
+	}
+	if dfs, ok := fs.(diskUsageFS); ok {
+		du, err := dfs.GetDiskUsage(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		return du.AvailBytes, du.TotalBytes, nil
+	}
+	free, err := fs.GetFreeSpace(dir)
+	return free, 0, err
+}
+
+// freeSpaceLevel returns the level of the specified free space relative to
+// the watermarks of the config.
+func freeSpaceLevel(config LogDBConfig, free uint64, total uint64) FreeSpaceLevel {
+	below := func(watermark uint64, percent uint64) bool {
+		if watermark > 0 && free < watermark {
+			return true
+		}
+		return percent > 0 && total > 0 && free*100 < total*percent
+	}
+	if below(config.CriticalFreeSpace, config.CriticalFreeSpacePercent) {
+		return FreeSpaceCritical
+	}
+	if below(config.LowFreeSpace, config.LowFreeSpacePercent) {
+		return FreeSpaceLow
+	}
+	return FreeSpaceOK
+}
+
+// checkFreeSpace updates the free space level of the specified shard from
+// the free space of its directories.
+func (s *ShardedDB) checkFreeSpace(i uint64, shard *db) {
+	fs := s.config.FS
+	dirs := []string{fs.PathJoin(s.dirs[i], shardDirName(i))}
+	if len(s.lldirs) > 0 {
+		dirs = append(dirs, fs.PathJoin(s.lldirs[i], shardDirName(i)))
+	}
+	info := FreeSpaceInfo{Shard: i}
+	for _, dir := range dirs {
+		free, total, err := getDiskUsage(dir, fs)
+		if err != nil {
+			plog.Errorf("shard %d: failed to get free space of %s: %v", i, dir, err)
+			return
+		}
+		level := freeSpaceLevel(s.config, free, total)
+		if len(info.Dir) == 0 || level > info.Level ||
+			(level == info.Level && free < info.Free) {
+			info.Level, info.Dir, info.Free, info.Total = level, dir, free, total
+		}
+	}
+	prev := FreeSpaceLevel(atomic.SwapUint32(&shard.kvs.freeSpace, uint32(info.Level)))
+	if prev == info.Level {
+		return
+	}
+	if info.Level == FreeSpaceOK {
+		plog.Infof("shard %d: free space of %s recovered, %d bytes free",
+			i, info.Dir, info.Free)
+	} else {
+		plog.Warningf("shard %d: free space of %s is %s, %d bytes free",
+			i, info.Dir, info.Level, info.Free)
+	}
+	if s.callback != nil {
+		sc := shardCallback{shard: i, f: s.callback}
+		sc.callback(info.Level != FreeSpaceOK)
+	}
+	if s.config.FreeSpaceListener != nil {
+		s.config.FreeSpaceListener(info)
+	}
+}
+
+func (s *ShardedDB) freeSpaceWorkerMain() {
+	ticker := time.NewTicker(s.config.FreeSpaceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			for i, shard := range s.openedShards() {
+				if shard != nil {
+					s.checkFreeSpace(uint64(i), shard)
+				}
+			}
+		}
+	}
+}
+
+// FreeSpaceLevels returns the free space levels of all shards as of their
+// latest check, shards not opened yet are reported as FreeSpaceOK.
+func (s *ShardedDB) FreeSpaceLevels() []FreeSpaceLevel {
+	levels := make([]FreeSpaceLevel, len(s.shards))
+	for i, shard := range s.openedShards() {
+		if shard != nil {
+			levels[i] = shard.kvs.freeSpaceLevel()
+		}
+	}
+	return levels
+}
+
+func (r *KV) freeSpaceLevel() FreeSpaceLevel {
+	return FreeSpaceLevel(atomic.LoadUint32(&r.freeSpace))
+}
+
+// rejectEntries returns the updates which can be saved given the free space
+// of the shard. Below the critical watermark, entries are dropped from the
+// updates while their raft states and snapshots are kept, the commit of the
+// kept states is capped to the entries already saved. ErrFreeSpaceCritical
+// naming the nodes with dropped entries is returned along with the updates.
+func (r *db) rejectEntries(updates []pb.Update) ([]pb.Update, error) {
+	if r.kvs.freeSpaceLevel() != FreeSpaceCritical {
+		return updates, nil
+	}
+	kept := make([]pb.Update, 0, len(updates))
+	var rejected []string
+	for _, ud := range updates {
+		if len(ud.EntriesToSave) == 0 {
+			kept = append(kept, ud)
+			continue
+		}
+		rejected = append(rejected, dn(ud.ClusterID, ud.NodeID))
+		ud.EntriesToSave = nil
+		if !pb.IsEmptyState(ud.State) {
+			maxIndex, err := r.getMaxIndex(ud.ClusterID, ud.NodeID)
+			if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+				return nil, err
+			}
+			if ud.Snapshot.Index > maxIndex {
+				maxIndex = ud.Snapshot.Index
+			}
+			if ud.State.Commit > maxIndex {
+				ud.State.Commit = maxIndex
+			}
+		}
+		if !pb.IsEmptyState(ud.State) || !pb.IsEmptySnapshot(ud.Snapshot) {
+			kept = append(kept, ud)
+		}
+	}
+	if len(rejected) == 0 {
+		return updates, nil
+	}
+	return kept, errors.Wrapf(ErrFreeSpaceCritical,
+		"%s", strings.Join(rejected, ", "))
+}
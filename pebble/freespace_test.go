@@ -0,0 +1,156 @@
+package pebble
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/coufalja/tugboat/logdb"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type freeSpaceFS struct {
+	vfs.FS
+	free  uint64
+	total uint64
+}
+
+func (f *freeSpaceFS) GetFreeSpace(path string) (uint64, error) {
+	return atomic.LoadUint64(&f.free), nil
+}
+
+func (f *freeSpaceFS) GetDiskUsage(path string) (pvfs.DiskUsage, error) {
+	free := atomic.LoadUint64(&f.free)
+	return pvfs.DiskUsage{
+		AvailBytes: free,
+		TotalBytes: f.total,
+		UsedBytes:  f.total - free,
+	}, nil
+}
+
+func TestFreeSpaceLevel(t *testing.T) {
+	cfg := LogDBConfig{
+		LowFreeSpace:             100,
+		CriticalFreeSpace:        10,
+		LowFreeSpacePercent:      20,
+		CriticalFreeSpacePercent: 5,
+	}
+	require.Equal(t, FreeSpaceOK, freeSpaceLevel(cfg, 500, 0))
+	require.Equal(t, FreeSpaceLow, freeSpaceLevel(cfg, 50, 0))
+	require.Equal(t, FreeSpaceCritical, freeSpaceLevel(cfg, 5, 0))
+	require.Equal(t, FreeSpaceOK, freeSpaceLevel(cfg, 500, 1000))
+	require.Equal(t, FreeSpaceLow, freeSpaceLevel(cfg, 150, 1000))
+	require.Equal(t, FreeSpaceCritical, freeSpaceLevel(cfg, 40, 1000))
+	require.Equal(t, "critical", FreeSpaceCritical.String())
+}
+
+func TestCriticalFreeSpaceRejectsEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := &freeSpaceFS{FS: vfs.NewMem(), free: 1000, total: 1000}
+	defer deleteTestDB(fs)
+	var mu sync.Mutex
+	var infos []FreeSpaceInfo
+	busy := make(map[uint64]bool)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 2
+	cfg.LowFreeSpacePercent = 50
+	cfg.CriticalFreeSpace = 100
+	cfg.FreeSpaceCheckInterval = time.Millisecond
+	cfg.FreeSpaceListener = func(info FreeSpaceInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		infos = append(infos, info)
+	}
+	cb := func(info logdb.LogDBInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		busy[info.Shard] = info.Busy
+	}
+	dirs := []string{RDBTestDirectory, RDBTestDirectory}
+	db, err := OpenShardedDB(cfg, cb, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 2, 10)
+	wait := func(level FreeSpaceLevel) {
+		require.Eventually(t, func() bool {
+			for _, l := range db.FreeSpaceLevels() {
+				if l != level {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, time.Millisecond)
+	}
+	atomic.StoreUint64(&fs.free, 400)
+	wait(FreeSpaceLow)
+	saveTestNode(t, db, 3, 2, 10)
+	atomic.StoreUint64(&fs.free, 50)
+	wait(FreeSpaceCritical)
+	err = db.SaveRaftState([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 2, Vote: 3, Commit: 10},
+		EntriesToSave: []pb.Entry{{Index: 11, Term: 2}},
+	}}, 1)
+	require.True(t, errors.Is(err, ErrFreeSpaceCritical))
+	require.NoError(t, db.SaveRaftState([]pb.Update{{
+		ClusterID: 1,
+		NodeID:    2,
+		State:     pb.State{Term: 2, Vote: 3, Commit: 10},
+	}}, 1))
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rs.State.Vote)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	// only the entries are rejected, both nodes are in the same shard, the
+	// commit is capped to the saved entries
+	err = db.SaveRaftState([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 3, Vote: 3, Commit: 11},
+		Snapshot:      pb.Snapshot{Index: 5, Term: 1},
+		EntriesToSave: []pb.Entry{{Index: 11, Term: 3}},
+	}, {
+		ClusterID: 3,
+		NodeID:    2,
+		State:     pb.State{Term: 3, Vote: 4, Commit: 10},
+	}}, 1)
+	require.True(t, errors.Is(err, ErrFreeSpaceCritical))
+	rs, err = db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rs.State.Term)
+	require.Equal(t, uint64(10), rs.State.Commit)
+	// entries after the saved snapshot
+	require.Equal(t, uint64(5), rs.EntryCount)
+	ss, err := db.GetSnapshot(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), ss.Index)
+	rs, err = db.ReadRaftState(3, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), rs.State.Vote)
+	atomic.StoreUint64(&fs.free, 1000)
+	wait(FreeSpaceOK)
+	saveTestNode(t, db, 5, 2, 10)
+	// levels are updated before the listener is called
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(infos) == 6
+	}, 5*time.Second, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, FreeSpaceLow, infos[0].Level)
+	require.Equal(t, uint64(400), infos[0].Free)
+	require.Equal(t, uint64(1000), infos[0].Total)
+	require.Equal(t, FreeSpaceOK, infos[5].Level)
+	require.Equal(t, map[uint64]bool{0: false, 1: false}, busy)
+}
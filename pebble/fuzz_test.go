@@ -0,0 +1,104 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble/invariants"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzKeyDecoding(f *testing.F) {
+	k := newKey(maxKeySize, nil)
+	k.SetEntryKey(1, 2, 3)
+	f.Add(append([]byte{}, k.Key()...))
+	k.SetStateKey(1, 2)
+	f.Add(append([]byte{}, k.Key()...))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if cid, nid, err := decodeNodeInfoKey(data); err == nil {
+			k := newKey(maxKeySize, nil)
+			k.SetStateKey(cid, nid)
+			require.Equal(t, data[4:], k.Key()[4:])
+		} else {
+			require.True(t, errors.Is(err, ErrCorruptedRecord))
+		}
+		if cid, nid, index, err := decodeEntryKey(data); err == nil {
+			k := newKey(maxKeySize, nil)
+			k.SetEntryKey(cid, nid, index)
+			require.Equal(t, data[4:], k.Key()[4:])
+		} else {
+			require.True(t, errors.Is(err, ErrCorruptedRecord))
+		}
+	})
+}
+
+// FuzzReadCorruptedRecords stores adversarial records of a node and makes sure
+// reading them returns errors rather than panicking.
+func FuzzReadCorruptedRecords(f *testing.F) {
+	ent := pb.Entry{Index: 1, Term: 1, Cmd: []byte("data")}
+	ss := pb.Snapshot{Index: 1, Term: 1}
+	st := pb.State{Term: 1, Commit: 1}
+	bs := pb.Bootstrap{Join: true}
+	mi := make([]byte, 8)
+	binary.BigEndian.PutUint64(mi, 2)
+	f.Add(pb.MustMarshal(&ent), pb.MustMarshal(&ss), pb.MustMarshal(&st),
+		pb.MustMarshal(&bs), mi, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{0xff}, []byte{0x0a, 0xff}, []byte{0x08}, []byte{0x12},
+		[]byte{1}, []byte{})
+	f.Add(pb.MustMarshal(&pb.Entry{Term: 1}), []byte{}, []byte{}, []byte{}, mi, []byte{1})
+
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.NoError(f, err)
+	defer func() {
+		require.NoError(f, db.Close())
+	}()
+	kvs := db.shards[0].kvs
+	f.Fuzz(func(t *testing.T, entry []byte, snapshot []byte, state []byte,
+		bootstrap []byte, maxIndex []byte, suffix []byte) {
+		keys := make([][]byte, 0)
+		save := func(key []byte, value []byte) {
+			require.NoError(t, kvs.SaveValue(key, value))
+			keys = append(keys, key)
+		}
+		defer func() {
+			for _, key := range keys {
+				require.NoError(t, kvs.DeleteValue(key))
+			}
+		}()
+		k := newKey(maxKeySize, nil)
+		for i := uint64(1); i <= 2; i++ {
+			k.SetEntryKey(1, 2, i)
+			save(append([]byte{}, k.Key()...), entry)
+		}
+		// a malformed key sorted among the entry keys of the node
+		k.SetEntryKey(1, 2, 0)
+		save(append(append([]byte{}, k.Key()[:20]...), suffix...), entry)
+		k.setSnapshotKey(1, 2, 1)
+		save(append([]byte{}, k.Key()...), snapshot)
+		k.SetStateKey(1, 2)
+		save(append([]byte{}, k.Key()...), state)
+		k.setBootstrapKey(1, 2)
+		save(append([]byte{}, k.Key()...), bootstrap)
+		k.SetMaxIndexKey(1, 2)
+		save(append([]byte{}, k.Key()...), maxIndex)
+
+		_, _ = db.ReadRaftState(1, 2, 0)
+		_, _ = db.GetSnapshot(1, 2)
+		_, _ = db.GetBootstrapInfo(1, 2)
+		_, _ = db.ListNodeInfo()
+		_, _, _ = db.IterateEntries(nil, 0, 1, 2, 1, 2, 1024)
+		_, _, _ = db.IterateEntries(nil, 0, 1, 2, 1, 3, 1024)
+		_, _ = db.DumpStates()
+		_, _ = db.Stats()
+		_, _ = db.Verify()
+		_, _ = invariants.CheckLogDB(db)
+	})
+}
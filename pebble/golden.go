@@ -0,0 +1,301 @@
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// keyLayoutVersion is the version of the key layout defined in key.go, it
+	// must be bumped whenever the layout of any key changes.
+	keyLayoutVersion uint32 = 1
+	// GoldenDataShards is the number of shards of golden databases.
+	GoldenDataShards uint64 = 2
+)
+
+// GoldenFormat identifies the on disk format of a golden database.
+type GoldenFormat struct {
+	BinaryFormat uint32
+	KeyLayout    uint32
+}
+
+// Name returns the name of the golden database directory.
+func (f GoldenFormat) Name() string {
+	return fmt.Sprintf("binfmt-%d-keys-%d", f.BinaryFormat, f.KeyLayout)
+}
+
+// CurrentGoldenFormat returns the on disk format written by this release.
+func CurrentGoldenFormat() GoldenFormat {
+	return GoldenFormat{
+		BinaryFormat: raftio.PlainLogDBBinVersion,
+		KeyLayout:    keyLayoutVersion,
+	}
+}
+
+// GetGoldenLogDBConfig returns the LogDB config used for generating and
+// opening golden databases.
+func GetGoldenLogDBConfig(fs vfs.FS) LogDBConfig {
+	cfg := GetTinyMemLogDBConfig()
+	cfg.Shards = GoldenDataShards
+	cfg.FS = fs
+	return cfg
+}
+
+// GenerateGoldenData generates a small reference database in the specified
+// dir using the current on disk format. The database covers all record types
+// and is expected to be kept as a test fixture, every later release must be
+// able to open it and pass the CheckGoldenData check. The dir must not exist
+// yet.
+func GenerateGoldenData(fs vfs.FS, dir string) (f GoldenFormat, err error) {
+	if _, err := fs.Stat(dir); err == nil {
+		return GoldenFormat{}, errors.Errorf("golden data dir %s already exist", dir)
+	}
+	db, err := NewLogDB(GetGoldenLogDBConfig(fs), nil, []string{dir}, nil, CheckNone)
+	if err != nil {
+		return GoldenFormat{}, err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	save := func(ud pb.Update) error {
+		return db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext())
+	}
+	// cluster 1 node 1, a snapshotted and compacted log, later entries are
+	// saved after the compaction so they are only found in the WAL
+	if err := db.SaveBootstrapInfo(1, 1, goldenBootstrap(pb.RegularStateMachine)); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := save(goldenUpdate(1, 1, 1, 100, 1)); err != nil {
+		return GoldenFormat{}, err
+	}
+	ss := goldenSnapshot(1, 50, 1, pb.RegularStateMachine)
+	if err := db.SaveSnapshots([]pb.Update{{ClusterID: 1, NodeID: 1, Snapshot: ss}}); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := db.RemoveEntriesTo(1, 1, 50); err != nil {
+		return GoldenFormat{}, err
+	}
+	done, err := db.CompactEntriesTo(1, 1, 50)
+	if err != nil {
+		return GoldenFormat{}, err
+	}
+	<-done
+	if err := save(goldenUpdate(1, 1, 101, 110, 2)); err != nil {
+		return GoldenFormat{}, err
+	}
+	// cluster 2 node 3, a log with its tail overwritten by a later term
+	if err := db.SaveBootstrapInfo(2, 3, goldenBootstrap(pb.ConcurrentStateMachine)); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := save(goldenUpdate(2, 3, 1, 20, 1)); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := save(goldenUpdate(2, 3, 15, 22, 3)); err != nil {
+		return GoldenFormat{}, err
+	}
+	// cluster 3 node 1, an imported snapshot
+	if err := db.ImportSnapshot(goldenSnapshot(3, 200, 4, pb.OnDiskStateMachine), 1); err != nil {
+		return GoldenFormat{}, err
+	}
+	// cluster 4 node 2, removed node
+	if err := db.SaveBootstrapInfo(4, 2, goldenBootstrap(pb.RegularStateMachine)); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := save(goldenUpdate(4, 2, 1, 10, 1)); err != nil {
+		return GoldenFormat{}, err
+	}
+	if err := db.RemoveNodeData(4, 2); err != nil {
+		return GoldenFormat{}, err
+	}
+	return CurrentGoldenFormat(), nil
+}
+
+// CheckGoldenData checks that the LogDB returns exactly the content written
+// by GenerateGoldenData.
+func CheckGoldenData(db raftio.ILogDB) error {
+	nodes, err := db.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	expected := []raftio.NodeInfo{{ClusterID: 1, NodeID: 1},
+		{ClusterID: 2, NodeID: 3}, {ClusterID: 3, NodeID: 1}}
+	if !sameNodeInfo(nodes, expected) {
+		return errors.Errorf("got nodes %v, want %v", nodes, expected)
+	}
+	checks := []struct {
+		clusterID uint64
+		nodeID    uint64
+		bootstrap pb.Bootstrap
+		snapshot  pb.Snapshot
+		state     pb.State
+		first     uint64
+		last      uint64
+		terms     func(index uint64) uint64
+	}{
+		{
+			clusterID: 1,
+			nodeID:    1,
+			bootstrap: goldenBootstrap(pb.RegularStateMachine),
+			snapshot:  goldenSnapshot(1, 50, 1, pb.RegularStateMachine),
+			state:     goldenState(1, 110, 2),
+			first:     50,
+			last:      110,
+			terms: func(index uint64) uint64 {
+				if index > 100 {
+					return 2
+				}
+				return 1
+			},
+		},
+		{
+			clusterID: 2,
+			nodeID:    3,
+			bootstrap: goldenBootstrap(pb.ConcurrentStateMachine),
+			state:     goldenState(3, 22, 3),
+			first:     1,
+			last:      22,
+			terms: func(index uint64) uint64 {
+				if index >= 15 {
+					return 3
+				}
+				return 1
+			},
+		},
+		{
+			clusterID: 3,
+			nodeID:    1,
+			bootstrap: pb.Bootstrap{Join: true, Type: pb.OnDiskStateMachine},
+			snapshot:  goldenSnapshot(3, 200, 4, pb.OnDiskStateMachine),
+			state:     pb.State{Term: 4, Commit: 200},
+		},
+	}
+	for _, c := range checks {
+		ni := raftio.GetNodeInfo(c.clusterID, c.nodeID)
+		bs, err := db.GetBootstrapInfo(c.clusterID, c.nodeID)
+		if err != nil {
+			return errors.Wrapf(err, "%v", ni)
+		}
+		if !reflect.DeepEqual(bs, c.bootstrap) {
+			return errors.Errorf("%v got bootstrap %v, want %v", ni, bs, c.bootstrap)
+		}
+		ss, err := db.GetSnapshot(c.clusterID, c.nodeID)
+		if err != nil {
+			return errors.Wrapf(err, "%v", ni)
+		}
+		if !reflect.DeepEqual(ss, c.snapshot) {
+			return errors.Errorf("%v got snapshot %v, want %v", ni, ss, c.snapshot)
+		}
+		rs, err := db.ReadRaftState(c.clusterID, c.nodeID, ss.Index)
+		if err != nil {
+			return errors.Wrapf(err, "%v", ni)
+		}
+		if !pb.IsStateEqual(rs.State, c.state) {
+			return errors.Errorf("%v got state %v, want %v", ni, rs.State, c.state)
+		}
+		if c.last == 0 {
+			if rs.EntryCount != 0 {
+				return errors.Errorf("%v got %d entries, want 0", ni, rs.EntryCount)
+			}
+			continue
+		}
+		if rs.FirstIndex != c.first || rs.FirstIndex+rs.EntryCount-1 != c.last {
+			return errors.Errorf("%v got range [%d, %d), want [%d, %d]", ni,
+				rs.FirstIndex, rs.FirstIndex+rs.EntryCount, c.first, c.last)
+		}
+		ents, _, err := db.IterateEntries(nil, 0,
+			c.clusterID, c.nodeID, c.first, c.last+1, ^uint64(0))
+		if err != nil {
+			return errors.Wrapf(err, "%v", ni)
+		}
+		if uint64(len(ents)) != c.last-c.first+1 {
+			return errors.Errorf("%v got %d entries, want %d",
+				ni, len(ents), c.last-c.first+1)
+		}
+		for i, e := range ents {
+			index := c.first + uint64(i)
+			term := c.terms(index)
+			if e.Index != index || e.Term != term ||
+				!bytes.Equal(e.Cmd, goldenCmd(c.clusterID, c.nodeID, index, term)) {
+				return errors.Errorf("%v got unexpected entry %v", ni, e)
+			}
+		}
+	}
+	if _, err := db.GetBootstrapInfo(4, 2); !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return errors.Errorf("removed node got bootstrap info, %v", err)
+	}
+	return nil
+}
+
+func sameNodeInfo(nodes []raftio.NodeInfo, expected []raftio.NodeInfo) bool {
+	if len(nodes) != len(expected) {
+		return false
+	}
+	found := make(map[raftio.NodeInfo]struct{})
+	for _, n := range nodes {
+		found[n] = struct{}{}
+	}
+	for _, n := range expected {
+		if _, ok := found[n]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func goldenBootstrap(smType pb.StateMachineType) pb.Bootstrap {
+	return pb.Bootstrap{
+		Addresses: map[uint64]string{1: "a1", 2: "a2", 3: "a3"},
+		Type:      smType,
+	}
+}
+
+func goldenSnapshot(clusterID uint64,
+	index uint64, term uint64, smType pb.StateMachineType) pb.Snapshot {
+	return pb.Snapshot{
+		ClusterId: clusterID,
+		Index:     index,
+		Term:      term,
+		Filepath:  fmt.Sprintf("snapshot-%d-%d", clusterID, index),
+		FileSize:  1024,
+		Type:      smType,
+		Membership: pb.Membership{
+			ConfigChangeId: index,
+			Addresses:      map[uint64]string{1: "a1", 2: "a2", 3: "a3"},
+		},
+	}
+}
+
+func goldenState(nodeID uint64, last uint64, term uint64) pb.State {
+	return pb.State{Term: term, Vote: nodeID, Commit: last}
+}
+
+func goldenCmd(clusterID uint64,
+	nodeID uint64, index uint64, term uint64) []byte {
+	return []byte(fmt.Sprintf("golden-%d-%d-%d-%d", clusterID, nodeID, index, term))
+}
+
+func goldenUpdate(clusterID uint64,
+	nodeID uint64, first uint64, last uint64, term uint64) pb.Update {
+	ents := make([]pb.Entry, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		ents = append(ents, pb.Entry{
+			Index: i,
+			Term:  term,
+			Cmd:   goldenCmd(clusterID, nodeID, i, term),
+		})
+	}
+	return pb.Update{
+		ClusterID:     clusterID,
+		NodeID:        nodeID,
+		State:         goldenState(nodeID, last, term),
+		EntriesToSave: ents,
+	}
+}
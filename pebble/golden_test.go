@@ -0,0 +1,75 @@
+package pebble
+
+import (
+	"io"
+	"testing"
+
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+const goldenTestDataDir = "testdata/golden"
+
+// copyDir copies the dir from vfs.Default into the dst FS.
+func copyDir(t *testing.T, src string, dst vfs.FS, target string) {
+	require.NoError(t, dst.MkdirAll(target, 0755))
+	names, err := vfs.Default.List(src)
+	require.NoError(t, err)
+	for _, name := range names {
+		sp := vfs.Default.PathJoin(src, name)
+		tp := dst.PathJoin(target, name)
+		fi, err := vfs.Default.Stat(sp)
+		require.NoError(t, err)
+		if fi.IsDir() {
+			copyDir(t, sp, dst, tp)
+			continue
+		}
+		in, err := vfs.Default.Open(sp)
+		require.NoError(t, err)
+		out, err := dst.Create(tp)
+		require.NoError(t, err)
+		_, err = io.Copy(out, in)
+		require.NoError(t, err)
+		require.NoError(t, out.Close())
+		require.NoError(t, in.Close())
+	}
+}
+
+func TestGoldenDataCanBeGenerated(t *testing.T) {
+	fs := vfs.NewMem()
+	f, err := GenerateGoldenData(fs, "golden")
+	require.NoError(t, err)
+	require.Equal(t, CurrentGoldenFormat(), f)
+	_, err = GenerateGoldenData(fs, "golden")
+	require.Error(t, err)
+	db, err := NewLogDB(GetGoldenLogDBConfig(fs), nil, []string{"golden"}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, CheckGoldenData(db))
+	require.NoError(t, db.Close())
+}
+
+// TestGoldenDataCompatibility makes sure all golden databases found in the
+// testdata dir can still be opened and read. Run logdbctl golden -out
+// pebble/testdata/golden from the module root to add the golden database of
+// a new on disk format, existing golden databases must never be modified.
+func TestGoldenDataCompatibility(t *testing.T) {
+	names, err := vfs.Default.List(goldenTestDataDir)
+	require.NoError(t, err)
+	require.Contains(t, names, CurrentGoldenFormat().Name(),
+		"no golden database of the current on disk format")
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			fs := vfs.NewMem()
+			copyDir(t, vfs.Default.PathJoin(goldenTestDataDir, name), fs, name)
+			db, err := NewLogDB(GetGoldenLogDBConfig(fs), nil, []string{name}, nil, CheckNone)
+			require.NoError(t, err)
+			require.NoError(t, CheckGoldenData(db))
+			require.NoError(t, db.Close())
+			// reopened after being written by the current release
+			db, err = NewLogDB(GetGoldenLogDBConfig(fs), nil, []string{name}, nil, CheckNone)
+			require.NoError(t, err)
+			require.NoError(t, CheckGoldenData(db))
+			require.NoError(t, db.Close())
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/cockroachdb/pebble/sstable"
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/pkg/errors"
+)
+
+// ingestFileSize is the size at which the sstables built for ingestion are
+// rotated.
+const ingestFileSize = 64 * 1024 * 1024
+
+// errUnorderedIngestion indicates that records were not added to an ingester
+// in strictly increasing key order.
+var errUnorderedIngestion = errors.New("records not in increasing key order")
+
+// canIngest returns a boolean value indicating whether records can be
+// ingested as external sstables. Mirroring and shipping only observe write
+// batches, ingestion is not used when either of them is enabled.
+func (r *KV) canIngest() bool {
+	return r.config.IngestImports && !r.config.ReadOnly && !r.observed()
+}
+
+// ingester builds external sstables from records added in strictly increasing
+// key order and ingests them into the KV store.
+type ingester struct {
+	kv    *KV
+	fs    pvfs.FS
+	paths []string
+	w     *sstable.Writer
+	last  []byte
+	size  uint64
+}
+
+func (r *KV) newIngester() *ingester {
+	fs := r.opts.FS
+	if fs == nil {
+		fs = pvfs.Default
+	}
+	return &ingester{kv: r, fs: fs}
+}
+
+func (i *ingester) add(key []byte, data []byte) error {
+	if i.last != nil && bytes.Compare(key, i.last) <= 0 {
+		return errors.Wrapf(errUnorderedIngestion, "key %x after %x", key, i.last)
+	}
+	if i.w == nil {
+		name := i.fs.PathJoin(i.kv.dir, fmt.Sprintf("ingest-%d.sst", len(i.paths)))
+		f, err := i.fs.Create(name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		opts := i.kv.opts.MakeWriterOptions(0)
+		opts.Cache = nil
+		i.w = sstable.NewWriter(f, opts)
+		i.paths = append(i.paths, name)
+		i.size = 0
+	}
+	if err := i.w.Set(key, data); err != nil {
+		return errors.WithStack(err)
+	}
+	i.last = append(i.last[:0], key...)
+	i.size += uint64(len(key) + len(data))
+	if i.size >= ingestFileSize {
+		return i.closeWriter()
+	}
+	return nil
+}
+
+func (i *ingester) closeWriter() error {
+	if i.w == nil {
+		return nil
+	}
+	w := i.w
+	i.w = nil
+	return errors.WithStack(w.Close())
+}
+
+// ingest ingests all built sstables, the sstables are removed afterwards
+// whether the ingestion succeeded or not.
+func (i *ingester) ingest() (err error) {
+	defer func() {
+		err = firstError(err, i.cleanup())
+	}()
+	if err := i.closeWriter(); err != nil {
+		return err
+	}
+	if len(i.paths) == 0 {
+		return nil
+	}
+	return errors.WithStack(i.kv.db.Ingest(i.paths))
+}
+
+// cleanup closes the sstable being built and removes all built sstables.
+func (i *ingester) cleanup() error {
+	var err error
+	if i.w != nil {
+		// the writer is being abandoned, its error is not interesting
+		_ = i.w.Close()
+		i.w = nil
+	}
+	for _, p := range i.paths {
+		// pebble may have moved the sstable when ingesting it
+		if rerr := i.fs.Remove(p); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+			err = firstError(err, errors.WithStack(rerr))
+		}
+	}
+	i.paths = nil
+	return err
+}
@@ -0,0 +1,90 @@
+package pebble
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// DirInfo describes the LogDB found in a directory as reported by InspectDir.
+type DirInfo struct {
+	// Exists is set when the directory contains a LogDB, all other fields
+	// are only valid when it is set.
+	Exists bool
+	// Shards is the number of shards found in the directory.
+	Shards uint64
+	// BinaryFormat is the binary format of the stored records.
+	BinaryFormat uint32
+	// FormatMajorVersion is the lowest pebble format major version of all
+	// shards.
+	FormatMajorVersion uint64
+	// Standby is set when the directory is a standby maintained by
+	// mirroring, see PromoteStandby.
+	Standby bool
+	// Unclean is set when at least one shard was not closed cleanly.
+	Unclean bool
+}
+
+// InspectDir reports the LogDB found in dir without opening any of its
+// shards, e.g. so the LogDB can be migrated or rejected before calling
+// NewLogDB. Only the manifest and marker files of each shard are read, the
+// LogDB must not be open when dir is on a file system not supporting
+// concurrent readers.
+func InspectDir(dir string, fs vfs.FS) (DirInfo, error) {
+	exist, err := fileutil.DirExist(dir, fs)
+	if err != nil {
+		return DirInfo{}, errors.WithStack(err)
+	}
+	if !exist {
+		return DirInfo{}, nil
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return DirInfo{}, errors.WithStack(err)
+	}
+	shards := uint64(0)
+	for _, name := range names {
+		if !isShardDirName(name) {
+			continue
+		}
+		shard, _ := strconv.ParseUint(strings.TrimPrefix(name, shardDirPrefix), 10, 64)
+		if shard+1 > shards {
+			shards = shard + 1
+		}
+	}
+	if shards == 0 {
+		return DirInfo{}, nil
+	}
+	info := DirInfo{
+		Exists:       true,
+		Shards:       shards,
+		BinaryFormat: raftio.PlainLogDBBinVersion,
+		Standby:      isStandby(dir, fs),
+	}
+	for i := uint64(0); i < shards; i++ {
+		sdir := fs.PathJoin(dir, shardDirName(i))
+		exist, err := fileutil.DirExist(sdir, fs)
+		if err != nil {
+			return DirInfo{}, errors.WithStack(err)
+		}
+		var desc *pebble.DBDesc
+		if exist {
+			if desc, err = pebble.Peek(sdir, NewPebbleFS(fs)); err != nil {
+				return DirInfo{}, errors.Wrapf(err, "shard %d", i)
+			}
+		}
+		if !exist || !desc.Exists {
+			return DirInfo{}, errors.Errorf("shard %d not found in %s", i, dir)
+		}
+		if i == 0 || uint64(desc.FormatMajorVersion) < info.FormatMajorVersion {
+			info.FormatMajorVersion = uint64(desc.FormatMajorVersion)
+		}
+		info.Unclean = info.Unclean || hasRunningMarker(sdir, fs)
+	}
+	return info, nil
+}
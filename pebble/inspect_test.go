@@ -0,0 +1,45 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectDirReportsLogDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	info, err := InspectDir(dir, fs)
+	require.NoError(t, err)
+	require.False(t, info.Exists)
+
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	info, err = InspectDir(dir, fs)
+	require.NoError(t, err)
+	require.True(t, info.Exists)
+	require.True(t, info.Unclean)
+	require.NoError(t, db.Close())
+
+	info, err = InspectDir(dir, fs)
+	require.NoError(t, err)
+	require.Equal(t, DirInfo{
+		Exists:             true,
+		Shards:             cfg.Shards,
+		BinaryFormat:       raftio.PlainLogDBBinVersion,
+		FormatMajorVersion: uint64(pebble.FormatMostCompatible),
+	}, info)
+
+	require.NoError(t, fs.RemoveAll(fs.PathJoin(dir, shardDirName(1))))
+	_, err = InspectDir(dir, fs)
+	require.Error(t, err)
+}
@@ -0,0 +1,247 @@
+/*
+Package invariants provides reusable checks of the invariants expected to hold
+between the records of each node stored in a LogDB. The same checks are used by
+the ShardedDB.Verify method, the simulation harness and the fuzz tests. They
+can also be run against any LogDB instance via the raftio.ILogDB API, e.g. in
+CI pipelines checking LogDB directories produced by integration tests.
+
+The following invariants are checked:
+
+  - maxIndex consistency, entries up to the max index must be present and the
+    snapshot index can not be beyond the max index
+  - entry contiguity, entries above the snapshot index have no gaps and their
+    terms never decrease
+  - snapshot monotonicity, the terms of snapshots never decrease with the
+    growing snapshot index
+*/
+package invariants
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// Violation describes a single invariant violation of a node.
+type Violation struct {
+	ClusterID uint64
+	NodeID    uint64
+	Message   string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("[%05d:%05d]: %s", v.ClusterID, v.NodeID, v.Message)
+}
+
+// Records is the summary of the records of a single node, it is built by
+// adding records in the order of their indexes.
+type Records struct {
+	HasBootstrap bool
+	HasMaxIndex  bool
+	MaxIndex     uint64
+	// Entries is the number of added entries.
+	Entries   uint64
+	LastIndex uint64
+	LastTerm  uint64
+	// Gaps are the inclusive ranges of missing entries between the added
+	// entries.
+	Gaps [][2]uint64
+	// TermDecreases are the indexes of entries with a term lower than the term
+	// of the preceding entry.
+	TermDecreases []uint64
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	// SnapshotTermDecreases are the indexes of snapshots with a term lower than
+	// the term of the preceding snapshot.
+	SnapshotTermDecreases []uint64
+}
+
+// AddEntry adds the entry with the specified index and term.
+func (r *Records) AddEntry(index uint64, term uint64) {
+	if r.Entries > 0 {
+		if index != r.LastIndex+1 {
+			r.Gaps = append(r.Gaps, [2]uint64{r.LastIndex + 1, index - 1})
+		}
+		if term < r.LastTerm {
+			r.TermDecreases = append(r.TermDecreases, index)
+		}
+	}
+	r.LastIndex = index
+	r.LastTerm = term
+	r.Entries++
+}
+
+// AddSnapshot adds the snapshot with the specified index and term.
+func (r *Records) AddSnapshot(index uint64, term uint64) {
+	if index > r.SnapshotIndex || r.SnapshotIndex == 0 {
+		if term < r.SnapshotTerm {
+			r.SnapshotTermDecreases = append(r.SnapshotTermDecreases, index)
+		}
+		r.SnapshotIndex = index
+		r.SnapshotTerm = term
+	}
+}
+
+// SetMaxIndex sets the max index of the node.
+func (r *Records) SetMaxIndex(index uint64) {
+	r.MaxIndex = index
+	r.HasMaxIndex = true
+}
+
+// Check runs all checks and returns the violation messages.
+func (r *Records) Check() []string {
+	var result []string
+	if !r.HasBootstrap {
+		result = append(result, "no bootstrap record")
+	}
+	result = append(result, CheckMaxIndex(r)...)
+	result = append(result, CheckEntryContiguity(r)...)
+	result = append(result, CheckSnapshotMonotonicity(r)...)
+	return result
+}
+
+// CheckMetadata runs the checks not involving entries, for records added
+// without their entries.
+func CheckMetadata(r *Records) []string {
+	var result []string
+	if !r.HasBootstrap {
+		result = append(result, "no bootstrap record")
+	}
+	if r.HasMaxIndex && r.SnapshotIndex > r.MaxIndex {
+		result = append(result, fmt.Sprintf("snapshot index %d beyond max index %d",
+			r.SnapshotIndex, r.MaxIndex))
+	}
+	result = append(result, CheckSnapshotMonotonicity(r)...)
+	return result
+}
+
+// CheckMaxIndex checks that all entries up to the max index are present and
+// that the snapshot index is not beyond the max index.
+func CheckMaxIndex(r *Records) []string {
+	var result []string
+	if r.Entries > 0 && !r.HasMaxIndex {
+		result = append(result, "entries found without max index record")
+	}
+	if !r.HasMaxIndex {
+		return result
+	}
+	if r.SnapshotIndex > r.MaxIndex {
+		result = append(result, fmt.Sprintf("snapshot index %d beyond max index %d",
+			r.SnapshotIndex, r.MaxIndex))
+	}
+	if r.MaxIndex > r.SnapshotIndex && (r.Entries == 0 || r.LastIndex < r.MaxIndex) {
+		result = append(result, fmt.Sprintf("entries up to max index %d missing, last index %d",
+			r.MaxIndex, r.LastIndex))
+	}
+	return result
+}
+
+// CheckEntryContiguity checks that there is no gap between entries above the
+// snapshot index and that entry terms never decrease.
+func CheckEntryContiguity(r *Records) []string {
+	var result []string
+	// entries below the snapshot index are not required, they might not have
+	// been removed yet after a snapshot was installed
+	for _, gap := range r.Gaps {
+		if gap[1] > r.SnapshotIndex && (!r.HasMaxIndex || gap[0] <= r.MaxIndex) {
+			result = append(result, fmt.Sprintf("entries [%d, %d] missing",
+				gap[0], gap[1]))
+		}
+	}
+	for _, index := range r.TermDecreases {
+		result = append(result, fmt.Sprintf("entry %d term lower than the term of entry %d",
+			index, index-1))
+	}
+	return result
+}
+
+// CheckSnapshotMonotonicity checks that snapshot terms never decrease.
+func CheckSnapshotMonotonicity(r *Records) []string {
+	var result []string
+	for _, index := range r.SnapshotTermDecreases {
+		result = append(result, fmt.Sprintf("snapshot %d term lower than the term of an earlier snapshot",
+			index))
+	}
+	return result
+}
+
+// CheckNode checks the invariants of the specified node using the
+// raftio.ILogDB API. It returns an error only when the LogDB can not be read.
+func CheckNode(db raftio.ILogDB,
+	clusterID uint64, nodeID uint64) ([]Violation, error) {
+	r := &Records{}
+	if _, err := db.GetBootstrapInfo(clusterID, nodeID); err == nil {
+		r.HasBootstrap = true
+	} else if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return nil, err
+	}
+	ss, err := db.GetSnapshot(clusterID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		r.AddSnapshot(ss.Index, ss.Term)
+	}
+	rs, err := db.ReadRaftState(clusterID, nodeID, ss.Index)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		return nil, err
+	}
+	var result []Violation
+	violate := func(messages ...string) {
+		for _, msg := range messages {
+			result = append(result, Violation{
+				ClusterID: clusterID,
+				NodeID:    nodeID,
+				Message:   msg,
+			})
+		}
+	}
+	if rs.EntryCount > 0 {
+		last := rs.FirstIndex + rs.EntryCount - 1
+		r.SetMaxIndex(last)
+		if rs.FirstIndex > ss.Index+1 && ss.Index > 0 {
+			violate(fmt.Sprintf("entries [%d, %d] missing", ss.Index+1, rs.FirstIndex-1))
+		}
+		ents, _, err := db.IterateEntries(nil, 0,
+			clusterID, nodeID, rs.FirstIndex, last+1, ^uint64(0))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			r.AddEntry(e.Index, e.Term)
+		}
+		if len(ents) > 0 && ents[0].Index != rs.FirstIndex {
+			violate(fmt.Sprintf("first entry %d, want %d", ents[0].Index, rs.FirstIndex))
+		}
+	} else if !pb.IsEmptySnapshot(ss) {
+		r.SetMaxIndex(ss.Index)
+	}
+	violate(r.Check()...)
+	return result, nil
+}
+
+// CheckLogDB checks the invariants of all nodes found in the LogDB.
+func CheckLogDB(db raftio.ILogDB) ([]Violation, error) {
+	nodes, err := db.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].ClusterID != nodes[j].ClusterID {
+			return nodes[i].ClusterID < nodes[j].ClusterID
+		}
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	var result []Violation
+	for _, n := range nodes {
+		v, err := CheckNode(db, n.ClusterID, n.NodeID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check %v", n)
+		}
+		result = append(result, v...)
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package invariants
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthyRecordsPassAllChecks(t *testing.T) {
+	r := &Records{HasBootstrap: true}
+	// entries below the snapshot index might not have been removed yet
+	r.AddEntry(3, 1)
+	r.AddEntry(5, 1)
+	r.AddEntry(6, 2)
+	r.AddEntry(7, 2)
+	r.AddSnapshot(3, 1)
+	r.AddSnapshot(5, 1)
+	r.SetMaxIndex(7)
+	require.Empty(t, r.Check())
+}
+
+func TestMaxIndexViolationsAreReported(t *testing.T) {
+	r := &Records{HasBootstrap: true}
+	r.AddEntry(1, 1)
+	require.Equal(t, []string{"entries found without max index record"}, CheckMaxIndex(r))
+	r.SetMaxIndex(3)
+	require.Equal(t, []string{"entries up to max index 3 missing, last index 1"},
+		CheckMaxIndex(r))
+	r.AddSnapshot(4, 1)
+	require.Len(t, CheckMaxIndex(r), 1)
+	require.True(t, strings.Contains(CheckMaxIndex(r)[0], "snapshot index 4 beyond max index 3"))
+}
+
+func TestEntryContiguityViolationsAreReported(t *testing.T) {
+	r := &Records{HasBootstrap: true}
+	r.AddEntry(1, 2)
+	r.AddEntry(4, 2)
+	r.AddEntry(5, 1)
+	r.SetMaxIndex(5)
+	require.Equal(t, []string{
+		"entries [2, 3] missing",
+		"entry 5 term lower than the term of entry 4",
+	}, CheckEntryContiguity(r))
+	r.AddSnapshot(3, 2)
+	require.Len(t, CheckEntryContiguity(r), 1)
+}
+
+func TestSnapshotMonotonicityViolationsAreReported(t *testing.T) {
+	r := &Records{HasBootstrap: true}
+	r.AddSnapshot(10, 3)
+	r.AddSnapshot(20, 2)
+	// older snapshots are ignored
+	r.AddSnapshot(5, 1)
+	require.Equal(t, []string{"snapshot 20 term lower than the term of an earlier snapshot"},
+		CheckSnapshotMonotonicity(r))
+	require.Equal(t, uint64(20), r.SnapshotIndex)
+}
+
+func TestMetadataViolationsAreReported(t *testing.T) {
+	r := &Records{}
+	r.SetMaxIndex(3)
+	// entries are not checked
+	require.Equal(t, []string{"no bootstrap record"}, CheckMetadata(r))
+	r.HasBootstrap = true
+	r.AddSnapshot(2, 2)
+	require.Empty(t, CheckMetadata(r))
+	r.AddSnapshot(4, 1)
+	require.Len(t, CheckMetadata(r), 2)
+}
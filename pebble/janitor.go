@@ -0,0 +1,109 @@
+package pebble
+
+import (
+	"math"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/pkg/errors"
+)
+
+// RunJanitor removes entries of all nodes with an index lower than the index
+// of the latest snapshot of the node minus JanitorRetainedEntries. Such
+// entries are normally removed when snapshots are taken, RunJanitor removes
+// those left behind, e.g. when the process crashed before the log was
+// trimmed. It returns the number of nodes with removed entries. RunJanitor
+// is periodically invoked when JanitorInterval is set, shards not opened yet
+// are skipped.
+func (s *ShardedDB) RunJanitor() (int, error) {
+	trimmed := 0
+	for _, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		ni, err := shard.listNodeInfo()
+		if err != nil {
+			return trimmed, errors.WithStack(err)
+		}
+		for _, n := range ni {
+			ok, _, err := s.trimNode(shard, n)
+			if err != nil {
+				return trimmed, err
+			}
+			if ok {
+				trimmed++
+			}
+		}
+	}
+	return trimmed, nil
+}
+
+// trimNode removes the entries of the specified node not retained by the
+// janitor. It returns a boolean value indicating whether any entry was
+// removed and the estimated disk usage of the removed entries.
+func (s *ShardedDB) trimNode(shard *db, n raftio.NodeInfo) (bool, uint64, error) {
+	index, err := shard.getJanitorTrimIndex(n.ClusterID,
+		n.NodeID, s.config.JanitorRetainedEntries)
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	if index == 0 {
+		return false, 0, nil
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(n.ClusterID, n.NodeID, 0)
+	lk.SetEntryKey(n.ClusterID, n.NodeID, index)
+	size, err := shard.kvs.EstimateDiskUsage(fk.Key(), lk.Key())
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	if err := s.RemoveEntriesTo(n.ClusterID, n.NodeID, index); err != nil {
+		return false, 0, err
+	}
+	plog.Infof("%s janitor removed entries up to index %d",
+		dn(n.ClusterID, n.NodeID), index)
+	return true, size, nil
+}
+
+func (s *ShardedDB) janitorWorkerMain() {
+	ticker := time.NewTicker(s.config.JanitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			if _, err := s.RunJanitor(); err != nil && !errors.Is(err, ErrClosing) {
+				plog.Errorf("trim janitor failed: %v", err)
+			}
+		}
+	}
+}
+
+// getJanitorTrimIndex returns the index up to which, exclusively, entries of
+// the specified node are expected to be removed, 0 is returned when there is
+// nothing to remove.
+func (r *db) getJanitorTrimIndex(clusterID uint64,
+	nodeID uint64, retained uint64) (uint64, error) {
+	snapshots, err := r.listSnapshots(clusterID, nodeID, math.MaxUint64)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+	ssIndex := snapshots[len(snapshots)-1].Index
+	if ssIndex <= retained {
+		return 0, nil
+	}
+	index := ssIndex - retained
+	first, _, err := r.entryIndexRange(clusterID, nodeID)
+	if err != nil {
+		return 0, err
+	}
+	if first == 0 || first >= index {
+		return 0, nil
+	}
+	return index, nil
+}
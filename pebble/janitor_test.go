@@ -0,0 +1,49 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJanitorRemovesEntriesBelowSnapshot(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		sdb.config.JanitorRetainedEntries = 10
+		saveTestNode(t, sdb, 1, 2, 100)
+		saveTestNode(t, sdb, 3, 2, 100)
+		saveTestNode(t, sdb, 5, 2, 100)
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 1,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 60, Term: 1},
+		}}))
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 3,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 5, Term: 1},
+		}}))
+		trimmed, err := sdb.RunJanitor()
+		require.NoError(t, err)
+		require.Equal(t, 1, trimmed)
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Empty(t, ents)
+		ents, _, err = db.IterateEntries(nil, 0, 1, 2, 50, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, 51)
+		for _, cid := range []uint64{3, 5} {
+			ents, _, err = db.IterateEntries(nil, 0, cid, 2, 1, 101, math.MaxUint64)
+			require.NoError(t, err)
+			require.Len(t, ents, 100)
+		}
+		trimmed, err = sdb.RunJanitor()
+		require.NoError(t, err)
+		require.Equal(t, 0, trimmed)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -16,9 +16,16 @@ package pebble
 
 import (
 	"encoding/binary"
+	"hash/fnv"
 	"sync"
+
+	"github.com/pkg/errors"
 )
 
+// ErrCorruptedRecord indicates that a key or value read from the storage can
+// not be decoded.
+var ErrCorruptedRecord = errors.New("corrupted record")
+
 const (
 	maxKeySize             uint64 = 28
 	entryKeySize           uint64 = 28
@@ -27,6 +34,9 @@ const (
 	nodeInfoKeySize        uint64 = 20
 	bootstrapKeySize       uint64 = 20
 	snapshotKeySize        uint64 = 28
+	sinkOffsetKeySize      uint64 = 28
+	nodeMetadataKeySize    uint64 = 20
+	appliedIndexKeySize    uint64 = 20
 	dataSize                      = entryKeySize
 )
 
@@ -37,16 +47,20 @@ var (
 	nodeInfoKeyHeader        = [2]byte{0x4, 0x4}
 	snapshotKeyHeader        = [2]byte{0x5, 0x5}
 	bootstrapKeyHeader       = [2]byte{0x6, 0x6}
+	sinkOffsetKeyHeader      = [2]byte{0x7, 0x7}
+	nodeMetadataKeyHeader    = [2]byte{0x8, 0x8}
+	appliedIndexKeyHeader    = [2]byte{0x9, 0x9}
+	appRecordKeyHeader       = [2]byte{0xa, 0xa}
 )
 
-// Key represents keys that are managed by a sync.Pool to be reused.
+// Key represents keys that are managed by a keyPool to be reused.
 type Key struct {
-	pool *sync.Pool
+	pool *keyPool
 	data []byte
 	key  []byte
 }
 
-func newKey(sz uint64, pool *sync.Pool) *Key {
+func newKey(sz uint64, pool *keyPool) *Key {
 	return &Key{
 		data: make([]byte, sz),
 		pool: pool,
@@ -57,7 +71,7 @@ func newKey(sz uint64, pool *sync.Pool) *Key {
 func (k *Key) Release() {
 	k.key = nil
 	if k.pool != nil {
-		k.pool.Put(k)
+		k.pool.put(k)
 	}
 }
 
@@ -146,12 +160,44 @@ func (k *Key) useAsBootstrapKey() {
 }
 
 func parseNodeInfoKey(data []byte) (uint64, uint64) {
-	if len(data) != 20 {
+	cid, nid, err := decodeNodeInfoKey(data)
+	if err != nil {
 		panic("invalid node info data")
 	}
+	return cid, nid
+}
+
+func parseEntryKey(data []byte) (uint64, uint64, uint64) {
+	cid, nid, index, err := decodeEntryKey(data)
+	if err != nil {
+		panic("invalid entry key data")
+	}
+	return cid, nid, index
+}
+
+// decodeNodeInfoKey is similar to parseNodeInfoKey but returns an error
+// rather than panicking when the key has an invalid size. It is used on keys
+// read from the storage.
+func decodeNodeInfoKey(data []byte) (uint64, uint64, error) {
+	if uint64(len(data)) != nodeInfoKeySize {
+		return 0, 0, errors.Wrapf(ErrCorruptedRecord, "key size %d", len(data))
+	}
 	cid := binary.BigEndian.Uint64(data[4:])
 	nid := binary.BigEndian.Uint64(data[12:])
-	return cid, nid
+	return cid, nid, nil
+}
+
+// decodeEntryKey is similar to parseEntryKey but returns an error rather than
+// panicking when the key has an invalid size. It is used on keys read from
+// the storage.
+func decodeEntryKey(data []byte) (uint64, uint64, uint64, error) {
+	if uint64(len(data)) != entryKeySize {
+		return 0, 0, 0, errors.Wrapf(ErrCorruptedRecord, "key size %d", len(data))
+	}
+	cid := binary.BigEndian.Uint64(data[4:])
+	nid := binary.BigEndian.Uint64(data[12:])
+	index := binary.BigEndian.Uint64(data[20:])
+	return cid, nid, index, nil
 }
 
 func (k *Key) setNodeInfoKey(clusterID uint64, nodeID uint64) {
@@ -164,6 +210,26 @@ func (k *Key) setNodeInfoKey(clusterID uint64, nodeID uint64) {
 	binary.BigEndian.PutUint64(k.key[12:], nodeID)
 }
 
+func (k *Key) setNodeMetadataKey(clusterID uint64, nodeID uint64) {
+	k.key = k.data[:nodeMetadataKeySize]
+	k.key[0] = nodeMetadataKeyHeader[0]
+	k.key[1] = nodeMetadataKeyHeader[1]
+	k.key[2] = 0
+	k.key[3] = 0
+	binary.BigEndian.PutUint64(k.key[4:], clusterID)
+	binary.BigEndian.PutUint64(k.key[12:], nodeID)
+}
+
+func (k *Key) setAppliedIndexKey(clusterID uint64, nodeID uint64) {
+	k.key = k.data[:appliedIndexKeySize]
+	k.key[0] = appliedIndexKeyHeader[0]
+	k.key[1] = appliedIndexKeyHeader[1]
+	k.key[2] = 0
+	k.key[3] = 0
+	binary.BigEndian.PutUint64(k.key[4:], clusterID)
+	binary.BigEndian.PutUint64(k.key[12:], nodeID)
+}
+
 func (k *Key) setBootstrapKey(clusterID uint64, nodeID uint64) {
 	k.useAsBootstrapKey()
 	k.key[0] = bootstrapKeyHeader[0]
@@ -185,18 +251,62 @@ func (k *Key) setSnapshotKey(clusterID uint64, nodeID uint64, index uint64) {
 	binary.BigEndian.PutUint64(k.key[20:], index)
 }
 
+// setSinkOffsetKey sets the key to the offset record of the named change
+// feed sink, the name is stored as its hash.
+func (k *Key) setSinkOffsetKey(clusterID uint64, nodeID uint64, name string) {
+	k.useAsEntryKey()
+	k.key[0] = sinkOffsetKeyHeader[0]
+	k.key[1] = sinkOffsetKeyHeader[1]
+	k.key[2] = 0
+	k.key[3] = 0
+	binary.BigEndian.PutUint64(k.key[4:], clusterID)
+	binary.BigEndian.PutUint64(k.key[12:], nodeID)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	binary.BigEndian.PutUint64(k.key[20:], h.Sum64())
+}
+
+// keyPool keeps up to size pre-allocated keys in a free list, keys are taken
+// from a sync.Pool once the free list is exhausted.
 type keyPool struct {
-	pool *sync.Pool
+	pool     *sync.Pool
+	free     chan *Key
+	counters poolCounters
 }
 
-func newLogDBKeyPool() *keyPool {
-	p := &sync.Pool{}
-	p.New = func() interface{} {
-		return newKey(dataSize, p)
+func newLogDBKeyPool(size uint64) *keyPool {
+	kp := &keyPool{pool: &sync.Pool{}}
+	kp.pool.New = func() interface{} {
+		return newKey(dataSize, kp)
 	}
-	return &keyPool{pool: p}
+	if size > 0 {
+		kp.free = make(chan *Key, size)
+		for i := uint64(0); i < size; i++ {
+			kp.free <- newKey(dataSize, kp)
+		}
+	}
+	return kp
 }
 
 func (p *keyPool) get() *Key {
+	select {
+	case k := <-p.free:
+		p.counters.hit()
+		return k
+	default:
+	}
+	p.counters.miss()
 	return p.pool.Get().(*Key)
 }
+
+func (p *keyPool) put(k *Key) {
+	select {
+	case p.free <- k:
+	default:
+		p.pool.Put(k)
+	}
+}
+
+func (p *keyPool) stats() PoolStats {
+	return p.counters.stats(uint64(cap(p.free)))
+}
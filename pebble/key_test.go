@@ -24,7 +24,7 @@ import (
 )
 
 func TestEntryKeysOrdered(t *testing.T) {
-	p := newLogDBKeyPool()
+	p := newLogDBKeyPool(0)
 	for i := uint64(0); i < 65536+10; i++ {
 		k1 := p.get()
 		k1.SetEntryKey(100, 100, i)
@@ -43,7 +43,7 @@ func TestEntryKeysOrdered(t *testing.T) {
 }
 
 func TestSnapshotKeysOrdered(t *testing.T) {
-	p := newLogDBKeyPool()
+	p := newLogDBKeyPool(0)
 	k1 := p.get()
 	k1.setSnapshotKey(100, 100, 0)
 	k2 := p.get()
@@ -52,7 +52,7 @@ func TestSnapshotKeysOrdered(t *testing.T) {
 }
 
 func TestNodeInfoKeyCanBeParsed(t *testing.T) {
-	p := newLogDBKeyPool()
+	p := newLogDBKeyPool(0)
 	for i := 0; i < 1024; i++ {
 		k1 := p.get()
 		cid := rand.Uint64()
@@ -19,6 +19,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
+	"sync"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
@@ -33,6 +34,12 @@ const (
 type eventListener struct {
 	kv      *KV
 	stopper *syncutil.Stopper
+	// engine forwards compaction and flush events, it is nil when events are
+	// not reported.
+	engine *engineEvents
+	// replay contains the sstables written when replaying the WAL during
+	// open.
+	replay replayStats
 }
 
 func (l *eventListener) close() {
@@ -41,27 +48,55 @@ func (l *eventListener) close() {
 
 func (l *eventListener) notify() {
 	l.stopper.RunWorker(func() {
-		select {
-		case <-l.kv.dbSet:
-			if l.kv.callback != nil {
-				memSizeThreshold := l.kv.config.KVWriteBufferSize *
-					l.kv.config.KVMaxWriteBufferNumber * 19 / 20
-				l0FileNumThreshold := l.kv.config.KVLevel0StopWritesTrigger - 1
-				m := l.kv.db.Metrics()
-				busy := m.MemTable.Size >= memSizeThreshold ||
-					uint64(m.Levels[0].Sublevels) >= l0FileNumThreshold
-				l.kv.callback(busy)
-			}
-		default:
+		if l.engine != nil {
+			withShardLabels("engine-events", l.engine.shard, l.handleNotify)
+		} else {
+			withLabels("engine-events", l.handleNotify)
 		}
 	})
 }
 
-func (l *eventListener) onCompactionEnd(pebble.CompactionInfo) {
+func (l *eventListener) handleNotify() {
+	select {
+	case <-l.kv.dbSet:
+		l.kv.sampleWriteRate()
+		if l.kv.callback != nil {
+			memSizeThreshold := l.kv.config.KVWriteBufferSize *
+				l.kv.config.KVMaxWriteBufferNumber * 19 / 20
+			l0FileNumThreshold := l.kv.config.KVLevel0StopWritesTrigger - 1
+			m := l.kv.db.Metrics()
+			busy := m.MemTable.Size >= memSizeThreshold ||
+				uint64(m.Levels[0].Sublevels) >= l0FileNumThreshold ||
+				l.kv.freeSpaceLevel() != FreeSpaceOK
+			l.kv.callback(busy)
+		}
+	default:
+	}
+}
+
+func (l *eventListener) onCompactionBegin(info pebble.CompactionInfo) {
+	if l.engine != nil {
+		l.engine.onCompaction(info)
+	}
+}
+
+func (l *eventListener) onCompactionEnd(info pebble.CompactionInfo) {
+	if l.engine != nil {
+		l.engine.onCompaction(info)
+	}
 	l.notify()
 }
 
-func (l *eventListener) onFlushEnd(pebble.FlushInfo) {
+func (l *eventListener) onFlushBegin(info pebble.FlushInfo) {
+	if l.engine != nil {
+		l.engine.onFlush(info)
+	}
+}
+
+func (l *eventListener) onFlushEnd(info pebble.FlushInfo) {
+	if l.engine != nil {
+		l.engine.onFlush(info)
+	}
 	l.notify()
 }
 
@@ -69,38 +104,119 @@ func (l *eventListener) onWALCreated(pebble.WALCreateInfo) {
 	l.notify()
 }
 
+func (l *eventListener) onTableCreated(info pebble.TableCreateInfo) {
+	if l.engine != nil {
+		l.engine.onTableCreated(info)
+	}
+	select {
+	case <-l.kv.dbSet:
+	default:
+		// pebble flushes the replayed WAL before the DB is set
+		if info.Reason == "flushing" {
+			l.replay.paths = append(l.replay.paths, info.Path)
+			if l.engine != nil && l.engine.progress != nil {
+				l.engine.progress.tableWritten()
+			}
+		}
+	}
+}
+
 type pebbleWriteBatch struct {
 	wb *pebble.Batch
 	db *pebble.DB
 	wo *pebble.WriteOptions
+	// state is the batch of records routed to the state store
+	state *pebbleWriteBatch
+	// pool is the pool of the KV store the batch is returned to once it is
+	// destroyed.
+	pool *batchPool
 }
 
 func (w *pebbleWriteBatch) Destroy() {
+	if w.pool != nil && w.pool.put(w) {
+		return
+	}
+	w.close()
+}
+
+func (w *pebbleWriteBatch) close() {
 	if err := w.wb.Close(); err != nil {
 		panic(err)
 	}
+	if w.state != nil {
+		w.state.close()
+	}
+}
+
+// reset empties the write batch for reuse. It returns false when the batch
+// is too large to be reused.
+func (w *pebbleWriteBatch) reset() bool {
+	if w.pool != nil && len(w.wb.Repr()) > w.pool.maxSize {
+		return false
+	}
+	if w.state != nil && !w.state.reset() {
+		return false
+	}
+	w.wb.Reset()
+	return true
 }
 
 func (w *pebbleWriteBatch) Put(key []byte, val []byte) {
+	if w.state != nil && isStateStoreKey(key) {
+		w.state.Put(key, val)
+		return
+	}
 	if err := w.wb.Set(key, val, w.wo); err != nil {
 		panic(err)
 	}
 }
 
 func (w *pebbleWriteBatch) Delete(key []byte) {
+	if w.state != nil && isStateStoreKey(key) {
+		w.state.Delete(key)
+		return
+	}
 	if err := w.wb.Delete(key, w.wo); err != nil {
 		panic(err)
 	}
 }
 
+// DeleteRange deletes all keys in the range of [fk, lk). The range is not
+// expected to include keys of the state store.
+func (w *pebbleWriteBatch) DeleteRange(fk []byte, lk []byte) {
+	if err := w.wb.DeleteRange(fk, lk, w.wo); err != nil {
+		panic(err)
+	}
+}
+
+// merge appends all records of o to the write batch.
+func (w *pebbleWriteBatch) merge(o *pebbleWriteBatch) error {
+	if err := w.wb.Apply(o.wb, w.wo); err != nil {
+		return err
+	}
+	if w.state != nil {
+		return w.state.merge(o.state)
+	}
+	return nil
+}
+
 func (w *pebbleWriteBatch) Clear() {
+	if w.reset() {
+		return
+	}
 	if err := w.wb.Close(); err != nil {
 		panic(err)
 	}
 	w.wb = w.db.NewBatch()
+	if w.state != nil {
+		w.state.Clear()
+	}
 }
 
 func (w *pebbleWriteBatch) Count() int {
+	if w.state != nil {
+		return int(w.wb.Count()) + w.state.Count()
+	}
 	return int(w.wb.Count())
 }
 
@@ -130,10 +246,46 @@ type KV struct {
 	event    *eventListener
 	callback LogDBCallback
 	config   LogDBConfig
+	dir      string
+	mirror   *mirror
+	shipper  *shipper
+	// state is the dedicated store of raft states and max index records, it
+	// is nil when the state store is not enabled.
+	state *KV
+	// stateMu serializes write batches split across the store and the state
+	// store, stateCommits is the id of the last recovery marker, see
+	// commitSplitBatch.
+	stateMu      sync.Mutex
+	stateCommits uint64
+	mu           sync.Mutex
+	// relaxed is set when writes are committed without syncing the WAL, the
+	// WAL is then synced in the background, see RelaxedSyncInterval.
+	relaxed  bool
+	unsynced uint32
+	syncMu   sync.Mutex
+	syncErr  error
+	// gate rejects writes once the LogDB is being closed or once the lock of
+	// its directory is lost.
+	gate writeGate
+	// batches are the write batches kept for reuse.
+	batches *batchPool
+	// freeSpace is the FreeSpaceLevel of the shard.
+	freeSpace uint32
+	// rate samples the bytes written to the WAL for forecasting disk usage.
+	rate rateSampler
+	// amp tracks the bytes written for each cluster.
+	amp *writeAmp
 }
 
 func openPebbleDB(config LogDBConfig, callback LogDBCallback,
 	dir string, walDir string, fs vfs.FS) (*KV, error) {
+	return openPebbleDBWithEvents(config, callback, nil, dir, walDir, fs)
+}
+
+// openPebbleDBWithEvents is similar to openPebbleDB, compaction and flush
+// events are forwarded to engine when it is not nil.
+func openPebbleDBWithEvents(config LogDBConfig, callback LogDBCallback,
+	engine *engineEvents, dir string, walDir string, fs vfs.FS) (*KV, error) {
 	if config.IsEmpty() {
 		panic("invalid LogDBConfig")
 	}
@@ -151,19 +303,27 @@ func openPebbleDB(config LogDBConfig, callback LogDBCallback,
 	sz := targetFileSizeBase
 	for l := int64(0); l < numOfLevels; l++ {
 		opt := pebble.LevelOptions{
-			Compression:    pebble.NoCompression,
+			Compression:    config.EntryCompression.pebbleCompression(),
 			BlockSize:      blockSize,
 			TargetFileSize: sz,
 		}
 		sz = sz * levelSizeMultiplier
 		lopts = append(lopts, opt)
 	}
+	maxManifestFileSize := int64(maxLogFileSize)
+	if config.MaxManifestFileSize > 0 {
+		maxManifestFileSize = int64(config.MaxManifestFileSize)
+	}
 	cache := pebble.NewCache(cacheSize)
 	ro := &pebble.IterOptions{}
 	wo := &pebble.WriteOptions{Sync: true}
+	relaxed := config.RelaxedSyncInterval > 0 && !config.ReadOnly
+	if relaxed {
+		wo = pebble.NoSync
+	}
 	opts := &pebble.Options{
 		Levels:                      lopts,
-		MaxManifestFileSize:         maxLogFileSize,
+		MaxManifestFileSize:         maxManifestFileSize,
 		MemTableSize:                writeBufferSize,
 		MemTableStopWritesThreshold: maxWriteBufferNumber,
 		LBaseMaxBytes:               maxBytesForLevelBase,
@@ -171,35 +331,71 @@ func openPebbleDB(config LogDBConfig, callback LogDBCallback,
 		L0StopWritesThreshold:       l0StopWritesTrigger,
 		Cache:                       cache,
 		Logger:                      PebbleLogger,
+		ReadOnly:                    config.ReadOnly,
+		FormatMajorVersion:          config.FormatMajorVersion,
 	}
-	if fs != vfs.Default {
-		opts.FS = NewPebbleFS(fs)
+	opts.Experimental.DeleteRangeFlushDelay = config.DeleteRangeFlushDelay
+	opts.Experimental.MinDeletionRate = int(config.ObsoleteFileDeletionRate)
+	opts.Experimental.L0CompactionConcurrency = int(config.L0CompactionConcurrency)
+	opts.Experimental.CompactionDebtConcurrency = int(config.CompactionDebtConcurrency)
+	opts.MaxConcurrentCompactions = int(config.MaxConcurrentCompactions)
+	opts.FlushSplitBytes = int64(config.FlushSplitBytes)
+	opts.BytesPerSync = int(config.BytesPerSync)
+	opts.WALBytesPerSync = int(config.WALBytesPerSync)
+	if (config.WALDSync || config.TableDSync) && (fs != vfs.Default || !dsyncSupported) {
+		plog.Warningf("O_DSYNC is not supported by the configured FS, ignored")
+	}
+	if pfs := newPebbleFS(fs, config); fs != vfs.Default || pfs.customized() {
+		opts.FS = pfs
+	}
+	lfs := newLockFS(opts.FS, config)
+	opts.FS = lfs
+	if engine != nil && engine.progress != nil {
+		opts.FS = &progressFS{FS: opts.FS, progress: engine.progress}
 	}
 	kv := &KV{
 		ro:       ro,
 		wo:       wo,
+		relaxed:  relaxed,
 		opts:     opts,
 		config:   config,
+		dir:      dir,
 		callback: callback,
 		dbSet:    make(chan struct{}),
+		batches:  newBatchPool(config.WriteBatchPoolSize, writeBufferSize/2),
+		amp:      newWriteAmp(),
+	}
+	kv.gate.lock = lfs
+	opts.TablePropertyCollectors = []func() pebble.TablePropertyCollector{
+		func() pebble.TablePropertyCollector {
+			return newEntryPropertyCollector(kv.amp)
+		},
 	}
 	event := &eventListener{
 		kv:      kv,
 		stopper: syncutil.NewStopper(),
+		engine:  engine,
 	}
 	opts.EventListener = pebble.EventListener{
-		WALCreated:    event.onWALCreated,
-		FlushEnd:      event.onFlushEnd,
-		CompactionEnd: event.onCompactionEnd,
+		WALCreated:      event.onWALCreated,
+		TableCreated:    event.onTableCreated,
+		FlushBegin:      event.onFlushBegin,
+		FlushEnd:        event.onFlushEnd,
+		CompactionBegin: event.onCompactionBegin,
+		CompactionEnd:   event.onCompactionEnd,
 	}
 	if len(walDir) > 0 {
-		if err := fileutil.MkdirAll(walDir, fs); err != nil {
-			return nil, err
+		if !config.ReadOnly {
+			if err := fileutil.MkdirAll(walDir, fs); err != nil {
+				return nil, err
+			}
 		}
 		opts.WALDir = walDir
 	}
-	if err := fileutil.MkdirAll(dir, fs); err != nil {
-		return nil, err
+	if !config.ReadOnly {
+		if err := fileutil.MkdirAll(dir, fs); err != nil {
+			return nil, err
+		}
 	}
 	pdb, err := pebble.Open(dir, opts)
 	if err != nil {
@@ -208,6 +404,8 @@ func openPebbleDB(config LogDBConfig, callback LogDBCallback,
 	cache.Unref()
 	kv.db = pdb
 	kv.setEventListener(event)
+	kv.sampleWriteRate()
+	kv.replayedTables(fs)
 	return kv, nil
 }
 
@@ -229,9 +427,28 @@ func (r *KV) Name() string {
 
 // Close closes the RDB object.
 func (r *KV) Close() error {
+	if r.relaxed {
+		if err := r.syncWAL(); err != nil {
+			plog.Errorf("failed to sync the WAL on close: %v", err)
+		}
+	}
+	r.batches.close()
 	if err := r.db.Close(); err != nil {
 		return err
 	}
+	if r.state != nil {
+		if err := r.state.Close(); err != nil {
+			return err
+		}
+	}
+	if r.mirror != nil {
+		if err := r.mirror.close(); err != nil {
+			return err
+		}
+	}
+	if r.shipper != nil {
+		r.shipper.close()
+	}
 	r.event.close()
 	return nil
 }
@@ -247,7 +464,14 @@ func iteratorIsValid(iter *pebble.Iterator) bool {
 // IterateValue ...
 func (r *KV) IterateValue(fk []byte, lk []byte, inc bool,
 	op func(key []byte, data []byte) (bool, error)) (err error) {
-	iter := r.db.NewIter(r.ro)
+	if r.state != nil {
+		return iterateRouted(r.db, r.state.db, r.ro, fk, lk, inc, op)
+	}
+	return iterateValue(r.db.NewIter(r.ro), fk, lk, inc, op)
+}
+
+func iterateValue(iter *pebble.Iterator, fk []byte, lk []byte, inc bool,
+	op func(key []byte, data []byte) (bool, error)) (err error) {
 	defer func() {
 		err = firstError(err, iter.Close())
 	}()
@@ -276,7 +500,15 @@ func (r *KV) IterateValue(fk []byte, lk []byte, inc bool,
 
 // GetValue ...
 func (r *KV) GetValue(key []byte, op func([]byte) error) (err error) {
-	val, closer, err := r.db.Get(key)
+	if r.state != nil && isStateStoreKey(key) {
+		return getValue(r.state.db, key, op)
+	}
+	return getValue(r.db, key, op)
+}
+
+func getValue(reader pebble.Reader,
+	key []byte, op func([]byte) error) (err error) {
+	val, closer, err := reader.Get(key)
 	if err != nil && err != pebble.ErrNotFound {
 		return err
 	}
@@ -288,35 +520,224 @@ func (r *KV) GetValue(key []byte, op func([]byte) error) (err error) {
 	return op(val)
 }
 
+// MultiGet invokes op with the index and the value of each of the specified
+// keys, the value is empty when the key is not found. All keys stored in the
+// same store are read using a single iterator.
+func (r *KV) MultiGet(keys [][]byte, op func(int, []byte) error) error {
+	if r.state != nil {
+		return multiGet(r.db, r.state.db, r.ro, keys, op)
+	}
+	return multiGet(r.db, nil, r.ro, keys, op)
+}
+
+func multiGet(main pebble.Reader, state pebble.Reader, ro *pebble.IterOptions,
+	keys [][]byte, op func(int, []byte) error) error {
+	var mainKeys, stateKeys []int
+	for i, key := range keys {
+		if state != nil && isStateStoreKey(key) {
+			stateKeys = append(stateKeys, i)
+		} else {
+			mainKeys = append(mainKeys, i)
+		}
+	}
+	if err := seekValues(main, ro, keys, mainKeys, op); err != nil {
+		return err
+	}
+	return seekValues(state, ro, keys, stateKeys, op)
+}
+
+func seekValues(reader pebble.Reader, ro *pebble.IterOptions,
+	keys [][]byte, indexes []int, op func(int, []byte) error) (err error) {
+	if len(indexes) == 0 {
+		return nil
+	}
+	iter := reader.NewIter(ro)
+	defer func() {
+		err = firstError(err, iter.Close())
+	}()
+	for _, i := range indexes {
+		iter.SeekGE(keys[i])
+		var val []byte
+		if iteratorIsValid(iter) && bytes.Equal(iter.Key(), keys[i]) {
+			val = iter.Value()
+		}
+		if err := op(i, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvSnapshot is a consistent point in time view of the KV store.
+type kvSnapshot struct {
+	ss    *pebble.Snapshot
+	state *pebble.Snapshot
+	ro    *pebble.IterOptions
+}
+
+// newSnapshot returns a consistent point in time view of the KV store. The
+// returned snapshot must be closed once it is no longer required. When the
+// state store is enabled, the view of the state store is taken separately
+// right after the view of the KV store.
+func (r *KV) newSnapshot() *kvSnapshot {
+	ss := &kvSnapshot{ss: r.db.NewSnapshot(), ro: r.ro}
+	if r.state != nil {
+		ss.state = r.state.db.NewSnapshot()
+	}
+	return ss
+}
+
+// IterateValue ...
+func (s *kvSnapshot) IterateValue(fk []byte, lk []byte, inc bool,
+	op func(key []byte, data []byte) (bool, error)) error {
+	if s.state != nil {
+		return iterateRouted(s.ss, s.state, s.ro, fk, lk, inc, op)
+	}
+	return iterateValue(s.ss.NewIter(s.ro), fk, lk, inc, op)
+}
+
+// GetValue ...
+func (s *kvSnapshot) GetValue(key []byte, op func([]byte) error) error {
+	if s.state != nil && isStateStoreKey(key) {
+		return getValue(s.state, key, op)
+	}
+	return getValue(s.ss, key, op)
+}
+
+// MultiGet ...
+func (s *kvSnapshot) MultiGet(keys [][]byte, op func(int, []byte) error) error {
+	if s.state != nil {
+		return multiGet(s.ss, s.state, s.ro, keys, op)
+	}
+	return multiGet(s.ss, nil, s.ro, keys, op)
+}
+
+// Close releases the snapshot.
+func (s *kvSnapshot) Close() error {
+	err := s.ss.Close()
+	if s.state != nil {
+		err = firstError(err, s.state.Close())
+	}
+	return err
+}
+
 // SaveValue ...
-func (r *KV) SaveValue(key []byte, value []byte) error {
-	return r.db.Set(key, value, r.wo)
+func (r *KV) SaveValue(key []byte, value []byte) (err error) {
+	if err := r.gate.enter(); err != nil {
+		return err
+	}
+	defer r.gate.exit()
+	if r.state != nil && isStateStoreKey(key) {
+		return r.state.SaveValue(key, value)
+	}
+	if !r.observed() && !r.relaxed {
+		return r.db.Set(key, value, r.wo)
+	}
+	wb := r.db.NewBatch()
+	defer func() {
+		err = firstError(err, wb.Close())
+	}()
+	if err := wb.Set(key, value, r.wo); err != nil {
+		return err
+	}
+	return r.apply(wb)
+}
+
+// SaveValueNoSync is similar to SaveValue, but the WAL is not synced. The
+// value survives process crashes but can be lost on power failures until the
+// WAL is synced by a subsequent write.
+func (r *KV) SaveValueNoSync(key []byte, value []byte) (err error) {
+	if err := r.gate.enter(); err != nil {
+		return err
+	}
+	defer r.gate.exit()
+	if r.state != nil && isStateStoreKey(key) {
+		return r.state.SaveValueNoSync(key, value)
+	}
+	wb := r.db.NewBatch()
+	defer func() {
+		err = firstError(err, wb.Close())
+	}()
+	if err := wb.Set(key, value, pebble.NoSync); err != nil {
+		return err
+	}
+	return r.applyWithOptions(wb, pebble.NoSync)
 }
 
 // DeleteValue ...
-func (r *KV) DeleteValue(key []byte) error {
-	return r.db.Delete(key, r.wo)
+func (r *KV) DeleteValue(key []byte) (err error) {
+	if err := r.gate.enter(); err != nil {
+		return err
+	}
+	defer r.gate.exit()
+	if r.state != nil && isStateStoreKey(key) {
+		return r.state.DeleteValue(key)
+	}
+	if !r.observed() && !r.relaxed {
+		return r.db.Delete(key, r.wo)
+	}
+	wb := r.db.NewBatch()
+	defer func() {
+		err = firstError(err, wb.Close())
+	}()
+	if err := wb.Delete(key, r.wo); err != nil {
+		return err
+	}
+	return r.apply(wb)
 }
 
-// GetWriteBatch ...
+// GetWriteBatch returns a write batch taken from the pool of the KV store,
+// a new write batch is created when the pool is empty.
 func (r *KV) GetWriteBatch() *pebbleWriteBatch {
-	return &pebbleWriteBatch{
-		wb: r.db.NewBatch(),
-		db: r.db,
-		wo: r.wo,
+	if wb := r.batches.get(); wb != nil {
+		return wb
+	}
+	return r.newWriteBatch()
+}
+
+func (r *KV) newWriteBatch() *pebbleWriteBatch {
+	wb := &pebbleWriteBatch{
+		wb:   r.db.NewBatch(),
+		db:   r.db,
+		wo:   r.wo,
+		pool: r.batches,
+	}
+	if r.state != nil {
+		wb.state = r.state.newWriteBatch()
 	}
+	return wb
 }
 
-// CommitWriteBatch ...
+// CommitWriteBatch commits the write batch. When the state store is enabled,
+// records of the state store are committed after all other records together
+// with a recovery marker, see commitSplitBatch.
 func (r *KV) CommitWriteBatch(wb *pebbleWriteBatch) error {
+	if err := r.gate.enter(); err != nil {
+		return err
+	}
+	defer r.gate.exit()
+	return r.commitWriteBatch(wb)
+}
+
+func (r *KV) commitWriteBatch(wb *pebbleWriteBatch) error {
 	if wb.db != r.db {
 		panic("pwb.db != r.db")
 	}
-	return r.db.Apply(wb.wb, r.wo)
+	if wb.state == nil || wb.state.Count() == 0 {
+		return r.apply(wb.wb)
+	}
+	if wb.wb.Count() == 0 {
+		return r.state.CommitWriteBatch(wb.state)
+	}
+	return r.commitSplitBatch(wb)
 }
 
 // BulkRemoveEntries ...
 func (r *KV) BulkRemoveEntries(fk []byte, lk []byte) (err error) {
+	if err := r.gate.enter(); err != nil {
+		return err
+	}
+	defer r.gate.exit()
 	wb := r.db.NewBatch()
 	defer func() {
 		err = firstError(err, wb.Close())
@@ -324,7 +745,7 @@ func (r *KV) BulkRemoveEntries(fk []byte, lk []byte) (err error) {
 	if err := wb.DeleteRange(fk, lk, r.wo); err != nil {
 		return err
 	}
-	return r.db.Apply(wb, r.wo)
+	return r.apply(wb)
 }
 
 // CompactEntries ...
@@ -332,6 +753,41 @@ func (r *KV) CompactEntries(fk []byte, lk []byte) error {
 	return r.db.Compact(fk, lk)
 }
 
+// flush flushes the memtables of the store and the state store.
+func (r *KV) flush() error {
+	if r.state != nil {
+		if err := r.state.flush(); err != nil {
+			return err
+		}
+	}
+	return r.db.Flush()
+}
+
+// ratchetFormat upgrades the format major version of the store, the state
+// store and the mirror standby to v.
+func (r *KV) ratchetFormat(v pebble.FormatMajorVersion) error {
+	if r.state != nil {
+		if err := r.state.ratchetFormat(v); err != nil {
+			return err
+		}
+	}
+	if r.mirror != nil {
+		if err := r.mirror.standby.ratchetFormat(v); err != nil {
+			return err
+		}
+	}
+	if r.db.FormatMajorVersion() >= v {
+		return nil
+	}
+	return r.db.RatchetFormatMajorVersion(v)
+}
+
+// EstimateDiskUsage returns the estimated on disk size of the key range
+// [fk, lk].
+func (r *KV) EstimateDiskUsage(fk []byte, lk []byte) (uint64, error) {
+	return r.db.EstimateDiskUsage(fk, lk)
+}
+
 // FullCompaction ...
 func (r *KV) FullCompaction() error {
 	fk := make([]byte, MaxKeyLength)
@@ -340,5 +796,10 @@ func (r *KV) FullCompaction() error {
 		fk[i] = 0
 		lk[i] = 0xFF
 	}
+	if r.state != nil {
+		if err := r.state.FullCompaction(); err != nil {
+			return err
+		}
+	}
 	return r.db.Compact(fk, lk)
 }
@@ -23,9 +23,11 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/pebble"
 	pb "github.com/coufalja/tugboat/raftpb"
 	"github.com/lni/goutils/leaktest"
 	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKVCanBeCreatedAndClosed(t *testing.T) {
@@ -86,6 +88,26 @@ func TestKVGetAndSet(t *testing.T) {
 	runKVTest(t, tf, fs)
 }
 
+func TestKVMultiGet(t *testing.T) {
+	tf := func(t *testing.T, kvs *KV) {
+		require.NoError(t, kvs.SaveValue([]byte("key-1"), []byte("value-1")))
+		require.NoError(t, kvs.SaveValue([]byte("key-3"), []byte("value-3")))
+		keys := [][]byte{[]byte("key-3"), []byte("key-2"), []byte("key-1"), []byte("key-4")}
+		values := make([]string, len(keys))
+		require.NoError(t, kvs.MultiGet(keys, func(i int, data []byte) error {
+			values[i] = string(data)
+			return nil
+		}))
+		require.Equal(t, []string{"value-3", "", "value-1", ""}, values)
+		err := kvs.MultiGet(keys, func(i int, data []byte) error {
+			return io.ErrUnexpectedEOF
+		})
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+	fs := vfs.NewMem()
+	runKVTest(t, tf, fs)
+}
+
 func TestKVValueCanBeDeleted(t *testing.T) {
 	tf := func(t *testing.T, kvs *KV) {
 		if err := kvs.SaveValue([]byte("test-key"), []byte("test-value")); err != nil {
@@ -556,3 +578,98 @@ func TestWALCorruptionIsHandled(t *testing.T) {
 	fs := vfs.NewMem()
 	testDiskCorruptionIsHandled(t, true, false, fs)
 }
+
+func TestFormatMajorVersionCanBeRatcheted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.StateStore = true
+	dirs := []string{RDBTestDirectory}
+	cfg.FormatMajorVersion = pebble.FormatNewest + 1
+	_, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.Error(t, err)
+	cfg.FormatMajorVersion = pebble.FormatDefault
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	for _, s := range stats.Shards {
+		require.Equal(t, uint64(pebble.FormatMostCompatible), s.FormatMajorVersion)
+	}
+	require.NoError(t, db.RatchetFormat(pebble.FormatVersioned))
+	require.NoError(t, db.RatchetFormat(pebble.FormatMostCompatible))
+	for _, shard := range db.shards {
+		require.Equal(t, pebble.FormatVersioned, shard.kvs.db.FormatMajorVersion())
+		require.Equal(t, pebble.FormatVersioned, shard.kvs.state.db.FormatMajorVersion())
+	}
+	require.NoError(t, db.Close())
+	cfg.FormatMajorVersion = pebble.FormatNewest
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	for _, s := range stats.Shards {
+		require.Equal(t, uint64(pebble.FormatNewest), s.FormatMajorVersion)
+	}
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+}
+
+func TestManifestAndDeletionOptionsAreApplied(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	kv, err := openPebbleDB(cfg, nil, RDBTestDirectory, "", fs)
+	require.NoError(t, err)
+	require.Equal(t, int64(maxLogFileSize), kv.opts.MaxManifestFileSize)
+	require.Equal(t, 0, kv.opts.Experimental.MinDeletionRate)
+	require.NoError(t, kv.Close())
+	cfg.MaxManifestFileSize = 64 * 1024
+	cfg.ObsoleteFileDeletionRate = 32 * 1024 * 1024
+	kv, err = openPebbleDB(cfg, nil, RDBTestDirectory, "", fs)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, kv.Close())
+	}()
+	require.Equal(t, int64(64*1024), kv.opts.MaxManifestFileSize)
+	require.Equal(t, 32*1024*1024, kv.opts.Experimental.MinDeletionRate)
+	for i := 0; i < 64; i++ {
+		require.NoError(t, kv.SaveValue([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 128)))
+		require.NoError(t, kv.db.Flush())
+	}
+	require.NoError(t, kv.FullCompaction())
+}
+
+func TestCompactionConcurrencyOptionsAreApplied(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.MaxConcurrentCompactions = 4
+	cfg.L0CompactionConcurrency = 2
+	cfg.CompactionDebtConcurrency = 64 * 1024 * 1024
+	cfg.FlushSplitBytes = 1024 * 1024
+	kv, err := openPebbleDB(cfg, nil, RDBTestDirectory, "", fs)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, kv.Close())
+	}()
+	require.Equal(t, 4, kv.opts.MaxConcurrentCompactions)
+	require.Equal(t, 2, kv.opts.Experimental.L0CompactionConcurrency)
+	require.Equal(t, 64*1024*1024, kv.opts.Experimental.CompactionDebtConcurrency)
+	require.Equal(t, int64(1024*1024), kv.opts.FlushSplitBytes)
+	for i := 0; i < 1024; i++ {
+		require.NoError(t, kv.SaveValue([]byte(fmt.Sprintf("key-%d", i)), make([]byte, 1024)))
+	}
+	require.NoError(t, kv.FullCompaction())
+}
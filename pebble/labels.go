@@ -0,0 +1,32 @@
+package pebble
+
+import (
+	goctx "context"
+	"runtime/pprof"
+	"strconv"
+)
+
+const (
+	// SubsystemLabel is the key of the pprof label set on goroutines of the
+	// LogDB, its value is the name of the subsystem running on the goroutine,
+	// e.g. "janitor" or "committer".
+	SubsystemLabel = "logdb.subsystem"
+	// ShardLabel is the key of the pprof label identifying the shard the
+	// goroutine works on, it is not set for subsystems covering all shards.
+	ShardLabel = "logdb.shard"
+)
+
+// withLabels runs f with the pprof labels of the specified subsystem, so CPU
+// and goroutine profiles of the host application attribute the work to the
+// LogDB. The previous labels of the goroutine are restored once f returns.
+func withLabels(subsystem string, f func()) {
+	pprof.Do(goctx.Background(), pprof.Labels(SubsystemLabel, subsystem),
+		func(goctx.Context) { f() })
+}
+
+// withShardLabels is similar to withLabels, but it also labels the goroutine
+// with the specified shard.
+func withShardLabels(subsystem string, shard uint64, f func()) {
+	pprof.Do(goctx.Background(), pprof.Labels(SubsystemLabel, subsystem,
+		ShardLabel, strconv.FormatUint(shard, 10)), func(goctx.Context) { f() })
+}
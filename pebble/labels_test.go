@@ -0,0 +1,54 @@
+package pebble
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func goroutineProfile(t *testing.T) string {
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	return buf.String()
+}
+
+func TestWorkersHavePprofLabels(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	cfg.JanitorInterval = time.Hour
+	dirs := []string{RDBTestDirectory}
+	db, err := OpenShardedDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Eventually(t, func() bool {
+		profile := goroutineProfile(t)
+		return strings.Contains(profile, `"logdb.subsystem":"compaction-scheduler"`) &&
+			strings.Contains(profile, `"logdb.subsystem":"janitor"`)
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestWithShardLabels(t *testing.T) {
+	done := make(chan struct{})
+	labeled := make(chan struct{})
+	go withShardLabels("test-subsystem", 3, func() {
+		close(labeled)
+		<-done
+	})
+	<-labeled
+	profile := goroutineProfile(t)
+	close(done)
+	require.Contains(t, profile, `"logdb.shard":"3"`)
+	require.Contains(t, profile, `"logdb.subsystem":"test-subsystem"`)
+}
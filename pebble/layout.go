@@ -0,0 +1,233 @@
+package pebble
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// layoutFilename is the name of the file recording the version of the
+	// directory layout in each directory holding shard directories.
+	layoutFilename = "LAYOUT"
+	// CurrentLayoutVersion is the version of the directory layout used by
+	// this release. In version 1, each directory holds one logdb-<shard>
+	// directory per shard, the shard directory in the low latency directory,
+	// when specified, holds the WAL, the state store and the segments of the
+	// shard.
+	CurrentLayoutVersion uint64 = 1
+)
+
+var (
+	// ErrUnsupportedLayout indicates that the directory layout was created
+	// by a newer release which is not understood by this release.
+	ErrUnsupportedLayout = errors.New("unsupported directory layout")
+	// ErrLayoutMigrationRequired indicates that the directory layout must be
+	// migrated using MigrateLayout before the LogDB can be opened, see
+	// LogDBConfig.ManualLayoutMigration.
+	ErrLayoutMigrationRequired = errors.New("directory layout migration required")
+)
+
+// layoutMigration migrates the directories of a shard from the previous
+// layout version to the next one. Migrations are resumed from the beginning
+// when interrupted, so they must complete what an interrupted run started.
+type layoutMigration struct {
+	// compatible is set when the previous layout can be opened as it is, so
+	// read-only opens do not require the migration.
+	compatible bool
+	migrate    func(shard uint64, dir string, lldir string, fs vfs.FS) error
+}
+
+// layoutMigrations contains the migration to version v+1 at index v. Version
+// 0 is the layout of directories created before layouts were versioned, it
+// is identical to version 1.
+var layoutMigrations = []layoutMigration{
+	{compatible: true},
+}
+
+// LayoutVersion returns the version of the directory layout of the specified
+// directory holding shard directories, i.e. a directory the LogDB is opened
+// with or its namespace directory when namespaced. CurrentLayoutVersion is
+// returned for directories with no shards and 0 is returned for directories
+// created before layouts were versioned.
+func LayoutVersion(dir string, fs vfs.FS) (uint64, error) {
+	v, ok, err := readLayoutVersion(dir, fs)
+	if err != nil || ok {
+		return v, err
+	}
+	hasShards, err := hasShardDirs(dir, fs)
+	if err != nil || hasShards {
+		return 0, err
+	}
+	return CurrentLayoutVersion, nil
+}
+
+// readLayoutVersion returns the version recorded in the layout file of dir,
+// false is returned when there is no such file.
+func readLayoutVersion(dir string, fs vfs.FS) (uint64, bool, error) {
+	f, err := fs.Open(fs.PathJoin(dir, layoutFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, false, nil
+		}
+		return 0, false, errors.WithStack(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(ErrUnsupportedLayout, "%s: %v", dir, err)
+	}
+	return v, true, nil
+}
+
+func hasShardDirs(dir string, fs vfs.FS) (bool, error) {
+	exist, err := fileutil.DirExist(dir, fs)
+	if err != nil || !exist {
+		return false, errors.WithStack(err)
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, name := range names {
+		if isShardDirName(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MigrateLayout migrates the directory layout of the LogDB with the
+// specified config and directories, which are the ones the LogDB is opened
+// with, to CurrentLayoutVersion. The LogDB must not be open. Migrations are
+// performed by OpenShardedDB unless LogDBConfig.ManualLayoutMigration is set,
+// MigrateLayout allows tools to migrate the layout ahead of an upgrade.
+func MigrateLayout(config LogDBConfig, dirs []string, lldirs []string) error {
+	fs := config.FS
+	if len(config.Namespace) > 0 {
+		if err := validateNamespace(config.Namespace); err != nil {
+			return err
+		}
+		dirs = NamespaceDirs(dirs, config.Namespace, fs)
+		lldirs = NamespaceDirs(lldirs, config.Namespace, fs)
+	}
+	checkDirs(config.Shards, dirs, lldirs)
+	dirs, lldirs = expandDirs(config.Shards, dirs, lldirs)
+	return migrateLayout(config.Shards, dirs, lldirs, fs)
+}
+
+// migrateLayout migrates the directories of all shards one version at a
+// time, directories are only stamped with the current version once all
+// their shards are migrated, so an interrupted migration is resumed.
+func migrateLayout(shards uint64, dirs []string, lldirs []string, fs vfs.FS) error {
+	from, err := oldestLayoutVersion(dirs, lldirs, fs)
+	if err != nil {
+		return err
+	}
+	for v := from; v < CurrentLayoutVersion; v++ {
+		m := layoutMigrations[v]
+		if m.migrate == nil {
+			continue
+		}
+		for i := uint64(0); i < shards; i++ {
+			lldir := ""
+			if len(lldirs) > 0 {
+				lldir = lldirs[i]
+			}
+			if err := m.migrate(i, dirs[i], lldir, fs); err != nil {
+				return errors.Wrapf(err, "shard %d to layout %d", i, v+1)
+			}
+		}
+	}
+	for _, dir := range uniqueDirs(append(append([]string{}, dirs...), lldirs...)) {
+		v, ok, err := readLayoutVersion(dir, fs)
+		if err != nil {
+			return err
+		}
+		if ok && v == CurrentLayoutVersion {
+			continue
+		}
+		if err := writeLayoutVersion(dir, fs); err != nil {
+			return err
+		}
+	}
+	if from < CurrentLayoutVersion {
+		plog.Infof("directory layout migrated from version %d to %d",
+			from, CurrentLayoutVersion)
+	}
+	return nil
+}
+
+// oldestLayoutVersion returns the oldest layout version found in the
+// specified directories, ErrUnsupportedLayout is returned when any of them
+// uses a layout newer than CurrentLayoutVersion.
+func oldestLayoutVersion(dirs []string, lldirs []string, fs vfs.FS) (uint64, error) {
+	oldest := CurrentLayoutVersion
+	for _, dir := range uniqueDirs(append(append([]string{}, dirs...), lldirs...)) {
+		v, err := LayoutVersion(dir, fs)
+		if err != nil {
+			return 0, err
+		}
+		if v > CurrentLayoutVersion {
+			return 0, errors.Wrapf(ErrUnsupportedLayout,
+				"%s: version %d, max supported %d", dir, v, CurrentLayoutVersion)
+		}
+		if v < oldest {
+			oldest = v
+		}
+	}
+	return oldest, nil
+}
+
+// checkLayout migrates the layout of the directories of the LogDB when
+// opened for writing. Read-only opens only accept layouts compatible with
+// the current one.
+func checkLayout(config LogDBConfig, dirs []string, lldirs []string) error {
+	fs := config.FS
+	from, err := oldestLayoutVersion(dirs, lldirs, fs)
+	if err != nil {
+		return err
+	}
+	compatible := true
+	for v := from; v < CurrentLayoutVersion; v++ {
+		compatible = compatible && layoutMigrations[v].compatible
+	}
+	if config.ReadOnly || (config.ManualLayoutMigration && from < CurrentLayoutVersion) {
+		if !compatible {
+			return errors.Wrapf(ErrLayoutMigrationRequired,
+				"version %d found, %d required", from, CurrentLayoutVersion)
+		}
+		return nil
+	}
+	return migrateLayout(config.Shards, dirs, lldirs, fs)
+}
+
+func writeLayoutVersion(dir string, fs vfs.FS) error {
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
+	}
+	fp := fs.PathJoin(dir, layoutFilename)
+	tmp := fp + ".tmp"
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = f.Write([]byte(strconv.FormatUint(CurrentLayoutVersion, 10)))
+	err = firstError(err, f.Sync())
+	if err := firstError(err, f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fs.Rename(tmp, fp); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
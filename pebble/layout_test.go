@@ -0,0 +1,95 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutVersionIsRecorded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	v, err := LayoutVersion(dir, fs)
+	require.NoError(t, err)
+	require.Equal(t, CurrentLayoutVersion, v)
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	for _, d := range []string{dir, lldir} {
+		v, ok, err := readLayoutVersion(d, fs)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, CurrentLayoutVersion, v)
+	}
+}
+
+func TestUnversionedLayoutIsMigrated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	require.NoError(t, db.Close())
+	// directories created before layouts were versioned
+	require.NoError(t, fs.Remove(fs.PathJoin(dir, layoutFilename)))
+	v, err := LayoutVersion(dir, fs)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), v)
+
+	cfg.ReadOnly = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	cfg.ReadOnly = false
+	cfg.ManualLayoutMigration = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	v, err = LayoutVersion(dir, fs)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), v)
+
+	require.NoError(t, MigrateLayout(cfg, []string{dir}, nil))
+	v, err = LayoutVersion(dir, fs)
+	require.NoError(t, err)
+	require.Equal(t, CurrentLayoutVersion, v)
+	cfg.ManualLayoutMigration = false
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.NoError(t, db.Close())
+}
+
+func TestNewerLayoutIsRejected(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	require.NoError(t, fs.MkdirAll(dir, 0755))
+	f, err := fs.Create(fs.PathJoin(dir, layoutFilename))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("100"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrUnsupportedLayout)
+	cfg.ReadOnly = true
+	_, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrUnsupportedLayout)
+	require.ErrorIs(t, MigrateLayout(cfg, []string{dir}, nil), ErrUnsupportedLayout)
+}
@@ -0,0 +1,293 @@
+package pebble
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// lockOwnerSuffix is the suffix of the name of the file recording the
+	// owner of the lock file of a shard, it is kept next to the lock file.
+	lockOwnerSuffix = ".owner"
+	// staleHeartbeats is the number of missed heartbeats after which a lock
+	// is considered stale.
+	staleHeartbeats = 3
+	// fenceHeartbeats is the number of missed heartbeats after which the
+	// owner stops writing, before other hosts consider its lock stale.
+	fenceHeartbeats = staleHeartbeats - 1
+)
+
+var (
+	// ErrLocked indicates that a LogDB directory is locked by another process.
+	// Errors returned when opening a locked LogDB are of type *LockError.
+	ErrLocked = errors.New("LogDB directory locked")
+	// ErrLockLost indicates that the owner record of the lock of a LogDB
+	// directory could not be refreshed in time, so the lock might be taken
+	// over by another host. All further writes are rejected, the LogDB has to
+	// be closed and opened again.
+	ErrLockLost = errors.New("LogDB directory lock lost")
+)
+
+// LockOwner describes the process holding the lock of a LogDB directory.
+type LockOwner struct {
+	PID      int
+	Hostname string
+	// Heartbeat is the last time the owner refreshed the record, it is the
+	// time the lock was acquired when heartbeats are disabled.
+	Heartbeat time.Time
+}
+
+// LockError is the error returned when the lock of a LogDB directory could
+// not be acquired.
+type LockError struct {
+	// Path is the path of the lock file.
+	Path string
+	// Owner is the last recorded owner of the lock, it is only valid when
+	// HasOwner is true. Locks acquired by older versions or other tools have no
+	// recorded owner.
+	Owner    LockOwner
+	HasOwner bool
+	// Stale indicates that the owner on another host missed its heartbeats,
+	// see LogDBConfig.TakeOverStaleLocks.
+	Stale bool
+	Err   error
+}
+
+func (e *LockError) Error() string {
+	if !e.HasOwner {
+		return fmt.Sprintf("%s locked by unknown owner: %v", e.Path, e.Err)
+	}
+	stale := ""
+	if e.Stale {
+		stale = " (stale)"
+	}
+	return fmt.Sprintf("%s locked by pid %d on %s%s, last heartbeat %s: %v",
+		e.Path, e.Owner.PID, e.Owner.Hostname, stale,
+		e.Owner.Heartbeat.Format(time.RFC3339), e.Err)
+}
+
+// Is returns a boolean value indicating whether target is ErrLocked.
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+// stale returns a boolean value indicating whether the owner on another host
+// missed its heartbeats. A lock held according to the OS is never stale on
+// its own host, e.g. it might be held by a release or a tool not recording
+// its owner.
+func (o LockOwner) stale(hostname string, heartbeat time.Duration) bool {
+	return o.Hostname != hostname &&
+		heartbeat > 0 && time.Since(o.Heartbeat) > staleHeartbeats*heartbeat
+}
+
+// lockFS records the owner of the lock files acquired by pebble, so locks
+// left on shared storage by crashed hosts are reported as such and can be
+// taken over, the owner stops writing once it fails to refresh its record.
+type lockFS struct {
+	pvfs.FS
+	hostname  string
+	heartbeat time.Duration
+	takeOver  bool
+	force     bool
+	// held is the *ownedLock acquired by pebble.
+	held atomic.Value
+}
+
+func newLockFS(fs pvfs.FS, config LogDBConfig) *lockFS {
+	if fs == nil {
+		fs = pvfs.Default
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		plog.Warningf("failed to get hostname, %v", err)
+	}
+	heartbeat := config.LockHeartbeat
+	if config.ReadOnly {
+		// read-only LogDBs do not write, there is nothing to fence
+		heartbeat = 0
+	}
+	return &lockFS{
+		FS:        fs,
+		hostname:  hostname,
+		heartbeat: heartbeat,
+		takeOver:  config.TakeOverStaleLocks,
+		force:     config.ForceUnlock,
+	}
+}
+
+// Lock acquires the lock file, a lock held by another process is taken over
+// by removing the lock file when it is stale and TakeOverStaleLocks is set, or
+// when ForceUnlock is set and the lock is recorded as owned by another host.
+func (l *lockFS) Lock(name string) (io.Closer, error) {
+	c, err := l.FS.Lock(name)
+	if err != nil {
+		lerr := &LockError{Path: name, Err: err}
+		lerr.Owner, lerr.HasOwner = l.readOwner(name)
+		lerr.Stale = lerr.HasOwner && lerr.Owner.stale(l.hostname, l.heartbeat)
+		forced := l.force && lerr.HasOwner && lerr.Owner.Hostname != l.hostname
+		if !forced && !(l.takeOver && lerr.Stale) {
+			return nil, lerr
+		}
+		plog.Warningf("taking over lock, %v", lerr)
+		if err := l.FS.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, lerr
+		}
+		if c, err = l.FS.Lock(name); err != nil {
+			lerr.Err = err
+			return nil, lerr
+		}
+	}
+	owned := &ownedLock{
+		fs:        l,
+		name:      name + lockOwnerSuffix,
+		lock:      c,
+		heartbeat: l.heartbeat,
+		stopper:   make(chan struct{}),
+	}
+	owned.owner = LockOwner{PID: os.Getpid(), Hostname: l.hostname}
+	if err := owned.refresh(); err != nil {
+		// other hosts can not tell whether the lock is in use without the
+		// heartbeats of its owner
+		if l.heartbeat > 0 {
+			return nil, firstError(err, c.Close())
+		}
+		plog.Warningf("failed to record lock owner, %v", err)
+	}
+	if l.heartbeat > 0 {
+		owned.wg.Add(1)
+		go owned.run()
+	}
+	l.held.Store(owned)
+	return owned, nil
+}
+
+// check returns ErrLockLost once the acquired lock might have been taken
+// over by another host.
+func (l *lockFS) check() error {
+	if owned, ok := l.held.Load().(*ownedLock); ok && owned != nil {
+		return owned.check()
+	}
+	return nil
+}
+
+func (l *lockFS) readOwner(name string) (LockOwner, bool) {
+	f, err := l.FS.Open(name + lockOwnerSuffix)
+	if err != nil {
+		return LockOwner{}, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return LockOwner{}, false
+	}
+	var owner LockOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return LockOwner{}, false
+	}
+	return owner, true
+}
+
+// ownedLock is an acquired lock file together with the record of its owner,
+// which is refreshed at the heartbeat interval and removed once the lock is
+// released.
+type ownedLock struct {
+	fs        *lockFS
+	name      string
+	lock      io.Closer
+	owner     LockOwner
+	heartbeat time.Duration
+	// refreshed is the time of the last successful refresh in nanoseconds,
+	// lost is set once it is too old, the lock is never regained.
+	refreshed int64
+	lost      uint32
+	stopper   chan struct{}
+	wg        sync.WaitGroup
+}
+
+func (o *ownedLock) run() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stopper:
+			return
+		case <-ticker.C:
+			if o.check() != nil {
+				return
+			}
+			if err := o.refresh(); err != nil {
+				plog.Warningf("failed to refresh lock owner, %v", err)
+			}
+		}
+	}
+}
+
+// check returns ErrLockLost once the owner record has not been refreshed
+// for fenceHeartbeats intervals, leaving at least one interval before other
+// hosts consider the lock stale.
+func (o *ownedLock) check() error {
+	if o.heartbeat == 0 {
+		return nil
+	}
+	if atomic.LoadUint32(&o.lost) == 1 {
+		return errors.Wrapf(ErrLockLost, "%s", o.name)
+	}
+	refreshed := time.Unix(0, atomic.LoadInt64(&o.refreshed))
+	if time.Since(refreshed) < fenceHeartbeats*o.heartbeat {
+		return nil
+	}
+	if atomic.CompareAndSwapUint32(&o.lost, 0, 1) {
+		plog.Errorf("lock owner %s not refreshed since %s, rejecting writes",
+			o.name, refreshed.Format(time.RFC3339))
+	}
+	return errors.Wrapf(ErrLockLost, "%s", o.name)
+}
+
+// refresh atomically replaces the owner record.
+func (o *ownedLock) refresh() error {
+	now := time.Now()
+	o.owner.Heartbeat = now
+	data, err := json.Marshal(o.owner)
+	if err != nil {
+		panic(err)
+	}
+	tmp := o.name + ".tmp"
+	f, err := o.fs.FS.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = f.Write(data)
+	err = firstError(err, f.Sync())
+	err = firstError(err, f.Close())
+	if err == nil {
+		err = o.fs.FS.Rename(tmp, o.name)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	atomic.StoreInt64(&o.refreshed, now.UnixNano())
+	return nil
+}
+
+func (o *ownedLock) Close() error {
+	close(o.stopper)
+	o.wg.Wait()
+	o.fs.held.Store((*ownedLock)(nil))
+	if err := o.fs.FS.Remove(o.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		plog.Warningf("failed to remove lock owner, %v", err)
+	}
+	return o.lock.Close()
+}
@@ -0,0 +1,245 @@
+package pebble
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+var errTestLockHeld = errors.New("resource temporarily unavailable")
+
+// heldLockFS fails to lock files held by another process until they are
+// removed, as shared storage does for locks left by crashed hosts.
+type heldLockFS struct {
+	vfs.FS
+	mu   sync.Mutex
+	held map[string]bool
+	// failOwner fails the creation of owner records.
+	failOwner bool
+}
+
+func newHeldLockFS() *heldLockFS {
+	return &heldLockFS{FS: vfs.NewMem(), held: make(map[string]bool)}
+}
+
+func (fs *heldLockFS) hold(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.held[name] = true
+}
+
+func (fs *heldLockFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.held[name] {
+		return nil, errTestLockHeld
+	}
+	return fs.FS.Lock(name)
+}
+
+func (fs *heldLockFS) failOwnerRecords() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.failOwner = true
+}
+
+func (fs *heldLockFS) Create(name string) (vfs.File, error) {
+	fs.mu.Lock()
+	fail := fs.failOwner && strings.HasSuffix(name, lockOwnerSuffix+".tmp")
+	fs.mu.Unlock()
+	if fail {
+		return nil, errTestLockHeld
+	}
+	return fs.FS.Create(name)
+}
+
+func (fs *heldLockFS) Remove(name string) error {
+	fs.mu.Lock()
+	delete(fs.held, name)
+	fs.mu.Unlock()
+	return fs.FS.Remove(name)
+}
+
+func writeTestLockOwner(t *testing.T, fs vfs.FS, name string, owner LockOwner) {
+	data, err := json.Marshal(owner)
+	require.NoError(t, err)
+	f, err := fs.Create(name + lockOwnerSuffix)
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestLockRecordsItsOwner(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := newHeldLockFS()
+	lfs := newLockFS(NewPebbleFS(fs), LogDBConfig{LockHeartbeat: 10 * time.Millisecond})
+	c, err := lfs.Lock("LOCK")
+	require.NoError(t, err)
+	owner, ok := lfs.readOwner("LOCK")
+	require.True(t, ok)
+	require.Equal(t, os.Getpid(), owner.PID)
+	require.Equal(t, lfs.hostname, owner.Hostname)
+	require.Eventually(t, func() bool {
+		refreshed, ok := lfs.readOwner("LOCK")
+		return ok && refreshed.Heartbeat.After(owner.Heartbeat)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Close())
+	_, ok = lfs.readOwner("LOCK")
+	require.False(t, ok)
+}
+
+func TestLockReturnsLockError(t *testing.T) {
+	fs := newHeldLockFS()
+	fs.hold("LOCK")
+	lfs := newLockFS(NewPebbleFS(fs), LogDBConfig{})
+	_, err := lfs.Lock("LOCK")
+	require.ErrorIs(t, err, ErrLocked)
+	require.ErrorIs(t, err, errTestLockHeld)
+	var lerr *LockError
+	require.True(t, errors.As(err, &lerr))
+	require.False(t, lerr.HasOwner)
+	owner := LockOwner{PID: 1, Hostname: "other", Heartbeat: time.Now()}
+	writeTestLockOwner(t, fs, "LOCK", owner)
+	_, err = lfs.Lock("LOCK")
+	require.True(t, errors.As(err, &lerr))
+	require.True(t, lerr.HasOwner)
+	require.False(t, lerr.Stale)
+	require.Equal(t, owner.PID, lerr.Owner.PID)
+	require.Equal(t, owner.Hostname, lerr.Owner.Hostname)
+}
+
+func TestOnlyLocksOfOtherHostsAreTakenOver(t *testing.T) {
+	hour := time.Now().Add(-time.Hour)
+	tests := []struct {
+		owner    *LockOwner
+		takeOver bool
+		force    bool
+		stale    bool
+		acquired bool
+	}{
+		{nil, true, true, false, false},
+		// a dead process on this host does not hold the OS lock, a live
+		// process not recording its owner does
+		{&LockOwner{PID: math.MaxInt32, Heartbeat: hour}, true, true, false, false},
+		{&LockOwner{PID: os.Getpid()}, true, true, false, false},
+		{&LockOwner{PID: 1, Hostname: "other", Heartbeat: hour}, false, false, true, false},
+		{&LockOwner{PID: 1, Hostname: "other", Heartbeat: hour}, true, false, true, true},
+		{&LockOwner{PID: 1, Hostname: "other", Heartbeat: hour}, false, true, true, true},
+		{&LockOwner{PID: 1, Hostname: "other", Heartbeat: time.Now()}, true, false, false, false},
+		{&LockOwner{PID: 1, Hostname: "other", Heartbeat: time.Now()}, false, true, false, true},
+	}
+	for idx, tt := range tests {
+		fs := newHeldLockFS()
+		lfs := newLockFS(NewPebbleFS(fs), LogDBConfig{
+			LockHeartbeat:      time.Second,
+			TakeOverStaleLocks: tt.takeOver,
+			ForceUnlock:        tt.force,
+		})
+		fs.hold("LOCK")
+		if tt.owner != nil {
+			if len(tt.owner.Hostname) == 0 {
+				tt.owner.Hostname = lfs.hostname
+			}
+			writeTestLockOwner(t, fs, "LOCK", *tt.owner)
+		}
+		c, err := lfs.Lock("LOCK")
+		if !tt.acquired {
+			require.ErrorIs(t, err, ErrLocked, idx)
+			var lerr *LockError
+			require.True(t, errors.As(err, &lerr), idx)
+			require.Equal(t, tt.stale, lerr.Stale, idx)
+			continue
+		}
+		require.NoError(t, err, idx)
+		owner, ok := lfs.readOwner("LOCK")
+		require.True(t, ok, idx)
+		require.Equal(t, os.Getpid(), owner.PID, idx)
+		require.NoError(t, c.Close(), idx)
+	}
+}
+
+func TestLockIsLostWhenOwnerCanNotBeRefreshed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := newHeldLockFS()
+	lfs := newLockFS(NewPebbleFS(fs), LogDBConfig{LockHeartbeat: 10 * time.Millisecond})
+	c, err := lfs.Lock("LOCK")
+	require.NoError(t, err)
+	require.NoError(t, lfs.check())
+	fs.failOwnerRecords()
+	require.Eventually(t, func() bool {
+		return errors.Is(lfs.check(), ErrLockLost)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Close())
+
+	lfs = newLockFS(NewPebbleFS(fs), LogDBConfig{LockHeartbeat: 10 * time.Millisecond})
+	_, err = lfs.Lock("LOCK")
+	require.Error(t, err)
+}
+
+func TestWritesAreRejectedOnceLockIsLost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := newHeldLockFS()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	cfg.LockHeartbeat = 10 * time.Millisecond
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	fs.failOwnerRecords()
+	require.Eventually(t, func() bool {
+		err := db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true})
+		return errors.Is(err, ErrLockLost)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, db.Close())
+}
+
+func TestLockedLogDBCanBeTakenOver(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := newHeldLockFS()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lock := fs.PathJoin(dir, shardDirName(0), "LOCK")
+	require.NoError(t, fs.MkdirAll(fs.PathJoin(dir, shardDirName(0)), 0755))
+	fs.hold(lock)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	writeTestLockOwner(t, fs, lock, LockOwner{PID: math.MaxInt32, Hostname: hostname})
+	cfg.ForceUnlock = true
+	_, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrLocked)
+	writeTestLockOwner(t, fs, lock, LockOwner{PID: 1, Hostname: "other"})
+	cfg.ForceUnlock = false
+	_, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrLocked)
+	cfg.ForceUnlock = true
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	// stale locks are taken over without forcing
+	fs.hold(lock)
+	writeTestLockOwner(t, fs, lock, LockOwner{PID: 1, Hostname: "other",
+		Heartbeat: time.Now().Add(-time.Minute)})
+	cfg.ForceUnlock = false
+	cfg.LockHeartbeat = time.Second
+	cfg.TakeOverStaleLocks = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
@@ -20,6 +20,7 @@ package pebble
 import (
 	"github.com/coufalja/tugboat/logdb"
 	"github.com/coufalja/tugboat/logger"
+	"github.com/coufalja/tugboat/raftio"
 	pb "github.com/coufalja/tugboat/raftpb"
 	"github.com/pkg/errors"
 )
@@ -64,17 +65,75 @@ type IContext interface {
 	GetWriteBatch() interface{}
 	// SetWriteBatch adds the write batch to the IContext instance.
 	SetWriteBatch(wb interface{})
-	// GetEntryBatch returns an entry batch instance.
+	// GetEntryBatch returns an entry batch instance. Entry batches are only
+	// used by the batched binary format, the plain format, which is the only
+	// format supported by the LogDB, neither writes nor reads entry batches.
+	// Buffers for reading entries are provided by GetEntryArena.
 	GetEntryBatch() pb.EntryBatch
-	// GetLastEntryBatch returns an entry batch instance.
+	// GetLastEntryBatch returns an entry batch instance, see GetEntryBatch.
 	GetLastEntryBatch() pb.EntryBatch
+	// GetEntryArena returns the entry arena owned by the IContext instance,
+	// it is not released by Reset.
+	GetEntryArena() *EntryArena
 }
 
+// ILogDB is the interface of the ShardedDB methods used by Tugboat. Components
+// holding a LogDB reference can depend on ILogDB rather than on ShardedDB so
+// they can be unit tested using the testutil.MockLogDB mock or the in-memory
+// testutil.FakeLogDB without touching the disk.
+type ILogDB interface {
+	raftio.ILogDB
+}
+
+var _ ILogDB = (*ShardedDB)(nil)
+
+//go:generate moq -out testutil/mock_logdb.go -pkg testutil . ILogDB:MockLogDB
+
+// Factory returns a function creating a LogDB instance using the specified
+// config in nhPath, with the low latency data placed in walPath, it can be
+// passed to tugboat.NewNodeHost. The returned function panics when the LogDB
+// instance can not be created, see FactoryWithError and CaptureFactory.
 func Factory(config LogDBConfig) func(logdb.LogDBCallback, string, string) *ShardedDB {
+	f := FactoryWithError(config)
 	return func(callback logdb.LogDBCallback, nhPath string, walPath string) *ShardedDB {
-		logDB, err := NewLogDB(config, callback, []string{nhPath}, []string{walPath}, false)
+		logDB, err := f(callback, nhPath, walPath)
 		if err != nil {
-			panic(errors.WithStack(err))
+			panic(err)
+		}
+		return logDB
+	}
+}
+
+// MustFactory is equivalent to Factory.
+func MustFactory(config LogDBConfig) func(logdb.LogDBCallback, string, string) *ShardedDB {
+	return Factory(config)
+}
+
+// FactoryWithError is similar to Factory, but errors, e.g. caused by
+// inaccessible directories, are returned to the caller.
+func FactoryWithError(config LogDBConfig) func(logdb.LogDBCallback, string, string) (*ShardedDB, error) {
+	return func(callback logdb.LogDBCallback, nhPath string, walPath string) (*ShardedDB, error) {
+		logDB, err := NewLogDB(config, callback, []string{nhPath}, []string{walPath}, CheckNone)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return logDB, nil
+	}
+}
+
+// CaptureFactory is similar to Factory, but the error is stored in errp
+// before the returned function panics. tugboat.NewNodeHost closes the
+// NodeHost and panics with the error, hosts recovering from the panic can
+// tell the failure to open the LogDB, e.g. caused by inaccessible
+// directories, from other failures using errp, see the README for an example.
+func CaptureFactory(config LogDBConfig,
+	errp *error) func(logdb.LogDBCallback, string, string) *ShardedDB {
+	f := FactoryWithError(config)
+	return func(callback logdb.LogDBCallback, nhPath string, walPath string) *ShardedDB {
+		logDB, err := f(callback, nhPath, walPath)
+		if err != nil {
+			*errp = err
+			panic(err)
 		}
 		return logDB
 	}
@@ -82,19 +141,32 @@ func Factory(config LogDBConfig) func(logdb.LogDBCallback, string, string) *Shar
 
 // NewLogDB creates a Log DB instance based on provided configuration
 // parameters. The underlying KV store used by the Log DB instance is created
-// by the provided factory function.
-func NewLogDB(config LogDBConfig, callback logdb.LogDBCallback, dirs []string, lldirs []string, check bool) (*ShardedDB, error) {
+// by the provided factory function. The opened shards are checked at the
+// specified level, the outcome is reported by ShardedDB.CheckReport.
+func NewLogDB(config LogDBConfig, callback logdb.LogDBCallback, dirs []string, lldirs []string, check CheckLevel) (*ShardedDB, error) {
+	if len(config.Engine) > 0 && config.Engine != PebbleEngine {
+		return nil, errors.Errorf("storage engine %s can not be opened as a "+
+			"ShardedDB, use OpenLogDB", config.Engine)
+	}
 	checkDirs(config.Shards, dirs, lldirs)
+	dirs, lldirs = expandDirs(config.Shards, dirs, lldirs)
+	return OpenShardedDB(config, callback, dirs, lldirs, check)
+}
+
+// expandDirs returns the dirs and lldirs to be used by each shard when the
+// same directory is specified for all shards.
+func expandDirs(numOfShards uint64,
+	dirs []string, lldirs []string) ([]string, []string) {
 	llDirRequired := len(lldirs) == 1
 	if len(dirs) == 1 {
-		for i := uint64(1); i < config.Shards; i++ {
+		for i := uint64(1); i < numOfShards; i++ {
 			dirs = append(dirs, dirs[0])
 			if llDirRequired {
 				lldirs = append(lldirs, lldirs[0])
 			}
 		}
 	}
-	return OpenShardedDB(config, callback, dirs, lldirs, check)
+	return dirs, lldirs
 }
 
 func checkDirs(numOfShards uint64, dirs []string, lldirs []string) {
@@ -0,0 +1,276 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidMetadata indicates that the metadata export being imported is
+// corrupted or has unsupported format.
+var ErrInvalidMetadata = errors.New("invalid metadata export")
+
+var metadataFormat = streamFormat{
+	magic:   [8]byte{'T', 'G', 'B', 'M', 'E', 'T', 'A', 0},
+	version: 1,
+	invalid: ErrInvalidMetadata,
+}
+
+// metadataHeaders are the headers of all records included in a metadata
+// export.
+var metadataHeaders = [][2]byte{
+	bootstrapKeyHeader,
+	persistentStateKeyHeader,
+	maxIndexKeyHeader,
+	snapshotKeyHeader,
+	nodeMetadataKeyHeader,
+}
+
+func isMetadataKey(key []byte) bool {
+	if len(key) < 2 {
+		return false
+	}
+	for _, h := range metadataHeaders {
+		if key[0] == h[0] && key[1] == h[1] {
+			expected := persistentStateKeySize
+			if h == snapshotKeyHeader {
+				expected = snapshotKeySize
+			}
+			return uint64(len(key)) == expected
+		}
+	}
+	return false
+}
+
+// ExportMetadata writes the bootstrap, raft state, max index, snapshot and
+// node metadata records of all nodes to w, entries are not included. It
+// returns the number of exported records.
+func (s *ShardedDB) ExportMetadata(w io.Writer) (uint64, error) {
+	rw, err := newRecordWriter(w, metadataFormat)
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	op := func(key []byte, data []byte) (bool, error) {
+		if err := rw.write(key, data); err != nil {
+			return false, err
+		}
+		count++
+		return true, nil
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return 0, err
+	}
+	for _, shard := range shards {
+		if err := shard.iterateMetadata(op); err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return count, rw.finish()
+}
+
+func (r *db) iterateMetadata(op func(key []byte, data []byte) (bool, error)) error {
+	return r.iterateMetadataFrom(nil, op)
+}
+
+// iterateMetadataFrom iterates metadata records starting from the start key,
+// the header of the start key selects the first iterated header. The
+// iteration stops once op returns false.
+func (r *db) iterateMetadataFrom(start []byte,
+	op func(key []byte, data []byte) (bool, error)) error {
+	r.reads.acquire()
+	defer r.reads.release()
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	stopped := false
+	iop := func(key []byte, data []byte) (bool, error) {
+		cont, err := op(key, data)
+		stopped = !cont
+		return cont, err
+	}
+	for _, h := range metadataHeaders {
+		if len(start) >= 2 {
+			if h != [2]byte{start[0], start[1]} {
+				continue
+			}
+		}
+		fk.SetMinimumKey()
+		lk.SetMaximumKey()
+		fk.key[0], fk.key[1] = h[0], h[1]
+		lk.key[0], lk.key[1] = h[0], h[1]
+		first := fk.Key()
+		if len(start) >= 2 {
+			first = start
+			start = nil
+		}
+		if err := r.kvs.IterateValue(first, lk.Key(), true, iop); err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+type metadataRecord struct {
+	key  []byte
+	data []byte
+}
+
+func readMetadata(r io.Reader) ([]metadataRecord, error) {
+	rr, err := newRecordReader(r, metadataFormat)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]metadataRecord, 0)
+	for {
+		key, data, ok, err := rr.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return records, nil
+		}
+		if !isMetadataKey(key) {
+			return nil, errors.Wrapf(ErrInvalidMetadata, "unexpected key %x", key)
+		}
+		records = append(records, metadataRecord{key: key, data: data})
+	}
+}
+
+// ImportMetadata imports the records exported by ExportMetadata. It is
+// expected to be used on an empty LogDB, existing records of the imported
+// nodes are overwritten.
+//
+// Entries are not part of the export, for each node without local entries up
+// to its exported max index, the max index is lowered to the index of its
+// latest snapshot and the commit index is capped accordingly, so the node
+// restarts as if it just applied its latest snapshot and catches up with its
+// peers. Term and vote are always preserved.
+func (s *ShardedDB) ImportMetadata(r io.Reader) error {
+	records, err := readMetadata(r)
+	if err != nil {
+		return err
+	}
+	perShard := make(map[uint64][]metadataRecord)
+	for _, rec := range records {
+		clusterID, _ := parseNodeInfoKey(rec.key[:persistentStateKeySize])
+		p := s.partitioner.GetPartitionID(clusterID)
+		perShard[p] = append(perShard[p], rec)
+	}
+	for p, recs := range perShard {
+		shard, err := s.shard(p)
+		if err != nil {
+			return err
+		}
+		if err := shard.importMetadata(recs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+type importedNode struct {
+	state         *pb.State
+	maxIndex      uint64
+	hasMaxIndex   bool
+	snapshotIndex uint64
+}
+
+func (r *db) importMetadata(records []metadataRecord) error {
+	nodes := make(map[raftio.NodeInfo]*importedNode)
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	for _, rec := range records {
+		ni := raftio.GetNodeInfo(parseNodeInfoKey(rec.key[:persistentStateKeySize]))
+		n, ok := nodes[ni]
+		if !ok {
+			n = &importedNode{}
+			nodes[ni] = n
+			r.cs.dropSparseIndex(ni.ClusterID, ni.NodeID)
+		}
+		switch {
+		case bytes.HasPrefix(rec.key, persistentStateKeyHeader[:]):
+			st := pb.State{}
+			if err := st.Unmarshal(rec.data); err != nil {
+				return errors.Wrapf(ErrInvalidMetadata, "%v", err)
+			}
+			n.state = &st
+		case bytes.HasPrefix(rec.key, maxIndexKeyHeader[:]):
+			if len(rec.data) != 8 {
+				return errors.Wrap(ErrInvalidMetadata, "invalid max index")
+			}
+			n.maxIndex = binary.BigEndian.Uint64(rec.data)
+			n.hasMaxIndex = true
+		case bytes.HasPrefix(rec.key, snapshotKeyHeader[:]):
+			_, _, index := parseEntryKey(rec.key)
+			if index > n.snapshotIndex {
+				n.snapshotIndex = index
+			}
+			wb.Put(rec.key, rec.data)
+		default:
+			wb.Put(rec.key, rec.data)
+		}
+	}
+	for ni, n := range nodes {
+		if n.hasMaxIndex && n.maxIndex > n.snapshotIndex {
+			found, err := r.hasEntry(ni.ClusterID, ni.NodeID, n.maxIndex)
+			if err != nil {
+				return err
+			}
+			if !found {
+				n.maxIndex = n.snapshotIndex
+			}
+		}
+		if n.state != nil && n.state.Commit > n.maxIndex {
+			n.state.Commit = n.maxIndex
+		}
+		if n.state != nil {
+			r.saveStateAllocs(wb, ni.ClusterID, ni.NodeID, *n.state)
+		}
+		if n.hasMaxIndex && n.maxIndex > 0 {
+			r.saveMaxIndex(wb, ni.ClusterID, ni.NodeID, n.maxIndex, nil)
+		}
+	}
+	if wb.Count() > 0 {
+		if err := r.kvs.CommitWriteBatch(wb); err != nil {
+			return err
+		}
+	}
+	for ni, n := range nodes {
+		if n.state != nil {
+			r.cs.setState(ni.ClusterID, ni.NodeID, *n.state)
+		}
+		if n.hasMaxIndex && n.maxIndex > 0 {
+			r.cs.setMaxIndex(ni.ClusterID, ni.NodeID, n.maxIndex)
+		}
+		if n.snapshotIndex > 0 {
+			r.cs.setSnapshotIndex(ni.ClusterID, ni.NodeID, n.snapshotIndex)
+		}
+	}
+	return nil
+}
+
+func (r *db) hasEntry(clusterID uint64, nodeID uint64, index uint64) (bool, error) {
+	if se, ok := r.entries.(*segmentEntries); ok {
+		_, length, err := se.getRange(nil, clusterID, nodeID, index, index)
+		return length > 0, err
+	}
+	k := r.keys.get()
+	defer k.Release()
+	k.SetEntryKey(clusterID, nodeID, index)
+	found := false
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		found = len(data) > 0
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return found, nil
+}
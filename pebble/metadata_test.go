@@ -0,0 +1,78 @@
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataCanBeExportedAndImported(t *testing.T) {
+	var exported bytes.Buffer
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 3, 4, 20)
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 3,
+			NodeID:    4,
+			Snapshot:  pb.Snapshot{Index: 15, Term: 1},
+		}}))
+		count, err := sdb.ExportMetadata(&exported)
+		require.NoError(t, err)
+		// bootstrap, state and max index for both nodes plus one snapshot
+		require.Equal(t, uint64(7), count)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+	tf = func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		require.NoError(t, sdb.ImportMetadata(bytes.NewReader(exported.Bytes())))
+		bs, err := db.GetBootstrapInfo(3, 4)
+		require.NoError(t, err)
+		require.True(t, bs.Join)
+		ss, err := db.GetSnapshot(3, 4)
+		require.NoError(t, err)
+		require.Equal(t, uint64(15), ss.Index)
+		states, err := sdb.DumpStates()
+		require.NoError(t, err)
+		require.Len(t, states, 2)
+		require.Equal(t, uint64(1), states[0].State.Term)
+		require.Equal(t, uint64(2), states[0].State.Vote)
+		require.Zero(t, states[0].State.Commit)
+		require.Zero(t, states[0].MaxIndex)
+		require.Equal(t, uint64(2), states[1].State.Vote)
+		require.Equal(t, uint64(15), states[1].State.Commit)
+		require.Equal(t, uint64(15), states[1].MaxIndex)
+		rs, err := db.ReadRaftState(3, 4, ss.Index)
+		require.NoError(t, err)
+		require.Equal(t, uint64(15), rs.State.Commit)
+		require.Zero(t, rs.EntryCount)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestImportMetadataRejectsCorruptedInput(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		var buf bytes.Buffer
+		_, err := sdb.ExportMetadata(&buf)
+		require.NoError(t, err)
+		data := buf.Bytes()
+		corrupted := append([]byte{}, data...)
+		corrupted[len(corrupted)/2] ^= 0xFF
+		err = sdb.ImportMetadata(bytes.NewReader(corrupted))
+		require.True(t, errors.Is(err, ErrInvalidMetadata))
+		corrupted = append([]byte{}, data...)
+		corrupted[0] = 'X'
+		err = sdb.ImportMetadata(bytes.NewReader(corrupted))
+		require.True(t, errors.Is(err, ErrInvalidMetadata))
+		err = sdb.ImportMetadata(bytes.NewReader(data[:len(data)-1]))
+		require.True(t, errors.Is(err, ErrInvalidMetadata))
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,285 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/goutils/syncutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// standbyMarkerFilename is the name of the file marking a mirror directory as
+// a standby, a standby can only be opened read-only until promoted.
+const standbyMarkerFilename = "STANDBY"
+
+// ErrStandby indicates that the LogDB directory is a standby maintained by
+// mirroring, it has to be promoted using PromoteStandby before being opened
+// for writing.
+var ErrStandby = errors.New("standby LogDB must be promoted before use")
+
+// MirrorStats contains the statistics of mirroring a shard to its standby.
+type MirrorStats struct {
+	Shard uint64
+	// Pending is the number of committed write batches not yet applied to
+	// the standby.
+	Pending      int
+	PendingBytes uint64
+	Applied      uint64
+	AppliedBytes uint64
+	// Lag is the age of the oldest write batch not yet applied to the standby.
+	Lag time.Duration
+	// Error is the error which stopped the mirroring, e.g. a failure of the
+	// standby disk.
+	Error string `json:",omitempty"`
+}
+
+type mirrorBatch struct {
+	frame  []byte
+	queued time.Time
+}
+
+// mirror asynchronously applies committed write batches of a shard to its
+// standby. Writing to the shard is never blocked by the standby, pending
+// batches are queued in memory as replication stream frames, see
+// StreamFrame, so their checksums are verified before they are applied.
+type mirror struct {
+	shard        uint64
+	standby      *KV
+	stopper      *syncutil.Stopper
+	notifyC      chan struct{}
+	mu           sync.Mutex
+	queue        []mirrorBatch
+	pendingBytes uint64
+	applied      uint64
+	appliedBytes uint64
+	err          error
+}
+
+// startMirror creates a point in time copy of the shard in dir and starts
+// mirroring all later writes to it. The existing content of dir is replaced.
+func (r *KV) startMirror(shard uint64, dir string, fs vfs.FS) error {
+	if err := fs.RemoveAll(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.db.Checkpoint(dir, pebble.WithFlushedWAL()); err != nil {
+		return errors.WithStack(err)
+	}
+	cfg := r.config
+	cfg.MirrorDir = ""
+	standby, err := openPebbleDB(cfg, nil, dir, "", fs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	m := &mirror{
+		shard:   shard,
+		standby: standby,
+		stopper: syncutil.NewStopper(),
+		notifyC: make(chan struct{}, 1),
+	}
+	m.stopper.RunWorker(func() {
+		withShardLabels("mirror", shard, m.workerMain)
+	})
+	r.mirror = m
+	return nil
+}
+
+// observed returns a boolean value indicating whether committed batches are
+// mirrored or shipped.
+func (r *KV) observed() bool {
+	return r.mirror != nil || r.shipper != nil
+}
+
+// apply commits the batch and queues it for mirroring and shipping when
+// enabled.
+func (r *KV) apply(wb *pebble.Batch) error {
+	return r.applyWithOptions(wb, r.wo)
+}
+
+func (r *KV) applyWithOptions(wb *pebble.Batch, wo *pebble.WriteOptions) error {
+	if err := r.syncFailure(); err != nil {
+		return err
+	}
+	if !r.observed() {
+		if err := r.db.Apply(wb, wo); err != nil {
+			return err
+		}
+		r.markUnsynced()
+		return nil
+	}
+	// serialized so batches are mirrored and shipped in the commit order
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.db.Apply(wb, wo); err != nil {
+		return err
+	}
+	r.markUnsynced()
+	if r.mirror != nil {
+		r.mirror.enqueue(wb)
+	}
+	if r.shipper != nil {
+		r.shipper.enqueue(wb)
+	}
+	return nil
+}
+
+func (m *mirror) enqueue(wb *pebble.Batch) {
+	now := time.Now()
+	frame, err := encodeFrame(StreamFrame{
+		Shard:     m.shard,
+		Seq:       wb.SeqNum(),
+		Committed: now,
+		Data:      wb.Repr(),
+	})
+	m.mu.Lock()
+	if m.err == nil && err != nil {
+		m.fail(err)
+	} else if m.err == nil {
+		m.queue = append(m.queue, mirrorBatch{frame: frame, queued: now})
+		m.pendingBytes += uint64(len(frame))
+	}
+	m.mu.Unlock()
+	select {
+	case m.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+func (m *mirror) workerMain() {
+	for {
+		select {
+		case <-m.stopper.ShouldStop():
+			// pending batches are applied before the standby is closed
+			m.drain()
+			return
+		case <-m.notifyC:
+			m.drain()
+		}
+	}
+}
+
+func (m *mirror) drain() {
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 || m.err != nil {
+			m.mu.Unlock()
+			return
+		}
+		// removed from the queue only once applied so the lag covers the
+		// batch being applied
+		b := m.queue[0]
+		m.mu.Unlock()
+		err := m.applyToStandby(b.frame)
+		m.mu.Lock()
+		m.queue[0] = mirrorBatch{}
+		m.queue = m.queue[1:]
+		m.pendingBytes -= uint64(len(b.frame))
+		if err != nil {
+			m.fail(err)
+		} else {
+			m.applied++
+			m.appliedBytes += uint64(len(b.frame))
+		}
+		m.mu.Unlock()
+	}
+}
+
+// fail stops the mirroring, pending batches are dropped.
+func (m *mirror) fail(err error) {
+	plog.Errorf("mirroring stopped, failed to apply to standby: %v", err)
+	m.err = err
+	m.queue = nil
+	m.pendingBytes = 0
+}
+
+func (m *mirror) applyToStandby(frame []byte) (err error) {
+	f, err := decodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	wb := m.standby.db.NewBatch()
+	defer func() {
+		err = firstError(err, wb.Close())
+	}()
+	if err := wb.SetRepr(f.Data); err != nil {
+		return err
+	}
+	return m.standby.db.Apply(wb, m.standby.wo)
+}
+
+func (m *mirror) stats(shard uint64) MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := MirrorStats{
+		Shard:        shard,
+		Pending:      len(m.queue),
+		PendingBytes: m.pendingBytes,
+		Applied:      m.applied,
+		AppliedBytes: m.appliedBytes,
+	}
+	if len(m.queue) > 0 {
+		st.Lag = time.Since(m.queue[0].queued)
+	}
+	if m.err != nil {
+		st.Error = m.err.Error()
+	}
+	return st
+}
+
+func (m *mirror) close() error {
+	m.stopper.Stop()
+	return m.standby.Close()
+}
+
+// MirrorStats returns the mirroring statistics of all shards, nil is returned
+// when mirroring is not enabled.
+func (s *ShardedDB) MirrorStats() []MirrorStats {
+	var result []MirrorStats
+	for i, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		if m := shard.kvs.mirror; m != nil {
+			result = append(result, m.stats(uint64(i)))
+		}
+	}
+	return result
+}
+
+// createStandbyMarker marks the mirror dir as a standby.
+func createStandbyMarker(dir string, fs vfs.FS) error {
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
+	}
+	f, err := fs.Create(fs.PathJoin(dir, standbyMarkerFilename))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := firstError(f.Sync(), f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+func isStandby(dir string, fs vfs.FS) bool {
+	_, err := fs.Stat(fs.PathJoin(dir, standbyMarkerFilename))
+	return err == nil
+}
+
+// PromoteStandby turns the standby maintained by mirroring in the specified
+// dir into a regular LogDB directory, e.g. once the disk of the primary
+// failed. The promoted LogDB is opened by passing dir as the only LogDB
+// directory, it contains writes acknowledged by the primary up to the
+// mirroring lag at the time of the failure. The primary must not be mirroring
+// to dir anymore.
+func PromoteStandby(dir string, fs vfs.FS) error {
+	if !isStandby(dir, fs) {
+		return errors.Errorf("%s is not a standby", dir)
+	}
+	if err := fs.Remove(fs.PathJoin(dir, standbyMarkerFilename)); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
@@ -0,0 +1,92 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStandbyCanBePromoted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 2
+	db, err := NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	// saved before mirroring is enabled
+	saveTestNode(t, db, 1, 1, 10)
+	require.NoError(t, db.Close())
+
+	cfg.MirrorDir = "standby"
+	db, err = NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 2, 1, 20)
+	require.NoError(t, db.RemoveEntriesTo(2, 1, 5))
+	require.Eventually(t, func() bool {
+		for _, st := range db.MirrorStats() {
+			if st.Pending > 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+	ms := db.MirrorStats()
+	require.Len(t, ms, 2)
+	applied := uint64(0)
+	for _, st := range ms {
+		require.Empty(t, st.Error)
+		applied += st.Applied
+	}
+	require.True(t, applied >= 3)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	require.NotNil(t, stats.Shards[0].Mirror)
+	require.NoError(t, db.Close())
+
+	cfg.MirrorDir = ""
+	_, err = NewLogDB(cfg, nil, []string{"standby"}, nil, CheckNone)
+	require.True(t, errors.Is(err, ErrStandby))
+	require.Error(t, PromoteStandby("primary", fs))
+	require.NoError(t, PromoteStandby("standby", fs))
+	db, err = NewLogDB(cfg, nil, []string{"standby"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.Nil(t, db.MirrorStats())
+	rs, err := db.ReadRaftState(1, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	rs, err = db.ReadRaftState(2, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), rs.FirstIndex)
+	require.Equal(t, uint64(16), rs.EntryCount)
+	_, err = db.GetBootstrapInfo(2, 1)
+	require.NoError(t, err)
+}
+
+func TestStandbyCanBeOpenedReadOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	cfg.MirrorDir = "standby"
+	db, err := NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 1, 10)
+	require.NoError(t, db.Close())
+	cfg.MirrorDir = ""
+	cfg.ReadOnly = true
+	ro, err := NewLogDB(cfg, nil, []string{"standby"}, nil, CheckNone)
+	require.NoError(t, err)
+	rs, err := ro.ReadRaftState(1, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.NoError(t, ro.Close())
+}
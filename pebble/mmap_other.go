@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package pebble
+
+const mmapSupported = false
+
+func mmapFile(fd uintptr, size int) ([]byte, error) {
+	panic("mmap not supported")
+}
+
+func munmapFile(data []byte) error {
+	panic("mmap not supported")
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package pebble
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const mmapSupported = true
+
+// mmapFile maps the first size bytes of the file with the specified
+// descriptor read-only into memory.
+func mmapFile(fd uintptr, size int) ([]byte, error) {
+	data, err := syscall.Mmap(int(fd), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+func munmapFile(data []byte) error {
+	return errors.WithStack(syscall.Munmap(data))
+}
@@ -0,0 +1,131 @@
+package pebble
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidNamespace indicates that the namespace can not be used as a
+// directory name.
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+const (
+	namespaceDirPrefix = "ns-"
+	maxNamespaceLength = 64
+)
+
+func validateNamespace(namespace string) error {
+	if len(namespace) == 0 || len(namespace) > maxNamespaceLength ||
+		namespace == "." || namespace == ".." {
+		return errors.Wrapf(ErrInvalidNamespace, "%q", namespace)
+	}
+	for _, c := range namespace {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errors.Wrapf(ErrInvalidNamespace, "%q", namespace)
+		}
+	}
+	return nil
+}
+
+// NamespaceDirs returns the directories holding the shards of the specified
+// namespace within dirs, e.g. to inspect or back up the LogDB of a namespace
+// using functions accepting the directories of a LogDB. The specified dirs
+// are returned as they are when namespace is empty.
+func NamespaceDirs(dirs []string, namespace string, fs vfs.FS) []string {
+	if len(namespace) == 0 {
+		return dirs
+	}
+	result := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		result = append(result, fs.PathJoin(dir, namespaceDirPrefix+namespace))
+	}
+	return result
+}
+
+// ListNamespaces returns the sorted namespaces with shard directories in
+// dirs.
+func ListNamespaces(dirs []string, fs vfs.FS) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, dir := range uniqueDirs(dirs) {
+		exist, err := fileutil.DirExist(dir, fs)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !exist {
+			continue
+		}
+		names, err := fs.List(dir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, namespaceDirPrefix) {
+				continue
+			}
+			ns := name[len(namespaceDirPrefix):]
+			if validateNamespace(ns) != nil {
+				continue
+			}
+			shards, err := fs.List(fs.PathJoin(dir, name))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			for _, shard := range shards {
+				if isShardDirName(shard) {
+					seen[ns] = struct{}{}
+					break
+				}
+			}
+		}
+	}
+	result := make([]string, 0, len(seen))
+	for ns := range seen {
+		result = append(result, ns)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// DestroyNamespace removes all shard directories of the specified namespace
+// found in dirs and lldirs, which are the directories the LogDB of the
+// namespace was created with. Other namespaces and the LogDB opened without a
+// namespace are left untouched. The LogDB of the namespace must not be open.
+func DestroyNamespace(dirs []string,
+	lldirs []string, namespace string, fs vfs.FS) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	nsDirs := NamespaceDirs(dirs, namespace, fs)
+	nsLLDirs := NamespaceDirs(lldirs, namespace, fs)
+	if err := DestroyLogDB(nsDirs, nsLLDirs, fs); err != nil {
+		return err
+	}
+	parents := make([]string, 0)
+	for _, dir := range uniqueDirs(append(nsDirs, nsLLDirs...)) {
+		exist, err := fileutil.DirExist(dir, fs)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !exist {
+			continue
+		}
+		names, err := fs.List(dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// the namespace directory is kept when it holds other content
+		if len(names) > 0 {
+			continue
+		}
+		if err := fs.RemoveAll(dir); err != nil {
+			return errors.WithStack(err)
+		}
+		parents = append(parents, fs.PathDir(dir))
+	}
+	return syncDirs(parents, fs)
+}
@@ -0,0 +1,80 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	require.NoError(t, validateNamespace("deployment-1"))
+	require.NoError(t, validateNamespace("test_2.a"))
+	for _, ns := range []string{"", ".", "..", "a/b", "a b", string(make([]byte, 65))} {
+		require.True(t, errors.Is(validateNamespace(ns), ErrInvalidNamespace), ns)
+	}
+}
+
+func TestNamespacesShareDirectories(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	dirs := []string{RDBTestDirectory}
+	open := func(namespace string) *ShardedDB {
+		cfg := getDefaultLogDBConfig()
+		cfg.FS = fs
+		cfg.Shards = 2
+		cfg.Namespace = namespace
+		db, err := NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+		require.NoError(t, err)
+		return db
+	}
+	db1 := open("1")
+	db2 := open("2")
+	db3 := open("")
+	saveTestNode(t, db1, 1, 2, 10)
+	saveTestNode(t, db2, 1, 2, 20)
+	saveTestNode(t, db2, 3, 4, 20)
+	saveTestNode(t, db3, 5, 6, 20)
+	ni, err := db1.ListNodeInfo()
+	require.NoError(t, err)
+	require.Equal(t, []raftio.NodeInfo{{ClusterID: 1, NodeID: 2}}, ni)
+	ni, err = db2.ListNodeInfo()
+	require.NoError(t, err)
+	require.Len(t, ni, 2)
+	rs, err := db1.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.NoError(t, db1.RemoveNodeData(1, 2))
+	rs, err = db2.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), rs.EntryCount)
+	namespaces, err := ListNamespaces(dirs, fs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, namespaces)
+	require.NoError(t, db1.Close())
+	require.NoError(t, db2.Close())
+	require.NoError(t, db3.Close())
+
+	require.NoError(t, DestroyNamespace(dirs, dirs, "1", fs))
+	namespaces, err = ListNamespaces(dirs, fs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, namespaces)
+	_, err = fs.Stat(fs.PathJoin(RDBTestDirectory, "ns-1"))
+	require.Error(t, err)
+	// the LogDB without a namespace leaves namespaces untouched
+	require.NoError(t, DestroyLogDB(dirs, dirs, fs))
+	db2 = open("2")
+	ni, err = db2.ListNodeInfo()
+	require.NoError(t, err)
+	require.Len(t, ni, 2)
+	require.NoError(t, db2.Close())
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Namespace = "a/b"
+	_, err = NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.True(t, errors.Is(err, ErrInvalidNamespace))
+}
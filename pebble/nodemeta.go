@@ -0,0 +1,119 @@
+package pebble
+
+import (
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// MaxNodeMetadataSize is the max size of the user metadata of a node.
+const MaxNodeMetadataSize uint64 = 64 * 1024
+
+// ErrNodeMetadataTooLarge indicates that the user metadata of a node is
+// larger than MaxNodeMetadataSize.
+var ErrNodeMetadataTooLarge = errors.New("node metadata too large")
+
+// NodeMetadata is an opaque user blob stored for a node, e.g. shard labels or
+// epoch markers. An empty Data removes the stored metadata.
+type NodeMetadata struct {
+	ClusterID uint64
+	NodeID    uint64
+	Data      []byte
+}
+
+func (md NodeMetadata) validate() error {
+	if uint64(len(md.Data)) > MaxNodeMetadataSize {
+		return errors.Wrapf(ErrNodeMetadataTooLarge,
+			"cluster %d node %d, size %d", md.ClusterID, md.NodeID, len(md.Data))
+	}
+	return nil
+}
+
+// SaveNodeMetadata saves the user metadata of the specified node. The
+// metadata is removed together with the node data.
+func (s *ShardedDB) SaveNodeMetadata(clusterID uint64,
+	nodeID uint64, data []byte) error {
+	md := NodeMetadata{ClusterID: clusterID, NodeID: nodeID, Data: data}
+	if err := md.validate(); err != nil {
+		return err
+	}
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.saveNodeMetadataRecord(md))
+}
+
+// GetNodeMetadata returns the user metadata of the specified node, nil is
+// returned when no metadata has been saved.
+func (s *ShardedDB) GetNodeMetadata(clusterID uint64,
+	nodeID uint64) ([]byte, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	data, err := shard.getNodeMetadata(clusterID, nodeID)
+	return data, errors.WithStack(err)
+}
+
+// SaveRaftStateWithMetadata is similar to SaveRaftStateCtx, but the
+// specified node metadata is saved in the same atomic write batch as the raft
+// state. All updates and metadata must belong to nodes placed in the same
+// shard.
+func (s *ShardedDB) SaveRaftStateWithMetadata(updates []pb.Update,
+	metadata []NodeMetadata, ctx IContext) error {
+	if len(metadata) == 0 {
+		return s.SaveRaftStateCtx(updates, ctx)
+	}
+	p := s.partitioner.GetPartitionID(metadata[0].ClusterID)
+	for _, md := range metadata {
+		if err := md.validate(); err != nil {
+			return err
+		}
+		if s.partitioner.GetPartitionID(md.ClusterID) != p {
+			return errors.Errorf("metadata of cluster %d not in shard %d",
+				md.ClusterID, p)
+		}
+	}
+	if len(updates) > 0 && s.getParititionID(updates) != p {
+		return errors.Errorf("updates and metadata not in the same shard")
+	}
+	shard, err := s.shard(p)
+	if err != nil {
+		return err
+	}
+	saved, err := shard.saveRaftStateWithMetadata(updates, metadata, nil, ctx)
+	s.watches.committed(saved)
+	return errors.WithStack(err)
+}
+
+func (r *db) saveNodeMetadataRecord(md NodeMetadata) error {
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	r.saveNodeMetadata(wb, md)
+	return r.kvs.CommitWriteBatch(wb)
+}
+
+func (r *db) saveNodeMetadata(wb *pebbleWriteBatch, md NodeMetadata) {
+	k := newKey(maxKeySize, nil)
+	k.setNodeMetadataKey(md.ClusterID, md.NodeID)
+	if len(md.Data) == 0 {
+		wb.Delete(k.Key())
+	} else {
+		wb.Put(k.Key(), md.Data)
+	}
+}
+
+func (r *db) getNodeMetadata(clusterID uint64, nodeID uint64) ([]byte, error) {
+	k := newKey(maxKeySize, nil)
+	k.setNodeMetadataKey(clusterID, nodeID)
+	var result []byte
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		if len(data) > 0 {
+			result = append([]byte(nil), data...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package pebble
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeMetadataCanBeSavedAndRemoved(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		data, err := sdb.GetNodeMetadata(1, 2)
+		require.NoError(t, err)
+		require.Nil(t, data)
+		require.NoError(t, sdb.SaveNodeMetadata(1, 2, []byte("labels")))
+		data, err = sdb.GetNodeMetadata(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, []byte("labels"), data)
+		require.NoError(t, sdb.SaveNodeMetadata(1, 2, nil))
+		data, err = sdb.GetNodeMetadata(1, 2)
+		require.NoError(t, err)
+		require.Nil(t, data)
+		large := make([]byte, MaxNodeMetadataSize+1)
+		require.ErrorIs(t, sdb.SaveNodeMetadata(1, 2, large), ErrNodeMetadataTooLarge)
+		require.NoError(t, sdb.SaveNodeMetadata(1, 2, []byte("epoch")))
+		require.NoError(t, db.RemoveNodeData(1, 2))
+		data, err = sdb.GetNodeMetadata(1, 2)
+		require.NoError(t, err)
+		require.Nil(t, data)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestNodeMetadataCanBeSavedWithRaftState(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		ud := pb.Update{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 2, Vote: 2, Commit: 1},
+			EntriesToSave: []pb.Entry{{Index: 1, Term: 2}},
+		}
+		md := []NodeMetadata{{ClusterID: 1, NodeID: 2, Data: []byte("epoch-2")}}
+		require.NoError(t, sdb.SaveRaftStateWithMetadata([]pb.Update{ud},
+			md, sdb.GetLogDBThreadContext()))
+		rs, err := db.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), rs.State.Term)
+		require.Equal(t, uint64(1), rs.EntryCount)
+		data, err := sdb.GetNodeMetadata(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, []byte("epoch-2"), data)
+		large := []NodeMetadata{{ClusterID: 1, NodeID: 2,
+			Data: bytes.Repeat([]byte("x"), int(MaxNodeMetadataSize)+1)}}
+		require.ErrorIs(t, sdb.SaveRaftStateWithMetadata(nil, large,
+			sdb.GetLogDBThreadContext()), ErrNodeMetadataTooLarge)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
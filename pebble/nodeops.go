@@ -0,0 +1,126 @@
+package pebble
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+)
+
+// NodeOperations contains the counters of the operations of a single node
+// since the LogDB was opened.
+type NodeOperations struct {
+	// Saves is the number of saved updates of the node, EntriesAppended and
+	// BytesAppended are the number and the total size of the entries saved
+	// by those updates.
+	Saves           uint64
+	EntriesAppended uint64
+	BytesAppended   uint64
+	// Reads is the number of entry iterations and raft state reads.
+	Reads uint64
+	// Trims is the number of removals of entries up to an index.
+	Trims uint64
+}
+
+type nodeCounters struct {
+	saves   uint64
+	entries uint64
+	bytes   uint64
+	reads   uint64
+	trims   uint64
+}
+
+// nodeOps keeps the operation counters of the nodes of a shard, counters are
+// updated atomically once created.
+type nodeOps struct {
+	mu    sync.RWMutex
+	nodes map[raftio.NodeInfo]*nodeCounters
+}
+
+func newNodeOps() *nodeOps {
+	return &nodeOps{nodes: make(map[raftio.NodeInfo]*nodeCounters)}
+}
+
+func (o *nodeOps) get(clusterID uint64, nodeID uint64) *nodeCounters {
+	key := raftio.GetNodeInfo(clusterID, nodeID)
+	o.mu.RLock()
+	c, ok := o.nodes[key]
+	o.mu.RUnlock()
+	if ok {
+		return c
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if c, ok = o.nodes[key]; !ok {
+		c = &nodeCounters{}
+		o.nodes[key] = c
+	}
+	return c
+}
+
+func (o *nodeOps) read(clusterID uint64, nodeID uint64) {
+	atomic.AddUint64(&o.get(clusterID, nodeID).reads, 1)
+}
+
+func (o *nodeOps) trim(clusterID uint64, nodeID uint64) {
+	atomic.AddUint64(&o.get(clusterID, nodeID).trims, 1)
+}
+
+func (o *nodeOps) operations(clusterID uint64, nodeID uint64) NodeOperations {
+	o.mu.RLock()
+	c, ok := o.nodes[raftio.GetNodeInfo(clusterID, nodeID)]
+	o.mu.RUnlock()
+	if !ok {
+		return NodeOperations{}
+	}
+	return c.operations()
+}
+
+func (c *nodeCounters) operations() NodeOperations {
+	return NodeOperations{
+		Saves:           atomic.LoadUint64(&c.saves),
+		EntriesAppended: atomic.LoadUint64(&c.entries),
+		BytesAppended:   atomic.LoadUint64(&c.bytes),
+		Reads:           atomic.LoadUint64(&c.reads),
+		Trims:           atomic.LoadUint64(&c.trims),
+	}
+}
+
+// recordSaves updates the operation counters, the logical bytes written and
+// the entry sizes of the nodes of the saved updates.
+func (r *db) recordSaves(updates []pb.Update) {
+	for _, ud := range updates {
+		bytes := 0
+		for i := range ud.EntriesToSave {
+			bytes += ud.EntriesToSave[i].Size()
+		}
+		c := r.ops.get(ud.ClusterID, ud.NodeID)
+		atomic.AddUint64(&c.saves, 1)
+		atomic.AddUint64(&c.entries, uint64(len(ud.EntriesToSave)))
+		atomic.AddUint64(&c.bytes, uint64(bytes))
+		if !pb.IsEmptyState(ud.State) {
+			bytes += ud.State.Size()
+		}
+		r.kvs.amp.addLogical(ud.ClusterID, uint64(bytes))
+		r.sizes.append(ud.ClusterID, ud.NodeID, ud.EntriesToSave)
+	}
+}
+
+// NodeOperations returns the operation counters of all nodes with operations
+// since the LogDB was opened. Unlike Stats, it requires no scan of the stored
+// records. Only shards already opened are included.
+func (s *ShardedDB) NodeOperations() map[raftio.NodeInfo]NodeOperations {
+	result := make(map[raftio.NodeInfo]NodeOperations)
+	for _, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		shard.ops.mu.RLock()
+		for k, c := range shard.ops.nodes {
+			result[k] = c.operations()
+		}
+		shard.ops.mu.RUnlock()
+	}
+	return result
+}
@@ -0,0 +1,44 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeOperationsAreCounted(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		require.Empty(t, sdb.NodeOperations())
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 1, 2, 20)
+		saveTestNode(t, sdb, 3, 4, 5)
+		_, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 11, math.MaxUint64)
+		require.NoError(t, err)
+		_, err = db.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 5))
+		ops := sdb.NodeOperations()
+		require.Len(t, ops, 2)
+		n := ops[raftio.GetNodeInfo(1, 2)]
+		require.Equal(t, uint64(2), n.Saves)
+		require.Equal(t, uint64(30), n.EntriesAppended)
+		require.NotZero(t, n.BytesAppended)
+		require.Equal(t, uint64(2), n.Reads)
+		require.Equal(t, uint64(1), n.Trims)
+		other := ops[raftio.GetNodeInfo(3, 4)]
+		require.Equal(t, uint64(1), other.Saves)
+		require.Equal(t, uint64(5), other.EntriesAppended)
+		require.Less(t, other.BytesAppended, n.BytesAppended)
+		require.Zero(t, other.Reads)
+		require.Zero(t, other.Trims)
+		stats, err := sdb.Stats()
+		require.NoError(t, err)
+		require.Len(t, stats.Nodes, 2)
+		require.Equal(t, n, stats.Nodes[0].Operations)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,228 @@
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrShippedLogGap indicates that shipped write batches required for a
+// point in time restore are missing or can not be applied in order.
+var ErrShippedLogGap = errors.New("gap in shipped log")
+
+// RestoreTarget is the point in time a LogDB is restored to, the zero value
+// restores all shipped write batches.
+type RestoreTarget struct {
+	// Until excludes write batches committed after the specified time.
+	Until time.Time
+	// Sequences excludes write batches of each shard with sequence numbers
+	// equal to or greater than the specified ones, all batches of a shard are
+	// included when it is set to 0.
+	Sequences []uint64
+}
+
+func (t RestoreTarget) includes(shard uint64, b ShippedBatch) bool {
+	if !t.Until.IsZero() && b.Committed.After(t.Until) {
+		return false
+	}
+	if len(t.Sequences) > 0 && t.Sequences[shard] > 0 && b.Seq >= t.Sequences[shard] {
+		return false
+	}
+	return true
+}
+
+// ShardRestore describes the shipped write batches applied to a shard.
+type ShardRestore struct {
+	Shard uint64
+	// From is the sequence number of the first write batch not included in
+	// the backup.
+	From uint64
+	// Next is the sequence number following the last applied write batch.
+	Next     uint64
+	Segments uint64
+	Batches  uint64
+	// LastCommitted is the commit time of the last applied write batch.
+	LastCommitted time.Time
+}
+
+// RestoreReport is the report of a point in time restore.
+type RestoreReport struct {
+	Shards []ShardRestore
+	Verify VerifyReport
+}
+
+// RestoreToPointInTime restores the backup found in backupDir into the
+// specified LogDB directories and applies write batches shipped to the store
+// after the backup was created up to the target. The backup must have been
+// created with log shipping enabled. Checksums of all segments and the
+// continuity of the applied batches are verified, the restored LogDB is
+// checked using ShardedDB.Verify before the restore is declared successful.
+func RestoreToPointInTime(config LogDBConfig, backupDir string,
+	store ObjectStore, dirs []string, lldirs []string,
+	target RestoreTarget) (RestoreReport, error) {
+	fs := config.FS
+	m, err := VerifyBackup(backupDir, fs)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	if uint64(len(m.Sequences)) != m.Shards {
+		return RestoreReport{}, errors.Wrap(ErrInvalidBackup,
+			"backup not created with log shipping enabled")
+	}
+	if len(target.Sequences) > 0 && uint64(len(target.Sequences)) != m.Shards {
+		return RestoreReport{}, errors.Errorf("%d target sequences, backup has %d shards",
+			len(target.Sequences), m.Shards)
+	}
+	// segments are checked before restoring anything
+	plans := make([][]Segment, m.Shards)
+	gaps := make([]*[2]uint64, m.Shards)
+	for i := uint64(0); i < m.Shards; i++ {
+		segments, err := ListSegments(store, i)
+		if err != nil {
+			return RestoreReport{}, err
+		}
+		plans[i], gaps[i], err = planShardRestore(i, m.Sequences[i], segments)
+		if err != nil {
+			return RestoreReport{}, err
+		}
+	}
+	if err := RestoreBackup(config, backupDir, dirs, lldirs); err != nil {
+		return RestoreReport{}, err
+	}
+	config.ReadOnly = false
+	config.MirrorDir = ""
+	config.ShippingStore = nil
+	edirs, elldirs := expandDirs(config.Shards, dirs, lldirs)
+	report := RestoreReport{}
+	for i := uint64(0); i < m.Shards; i++ {
+		dir, walDir := restoreTarget(config, edirs, elldirs, i)
+		sr, reached, err := applyShipped(config, dir, walDir, store,
+			i, m.Sequences[i], plans[i], target)
+		if err != nil {
+			return RestoreReport{}, err
+		}
+		// batches after the gap might be required to reach the target
+		if gap := gaps[i]; gap != nil && !reached {
+			return RestoreReport{}, errors.Wrapf(ErrShippedLogGap,
+				"shard %d batches [%d, %d) missing", i, gap[0], gap[1])
+		}
+		report.Shards = append(report.Shards, sr)
+	}
+	db, err := NewLogDB(config, nil, dirs, lldirs, CheckNone)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	report.Verify, err = db.Verify()
+	if err = firstError(err, db.Close()); err != nil {
+		return RestoreReport{}, err
+	}
+	if len(report.Verify.Violations) > 0 {
+		return report, errors.Errorf("restored LogDB has %d invariant violations, first %s",
+			len(report.Verify.Violations), report.Verify.Violations[0])
+	}
+	return report, nil
+}
+
+// planShardRestore returns the contiguous segments covering the write batches
+// of the shard starting from the sequence number from. The returned gap is the
+// range of missing batches found after the contiguous segments, if any.
+func planShardRestore(shard uint64,
+	from uint64, segments []Segment) ([]Segment, *[2]uint64, error) {
+	var result []Segment
+	next := from
+	for _, seg := range segments {
+		if seg.Next <= from {
+			continue
+		}
+		if seg.First > next {
+			return result, &[2]uint64{next, seg.First}, nil
+		}
+		if seg.First < next && len(result) > 0 {
+			return nil, nil, errors.Wrapf(ErrShippedLogGap,
+				"shard %d segment %s overlaps [%d, %d)", shard, seg.Name, seg.First, next)
+		}
+		result = append(result, seg)
+		next = seg.Next
+	}
+	return result, nil, nil
+}
+
+func applyShipped(config LogDBConfig, dir string, walDir string,
+	store ObjectStore, shard uint64, from uint64, segments []Segment,
+	target RestoreTarget) (sr ShardRestore, reached bool, err error) {
+	sr = ShardRestore{Shard: shard, From: from, Next: from}
+	if walDir == dir {
+		walDir = ""
+	}
+	kv, err := openPebbleDB(config, nil, dir, walDir, config.FS)
+	if err != nil {
+		return ShardRestore{}, false, err
+	}
+	defer func() {
+		err = firstError(err, kv.Close())
+	}()
+	for _, seg := range segments {
+		data, err := store.Get(seg.Name)
+		if err != nil {
+			return ShardRestore{}, false, err
+		}
+		batches, err := DecodeSegment(data)
+		if err != nil {
+			return ShardRestore{}, false, errors.Wrapf(err, "segment %s", seg.Name)
+		}
+		sr.Segments++
+		next := seg.First
+		for _, b := range batches {
+			if b.Seq != next {
+				return ShardRestore{}, false, errors.Wrapf(ErrShippedLogGap,
+					"segment %s batch %d, expected %d", seg.Name, b.Seq, next)
+			}
+			wb := kv.db.NewBatch()
+			if err := wb.SetRepr(b.Data); err != nil {
+				return ShardRestore{}, false, firstError(errors.Wrapf(ErrInvalidSegment,
+					"segment %s batch %d: %v", seg.Name, b.Seq, err), wb.Close())
+			}
+			next = b.Seq + uint64(wb.Count())
+			if b.Seq < from {
+				// already included in the backup
+				if err := wb.Close(); err != nil {
+					return ShardRestore{}, false, err
+				}
+				continue
+			}
+			if !target.includes(shard, b) {
+				return sr, true, wb.Close()
+			}
+			if err := firstError(kv.db.Apply(wb, kv.wo), wb.Close()); err != nil {
+				return ShardRestore{}, false, err
+			}
+			sr.Next = next
+			sr.Batches++
+			sr.LastCommitted = b.Committed
+		}
+		if next != seg.Next {
+			return ShardRestore{}, false, errors.Wrapf(ErrShippedLogGap,
+				"segment %s ends at %d, expected %d", seg.Name, next, seg.Next)
+		}
+	}
+	// the target sequence might be the end of the contiguous segments
+	reached = len(target.Sequences) > 0 &&
+		target.Sequences[shard] > 0 && sr.Next >= target.Sequences[shard]
+	return sr, reached, nil
+}
+
+// String returns a human readable summary of the report.
+func (r RestoreReport) String() string {
+	var sb strings.Builder
+	for _, s := range r.Shards {
+		fmt.Fprintf(&sb, "shard %d: applied %d batches from %d segments, sequences [%d, %d)",
+			s.Shard, s.Batches, s.Segments, s.From, s.Next)
+		if !s.LastCommitted.IsZero() {
+			fmt.Fprintf(&sb, ", last committed %s", s.LastCommitted.Format(time.RFC3339Nano))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
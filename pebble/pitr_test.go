@@ -0,0 +1,128 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func getShippingTestConfig(fs vfs.FS, store ObjectStore) LogDBConfig {
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 2
+	cfg.ShippingStore = store
+	cfg.ShippingInterval = time.Hour
+	return cfg
+}
+
+func entryCountOf(t *testing.T, cfg LogDBConfig,
+	dir string, clusterID uint64) uint64 {
+	cfg.ShippingStore = nil
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(clusterID, 1, 0)
+	if err != nil {
+		return 0
+	}
+	return rs.EntryCount
+}
+
+func TestPointInTimeRestore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	store := NewFSObjectStore(fs, "store")
+	cfg := getShippingTestConfig(fs, store)
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 1, 10)
+	_, err = db.Backup("backup")
+	require.NoError(t, err)
+	saveTestNode(t, db, 2, 1, 20)
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	saveTestNode(t, db, 3, 1, 30)
+	require.NoError(t, db.RemoveNodeData(1, 1))
+	require.NoError(t, db.Close())
+
+	// latest
+	report, err := RestoreToPointInTime(cfg, "backup", store,
+		[]string{"latest"}, nil, RestoreTarget{})
+	require.NoError(t, err)
+	require.Len(t, report.Shards, 2)
+	require.NotEmpty(t, report.String())
+	require.Equal(t, uint64(0), entryCountOf(t, cfg, "latest", 1))
+	require.Equal(t, uint64(20), entryCountOf(t, cfg, "latest", 2))
+	require.Equal(t, uint64(30), entryCountOf(t, cfg, "latest", 3))
+	// point in time
+	_, err = RestoreToPointInTime(cfg, "backup", store,
+		[]string{"pitr"}, nil, RestoreTarget{Until: until})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), entryCountOf(t, cfg, "pitr", 1))
+	require.Equal(t, uint64(20), entryCountOf(t, cfg, "pitr", 2))
+	require.Equal(t, uint64(0), entryCountOf(t, cfg, "pitr", 3))
+	// sequences
+	seqs := make([]uint64, 2)
+	for _, sr := range report.Shards {
+		seqs[sr.Shard] = sr.From
+	}
+	_, err = RestoreToPointInTime(cfg, "backup", store,
+		[]string{"seq"}, nil, RestoreTarget{Sequences: seqs})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), entryCountOf(t, cfg, "seq", 1))
+	require.Equal(t, uint64(0), entryCountOf(t, cfg, "seq", 2))
+}
+
+func TestPointInTimeRestoreDetectsCorruptionsAndGaps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	store := NewFSObjectStore(fs, "store")
+	cfg := getShippingTestConfig(fs, store)
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	_, err = db.Backup("backup")
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 1, 10)
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 3, 1, 10)
+	require.NoError(t, db.Close())
+
+	shard := db.partitioner.GetPartitionID(1)
+	require.Equal(t, shard, db.partitioner.GetPartitionID(3))
+	segments, err := ListSegments(store, shard)
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+	data, err := store.Get(segments[0].Name)
+	require.NoError(t, err)
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xFF
+	require.NoError(t, store.Put(segments[0].Name, corrupted))
+	_, err = RestoreToPointInTime(cfg, "backup", store,
+		[]string{"corrupted"}, nil, RestoreTarget{})
+	require.True(t, errors.Is(err, ErrInvalidSegment))
+
+	require.NoError(t, store.Put(segments[0].Name, data))
+	require.NoError(t, fs.Remove(fs.PathJoin("store", segments[0].Name)))
+	_, err = RestoreToPointInTime(cfg, "backup", store,
+		[]string{"gap"}, nil, RestoreTarget{})
+	require.True(t, errors.Is(err, ErrShippedLogGap))
+
+	cfg.ShippingStore = nil
+	db, err = NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	_, err = db.Backup("unshipped")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = RestoreToPointInTime(cfg, "unshipped", store,
+		[]string{"unshipped-restore"}, nil, RestoreTarget{})
+	require.True(t, errors.Is(err, ErrInvalidBackup))
+}
@@ -17,26 +17,31 @@ package pebble
 import (
 	"github.com/coufalja/tugboat/raftio"
 	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
 )
 
 type plainEntries struct {
 	cs   *cache
 	keys *keyPool
 	kvs  *KV
+	// verify enables the structural checks of entries read, see
+	// LogDBConfig.VerifyReads.
+	verify bool
 }
 
 var _ entryManager = (*plainEntries)(nil)
 
 func newPlainEntries(cs *cache, keys *keyPool, kvs *KV) entryManager {
 	return &plainEntries{
-		cs:   cs,
-		keys: keys,
-		kvs:  kvs,
+		cs:     cs,
+		keys:   keys,
+		kvs:    kvs,
+		verify: kvs.config.VerifyReads,
 	}
 }
 
 func (pe *plainEntries) record(wb *pebbleWriteBatch,
-	clusterID uint64, nodeID uint64, ctx IContext, entries []pb.Entry) uint64 {
+	clusterID uint64, nodeID uint64, ctx IContext, entries []pb.Entry) (uint64, error) {
 	idx := 0
 	maxIndex := uint64(0)
 	for idx < len(entries) {
@@ -55,14 +60,16 @@ func (pe *plainEntries) record(wb *pebbleWriteBatch,
 		}
 		idx++
 	}
-	return maxIndex
+	pe.cs.recordEntries(clusterID, nodeID, entries)
+	return maxIndex, nil
 }
 
-func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
+func (pe *plainEntries) iterate(arena *EntryArena,
+	ents []pb.Entry, maxIndex uint64,
 	size uint64, clusterID uint64, nodeID uint64,
 	low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
 	if low+1 == high && low <= maxIndex {
-		e, err := pe.getEntry(clusterID, nodeID, low)
+		e, err := pe.getEntry(arena, clusterID, nodeID, low)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -73,6 +80,7 @@ func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
 	if high > maxIndex+1 {
 		high = maxIndex + 1
 	}
+	high = pe.cs.boundBySize(clusterID, nodeID, low, high, size, maxSize)
 	fk := pe.keys.get()
 	lk := pe.keys.get()
 	defer fk.Release()
@@ -82,7 +90,19 @@ func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
 	expectedIndex := low
 	op := func(key []byte, data []byte) (bool, error) {
 		var e pb.Entry
-		pb.MustUnmarshal(&e, data)
+		if err := arena.decode(&e, data); err != nil {
+			return false, err
+		}
+		if pe.verify {
+			if err := checkEntry(key, e, clusterID, nodeID); err != nil {
+				return false, err
+			}
+			if e.Index != expectedIndex && expectedIndex != low {
+				return false, errors.Wrapf(ErrCorruptedRecord,
+					"cluster %d node %d: entry %d follows entry %d",
+					clusterID, nodeID, e.Index, expectedIndex-1)
+			}
+		}
 		if e.Index != expectedIndex {
 			return false, nil
 		}
@@ -100,23 +120,47 @@ func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
 	return ents, size, nil
 }
 
-func (pe *plainEntries) getEntry(clusterID uint64,
+func (pe *plainEntries) getEntry(arena *EntryArena, clusterID uint64,
 	nodeID uint64, index uint64) (pb.Entry, error) {
 	k := pe.keys.get()
 	defer k.Release()
 	k.SetEntryKey(clusterID, nodeID, index)
 	var e pb.Entry
 	op := func(data []byte) error {
-		pb.MustUnmarshal(&e, data)
-		return nil
+		return arena.decode(&e, data)
 	}
 	if err := pe.kvs.GetValue(k.Key(), op); err != nil {
 		return pb.Entry{}, err
 	}
+	if pe.verify && e.Index != index {
+		return pb.Entry{}, errors.Wrapf(ErrCorruptedRecord,
+			"cluster %d node %d: entry %d read under the key of entry %d",
+			clusterID, nodeID, e.Index, index)
+	}
 	return e, nil
 }
 
-func (pe *plainEntries) getRange(clusterID uint64,
+// checkEntry returns ErrCorruptedRecord when the entry e read under key for
+// the specified node does not belong to the key.
+func checkEntry(key []byte, e pb.Entry, clusterID uint64, nodeID uint64) error {
+	cid, nid, index, err := decodeEntryKey(key)
+	if err != nil {
+		return err
+	}
+	if cid != clusterID || nid != nodeID {
+		return errors.Wrapf(ErrCorruptedRecord,
+			"cluster %d node %d: entry %d read under the key of cluster %d node %d",
+			clusterID, nodeID, e.Index, cid, nid)
+	}
+	if index != e.Index {
+		return errors.Wrapf(ErrCorruptedRecord,
+			"cluster %d node %d: entry %d read under the key of entry %d",
+			clusterID, nodeID, e.Index, index)
+	}
+	return nil
+}
+
+func (pe *plainEntries) getRange(kvs kvReader, clusterID uint64,
 	nodeID uint64, snapshotIndex uint64, maxIndex uint64) (uint64, uint64, error) {
 	fk := pe.keys.get()
 	lk := pe.keys.get()
@@ -128,14 +172,24 @@ func (pe *plainEntries) getRange(clusterID uint64,
 	length := uint64(0)
 	op := func(key []byte, data []byte) (bool, error) {
 		if firstIndex == 0 {
+			_, _, index, err := decodeEntryKey(key)
+			if err != nil {
+				return false, err
+			}
 			var e pb.Entry
-			pb.MustUnmarshal(&e, data)
+			if err := unmarshal(&e, data); err != nil {
+				return false, err
+			}
+			if e.Index != index {
+				return false, errors.Wrapf(ErrCorruptedRecord,
+					"entry index %d, key index %d", e.Index, index)
+			}
 			firstIndex = e.Index
 			return false, nil
 		}
 		return true, nil
 	}
-	if err := pe.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+	if err := kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
 		return 0, 0, err
 	}
 	if firstIndex == 0 && maxIndex != 0 {
@@ -158,6 +212,14 @@ func (pe *plainEntries) rangedOp(clusterID uint64,
 	return op(fk, lk)
 }
 
+// remove is a no-op as all entries are kept in pebble.
+func (pe *plainEntries) remove(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	return nil
+}
+
+func (pe *plainEntries) close() {}
+
 func (pe *plainEntries) binaryFormat() uint32 {
 	return raftio.PlainLogDBBinVersion
 }
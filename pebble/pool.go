@@ -0,0 +1,160 @@
+package pebble
+
+import (
+	"sync/atomic"
+)
+
+// PoolStats contains the statistics of a pool of reusable objects of a shard.
+type PoolStats struct {
+	// Size is the number of pre-allocated objects kept by the pool.
+	Size uint64
+	// Gets is the number of objects taken from the pool.
+	Gets uint64
+	// Misses is the number of gets that found no pre-allocated object
+	// available, a high ratio of misses indicates that the pool is too small
+	// for the number of concurrent users.
+	Misses uint64
+}
+
+type poolCounters struct {
+	gets   uint64
+	misses uint64
+}
+
+func (c *poolCounters) hit() {
+	atomic.AddUint64(&c.gets, 1)
+}
+
+func (c *poolCounters) miss() {
+	atomic.AddUint64(&c.gets, 1)
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *poolCounters) stats(size uint64) PoolStats {
+	return PoolStats{
+		Size:   size,
+		Gets:   atomic.LoadUint64(&c.gets),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// contextPool keeps up to size pre-allocated IContext instances of a shard,
+// new instances are created once all of them are in use.
+type contextPool struct {
+	free     chan *context
+	size     uint64
+	maxSize  uint64
+	counters poolCounters
+}
+
+func newContextPool(count uint64, size uint64, maxSize uint64) *contextPool {
+	p := &contextPool{
+		free:    make(chan *context, count),
+		size:    size,
+		maxSize: maxSize,
+	}
+	for i := uint64(0); i < count; i++ {
+		p.free <- p.newContext()
+	}
+	return p
+}
+
+func (p *contextPool) newContext() *context {
+	ctx := newContext(p.size, p.maxSize)
+	ctx.pool = p
+	return ctx
+}
+
+func (p *contextPool) get() *context {
+	select {
+	case ctx := <-p.free:
+		p.counters.hit()
+		return ctx
+	default:
+	}
+	p.counters.miss()
+	return p.newContext()
+}
+
+func (p *contextPool) put(ctx *context) {
+	ctx.Reset()
+	select {
+	case p.free <- ctx:
+	default:
+		ctx.Destroy()
+	}
+}
+
+func (p *contextPool) close() {
+	for {
+		select {
+		case ctx := <-p.free:
+			ctx.Destroy()
+		default:
+			return
+		}
+	}
+}
+
+func (p *contextPool) stats() PoolStats {
+	return p.counters.stats(uint64(cap(p.free)))
+}
+
+// batchPool keeps up to size destroyed write batches of a KV store for reuse,
+// batches are reset when returned to the pool. Batches with more than maxSize
+// bytes of records are never reused, the storage engine keeps referring to
+// the content of such large batches once they are committed.
+type batchPool struct {
+	free     chan *pebbleWriteBatch
+	maxSize  int
+	counters poolCounters
+}
+
+func newBatchPool(size uint64, maxSize int) *batchPool {
+	return &batchPool{
+		free:    make(chan *pebbleWriteBatch, size),
+		maxSize: maxSize,
+	}
+}
+
+// get returns a write batch from the pool, nil is returned when the pool is
+// empty.
+func (p *batchPool) get() *pebbleWriteBatch {
+	select {
+	case wb := <-p.free:
+		p.counters.hit()
+		return wb
+	default:
+	}
+	p.counters.miss()
+	return nil
+}
+
+// put returns a boolean value indicating whether the reset write batch was
+// kept by the pool.
+func (p *batchPool) put(wb *pebbleWriteBatch) bool {
+	if !wb.reset() {
+		return false
+	}
+	select {
+	case p.free <- wb:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *batchPool) close() {
+	for {
+		select {
+		case wb := <-p.free:
+			wb.close()
+		default:
+			return
+		}
+	}
+}
+
+func (p *batchPool) stats() PoolStats {
+	return p.counters.stats(uint64(cap(p.free)))
+}
@@ -0,0 +1,94 @@
+package pebble
+
+import (
+	"testing"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPoolUsesPreallocatedKeys(t *testing.T) {
+	p := newLogDBKeyPool(2)
+	k1 := p.get()
+	k2 := p.get()
+	require.Equal(t, PoolStats{Size: 2, Gets: 2}, p.stats())
+	k3 := p.get()
+	require.Equal(t, PoolStats{Size: 2, Gets: 3, Misses: 1}, p.stats())
+	k1.Release()
+	k2.Release()
+	k3.Release()
+	require.Len(t, p.free, 2)
+	k := p.get()
+	require.Nil(t, k.Key())
+	require.Equal(t, uint64(1), p.stats().Misses)
+}
+
+func TestWriteBatchesAreReused(t *testing.T) {
+	tf := func(t *testing.T, kvs *KV) {
+		kvs.batches.maxSize = 1024
+		wb := kvs.GetWriteBatch()
+		wb.Put([]byte("key-1"), []byte("value-1"))
+		require.NoError(t, kvs.CommitWriteBatch(wb))
+		wb.Destroy()
+		require.Equal(t, PoolStats{Size: 16, Gets: 1, Misses: 1}, kvs.batches.stats())
+		reused := kvs.GetWriteBatch()
+		require.Same(t, wb, reused)
+		require.Zero(t, reused.Count())
+		require.Equal(t, PoolStats{Size: 16, Gets: 2, Misses: 1}, kvs.batches.stats())
+		reused.Put([]byte("key-2"), []byte("value-2"))
+		require.NoError(t, kvs.CommitWriteBatch(reused))
+		reused.Destroy()
+		large := kvs.GetWriteBatch()
+		large.Put([]byte("key-3"), make([]byte, kvs.batches.maxSize+1))
+		large.Destroy()
+		require.Len(t, kvs.batches.free, 0)
+		for _, key := range []string{"key-1", "key-2"} {
+			require.NoError(t, kvs.GetValue([]byte(key), func(data []byte) error {
+				require.NotEmpty(t, data)
+				return nil
+			}))
+		}
+		require.NoError(t, kvs.GetValue([]byte("key-3"), func(data []byte) error {
+			require.Empty(t, data)
+			return nil
+		}))
+	}
+	runKVTest(t, tf, vfs.NewMem())
+}
+
+func TestContextCanBeAcquiredFromPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.ContextPoolSize = 1
+	cfg.KeyPoolSize = 16
+	sdb, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, sdb.Close())
+	}()
+	ctx1 := sdb.AcquireContext(1)
+	ctx2 := sdb.AcquireContext(1)
+	require.NotSame(t, ctx1, ctx2)
+	require.NoError(t, sdb.SaveRaftStateCtx([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Commit: 1},
+		EntriesToSave: []pb.Entry{{Index: 1, Term: 1}},
+	}}, ctx1))
+	sdb.ReleaseContext(ctx1)
+	sdb.ReleaseContext(ctx2)
+	require.Same(t, ctx1, sdb.AcquireContext(1))
+	stats, err := sdb.Stats()
+	require.NoError(t, err)
+	require.Equal(t, PoolStats{Size: 1, Gets: 3, Misses: 1}, stats.Shards[0].ContextPool)
+	require.Equal(t, PoolStats{Size: 1}, stats.Shards[1].ContextPool)
+	require.Equal(t, uint64(16), stats.Shards[0].KeyPool.Size)
+	require.Panics(t, func() {
+		sdb.ReleaseContext(sdb.GetLogDBThreadContext())
+	})
+}
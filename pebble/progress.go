@@ -0,0 +1,181 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
+	"github.com/lni/vfs"
+)
+
+// walProgressBytes is the number of WAL bytes replayed between two
+// OpenReplayingWAL reports of a shard.
+const walProgressBytes = 4 * 1024 * 1024
+
+// OpenPhase is the phase of opening a shard reported to the
+// OpenProgressListener.
+type OpenPhase int
+
+const (
+	// OpenStarted is reported once the WAL of the shard to be replayed is
+	// known, before the storage engine of the shard is opened.
+	OpenStarted OpenPhase = iota
+	// OpenReplayingWAL is reported while the WAL of the shard is replayed.
+	OpenReplayingWAL
+	// OpenWritingTables is reported for each sstable written from the
+	// replayed WAL.
+	OpenWritingTables
+	// OpenCompleted is reported once the shard is open.
+	OpenCompleted
+)
+
+var openPhaseNames = [...]string{
+	OpenStarted:       "started",
+	OpenReplayingWAL:  "replaying-wal",
+	OpenWritingTables: "writing-tables",
+	OpenCompleted:     "completed",
+}
+
+func (p OpenPhase) String() string {
+	if p < 0 || int(p) >= len(openPhaseNames) {
+		return "unknown"
+	}
+	return openPhaseNames[p]
+}
+
+// OpenProgress describes the progress of opening a shard.
+type OpenProgress struct {
+	Shard uint64
+	Phase OpenPhase
+	// WALBytes is the size of the WAL files found in the shard, including the
+	// WAL of its state store. It is an upper bound of the bytes replayed, WAL
+	// files already flushed are not replayed.
+	WALBytes uint64
+	// ReplayedWALBytes is the number of WAL bytes replayed so far.
+	ReplayedWALBytes uint64
+	// ReplayedTables is the number of sstables written from the replayed WAL
+	// so far.
+	ReplayedTables int
+	// Elapsed is the time since the shard started to be opened.
+	Elapsed time.Duration
+}
+
+// OpenProgressListener is the function called with the progress of opening
+// each shard. It is called synchronously from the goroutine opening the
+// shard, or from goroutines of the storage engine, and must not block.
+type OpenProgressListener func(OpenProgress)
+
+// openProgress reports the progress of opening a shard.
+type openProgress struct {
+	listener OpenProgressListener
+	start    time.Time
+	mu       sync.Mutex
+	progress OpenProgress
+	reported uint64
+	done     bool
+}
+
+// newOpenProgress returns the reporter of the progress of opening the shard
+// with the specified WAL dirs, nil is returned when listener is nil.
+func newOpenProgress(shard uint64, listener OpenProgressListener,
+	walDirs []string, fs vfs.FS) *openProgress {
+	if listener == nil {
+		return nil
+	}
+	p := &openProgress{
+		listener: listener,
+		start:    time.Now(),
+		progress: OpenProgress{Shard: shard},
+	}
+	for _, dir := range walDirs {
+		p.progress.WALBytes += walSize(dir, fs)
+	}
+	p.report(OpenStarted)
+	return p
+}
+
+// walSize returns the total size of the WAL files in dir.
+func walSize(dir string, fs vfs.FS) uint64 {
+	names, err := fs.List(dir)
+	if err != nil {
+		return 0
+	}
+	size := uint64(0)
+	for _, name := range names {
+		if !isWALFile(name) {
+			continue
+		}
+		if fi, err := fs.Stat(fs.PathJoin(dir, name)); err == nil {
+			size += uint64(fi.Size())
+		}
+	}
+	return size
+}
+
+func (p *openProgress) report(phase OpenPhase) {
+	p.progress.Phase = phase
+	p.progress.Elapsed = time.Since(p.start)
+	p.listener(p.progress)
+}
+
+func (p *openProgress) walRead(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.progress.ReplayedWALBytes += uint64(n)
+	if p.progress.ReplayedWALBytes-p.reported >= walProgressBytes {
+		p.reported = p.progress.ReplayedWALBytes
+		p.report(OpenReplayingWAL)
+	}
+}
+
+func (p *openProgress) tableWritten() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.progress.ReplayedTables++
+	p.report(OpenWritingTables)
+}
+
+// complete reports the shard as open, no progress is reported afterwards.
+func (p *openProgress) complete() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.progress.ReplayedWALBytes > p.reported {
+		p.reported = p.progress.ReplayedWALBytes
+		p.report(OpenReplayingWAL)
+	}
+	p.done = true
+	p.report(OpenCompleted)
+}
+
+// progressFS counts the bytes of WAL files read by pebble while the shard is
+// opened, which are the bytes of the replayed WAL.
+type progressFS struct {
+	pvfs.FS
+	progress *openProgress
+}
+
+func (p *progressFS) Open(name string, opts ...pvfs.OpenOption) (pvfs.File, error) {
+	f, err := p.FS.Open(name, opts...)
+	if err != nil || vfsutil.GetFileType(name) != vfsutil.FileTypeWAL {
+		return f, err
+	}
+	return &progressFile{File: f, progress: p.progress}, nil
+}
+
+type progressFile struct {
+	pvfs.File
+	progress *openProgress
+}
+
+func (f *progressFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.progress.walRead(n)
+	return n, err
+}
@@ -0,0 +1,59 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenProgressIsReported(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	p := db.partitioner.GetPartitionID(1)
+	saveTestNode(t, db, 1, 2, 100)
+	require.NoError(t, db.Close())
+
+	var mu sync.Mutex
+	progress := make(map[uint64][]OpenProgress)
+	cfg.OpenProgressListener = func(op OpenProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress[op.Shard] = append(progress[op.Shard], op)
+	}
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, progress, int(cfg.Shards))
+	for shard, reports := range progress {
+		require.Equal(t, OpenStarted, reports[0].Phase)
+		last := reports[len(reports)-1]
+		require.Equal(t, OpenCompleted, last.Phase)
+		require.LessOrEqual(t, last.ReplayedWALBytes, last.WALBytes)
+		for i := 1; i < len(reports); i++ {
+			require.LessOrEqual(t, reports[i-1].ReplayedWALBytes, reports[i].ReplayedWALBytes)
+			require.LessOrEqual(t, reports[i-1].Elapsed, reports[i].Elapsed)
+		}
+		if shard == p {
+			require.NotZero(t, last.ReplayedWALBytes)
+			require.Equal(t, 1, last.ReplayedTables)
+			require.Equal(t, OpenWritingTables, reports[len(reports)-3].Phase)
+			require.Equal(t, OpenReplayingWAL, reports[len(reports)-2].Phase)
+		}
+	}
+}
+
+func TestOpenPhaseString(t *testing.T) {
+	require.Equal(t, "replaying-wal", OpenReplayingWAL.String())
+	require.Equal(t, "unknown", OpenPhase(100).String())
+}
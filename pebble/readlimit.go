@@ -0,0 +1,66 @@
+package pebble
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ReadStats contains the statistics of the heavy reads of a shard limited
+// by LogDBConfig.MaxConcurrentReads.
+type ReadStats struct {
+	// Active is the number of heavy reads currently running.
+	Active uint64
+	// Waits is the number of heavy reads which had to wait for another read
+	// to complete, WaitTime is the total time spent waiting.
+	Waits    uint64
+	WaitTime time.Duration
+}
+
+// readSlots is a semaphore bounding the number of concurrent heavy reads of
+// a shard, i.e. entry iterations, exports and verifications. A nil readSlots
+// imposes no limit.
+type readSlots struct {
+	slots    chan struct{}
+	waits    uint64
+	waitTime int64
+}
+
+func newReadSlots(n uint64) *readSlots {
+	if n == 0 {
+		return nil
+	}
+	return &readSlots{slots: make(chan struct{}, n)}
+}
+
+func (s *readSlots) acquire() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return
+	default:
+	}
+	start := time.Now()
+	s.slots <- struct{}{}
+	atomic.AddUint64(&s.waits, 1)
+	atomic.AddInt64(&s.waitTime, int64(time.Since(start)))
+}
+
+func (s *readSlots) release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+func (s *readSlots) stats() *ReadStats {
+	if s == nil {
+		return nil
+	}
+	return &ReadStats{
+		Active:   uint64(len(s.slots)),
+		Waits:    atomic.LoadUint64(&s.waits),
+		WaitTime: time.Duration(atomic.LoadInt64(&s.waitTime)),
+	}
+}
@@ -0,0 +1,72 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSlotsBoundConcurrentReads(t *testing.T) {
+	require.Nil(t, newReadSlots(0))
+	var nilSlots *readSlots
+	nilSlots.acquire()
+	nilSlots.release()
+	require.Nil(t, nilSlots.stats())
+	s := newReadSlots(2)
+	s.acquire()
+	s.acquire()
+	require.Equal(t, uint64(2), s.stats().Active)
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("acquired more than the max number of slots")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.release()
+	<-acquired
+	st := s.stats()
+	require.Equal(t, uint64(2), st.Active)
+	require.Equal(t, uint64(1), st.Waits)
+	require.NotZero(t, st.WaitTime)
+	s.release()
+	s.release()
+	require.Zero(t, s.stats().Active)
+}
+
+func TestConcurrentReadsAreLimited(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		shard, err := sdb.shard(sdb.partitioner.GetPartitionID(1))
+		require.NoError(t, err)
+		shard.reads = newReadSlots(1)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 101, 1<<30)
+				require.NoError(t, err)
+				require.Len(t, ents, 100)
+			}()
+		}
+		wg.Wait()
+		_, err = sdb.Verify()
+		require.NoError(t, err)
+		stats, err := sdb.Stats()
+		require.NoError(t, err)
+		p := sdb.partitioner.GetPartitionID(1)
+		require.NotNil(t, stats.Shards[p].Reads)
+		require.Zero(t, stats.Shards[p].Reads.Active)
+		require.Nil(t, stats.Shards[(p+1)%sdb.config.Shards].Reads)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,98 @@
+package pebble
+
+import (
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// runningMarkerFilename is the name of the file created in the shard
+// directory when the shard is opened for writing, it is removed once the
+// shard is closed cleanly.
+const runningMarkerFilename = "RUNNING"
+
+// ShardRecovery describes how a shard was recovered when it was opened.
+type ShardRecovery struct {
+	Shard uint64
+	// Unclean is set when the shard was not closed cleanly the last time it
+	// was open for writing.
+	Unclean bool
+	// ReplayedTables and ReplayedBytes are the number and the total size of
+	// the sstables written from the replayed WAL.
+	ReplayedTables int
+	ReplayedBytes  uint64
+	// OpenDuration is the time taken to open the shard including the WAL
+	// replay.
+	OpenDuration time.Duration
+}
+
+// RecoveryReport describes the recovery of all shards when the LogDB was
+// opened.
+type RecoveryReport struct {
+	// Unclean is set when at least one shard was not closed cleanly.
+	Unclean bool
+	Shards  []ShardRecovery
+}
+
+// replayStats contains the sstables written by pebble when replaying the WAL
+// during open.
+type replayStats struct {
+	paths []string
+	bytes uint64
+}
+
+// RecoveryReport returns the report of the recovery performed when the LogDB
+// was opened. Shards opened on demand are included once opened.
+func (s *ShardedDB) RecoveryReport() RecoveryReport {
+	s.recoveryMu.Lock()
+	defer s.recoveryMu.Unlock()
+	report := s.recovery
+	report.Shards = append([]ShardRecovery{}, s.recovery.Shards...)
+	return report
+}
+
+func (r *KV) replayedTables(fs vfs.FS) {
+	for _, p := range r.event.replay.paths {
+		// the table might be compacted away already
+		if fi, err := fs.Stat(p); err == nil {
+			r.event.replay.bytes += uint64(fi.Size())
+		}
+	}
+}
+
+func hasRunningMarker(dir string, fs vfs.FS) bool {
+	_, err := fs.Stat(fs.PathJoin(dir, runningMarkerFilename))
+	return err == nil
+}
+
+func createRunningMarker(dir string, fs vfs.FS) error {
+	f, err := fs.Create(fs.PathJoin(dir, runningMarkerFilename))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := firstError(f.Sync(), f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+func removeRunningMarker(dir string, fs vfs.FS) error {
+	if err := fs.Remove(fs.PathJoin(dir, runningMarkerFilename)); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+func logRecovery(rec ShardRecovery) {
+	if rec.Unclean {
+		plog.Warningf("shard %d recovered from an unclean shutdown, "+
+			"%d tables (%d bytes) written from the WAL, took %s", rec.Shard,
+			rec.ReplayedTables, rec.ReplayedBytes, rec.OpenDuration)
+	} else {
+		plog.Debugf("shard %d opened, %d tables (%d bytes) written from the WAL, "+
+			"took %s", rec.Shard, rec.ReplayedTables, rec.ReplayedBytes,
+			rec.OpenDuration)
+	}
+}
@@ -0,0 +1,108 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryReportDetectsUncleanShutdown(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	report := db.RecoveryReport()
+	require.False(t, report.Unclean)
+	require.Len(t, report.Shards, int(cfg.Shards))
+	p := db.partitioner.GetPartitionID(1)
+	dir := fs.PathJoin(RDBTestDirectory, shardDirName(p))
+	require.True(t, hasRunningMarker(dir, fs))
+	saveTestNode(t, db, 1, 2, 100)
+	require.NoError(t, db.Close())
+	require.False(t, hasRunningMarker(dir, fs))
+
+	// the marker left behind by a crashed instance
+	require.NoError(t, createRunningMarker(dir, fs))
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	report = db.RecoveryReport()
+	require.True(t, report.Unclean)
+	for _, rec := range report.Shards {
+		require.Equal(t, rec.Shard == p, rec.Unclean)
+	}
+	require.Equal(t, 1, report.Shards[p].ReplayedTables)
+	require.NotZero(t, report.Shards[p].ReplayedBytes)
+	require.NoError(t, db.Close())
+
+	cfg.ReadOnly = true
+	require.NoError(t, createRunningMarker(dir, fs))
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	require.True(t, db.RecoveryReport().Unclean)
+	require.NoError(t, db.Close())
+	require.True(t, hasRunningMarker(dir, fs))
+}
+
+func TestShardsAreOpenedWithLimitedParallelism(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	for _, limit := range []uint64{0, 1, 3} {
+		cfg := getDefaultLogDBConfig()
+		cfg.FS = fs
+		cfg.OpenParallelism = limit
+		var mu sync.Mutex
+		opening, maxOpening := uint64(0), uint64(0)
+		cfg.OpenProgressListener = func(op OpenProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch op.Phase {
+			case OpenStarted:
+				opening++
+				if opening > maxOpening {
+					maxOpening = opening
+				}
+			case OpenCompleted:
+				opening--
+			}
+		}
+		db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+		require.NoError(t, err)
+		report := db.RecoveryReport()
+		require.NoError(t, db.Close())
+		require.Len(t, report.Shards, int(cfg.Shards))
+		for i, rec := range report.Shards {
+			require.Equal(t, uint64(i), rec.Shard)
+		}
+		if limit > 0 {
+			require.LessOrEqual(t, maxOpening, limit)
+		}
+	}
+}
+
+func TestFailedShardOpenClosesOpenedShards(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := newHeldLockFS()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.OpenParallelism = 4
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	require.NoError(t, fs.MkdirAll(fs.PathJoin(dir, shardDirName(5)), 0755))
+	lock := fs.PathJoin(dir, shardDirName(5), "LOCK")
+	fs.hold(lock)
+	_, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrLocked)
+	// locks of the other shards are released
+	_ = fs.Remove(lock)
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,98 @@
+package pebble
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/pkg/errors"
+)
+
+// AcceptRelaxedDurability is the value LogDBConfig.RelaxedDurability must be
+// set to for the relaxed durability mode to be enabled.
+const AcceptRelaxedDurability = "accept-loss-of-acknowledged-writes"
+
+// ErrRelaxedDurabilityNotAccepted indicates that RelaxedSyncInterval was set
+// without explicitly accepting the relaxed durability semantics.
+var ErrRelaxedDurabilityNotAccepted = errors.New("relaxed durability not accepted")
+
+// checkRelaxedDurability makes sure the relaxed durability mode can not be
+// enabled by accident.
+func checkRelaxedDurability(config LogDBConfig) error {
+	if config.ReadOnly {
+		return nil
+	}
+	if config.RelaxedSyncInterval < 0 {
+		return errors.Errorf("invalid relaxed sync interval %s",
+			config.RelaxedSyncInterval)
+	}
+	if config.RelaxedSyncInterval > 0 &&
+		config.RelaxedDurability != AcceptRelaxedDurability {
+		return errors.WithStack(ErrRelaxedDurabilityNotAccepted)
+	}
+	if config.RelaxedSyncInterval == 0 && len(config.RelaxedDurability) > 0 {
+		return errors.New("relaxed durability accepted without a sync interval")
+	}
+	return nil
+}
+
+// markUnsynced records that a write has been committed without syncing the
+// WAL.
+func (r *KV) markUnsynced() {
+	if r.relaxed {
+		atomic.StoreUint32(&r.unsynced, 1)
+	}
+}
+
+// syncFailure returns the error of the last failed background sync, all
+// writes fail once a background sync failed so the loss window can not grow
+// past the sync interval.
+func (r *KV) syncFailure() error {
+	if !r.relaxed {
+		return nil
+	}
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+	return r.syncErr
+}
+
+// syncWAL syncs the WAL when there are writes committed without syncing it.
+func (r *KV) syncWAL() error {
+	if r.state != nil {
+		if err := r.state.syncWAL(); err != nil {
+			return err
+		}
+	}
+	if !r.relaxed || !atomic.CompareAndSwapUint32(&r.unsynced, 1, 0) {
+		return r.syncFailure()
+	}
+	if err := r.db.LogData(nil, pebble.Sync); err != nil {
+		r.syncMu.Lock()
+		if r.syncErr == nil {
+			r.syncErr = errors.Wrap(err, "background sync failed")
+		}
+		r.syncMu.Unlock()
+		return r.syncErr
+	}
+	return nil
+}
+
+func (s *ShardedDB) relaxedSyncWorkerMain() {
+	ticker := time.NewTicker(s.config.RelaxedSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			for i, shard := range s.openedShards() {
+				if shard == nil {
+					continue
+				}
+				if err := shard.kvs.syncWAL(); err != nil {
+					plog.Errorf("shard %d: %v", i, err)
+				}
+			}
+		}
+	}
+}
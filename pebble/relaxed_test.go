@@ -0,0 +1,74 @@
+package pebble
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/syncutil"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelaxedDurabilityMustBeAccepted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	cfg.RelaxedSyncInterval = 10 * time.Millisecond
+	_, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.ErrorIs(t, err, ErrRelaxedDurabilityNotAccepted)
+	cfg.RelaxedDurability = "yes"
+	_, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.ErrorIs(t, err, ErrRelaxedDurabilityNotAccepted)
+	cfg.RelaxedSyncInterval = 0
+	cfg.RelaxedDurability = AcceptRelaxedDurability
+	_, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.Error(t, err)
+}
+
+func TestRelaxedDurabilitySyncsInBackground(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.RelaxedSyncInterval = 10 * time.Millisecond
+	cfg.RelaxedDurability = AcceptRelaxedDurability
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	kvs := db.shards[db.partitioner.GetPartitionID(1)].kvs
+	require.True(t, kvs.relaxed)
+	require.False(t, kvs.wo.Sync)
+	db.stopper.Stop()
+	saveTestNode(t, db, 1, 2, 10)
+	require.Equal(t, uint32(1), atomic.LoadUint32(&kvs.unsynced))
+	db.stopper = syncutil.NewStopper()
+	db.stopper.RunWorker(func() {
+		db.relaxedSyncWorkerMain()
+	})
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint32(&kvs.unsynced) == 0
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, db.Close())
+
+	cfg.RelaxedSyncInterval = 0
+	cfg.RelaxedDurability = ""
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.False(t, db.shards[0].kvs.relaxed)
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.Equal(t, pb.State{Term: 1, Vote: 2, Commit: 10}, rs.State)
+}
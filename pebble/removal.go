@@ -0,0 +1,192 @@
+package pebble
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/pkg/errors"
+)
+
+// removalChunkSize is the number of entry indexes compacted at once by
+// asynchronous removals.
+var removalChunkSize = uint64(64 * 1024)
+
+// ErrRemovalCanceled indicates that an asynchronous removal was canceled or
+// the LogDB was closed before the removal completed.
+var ErrRemovalCanceled = errors.New("removal canceled")
+
+// RemovalHandle tracks an asynchronous removal started by the
+// RemoveEntriesToAsync or RemoveNodeDataAsync methods. Removed records are
+// no longer visible once the removal has been started, the handle tracks the
+// compaction of the removed entries reclaiming the used disk space.
+type RemovalHandle struct {
+	done      chan struct{}
+	cancelC   chan struct{}
+	once      sync.Once
+	completed uint64
+	total     uint64
+	err       error
+}
+
+func newRemovalHandle(total uint64) *RemovalHandle {
+	return &RemovalHandle{
+		done:    make(chan struct{}),
+		cancelC: make(chan struct{}),
+		total:   total,
+	}
+}
+
+// Progress returns the number of completed and the total number of chunks
+// of entries to be compacted.
+func (h *RemovalHandle) Progress() (uint64, uint64) {
+	return atomic.LoadUint64(&h.completed), h.total
+}
+
+// Done returns a channel closed once the removal completes, fails or is
+// canceled.
+func (h *RemovalHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the error encountered by the removal, it is ErrRemovalCanceled
+// when the removal was canceled. Err is only valid once the Done channel is
+// closed.
+func (h *RemovalHandle) Err() error {
+	<-h.done
+	return h.err
+}
+
+// Cancel cancels the removal, the chunk being compacted is always completed
+// first. Records already removed stay removed, only the space reclamation is
+// stopped.
+func (h *RemovalHandle) Cancel() {
+	h.once.Do(func() { close(h.cancelC) })
+}
+
+func (h *RemovalHandle) finish(err error) {
+	h.err = err
+	close(h.done)
+}
+
+// RemoveEntriesToAsync is similar to RemoveEntriesTo, but the compaction of
+// the removed entries is done in the background in chunks rather than being
+// left to the storage engine, the returned handle reports its progress.
+func (s *ShardedDB) RemoveEntriesToAsync(clusterID uint64,
+	nodeID uint64, index uint64) (*RemovalHandle, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := shard.entryIndexRange(clusterID, nodeID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := shard.removeEntriesTo(clusterID, nodeID, index); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if index > last+1 {
+		index = last + 1
+	}
+	return s.compactRemoved(shard, clusterID, nodeID, first, index), nil
+}
+
+// RemoveNodeDataAsync is similar to RemoveNodeData, but the compaction of the
+// removed entries is done in the background in chunks, the returned handle
+// reports its progress. All node data is removed atomically before
+// RemoveNodeDataAsync returns.
+func (s *ShardedDB) RemoveNodeDataAsync(clusterID uint64,
+	nodeID uint64) (*RemovalHandle, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := shard.entryIndexRange(clusterID, nodeID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := shard.removeNodeData(clusterID, nodeID); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.compactRemoved(shard, clusterID, nodeID, first, last+1), nil
+}
+
+// compactRemoved compacts entries in the range of [first, end) in the
+// background. The pebble version in use provides no excise operation for
+// dropping a key range instantly at any format major version, sstables fully
+// covered by the range tombstone are dropped without being rewritten by
+// pebble's delete-only compactions, the chunked compactions rewrite the rest.
+func (s *ShardedDB) compactRemoved(shard *db,
+	clusterID uint64, nodeID uint64, first uint64, end uint64) *RemovalHandle {
+	total := uint64(0)
+	if first > 0 && end > first {
+		total = (end - first + removalChunkSize - 1) / removalChunkSize
+	}
+	h := newRemovalHandle(total)
+	work := func() {
+		fk := newKey(entryKeySize, nil)
+		lk := newKey(entryKeySize, nil)
+		for i := uint64(0); i < total; i++ {
+			select {
+			case <-h.cancelC:
+				h.finish(ErrRemovalCanceled)
+				return
+			case <-s.stopper.ShouldStop():
+				h.finish(ErrRemovalCanceled)
+				return
+			default:
+			}
+			low := first + i*removalChunkSize
+			high := low + removalChunkSize
+			if high > end || high < low {
+				high = end
+			}
+			fk.SetEntryKey(clusterID, nodeID, low)
+			lk.SetEntryKey(clusterID, nodeID, high)
+			if err := shard.kvs.CompactEntries(fk.Key(), lk.Key()); err != nil {
+				h.finish(errors.WithStack(err))
+				return
+			}
+			atomic.AddUint64(&h.completed, 1)
+		}
+		h.finish(nil)
+	}
+	p := s.partitioner.GetPartitionID(clusterID)
+	s.stopper.RunWorker(func() {
+		withShardLabels("removal", p, work)
+	})
+	return h
+}
+
+// entryIndexRange returns the indexes of the first and the last entry of the
+// specified node, both are 0 when there is no entry.
+func (r *db) entryIndexRange(clusterID uint64, nodeID uint64) (uint64, uint64, error) {
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(clusterID, nodeID, 0)
+	lk.SetEntryKey(clusterID, nodeID, math.MaxUint64)
+	first := uint64(0)
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			_, _, index, err := decodeEntryKey(key)
+			if err != nil {
+				return false, err
+			}
+			first = index
+			return false, nil
+		}); err != nil {
+		return 0, 0, err
+	}
+	if first == 0 {
+		return 0, 0, nil
+	}
+	last, err := r.getMaxIndex(clusterID, nodeID)
+	if err != nil && err != raftio.ErrNoSavedLog {
+		return 0, 0, err
+	}
+	if last < first {
+		last = first
+	}
+	return first, last, nil
+}
@@ -0,0 +1,64 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveEntriesToAsync(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		defer func(v uint64) { removalChunkSize = v }(removalChunkSize)
+		removalChunkSize = 8
+		h, err := sdb.RemoveEntriesToAsync(1, 2, 51)
+		require.NoError(t, err)
+		// removed entries are no longer visible once the removal is started
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Empty(t, ents)
+		ents, _, err = db.IterateEntries(nil, 0, 1, 2, 51, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, 50)
+		<-h.Done()
+		require.NoError(t, h.Err())
+		completed, total := h.Progress()
+		require.Equal(t, uint64(7), total)
+		require.Equal(t, total, completed)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestRemoveNodeDataAsync(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		h, err := sdb.RemoveNodeDataAsync(1, 2)
+		require.NoError(t, err)
+		_, err = db.GetBootstrapInfo(1, 2)
+		require.ErrorIs(t, err, raftio.ErrNoBootstrapInfo)
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Empty(t, ents)
+		require.NoError(t, h.Err())
+		h, err = sdb.RemoveNodeDataAsync(1, 2)
+		require.NoError(t, err)
+		require.NoError(t, h.Err())
+		completed, total := h.Progress()
+		require.Equal(t, uint64(0), total)
+		require.Equal(t, uint64(0), completed)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestRemovalCanBeCanceled(t *testing.T) {
+	h := newRemovalHandle(1)
+	h.Cancel()
+	h.Cancel()
+	go h.finish(ErrRemovalCanceled)
+	require.ErrorIs(t, h.Err(), ErrRemovalCanceled)
+}
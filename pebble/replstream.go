@@ -0,0 +1,231 @@
+package pebble
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplicationStreamVersion is the version of the replication stream format
+// written by StreamEncoder.
+const ReplicationStreamVersion uint32 = 1
+
+// ErrInvalidStream indicates that a replication stream is corrupted or has
+// unsupported format.
+var ErrInvalidStream = errors.New("invalid replication stream")
+
+// replicationStreamMagic is the magic at the beginning of every replication
+// stream.
+var replicationStreamMagic = [8]byte{'T', 'G', 'B', 'R', 'E', 'P', 'L', 0}
+
+const (
+	streamHeaderSize      = 12
+	frameHeaderSize       = 8
+	framePayloadFixedSize = 24
+	// batchHeaderSize is the size of the sequence number and the count found
+	// at the beginning of every pebble write batch.
+	batchHeaderSize = 12
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// StreamFrame is a single write batch carried by the replication stream.
+//
+// The replication stream is the stable encoding of write batches used to
+// ship them out of the LogDB. Shipped segments are replication streams of
+// committed write batches of a shard, see Segment, batches are also queued
+// as frames for the mirror. Sessions of the replication package carry raft
+// updates of a single node as write batches encoded by EncodeUpdateBatch.
+// All integers are big endian. A stream starts with a 12 bytes header
+// followed by any number of frames:
+//
+//	header  = magic "TGBREPL\x00" (8 bytes) | version (uint32)
+//	frame   = length (uint32) | crc (uint32) | payload (length bytes)
+//	payload = shard (uint64) | seq (uint64) | committed (int64) | batch
+//
+// The crc is the CRC32 with the Castagnoli polynomial of the length field
+// and the payload. The committed field is the commit time in nanoseconds
+// since the Unix epoch. The batch is the pebble write batch representation,
+// it starts with the little endian sequence number (uint64) and the number of
+// operations (uint32). The seq field is the sequence number of committed
+// write batches and the index of the last entry or of the snapshot of raft
+// updates. Readers must reject streams with unknown versions,
+// new versions are only introduced with changes incompatible with existing
+// readers.
+type StreamFrame struct {
+	Shard     uint64
+	Seq       uint64
+	Committed time.Time
+	// Data is the pebble write batch representation.
+	Data []byte
+}
+
+// Count returns the number of operations in the write batch, the following
+// write batch of the shard starts at the sequence number Seq+Count.
+func (f StreamFrame) Count() uint32 {
+	if len(f.Data) < batchHeaderSize {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(f.Data[8:batchHeaderSize])
+}
+
+// StreamEncoder writes a replication stream.
+type StreamEncoder struct {
+	bw  *bufio.Writer
+	buf []byte
+}
+
+// NewStreamEncoder returns a StreamEncoder writing to w, the stream header is
+// written immediately.
+func NewStreamEncoder(w io.Writer) (*StreamEncoder, error) {
+	e := &StreamEncoder{bw: bufio.NewWriter(w)}
+	header := make([]byte, streamHeaderSize)
+	copy(header, replicationStreamMagic[:])
+	binary.BigEndian.PutUint32(header[8:], ReplicationStreamVersion)
+	if _, err := e.bw.Write(header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return e, nil
+}
+
+// Encode writes the frame, it is buffered until Flush is called.
+func (e *StreamEncoder) Encode(f StreamFrame) error {
+	if cap(e.buf) < frameHeaderSize+framePayloadFixedSize {
+		e.buf = make([]byte, frameHeaderSize+framePayloadFixedSize)
+	}
+	buf := e.buf[:frameHeaderSize+framePayloadFixedSize]
+	if err := putFrameHeader(buf, f); err != nil {
+		return err
+	}
+	if _, err := e.bw.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := e.bw.Write(f.Data)
+	return errors.WithStack(err)
+}
+
+// putFrameHeader puts the frame header and the fixed part of the payload of
+// f into buf, the checksum covers f.Data which follows them in the frame.
+func putFrameHeader(buf []byte, f StreamFrame) error {
+	if len(f.Data) < batchHeaderSize {
+		return errors.Errorf("invalid write batch size %d", len(f.Data))
+	}
+	sz := framePayloadFixedSize + len(f.Data)
+	if sz > maxStreamRecordSize {
+		return errors.Errorf("write batch too large, %d", len(f.Data))
+	}
+	binary.BigEndian.PutUint32(buf, uint32(sz))
+	binary.BigEndian.PutUint64(buf[8:], f.Shard)
+	binary.BigEndian.PutUint64(buf[16:], f.Seq)
+	binary.BigEndian.PutUint64(buf[24:], uint64(f.Committed.UnixNano()))
+	crc := crc32.Update(0, castagnoli, buf[:4])
+	crc = crc32.Update(crc, castagnoli, buf[frameHeaderSize:frameHeaderSize+framePayloadFixedSize])
+	crc = crc32.Update(crc, castagnoli, f.Data)
+	binary.BigEndian.PutUint32(buf[4:], crc)
+	return nil
+}
+
+// Flush writes all buffered frames to the underlying writer.
+func (e *StreamEncoder) Flush() error {
+	return errors.WithStack(e.bw.Flush())
+}
+
+// StreamDecoder reads a replication stream.
+type StreamDecoder struct {
+	br      *bufio.Reader
+	Version uint32
+	// MaxFrameSize is the max size of the payload of accepted frames, larger
+	// frames are rejected before being read. Frames up to 1GB are accepted
+	// when it is 0.
+	MaxFrameSize uint32
+}
+
+// NewStreamDecoder returns a StreamDecoder reading from r, the stream header
+// is read and checked immediately.
+func NewStreamDecoder(r io.Reader) (*StreamDecoder, error) {
+	d := &StreamDecoder{br: bufio.NewReader(r)}
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(d.br, header); err != nil {
+		return nil, invalidStream(err)
+	}
+	if !bytes.Equal(header[:8], replicationStreamMagic[:]) {
+		return nil, errors.Wrap(ErrInvalidStream, "unexpected magic")
+	}
+	d.Version = binary.BigEndian.Uint32(header[8:])
+	if d.Version != ReplicationStreamVersion {
+		return nil, errors.Wrapf(ErrInvalidStream, "unsupported version %d", d.Version)
+	}
+	return d, nil
+}
+
+// Decode returns the next frame, io.EOF is returned once the stream ends at a
+// frame boundary. The checksum of the frame is verified.
+func (d *StreamDecoder) Decode() (StreamFrame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(d.br, header); err != nil {
+		if err == io.EOF {
+			return StreamFrame{}, io.EOF
+		}
+		return StreamFrame{}, invalidStream(err)
+	}
+	sz := binary.BigEndian.Uint32(header)
+	if sz < framePayloadFixedSize+batchHeaderSize || sz > maxStreamRecordSize ||
+		(d.MaxFrameSize > 0 && sz > d.MaxFrameSize) {
+		return StreamFrame{}, errors.Wrapf(ErrInvalidStream, "invalid frame size %d", sz)
+	}
+	payload := make([]byte, sz)
+	if _, err := io.ReadFull(d.br, payload); err != nil {
+		return StreamFrame{}, invalidStream(err)
+	}
+	return parseFrame(header, payload)
+}
+
+func parseFrame(header []byte, payload []byte) (StreamFrame, error) {
+	if len(payload) < framePayloadFixedSize+batchHeaderSize {
+		return StreamFrame{}, errors.Wrapf(ErrInvalidStream,
+			"invalid frame size %d", len(payload))
+	}
+	crc := crc32.Update(0, castagnoli, header[:4])
+	crc = crc32.Update(crc, castagnoli, payload)
+	if crc != binary.BigEndian.Uint32(header[4:]) {
+		return StreamFrame{}, errors.Wrap(ErrInvalidStream, "checksum mismatch")
+	}
+	return StreamFrame{
+		Shard:     binary.BigEndian.Uint64(payload),
+		Seq:       binary.BigEndian.Uint64(payload[8:]),
+		Committed: time.Unix(0, int64(binary.BigEndian.Uint64(payload[16:]))),
+		Data:      payload[framePayloadFixedSize:],
+	}, nil
+}
+
+// encodeFrame returns the encoded frame f.
+func encodeFrame(f StreamFrame) ([]byte, error) {
+	buf := make([]byte, frameHeaderSize+framePayloadFixedSize+len(f.Data))
+	if err := putFrameHeader(buf, f); err != nil {
+		return nil, err
+	}
+	copy(buf[frameHeaderSize+framePayloadFixedSize:], f.Data)
+	return buf, nil
+}
+
+// decodeFrame decodes the frame encoded by encodeFrame, the checksum is
+// verified.
+func decodeFrame(data []byte) (StreamFrame, error) {
+	if len(data) < frameHeaderSize ||
+		int(binary.BigEndian.Uint32(data)) != len(data)-frameHeaderSize {
+		return StreamFrame{}, errors.Wrapf(ErrInvalidStream, "invalid frame size %d", len(data))
+	}
+	return parseFrame(data[:frameHeaderSize], data[frameHeaderSize:])
+}
+
+func invalidStream(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errors.Wrapf(ErrInvalidStream, "%v", err)
+}
@@ -0,0 +1,153 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestBatchRepr(seq uint64, count uint32, data string) []byte {
+	repr := make([]byte, batchHeaderSize, batchHeaderSize+len(data))
+	binary.LittleEndian.PutUint64(repr, seq)
+	binary.LittleEndian.PutUint32(repr[8:], count)
+	return append(repr, data...)
+}
+
+func TestReplicationStreamCanBeDecoded(t *testing.T) {
+	frames := []StreamFrame{
+		{Shard: 1, Seq: 10, Committed: time.Unix(0, 100), Data: getTestBatchRepr(10, 2, "ab")},
+		{Shard: 1, Seq: 12, Committed: time.Unix(0, 200), Data: getTestBatchRepr(12, 1, "")},
+	}
+	var buf bytes.Buffer
+	e, err := NewStreamEncoder(&buf)
+	require.NoError(t, err)
+	for _, f := range frames {
+		require.NoError(t, e.Encode(f))
+	}
+	require.Error(t, e.Encode(StreamFrame{Data: []byte("short")}))
+	require.NoError(t, e.Flush())
+	data := buf.Bytes()
+
+	d, err := NewStreamDecoder(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, ReplicationStreamVersion, d.Version)
+	for _, expected := range frames {
+		f, err := d.Decode()
+		require.NoError(t, err)
+		require.Equal(t, expected.Shard, f.Shard)
+		require.Equal(t, expected.Seq, f.Seq)
+		require.True(t, expected.Committed.Equal(f.Committed))
+		require.Equal(t, expected.Data, f.Data)
+	}
+	require.Equal(t, uint32(2), frames[0].Count())
+	_, err = d.Decode()
+	require.Equal(t, io.EOF, err)
+
+	for _, corrupted := range [][]byte{
+		data[:len(data)-1],
+		append([]byte{'X'}, data[1:]...),
+		append(append([]byte(nil), data[:len(data)-1]...), data[len(data)-1]^0xFF),
+	} {
+		d, err := NewStreamDecoder(bytes.NewReader(corrupted))
+		if err == nil {
+			for err == nil {
+				_, err = d.Decode()
+			}
+		}
+		require.True(t, errors.Is(err, ErrInvalidStream))
+	}
+	unknown := append([]byte(nil), data...)
+	unknown[11] = 2
+	_, err = NewStreamDecoder(bytes.NewReader(unknown))
+	require.True(t, errors.Is(err, ErrInvalidStream))
+
+	// frames above the limit are rejected
+	d, err = NewStreamDecoder(bytes.NewReader(data))
+	require.NoError(t, err)
+	d.MaxFrameSize = framePayloadFixedSize + batchHeaderSize + 1
+	_, err = d.Decode()
+	require.True(t, errors.Is(err, ErrInvalidStream))
+}
+
+// TestReplicationStreamFormatIsStable makes sure the encoding does not
+// change, existing readers of the stream depend on it.
+func TestReplicationStreamFormatIsStable(t *testing.T) {
+	var buf bytes.Buffer
+	e, err := NewStreamEncoder(&buf)
+	require.NoError(t, err)
+	require.NoError(t, e.Encode(StreamFrame{Shard: 3, Seq: 7,
+		Committed: time.Unix(0, 1), Data: getTestBatchRepr(7, 1, "x")}))
+	require.NoError(t, e.Flush())
+	require.Equal(t, "5447425245504c0000000001"+
+		"00000025"+"8234e7b2"+
+		"0000000000000003"+"0000000000000007"+"0000000000000001"+
+		"0700000000000000"+"01000000"+"78", hex.EncodeToString(buf.Bytes()))
+}
+
+func TestLegacySegmentsCanBeDecoded(t *testing.T) {
+	var buf bytes.Buffer
+	rw, err := newRecordWriter(&buf, legacySegmentFormat)
+	require.NoError(t, err)
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, 5)
+	binary.BigEndian.PutUint64(key[8:], 100)
+	repr := getTestBatchRepr(5, 1, "a")
+	require.NoError(t, rw.write(key, repr))
+	require.NoError(t, rw.finish())
+	batches, err := DecodeSegment(buf.Bytes())
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, uint64(5), batches[0].Seq)
+	require.Equal(t, repr, batches[0].Data)
+}
+
+func TestUpdateBatchCanBeDecoded(t *testing.T) {
+	ud := pb.Update{
+		ClusterID: 2,
+		NodeID:    3,
+		State:     pb.State{Term: 5, Vote: 3, Commit: 11},
+		Snapshot:  pb.Snapshot{Index: 9, Term: 4},
+		EntriesToSave: []pb.Entry{
+			{Index: 10, Term: 5, Cmd: []byte("a")},
+			{Index: 11, Term: 5, Cmd: []byte("b")},
+		},
+	}
+	data, err := EncodeUpdateBatch(ud)
+	require.NoError(t, err)
+	decoded, err := DecodeUpdateBatch(data)
+	require.NoError(t, err)
+	require.Equal(t, ud, decoded)
+	f, err := decodeFrame(mustEncodeFrame(t, StreamFrame{Shard: 1, Seq: 11, Data: data}))
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), f.Count())
+	_, err = EncodeUpdateBatch(pb.Update{ClusterID: 2, NodeID: 3})
+	require.Error(t, err)
+
+	// records of other nodes and other records are rejected
+	k := newKey(maxKeySize, nil)
+	for _, set := range []func(){
+		func() { k.SetEntryKey(2, 4, 12) },
+		func() { k.SetMaxIndexKey(2, 3) },
+	} {
+		wb := new(pebble.Batch)
+		require.NoError(t, wb.SetRepr(append([]byte(nil), data...)))
+		set()
+		require.NoError(t, wb.Set(k.Key(), pb.MustMarshal(&pb.Entry{Index: 12}), nil))
+		_, err = DecodeUpdateBatch(wb.Repr())
+		require.True(t, errors.Is(err, ErrInvalidStream))
+	}
+}
+
+func mustEncodeFrame(t *testing.T, f StreamFrame) []byte {
+	frame, err := encodeFrame(f)
+	require.NoError(t, err)
+	return frame
+}
@@ -0,0 +1,308 @@
+package pebble
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble/invariants"
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidResumeToken indicates that a resume token is malformed or was
+// returned by a different kind of scan.
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// ScanBudget limits the work done by a single call of a resumable scan. The
+// scan stops at the first position it can be resumed from once the number of
+// scanned bytes or the elapsed time reaches its limit, zero values mean no
+// limit. At least one record or node is always processed by each call.
+type ScanBudget struct {
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// ResumeToken is an opaque position returned by a resumable scan when its
+// budget was exhausted before the scan completed. Passing it to the same scan
+// continues from that position without rescanning the processed records. It
+// is a stable position in the key space, tokens remain valid across restarts
+// of the LogDB as long as the number of shards is not changed. Records
+// written or removed before the position after the token was returned are not
+// seen by the resumed scan.
+type ResumeToken []byte
+
+type scanKind string
+
+const (
+	verifyScan         scanKind = "verify"
+	exportMetadataScan scanKind = "export-metadata"
+	janitorScan        scanKind = "janitor"
+)
+
+const resumeTokenVersion = 1
+
+type resumeNode struct {
+	ClusterID uint64
+	NodeID    uint64
+	Records   invariants.Records
+}
+
+// resumeState is the content of a ResumeToken.
+type resumeState struct {
+	Version int
+	Scan    scanKind
+	Shard   uint64
+	// Key is the first key to scan in the shard.
+	Key []byte `json:",omitempty"`
+	// Node is the first node to process in the shard.
+	Node raftio.NodeInfo
+	// Nodes are the records of the nodes partially verified in the shard.
+	Nodes []resumeNode `json:",omitempty"`
+}
+
+func decodeResumeToken(token ResumeToken, scan scanKind) (resumeState, error) {
+	if len(token) == 0 {
+		return resumeState{Version: resumeTokenVersion, Scan: scan}, nil
+	}
+	var st resumeState
+	if err := json.Unmarshal(token, &st); err != nil {
+		return resumeState{}, errors.Wrapf(ErrInvalidResumeToken, "%v", err)
+	}
+	if st.Version != resumeTokenVersion {
+		return resumeState{}, errors.Wrapf(ErrInvalidResumeToken,
+			"unsupported version %d", st.Version)
+	}
+	if st.Scan != scan {
+		return resumeState{}, errors.Wrapf(ErrInvalidResumeToken,
+			"token of %s scan used for %s scan", st.Scan, scan)
+	}
+	return st, nil
+}
+
+func (st resumeState) encode() (ResumeToken, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+func (st resumeState) nodes() map[raftio.NodeInfo]*invariants.Records {
+	nodes := make(map[raftio.NodeInfo]*invariants.Records)
+	for i := range st.Nodes {
+		n := st.Nodes[i]
+		nodes[raftio.GetNodeInfo(n.ClusterID, n.NodeID)] = &n.Records
+	}
+	return nodes
+}
+
+func (st *resumeState) setNodes(nodes map[raftio.NodeInfo]*invariants.Records) {
+	st.Nodes = make([]resumeNode, 0, len(nodes))
+	for k, n := range nodes {
+		st.Nodes = append(st.Nodes, resumeNode{
+			ClusterID: k.ClusterID,
+			NodeID:    k.NodeID,
+			Records:   *n,
+		})
+	}
+}
+
+type scanBudget struct {
+	limit ScanBudget
+	start time.Time
+	bytes uint64
+}
+
+func newScanBudget(limit ScanBudget) *scanBudget {
+	return &scanBudget{limit: limit, start: time.Now()}
+}
+
+// consume accounts n scanned bytes and returns a boolean value indicating
+// whether the budget has been exhausted.
+func (b *scanBudget) consume(n uint64) bool {
+	if b == nil {
+		return false
+	}
+	b.bytes += n
+	if b.limit.Bytes > 0 && b.bytes >= b.limit.Bytes {
+		return true
+	}
+	return b.limit.Duration > 0 && time.Since(b.start) >= b.limit.Duration
+}
+
+// keySuccessor returns the smallest key greater than the specified key.
+func keySuccessor(key []byte) []byte {
+	next := make([]byte, len(key)+1)
+	copy(next, key)
+	return next
+}
+
+// VerifyResumable is similar to Verify, but it stops once the budget is
+// exhausted and returns a token to continue the verification from. A nil
+// token starts the verification, a nil token is returned once it completes.
+// The returned report only covers the records scanned by the call, node
+// invariants are reported by the call completing the scan of their shard.
+func (s *ShardedDB) VerifyResumable(token ResumeToken,
+	budget ScanBudget) (VerifyReport, ResumeToken, error) {
+	if s.hasSegmentedEntries() {
+		return VerifyReport{}, nil, errors.WithStack(ErrSegmentedEntries)
+	}
+	st, err := decodeResumeToken(token, verifyScan)
+	if err != nil {
+		return VerifyReport{}, nil, err
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return VerifyReport{}, nil, err
+	}
+	if st.Shard >= uint64(len(shards)) {
+		return VerifyReport{}, nil, errors.Wrapf(ErrInvalidResumeToken,
+			"shard %d not found", st.Shard)
+	}
+	b := newScanBudget(budget)
+	report := VerifyReport{}
+	key := st.Key
+	nodes := st.nodes()
+	for i := st.Shard; i < uint64(len(shards)); i++ {
+		next, err := shards[i].verifyFrom(i, key, nodes, &report, b)
+		if err != nil {
+			return VerifyReport{}, nil, err
+		}
+		if next != nil {
+			rs := resumeState{
+				Version: resumeTokenVersion,
+				Scan:    verifyScan,
+				Shard:   i,
+				Key:     next,
+			}
+			rs.setNodes(nodes)
+			t, err := rs.encode()
+			return report, t, err
+		}
+		report.Shards++
+		key = nil
+		nodes = make(map[raftio.NodeInfo]*invariants.Records)
+	}
+	return report, nil, nil
+}
+
+// ExportMetadataResumable is similar to ExportMetadata, but it stops once the
+// budget is exhausted and returns a token to continue the export from. A nil
+// token starts the export, a nil token is returned once it completes. Each
+// call writes a complete stream to w that can be imported on its own by the
+// ImportMetadata method.
+func (s *ShardedDB) ExportMetadataResumable(w io.Writer,
+	token ResumeToken, budget ScanBudget) (uint64, ResumeToken, error) {
+	st, err := decodeResumeToken(token, exportMetadataScan)
+	if err != nil {
+		return 0, nil, err
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return 0, nil, err
+	}
+	if st.Shard >= uint64(len(shards)) {
+		return 0, nil, errors.Wrapf(ErrInvalidResumeToken,
+			"shard %d not found", st.Shard)
+	}
+	rw, err := newRecordWriter(w, metadataFormat)
+	if err != nil {
+		return 0, nil, err
+	}
+	b := newScanBudget(budget)
+	count := uint64(0)
+	var next []byte
+	op := func(key []byte, data []byte) (bool, error) {
+		if err := rw.write(key, data); err != nil {
+			return false, err
+		}
+		count++
+		if b.consume(uint64(len(key) + len(data))) {
+			next = keySuccessor(key)
+			return false, nil
+		}
+		return true, nil
+	}
+	key := st.Key
+	for i := st.Shard; i < uint64(len(shards)); i++ {
+		if err := shards[i].iterateMetadataFrom(key, op); err != nil {
+			return 0, nil, errors.WithStack(err)
+		}
+		if next != nil {
+			if err := rw.finish(); err != nil {
+				return 0, nil, err
+			}
+			rs := resumeState{
+				Version: resumeTokenVersion,
+				Scan:    exportMetadataScan,
+				Shard:   i,
+				Key:     next,
+			}
+			t, err := rs.encode()
+			return count, t, err
+		}
+		key = nil
+	}
+	return count, nil, rw.finish()
+}
+
+// RunJanitorResumable is similar to RunJanitor, but it stops once the budget
+// is exhausted and returns a token to continue from. The bytes of the budget
+// are the estimated disk usage of the removed entries. A nil token starts the
+// run, a nil token is returned once it completes.
+func (s *ShardedDB) RunJanitorResumable(token ResumeToken,
+	budget ScanBudget) (int, ResumeToken, error) {
+	st, err := decodeResumeToken(token, janitorScan)
+	if err != nil {
+		return 0, nil, err
+	}
+	shards := s.openedShards()
+	if st.Shard >= uint64(len(shards)) {
+		return 0, nil, errors.Wrapf(ErrInvalidResumeToken,
+			"shard %d not found", st.Shard)
+	}
+	b := newScanBudget(budget)
+	trimmed := 0
+	start := st.Node
+	for i := st.Shard; i < uint64(len(shards)); i++ {
+		shard := shards[i]
+		if shard == nil {
+			start = raftio.NodeInfo{}
+			continue
+		}
+		ni, err := shard.listNodeInfo()
+		if err != nil {
+			return trimmed, nil, errors.WithStack(err)
+		}
+		for j, n := range ni {
+			if nodeInfoLess(n, start) {
+				continue
+			}
+			ok, size, err := s.trimNode(shard, n)
+			if err != nil {
+				return trimmed, nil, err
+			}
+			if ok {
+				trimmed++
+			}
+			if !b.consume(size) {
+				continue
+			}
+			rs := resumeState{
+				Version: resumeTokenVersion,
+				Scan:    janitorScan,
+				Shard:   i,
+			}
+			if j+1 < len(ni) {
+				rs.Node = ni[j+1]
+			} else if rs.Shard++; rs.Shard == uint64(len(shards)) {
+				return trimmed, nil, nil
+			}
+			t, err := rs.encode()
+			return trimmed, t, err
+		}
+		start = raftio.NodeInfo{}
+	}
+	return trimmed, nil, nil
+}
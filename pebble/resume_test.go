@@ -0,0 +1,134 @@
+package pebble
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCanBeResumedAfterRestart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 3, 4, 20)
+	expected, err := db.Verify()
+	require.NoError(t, err)
+	require.True(t, expected.OK())
+	budget := ScanBudget{Bytes: 1}
+	report, token, err := db.VerifyResumable(nil, budget)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	require.Equal(t, uint64(1), report.Records)
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, dirs, dirs, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	calls := 1
+	for token != nil {
+		var r VerifyReport
+		r, token, err = db.VerifyResumable(token, budget)
+		require.NoError(t, err)
+		report.Shards += r.Shards
+		report.Nodes += r.Nodes
+		report.Records += r.Records
+		report.Entries += r.Entries
+		report.Violations = append(report.Violations, r.Violations...)
+		calls++
+	}
+	require.Equal(t, expected, report)
+	require.GreaterOrEqual(t, uint64(calls), expected.Records)
+	_, _, err = db.RunJanitorResumable(ResumeToken("{}"), budget)
+	require.ErrorIs(t, err, ErrInvalidResumeToken)
+}
+
+func TestMetadataExportCanBeResumed(t *testing.T) {
+	var chunks [][]byte
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 3, 4, 20)
+		var token ResumeToken
+		total := uint64(0)
+		for {
+			var buf bytes.Buffer
+			count, next, err := sdb.ExportMetadataResumable(&buf,
+				token, ScanBudget{Bytes: 1})
+			require.NoError(t, err)
+			total += count
+			chunks = append(chunks, buf.Bytes())
+			if next == nil {
+				break
+			}
+			token = next
+		}
+		// bootstrap, state and max index for both nodes
+		require.Equal(t, uint64(6), total)
+		_, _, err := sdb.VerifyResumable(token, ScanBudget{})
+		require.ErrorIs(t, err, ErrInvalidResumeToken)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+	tf = func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		for _, c := range chunks {
+			require.NoError(t, sdb.ImportMetadata(bytes.NewReader(c)))
+		}
+		states, err := sdb.DumpStates()
+		require.NoError(t, err)
+		require.Len(t, states, 2)
+		require.Equal(t, uint64(2), states[0].State.Vote)
+		require.Equal(t, uint64(2), states[1].State.Vote)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestJanitorCanBeResumed(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		sdb.config.JanitorRetainedEntries = 10
+		for _, cid := range []uint64{1, 3, 5} {
+			saveTestNode(t, sdb, cid, 2, 100)
+			require.NoError(t, db.SaveSnapshots([]pb.Update{{
+				ClusterID: cid,
+				NodeID:    2,
+				Snapshot:  pb.Snapshot{Index: 60, Term: 1},
+			}}))
+		}
+		var token ResumeToken
+		total := 0
+		calls := 0
+		for {
+			trimmed, next, err := sdb.RunJanitorResumable(token,
+				ScanBudget{Duration: time.Nanosecond})
+			require.NoError(t, err)
+			total += trimmed
+			calls++
+			if next == nil {
+				break
+			}
+			token = next
+		}
+		require.Equal(t, 3, total)
+		require.Greater(t, calls, 1)
+		for _, cid := range []uint64{1, 3, 5} {
+			ents, _, err := db.IterateEntries(nil, 0, cid, 2, 1, 101, math.MaxUint64)
+			require.NoError(t, err)
+			require.Empty(t, ents)
+		}
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,325 @@
+package pebble
+
+import (
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/goutils/syncutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	checkpointDirPrefix      = "checkpoint-"
+	latestCheckpointFilename = "LATEST"
+	latestCheckpointTmpName  = "LATEST.tmp"
+	secondaryCopyDirPrefix   = "secondary-"
+	// retainedCheckpoints is the number of published checkpoints kept, older
+	// ones are removed.
+	retainedCheckpoints = 2
+)
+
+// ErrNoCheckpoint indicates that no checkpoint has been published yet.
+var ErrNoCheckpoint = errors.New("no published checkpoint")
+
+func checkpointDirName(gen uint64) string {
+	return fmt.Sprintf("%s%020d", checkpointDirPrefix, gen)
+}
+
+func parseCheckpointDirName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, checkpointDirPrefix) {
+		return 0, false
+	}
+	var gen uint64
+	if _, err := fmt.Sscanf(name[len(checkpointDirPrefix):], "%d", &gen); err != nil {
+		return 0, false
+	}
+	return gen, true
+}
+
+// PublishCheckpoints starts periodically publishing point in time copies of
+// the LogDB into the specified dir, one is published immediately. Secondaries
+// opened by OpenSecondary, e.g. in backup agents or inspection tools running
+// in other processes, follow the published checkpoints while the ShardedDB
+// keeps being written. Publishing stops once the ShardedDB is closed.
+func (s *ShardedDB) PublishCheckpoints(dir string, interval time.Duration) error {
+	if s.hasSegmentedEntries() {
+		return errors.WithStack(ErrSegmentedEntries)
+	}
+	if s.config.ReadOnly {
+		return errors.New("can not publish checkpoints in read-only mode")
+	}
+	if interval <= 0 {
+		return errors.Errorf("invalid checkpoint interval %v", interval)
+	}
+	fs := s.config.FS
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
+	}
+	gen, err := latestCheckpoint(dir, fs)
+	if err != nil && !errors.Is(err, ErrNoCheckpoint) {
+		return err
+	}
+	if err := s.publishCheckpoint(dir, gen+1); err != nil {
+		return err
+	}
+	gen++
+	work := func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopper.ShouldStop():
+				return
+			case <-ticker.C:
+				if err := s.publishCheckpoint(dir, gen+1); err != nil {
+					plog.Errorf("failed to publish checkpoint: %v", err)
+					continue
+				}
+				gen++
+			}
+		}
+	}
+	s.stopper.RunWorker(func() {
+		withLabels("checkpoint-publisher", work)
+	})
+	return nil
+}
+
+// publishCheckpoint creates the checkpoint of the specified generation, makes
+// it the latest and removes older checkpoints no longer retained.
+func (s *ShardedDB) publishCheckpoint(dir string, gen uint64) error {
+	fs := s.config.FS
+	target := fs.PathJoin(dir, checkpointDirName(gen))
+	if err := fs.RemoveAll(target); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := s.Backup(target); err != nil {
+		return err
+	}
+	if err := saveLatestCheckpoint(dir, gen, fs); err != nil {
+		return err
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, n := range names {
+		// the previous checkpoint is retained for secondaries still copying it
+		if g, ok := parseCheckpointDirName(n); ok && g+retainedCheckpoints <= gen {
+			if err := fs.RemoveAll(fs.PathJoin(dir, n)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+func saveLatestCheckpoint(dir string, gen uint64, fs vfs.FS) (err error) {
+	tmp := fs.PathJoin(dir, latestCheckpointTmpName)
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write([]byte(checkpointDirName(gen))); err != nil {
+		return firstError(errors.WithStack(err), f.Close())
+	}
+	if err := firstError(f.Sync(), f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fs.Rename(tmp, fs.PathJoin(dir, latestCheckpointFilename)); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// latestCheckpoint returns the generation of the latest checkpoint published
+// in dir.
+func latestCheckpoint(dir string, fs vfs.FS) (gen uint64, err error) {
+	f, err := fs.Open(fs.PathJoin(dir, latestCheckpointFilename))
+	if err != nil {
+		if errors.Is(err, iofs.ErrNotExist) {
+			return 0, errors.Wrapf(ErrNoCheckpoint, "%s", dir)
+		}
+		return 0, errors.WithStack(err)
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	gen, ok := parseCheckpointDirName(string(data))
+	if !ok {
+		return 0, errors.Errorf("invalid latest checkpoint %q", data)
+	}
+	return gen, nil
+}
+
+// Secondary is a read-only view of a LogDB written by another ShardedDB
+// instance, possibly in another process, following the checkpoints published
+// by the ShardedDB.PublishCheckpoints method. Each refresh copies the latest
+// checkpoint into the private scratch dir of the secondary, hard linking
+// files where possible, and opens the copy in read-only mode.
+type Secondary struct {
+	config     LogDBConfig
+	dir        string
+	scratchDir string
+	stopper    *syncutil.Stopper
+	// refreshMu serializes refreshes
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	db        *ShardedDB
+	gen       uint64
+	copyDir   string
+}
+
+// OpenSecondary opens the latest checkpoint published in dir. The scratchDir
+// is owned by the secondary, its existing content is removed. A non zero
+// refresh interval enables refreshing the secondary in the background, Refresh
+// can be used to refresh it on demand.
+func OpenSecondary(config LogDBConfig, dir string,
+	scratchDir string, refresh time.Duration) (*Secondary, error) {
+	fs := config.FS
+	config.ReadOnly = true
+	config.MirrorDir = ""
+	if err := fs.RemoveAll(scratchDir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := fileutil.MkdirAll(scratchDir, fs); err != nil {
+		return nil, err
+	}
+	s := &Secondary{
+		config:     config,
+		dir:        dir,
+		scratchDir: scratchDir,
+		stopper:    syncutil.NewStopper(),
+	}
+	if _, err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		work := func() {
+			ticker := time.NewTicker(refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.stopper.ShouldStop():
+					return
+				case <-ticker.C:
+					if _, err := s.Refresh(); err != nil {
+						plog.Errorf("failed to refresh secondary: %v", err)
+					}
+				}
+			}
+		}
+		s.stopper.RunWorker(func() {
+			withLabels("secondary-refresh", work)
+		})
+	}
+	return s, nil
+}
+
+// Refresh switches the secondary to the latest published checkpoint, it
+// returns a boolean value indicating whether a newer checkpoint was found. The
+// secondary keeps using the current checkpoint when the refresh fails.
+func (s *Secondary) Refresh() (bool, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	fs := s.config.FS
+	gen, err := latestCheckpoint(s.dir, fs)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	current := s.gen
+	s.mu.RUnlock()
+	if gen <= current {
+		return false, nil
+	}
+	copyDir := fs.PathJoin(s.scratchDir,
+		fmt.Sprintf("%s%020d", secondaryCopyDirPrefix, gen))
+	src := fs.PathJoin(s.dir, checkpointDirName(gen))
+	db, err := s.open(src, copyDir)
+	if err != nil {
+		return false, firstError(err, fs.RemoveAll(copyDir))
+	}
+	s.mu.Lock()
+	old, oldDir := s.db, s.copyDir
+	s.db, s.gen, s.copyDir = db, gen, copyDir
+	s.mu.Unlock()
+	if old != nil {
+		// views hold the read lock, the old db is no longer used once swapped
+		if err := old.Close(); err != nil {
+			return true, err
+		}
+		if err := fs.RemoveAll(oldDir); err != nil {
+			return true, errors.WithStack(err)
+		}
+	}
+	return true, nil
+}
+
+func (s *Secondary) open(src string, copyDir string) (*ShardedDB, error) {
+	fs := s.config.FS
+	m, err := VerifyBackup(src, fs)
+	if err != nil {
+		return nil, err
+	}
+	if m.Shards != s.config.Shards {
+		return nil, errors.Errorf("checkpoint has %d shards, but configured to have %d",
+			m.Shards, s.config.Shards)
+	}
+	for i := uint64(0); i < m.Shards; i++ {
+		if err := fileutil.MkdirAll(fs.PathJoin(copyDir, shardDirName(i)), fs); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.Files {
+		if err := vfs.LinkOrCopy(fs,
+			fs.PathJoin(src, f.Name), fs.PathJoin(copyDir, f.Name)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return NewLogDB(s.config, nil, []string{copyDir}, nil, CheckNone)
+}
+
+// Generation returns the generation of the checkpoint currently used.
+func (s *Secondary) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gen
+}
+
+// View calls f with the read-only ShardedDB opened from the current
+// checkpoint. The ShardedDB must not be used once f returns, refreshes are
+// blocked while f is running.
+func (s *Secondary) View(f func(db *ShardedDB) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return errors.New("secondary closed")
+	}
+	return f(s.db)
+}
+
+// Close closes the secondary and removes its copy of the checkpoint.
+func (s *Secondary) Close() (err error) {
+	s.stopper.Stop()
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err = s.db.Close()
+	s.db = nil
+	return firstError(err, s.config.FS.RemoveAll(s.copyDir))
+}
@@ -0,0 +1,109 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondaryFollowsPublishedCheckpoints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 2
+	_, err := OpenSecondary(cfg, "checkpoints", "scratch", 0)
+	require.True(t, errors.Is(err, ErrNoCheckpoint))
+	db, err := NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 1, 10)
+	require.NoError(t, db.PublishCheckpoints("checkpoints", time.Hour))
+	// two secondaries of the same checkpoints
+	sec1, err := OpenSecondary(cfg, "checkpoints", "scratch1", 0)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, sec1.Close())
+	}()
+	sec2, err := OpenSecondary(cfg, "checkpoints", "scratch2", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), sec1.Generation())
+	entryCount := func(sec *Secondary, clusterID uint64) (count uint64) {
+		require.NoError(t, sec.View(func(db *ShardedDB) error {
+			rs, err := db.ReadRaftState(clusterID, 1, 0)
+			count = rs.EntryCount
+			return err
+		}))
+		return count
+	}
+	require.Equal(t, uint64(10), entryCount(sec1, 1))
+	require.Equal(t, uint64(10), entryCount(sec2, 1))
+	// secondaries are read-only
+	require.Error(t, sec1.View(func(db *ShardedDB) error {
+		return db.RemoveNodeData(1, 1)
+	}))
+	require.NoError(t, sec2.Close())
+	require.Error(t, sec2.View(func(db *ShardedDB) error { return nil }))
+
+	// the primary keeps writing, secondaries see the writes once refreshed
+	saveTestNode(t, db, 2, 1, 20)
+	refreshed, err := sec1.Refresh()
+	require.NoError(t, err)
+	require.False(t, refreshed)
+	for gen := uint64(2); gen <= 4; gen++ {
+		require.NoError(t, db.publishCheckpoint("checkpoints", gen))
+	}
+	refreshed, err = sec1.Refresh()
+	require.NoError(t, err)
+	require.True(t, refreshed)
+	require.Equal(t, uint64(4), sec1.Generation())
+	require.Equal(t, uint64(20), entryCount(sec1, 2))
+	// only the latest checkpoints are retained
+	names, err := fs.List("checkpoints")
+	require.NoError(t, err)
+	var retained []uint64
+	for _, n := range names {
+		if gen, ok := parseCheckpointDirName(n); ok {
+			retained = append(retained, gen)
+		}
+	}
+	require.ElementsMatch(t, []uint64{3, 4}, retained)
+	names, err = fs.List("scratch1")
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+}
+
+func TestSecondaryRefreshesInBackground(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	db, err := NewLogDB(cfg, nil, []string{"primary"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.PublishCheckpoints("checkpoints", 10*time.Millisecond))
+	sec, err := OpenSecondary(cfg, "checkpoints", "scratch", 10*time.Millisecond)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, sec.Close())
+	}()
+	saveTestNode(t, db, 1, 1, 10)
+	require.Eventually(t, func() bool {
+		found := false
+		require.NoError(t, sec.View(func(db *ShardedDB) error {
+			rs, err := db.ReadRaftState(1, 1, 0)
+			found = err == nil && rs.EntryCount == 10
+			return nil
+		}))
+		return found
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,299 @@
+package pebble
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/logdb"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SegmentedEngine is the name of the storage engine implemented by
+	// SegmentedDB.
+	SegmentedEngine = "segmented"
+	segmentsDirName = "segments"
+)
+
+func init() {
+	RegisterEngine(segmentedFactory{})
+}
+
+// SegmentedDB is a LogDB storing the entries of each node in append-only
+// segment files, only the bootstrap records, raft states and snapshots are
+// stored in pebble. Entries are written once and removed by deleting whole
+// segment files, instead of being rewritten by compactions, which
+// significantly reduces the write amplification of workloads appending
+// entries and regularly removing them once covered by snapshots. The index of
+// each segment is kept in memory and rebuilt by scanning the segments of a
+// node when it is first accessed after opening the LogDB.
+//
+// Segments are kept in the segments directory of the first low latency
+// directory, or of the first directory when no low latency directories are
+// specified. Entries below the index passed to RemoveEntriesTo may become
+// readable again after reopening the LogDB until their segment is removed,
+// readers are expected to start at the snapshot index of the node. Select it
+// using LogDBConfig.Engine and OpenLogDB.
+type SegmentedDB struct {
+	meta *ShardedDB
+	logs *nodeLogs
+}
+
+var _ raftio.ILogDB = (*SegmentedDB)(nil)
+
+// OpenSegmentedDB creates a SegmentedDB instance.
+func OpenSegmentedDB(config LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (*SegmentedDB, error) {
+	fs := config.FS
+	segDirs := dirs
+	if len(lldirs) > 0 {
+		segDirs = lldirs
+	}
+	dir := fs.PathJoin(NamespaceDirs(segDirs, config.Namespace, fs)[0],
+		segmentsDirName)
+	if !config.ReadOnly {
+		if err := fileutil.MkdirAll(dir, fs); err != nil {
+			return nil, err
+		}
+	}
+	metaConfig := config
+	metaConfig.Engine = ""
+	metaConfig.SegmentedEntries = false
+	meta, err := NewLogDB(metaConfig, callback, dirs, lldirs, CheckNone)
+	if err != nil {
+		return nil, err
+	}
+	return &SegmentedDB{
+		meta: meta,
+		logs: newNodeLogs(fs, dir, config),
+	}, nil
+}
+
+// Meta returns the ShardedDB storing the bootstrap records, raft states and
+// snapshots of the nodes, e.g. to use its maintenance APIs. It holds no
+// entries.
+func (s *SegmentedDB) Meta() *ShardedDB {
+	return s.meta
+}
+
+// Name returns the type name of the instance.
+func (s *SegmentedDB) Name() string {
+	return fmt.Sprintf("%s-%s", SegmentedEngine, s.meta.Name())
+}
+
+// Close closes the SegmentedDB instance.
+func (s *SegmentedDB) Close() error {
+	s.logs.close()
+	return s.meta.Close()
+}
+
+// BinaryFormat is the binary format supported by the SegmentedDB.
+func (s *SegmentedDB) BinaryFormat() uint32 {
+	return s.meta.BinaryFormat()
+}
+
+// ListNodeInfo lists all available NodeInfo found in the log db.
+func (s *SegmentedDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	return s.meta.ListNodeInfo()
+}
+
+// SaveBootstrapInfo saves the specified bootstrap info for the given node.
+func (s *SegmentedDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	return s.meta.SaveBootstrapInfo(clusterID, nodeID, bootstrap)
+}
+
+// GetBootstrapInfo returns the saved bootstrap info for the given node.
+func (s *SegmentedDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	return s.meta.GetBootstrapInfo(clusterID, nodeID)
+}
+
+// SaveRaftState saves the raft state and logs found in the raft.Update list
+// to the log db. Entries are appended to the segments of all nodes, the
+// segments are then synced concurrently before the raft states are saved
+// together with the max index of each node. Entries are only visible up to
+// the saved max index, entries appended by a save that failed to complete
+// are ignored until they are overwritten.
+func (s *SegmentedDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	meta := make([]pb.Update, 0, len(updates))
+	maxIndexes := make([]uint64, 0, len(updates))
+	written := make([]*nodeLog, 0, len(updates))
+	for _, ud := range updates {
+		mi := uint64(0)
+		if len(ud.EntriesToSave) > 0 {
+			l, err := s.logs.get(ud.ClusterID, ud.NodeID, true)
+			if err != nil {
+				return err
+			}
+			if err := l.write(ud.EntriesToSave); err != nil {
+				return err
+			}
+			written = append(written, l)
+			mi = ud.EntriesToSave[len(ud.EntriesToSave)-1].Index
+		}
+		ud.EntriesToSave = nil
+		meta = append(meta, ud)
+		maxIndexes = append(maxIndexes, mi)
+	}
+	if err := syncNodeLogs(written); err != nil {
+		return err
+	}
+	return s.meta.saveMaxIndexes(meta, maxIndexes, shardID)
+}
+
+// syncNodeLogs syncs the written logs concurrently, so a batch of updates of
+// many nodes waits for about a single sync.
+func syncNodeLogs(logs []*nodeLog) error {
+	if len(logs) == 1 {
+		return logs[0].sync()
+	}
+	errs := make([]error, len(logs))
+	var wg sync.WaitGroup
+	for i, l := range logs {
+		wg.Add(1)
+		go func(i int, l *nodeLog) {
+			defer wg.Done()
+			errs[i] = l.sync()
+		}(i, l)
+	}
+	wg.Wait()
+	var err error
+	for _, e := range errs {
+		err = firstError(err, e)
+	}
+	return err
+}
+
+// IterateEntries returns a list of saved entries starting with index low up to
+// index high with a max size of maxSize.
+func (s *SegmentedDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	maxIndex, err := s.maxIndex(clusterID, nodeID)
+	if err != nil {
+		return nil, 0, err
+	}
+	l, err := s.logs.get(clusterID, nodeID, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l == nil {
+		return ents, size, nil
+	}
+	if high > maxIndex+1 {
+		high = maxIndex + 1
+	}
+	return l.iterate(ents, size, low, high, maxSize)
+}
+
+// ReadRaftState returns the persistent state of the specified raft node.
+func (s *SegmentedDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	shard, err := s.meta.shard(s.meta.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	state, err := shard.getState(clusterID, nodeID)
+	if err != nil {
+		return raftio.RaftState{}, errors.WithStack(err)
+	}
+	rs := raftio.RaftState{State: state, FirstIndex: lastIndex}
+	maxIndex, err := s.maxIndex(clusterID, nodeID)
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	l, err := s.logs.get(clusterID, nodeID, false)
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	if l != nil {
+		rs.FirstIndex, rs.EntryCount = l.rangeFrom(lastIndex, maxIndex)
+	}
+	return rs, nil
+}
+
+// maxIndex returns the max index of the node saved with its raft state, it
+// is 0 when the node has no saved entry.
+func (s *SegmentedDB) maxIndex(clusterID uint64, nodeID uint64) (uint64, error) {
+	shard, err := s.meta.shard(s.meta.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return 0, err
+	}
+	maxIndex, err := shard.getMaxIndex(clusterID, nodeID)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return 0, nil
+	}
+	return maxIndex, errors.WithStack(err)
+}
+
+// RemoveEntriesTo removes entries associated with the specified raft node up
+// to the specified index. Segments with no entries left are removed
+// immediately.
+func (s *SegmentedDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	l, err := s.logs.get(clusterID, nodeID, false)
+	if err != nil || l == nil {
+		return err
+	}
+	return l.removeTo(index)
+}
+
+// CompactEntriesTo has nothing to reclaim as segments are removed by
+// RemoveEntriesTo, the returned channel is closed.
+func (s *SegmentedDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	close(done)
+	return done, nil
+}
+
+// SaveSnapshots saves all snapshot metadata found in the raft.Update list.
+func (s *SegmentedDB) SaveSnapshots(updates []pb.Update) error {
+	return s.meta.SaveSnapshots(updates)
+}
+
+// GetSnapshot returns the most recent snapshot associated with the specified
+// cluster.
+func (s *SegmentedDB) GetSnapshot(clusterID uint64,
+	nodeID uint64) (pb.Snapshot, error) {
+	return s.meta.GetSnapshot(clusterID, nodeID)
+}
+
+// RemoveNodeData deletes all node data that belongs to the specified node.
+func (s *SegmentedDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	if err := s.logs.remove(clusterID, nodeID); err != nil {
+		return err
+	}
+	return s.meta.RemoveNodeData(clusterID, nodeID)
+}
+
+// ImportSnapshot imports the snapshot record and other metadata records to the
+// system, existing entries of the node are removed.
+func (s *SegmentedDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	if err := s.logs.remove(ss.ClusterId, nodeID); err != nil {
+		return err
+	}
+	return s.meta.ImportSnapshot(ss, nodeID)
+}
+
+type segmentedFactory struct{}
+
+func (segmentedFactory) Create(config LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (ILogDB, error) {
+	db, err := OpenSegmentedDB(config, callback, dirs, lldirs)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (segmentedFactory) Name() string {
+	return SegmentedEngine
+}
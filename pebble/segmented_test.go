@@ -0,0 +1,154 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestSegmentedDB(t *testing.T, fs vfs.FS) *SegmentedDB {
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Engine = SegmentedEngine
+	cfg.SegmentSize = 4096
+	dirs := []string{fs.PathJoin(RDBTestDirectory, "db")}
+	lldirs := []string{fs.PathJoin(RDBTestDirectory, "wal")}
+	db, err := OpenLogDB(cfg, nil, dirs, lldirs)
+	require.NoError(t, err)
+	return db.(*SegmentedDB)
+}
+
+func TestSegmentedDBStoresEntriesInSegments(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestSegmentedDB(t, fs)
+	require.NoError(t, db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true}))
+	for i := uint64(1); i <= 100; i += 20 {
+		require.NoError(t, db.SaveRaftState([]pb.Update{{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 1, Vote: 2, Commit: i + 19},
+			EntriesToSave: segmentTestEntries(i, i+19, 1),
+		}}, 1))
+	}
+	check := func(first uint64, count uint64) {
+		rs, err := db.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), rs.State.Commit)
+		require.Equal(t, first, rs.FirstIndex)
+		require.Equal(t, count, rs.EntryCount)
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, first, 101, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, int(count))
+	}
+	check(1, 100)
+	ents, _, err := db.Meta().IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+	require.NoError(t, err)
+	require.Empty(t, ents)
+	require.NoError(t, db.RemoveEntriesTo(1, 2, 51))
+	check(51, 50)
+	require.NoError(t, db.Close())
+	db = openTestSegmentedDB(t, fs)
+	rs, err := db.ReadRaftState(1, 2, 50)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), rs.FirstIndex)
+	require.Equal(t, uint64(51), rs.EntryCount)
+	ni, err := db.ListNodeInfo()
+	require.NoError(t, err)
+	require.Equal(t, []raftio.NodeInfo{{ClusterID: 1, NodeID: 2}}, ni)
+	require.NoError(t, db.RemoveNodeData(1, 2))
+	ents, _, err = db.IterateEntries(nil, 0, 1, 2, 51, 101, math.MaxUint64)
+	require.NoError(t, err)
+	require.Empty(t, ents)
+	exist, err := fs.Stat(fs.PathJoin(db.logs.dir, nodeLogDirName(1, 2)))
+	require.Error(t, err)
+	require.Nil(t, exist)
+	require.NoError(t, db.Close())
+}
+
+func TestSegmentedDBImportSnapshotRemovesEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestSegmentedDB(t, fs)
+	require.NoError(t, db.SaveRaftState([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Vote: 2, Commit: 10},
+		EntriesToSave: segmentTestEntries(1, 10, 1),
+	}}, 1))
+	ss := pb.Snapshot{
+		ClusterId: 1,
+		Index:     20,
+		Term:      2,
+		Type:      pb.RegularStateMachine,
+		Filepath:  "f",
+	}
+	require.NoError(t, db.ImportSnapshot(ss, 2))
+	rs, err := db.ReadRaftState(1, 2, 20)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), rs.FirstIndex)
+	require.Zero(t, rs.EntryCount)
+	got, err := db.GetSnapshot(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), got.Index)
+	require.NoError(t, db.Close())
+}
+
+func TestSegmentedDBBoundsEntriesByMaxIndex(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestSegmentedDB(t, fs)
+	updates := make([]pb.Update, 0)
+	for nid := uint64(1); nid <= 4; nid++ {
+		updates = append(updates, pb.Update{
+			ClusterID:     1,
+			NodeID:        nid,
+			State:         pb.State{Term: 1, Vote: 2, Commit: 10},
+			EntriesToSave: segmentTestEntries(1, 10, 1),
+		})
+	}
+	require.NoError(t, db.SaveRaftState(updates, 1))
+	// entries written to the segment of a node by a save which did not
+	// complete are not visible
+	l, err := db.logs.get(1, 2, false)
+	require.NoError(t, err)
+	require.NoError(t, l.append(segmentTestEntries(11, 20, 1)))
+	for nid := uint64(1); nid <= 4; nid++ {
+		rs, err := db.ReadRaftState(1, nid, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), rs.FirstIndex)
+		require.Equal(t, uint64(10), rs.EntryCount)
+		ents, _, err := db.IterateEntries(nil, 0, 1, nid, 1, 21, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, 10)
+	}
+	require.NoError(t, db.Close())
+	db = openTestSegmentedDB(t, fs)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.NoError(t, db.SaveRaftState([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 2, Vote: 2, Commit: 12},
+		EntriesToSave: segmentTestEntries(11, 12, 2),
+	}}, 1))
+	rs, err = db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), rs.EntryCount)
+	ents, _, err := db.IterateEntries(nil, 0, 1, 2, 11, 21, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, ents, 2)
+	require.Equal(t, uint64(2), ents[1].Term)
+}
@@ -0,0 +1,340 @@
+package pebble
+
+import (
+	"math"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// segmentsMarkerFilename is the name of the file marking the segments
+	// directory of a shard as holding the entries of the shard, it is created
+	// once all entries were migrated into segments and removed before they
+	// are migrated back into pebble.
+	segmentsMarkerFilename = "SEGMENTED"
+	// migrationBatchSize is the number of entries written at once when
+	// migrating entries between pebble and segments.
+	migrationBatchSize = 1024
+)
+
+// ErrSegmentedEntries indicates that the requested feature can not be used
+// when entries are kept in segments, see LogDBConfig.SegmentedEntries.
+var ErrSegmentedEntries = errors.New("not supported with segmented entries")
+
+// segmentEntries is the entryManager keeping entries in the segment files of
+// each node, the max index and all other records of the nodes are kept in
+// pebble. Entries are only visible up to the max index saved in pebble, so
+// entries appended by a save that failed to commit are ignored until they
+// are overwritten.
+type segmentEntries struct {
+	plain *plainEntries
+	logs  *nodeLogs
+}
+
+var _ entryManager = (*segmentEntries)(nil)
+
+func newSegmentEntries(plain *plainEntries, logs *nodeLogs) *segmentEntries {
+	return &segmentEntries{plain: plain, logs: logs}
+}
+
+func (se *segmentEntries) binaryFormat() uint32 {
+	return raftio.PlainLogDBBinVersion
+}
+
+func (se *segmentEntries) record(wb *pebbleWriteBatch, clusterID uint64,
+	nodeID uint64, ctx IContext, entries []pb.Entry) (uint64, error) {
+	l, err := se.logs.get(clusterID, nodeID, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.append(entries); err != nil {
+		return 0, err
+	}
+	return entries[len(entries)-1].Index, nil
+}
+
+func (se *segmentEntries) iterate(arena *EntryArena,
+	ents []pb.Entry, maxIndex uint64,
+	size uint64, clusterID uint64, nodeID uint64,
+	low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
+	l, err := se.logs.get(clusterID, nodeID, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l == nil {
+		return ents, size, nil
+	}
+	if high > maxIndex+1 {
+		high = maxIndex + 1
+	}
+	return l.iterate(ents, size, low, high, maxSize)
+}
+
+func (se *segmentEntries) getRange(kvs kvReader, clusterID uint64,
+	nodeID uint64, snapshotIndex uint64, maxIndex uint64) (uint64, uint64, error) {
+	l, err := se.logs.get(clusterID, nodeID, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if l == nil {
+		return snapshotIndex, 0, nil
+	}
+	l.mu.RLock()
+	first, last, ok := l.bounds()
+	l.mu.RUnlock()
+	if !ok {
+		return snapshotIndex, 0, nil
+	}
+	if first < snapshotIndex {
+		first = snapshotIndex
+	}
+	if last > maxIndex {
+		last = maxIndex
+	}
+	if first > last {
+		return snapshotIndex, 0, nil
+	}
+	return first, last - first + 1, nil
+}
+
+// rangedOp applies op to the entry keys in pebble, there are none once the
+// entries of the shard were migrated into segments.
+func (se *segmentEntries) rangedOp(clusterID uint64,
+	nodeID uint64, index uint64, op func(*Key, *Key) error) error {
+	return se.plain.rangedOp(clusterID, nodeID, index, op)
+}
+
+func (se *segmentEntries) remove(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	if index == math.MaxUint64 {
+		return se.logs.remove(clusterID, nodeID)
+	}
+	l, err := se.logs.get(clusterID, nodeID, false)
+	if err != nil || l == nil {
+		return err
+	}
+	return l.removeTo(index)
+}
+
+func (se *segmentEntries) close() {
+	se.logs.close()
+}
+
+// hasSegmentedEntries returns a boolean value indicating whether entries of
+// the ShardedDB are kept in segments.
+func (s *ShardedDB) hasSegmentedEntries() bool {
+	if s.config.SegmentedEntries {
+		return true
+	}
+	for _, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		if _, ok := shard.entries.(*segmentEntries); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// createSegmentedMarker marks the segments in dir as holding the entries of
+// the shard.
+func createSegmentedMarker(dir string, fs vfs.FS) error {
+	f, err := fs.Create(fs.PathJoin(dir, segmentsMarkerFilename))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := firstError(f.Sync(), f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+func isSegmented(dir string, fs vfs.FS) bool {
+	_, err := fs.Stat(fs.PathJoin(dir, segmentsMarkerFilename))
+	return err == nil
+}
+
+// openEntryManager returns the entryManager of the shard, the entries are
+// migrated first when the layout selected by config.SegmentedEntries differs
+// from the layout of the shard. The layout of the shard is used in read-only
+// mode.
+func openEntryManager(config LogDBConfig, cs *cache, keys *keyPool,
+	kvs *KV, sdir string, fs vfs.FS) (entryManager, error) {
+	plain := newPlainEntries(cs, keys, kvs).(*plainEntries)
+	dir := fs.PathJoin(sdir, segmentsDirName)
+	segmented := isSegmented(dir, fs)
+	if config.ReadOnly {
+		if segmented {
+			return newSegmentEntries(plain,
+				newNodeLogs(fs, dir, config)), nil
+		}
+		return plain, nil
+	}
+	if config.SegmentedEntries {
+		logs := newNodeLogs(fs, dir, config)
+		if !segmented {
+			if err := migrateToSegments(kvs, dir, fs, logs); err != nil {
+				logs.close()
+				return nil, err
+			}
+		} else if err := removePebbleEntries(kvs); err != nil {
+			return nil, err
+		}
+		return newSegmentEntries(plain, logs), nil
+	}
+	if segmented {
+		if err := migrateToPebble(plain, dir, fs,
+			newNodeLogs(fs, dir, config)); err != nil {
+			return nil, err
+		}
+	} else if err := fs.RemoveAll(dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return plain, nil
+}
+
+// removePebbleEntries removes entries left in pebble when the shard crashed
+// after its entries were migrated into segments.
+func removePebbleEntries(kvs *KV) error {
+	found, err := hasEntryRecord(kvs)
+	if err != nil || !found {
+		return err
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(0, 0, 0)
+	lk.SetEntryKey(math.MaxUint64, math.MaxUint64, math.MaxUint64)
+	return kvs.BulkRemoveEntries(fk.Key(), lk.Key())
+}
+
+// migrateToSegments copies all entries of the shard from pebble into
+// segments, marks the segments as holding the entries of the shard and
+// removes the entries from pebble. Segments left by an interrupted migration
+// are discarded first.
+func migrateToSegments(kvs *KV, dir string, fs vfs.FS, logs *nodeLogs) error {
+	if err := fs.RemoveAll(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return err
+	}
+	var ni raftio.NodeInfo
+	batch := make([]pb.Entry, 0, migrationBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		l, err := logs.get(ni.ClusterID, ni.NodeID, true)
+		if err != nil {
+			return err
+		}
+		if err := l.append(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+	count := 0
+	op := func(key []byte, data []byte) (bool, error) {
+		clusterID, nodeID, _, err := decodeEntryKey(key)
+		if err != nil {
+			return false, err
+		}
+		if current := raftio.GetNodeInfo(clusterID, nodeID); current != ni ||
+			len(batch) == migrationBatchSize {
+			if err := flush(); err != nil {
+				return false, err
+			}
+			ni = current
+		}
+		var e pb.Entry
+		if err := unmarshal(&e, data); err != nil {
+			return false, err
+		}
+		batch = append(batch, e)
+		count++
+		return true, nil
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(0, 0, 0)
+	lk.SetEntryKey(math.MaxUint64, math.MaxUint64, math.MaxUint64)
+	if err := kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := createSegmentedMarker(dir, fs); err != nil {
+		return err
+	}
+	if count > 0 {
+		plog.Infof("%s: migrated %d entries into segments", dir, count)
+	}
+	return kvs.BulkRemoveEntries(fk.Key(), lk.Key())
+}
+
+// migrateToPebble copies all entries of the shard from segments into pebble,
+// the segments are removed once they are no longer marked as holding the
+// entries of the shard. Entries copied by an interrupted migration are
+// overwritten when it is repeated.
+func migrateToPebble(plain *plainEntries,
+	dir string, fs vfs.FS, logs *nodeLogs) error {
+	defer logs.close()
+	nodes, err := logs.list()
+	if err != nil {
+		return err
+	}
+	ctx := newContext(plain.kvs.config.SaveBufferSize,
+		plain.kvs.config.MaxSaveBufferSize)
+	defer ctx.Destroy()
+	count := 0
+	for _, ni := range nodes {
+		l, err := logs.get(ni.ClusterID, ni.NodeID, false)
+		if err != nil {
+			return err
+		}
+		l.mu.RLock()
+		first, last, ok := l.bounds()
+		l.mu.RUnlock()
+		for low := first; ok && low <= last; {
+			high := low + migrationBatchSize
+			if high > last+1 {
+				high = last + 1
+			}
+			ents, _, err := l.iterate(nil, 0, low, high, math.MaxUint64)
+			if err != nil {
+				return err
+			}
+			ctx.Reset()
+			wb := plain.kvs.GetWriteBatch()
+			if _, err := plain.record(wb, ni.ClusterID, ni.NodeID, ctx, ents); err != nil {
+				wb.Destroy()
+				return err
+			}
+			err = plain.kvs.CommitWriteBatch(wb)
+			wb.Destroy()
+			if err != nil {
+				return err
+			}
+			count += len(ents)
+			low = high
+		}
+	}
+	if err := fs.Remove(fs.PathJoin(dir, segmentsMarkerFilename)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fileutil.SyncDir(dir, fs); err != nil {
+		return err
+	}
+	if count > 0 {
+		plog.Infof("%s: migrated %d entries into pebble", dir, count)
+	}
+	logs.close()
+	return errors.WithStack(fs.RemoveAll(dir))
+}
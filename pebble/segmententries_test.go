@@ -0,0 +1,141 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestHybridDB(t *testing.T, fs vfs.FS, segmented bool) *ShardedDB {
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.SegmentedEntries = segmented
+	cfg.SegmentSize = 4096
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	return db
+}
+
+func checkHybridEntries(t *testing.T, db *ShardedDB, segmented bool) {
+	for _, n := range []struct{ cid, nid, count uint64 }{{1, 2, 100}, {3, 4, 50}} {
+		rs, err := db.ReadRaftState(n.cid, n.nid, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), rs.FirstIndex)
+		require.Equal(t, n.count, rs.EntryCount)
+		ents, _, err := db.IterateEntries(nil, 0, n.cid, n.nid, 1, n.count+1, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, int(n.count))
+		for i, e := range ents {
+			require.Equal(t, uint64(i+1), e.Index)
+		}
+		shard, err := db.shard(db.partitioner.GetPartitionID(n.cid))
+		require.NoError(t, err)
+		_, ok := shard.entries.(*segmentEntries)
+		require.Equal(t, segmented, ok)
+		found, err := hasEntryRecord(shard.kvs)
+		require.NoError(t, err)
+		require.Equal(t, !segmented, found)
+	}
+}
+
+func TestSegmentedEntriesAreMigrated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestHybridDB(t, fs, false)
+	saveTestNode(t, db, 1, 2, 100)
+	saveTestNode(t, db, 3, 4, 50)
+	checkHybridEntries(t, db, false)
+	require.NoError(t, db.Close())
+	db = openTestHybridDB(t, fs, true)
+	checkHybridEntries(t, db, true)
+	require.NoError(t, db.Close())
+	db = openTestHybridDB(t, fs, true)
+	checkHybridEntries(t, db, true)
+	require.NoError(t, db.Close())
+	db = openTestHybridDB(t, fs, false)
+	checkHybridEntries(t, db, false)
+	for i := range db.shards {
+		_, err := fs.Stat(fs.PathJoin(RDBTestDirectory, "wal",
+			shardDirName(uint64(i)), segmentsDirName))
+		require.Error(t, err)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestSegmentedEntriesCanBeSavedAndRemoved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestHybridDB(t, fs, true)
+	require.NoError(t, db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true}))
+	for i := uint64(1); i <= 100; i += 20 {
+		require.NoError(t, db.SaveRaftState([]pb.Update{{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 1, Vote: 2, Commit: i + 19},
+			EntriesToSave: segmentTestEntries(i, i+19, 1),
+		}}, 1))
+	}
+	saveTestNode(t, db, 3, 4, 50)
+	checkHybridEntries(t, db, true)
+	_, err := db.Backup(fs.PathJoin(RDBTestDirectory, "backup"))
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	shard, err := db.shard(db.partitioner.GetPartitionID(1))
+	require.NoError(t, err)
+	logs := shard.entries.(*segmentEntries).logs
+	l, err := logs.get(1, 2, false)
+	require.NoError(t, err)
+	segments := len(l.segments)
+	require.Greater(t, segments, 1)
+	require.NoError(t, db.RemoveEntriesTo(1, 2, 90))
+	require.Less(t, len(l.segments), segments)
+	rs, err := db.ReadRaftState(1, 2, 90)
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), rs.FirstIndex)
+	require.Equal(t, uint64(11), rs.EntryCount)
+	require.NoError(t, db.RemoveNodeData(1, 2))
+	_, err = fs.Stat(fs.PathJoin(logs.dir, nodeLogDirName(1, 2)))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestEntryScansAreRejectedWithSegmentedEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	db := openTestHybridDB(t, fs, true)
+	saveTestNode(t, db, 1, 2, 10)
+	_, err := db.Verify()
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	_, _, err = db.VerifyResumable(nil, ScanBudget{})
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	_, err = db.EntryBytes(1, 2)
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	_, err = db.ClusterEntryBytes(1)
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	require.ErrorIs(t, db.ReconcileEntryBytes(), ErrSegmentedEntries)
+	_, err = db.Forecast(time.Hour)
+	require.ErrorIs(t, err, ErrSegmentedEntries)
+	require.NoError(t, db.Close())
+
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.SegmentedEntries = true
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckFull)
+	require.NoError(t, err)
+	report := db.CheckReport()
+	require.NoError(t, db.Close())
+	require.Equal(t, CheckQuick, report.Level)
+	require.True(t, report.OK(), "%v", report.Violations)
+	require.Equal(t, uint64(1), report.Nodes)
+}
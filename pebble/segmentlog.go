@@ -0,0 +1,639 @@
+package pebble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentFileSuffix = ".log"
+	// segmentRecordHeaderSize is the size of the header of each entry record
+	// in a segment file, it contains the length of the marshaled entry, the
+	// index of the entry and the CRC32 of both.
+	segmentRecordHeaderSize = 16
+	// defaultSegmentSize is the size of segment files used when
+	// LogDBConfig.SegmentSize is 0.
+	defaultSegmentSize = 64 * 1024 * 1024
+)
+
+func segmentFileName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentFileSuffix)
+}
+
+func parseSegmentFileName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentFileSuffix) {
+		return 0, false
+	}
+	first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return first, true
+}
+
+// segment is an append-only file of entry records with contiguous indexes
+// starting at first. The offsets of the records are kept in memory, they are
+// rebuilt by scanning the file when the log is opened.
+type segment struct {
+	name    string
+	first   uint64
+	offsets []int64
+	// end is the offset following the last valid record.
+	end int64
+	r   vfs.File
+	// data is the file of the segment mapped into memory, it is only set for
+	// segments no longer appended to when mmap is enabled.
+	data []byte
+}
+
+func (s *segment) count() uint64 {
+	return uint64(len(s.offsets))
+}
+
+func (s *segment) last() uint64 {
+	return s.first + s.count() - 1
+}
+
+// recordEnd returns the offset following the record at position i.
+func (s *segment) recordEnd(i uint64) int64 {
+	if i+1 < s.count() {
+		return s.offsets[i+1]
+	}
+	return s.end
+}
+
+// nodeLog is the segmented log of the entries of a single node. Entries are
+// appended to the last segment, which is rolled once it reaches the segment
+// size. Overwritten entries are superseded by a new segment starting at the
+// first overwritten index, segments entirely below the trimmed index are
+// removed.
+type nodeLog struct {
+	mu       sync.RWMutex
+	fs       vfs.FS
+	dir      string
+	maxSize  int64
+	segments []*segment
+	// w is the file of the last segment opened for appending, it is nil when
+	// the next append must start a new segment.
+	w vfs.File
+	// pending are the offsets of the records written to w but not synced
+	// yet, pendingSize is their total size, see write.
+	pending     []int64
+	pendingSize int64
+	// first is the first index not removed by RemoveEntriesTo since the log
+	// was opened.
+	first uint64
+	// mmap enables reading the segments no longer appended to from memory
+	// mappings, it is cleared once mapping a segment failed.
+	mmap bool
+}
+
+// openNodeLog opens the log in dir, records following a torn or corrupted
+// record are ignored, they can only be the result of a crash during an
+// append as the record is synced before the append is acknowledged.
+func openNodeLog(fs vfs.FS,
+	dir string, maxSize int64, mmap bool) (*nodeLog, error) {
+	l := &nodeLog{fs: fs, dir: dir, maxSize: maxSize, mmap: mmap}
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	firsts := make([]uint64, 0, len(names))
+	for _, name := range names {
+		if first, ok := parseSegmentFileName(name); ok {
+			firsts = append(firsts, first)
+		}
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+	for _, first := range firsts {
+		seg, err := l.scanSegment(first)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		if seg.count() == 0 {
+			if err := l.removeSegment(seg); err != nil {
+				l.close()
+				return nil, err
+			}
+			continue
+		}
+		if err := l.supersede(first); err != nil {
+			l.close()
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+		l.mapSegment(seg)
+	}
+	return l, nil
+}
+
+func (l *nodeLog) scanSegment(first uint64) (*segment, error) {
+	seg := &segment{name: segmentFileName(first), first: first}
+	f, err := l.fs.Open(l.fs.PathJoin(l.dir, seg.name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	seg.r = f
+	br := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	header := make([]byte, segmentRecordHeaderSize)
+	var payload []byte
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			break
+		}
+		n := binary.BigEndian.Uint32(header)
+		index := binary.BigEndian.Uint64(header[4:])
+		if uint64(cap(payload)) < uint64(n) {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(br, payload); err != nil {
+			break
+		}
+		crc := crc32.Update(0, castagnoli, header[:12])
+		crc = crc32.Update(crc, castagnoli, payload)
+		if crc != binary.BigEndian.Uint32(header[12:]) ||
+			index != first+seg.count() {
+			break
+		}
+		seg.offsets = append(seg.offsets, seg.end)
+		seg.end += segmentRecordHeaderSize + int64(n)
+	}
+	return seg, nil
+}
+
+// supersede drops the entries at or above index from the segments, the
+// files of segments left without entries are removed. The log is reset when
+// a gap would be left before index, e.g. after a snapshot was installed.
+func (l *nodeLog) supersede(index uint64) error {
+	removed := make([]*segment, 0)
+	kept := make([]*segment, 0, len(l.segments))
+	for _, seg := range l.segments {
+		if seg.first >= index {
+			removed = append(removed, seg)
+			continue
+		}
+		if seg.last() >= index {
+			seg.end = seg.offsets[index-seg.first]
+			seg.offsets = seg.offsets[:index-seg.first]
+		}
+		kept = append(kept, seg)
+	}
+	if len(kept) > 0 && kept[len(kept)-1].last()+1 < index {
+		removed = append(removed, kept...)
+		kept = kept[:0]
+	}
+	l.segments = kept
+	for _, seg := range removed {
+		if err := l.removeSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapSegment maps the file of a segment no longer appended to into memory,
+// the segment keeps being read using its file when mapping it failed or is
+// not supported by the file system.
+func (l *nodeLog) mapSegment(seg *segment) {
+	if !l.mmap || seg.data != nil || seg.end == 0 {
+		return
+	}
+	f, ok := seg.r.(interface{ Fd() uintptr })
+	if !mmapSupported || !ok {
+		l.mmap = false
+		return
+	}
+	data, err := mmapFile(f.Fd(), int(seg.end))
+	if err != nil {
+		plog.Warningf("%s: failed to mmap segment %s, %v", l.dir, seg.name, err)
+		l.mmap = false
+		return
+	}
+	seg.data = data
+}
+
+func (l *nodeLog) closeSegment(seg *segment) {
+	if seg.data != nil {
+		if err := munmapFile(seg.data); err != nil {
+			plog.Warningf("%s: failed to munmap segment %s, %v", l.dir, seg.name, err)
+		}
+		seg.data = nil
+	}
+	if seg.r != nil {
+		seg.r.Close()
+		seg.r = nil
+	}
+}
+
+func (l *nodeLog) removeSegment(seg *segment) error {
+	l.closeSegment(seg)
+	return errors.WithStack(l.fs.Remove(l.fs.PathJoin(l.dir, seg.name)))
+}
+
+// find returns the segment containing index, which must be within the
+// bounds of the log.
+func (l *nodeLog) find(index uint64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].first > index
+	})
+	return l.segments[i-1]
+}
+
+func (l *nodeLog) close() {
+	if l.w != nil {
+		l.w.Close()
+		l.w = nil
+	}
+	for _, seg := range l.segments {
+		l.closeSegment(seg)
+	}
+	l.segments = nil
+}
+
+// bounds returns the first and the last index of the log, false is returned
+// when the log is empty.
+func (l *nodeLog) bounds() (uint64, uint64, bool) {
+	if len(l.segments) == 0 {
+		return 0, 0, false
+	}
+	first := l.segments[0].first
+	if l.first > first {
+		first = l.first
+	}
+	last := l.segments[len(l.segments)-1].last()
+	if first > last {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// append appends the entries to the log and syncs them. Entries at or above
+// the first appended index are overwritten, the log is reset when the
+// appended entries do not follow its last entry, e.g. after a snapshot was
+// installed.
+func (l *nodeLog) append(entries []pb.Entry) error {
+	if err := l.write(entries); err != nil {
+		return err
+	}
+	return l.sync()
+}
+
+// write is similar to append, the entries are written without being synced.
+// They are not readable until they are synced by sync, so the logs of many
+// nodes can be written before being synced concurrently.
+func (l *nodeLog) write(entries []pb.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the bounds of the log must include entries written before
+	if err := l.syncPending(); err != nil {
+		return err
+	}
+	first := entries[0].Index
+	if n := len(l.segments); n > 0 {
+		if last := l.segments[n-1].last(); first <= last || first > last+1 {
+			if err := l.closeWriter(); err != nil {
+				return err
+			}
+			if err := l.supersede(first); err != nil {
+				return err
+			}
+		}
+	}
+	if l.first > first {
+		l.first = first
+	}
+	if l.w == nil {
+		if err := l.roll(first); err != nil {
+			return err
+		}
+	}
+	seg := l.segments[len(l.segments)-1]
+	size := 0
+	for i := range entries {
+		size += segmentRecordHeaderSize + entries[i].SizeUpperLimit()
+	}
+	buf := make([]byte, size)
+	offsets := make([]int64, 0, len(entries))
+	pos := 0
+	for i := range entries {
+		n, err := entries[i].MarshalTo(buf[pos+segmentRecordHeaderSize:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		header := buf[pos : pos+segmentRecordHeaderSize]
+		binary.BigEndian.PutUint32(header, uint32(n))
+		binary.BigEndian.PutUint64(header[4:], entries[i].Index)
+		crc := crc32.Update(0, castagnoli, header[:12])
+		crc = crc32.Update(crc, castagnoli,
+			buf[pos+segmentRecordHeaderSize:pos+segmentRecordHeaderSize+n])
+		binary.BigEndian.PutUint32(header[12:], crc)
+		offsets = append(offsets, seg.end+int64(pos))
+		pos += segmentRecordHeaderSize + n
+	}
+	if _, err := l.w.Write(buf[:pos]); err != nil {
+		l.closeWriter()
+		return errors.WithStack(err)
+	}
+	l.pending = offsets
+	l.pendingSize = int64(pos)
+	return nil
+}
+
+// sync syncs the entries written by write, they are then readable.
+func (l *nodeLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.syncPending(); err != nil {
+		return err
+	}
+	if l.w != nil && l.segments[len(l.segments)-1].end >= l.maxSize {
+		return l.closeWriter()
+	}
+	return nil
+}
+
+func (l *nodeLog) syncPending() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	offsets, size := l.pending, l.pendingSize
+	l.pending, l.pendingSize = nil, 0
+	if err := l.w.Sync(); err != nil {
+		l.closeWriter()
+		return errors.WithStack(err)
+	}
+	seg := l.segments[len(l.segments)-1]
+	seg.offsets = append(seg.offsets, offsets...)
+	seg.end += size
+	return nil
+}
+
+func (l *nodeLog) closeWriter() error {
+	if l.w == nil {
+		return nil
+	}
+	err := l.syncPending()
+	if l.w == nil {
+		// closed once syncing failed
+		return err
+	}
+	err = firstError(err, l.w.Close())
+	l.w = nil
+	l.mapSegment(l.segments[len(l.segments)-1])
+	return errors.WithStack(err)
+}
+
+// roll creates a new segment starting at first.
+func (l *nodeLog) roll(first uint64) error {
+	seg := &segment{name: segmentFileName(first), first: first}
+	fp := l.fs.PathJoin(l.dir, seg.name)
+	w, err := l.fs.Create(fp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fileutil.SyncDir(l.dir, l.fs); err != nil {
+		w.Close()
+		return err
+	}
+	r, err := l.fs.Open(fp)
+	if err != nil {
+		w.Close()
+		return errors.WithStack(err)
+	}
+	seg.r = r
+	l.w = w
+	l.segments = append(l.segments, seg)
+	return nil
+}
+
+// removeTo removes the entries below index, the files of segments with no
+// entries left are removed.
+func (l *nodeLog) removeTo(index uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if index > l.first {
+		l.first = index
+	}
+	kept := l.segments[:0]
+	for i, seg := range l.segments {
+		if seg.last() >= index {
+			kept = append(kept, l.segments[i:]...)
+			break
+		}
+		if i == len(l.segments)-1 {
+			if err := l.closeWriter(); err != nil {
+				return err
+			}
+		}
+		if err := l.removeSegment(seg); err != nil {
+			return err
+		}
+	}
+	l.segments = kept
+	return nil
+}
+
+// iterate appends the entries in [low, high) to ents, the iteration stops
+// once the total size exceeds maxSize or the next entry is not available.
+func (l *nodeLog) iterate(ents []pb.Entry, size uint64,
+	low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	first, last, ok := l.bounds()
+	if !ok || low < first || low > last {
+		return ents, size, nil
+	}
+	if high > last+1 {
+		high = last + 1
+	}
+	for low < high {
+		seg := l.find(low)
+		i := low - seg.first
+		j := i
+		bytes := uint64(0)
+		for j < seg.count() && seg.first+j < high {
+			bytes += uint64(seg.recordEnd(j) - seg.offsets[j])
+			j++
+			if size+bytes > maxSize {
+				break
+			}
+		}
+		var buf []byte
+		if seg.data != nil {
+			buf = seg.data[seg.offsets[i]:seg.recordEnd(j-1)]
+		} else {
+			buf = make([]byte, seg.recordEnd(j-1)-seg.offsets[i])
+			if _, err := seg.r.ReadAt(buf, seg.offsets[i]); err != nil {
+				return nil, 0, errors.WithStack(err)
+			}
+		}
+		pos := 0
+		for k := i; k < j; k++ {
+			n := int(binary.BigEndian.Uint32(buf[pos:]))
+			pos += segmentRecordHeaderSize
+			var e pb.Entry
+			if err := e.Unmarshal(buf[pos : pos+n]); err != nil {
+				return nil, 0, errors.Wrapf(ErrCorruptedRecord, "%v", err)
+			}
+			if e.Index != seg.first+k {
+				return nil, 0, errors.Wrapf(ErrCorruptedRecord,
+					"entry %d read at the position of entry %d", e.Index, seg.first+k)
+			}
+			pos += n
+			ents = append(ents, e)
+			size += uint64(e.SizeUpperLimit())
+			if size > maxSize {
+				return ents, size, nil
+			}
+		}
+		low = seg.first + j
+	}
+	return ents, size, nil
+}
+
+// rangeFrom returns the first index at or above snapshotIndex and the number
+// of entries from it to the last entry of the log not above maxIndex.
+func (l *nodeLog) rangeFrom(snapshotIndex uint64,
+	maxIndex uint64) (uint64, uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	first, last, ok := l.bounds()
+	if last > maxIndex {
+		last = maxIndex
+	}
+	if !ok || last <= snapshotIndex {
+		return snapshotIndex, 0
+	}
+	if first < snapshotIndex {
+		first = snapshotIndex
+	}
+	return first, last - first + 1
+}
+
+// nodeLogs manages the logs of the nodes kept in the subdirectories of dir,
+// logs are opened on first access.
+type nodeLogs struct {
+	fs      vfs.FS
+	dir     string
+	maxSize int64
+	mmap    bool
+	mu      sync.Mutex
+	logs    map[raftio.NodeInfo]*nodeLog
+}
+
+func newNodeLogs(fs vfs.FS, dir string, config LogDBConfig) *nodeLogs {
+	maxSize := config.SegmentSize
+	if maxSize == 0 {
+		maxSize = defaultSegmentSize
+	}
+	return &nodeLogs{
+		fs:      fs,
+		dir:     dir,
+		maxSize: int64(maxSize),
+		mmap:    config.SegmentMmap,
+		logs:    make(map[raftio.NodeInfo]*nodeLog),
+	}
+}
+
+func nodeLogDirName(clusterID uint64, nodeID uint64) string {
+	return fmt.Sprintf("%d-%d", clusterID, nodeID)
+}
+
+// get returns the log of the specified node, it is opened first when it was
+// not accessed yet. Nil is returned when the node has no log and create is
+// false.
+func (n *nodeLogs) get(clusterID uint64,
+	nodeID uint64, create bool) (*nodeLog, error) {
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if l, ok := n.logs[ni]; ok {
+		return l, nil
+	}
+	dir := n.fs.PathJoin(n.dir, nodeLogDirName(clusterID, nodeID))
+	exist, err := fileutil.DirExist(dir, n.fs)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		if !create {
+			return nil, nil
+		}
+		if err := fileutil.Mkdir(dir, n.fs); err != nil {
+			return nil, err
+		}
+	}
+	l, err := openNodeLog(n.fs, dir, n.maxSize, n.mmap)
+	if err != nil {
+		return nil, err
+	}
+	n.logs[ni] = l
+	return l, nil
+}
+
+// remove removes the log of the specified node.
+func (n *nodeLogs) remove(clusterID uint64, nodeID uint64) error {
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if l, ok := n.logs[ni]; ok {
+		l.mu.Lock()
+		l.close()
+		l.mu.Unlock()
+		delete(n.logs, ni)
+	}
+	dir := n.fs.PathJoin(n.dir, nodeLogDirName(clusterID, nodeID))
+	if err := n.fs.RemoveAll(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(n.dir, n.fs)
+}
+
+// list returns the nodes with a log in dir.
+func (n *nodeLogs) list() ([]raftio.NodeInfo, error) {
+	names, err := n.fs.List(n.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result := make([]raftio.NodeInfo, 0, len(names))
+	for _, name := range names {
+		var clusterID, nodeID uint64
+		if _, err := fmt.Sscanf(name, "%d-%d", &clusterID, &nodeID); err != nil {
+			continue
+		}
+		if name != nodeLogDirName(clusterID, nodeID) {
+			continue
+		}
+		result = append(result, raftio.GetNodeInfo(clusterID, nodeID))
+	}
+	return result, nil
+}
+
+func (n *nodeLogs) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, l := range n.logs {
+		l.mu.Lock()
+		l.close()
+		l.mu.Unlock()
+	}
+	n.logs = make(map[raftio.NodeInfo]*nodeLog)
+}
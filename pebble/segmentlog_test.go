@@ -0,0 +1,187 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func segmentTestEntries(first uint64, last uint64, term uint64) []pb.Entry {
+	ents := make([]pb.Entry, 0)
+	for i := first; i <= last; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: term, Cmd: make([]byte, 100)})
+	}
+	return ents
+}
+
+func openTestNodeLog(t *testing.T, fs vfs.FS) *nodeLog {
+	require.NoError(t, fs.MkdirAll("log", 0755))
+	l, err := openNodeLog(fs, "log", 1024, false)
+	require.NoError(t, err)
+	return l
+}
+
+func requireNodeLogEntries(t *testing.T,
+	l *nodeLog, first uint64, last uint64, term uint64) {
+	ents, _, err := l.iterate(nil, 0, first, last+1, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, ents, int(last-first+1))
+	for i, e := range ents {
+		require.Equal(t, first+uint64(i), e.Index)
+		require.Equal(t, term, e.Term)
+	}
+}
+
+func TestNodeLogAppendAndIterate(t *testing.T) {
+	fs := vfs.NewMem()
+	l := openTestNodeLog(t, fs)
+	for i := uint64(1); i <= 100; i += 10 {
+		require.NoError(t, l.append(segmentTestEntries(i, i+9, 1)))
+	}
+	require.Greater(t, len(l.segments), 1)
+	requireNodeLogEntries(t, l, 1, 100, 1)
+	requireNodeLogEntries(t, l, 35, 72, 1)
+	ents, size, err := l.iterate(nil, 0, 10, 101, 500)
+	require.NoError(t, err)
+	require.Greater(t, size, uint64(500))
+	require.LessOrEqual(t, size-uint64(ents[len(ents)-1].SizeUpperLimit()), uint64(500))
+	ents, _, err = l.iterate(nil, 0, 101, 102, math.MaxUint64)
+	require.NoError(t, err)
+	require.Empty(t, ents)
+	first, count := l.rangeFrom(0, math.MaxUint64)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(100), count)
+	first, count = l.rangeFrom(60, math.MaxUint64)
+	require.Equal(t, uint64(60), first)
+	require.Equal(t, uint64(41), count)
+	first, count = l.rangeFrom(60, 80)
+	require.Equal(t, uint64(60), first)
+	require.Equal(t, uint64(21), count)
+	l.close()
+	l = openTestNodeLog(t, fs)
+	requireNodeLogEntries(t, l, 1, 100, 1)
+	require.NoError(t, l.append(segmentTestEntries(101, 110, 1)))
+	requireNodeLogEntries(t, l, 1, 110, 1)
+	l.close()
+}
+
+func TestNodeLogOverwriteAndReset(t *testing.T) {
+	fs := vfs.NewMem()
+	l := openTestNodeLog(t, fs)
+	require.NoError(t, l.append(segmentTestEntries(1, 50, 1)))
+	require.NoError(t, l.append(segmentTestEntries(30, 40, 2)))
+	requireNodeLogEntries(t, l, 1, 29, 1)
+	requireNodeLogEntries(t, l, 30, 40, 2)
+	_, last, _ := l.bounds()
+	require.Equal(t, uint64(40), last)
+	l.close()
+	l = openTestNodeLog(t, fs)
+	requireNodeLogEntries(t, l, 1, 29, 1)
+	requireNodeLogEntries(t, l, 30, 40, 2)
+	require.NoError(t, l.append(segmentTestEntries(100, 110, 3)))
+	first, last, _ := l.bounds()
+	require.Equal(t, uint64(100), first)
+	require.Equal(t, uint64(110), last)
+	l.close()
+	names, err := fs.List("log")
+	require.NoError(t, err)
+	require.Equal(t, []string{segmentFileName(100)}, names)
+}
+
+func TestNodeLogRemoveTo(t *testing.T) {
+	fs := vfs.NewMem()
+	l := openTestNodeLog(t, fs)
+	require.NoError(t, l.append(segmentTestEntries(1, 100, 1)))
+	require.NoError(t, l.append(segmentTestEntries(101, 200, 1)))
+	before := len(l.segments)
+	require.NoError(t, l.removeTo(150))
+	require.Less(t, len(l.segments), before)
+	first, last, _ := l.bounds()
+	require.Equal(t, uint64(150), first)
+	require.Equal(t, uint64(200), last)
+	ents, _, err := l.iterate(nil, 0, 100, 201, math.MaxUint64)
+	require.NoError(t, err)
+	require.Empty(t, ents)
+	requireNodeLogEntries(t, l, 150, 200, 1)
+	names, err := fs.List("log")
+	require.NoError(t, err)
+	require.Len(t, names, len(l.segments))
+	require.NoError(t, l.removeTo(201))
+	_, _, ok := l.bounds()
+	require.False(t, ok)
+	require.NoError(t, l.append(segmentTestEntries(201, 210, 1)))
+	requireNodeLogEntries(t, l, 201, 210, 1)
+	l.close()
+}
+
+func TestNodeLogIgnoresTornRecord(t *testing.T) {
+	fs := vfs.NewMem()
+	l := openTestNodeLog(t, fs)
+	require.NoError(t, l.append(segmentTestEntries(1, 5, 1)))
+	name := fs.PathJoin("log", l.segments[0].name)
+	l.close()
+	f, err := fs.OpenForAppend(name)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 10, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	l = openTestNodeLog(t, fs)
+	requireNodeLogEntries(t, l, 1, 5, 1)
+	require.NoError(t, l.append(segmentTestEntries(6, 10, 1)))
+	l.close()
+	l = openTestNodeLog(t, fs)
+	requireNodeLogEntries(t, l, 1, 10, 1)
+	l.close()
+}
+
+func TestNodeLogReadsMappedSegments(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap not supported")
+	}
+	fs := vfs.Default
+	dir := t.TempDir()
+	l, err := openNodeLog(fs, dir, 1024, true)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 100; i += 10 {
+		require.NoError(t, l.append(segmentTestEntries(i, i+9, 1)))
+	}
+	mapped := 0
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		require.NotNil(t, seg.data)
+		mapped++
+	}
+	require.Greater(t, mapped, 0)
+	requireNodeLogEntries(t, l, 1, 100, 1)
+	require.NoError(t, l.append(segmentTestEntries(30, 40, 2)))
+	requireNodeLogEntries(t, l, 1, 29, 1)
+	requireNodeLogEntries(t, l, 30, 40, 2)
+	require.NoError(t, l.removeTo(20))
+	requireNodeLogEntries(t, l, 20, 29, 1)
+	l.close()
+	l, err = openNodeLog(fs, dir, 1024, true)
+	require.NoError(t, err)
+	for _, seg := range l.segments {
+		require.NotNil(t, seg.data)
+	}
+	requireNodeLogEntries(t, l, 30, 40, 2)
+	l.close()
+}
+
+func TestNodeLogFallsBackToReadsWithoutMmap(t *testing.T) {
+	fs := vfs.NewMem()
+	require.NoError(t, fs.MkdirAll("log", 0755))
+	l, err := openNodeLog(fs, "log", 1024, true)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 100; i += 10 {
+		require.NoError(t, l.append(segmentTestEntries(i, i+9, 1)))
+	}
+	require.False(t, l.mmap)
+	for _, seg := range l.segments {
+		require.Nil(t, seg.data)
+	}
+	requireNodeLogEntries(t, l, 1, 100, 1)
+	l.close()
+}
@@ -17,8 +17,13 @@ package pebble
 import (
 	"fmt"
 	"math"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
 	"github.com/coufalja/tugboat/logdb"
 	"github.com/coufalja/tugboat/raftio"
 	pb "github.com/coufalja/tugboat/raftpb"
@@ -33,10 +38,33 @@ type ShardedDB struct {
 	compactions          *compactions
 	stopper              *syncutil.Stopper
 	compactionCh         chan struct{}
+	watches              *watches
 	ctxs                 []IContext
+	ctxPools             []*contextPool
 	shards               []*db
+	dirs                 []string
+	lldirs               []string
 	config               LogDBConfig
 	completedCompactions uint64
+	deletionCompactions  uint64
+	closed               uint32
+	callback             logdb.LogDBCallback
+	// compactionLimiter limits the bytes written by compactions of all
+	// shards, it is nil when LogDBConfig.CompactionBandwidth is 0.
+	compactionLimiter *vfsutil.RateLimiter
+	// opened is set for each shard once it is opened, shards are opened on
+	// demand when LogDBConfig.OpenClusters is set. openMu protects the
+	// opening of shards on demand and closing. recoveryMu protects recovery
+	// as shards are opened concurrently by OpenShardedDB.
+	opened      []uint32
+	openMu      sync.Mutex
+	closing     bool
+	recovery    RecoveryReport
+	recoveryMu  sync.Mutex
+	check       CheckReport
+	drainOnce   sync.Once
+	drained     chan struct{}
+	jobsStopped uint32
 }
 
 var _ raftio.ILogDB = (*ShardedDB)(nil)
@@ -59,78 +87,361 @@ func (sc *shardCallback) callback(busy bool) {
 	}
 }
 
-// OpenShardedDB creates a ShardedDB instance.
-func OpenShardedDB(config LogDBConfig, cb logdb.LogDBCallback, dirs []string, lldirs []string, check bool) (*ShardedDB, error) {
+const shardDirPrefix = "logdb-"
+
+func shardDirName(shard uint64) string {
+	return fmt.Sprintf("%s%d", shardDirPrefix, shard)
+}
+
+// OpenShardedDB creates a ShardedDB instance, the opened shards are checked at
+// the specified level, see CheckReport.
+func OpenShardedDB(config LogDBConfig, cb logdb.LogDBCallback, dirs []string, lldirs []string, check CheckLevel) (*ShardedDB, error) {
 	fs := config.FS
 	if config.IsEmpty() {
 		panic("config.Expert.LogDB.IsEmpty()")
 	}
-	shards := make([]*db, 0)
-	closeAll := func(all []*db) {
-		var err error
-		for _, s := range all {
-			err = firstError(err, s.close())
-		}
-		if err != nil {
-			plog.Panicf("%+v", err)
-			panic("not suppose to reach here")
+	if len(config.Namespace) > 0 {
+		if err := validateNamespace(config.Namespace); err != nil {
+			return nil, err
 		}
+		dirs = NamespaceDirs(dirs, config.Namespace, fs)
+		lldirs = NamespaceDirs(lldirs, config.Namespace, fs)
 	}
-	for i := uint64(0); i < config.Shards; i++ {
-		dir := fs.PathJoin(dirs[i], fmt.Sprintf("logdb-%d", i))
-		lldir := ""
-		if len(lldirs) > 0 {
-			lldir = fs.PathJoin(lldirs[i], fmt.Sprintf("logdb-%d", i))
-		}
-		sc := shardCallback{shard: i, f: cb}
-		db, err := openRDB(config, sc.callback, dir, lldir, fs)
-		if err != nil {
-			closeAll(shards)
-			return nil, errors.WithStack(err)
-		}
-		shards = append(shards, db)
-	}
-	if check {
-		for _, s := range shards {
-			located, err := hasEntryRecord(s.kvs)
-			if err != nil {
-				closeAll(shards)
-				return nil, errors.WithStack(err)
-			}
-			if located {
-				closeAll(shards)
-				return OpenShardedDB(config, cb, dirs, lldirs, false)
+	if err := checkDragonboat(config, dirs); err != nil {
+		return nil, err
+	}
+	if !config.ReadOnly {
+		for _, dir := range uniqueDirs(dirs) {
+			if isStandby(dir, fs) {
+				return nil, errors.Wrapf(ErrStandby, "%s", dir)
 			}
 		}
 	}
-	plog.Infof("using plain logdb")
+	if err := checkRelaxedDurability(config); err != nil {
+		return nil, err
+	}
+	if err := checkLayout(config, dirs, lldirs); err != nil {
+		return nil, err
+	}
+	if config.FormatMajorVersion > pebble.FormatNewest {
+		return nil, errors.Errorf("unknown format major version %d",
+			config.FormatMajorVersion)
+	}
+	mirroring := len(config.MirrorDir) > 0 && !config.ReadOnly
+	if config.StateStore && (mirroring || config.ShippingStore != nil) {
+		return nil, errors.WithStack(ErrStateStoreUnsupported)
+	}
+	if config.SegmentedEntries && (mirroring || config.ShippingStore != nil) {
+		return nil, errors.WithStack(ErrSegmentedEntries)
+	}
+	if mirroring {
+		if err := createStandbyMarker(config.MirrorDir, fs); err != nil {
+			return nil, err
+		}
+	}
 	partitioner := server.NewDoubleFixedPartitioner(config.Shards, config.Shards)
 	mw := &ShardedDB{
 		config:       config,
-		shards:       shards,
+		callback:     cb,
+		shards:       make([]*db, config.Shards),
+		opened:       make([]uint32, config.Shards),
+		dirs:         dirs,
+		lldirs:       lldirs,
 		ctxs:         make([]IContext, config.Shards),
 		partitioner:  partitioner,
 		compactions:  newCompactions(),
 		compactionCh: make(chan struct{}, 1),
+		watches:      newWatches(),
 		stopper:      syncutil.NewStopper(),
 	}
+	if config.CompactionBandwidth > 0 && !config.ReadOnly {
+		mw.compactionLimiter = vfsutil.NewRateLimiter(config.CompactionBandwidth)
+	}
+	closeAll := func() {
+		var err error
+		for _, s := range mw.openedShards() {
+			if s != nil {
+				err = firstError(err, s.close())
+			}
+		}
+		if err != nil {
+			plog.Panicf("%+v", err)
+			panic("not suppose to reach here")
+		}
+	}
+	if err := mw.openInitialShards(); err != nil {
+		closeAll()
+		return nil, err
+	}
+	if err := mw.startupCheck(check); err != nil {
+		closeAll()
+		return nil, err
+	}
+	plog.Infof("using plain logdb")
 	for i := uint64(0); i < config.Shards; i++ {
 		mw.ctxs[i] = newContext(mw.config.SaveBufferSize, mw.config.MaxSaveBufferSize)
+		mw.ctxPools = append(mw.ctxPools, newContextPool(config.ContextPoolSize,
+			mw.config.SaveBufferSize, mw.config.MaxSaveBufferSize))
 	}
 	mw.stopper.RunWorker(func() {
-		mw.compactionWorkerMain()
+		withLabels("compaction-scheduler", mw.compactionWorkerMain)
 	})
+	if config.JanitorInterval > 0 && !config.ReadOnly {
+		mw.stopper.RunWorker(func() {
+			withLabels("janitor", mw.janitorWorkerMain)
+		})
+	}
+	if config.RelaxedSyncInterval > 0 && !config.ReadOnly {
+		mw.stopper.RunWorker(func() {
+			withLabels("relaxed-sync", mw.relaxedSyncWorkerMain)
+		})
+	}
+	if freeSpaceEnabled(config) {
+		mw.stopper.RunWorker(func() {
+			withLabels("free-space-monitor", mw.freeSpaceWorkerMain)
+		})
+	}
 	return mw, nil
 }
 
+// initialShards returns the shards opened by OpenShardedDB, these are all
+// shards unless LogDBConfig.OpenClusters is set.
+func (s *ShardedDB) initialShards() []bool {
+	initial := make([]bool, s.config.Shards)
+	for i := range initial {
+		initial[i] = len(s.config.OpenClusters) == 0
+	}
+	for _, clusterID := range s.config.OpenClusters {
+		initial[s.partitioner.GetPartitionID(clusterID)] = true
+	}
+	return initial
+}
+
+// openInitialShards opens the initial shards, up to
+// LogDBConfig.OpenParallelism shards are opened concurrently. No further
+// shard is opened once an open failed, the error of the lowest failed shard
+// is returned once all started opens completed.
+func (s *ShardedDB) openInitialShards() error {
+	initial := s.initialShards()
+	limit := s.config.OpenParallelism
+	if limit == 0 {
+		limit = s.config.Shards
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([]error, s.config.Shards)
+	failed := uint32(0)
+	var wg sync.WaitGroup
+	for i := uint64(0); i < s.config.Shards; i++ {
+		if !initial[i] {
+			continue
+		}
+		sem <- struct{}{}
+		if atomic.LoadUint32(&failed) == 1 {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if _, errs[i] = s.openShard(i); errs[i] != nil {
+				atomic.StoreUint32(&failed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.recoveryMu.Lock()
+	sort.Slice(s.recovery.Shards, func(i, j int) bool {
+		return s.recovery.Shards[i].Shard < s.recovery.Shards[j].Shard
+	})
+	s.recoveryMu.Unlock()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shard returns the specified shard, it is opened first when it was not
+// opened by OpenShardedDB.
+func (s *ShardedDB) shard(p uint64) (*db, error) {
+	if atomic.LoadUint32(&s.opened[p]) == 1 {
+		return s.shards[p], nil
+	}
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if atomic.LoadUint32(&s.opened[p]) == 1 {
+		return s.shards[p], nil
+	}
+	if s.closing {
+		return nil, errors.WithStack(ErrClosing)
+	}
+	return s.openShard(p)
+}
+
+// allShards returns all shards, shards not opened yet are opened first.
+func (s *ShardedDB) allShards() ([]*db, error) {
+	result := make([]*db, 0, len(s.shards))
+	for i := range s.shards {
+		shard, err := s.shard(uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, shard)
+	}
+	return result, nil
+}
+
+// openedShards returns all shards indexed by shard number, shards not opened
+// yet are nil.
+func (s *ShardedDB) openedShards() []*db {
+	result := make([]*db, len(s.shards))
+	for i := range s.shards {
+		if atomic.LoadUint32(&s.opened[i]) == 1 {
+			result[i] = s.shards[i]
+		}
+	}
+	return result
+}
+
+// openShard opens the specified shard, the caller must hold openMu unless
+// the ShardedDB is being created, in which case shards are opened
+// concurrently.
+func (s *ShardedDB) openShard(i uint64) (*db, error) {
+	config := s.config
+	fs := config.FS
+	dir := fs.PathJoin(s.dirs[i], shardDirName(i))
+	lldir := ""
+	if len(s.lldirs) > 0 {
+		lldir = fs.PathJoin(s.lldirs[i], shardDirName(i))
+	}
+	sc := shardCallback{shard: i, f: s.callback}
+	shardFS := fs
+	var accounting *vfsutil.AccountingFS
+	if config.IOAccounting {
+		accounting = vfsutil.NewAccountingFS(fs)
+		shardFS = accounting
+	}
+	events := newEngineEvents(i, config.EngineEventListener)
+	if s.compactionLimiter != nil {
+		shardFS = vfsutil.NewRateLimitedFS(shardFS,
+			s.compactionLimiter, events.compactionOutput)
+	}
+	class := getStorageClass(config, dir)
+	config = tuneForStorageClass(config, class)
+	rec := ShardRecovery{Shard: i, Unclean: hasRunningMarker(dir, fs)}
+	sdir := dir
+	if len(lldir) > 0 {
+		sdir = lldir
+	}
+	events.progress = newOpenProgress(i, config.OpenProgressListener,
+		[]string{sdir, fs.PathJoin(sdir, stateStoreDirName)}, fs)
+	start := time.Now()
+	db, err := openRDB(config, sc.callback, events, dir, lldir, shardFS)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db.accounting = accounting
+	db.class = class
+	if db.batcher != nil {
+		db.batcher.shard = i
+	}
+	rec.OpenDuration = time.Since(start)
+	rec.ReplayedTables = len(db.kvs.event.replay.paths)
+	rec.ReplayedBytes = db.kvs.event.replay.bytes
+	if !config.ReadOnly {
+		if err := createRunningMarker(dir, fs); err != nil {
+			return nil, firstError(err, db.close())
+		}
+		db.marker, db.fs = dir, fs
+	}
+	if len(config.MirrorDir) > 0 && !config.ReadOnly {
+		mdir := fs.PathJoin(config.MirrorDir, shardDirName(i))
+		if err := db.kvs.startMirror(i, mdir, fs); err != nil {
+			return nil, firstError(err, db.close())
+		}
+	}
+	if config.ShippingStore != nil && !config.ReadOnly {
+		if err := db.kvs.startShipping(i,
+			config.ShippingStore, config.ShippingInterval); err != nil {
+			return nil, firstError(err, db.close())
+		}
+	}
+	if freeSpaceEnabled(config) {
+		s.checkFreeSpace(i, db)
+	}
+	if events.progress != nil {
+		events.progress.complete()
+	}
+	logRecovery(rec)
+	s.recoveryMu.Lock()
+	s.recovery.Shards = append(s.recovery.Shards, rec)
+	s.recovery.Unclean = s.recovery.Unclean || rec.Unclean
+	s.recoveryMu.Unlock()
+	s.shards[i] = db
+	atomic.StoreUint32(&s.opened[i], 1)
+	return db, nil
+}
+
+// Flush flushes the memtables of all shards to sstables, the WAL replayed
+// when the LogDB is opened next time is minimal if no write follows.
+func (s *ShardedDB) Flush() error {
+	if s.config.ReadOnly {
+		return errors.WithStack(pebble.ErrReadOnly)
+	}
+	for i, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		if err := shard.kvs.flush(); err != nil {
+			return errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	return nil
+}
+
+// RatchetFormat upgrades the pebble format major version of all shards to v,
+// shards already using v or a newer format are left unchanged. The upgrade
+// is irreversible and the shards can no longer be opened by releases not
+// supporting v.
+func (s *ShardedDB) RatchetFormat(v pebble.FormatMajorVersion) error {
+	if s.config.ReadOnly {
+		return errors.WithStack(pebble.ErrReadOnly)
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return err
+	}
+	for i, shard := range shards {
+		if err := shard.kvs.ratchetFormat(v); err != nil {
+			return errors.Wrapf(err, "shard %d", i)
+		}
+	}
+	return nil
+}
+
 // Name returns the type name of the instance.
 func (s *ShardedDB) Name() string {
-	return fmt.Sprintf("sharded-%s", s.shards[0].name())
+	return fmt.Sprintf("sharded-%s", s.anyShard().name())
 }
 
 // BinaryFormat is the binary format supported by the sharded DB.
 func (s *ShardedDB) BinaryFormat() uint32 {
-	return s.shards[0].binaryFormat()
+	return s.anyShard().binaryFormat()
+}
+
+// anyShard returns an opened shard, at least one shard is always opened by
+// OpenShardedDB.
+func (s *ShardedDB) anyShard() *db {
+	for _, shard := range s.openedShards() {
+		if shard != nil {
+			return shard
+		}
+	}
+	panic("no opened shard")
 }
 
 // SaveRaftState saves the raft state and logs found in the raft.Update list
@@ -150,28 +461,84 @@ func (s *ShardedDB) GetLogDBThreadContext() IContext {
 	return newContext(s.config.SaveBufferSize, s.config.MaxSaveBufferSize)
 }
 
+// AcquireContext returns an IContext instance from the context pool of the
+// specified shard ID, it must be returned using ReleaseContext once the
+// caller is done with it.
+func (s *ShardedDB) AcquireContext(shardID uint64) IContext {
+	if shardID-1 >= uint64(len(s.ctxPools)) {
+		plog.Panicf("invalid shardID %d, len(s.ctxPools): %d",
+			shardID, len(s.ctxPools))
+	}
+	return s.ctxPools[shardID-1].get()
+}
+
+// ReleaseContext resets the IContext instance acquired using AcquireContext
+// and returns it to its pool.
+func (s *ShardedDB) ReleaseContext(ctx IContext) {
+	c, ok := ctx.(*context)
+	if !ok || c.pool == nil {
+		panic("context not acquired from a pool")
+	}
+	c.pool.put(c)
+}
+
 // SaveRaftStateCtx saves the raft state and logs found in the raft.Update list
-// to the log db.
+// to the log db. When entries are rejected with ErrFreeSpaceCritical, the raft
+// states and snapshots of all updates are still saved, see
+// LogDBConfig.CriticalFreeSpace.
 func (s *ShardedDB) SaveRaftStateCtx(updates []pb.Update, ctx IContext) error {
 	if len(updates) == 0 {
 		return nil
 	}
-	p := s.getParititionID(updates)
-	return errors.WithStack(s.shards[p].saveRaftState(updates, ctx))
+	shard, err := s.shard(s.getParititionID(updates))
+	if err != nil {
+		return err
+	}
+	saved, err := shard.saveRaftState(updates, ctx)
+	s.watches.committed(saved)
+	return errors.WithStack(err)
+}
+
+// saveMaxIndexes is similar to SaveRaftState, the entries of the updates are
+// kept outside of the LogDB and only the max index of each node is saved, see
+// db.saveMaxIndexes.
+func (s *ShardedDB) saveMaxIndexes(updates []pb.Update,
+	maxIndexes []uint64, shardID uint64) error {
+	if shardID-1 >= uint64(len(s.ctxs)) {
+		plog.Panicf("invalid shardID %d, len(s.ctxs): %d", shardID, len(s.ctxs))
+	}
+	ctx := s.ctxs[shardID-1]
+	ctx.Reset()
+	shard, err := s.shard(s.getParititionID(updates))
+	if err != nil {
+		return err
+	}
+	if err := shard.saveMaxIndexes(updates, maxIndexes, ctx); err != nil {
+		return errors.WithStack(err)
+	}
+	s.watches.committed(updates)
+	return nil
 }
 
 // ReadRaftState returns the persistent state of the specified raft node.
 func (s *ShardedDB) ReadRaftState(clusterID uint64,
 	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
-	p := s.partitioner.GetPartitionID(clusterID)
-	rs, err := s.shards[p].readRaftState(clusterID, nodeID, lastIndex)
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	rs, err := shard.readRaftState(clusterID, nodeID, lastIndex)
 	return rs, errors.WithStack(err)
 }
 
 // ListNodeInfo lists all available NodeInfo found in the log db.
 func (s *ShardedDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	shards, err := s.allShards()
+	if err != nil {
+		return nil, err
+	}
 	r := make([]raftio.NodeInfo, 0)
-	for _, v := range s.shards {
+	for _, v := range shards {
 		n, err := v.listNodeInfo()
 		if err != nil {
 			return nil, errors.WithStack(err)
@@ -181,37 +548,114 @@ func (s *ShardedDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
 	return r, nil
 }
 
+// IterateNodeInfo invokes op for each NodeInfo found in the log db without
+// materializing the full list in memory. The iteration stops when op returns
+// false or an error.
+func (s *ShardedDB) IterateNodeInfo(op func(raftio.NodeInfo) (bool, error)) error {
+	shards, err := s.allShards()
+	if err != nil {
+		return err
+	}
+	for _, v := range shards {
+		stopped := false
+		if err := v.iterateNodeInfo(0, math.MaxUint64,
+			func(ni raftio.NodeInfo) (bool, error) {
+				cont, err := op(ni)
+				stopped = !cont
+				return cont, err
+			}); err != nil {
+			return errors.WithStack(err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// IterateClusterNodeInfo is similar to IterateNodeInfo, but only NodeInfo of
+// the specified cluster are visited. Only the shard owning the cluster is
+// scanned.
+func (s *ShardedDB) IterateClusterNodeInfo(clusterID uint64,
+	op func(raftio.NodeInfo) (bool, error)) error {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.iterateNodeInfo(clusterID, clusterID, op))
+}
+
 // SaveSnapshots saves all snapshot metadata found in the raft.Update list.
 func (s *ShardedDB) SaveSnapshots(updates []pb.Update) error {
 	if len(updates) == 0 {
 		return nil
 	}
-	p := s.getParititionID(updates)
-	return errors.WithStack(s.shards[p].saveSnapshots(updates))
+	shard, err := s.shard(s.getParititionID(updates))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.saveSnapshots(updates))
 }
 
 // GetSnapshot returns the most recent snapshot associated with the specified
 // cluster.
 func (s *ShardedDB) GetSnapshot(clusterID uint64,
 	nodeID uint64) (pb.Snapshot, error) {
-	p := s.partitioner.GetPartitionID(clusterID)
-	ss, err := s.shards[p].getSnapshot(clusterID, nodeID)
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	ss, err := shard.getSnapshot(clusterID, nodeID)
 	return ss, errors.WithStack(err)
 }
 
 // SaveBootstrapInfo saves the specified bootstrap info for the given node.
 func (s *ShardedDB) SaveBootstrapInfo(clusterID uint64,
 	nodeID uint64, bootstrap pb.Bootstrap) error {
-	p := s.partitioner.GetPartitionID(clusterID)
-	err := s.shards[p].saveBootstrapInfo(clusterID, nodeID, bootstrap)
-	return errors.WithStack(err)
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(shard.saveBootstrapInfo(clusterID, nodeID, bootstrap))
+}
+
+// BootstrapRecord is the bootstrap info of a node.
+type BootstrapRecord struct {
+	ClusterID uint64
+	NodeID    uint64
+	Bootstrap pb.Bootstrap
+}
+
+// SaveBootstrapInfos saves the bootstrap info of many nodes at once, e.g.
+// when creating a large number of clusters. Records of all nodes placed in
+// the same shard are committed in a single write batch, so only one fsync is
+// required per shard.
+func (s *ShardedDB) SaveBootstrapInfos(records []BootstrapRecord) error {
+	partitions := make(map[uint64][]BootstrapRecord)
+	for _, rec := range records {
+		p := s.partitioner.GetPartitionID(rec.ClusterID)
+		partitions[p] = append(partitions[p], rec)
+	}
+	for p, recs := range partitions {
+		shard, err := s.shard(p)
+		if err != nil {
+			return err
+		}
+		if err := shard.saveBootstrapInfos(recs); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
 }
 
 // GetBootstrapInfo returns the saved bootstrap info for the given node.
 func (s *ShardedDB) GetBootstrapInfo(clusterID uint64,
 	nodeID uint64) (pb.Bootstrap, error) {
-	p := s.partitioner.GetPartitionID(clusterID)
-	bs, err := s.shards[p].getBootstrapInfo(clusterID, nodeID)
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return pb.Bootstrap{}, err
+	}
+	bs, err := shard.getBootstrapInfo(clusterID, nodeID)
 	return bs, errors.WithStack(err)
 }
 
@@ -220,20 +664,46 @@ func (s *ShardedDB) GetBootstrapInfo(clusterID uint64,
 func (s *ShardedDB) IterateEntries(ents []pb.Entry,
 	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
 	maxSize uint64) ([]pb.Entry, uint64, error) {
-	p := s.partitioner.GetPartitionID(clusterID)
-	entries, sz, err := s.shards[p].iterateEntries(ents,
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, sz, err := shard.iterateEntries(nil, ents,
 		size, clusterID, nodeID, low, high, maxSize)
 	return entries, sz, errors.WithStack(err)
 }
 
+// ApproximateNodeSize returns the estimated on disk size of all entries of
+// the specified node in bytes.
+func (s *ShardedDB) ApproximateNodeSize(clusterID uint64,
+	nodeID uint64) (uint64, error) {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return 0, err
+	}
+	sz, err := shard.approximateNodeSize(clusterID, nodeID)
+	return sz, errors.WithStack(err)
+}
+
 // RemoveEntriesTo removes entries associated with the specified raft node up
 // to the specified index.
 func (s *ShardedDB) RemoveEntriesTo(clusterID uint64,
 	nodeID uint64, index uint64) error {
-	p := s.partitioner.GetPartitionID(clusterID)
-	if err := s.shards[p].removeEntriesTo(clusterID, nodeID, index); err != nil {
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	first, last, err := s.getRemovedRange(shard, clusterID, nodeID)
+	if err != nil {
 		return errors.WithStack(err)
 	}
+	if err := shard.removeEntriesTo(clusterID, nodeID, index); err != nil {
+		return errors.WithStack(err)
+	}
+	if index > last+1 {
+		index = last + 1
+	}
+	s.addDeletionCompaction(shard, clusterID, nodeID, first, index)
 	return nil
 }
 
@@ -247,26 +717,83 @@ func (s *ShardedDB) CompactEntriesTo(clusterID uint64,
 
 // RemoveNodeData deletes all node data that belongs to the specified node.
 func (s *ShardedDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
-	p := s.partitioner.GetPartitionID(clusterID)
-	return errors.WithStack(s.shards[p].removeNodeData(clusterID, nodeID))
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return err
+	}
+	first, last, err := s.getRemovedRange(shard, clusterID, nodeID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := shard.removeNodeData(clusterID, nodeID); err != nil {
+		return errors.WithStack(err)
+	}
+	s.addDeletionCompaction(shard, clusterID, nodeID, first, last+1)
+	return nil
+}
+
+// getRemovedRange returns the range of entries of the specified node that
+// can be removed, it is only looked up when deletion compactions are enabled.
+func (s *ShardedDB) getRemovedRange(shard *db,
+	clusterID uint64, nodeID uint64) (uint64, uint64, error) {
+	if s.config.DeletionCompactionThreshold == 0 {
+		return 0, 0, nil
+	}
+	return shard.entryIndexRange(clusterID, nodeID)
+}
+
+// addDeletionCompaction schedules a compaction of the removed entries in the
+// range of [first, end) when there are at least DeletionCompactionThreshold
+// such entries.
+func (s *ShardedDB) addDeletionCompaction(shard *db, clusterID uint64,
+	nodeID uint64, first uint64, end uint64) {
+	threshold := s.config.DeletionCompactionThreshold
+	if threshold == 0 || first == 0 || end <= first || end-first < threshold {
+		return
+	}
+	s.compactRemoved(shard, clusterID, nodeID, first, end)
+	atomic.AddUint64(&s.deletionCompactions, 1)
 }
 
 // ImportSnapshot imports the snapshot record and other metadata records to the
 // system.
 func (s *ShardedDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
-	p := s.partitioner.GetPartitionID(ss.ClusterId)
-	return errors.WithStack(s.shards[p].importSnapshot(ss, nodeID))
+	shard, err := s.shard(s.partitioner.GetPartitionID(ss.ClusterId))
+	if err != nil {
+		return err
+	}
+	if err := shard.importSnapshot(ss, nodeID); err != nil {
+		return errors.WithStack(err)
+	}
+	s.watches.imported(ss, nodeID)
+	return nil
 }
 
-// Close closes the ShardedDB instance.
-func (s *ShardedDB) Close() (err error) {
-	s.stopper.Stop()
-	for _, v := range s.shards {
+// Close closes the ShardedDB instance once all writes in progress and all
+// background jobs have completed, see CloseWithTimeout.
+func (s *ShardedDB) Close() error {
+	<-s.drain()
+	return s.close()
+}
+
+func (s *ShardedDB) close() (err error) {
+	atomic.StoreUint32(&s.closed, 1)
+	s.watches.close()
+	for _, v := range s.openedShards() {
+		if v == nil {
+			continue
+		}
+		if s.config.FlushOnClose && !s.config.ReadOnly {
+			err = firstError(err, errors.WithStack(v.kvs.flush()))
+		}
 		err = firstError(err, v.close())
 	}
 	for _, v := range s.ctxs {
 		v.Destroy()
 	}
+	for _, p := range s.ctxPools {
+		p.close()
+	}
 	return err
 }
 
@@ -322,8 +849,14 @@ func (s *ShardedDB) addCompaction(clusterID uint64,
 func (s *ShardedDB) compact() error {
 	for {
 		if t, hasTask := s.compactions.getTask(); hasTask {
-			idx := s.partitioner.GetPartitionID(t.clusterID)
-			shard := s.shards[idx]
+			shard, err := s.shard(s.partitioner.GetPartitionID(t.clusterID))
+			if errors.Is(err, ErrClosing) {
+				// shards not opened yet are not opened once closing
+				close(t.done)
+				return nil
+			} else if err != nil {
+				return err
+			}
 			if err := shard.compact(t.clusterID, t.nodeID, t.index); err != nil {
 				return err
 			}
@@ -0,0 +1,103 @@
+package pebble
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ShardInfo contains the inventory information of a single shard as returned
+// by ShardedDB.ShardInfo.
+type ShardInfo struct {
+	Shard uint64
+	// Dir is the directory of the shard, LowLatencyDir is the directory of
+	// its WAL and is empty when the WAL is kept in Dir.
+	Dir           string
+	LowLatencyDir string `json:",omitempty"`
+	// MirrorDir is the directory of the standby when mirroring is enabled.
+	MirrorDir string `json:",omitempty"`
+	// Clusters are the IDs of the clusters with at least one node
+	// bootstrapped in the shard, sorted in ascending order.
+	Clusters []uint64
+	// ApproximateSize is the disk space used by the shard in bytes.
+	ApproximateSize uint64
+	Open            bool
+	ReadOnly        bool
+	// Error describes the failure which made the shard unhealthy, e.g. a
+	// failed background sync, it is empty when the shard is healthy.
+	Error string `json:",omitempty"`
+}
+
+// Healthy returns a boolean value indicating whether the shard is open and
+// no failure has been observed.
+func (i ShardInfo) Healthy() bool {
+	return i.Open && len(i.Error) == 0
+}
+
+// ShardOf returns the number of the shard holding the records of the
+// specified cluster.
+func (s *ShardedDB) ShardOf(clusterID uint64) uint64 {
+	return s.partitioner.GetPartitionID(clusterID)
+}
+
+// ShardInfo returns the inventory information of all shards ordered by shard
+// number. Only directories are reported for shards not opened yet and once
+// the LogDB has been closed.
+func (s *ShardedDB) ShardInfo() ([]ShardInfo, error) {
+	fs := s.config.FS
+	closed := atomic.LoadUint32(&s.closed) == 1
+	result := make([]ShardInfo, 0, len(s.shards))
+	for i, shard := range s.openedShards() {
+		info := ShardInfo{
+			Shard:    uint64(i),
+			Dir:      fs.PathJoin(s.dirs[i], shardDirName(uint64(i))),
+			Open:     !closed && shard != nil,
+			ReadOnly: s.config.ReadOnly,
+		}
+		if len(s.lldirs) > 0 {
+			info.LowLatencyDir = fs.PathJoin(s.lldirs[i], shardDirName(uint64(i)))
+		}
+		if len(s.config.MirrorDir) > 0 && !s.config.ReadOnly {
+			info.MirrorDir = fs.PathJoin(s.config.MirrorDir, shardDirName(uint64(i)))
+		}
+		if info.Open {
+			if err := shard.shardInfo(uint64(i), &info); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (r *db) shardInfo(shard uint64, info *ShardInfo) error {
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return err
+	}
+	clusters := make(map[uint64]struct{})
+	for _, n := range ni {
+		clusters[n.ClusterID] = struct{}{}
+	}
+	info.Clusters = make([]uint64, 0, len(clusters))
+	for cid := range clusters {
+		info.Clusters = append(info.Clusters, cid)
+	}
+	sort.Slice(info.Clusters, func(i, j int) bool {
+		return info.Clusters[i] < info.Clusters[j]
+	})
+	info.ApproximateSize = r.kvs.db.Metrics().DiskSpaceUsage()
+	if r.kvs.state != nil {
+		info.ApproximateSize += r.kvs.state.db.Metrics().DiskSpaceUsage()
+	}
+	if err := r.kvs.syncFailure(); err != nil {
+		info.Error = err.Error()
+	} else if r.kvs.mirror != nil {
+		info.Error = r.kvs.mirror.stats(shard).Error
+	}
+	if len(info.Error) == 0 && r.kvs.shipper != nil {
+		info.Error = r.kvs.shipper.stats().Error
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardInfoReportsShards(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 1, 3, 10)
+	saveTestNode(t, db, 2, 1, 10)
+	infos, err := db.ShardInfo()
+	require.NoError(t, err)
+	require.Len(t, infos, int(cfg.Shards))
+	for i, info := range infos {
+		require.Equal(t, uint64(i), info.Shard)
+		require.Equal(t, fs.PathJoin(dir, shardDirName(uint64(i))), info.Dir)
+		require.Equal(t, fs.PathJoin(lldir, shardDirName(uint64(i))), info.LowLatencyDir)
+		require.True(t, info.Healthy())
+		require.False(t, info.ReadOnly)
+	}
+	p1 := db.partitioner.GetPartitionID(1)
+	p2 := db.partitioner.GetPartitionID(2)
+	require.Equal(t, []uint64{1}, infos[p1].Clusters)
+	require.Equal(t, []uint64{2}, infos[p2].Clusters)
+	require.NotZero(t, infos[p1].ApproximateSize)
+	require.Empty(t, infos[(p2+1)%cfg.Shards].Clusters)
+	require.NoError(t, db.Close())
+
+	infos, err = db.ShardInfo()
+	require.NoError(t, err)
+	require.False(t, infos[p1].Open)
+	require.False(t, infos[p1].Healthy())
+	require.Nil(t, infos[p1].Clusters)
+}
+
+func TestOpenClustersOpensShardsOnDemand(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 2, 1, 10)
+	require.NoError(t, db.Close())
+
+	cfg.OpenClusters = []uint64{1}
+	db, err = NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	p1 := db.partitioner.GetPartitionID(1)
+	p2 := db.partitioner.GetPartitionID(2)
+	infos, err := db.ShardInfo()
+	require.NoError(t, err)
+	for _, info := range infos {
+		require.Equal(t, info.Shard == p1, info.Open)
+	}
+	require.Len(t, db.RecoveryReport().Shards, 1)
+	rs, err := db.ReadRaftState(2, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	infos, err = db.ShardInfo()
+	require.NoError(t, err)
+	require.True(t, infos[p2].Open)
+	require.Equal(t, []uint64{2}, infos[p2].Clusters)
+	require.Len(t, db.RecoveryReport().Shards, 2)
+	ni, err := db.ListNodeInfo()
+	require.NoError(t, err)
+	require.Len(t, ni, 2)
+	require.Len(t, db.RecoveryReport().Shards, int(cfg.Shards))
+}
+
+func TestCompactionOfUnopenedShardStopsOnceClosing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.OpenClusters = []uint64{1}
+	dirs := []string{RDBTestDirectory}
+	db, err := NewLogDB(cfg, nil, dirs, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NotEqual(t, db.partitioner.GetPartitionID(1), db.partitioner.GetPartitionID(2))
+	db.openMu.Lock()
+	db.closing = true
+	db.openMu.Unlock()
+	// the task is queued without waking up the compaction worker
+	done := db.compactions.addTask(task{clusterID: 2, nodeID: 1, index: 10})
+	require.NoError(t, db.compact())
+	select {
+	case <-done:
+	default:
+		t.Fatalf("done chan not closed")
+	}
+}
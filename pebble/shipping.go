@@ -0,0 +1,470 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/goutils/syncutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// defaultShippingInterval is the interval of uploading segments when
+// LogDBConfig.ShippingInterval is not set.
+const defaultShippingInterval = time.Second
+
+// ErrInvalidSegment indicates that a shipped segment is corrupted or has
+// unsupported format.
+var ErrInvalidSegment = errors.New("invalid shipped segment")
+
+var legacySegmentFormat = streamFormat{
+	magic:   [8]byte{'T', 'G', 'B', 'S', 'H', 'I', 'P', 0},
+	version: 1,
+	invalid: ErrInvalidSegment,
+}
+
+// ObjectStore is the object storage shipped segments are uploaded to, e.g. an
+// adapter of a S3 or GCS bucket. Object names are slash separated paths.
+type ObjectStore interface {
+	// Put durably stores the object, an existing object with the same name is
+	// replaced.
+	Put(name string, data []byte) error
+	// Get returns the content of the object.
+	Get(name string) ([]byte, error)
+	// List returns the names of all objects with the specified prefix.
+	List(prefix string) ([]string, error)
+}
+
+// FSObjectStore is an ObjectStore keeping objects as files in a directory,
+// e.g. on a network file system.
+type FSObjectStore struct {
+	fs  vfs.FS
+	dir string
+}
+
+var _ ObjectStore = (*FSObjectStore)(nil)
+
+// NewFSObjectStore returns an ObjectStore keeping objects in dir.
+func NewFSObjectStore(fs vfs.FS, dir string) *FSObjectStore {
+	return &FSObjectStore{fs: fs, dir: dir}
+}
+
+func (s *FSObjectStore) path(name string) string {
+	return s.fs.PathJoin(append([]string{s.dir}, strings.Split(name, "/")...)...)
+}
+
+// Put stores the object, it is written to a temporary file renamed once
+// synced.
+func (s *FSObjectStore) Put(name string, data []byte) error {
+	fp := s.path(name)
+	dir := s.fs.PathDir(fp)
+	if err := fileutil.MkdirAll(dir, s.fs); err != nil {
+		return err
+	}
+	tmp := fp + ".tmp"
+	f, err := s.fs.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return firstError(errors.WithStack(err), f.Close())
+	}
+	if err := firstError(f.Sync(), f.Close()); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := s.fs.Rename(tmp, fp); err != nil {
+		return errors.WithStack(err)
+	}
+	return fileutil.SyncDir(dir, s.fs)
+}
+
+// Get returns the content of the object.
+func (s *FSObjectStore) Get(name string) (data []byte, err error) {
+	f, err := s.fs.Open(s.path(name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		err = firstError(err, f.Close())
+	}()
+	data, err = io.ReadAll(f)
+	return data, errors.WithStack(err)
+}
+
+// List returns the names of all objects with the specified prefix, only the
+// directory of the prefix is searched.
+func (s *FSObjectStore) List(prefix string) ([]string, error) {
+	sub := ""
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		sub = prefix[:idx+1]
+	}
+	names, err := s.fs.List(s.path(sub))
+	if err != nil {
+		if _, serr := s.fs.Stat(s.path(sub)); serr != nil {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var result []string
+	for _, n := range names {
+		if name := sub + n; strings.HasPrefix(name, prefix) && !strings.HasSuffix(n, ".tmp") {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Segment is a shipped object covering write batches of a shard with sequence
+// numbers in the range of [First, Next).
+type Segment struct {
+	Shard uint64
+	First uint64
+	Next  uint64
+	Name  string
+}
+
+func segmentPrefix(shard uint64) string {
+	return fmt.Sprintf("%s/", shardDirName(shard))
+}
+
+func segmentName(shard uint64, first uint64, next uint64) string {
+	return fmt.Sprintf("%s%020d-%020d.seg", segmentPrefix(shard), first, next)
+}
+
+// ListSegments returns the segments of the shard found in the store in the
+// order of their sequence numbers.
+func ListSegments(store ObjectStore, shard uint64) ([]Segment, error) {
+	prefix := segmentPrefix(shard)
+	names, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Segment, 0, len(names))
+	for _, n := range names {
+		var first, next uint64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(n, prefix),
+			"%020d-%020d.seg", &first, &next); err != nil {
+			continue
+		}
+		result = append(result, Segment{Shard: shard, First: first, Next: next, Name: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].First < result[j].First
+	})
+	return result, nil
+}
+
+// ShippedBatch is a write batch read from a shipped segment.
+type ShippedBatch struct {
+	Seq       uint64
+	Committed time.Time
+	Data      []byte
+}
+
+// encodeSegment encodes the write batches of the shard as a replication
+// stream, see StreamFrame for details of the format.
+func encodeSegment(shard uint64, batches []ShippedBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	e, err := NewStreamEncoder(&buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range batches {
+		if err := e.Encode(StreamFrame{
+			Shard:     shard,
+			Seq:       b.Seq,
+			Committed: b.Committed,
+			Data:      b.Data,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeSegment decodes the write batches of a shipped segment, checksums of
+// all write batches are verified. Segments are replication streams, segments
+// shipped by earlier versions are also supported.
+func DecodeSegment(data []byte) ([]ShippedBatch, error) {
+	if bytes.HasPrefix(data, legacySegmentFormat.magic[:]) {
+		return decodeLegacySegment(data)
+	}
+	d, err := NewStreamDecoder(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidSegment, "%v", err)
+	}
+	var result []ShippedBatch
+	for {
+		f, err := d.Decode()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidSegment, "%v", err)
+		}
+		result = append(result, ShippedBatch{
+			Seq:       f.Seq,
+			Committed: f.Committed,
+			Data:      f.Data,
+		})
+	}
+}
+
+func decodeLegacySegment(data []byte) ([]ShippedBatch, error) {
+	rr, err := newRecordReader(bytes.NewReader(data), legacySegmentFormat)
+	if err != nil {
+		return nil, err
+	}
+	var result []ShippedBatch
+	for {
+		key, value, ok, err := rr.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return result, nil
+		}
+		if len(key) != 16 {
+			return nil, errors.Wrapf(ErrInvalidSegment, "key size %d", len(key))
+		}
+		result = append(result, ShippedBatch{
+			Seq:       binary.BigEndian.Uint64(key),
+			Committed: time.Unix(0, int64(binary.BigEndian.Uint64(key[8:]))),
+			Data:      value,
+		})
+	}
+}
+
+// ShippingStats contains the statistics of shipping a shard.
+type ShippingStats struct {
+	Shard uint64
+	// Pending is the number of committed write batches not yet uploaded.
+	Pending      int
+	PendingBytes uint64
+	Segments     uint64
+	ShippedBytes uint64
+	// Next is the sequence number following the last uploaded write batch.
+	Next uint64
+	// Lag is the age of the oldest write batch not yet uploaded.
+	Lag time.Duration
+	// Error is the last upload error, cleared once an upload succeeds.
+	Error string `json:",omitempty"`
+}
+
+type shippedBatch struct {
+	ShippedBatch
+	count uint32
+}
+
+// shipper asynchronously uploads committed write batches of a shard to the
+// object store in segments. Failed uploads are retried, pending batches are
+// queued in memory.
+type shipper struct {
+	shard        uint64
+	store        ObjectStore
+	interval     time.Duration
+	stopper      *syncutil.Stopper
+	mu           sync.Mutex
+	queue        []shippedBatch
+	pendingBytes uint64
+	// next is the sequence number of the next committed write batch
+	next         uint64
+	shipped      uint64
+	segments     uint64
+	shippedBytes uint64
+	err          error
+}
+
+// startShipping starts shipping all later writes of the shard to the store.
+func (r *KV) startShipping(shard uint64,
+	store ObjectStore, interval time.Duration) error {
+	if interval <= 0 {
+		interval = defaultShippingInterval
+	}
+	// an empty batch reveals the sequence number of the next write
+	wb := r.db.NewBatch()
+	defer func() {
+		if err := wb.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := wb.LogData(nil, nil); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.db.Apply(wb, r.wo); err != nil {
+		return errors.WithStack(err)
+	}
+	next := wb.SeqNum()
+	segments, err := ListSegments(store, shard)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		if last := segments[len(segments)-1].Next; last != next {
+			plog.Warningf("shipped log of shard %d ends at %d, shard continues at %d, "+
+				"take a new backup for point in time recovery", shard, last, next)
+		}
+	}
+	s := &shipper{
+		shard:    shard,
+		store:    store,
+		interval: interval,
+		stopper:  syncutil.NewStopper(),
+		next:     next,
+		shipped:  next,
+	}
+	s.stopper.RunWorker(func() {
+		withShardLabels("shipper", shard, s.workerMain)
+	})
+	r.shipper = s
+	return nil
+}
+
+func (s *shipper) enqueue(wb *pebble.Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wb.Count() == 0 {
+		return
+	}
+	s.queue = append(s.queue, shippedBatch{
+		ShippedBatch: ShippedBatch{
+			Seq:       wb.SeqNum(),
+			Committed: time.Now(),
+			Data:      append([]byte(nil), wb.Repr()...),
+		},
+		count: wb.Count(),
+	})
+	s.pendingBytes += uint64(len(wb.Repr()))
+	s.next = wb.SeqNum() + uint64(wb.Count())
+}
+
+// nextSeq returns the sequence number of the next committed write batch.
+func (s *shipper) nextSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+func (s *shipper) workerMain() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			// pending batches are uploaded before the shard is closed
+			if err := s.upload(); err != nil {
+				plog.Errorf("shard %d failed to ship pending batches: %v", s.shard, err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.upload(); err != nil {
+				plog.Warningf("shard %d failed to ship batches: %v", s.shard, err)
+			}
+		}
+	}
+}
+
+// upload ships all pending batches as a single segment.
+func (s *shipper) upload() error {
+	s.mu.Lock()
+	pending := s.queue
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	batches := make([]ShippedBatch, 0, len(pending))
+	size := uint64(0)
+	for _, b := range pending {
+		batches = append(batches, b.ShippedBatch)
+		size += uint64(len(b.Data))
+	}
+	last := pending[len(pending)-1]
+	next := last.Seq + uint64(last.count)
+	data, err := encodeSegment(s.shard, batches)
+	if err == nil {
+		err = s.store.Put(segmentName(s.shard, pending[0].Seq, next), data)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.err = err
+		return err
+	}
+	s.err = nil
+	s.queue = s.queue[len(pending):]
+	s.pendingBytes -= size
+	s.shipped = next
+	s.segments++
+	s.shippedBytes += uint64(len(data))
+	return nil
+}
+
+func (s *shipper) stats() ShippingStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := ShippingStats{
+		Shard:        s.shard,
+		Pending:      len(s.queue),
+		PendingBytes: s.pendingBytes,
+		Segments:     s.segments,
+		ShippedBytes: s.shippedBytes,
+		Next:         s.shipped,
+	}
+	if len(s.queue) > 0 {
+		st.Lag = time.Since(s.queue[0].Committed)
+	}
+	if s.err != nil {
+		st.Error = s.err.Error()
+	}
+	return st
+}
+
+func (s *shipper) close() {
+	s.stopper.Stop()
+}
+
+// ShippingStats returns the shipping statistics of all shards, nil is returned
+// when shipping is not enabled.
+func (s *ShardedDB) ShippingStats() []ShippingStats {
+	var result []ShippingStats
+	for _, shard := range s.openedShards() {
+		if shard == nil {
+			continue
+		}
+		if sp := shard.kvs.shipper; sp != nil {
+			result = append(result, sp.stats())
+		}
+	}
+	return result
+}
+
+// checkpoint creates a point in time copy of the shard in dir. When shipping
+// is enabled, it returns the sequence number of the first write batch not
+// included in the copy.
+func (r *KV) checkpoint(dir string) (uint64, error) {
+	if r.state != nil {
+		return 0, errors.WithStack(ErrStateStoreUnsupported)
+	}
+	if r.shipper == nil {
+		return 0, errors.WithStack(r.db.Checkpoint(dir, pebble.WithFlushedWAL()))
+	}
+	// no batch can be committed while the copy is being created
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.db.Checkpoint(dir, pebble.WithFlushedWAL()); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return r.shipper.nextSeq(), nil
+}
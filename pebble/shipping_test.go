@@ -0,0 +1,132 @@
+package pebble
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type flakyObjectStore struct {
+	ObjectStore
+	mu       sync.Mutex
+	failures int
+}
+
+func (s *flakyObjectStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("store unavailable")
+	}
+	return s.ObjectStore.Put(name, data)
+}
+
+func TestFSObjectStore(t *testing.T) {
+	fs := vfs.NewMem()
+	s := NewFSObjectStore(fs, "store")
+	names, err := s.List("a/")
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.NoError(t, s.Put("a/2", []byte("v2")))
+	require.NoError(t, s.Put("a/1", []byte("v0")))
+	require.NoError(t, s.Put("a/1", []byte("v1")))
+	require.NoError(t, s.Put("b/1", []byte("v3")))
+	names, err = s.List("a/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1", "a/2"}, names)
+	data, err := s.Get("a/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), data)
+	_, err = s.Get("a/3")
+	require.Error(t, err)
+}
+
+func TestShippedSegmentsAreContiguous(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	store := &flakyObjectStore{ObjectStore: NewFSObjectStore(fs, "store"), failures: 2}
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 2
+	cfg.ShippingStore = store
+	cfg.ShippingInterval = time.Millisecond
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 1, 10)
+	m, err := db.Backup("backup")
+	require.NoError(t, err)
+	require.Len(t, m.Sequences, 2)
+	saveTestNode(t, db, 2, 1, 20)
+	require.NoError(t, db.RemoveEntriesTo(2, 1, 5))
+	require.Eventually(t, func() bool {
+		for _, st := range db.ShippingStats() {
+			if st.Pending > 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	require.NotNil(t, stats.Shards[0].Shipping)
+	store.mu.Lock()
+	require.Equal(t, 0, store.failures)
+	store.mu.Unlock()
+	shipped := false
+	// pending batches are uploaded when closed
+	saveTestNode(t, db, 3, 1, 5)
+	next := make([]uint64, 2)
+	for _, st := range db.ShippingStats() {
+		shipped = shipped || st.Segments > 0
+		next[st.Shard] = db.shards[st.Shard].kvs.shipper.nextSeq()
+	}
+	require.True(t, shipped)
+	require.NoError(t, db.Close())
+
+	for shard := uint64(0); shard < 2; shard++ {
+		segments, err := ListSegments(store, shard)
+		require.NoError(t, err)
+		require.NotEmpty(t, segments)
+		covered := false
+		for i, seg := range segments {
+			if i > 0 {
+				require.Equal(t, segments[i-1].Next, seg.First)
+			}
+			covered = covered || (seg.First <= m.Sequences[shard] && m.Sequences[shard] < seg.Next)
+			data, err := store.Get(seg.Name)
+			require.NoError(t, err)
+			batches, err := DecodeSegment(data)
+			require.NoError(t, err)
+			require.NotEmpty(t, batches)
+			require.Equal(t, seg.First, batches[0].Seq)
+			for j := 1; j < len(batches); j++ {
+				require.True(t, batches[j].Seq > batches[j-1].Seq)
+				require.False(t, batches[j].Committed.Before(batches[j-1].Committed))
+			}
+			data[len(data)/2] ^= 0xFF
+			_, err = DecodeSegment(data)
+			require.True(t, errors.Is(err, ErrInvalidSegment))
+		}
+		require.Equal(t, next[shard], segments[len(segments)-1].Next)
+		require.True(t, covered || m.Sequences[shard] == segments[len(segments)-1].Next)
+	}
+
+	// shipping resumes where it stopped once reopened
+	db, err = NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 4, 1, 5)
+	require.NoError(t, db.Close())
+	for shard := uint64(0); shard < 2; shard++ {
+		segments, err := ListSegments(store, shard)
+		require.NoError(t, err)
+		for i := 1; i < len(segments); i++ {
+			require.Equal(t, segments[i-1].Next, segments[i].First)
+		}
+	}
+}
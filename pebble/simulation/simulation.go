@@ -0,0 +1,379 @@
+/*
+Package simulation provides a deterministic simulation harness for the pebble
+based LogDB. A simulation drives a LogDB instance running on a strict
+in-memory FS through a randomized sequence of saves, snapshots, trims, imports,
+restarts and crashes derived from a seed. The stored data is checked against
+an in-memory model after every step, failures can be reproduced by running
+the simulation again using the same seed.
+*/
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/invariants"
+	"github.com/coufalja/tugboat-logdb/pebble/testutil"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxEntriesPerSave = 8
+	maxEntrySize      = 64
+)
+
+// Config is the configuration of a simulation.
+type Config struct {
+	// Seed is the seed of the random number generator.
+	Seed int64
+	// Steps is the number of steps to run.
+	Steps int
+	// Nodes is the number of raft nodes stored in the LogDB.
+	Nodes int
+	// LogDB is the configuration of the simulated LogDB, its FS is replaced by
+	// a strict in-memory FS.
+	LogDB pebble.LogDBConfig
+}
+
+// DefaultConfig returns a simulation config using the specified seed.
+func DefaultConfig(seed int64) Config {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.Shards = 4
+	return Config{
+		Seed:  seed,
+		Steps: 1000,
+		Nodes: 8,
+		LogDB: cfg,
+	}
+}
+
+// node is the model of the data expected to be stored for a raft node.
+type node struct {
+	clusterID uint64
+	nodeID    uint64
+	// first is the lowest index not yet removed from a contiguous range of
+	// entries ending at last.
+	first uint64
+	last  uint64
+	// written is the highest index ever written, stale entries above last
+	// might still be stored.
+	written  uint64
+	snapshot uint64
+	terms    map[uint64]uint64
+	state    pb.State
+}
+
+type op struct {
+	name   string
+	weight int
+	f      func(s *Simulation, n *node) error
+}
+
+var ops = []op{
+	{"save", 50, (*Simulation).save},
+	{"snapshot", 15, (*Simulation).saveSnapshot},
+	{"trim", 15, (*Simulation).trim},
+	{"import", 3, (*Simulation).importSnapshot},
+	{"restart", 5, (*Simulation).restart},
+	{"crash", 12, (*Simulation).crash},
+}
+
+// Simulation is a deterministic LogDB simulation.
+type Simulation struct {
+	cfg   Config
+	rnd   *rand.Rand
+	db    *testutil.CrashTestDB
+	nodes []*node
+	steps int
+}
+
+// New creates a simulation and opens its LogDB.
+func New(cfg Config) (*Simulation, error) {
+	if cfg.Nodes <= 0 {
+		return nil, errors.New("no node to simulate")
+	}
+	db, err := testutil.NewCrashTestDB(cfg.LogDB, []string{"db"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulation{
+		cfg: cfg,
+		rnd: rand.New(rand.NewSource(cfg.Seed)),
+		db:  db,
+	}
+	for i := 0; i < cfg.Nodes; i++ {
+		n := &node{
+			clusterID: uint64(i + 1),
+			nodeID:    uint64(i%3 + 1),
+			first:     1,
+			terms:     make(map[uint64]uint64),
+		}
+		bs := pb.Bootstrap{Join: true, Type: pb.RegularStateMachine}
+		if err := db.DB().SaveBootstrapInfo(n.clusterID, n.nodeID, bs); err != nil {
+			return nil, firstError(err, db.Close())
+		}
+		s.nodes = append(s.nodes, n)
+	}
+	return s, nil
+}
+
+// Run runs the configured number of steps and closes the simulation.
+func (s *Simulation) Run() (err error) {
+	defer func() {
+		err = firstError(err, s.Close())
+	}()
+	for i := 0; i < s.cfg.Steps; i++ {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Step executes a single randomly selected operation and checks the stored
+// data of all nodes afterwards.
+func (s *Simulation) Step() error {
+	s.steps++
+	o := s.selectOp()
+	n := s.nodes[s.rnd.Intn(len(s.nodes))]
+	if err := o.f(s, n); err != nil {
+		return s.wrap(err, "%s %s failed", o.name, dn(n))
+	}
+	for _, n := range s.nodes {
+		if err := s.check(n); err != nil {
+			return s.wrap(err, "invariant violated after %s", o.name)
+		}
+	}
+	return nil
+}
+
+// Close closes the simulated LogDB.
+func (s *Simulation) Close() error {
+	return s.db.Close()
+}
+
+func (s *Simulation) wrap(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return errors.Wrapf(err, "seed %d, step %d, %s", s.cfg.Seed, s.steps, msg)
+}
+
+func (s *Simulation) selectOp() op {
+	total := 0
+	for _, o := range ops {
+		total += o.weight
+	}
+	v := s.rnd.Intn(total)
+	for _, o := range ops {
+		if v < o.weight {
+			return o
+		}
+		v -= o.weight
+	}
+	panic("not suppose to reach here")
+}
+
+// save appends new entries, possibly overwriting uncommitted ones, and
+// advances the commit index.
+func (s *Simulation) save(n *node) error {
+	start := n.state.Commit + 1 + uint64(s.rnd.Int63n(int64(n.last-n.state.Commit+1)))
+	count := uint64(s.rnd.Intn(maxEntriesPerSave) + 1)
+	term := n.state.Term + uint64(s.rnd.Intn(2))
+	if term == 0 {
+		term = 1
+	}
+	ents := make([]pb.Entry, 0, count)
+	for i := start; i < start+count; i++ {
+		ents = append(ents, pb.Entry{
+			Index: i,
+			Term:  term,
+			Cmd:   make([]byte, s.rnd.Intn(maxEntrySize)),
+		})
+	}
+	last := start + count - 1
+	state := pb.State{
+		Term:   term,
+		Vote:   n.nodeID,
+		Commit: n.state.Commit + uint64(s.rnd.Int63n(int64(last-n.state.Commit+1))),
+	}
+	ud := pb.Update{
+		ClusterID:     n.clusterID,
+		NodeID:        n.nodeID,
+		State:         state,
+		EntriesToSave: ents,
+	}
+	db := s.db.DB()
+	if err := db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()); err != nil {
+		return err
+	}
+	for i := last + 1; i <= n.last; i++ {
+		delete(n.terms, i)
+	}
+	for _, e := range ents {
+		n.terms[e.Index] = e.Term
+	}
+	n.last = last
+	if last > n.written {
+		n.written = last
+	}
+	n.state = state
+	return nil
+}
+
+// saveSnapshot records a snapshot of a committed index.
+func (s *Simulation) saveSnapshot(n *node) error {
+	if n.state.Commit <= n.snapshot {
+		return nil
+	}
+	index := n.snapshot + 1 + uint64(s.rnd.Int63n(int64(n.state.Commit-n.snapshot)))
+	ss := pb.Snapshot{
+		ClusterId: n.clusterID,
+		Index:     index,
+		Term:      n.terms[index],
+		Type:      pb.RegularStateMachine,
+	}
+	ud := pb.Update{ClusterID: n.clusterID, NodeID: n.nodeID, Snapshot: ss}
+	if err := s.db.DB().SaveSnapshots([]pb.Update{ud}); err != nil {
+		return err
+	}
+	n.snapshot = index
+	return nil
+}
+
+// trim removes all entries before the latest snapshot.
+func (s *Simulation) trim(n *node) error {
+	if n.snapshot <= n.first {
+		return nil
+	}
+	if err := s.db.DB().RemoveEntriesTo(n.clusterID, n.nodeID, n.snapshot); err != nil {
+		return err
+	}
+	for i := n.first; i < n.snapshot; i++ {
+		delete(n.terms, i)
+	}
+	n.first = n.snapshot
+	return nil
+}
+
+// importSnapshot imports a snapshot ahead of all stored entries, as done when
+// a node is repaired using an exported snapshot. Imports are done offline so
+// the LogDB is restarted around it.
+func (s *Simulation) importSnapshot(n *node) error {
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	if err := s.db.Restart(); err != nil {
+		return err
+	}
+	index := n.written + uint64(s.rnd.Intn(maxEntriesPerSave)+1)
+	ss := pb.Snapshot{
+		ClusterId: n.clusterID,
+		Index:     index,
+		Term:      n.state.Term + 1,
+		Type:      pb.RegularStateMachine,
+	}
+	if err := s.db.DB().ImportSnapshot(ss, n.nodeID); err != nil {
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	if err := s.db.Restart(); err != nil {
+		return err
+	}
+	n.terms = make(map[uint64]uint64)
+	n.first = index + 1
+	n.last = index
+	n.written = index
+	n.snapshot = index
+	n.state = pb.State{Term: ss.Term, Commit: index}
+	return nil
+}
+
+// restart closes the LogDB cleanly and opens it again.
+func (s *Simulation) restart(n *node) error {
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return s.db.Restart()
+}
+
+// crash simulates a power failure and opens the LogDB again. All saved data
+// is expected to survive as all updates are synced.
+func (s *Simulation) crash(n *node) error {
+	s.db.Crash()
+	return s.db.Restart()
+}
+
+func (s *Simulation) check(n *node) error {
+	db := s.db.DB()
+	violations, err := invariants.CheckNode(db, n.clusterID, n.nodeID)
+	if err != nil {
+		return errors.Wrapf(err, "%s failed to check invariants", dn(n))
+	}
+	if len(violations) > 0 {
+		return errors.Errorf("%v", violations)
+	}
+	if n.last == 0 {
+		return nil
+	}
+	rs, err := db.ReadRaftState(n.clusterID, n.nodeID, n.snapshot)
+	if err != nil {
+		return errors.Wrapf(err, "%s failed to read raft state", dn(n))
+	}
+	if !pb.IsStateEqual(rs.State, n.state) {
+		return errors.Errorf("%s state %v, want %v", dn(n), rs.State, n.state)
+	}
+	first, count := n.snapshot, uint64(0)
+	if n.last > n.snapshot {
+		if n.first > n.snapshot {
+			first = n.first
+		}
+		count = n.last - first + 1
+	}
+	if rs.FirstIndex != first || rs.EntryCount != count {
+		return errors.Errorf("%s first index %d, entry count %d, want %d, %d",
+			dn(n), rs.FirstIndex, rs.EntryCount, first, count)
+	}
+	if n.snapshot > 0 {
+		ss, err := db.GetSnapshot(n.clusterID, n.nodeID)
+		if err != nil {
+			return errors.Wrapf(err, "%s failed to get snapshot", dn(n))
+		}
+		if ss.Index != n.snapshot {
+			return errors.Errorf("%s snapshot index %d, want %d",
+				dn(n), ss.Index, n.snapshot)
+		}
+	}
+	if n.first > n.last {
+		return nil
+	}
+	ents, _, err := db.IterateEntries(nil, 0, n.clusterID, n.nodeID,
+		n.first, n.last+1, ^uint64(0))
+	if err != nil {
+		return errors.Wrapf(err, "%s failed to iterate entries", dn(n))
+	}
+	if uint64(len(ents)) != n.last-n.first+1 {
+		return errors.Errorf("%s got %d entries, want %d",
+			dn(n), len(ents), n.last-n.first+1)
+	}
+	for _, e := range ents {
+		if e.Term != n.terms[e.Index] {
+			return errors.Errorf("%s entry %d term %d, want %d",
+				dn(n), e.Index, e.Term, n.terms[e.Index])
+		}
+	}
+	return nil
+}
+
+func dn(n *node) string {
+	return fmt.Sprintf("[%05d:%05d]", n.clusterID, n.nodeID)
+}
+
+func firstError(err1 error, err2 error) error {
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -0,0 +1,21 @@
+package simulation
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	for seed := int64(1); seed <= 5; seed++ {
+		cfg := DefaultConfig(seed)
+		if testing.Short() {
+			cfg.Steps = 100
+		}
+		s, err := New(cfg)
+		require.NoError(t, err)
+		require.NoError(t, s.Run())
+	}
+}
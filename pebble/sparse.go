@@ -0,0 +1,153 @@
+package pebble
+
+import (
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+)
+
+// sparseIndexInterval is the number of entries covered by each block of the
+// sparse index.
+const sparseIndexInterval = 256
+
+// sparseIndex is the in-memory sparse index of the entries of a node. It
+// records the total size of each block of sparseIndexInterval entries fully
+// recorded since the LogDB was opened and the index of the first entry once
+// it has been located, allowing iterate to bound its reads by maxSize and
+// getRange to answer without seeking.
+type sparseIndex struct {
+	// first is the index of the first entry, it is unknown when 0.
+	first uint64
+	// blocks maps block numbers to the total size of their entries.
+	blocks map[uint64]uint64
+	// next is the index of the next entry expected to be recorded.
+	next uint64
+	// size is the size of the partially recorded block, it is only valid
+	// when the recording of the block started from its first entry.
+	size  uint64
+	valid bool
+}
+
+func newSparseIndex() *sparseIndex {
+	return &sparseIndex{blocks: make(map[uint64]uint64)}
+}
+
+func (s *sparseIndex) record(index uint64, sz uint64) {
+	if index != s.next {
+		// entries from index are overwritten
+		for b := range s.blocks {
+			if b >= index/sparseIndexInterval {
+				delete(s.blocks, b)
+			}
+		}
+		s.valid = index%sparseIndexInterval == 0
+		s.size = 0
+	}
+	if s.first > 0 && index < s.first {
+		s.first = index
+	}
+	s.size += sz
+	s.next = index + 1
+	if s.next%sparseIndexInterval == 0 {
+		if s.valid {
+			s.blocks[index/sparseIndexInterval] = s.size
+		}
+		s.valid = true
+		s.size = 0
+	}
+}
+
+func (s *sparseIndex) removeTo(index uint64) {
+	for b := range s.blocks {
+		if b*sparseIndexInterval < index {
+			delete(s.blocks, b)
+		}
+	}
+	if s.next > 0 && (s.next-1)/sparseIndexInterval*sparseIndexInterval < index {
+		s.valid = false
+	}
+	if s.first > 0 && index > s.first {
+		s.first = index
+	}
+}
+
+// bound returns the index h no greater than high such that entries in the
+// range of [low, h) are known to be larger than maxSize - size in total.
+func (s *sparseIndex) bound(low uint64,
+	high uint64, size uint64, maxSize uint64) uint64 {
+	for b := low/sparseIndexInterval + 1; b*sparseIndexInterval < high; b++ {
+		sz, ok := s.blocks[b]
+		if !ok {
+			return high
+		}
+		size += sz
+		if size > maxSize {
+			if h := (b + 1) * sparseIndexInterval; h < high {
+				return h
+			}
+			return high
+		}
+	}
+	return high
+}
+
+func (r *cache) getSparseIndex(clusterID uint64, nodeID uint64) *sparseIndex {
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	v, ok := r.sparse[key]
+	if !ok {
+		v = newSparseIndex()
+		r.sparse[key] = v
+	}
+	return v
+}
+
+func (r *cache) recordEntries(clusterID uint64,
+	nodeID uint64, entries []pb.Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.getSparseIndex(clusterID, nodeID)
+	for i := range entries {
+		s.record(entries[i].Index, uint64(entries[i].SizeUpperLimit()))
+	}
+}
+
+func (r *cache) removeEntriesTo(clusterID uint64, nodeID uint64, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	if s, ok := r.sparse[key]; ok {
+		s.removeTo(index)
+	}
+}
+
+func (r *cache) dropSparseIndex(clusterID uint64, nodeID uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sparse, raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID})
+}
+
+func (r *cache) setFirstIndex(clusterID uint64, nodeID uint64, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.getSparseIndex(clusterID, nodeID).first = index
+}
+
+func (r *cache) getFirstIndex(clusterID uint64, nodeID uint64) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	if s, ok := r.sparse[key]; ok {
+		return s.first
+	}
+	return 0
+}
+
+func (r *cache) boundBySize(clusterID uint64, nodeID uint64,
+	low uint64, high uint64, size uint64, maxSize uint64) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	if s, ok := r.sparse[key]; ok {
+		return s.bound(low, high, size, maxSize)
+	}
+	return high
+}
@@ -0,0 +1,87 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparseIndexBlocks(t *testing.T) {
+	n := uint64(sparseIndexInterval)
+	s := newSparseIndex()
+	for i := n / 2; i < 4*n; i++ {
+		s.record(i, 10)
+	}
+	require.Len(t, s.blocks, 3)
+	require.Equal(t, 10*n, s.blocks[1])
+	require.Equal(t, 2*n, s.bound(n/2, 4*n, 0, 10*n-1))
+	require.Equal(t, 3*n, s.bound(n/2, 4*n, 0, 10*n))
+	require.Equal(t, 3*n, s.bound(n/2, 4*n, 0, 20*n-1))
+	require.Equal(t, 4*n, s.bound(n/2, 4*n, 0, 20*n))
+	require.Equal(t, 3*n, s.bound(n/2, 4*n, 10, 20*n))
+	// overwritten entries invalidate blocks
+	s.record(2*n+1, 10)
+	require.Len(t, s.blocks, 1)
+	require.Equal(t, 4*n, s.bound(n/2, 4*n, 0, 20*n-1))
+	for i := 2*n + 2; i < 5*n; i++ {
+		s.record(i, 10)
+	}
+	require.Len(t, s.blocks, 3)
+	s.removeTo(3*n + 1)
+	require.Len(t, s.blocks, 1)
+	require.Equal(t, uint64(0), s.first)
+	s.first = 3 * n
+	s.removeTo(3*n + 1)
+	require.Equal(t, 3*n+1, s.first)
+	s.record(n, 10)
+	require.Equal(t, n, s.first)
+	require.Empty(t, s.blocks)
+}
+
+func TestSparseIndexIsUsedByIterateAndGetRange(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 100)
+		saveTestNode(t, sdb, 1, 2, 8*sparseIndexInterval+1)
+		expected, _, err := db.IterateEntries(nil, 0, 1, 2, 1,
+			8*sparseIndexInterval+2, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, expected, 8*sparseIndexInterval+1)
+		sz := expected[0].SizeUpperLimit()
+		for _, maxSize := range []uint64{0, 1, uint64(sz) * 300, uint64(sz) * 1000} {
+			for _, low := range []uint64{1, 100, 700} {
+				ents, _, err := db.IterateEntries(nil, 0, 1, 2, low,
+					8*sparseIndexInterval+2, maxSize)
+				require.NoError(t, err)
+				n := maxSize/uint64(sz) + 1
+				require.Equal(t, expected[low-1:low-1+n], ents)
+			}
+		}
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 1,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 100, Term: 1},
+		}}))
+		rs, err := db.ReadRaftState(1, 2, 100)
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), rs.FirstIndex)
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 50))
+		shard := sdb.shards[sdb.partitioner.GetPartitionID(1)]
+		require.Equal(t, uint64(0), shard.cs.getFirstIndex(1, 2))
+		rs, err = db.ReadRaftState(1, 2, 10)
+		require.NoError(t, err)
+		require.Equal(t, uint64(50), rs.FirstIndex)
+		require.Equal(t, uint64(50), shard.cs.getFirstIndex(1, 2))
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 80))
+		require.Equal(t, uint64(80), shard.cs.getFirstIndex(1, 2))
+		rs, err = db.ReadRaftState(1, 2, 10)
+		require.NoError(t, err)
+		require.Equal(t, uint64(80), rs.FirstIndex)
+		require.Equal(t, uint64(8*sparseIndexInterval+1-79), rs.EntryCount)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,225 @@
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/pkg/errors"
+)
+
+const (
+	entryPropertyCollectorName = "logdb.entries"
+	entryCountProperty         = "logdb.entries.count"
+	entryBytesProperty         = "logdb.entries.bytes"
+	entryFirstProperty         = "logdb.entries.first"
+	entryLastProperty          = "logdb.entries.last"
+	tombstoneCountProperty     = "logdb.tombstones"
+)
+
+// EntryPosition identifies an entry of a raft node.
+type EntryPosition struct {
+	ClusterID uint64
+	NodeID    uint64
+	Index     uint64
+}
+
+// SSTableInfo describes a live sstable of a shard.
+type SSTableInfo struct {
+	Shard uint64
+	// StateStore is set for sstables of the state store.
+	StateStore bool
+	FileNum    uint64
+	Level      int
+	Size       uint64
+	// Collected is set when the entry properties below were collected when
+	// the sstable was written, they are not available for sstables written
+	// by releases not collecting them.
+	Collected bool
+	// Entries is the number of entries in the sstable, EntryBytes is their
+	// total size in bytes before compression.
+	Entries    uint64
+	EntryBytes uint64
+	// Tombstones is the number of point and range deletions in the sstable,
+	// sstables with many tombstones hold space of removed entries until they
+	// are compacted.
+	Tombstones uint64
+	// FirstEntry and LastEntry are the first and the last entries of the
+	// sstable in key order, they are only set when Entries is not 0.
+	FirstEntry EntryPosition
+	LastEntry  EntryPosition
+}
+
+// ListSSTables returns all live sstables of all shards ordered by shard and
+// level. The returned information may be out of date due to concurrent
+// flushes and compactions.
+func (s *ShardedDB) ListSSTables() ([]SSTableInfo, error) {
+	shards, err := s.allShards()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SSTableInfo, 0)
+	for i, shard := range shards {
+		tables, err := shard.kvs.listSSTables(uint64(i))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, tables...)
+	}
+	return result, nil
+}
+
+func (r *KV) listSSTables(shard uint64) ([]SSTableInfo, error) {
+	levels, err := r.db.SSTables(pebble.WithProperties())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SSTableInfo, 0)
+	for level, tables := range levels {
+		for _, t := range tables {
+			info := SSTableInfo{
+				Shard:   shard,
+				FileNum: uint64(t.FileNum),
+				Level:   level,
+				Size:    t.Size,
+			}
+			if t.Properties != nil {
+				if err := info.setProperties(t.Properties.UserProperties); err != nil {
+					return nil, errors.Wrapf(err, "sstable %d", t.FileNum)
+				}
+			}
+			result = append(result, info)
+		}
+	}
+	if r.state != nil {
+		tables, err := r.state.listSSTables(shard)
+		if err != nil {
+			return nil, err
+		}
+		for i := range tables {
+			tables[i].StateStore = true
+		}
+		result = append(result, tables...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Level < result[j].Level
+	})
+	return result, nil
+}
+
+func (t *SSTableInfo) setProperties(props map[string]string) error {
+	if _, ok := props[entryCountProperty]; !ok {
+		return nil
+	}
+	t.Collected = true
+	var err error
+	parse := func(key string) uint64 {
+		v, perr := strconv.ParseUint(props[key], 10, 64)
+		if perr != nil && err == nil {
+			err = errors.Wrapf(ErrCorruptedRecord, "property %s", key)
+		}
+		return v
+	}
+	t.Entries = parse(entryCountProperty)
+	t.EntryBytes = parse(entryBytesProperty)
+	t.Tombstones = parse(tombstoneCountProperty)
+	if err != nil {
+		return err
+	}
+	if t.Entries == 0 {
+		return nil
+	}
+	if t.FirstEntry, err = parseEntryPosition(props[entryFirstProperty]); err != nil {
+		return err
+	}
+	t.LastEntry, err = parseEntryPosition(props[entryLastProperty])
+	return err
+}
+
+func formatEntryPosition(key []byte) string {
+	cid, nid, index := parseEntryKey(key)
+	return fmt.Sprintf("%d:%d:%d", cid, nid, index)
+}
+
+func parseEntryPosition(v string) (EntryPosition, error) {
+	var p EntryPosition
+	if _, err := fmt.Sscanf(v, "%d:%d:%d",
+		&p.ClusterID, &p.NodeID, &p.Index); err != nil {
+		return EntryPosition{}, errors.Wrapf(ErrCorruptedRecord, "entry position %q", v)
+	}
+	return p, nil
+}
+
+func isEntryKey(key []byte) bool {
+	return uint64(len(key)) == entryKeySize &&
+		key[0] == entryKeyHeader[0] && key[1] == entryKeyHeader[1]
+}
+
+// entryPropertyCollector collects the number, the size and the key range of
+// entries written to each sstable. The bytes of the records of each cluster
+// written to the sstable are accounted to amp when it is not nil.
+type entryPropertyCollector struct {
+	count      uint64
+	bytes      uint64
+	tombstones uint64
+	first      []byte
+	last       []byte
+	amp        *writeAmp
+	clusters   map[uint64]uint64
+}
+
+var _ pebble.TablePropertyCollector = (*entryPropertyCollector)(nil)
+
+func newEntryPropertyCollector(amp *writeAmp) pebble.TablePropertyCollector {
+	c := &entryPropertyCollector{amp: amp}
+	if amp != nil {
+		c.clusters = make(map[uint64]uint64)
+	}
+	return c
+}
+
+func (c *entryPropertyCollector) Add(key pebble.InternalKey, value []byte) error {
+	switch key.Kind() {
+	case pebble.InternalKeyKindDelete, pebble.InternalKeyKindSingleDelete,
+		pebble.InternalKeyKindRangeDelete:
+		c.tombstones++
+	case pebble.InternalKeyKindSet:
+		if c.clusters != nil {
+			if cid, ok := keyClusterID(key.UserKey); ok {
+				c.clusters[cid] += uint64(len(key.UserKey) + len(value))
+			}
+		}
+		if !isEntryKey(key.UserKey) {
+			return nil
+		}
+		c.count++
+		c.bytes += uint64(len(value))
+		if c.first == nil || bytes.Compare(key.UserKey, c.first) < 0 {
+			c.first = append(c.first[:0], key.UserKey...)
+		}
+		if c.last == nil || bytes.Compare(key.UserKey, c.last) > 0 {
+			c.last = append(c.last[:0], key.UserKey...)
+		}
+	}
+	return nil
+}
+
+func (c *entryPropertyCollector) Finish(props map[string]string) error {
+	props[entryCountProperty] = strconv.FormatUint(c.count, 10)
+	props[entryBytesProperty] = strconv.FormatUint(c.bytes, 10)
+	props[tombstoneCountProperty] = strconv.FormatUint(c.tombstones, 10)
+	if c.count > 0 {
+		props[entryFirstProperty] = formatEntryPosition(c.first)
+		props[entryLastProperty] = formatEntryPosition(c.last)
+	}
+	if c.amp != nil {
+		c.amp.addPhysical(c.clusters)
+	}
+	return nil
+}
+
+func (c *entryPropertyCollector) Name() string {
+	return entryPropertyCollectorName
+}
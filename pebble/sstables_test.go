@@ -0,0 +1,91 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSTablesCanBeListed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.StateStore = true
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 2, 100)
+	p := db.partitioner.GetPartitionID(1)
+	kvs := db.shards[p].kvs
+	require.NoError(t, kvs.db.Flush())
+	require.NoError(t, kvs.state.db.Flush())
+	tables, err := db.ListSSTables()
+	require.NoError(t, err)
+	entries := uint64(0)
+	state := 0
+	for _, table := range tables {
+		require.Equal(t, p, table.Shard)
+		require.True(t, table.Collected)
+		require.True(t, table.Size > 0)
+		if table.StateStore {
+			state++
+			require.Zero(t, table.Entries)
+			continue
+		}
+		entries += table.Entries
+		require.True(t, table.EntryBytes > 0)
+		require.Equal(t, EntryPosition{ClusterID: 1, NodeID: 2, Index: 1}, table.FirstEntry)
+		require.Equal(t, EntryPosition{ClusterID: 1, NodeID: 2, Index: 100}, table.LastEntry)
+	}
+	require.Equal(t, uint64(100), entries)
+	require.Equal(t, 1, state)
+
+	require.NoError(t, kvs.BulkRemoveEntries(entryRangeKeys(1, 2, 0, 51)))
+	require.NoError(t, kvs.db.Flush())
+	tables, err = db.ListSSTables()
+	require.NoError(t, err)
+	tombstones := uint64(0)
+	for _, table := range tables {
+		tombstones += table.Tombstones
+	}
+	require.Equal(t, uint64(1), tombstones)
+}
+
+func entryRangeKeys(clusterID uint64,
+	nodeID uint64, low uint64, high uint64) ([]byte, []byte) {
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(clusterID, nodeID, low)
+	lk.SetEntryKey(clusterID, nodeID, high)
+	return fk.Key(), lk.Key()
+}
+
+func TestEntryPropertyCollector(t *testing.T) {
+	c := newEntryPropertyCollector(nil)
+	k := newKey(entryKeySize, nil)
+	for _, index := range []uint64{5, 3, 9} {
+		k.SetEntryKey(1, 2, index)
+		require.NoError(t, c.Add(pebble.InternalKey{UserKey: k.Key(),
+			Trailer: uint64(pebble.InternalKeyKindSet)}, make([]byte, 10)))
+	}
+	props := make(map[string]string)
+	require.NoError(t, c.Finish(props))
+	var info SSTableInfo
+	require.NoError(t, info.setProperties(props))
+	require.Equal(t, uint64(3), info.Entries)
+	require.Equal(t, uint64(30), info.EntryBytes)
+	require.Equal(t, uint64(3), info.FirstEntry.Index)
+	require.Equal(t, uint64(9), info.LastEntry.Index)
+	props[entryFirstProperty] = "invalid"
+	require.ErrorIs(t, info.setProperties(props), ErrCorruptedRecord)
+	info = SSTableInfo{}
+	require.NoError(t, info.setProperties(map[string]string{}))
+	require.False(t, info.Collected)
+}
@@ -0,0 +1,86 @@
+package pebble
+
+import (
+	"math"
+	"sort"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// NodeRaftState is the persistent state of a single node as returned by
+// ReadRaftStates.
+type NodeRaftState struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Snapshot is the most recent snapshot saved for the node.
+	Snapshot pb.Snapshot
+	// RaftState is the persistent raft state with entries counted from the
+	// index of Snapshot.
+	RaftState raftio.RaftState
+	// HasState is false when no raft state has been saved for the node, in
+	// which case ReadRaftState would return raftio.ErrNoSavedLog.
+	HasState bool
+}
+
+// ReadRaftStates returns the most recent snapshot and the persistent raft
+// state of all specified nodes, results are returned in the same order as
+// the specified nodes. It is equivalent to calling GetSnapshot and
+// ReadRaftState for each node, but nodes are grouped by shard and each shard
+// resolves its nodes in key order against a single consistent snapshot of
+// the underlying KV store, making it much cheaper to restart hosts with a
+// large number of nodes.
+func (s *ShardedDB) ReadRaftStates(nodes []raftio.NodeInfo) ([]NodeRaftState, error) {
+	partitions := make(map[uint64][]int)
+	for i, n := range nodes {
+		p := s.partitioner.GetPartitionID(n.ClusterID)
+		partitions[p] = append(partitions[p], i)
+	}
+	result := make([]NodeRaftState, len(nodes))
+	for p, idx := range partitions {
+		sort.Slice(idx, func(i, j int) bool {
+			return nodeInfoLess(nodes[idx[i]], nodes[idx[j]])
+		})
+		shard, err := s.shard(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := shard.readRaftStates(nodes, idx, result); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
+// readRaftStates reads states of nodes[i] into result[i] for each i in idx.
+func (r *db) readRaftStates(nodes []raftio.NodeInfo,
+	idx []int, result []NodeRaftState) (err error) {
+	ss := r.kvs.newSnapshot()
+	defer func() {
+		err = firstError(err, ss.Close())
+	}()
+	for _, i := range idx {
+		n := nodes[i]
+		rs := NodeRaftState{ClusterID: n.ClusterID, NodeID: n.NodeID}
+		r.ops.read(n.ClusterID, n.NodeID)
+		snapshots, err := r.readSnapshots(ss,
+			n.ClusterID, n.NodeID, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) > 0 {
+			rs.Snapshot = snapshots[len(snapshots)-1]
+			r.cs.setSnapshotIndex(n.ClusterID, n.NodeID, rs.Snapshot.Index)
+		}
+		rs.RaftState, err = r.readRaftStateFrom(ss,
+			n.ClusterID, n.NodeID, rs.Snapshot.Index, false)
+		if err == nil {
+			rs.HasState = true
+		} else if err != raftio.ErrNoSavedLog {
+			return err
+		}
+		result[i] = rs
+	}
+	return nil
+}
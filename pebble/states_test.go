@@ -0,0 +1,54 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRaftStates(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		for cid := uint64(1); cid <= 32; cid++ {
+			saveTestNode(t, sdb, cid, 2, cid+10)
+		}
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 17,
+			NodeID:    2,
+			Snapshot:  pb.Snapshot{Index: 15, Term: 1},
+		}}))
+		require.NoError(t, db.SaveBootstrapInfo(100, 4, pb.Bootstrap{}))
+		nodes, err := db.ListNodeInfo()
+		require.NoError(t, err)
+		require.Len(t, nodes, 33)
+		states, err := sdb.ReadRaftStates(nodes)
+		require.NoError(t, err)
+		require.Len(t, states, len(nodes))
+		for i, n := range nodes {
+			ss, err := db.GetSnapshot(n.ClusterID, n.NodeID)
+			require.NoError(t, err)
+			rs, err := db.ReadRaftState(n.ClusterID, n.NodeID, ss.Index)
+			require.Equal(t, n.ClusterID, states[i].ClusterID)
+			require.Equal(t, n.NodeID, states[i].NodeID)
+			require.Equal(t, ss, states[i].Snapshot)
+			if n.ClusterID == 100 {
+				require.ErrorIs(t, err, raftio.ErrNoSavedLog)
+				require.False(t, states[i].HasState)
+				continue
+			}
+			require.NoError(t, err)
+			require.True(t, states[i].HasState)
+			require.Equal(t, rs, states[i].RaftState)
+			if n.ClusterID == 17 {
+				require.Equal(t, uint64(15), states[i].Snapshot.Index)
+			}
+		}
+		states, err = sdb.ReadRaftStates(nil)
+		require.NoError(t, err)
+		require.Empty(t, states)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
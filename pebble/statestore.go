@@ -0,0 +1,251 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// stateStoreDirName is the name of the directory of the state store, it is
+// created in the shard directory of the low latency dir when specified.
+const stateStoreDirName = "state"
+
+// ErrStateStoreUnsupported indicates that the requested feature can not be
+// used when the state store is enabled.
+var ErrStateStoreUnsupported = errors.New("not supported by the state store")
+
+var (
+	// keys in the range of [stateStoreFirstKey, stateStoreLastKey) are kept
+	// in the state store.
+	stateStoreFirstKey = []byte{persistentStateKeyHeader[0], persistentStateKeyHeader[1]}
+	stateStoreLastKey  = []byte{maxIndexKeyHeader[0], maxIndexKeyHeader[1] + 1}
+	// stateCommitKey is the key of the recovery marker of split batches kept
+	// in the store, see commitSplitBatch.
+	stateCommitKey = []byte{0xb, 0xb}
+	// stateAppliedKey is the key of the id of the last recovery marker
+	// committed to the state store, it is in the key range of the state store.
+	stateAppliedKey = []byte{persistentStateKeyHeader[0], persistentStateKeyHeader[1] + 1}
+)
+
+func isStateStoreKey(key []byte) bool {
+	return bytes.Compare(key, stateStoreFirstKey) >= 0 &&
+		bytes.Compare(key, stateStoreLastKey) < 0
+}
+
+// getStateStoreConfig returns the config of the state store derived from the
+// config of the shard. The state store only holds a few small records per
+// node, tiny memtables keep flushes cheap and each write is synced. Its
+// sstables use the metadata compression and block size.
+func getStateStoreConfig(config LogDBConfig, fs vfs.FS) LogDBConfig {
+	config.KVWriteBufferSize = 1024 * 1024
+	config.KVMaxWriteBufferNumber = 4
+	config.KVLevel0FileNumCompactionTrigger = 2
+	config.KVLevel0StopWritesTrigger = 36
+	config.KVMaxBytesForLevelBase = 8 * 1024 * 1024
+	config.KVTargetFileSizeBase = 2 * 1024 * 1024
+	config.KVLRUCacheSize = 0
+	config.KVBlockSize = config.MetadataBlockSize
+	if config.KVBlockSize == 0 {
+		config.KVBlockSize = 4 * 1024
+	}
+	config.EntryCompression = config.MetadataCompression
+	config.WALDSync = fs == vfs.Default && dsyncSupported
+	config.TableDSync = false
+	config.DeleteRangeFlushDelay = 0
+	return config
+}
+
+// openStateStore opens the state store located in dir. Records are moved into
+// the state store when it is enabled and back into the KV store when it is
+// disabled, the state store is then removed. In read-only mode, an existing
+// state store is always used.
+func (r *KV) openStateStore(config LogDBConfig, dir string, fs vfs.FS) error {
+	sdir := fs.PathJoin(dir, stateStoreDirName)
+	exist, err := fileutil.DirExist(sdir, fs)
+	if err != nil {
+		return err
+	}
+	if !exist && (!config.StateStore || config.ReadOnly) {
+		return nil
+	}
+	state, err := openPebbleDBWithEvents(getStateStoreConfig(config, fs),
+		nil, r.event.engine, sdir, "", fs)
+	if err != nil {
+		return err
+	}
+	if config.ReadOnly {
+		r.state = state
+		return nil
+	}
+	if exist {
+		if r.stateCommits, err = recoverStateCommit(r, state); err != nil {
+			return firstError(err, state.Close())
+		}
+	}
+	if config.StateStore {
+		if err := moveStateRecords(r, state); err != nil {
+			return firstError(err, state.Close())
+		}
+		r.state = state
+		return nil
+	}
+	if err := moveStateRecords(state, r); err != nil {
+		return firstError(err, state.Close())
+	}
+	if err := removeStateCommit(r); err != nil {
+		return firstError(err, state.Close())
+	}
+	if err := state.Close(); err != nil {
+		return err
+	}
+	return fs.RemoveAll(sdir)
+}
+
+// moveStateRecords copies all raft state and max index records from one
+// store to the other before removing them from the source. The copy is
+// synced first, moving records again after a crash is harmless.
+func moveStateRecords(from *KV, to *KV) error {
+	wb := to.GetWriteBatch()
+	defer wb.Destroy()
+	if err := from.IterateValue(stateStoreFirstKey, stateStoreLastKey, false,
+		func(key []byte, data []byte) (bool, error) {
+			wb.Put(key, data)
+			return true, nil
+		}); err != nil {
+		return err
+	}
+	if wb.Count() == 0 {
+		return nil
+	}
+	if err := to.CommitWriteBatch(wb); err != nil {
+		return err
+	}
+	return from.BulkRemoveEntries(stateStoreFirstKey, stateStoreLastKey)
+}
+
+// iterateRouted iterates over keys in the range of [fk, lk] or [fk, lk) in
+// key order, keys of the state store are read from state and all other keys
+// are read from main.
+func iterateRouted(main pebble.Reader, state pebble.Reader,
+	ro *pebble.IterOptions, fk []byte, lk []byte, inc bool,
+	op func(key []byte, data []byte) (bool, error)) error {
+	stopped := false
+	f := func(key []byte, data []byte) (bool, error) {
+		cont, err := op(key, data)
+		stopped = !cont
+		return cont, err
+	}
+	iterate := func(reader pebble.Reader, from []byte, to []byte, toInc bool) error {
+		if stopped {
+			return nil
+		}
+		if c := bytes.Compare(from, to); c > 0 || (c == 0 && !toInc) {
+			return nil
+		}
+		return iterateValue(reader.NewIter(ro), from, to, toInc, f)
+	}
+	upper := func(bound []byte) ([]byte, bool) {
+		if bytes.Compare(lk, bound) < 0 {
+			return lk, inc
+		}
+		return bound, false
+	}
+	lower := func(bound []byte) []byte {
+		if bytes.Compare(fk, bound) > 0 {
+			return fk
+		}
+		return bound
+	}
+	to, toInc := upper(stateStoreFirstKey)
+	if err := iterate(main, fk, to, toInc); err != nil {
+		return err
+	}
+	to, toInc = upper(stateStoreLastKey)
+	if err := iterate(state, lower(stateStoreFirstKey), to, toInc); err != nil {
+		return err
+	}
+	return iterate(main, lower(stateStoreLastKey), lk, inc)
+}
+
+// commitSplitBatch commits a write batch with records of both the store and
+// the state store. The records of the state store are also saved in the store
+// as a recovery marker, atomically with all other records, so a crash before
+// the state store is committed can not leave records of removed nodes behind
+// or keep the records of the state store behind those of the store. The
+// marker is applied when the state store is opened unless the state store
+// already holds its id. Split batches are serialized, the single marker
+// always belongs to the last of them.
+func (r *KV) commitSplitBatch(wb *pebbleWriteBatch) error {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, r.stateCommits+1)
+	wb.state.Put(stateAppliedKey, id)
+	marker := append(id, wb.state.wb.Repr()...)
+	if err := wb.wb.Set(stateCommitKey, marker, nil); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := r.apply(wb.wb); err != nil {
+		return err
+	}
+	r.stateCommits++
+	return r.state.CommitWriteBatch(wb.state)
+}
+
+// removeStateCommit removes the recovery marker and the id of the last
+// applied marker moved from the state store once it is disabled.
+func removeStateCommit(r *KV) error {
+	wb := r.GetWriteBatch()
+	defer wb.Destroy()
+	wb.Delete(stateCommitKey)
+	wb.Delete(stateAppliedKey)
+	return r.CommitWriteBatch(wb)
+}
+
+// recoverStateCommit applies the recovery marker of the last split batch to
+// the state store when the process crashed before the state store was
+// committed, see commitSplitBatch. It returns the id of the marker.
+func recoverStateCommit(main *KV, state *KV) (uint64, error) {
+	var marker []byte
+	if err := main.GetValue(stateCommitKey, func(data []byte) error {
+		marker = append([]byte(nil), data...)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	var applied uint64
+	if err := state.GetValue(stateAppliedKey, func(data []byte) error {
+		if len(data) == 8 {
+			applied = binary.BigEndian.Uint64(data)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if len(marker) < 8 {
+		return applied, nil
+	}
+	id := binary.BigEndian.Uint64(marker)
+	if id <= applied {
+		return applied, nil
+	}
+	plog.Warningf("%s: applying state store records of interrupted commit %d",
+		main.dir, id)
+	wb := state.db.NewBatch()
+	defer func() {
+		if err := wb.Close(); err != nil {
+			plog.Errorf("failed to close batch, %v", err)
+		}
+	}()
+	if err := wb.SetRepr(marker[8:]); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if err := state.apply(wb); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,188 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStoreKeepsStateRecords(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal")
+	sdir := fs.PathJoin(lldir, shardDirName(0), stateStoreDirName)
+	db, err := NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	require.NoError(t, db.Close())
+	exist, err := fileutil.DirExist(sdir, fs)
+	require.NoError(t, err)
+	require.False(t, exist)
+
+	check := func(db *ShardedDB, lastIndex uint64) {
+		rs, err := db.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), rs.FirstIndex)
+		require.Equal(t, lastIndex, rs.EntryCount)
+		require.Equal(t, pb.State{Term: 1, Vote: 2, Commit: lastIndex}, rs.State)
+		nodes, err := db.ListNodeInfo()
+		require.NoError(t, err)
+		require.Len(t, nodes, 2)
+		states, err := db.ReadRaftStates(nodes)
+		require.NoError(t, err)
+		require.Len(t, states, 2)
+		for _, s := range states {
+			require.True(t, s.HasState)
+		}
+		report, err := db.Verify()
+		require.NoError(t, err)
+		require.Empty(t, report.Violations)
+	}
+	cfg.StateStore = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 3, 4, 10)
+	check(db, 10)
+	ents := make([]pb.Entry, 0)
+	for i := uint64(11); i <= 20; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1})
+	}
+	require.NoError(t, db.SaveRaftState([]pb.Update{{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Vote: 2, Commit: 20},
+		EntriesToSave: ents,
+	}}, 1))
+	_, err = db.Backup(fs.PathJoin(RDBTestDirectory, "backup"))
+	require.ErrorIs(t, err, ErrStateStoreUnsupported)
+	require.NoError(t, db.Close())
+	exist, err = fileutil.DirExist(sdir, fs)
+	require.NoError(t, err)
+	require.True(t, exist)
+	kv, err := openPebbleDB(cfg, nil, fs.PathJoin(dir, shardDirName(0)),
+		fs.PathJoin(lldir, shardDirName(0)), fs)
+	require.NoError(t, err)
+	found := false
+	require.NoError(t, kv.IterateValue(stateStoreFirstKey, stateStoreLastKey, false,
+		func(key []byte, data []byte) (bool, error) {
+			found = true
+			return false, nil
+		}))
+	require.NoError(t, kv.Close())
+	require.False(t, found)
+
+	cfg.ReadOnly = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), rs.State.Commit)
+	require.NoError(t, db.Close())
+
+	cfg.ReadOnly = false
+	cfg.StateStore = false
+	db, err = NewLogDB(cfg, nil, []string{dir}, []string{lldir}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	check(db, 20)
+	exist, err = fileutil.DirExist(sdir, fs)
+	require.NoError(t, err)
+	require.False(t, exist)
+}
+
+func TestStateStoreIsNotSupportedWithMirroring(t *testing.T) {
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.StateStore = true
+	cfg.MirrorDir = fs.PathJoin(RDBTestDirectory, "mirror")
+	_, err := NewLogDB(cfg, nil,
+		[]string{fs.PathJoin(RDBTestDirectory, "db")}, nil, CheckNone)
+	require.ErrorIs(t, err, ErrStateStoreUnsupported)
+}
+
+func TestKeyspaceCompression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.StateStore = true
+	cfg.EntryCompression = SnappyCompression
+	cfg.MetadataCompression = ZstdCompression
+	cfg.MetadataBlockSize = 1024
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	kvs := db.shards[0].kvs
+	require.Equal(t, pebble.SnappyCompression, kvs.opts.Levels[0].Compression)
+	require.Equal(t, int(cfg.KVBlockSize), kvs.opts.Levels[0].BlockSize)
+	require.Equal(t, pebble.ZstdCompression, kvs.state.opts.Levels[0].Compression)
+	require.Equal(t, 1024, kvs.state.opts.Levels[0].BlockSize)
+	saveTestNode(t, db, 1, 2, 100)
+	require.NoError(t, db.shards[db.partitioner.GetPartitionID(1)].kvs.FullCompaction())
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), rs.EntryCount)
+	require.Equal(t, uint64(100), rs.State.Commit)
+}
+
+func TestInterruptedStateStoreCommitIsRecovered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.Shards = 1
+	cfg.StateStore = true
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	saveTestNode(t, db, 3, 4, 10)
+	// the removal is committed to the store but not to the state store, as
+	// if the process crashed in between
+	db.shards[0].kvs.state.gate.close()
+	require.ErrorIs(t, db.RemoveNodeData(1, 2), ErrClosing)
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	_, err = db.ReadRaftState(1, 2, 0)
+	require.ErrorIs(t, err, raftio.ErrNoSavedLog)
+	rs, err := db.ReadRaftState(3, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.State.Commit)
+	report, err := db.Verify()
+	require.NoError(t, err)
+	require.Empty(t, report.Violations)
+	// later commits are not undone by the recovered marker
+	saveTestNode(t, db, 1, 2, 5)
+	require.NoError(t, db.Close())
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	rs, err = db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), rs.State.Commit)
+}
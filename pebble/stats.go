@@ -0,0 +1,252 @@
+package pebble
+
+import (
+	"math"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
+	"github.com/coufalja/tugboat/raftio"
+)
+
+// CacheStats contains the statistics of a cache used by the storage engine.
+type CacheStats struct {
+	Size   int64
+	Count  int64
+	Hits   int64
+	Misses int64
+}
+
+func newCacheStats(m pebble.CacheMetrics) CacheStats {
+	return CacheStats{
+		Size:   m.Size,
+		Count:  m.Count,
+		Hits:   m.Hits,
+		Misses: m.Misses,
+	}
+}
+
+// ShardStats contains the storage engine metrics of a single shard.
+type ShardStats struct {
+	Shard          uint64
+	DiskSpaceUsage uint64
+	MemTableSize   uint64
+	MemTableCount  int64
+	WALFiles       int64
+	WALSize        uint64
+	L0Files        int64
+	L0Sublevels    int32
+	ReadAmp        int
+	Compactions    int64
+	CompactionDebt uint64
+	Flushes        int64
+	BlockCache     CacheStats
+	TableCache     CacheStats
+	// Events contains the totals of the compaction and flush events of the
+	// shard.
+	Events EngineEventStats
+	// FormatMajorVersion is the pebble format major version of the shard.
+	FormatMajorVersion uint64
+	// IO is only available when LogDBConfig.IOAccounting is set.
+	IO *vfsutil.IOStats
+	// Mirror is only available when LogDBConfig.MirrorDir is set.
+	Mirror *MirrorStats
+	// Shipping is only available when LogDBConfig.ShippingStore is set.
+	Shipping *ShippingStats
+	// Commits is only available when LogDBConfig.CommitWindow is set.
+	Commits *CommitStats
+	// Reads is only available when LogDBConfig.MaxConcurrentReads is set.
+	Reads *ReadStats
+	// StorageClass is the storage class of the shard directory.
+	StorageClass StorageClass
+	// SaveBuffer is the value buffer of the context used by SaveRaftState
+	// for the shard ID of the same number.
+	SaveBuffer SaveBufferStats
+	// KeyPool is the key pool of the shard, ContextPool is the context pool
+	// used by AcquireContext for the shard ID of the same number.
+	// WriteBatchPool is the pool of reused write batches of the shard.
+	KeyPool        PoolStats
+	ContextPool    PoolStats
+	WriteBatchPool PoolStats
+}
+
+// NodeStats contains the statistics of the data stored for a single node.
+type NodeStats struct {
+	ClusterID uint64
+	NodeID    uint64
+	Shard     uint64
+	// Entries is the number of stored entries, including entries not yet
+	// removed after being overwritten or covered by a snapshot.
+	Entries uint64
+	// EntryBytes is the total size of all stored entries in bytes.
+	EntryBytes    uint64
+	FirstIndex    uint64
+	LastIndex     uint64
+	MaxIndex      uint64
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	// SnapshotAge is the number of log entries appended after the latest
+	// snapshot.
+	SnapshotAge uint64
+	// Operations are the operation counters of the node.
+	Operations NodeOperations
+}
+
+// Stats contains the statistics of a ShardedDB instance.
+type Stats struct {
+	Shards []ShardStats
+	Nodes  []NodeStats
+}
+
+// Stats returns the storage engine metrics of all shards and the statistics
+// of all nodes. It requires a full scan of all stored entries.
+func (s *ShardedDB) Stats() (Stats, error) {
+	shards, err := s.allShards()
+	if err != nil {
+		return Stats{}, err
+	}
+	result := Stats{}
+	for i, shard := range shards {
+		st := shard.shardStats(uint64(i))
+		if ctx, ok := s.ctxs[i].(*context); ok {
+			st.SaveBuffer = ctx.bufferStats()
+		}
+		st.KeyPool = shard.keys.stats()
+		st.ContextPool = s.ctxPools[i].stats()
+		st.WriteBatchPool = shard.kvs.batches.stats()
+		result.Shards = append(result.Shards, st)
+		nodes, err := shard.nodeStats(uint64(i))
+		if err != nil {
+			return Stats{}, err
+		}
+		result.Nodes = append(result.Nodes, nodes...)
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool {
+		return nodeInfoLess(
+			raftio.GetNodeInfo(result.Nodes[i].ClusterID, result.Nodes[i].NodeID),
+			raftio.GetNodeInfo(result.Nodes[j].ClusterID, result.Nodes[j].NodeID))
+	})
+	return result, nil
+}
+
+func nodeInfoLess(a raftio.NodeInfo, b raftio.NodeInfo) bool {
+	if a.ClusterID != b.ClusterID {
+		return a.ClusterID < b.ClusterID
+	}
+	return a.NodeID < b.NodeID
+}
+
+func (r *db) shardStats(shard uint64) ShardStats {
+	m := r.kvs.db.Metrics()
+	var io *vfsutil.IOStats
+	if r.accounting != nil {
+		st := r.accounting.Stats()
+		io = &st
+	}
+	var ms *MirrorStats
+	if r.kvs.mirror != nil {
+		st := r.kvs.mirror.stats(shard)
+		ms = &st
+	}
+	var ss *ShippingStats
+	if r.kvs.shipper != nil {
+		st := r.kvs.shipper.stats()
+		ss = &st
+	}
+	var es EngineEventStats
+	if r.kvs.event.engine != nil {
+		es = r.kvs.event.engine.getStats()
+	}
+	var cs *CommitStats
+	if r.batcher != nil {
+		st := r.batcher.getStats()
+		cs = &st
+	}
+	return ShardStats{
+		Shard:              shard,
+		DiskSpaceUsage:     m.DiskSpaceUsage(),
+		MemTableSize:       m.MemTable.Size,
+		MemTableCount:      m.MemTable.Count,
+		WALFiles:           m.WAL.Files,
+		WALSize:            m.WAL.Size,
+		L0Files:            m.Levels[0].NumFiles,
+		L0Sublevels:        m.Levels[0].Sublevels,
+		ReadAmp:            m.ReadAmp(),
+		Compactions:        m.Compact.Count,
+		CompactionDebt:     m.Compact.EstimatedDebt,
+		Flushes:            m.Flush.Count,
+		BlockCache:         newCacheStats(m.BlockCache),
+		TableCache:         newCacheStats(m.TableCache),
+		Events:             es,
+		FormatMajorVersion: uint64(r.kvs.db.FormatMajorVersion()),
+		IO:                 io,
+		Mirror:             ms,
+		Shipping:           ss,
+		Commits:            cs,
+		Reads:              r.reads.stats(),
+		StorageClass:       r.class,
+	}
+}
+
+func (r *db) nodeStats(shard uint64) ([]NodeStats, error) {
+	nodes := make(map[raftio.NodeInfo]*NodeStats)
+	get := func(ni raftio.NodeInfo) *NodeStats {
+		n, ok := nodes[ni]
+		if !ok {
+			n = &NodeStats{ClusterID: ni.ClusterID, NodeID: ni.NodeID, Shard: shard}
+			nodes[ni] = n
+		}
+		return n
+	}
+	fk := newKey(entryKeySize, nil)
+	lk := newKey(entryKeySize, nil)
+	fk.SetEntryKey(0, 0, 0)
+	lk.SetEntryKey(math.MaxUint64, math.MaxUint64, math.MaxUint64)
+	op := func(key []byte, data []byte) (bool, error) {
+		clusterID, nodeID, index, err := decodeEntryKey(key)
+		if err != nil {
+			return false, err
+		}
+		n := get(raftio.GetNodeInfo(clusterID, nodeID))
+		if n.Entries == 0 {
+			n.FirstIndex = index
+		}
+		n.LastIndex = index
+		n.Entries++
+		n.EntryBytes += uint64(len(data))
+		return true, nil
+	}
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return nil, err
+	}
+	ni, err := r.listNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range ni {
+		get(v)
+	}
+	result := make([]NodeStats, 0, len(nodes))
+	for _, n := range nodes {
+		maxIndex, err := r.getMaxIndex(n.ClusterID, n.NodeID)
+		if err != nil && err != raftio.ErrNoSavedLog {
+			return nil, err
+		}
+		n.MaxIndex = maxIndex
+		snapshots, err := r.listSnapshots(n.ClusterID, n.NodeID, math.MaxUint64)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) > 0 {
+			ss := snapshots[len(snapshots)-1]
+			n.SnapshotIndex = ss.Index
+			n.SnapshotTerm = ss.Term
+		}
+		if n.MaxIndex > n.SnapshotIndex {
+			n.SnapshotAge = n.MaxIndex - n.SnapshotIndex
+		}
+		n.Operations = r.ops.operations(n.ClusterID, n.NodeID)
+		result = append(result, *n)
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsReportsNodeEntries(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 3, 4, 20)
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{
+			ClusterID: 3,
+			NodeID:    4,
+			Snapshot:  pb.Snapshot{Index: 15, Term: 1},
+		}}))
+		require.NoError(t, db.RemoveEntriesTo(3, 4, 15))
+		stats, err := sdb.Stats()
+		require.NoError(t, err)
+		require.Len(t, stats.Shards, int(sdb.config.Shards))
+		require.Nil(t, stats.Shards[0].IO)
+		require.Len(t, stats.Nodes, 2)
+		n1 := stats.Nodes[0]
+		require.Equal(t, uint64(1), n1.ClusterID)
+		require.Equal(t, uint64(10), n1.Entries)
+		require.Equal(t, uint64(1), n1.FirstIndex)
+		require.Equal(t, uint64(10), n1.LastIndex)
+		require.Equal(t, uint64(10), n1.MaxIndex)
+		require.Equal(t, uint64(10), n1.SnapshotAge)
+		require.Equal(t, sdb.partitioner.GetPartitionID(1), n1.Shard)
+		require.NotZero(t, n1.EntryBytes)
+		n2 := stats.Nodes[1]
+		require.Equal(t, uint64(6), n2.Entries)
+		require.Equal(t, uint64(15), n2.FirstIndex)
+		require.Equal(t, uint64(15), n2.SnapshotIndex)
+		require.Equal(t, uint64(5), n2.SnapshotAge)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestReadOnlyLogDBRejectsWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	dir := fs.PathJoin(RDBTestDirectory, "db")
+	db, err := NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 10)
+	require.NoError(t, db.Close())
+	cfg.ReadOnly = true
+	db, err = NewLogDB(cfg, nil, []string{dir}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.Error(t, db.SaveBootstrapInfo(1, 3, pb.Bootstrap{}))
+}
+
+func TestApproximateNodeSize(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 1000)
+		for _, shard := range sdb.shards {
+			require.NoError(t, shard.kvs.db.Flush())
+		}
+		sz, err := sdb.ApproximateNodeSize(1, 2)
+		require.NoError(t, err)
+		require.NotZero(t, sz)
+		sz, err = sdb.ApproximateNodeSize(2, 3)
+		require.NoError(t, err)
+		require.Zero(t, sz)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestStatsReportsIOAccounting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.IOAccounting = true
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 2, 10)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	io := stats.Shards[db.partitioner.GetPartitionID(1)].IO
+	require.NotNil(t, io)
+	require.NotZero(t, io.WAL.Writes.Bytes)
+	require.NotZero(t, io.WAL.Syncs.Count)
+	require.Equal(t, io.WAL.Syncs.Count, io.WAL.Syncs.Latency.Count())
+	require.LessOrEqual(t, io.WAL.Syncs.PercentileLatency(0.99), io.WAL.Syncs.MaxLatency)
+	require.NotZero(t, io.Manifest.Writes.Count)
+}
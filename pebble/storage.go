@@ -0,0 +1,112 @@
+package pebble
+
+import (
+	"github.com/lni/vfs"
+)
+
+// StorageClass is the class of the storage device holding a shard.
+type StorageClass int
+
+const (
+	// StorageClassAuto detects the storage class of the directory of each
+	// shard when it is opened.
+	StorageClassAuto StorageClass = iota
+	// StorageClassUnknown is the storage class of shards on devices which
+	// could not be detected, the configured defaults are used as they are.
+	StorageClassUnknown
+	// StorageClassSSD covers SSD and NVMe devices.
+	StorageClassSSD
+	// StorageClassHDD covers spinning disks.
+	StorageClassHDD
+	// StorageClassNetwork covers network file systems such as NFS and CIFS.
+	StorageClassNetwork
+)
+
+func (c StorageClass) String() string {
+	switch c {
+	case StorageClassAuto:
+		return "auto"
+	case StorageClassSSD:
+		return "ssd"
+	case StorageClassHDD:
+		return "hdd"
+	case StorageClassNetwork:
+		return "network"
+	}
+	return "unknown"
+}
+
+// storageProfile contains the defaults tuned for a storage class.
+type storageProfile struct {
+	maxConcurrentCompactions uint64
+	bytesPerSync             uint64
+	walBytesPerSync          uint64
+	readAhead                bool
+}
+
+// storageProfiles are the tuned defaults of each detected storage class.
+// SSDs handle concurrent compactions and frequent small syncs well. Spinning
+// disks are bound by seeks, compactions are not run concurrently, syncs are
+// issued in larger chunks and reads are always sequential. Network storage
+// has a high latency per request, so syncs and reads are batched as well.
+var storageProfiles = map[StorageClass]storageProfile{
+	StorageClassSSD: {
+		maxConcurrentCompactions: 4,
+		bytesPerSync:             512 << 10,
+	},
+	StorageClassHDD: {
+		maxConcurrentCompactions: 1,
+		bytesPerSync:             4 << 20,
+		walBytesPerSync:          1 << 20,
+		readAhead:                true,
+	},
+	StorageClassNetwork: {
+		maxConcurrentCompactions: 2,
+		bytesPerSync:             2 << 20,
+		walBytesPerSync:          1 << 20,
+		readAhead:                true,
+	},
+}
+
+// tuneForStorageClass returns the config with the defaults of the specified
+// storage class applied, options explicitly set in the config are kept.
+func tuneForStorageClass(config LogDBConfig, class StorageClass) LogDBConfig {
+	p, ok := storageProfiles[class]
+	if !ok {
+		return config
+	}
+	if config.MaxConcurrentCompactions == 0 {
+		config.MaxConcurrentCompactions = p.maxConcurrentCompactions
+	}
+	if config.BytesPerSync == 0 {
+		config.BytesPerSync = p.bytesPerSync
+	}
+	if config.WALBytesPerSync == 0 {
+		config.WALBytesPerSync = p.walBytesPerSync
+	}
+	config.ReadAhead = config.ReadAhead || p.readAhead
+	return config
+}
+
+// getStorageClass returns the storage class of the specified shard
+// directory, the directory might not exist yet. Detection is only supported
+// when the LogDB uses the OS file system.
+func getStorageClass(config LogDBConfig, dir string) StorageClass {
+	if config.StorageClass != StorageClassAuto {
+		return config.StorageClass
+	}
+	fs := config.FS
+	if fs != vfs.Default {
+		return StorageClassUnknown
+	}
+	for {
+		if _, err := fs.Stat(dir); err == nil {
+			return detectStorageClass(dir)
+		}
+		parent := fs.PathDir(dir)
+		if parent == dir {
+			return StorageClassUnknown
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,64 @@
+package pebble
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// magic numbers of network file systems as reported by statfs
+var networkFSTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x00c36400: true, // Ceph
+	0x01021997: true, // 9P
+	0x65735546: true, // FUSE, e.g. sshfs and object store mounts
+}
+
+// sysBlockDir is the sysfs directory containing the block devices.
+var sysBlockDir = "/sys/dev/block"
+
+func detectStorageClass(dir string) StorageClass {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return StorageClassUnknown
+	}
+	if networkFSTypes[uint32(fs.Type)] {
+		return StorageClassNetwork
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return StorageClassUnknown
+	}
+	dev := uint64(st.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	return rotationalClass(filepath.Join(sysBlockDir,
+		fmt.Sprintf("%d:%d", major, minor)))
+}
+
+// rotationalClass returns the storage class of the block device with the
+// specified sysfs directory, partitions are resolved to their parent device.
+func rotationalClass(dev string) StorageClass {
+	path, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return StorageClassUnknown
+	}
+	for _, d := range []string{path, filepath.Dir(path)} {
+		data, err := os.ReadFile(filepath.Join(d, "queue", "rotational"))
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(string(data)) {
+		case "0":
+			return StorageClassSSD
+		case "1":
+			return StorageClassHDD
+		}
+	}
+	return StorageClassUnknown
+}
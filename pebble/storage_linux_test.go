@@ -0,0 +1,28 @@
+package pebble
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationalClass(t *testing.T) {
+	dir := t.TempDir()
+	write := func(dev string, rotational string) {
+		qdir := filepath.Join(dir, dev, "queue")
+		require.NoError(t, os.MkdirAll(qdir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(qdir, "rotational"),
+			[]byte(rotational+"\n"), 0644))
+	}
+	write("sda", "1")
+	write("nvme0n1", "0")
+	// partitions have no queue directory of their own
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sda", "sda1"), 0755))
+	require.Equal(t, StorageClassHDD, rotationalClass(filepath.Join(dir, "sda")))
+	require.Equal(t, StorageClassHDD,
+		rotationalClass(filepath.Join(dir, "sda", "sda1")))
+	require.Equal(t, StorageClassSSD, rotationalClass(filepath.Join(dir, "nvme0n1")))
+	require.Equal(t, StorageClassUnknown, rotationalClass(filepath.Join(dir, "sdb")))
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package pebble
+
+func detectStorageClass(dir string) StorageClass {
+	return StorageClassUnknown
+}
@@ -0,0 +1,55 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTuneForStorageClassKeepsExplicitOptions(t *testing.T) {
+	cfg := getDefaultLogDBConfig()
+	require.Equal(t, cfg, tuneForStorageClass(cfg, StorageClassUnknown))
+	hdd := tuneForStorageClass(cfg, StorageClassHDD)
+	require.Equal(t, uint64(1), hdd.MaxConcurrentCompactions)
+	require.Equal(t, uint64(4<<20), hdd.BytesPerSync)
+	require.Equal(t, uint64(1<<20), hdd.WALBytesPerSync)
+	require.True(t, hdd.ReadAhead)
+	ssd := tuneForStorageClass(cfg, StorageClassSSD)
+	require.Equal(t, uint64(4), ssd.MaxConcurrentCompactions)
+	require.Zero(t, ssd.WALBytesPerSync)
+	require.False(t, ssd.ReadAhead)
+	cfg.MaxConcurrentCompactions = 8
+	cfg.BytesPerSync = 1024
+	cfg.ReadAhead = true
+	ssd = tuneForStorageClass(cfg, StorageClassSSD)
+	require.Equal(t, uint64(8), ssd.MaxConcurrentCompactions)
+	require.Equal(t, uint64(1024), ssd.BytesPerSync)
+	require.True(t, ssd.ReadAhead)
+}
+
+func TestGetStorageClass(t *testing.T) {
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	require.Equal(t, StorageClassUnknown, getStorageClass(cfg, "db-dir"))
+	cfg.StorageClass = StorageClassHDD
+	require.Equal(t, StorageClassHDD, getStorageClass(cfg, "db-dir"))
+	cfg.FS = vfs.Default
+	cfg.StorageClass = StorageClassAuto
+	// the directory does not exist yet, its parents are checked
+	class := getStorageClass(cfg, t.TempDir()+"/not/created")
+	require.NotEqual(t, StorageClassAuto, class)
+	require.Equal(t, "network", StorageClassNetwork.String())
+}
+
+func TestStatsReportStorageClass(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		stats, err := db.(*ShardedDB).Stats()
+		require.NoError(t, err)
+		for _, st := range stats.Shards {
+			require.Equal(t, StorageClassUnknown, st.StorageClass)
+		}
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
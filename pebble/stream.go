@@ -0,0 +1,178 @@
+package pebble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// streamFormat identifies the type and version of a record stream. A record
+// stream starts with the magic and the version, followed by records made of
+// a uvarint length prefixed key and a uvarint length prefixed value. A zero
+// length key marks the end of the records and is followed by the CRC32 of
+// everything written before it.
+type streamFormat struct {
+	magic   [8]byte
+	version uint32
+	// invalid is the error returned when the stream is malformed.
+	invalid error
+}
+
+type recordWriter struct {
+	bw  *bufio.Writer
+	w   io.Writer
+	h   hash.Hash32
+	buf []byte
+}
+
+func newRecordWriter(w io.Writer, f streamFormat) (*recordWriter, error) {
+	bw := bufio.NewWriter(w)
+	h := crc32.NewIEEE()
+	rw := &recordWriter{
+		bw:  bw,
+		w:   io.MultiWriter(bw, h),
+		h:   h,
+		buf: make([]byte, binary.MaxVarintLen64),
+	}
+	if _, err := rw.w.Write(f.magic[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := binary.Write(rw.w, binary.BigEndian, f.version); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return rw, nil
+}
+
+func (rw *recordWriter) writeBytes(data []byte) error {
+	n := binary.PutUvarint(rw.buf, uint64(len(data)))
+	if _, err := rw.w.Write(rw.buf[:n]); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := rw.w.Write(data)
+	return errors.WithStack(err)
+}
+
+func (rw *recordWriter) write(key []byte, data []byte) error {
+	if err := rw.writeBytes(key); err != nil {
+		return err
+	}
+	return rw.writeBytes(data)
+}
+
+// finish writes the end marker and the checksum and flushes the stream.
+func (rw *recordWriter) finish() error {
+	if err := rw.writeBytes(nil); err != nil {
+		return err
+	}
+	if err := binary.Write(rw.bw, binary.BigEndian, rw.h.Sum32()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(rw.bw.Flush())
+}
+
+type recordReader struct {
+	br      *bufio.Reader
+	h       hash.Hash32
+	invalid error
+	done    bool
+}
+
+func newRecordReader(r io.Reader, f streamFormat) (*recordReader, error) {
+	rr := &recordReader{
+		br:      bufio.NewReader(r),
+		h:       crc32.NewIEEE(),
+		invalid: f.invalid,
+	}
+	var magic [8]byte
+	if _, err := io.ReadFull(rr, magic[:]); err != nil {
+		return nil, rr.fail(err)
+	}
+	if magic != f.magic {
+		return nil, errors.Wrap(f.invalid, "unexpected magic")
+	}
+	var version uint32
+	if err := binary.Read(rr, binary.BigEndian, &version); err != nil {
+		return nil, rr.fail(err)
+	}
+	if version != f.version {
+		return nil, errors.Wrapf(f.invalid, "unsupported version %d", version)
+	}
+	return rr, nil
+}
+
+// Read and ReadByte feed everything read before the checksum into the hash.
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.br.Read(p)
+	rr.h.Write(p[:n])
+	return n, err
+}
+
+func (rr *recordReader) ReadByte() (byte, error) {
+	b, err := rr.br.ReadByte()
+	if err == nil {
+		rr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (rr *recordReader) fail(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errors.Wrapf(rr.invalid, "%v", err)
+}
+
+func (rr *recordReader) readBytes() ([]byte, error) {
+	sz, err := binary.ReadUvarint(rr)
+	if err != nil {
+		return nil, rr.fail(err)
+	}
+	if sz > maxStreamRecordSize {
+		return nil, errors.Wrapf(rr.invalid, "record too large, %d", sz)
+	}
+	v := make([]byte, sz)
+	if _, err := io.ReadFull(rr, v); err != nil {
+		return nil, rr.fail(err)
+	}
+	return v, nil
+}
+
+// maxStreamRecordSize is the maximum accepted size of a single key or value,
+// it prevents corrupted length prefixes from causing huge allocations.
+const maxStreamRecordSize = 1 << 30
+
+// next returns the next record in the stream. Once the end marker is reached
+// the checksum is verified and ok is false.
+func (rr *recordReader) next() (key []byte, data []byte, ok bool, err error) {
+	if rr.done {
+		return nil, nil, false, nil
+	}
+	key, err = rr.readBytes()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(key) == 0 {
+		rr.done = true
+		sum := rr.h.Sum32()
+		var expected uint32
+		if err := binary.Read(rr.br, binary.BigEndian, &expected); err != nil {
+			return nil, nil, false, rr.fail(err)
+		}
+		if sum != expected {
+			return nil, nil, false, errors.Wrap(rr.invalid, "checksum mismatch")
+		}
+		if _, err := rr.br.ReadByte(); err != io.EOF {
+			return nil, nil, false, errors.Wrap(rr.invalid, "unexpected trailing data")
+		}
+		return nil, nil, false, nil
+	}
+	data, err = rr.readBytes()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return key, data, true, nil
+}
@@ -0,0 +1,226 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// The stress tests hammer the cache, the key pool and the worker contexts
+// from many goroutines. They are skipped unless enabled, run them with the
+// race detector enabled, e.g.
+//
+//	go test -race -run Stress ./pebble -stress
+var (
+	stressTest       = flag.Bool("stress", false, "run the concurrency stress tests")
+	stressGoroutines = flag.Int("stress.goroutines", 256, "number of goroutines used by the stress tests")
+	stressDuration   = flag.Duration("stress.duration", 5*time.Second, "duration of each stress test")
+)
+
+// runStress runs f from the configured number of goroutines until the stress
+// duration elapses, f returns false to stop early.
+func runStress(t *testing.T, f func(g int, iteration uint64) bool) {
+	if !*stressTest {
+		t.Skip("stress tests not enabled, use the -stress flag")
+	}
+	deadline := time.Now().Add(*stressDuration)
+	var wg sync.WaitGroup
+	for g := 0; g < *stressGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := uint64(0); time.Now().Before(deadline); i++ {
+				if !f(g, i) {
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestStressCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	c := newCache()
+	var mu sync.Mutex
+	failure := ""
+	fail := func(msg string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failure) == 0 {
+			failure = msg
+		}
+		return false
+	}
+	runStress(t, func(g int, i uint64) bool {
+		// each goroutine owns a node, all of them also share node 0
+		owned := uint64(g + 1)
+		for _, nodeID := range []uint64{owned, 0} {
+			eb := pb.EntryBatch{Entries: make([]pb.Entry, 1+i%8)}
+			for j := range eb.Entries {
+				eb.Entries[j] = pb.Entry{Index: i, Term: owned}
+			}
+			c.setLastBatch(1, nodeID, eb)
+			// the cache must have copied the batch
+			eb.Entries[0].Index = 0
+			lb, ok := c.getLastBatch(1, nodeID, pb.EntryBatch{})
+			if !ok || len(lb.Entries) == 0 {
+				return fail("last batch not found")
+			}
+			for _, e := range lb.Entries {
+				if e.Term != lb.Entries[0].Term || e.Index != lb.Entries[0].Index {
+					return fail("torn last entry batch")
+				}
+			}
+			if nodeID == owned && (lb.Entries[0].Index != i || uint64(len(lb.Entries)) != 1+i%8) {
+				return fail("unexpected last entry batch")
+			}
+			// the returned batch must be a copy
+			lb.Entries[0].Term = 0
+		}
+		c.setMaxIndex(1, owned, i)
+		if v, ok := c.getMaxIndex(1, owned); !ok || v != i {
+			return fail("unexpected max index")
+		}
+		if !c.trySaveSnapshot(1, owned, i+1) {
+			return fail("snapshot not saved")
+		}
+		c.setSnapshotIndex(1, owned, i+1)
+		if !c.setState(1, owned, pb.State{Term: i + 1}) {
+			return fail("state not saved")
+		}
+		c.setNodeInfo(1, owned)
+		return true
+	})
+	require.Empty(t, failure)
+}
+
+func TestStressKeyPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := newLogDBKeyPool(0)
+	var mu sync.Mutex
+	failure := ""
+	runStress(t, func(g int, i uint64) bool {
+		keys := make([]*Key, 4)
+		for j := range keys {
+			keys[j] = p.get()
+			if keys[j].Key() != nil {
+				mu.Lock()
+				failure = "released key not reset"
+				mu.Unlock()
+				return false
+			}
+			keys[j].SetEntryKey(uint64(g), uint64(j), i)
+		}
+		for j, k := range keys {
+			cid, nid, index := parseEntryKey(k.Key())
+			if cid != uint64(g) || nid != uint64(j) || index != i {
+				mu.Lock()
+				failure = "key shared by multiple holders"
+				mu.Unlock()
+				return false
+			}
+			k.Release()
+		}
+		return true
+	})
+	require.Empty(t, failure)
+}
+
+func stressCmd(clusterID uint64, index uint64) []byte {
+	cmd := make([]byte, 16)
+	binary.BigEndian.PutUint64(cmd, clusterID)
+	binary.BigEndian.PutUint64(cmd[8:], index)
+	return cmd
+}
+
+func TestStressContexts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	if !*stressTest {
+		t.Skip("stress tests not enabled, use the -stress flag")
+	}
+	cfg := GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	db, err := NewLogDB(cfg, nil, []string{"db"}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	var mu sync.Mutex
+	failure := ""
+	fail := func(msg string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failure) == 0 {
+			failure = msg
+		}
+		return false
+	}
+	var ctxs sync.Map
+	lastIndexes := make([]uint64, *stressGoroutines)
+	runStress(t, func(g int, i uint64) bool {
+		v, _ := ctxs.LoadOrStore(g, db.GetLogDBThreadContext())
+		ctx := v.(IContext)
+		ctx.Reset()
+		// each goroutine writes its own cluster and reads the clusters of
+		// others, all using the shared key pools and caches of the shards
+		clusterID := uint64(g + 1)
+		first := i*4 + 1
+		ud := pb.Update{
+			ClusterID: clusterID,
+			NodeID:    1,
+			State:     pb.State{Term: 1, Vote: 1, Commit: first + 3},
+		}
+		for index := first; index < first+4; index++ {
+			ud.EntriesToSave = append(ud.EntriesToSave,
+				pb.Entry{Index: index, Term: 1, Cmd: stressCmd(clusterID, index)})
+		}
+		if err := db.SaveRaftStateCtx([]pb.Update{ud}, ctx); err != nil {
+			return fail(err.Error())
+		}
+		lastIndexes[g] = first + 3
+		other := uint64((g+int(i))%*stressGoroutines + 1)
+		rs, err := db.ReadRaftState(other, 1, 0)
+		if errors.Is(err, raftio.ErrNoSavedLog) {
+			return true
+		} else if err != nil {
+			return fail(err.Error())
+		}
+		if rs.EntryCount == 0 {
+			return true
+		}
+		ents, _, err := db.IterateEntries(nil, 0, other, 1,
+			rs.FirstIndex, rs.FirstIndex+rs.EntryCount, ^uint64(0))
+		if err != nil {
+			return fail(err.Error())
+		}
+		for _, e := range ents {
+			if string(e.Cmd) != string(stressCmd(other, e.Index)) {
+				return fail("unexpected entry payload")
+			}
+		}
+		return true
+	})
+	ctxs.Range(func(k, v interface{}) bool {
+		v.(IContext).Destroy()
+		return true
+	})
+	require.Empty(t, failure)
+	for g, last := range lastIndexes {
+		if last == 0 {
+			continue
+		}
+		rs, err := db.ReadRaftState(uint64(g+1), 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, last, rs.EntryCount)
+	}
+}
@@ -0,0 +1,274 @@
+package pebble
+
+import (
+	"fmt"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// tenantShift is the number of low bits of the physical cluster ID used
+	// for the cluster ID of a tenant, the remaining high bits hold the tenant
+	// ID.
+	tenantShift = 48
+	// MaxTenantID is the largest tenant ID accepted by ShardedDB.Tenant.
+	MaxTenantID = 1<<(64-tenantShift) - 1
+	// MaxTenantClusterID is the largest cluster ID accepted by a TenantDB.
+	MaxTenantClusterID = 1<<tenantShift - 1
+)
+
+var (
+	// ErrInvalidTenant indicates that the tenant ID is above MaxTenantID.
+	ErrInvalidTenant = errors.New("invalid tenant")
+	// ErrInvalidTenantClusterID indicates that the cluster ID is above
+	// MaxTenantClusterID and can not be stored by a TenantDB.
+	ErrInvalidTenantClusterID = errors.New("invalid tenant cluster ID")
+)
+
+// TenantDB is a logical LogDB stored in the shards of a ShardedDB, several
+// TenantDB instances, e.g. one for each group of tenants on a dense host,
+// share the pebble instances of a single ShardedDB instead of opening their
+// own. The cluster ID of each record is stored with the tenant ID in its high
+// bits, so ListNodeInfo only returns the nodes of the tenant and RemoveNodeData
+// can not remove records of other tenants. Cluster IDs are limited to
+// MaxTenantClusterID.
+//
+// Tenant 0 maps cluster IDs to themselves, records saved to the ShardedDB
+// itself are thus visible to tenant 0. The ShardedDB lists the nodes of all
+// tenants with their physical cluster IDs, it should not be used as a LogDB
+// once tenants are in use.
+type TenantDB struct {
+	s  *ShardedDB
+	id uint64
+}
+
+var _ raftio.ILogDB = (*TenantDB)(nil)
+
+// Tenant returns the logical LogDB of the specified tenant. The returned
+// TenantDB does not own the ShardedDB, closing it has no effect, the
+// ShardedDB must be closed once all its tenants are no longer used.
+func (s *ShardedDB) Tenant(id uint64) (*TenantDB, error) {
+	if id > MaxTenantID {
+		return nil, errors.Wrapf(ErrInvalidTenant, "%d", id)
+	}
+	return &TenantDB{s: s, id: id}, nil
+}
+
+// ID returns the ID of the tenant.
+func (t *TenantDB) ID() uint64 {
+	return t.id
+}
+
+// physical returns the cluster ID used by the ShardedDB for the specified
+// cluster of the tenant.
+func (t *TenantDB) physical(clusterID uint64) (uint64, error) {
+	if clusterID > MaxTenantClusterID {
+		return 0, errors.Wrapf(ErrInvalidTenantClusterID, "%d", clusterID)
+	}
+	return t.id<<tenantShift | clusterID, nil
+}
+
+func (t *TenantDB) logical(clusterID uint64) uint64 {
+	return clusterID & MaxTenantClusterID
+}
+
+// physicalUpdates returns copies of the specified updates with physical
+// cluster IDs, grouped by the partition of their physical cluster IDs.
+func (t *TenantDB) physicalUpdates(
+	updates []pb.Update) (map[uint64][]pb.Update, error) {
+	result := make(map[uint64][]pb.Update)
+	for _, ud := range updates {
+		cid, err := t.physical(ud.ClusterID)
+		if err != nil {
+			return nil, err
+		}
+		ud.ClusterID = cid
+		if !pb.IsEmptySnapshot(ud.Snapshot) {
+			ud.Snapshot.ClusterId = cid
+		}
+		p := t.s.partitioner.GetPartitionID(cid)
+		result[p] = append(result[p], ud)
+	}
+	return result, nil
+}
+
+// Name returns the type name of the instance.
+func (t *TenantDB) Name() string {
+	return fmt.Sprintf("tenant-%d-%s", t.id, t.s.Name())
+}
+
+// Close has no effect, the ShardedDB is not owned by the TenantDB.
+func (t *TenantDB) Close() error {
+	return nil
+}
+
+// BinaryFormat is the binary format supported by the ShardedDB.
+func (t *TenantDB) BinaryFormat() uint32 {
+	return t.s.BinaryFormat()
+}
+
+// ListNodeInfo lists the NodeInfo of the nodes of the tenant.
+func (t *TenantDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	shards, err := t.s.allShards()
+	if err != nil {
+		return nil, err
+	}
+	first := t.id << tenantShift
+	last := first | MaxTenantClusterID
+	r := make([]raftio.NodeInfo, 0)
+	op := func(ni raftio.NodeInfo) (bool, error) {
+		r = append(r, raftio.GetNodeInfo(t.logical(ni.ClusterID), ni.NodeID))
+		return true, nil
+	}
+	for _, shard := range shards {
+		if err := shard.iterateNodeInfo(first, last, op); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return r, nil
+}
+
+// SaveBootstrapInfo saves the specified bootstrap info for the given node.
+func (t *TenantDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return err
+	}
+	return t.s.SaveBootstrapInfo(cid, nodeID, bootstrap)
+}
+
+// GetBootstrapInfo returns the saved bootstrap info for the given node.
+func (t *TenantDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return pb.Bootstrap{}, err
+	}
+	return t.s.GetBootstrapInfo(cid, nodeID)
+}
+
+// SaveRaftState saves the raft state and logs found in the raft.Update list.
+// The contexts of the ShardedDB are shared by all tenants, so a context is
+// acquired from the context pool of the specified shard ID for each save.
+// Updates placed in different shards are saved separately.
+func (t *TenantDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	partitions, err := t.physicalUpdates(updates)
+	if err != nil {
+		return err
+	}
+	ctx := t.s.AcquireContext(shardID)
+	defer t.s.ReleaseContext(ctx)
+	for _, uds := range partitions {
+		ctx.Reset()
+		if err := t.s.SaveRaftStateCtx(uds, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IterateEntries returns a list of saved entries starting with index low up to
+// index high with a max size of maxSize.
+func (t *TenantDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t.s.IterateEntries(ents, size, cid, nodeID, low, high, maxSize)
+}
+
+// ReadRaftState returns the persistent state of the specified raft node.
+func (t *TenantDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	return t.s.ReadRaftState(cid, nodeID, lastIndex)
+}
+
+// RemoveEntriesTo removes entries associated with the specified raft node up
+// to the specified index.
+func (t *TenantDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return err
+	}
+	return t.s.RemoveEntriesTo(cid, nodeID, index)
+}
+
+// CompactEntriesTo reclaims underlying storage space used for storing
+// entries up to the specified index.
+func (t *TenantDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return t.s.CompactEntriesTo(cid, nodeID, index)
+}
+
+// SaveSnapshots saves all snapshot metadata found in the raft.Update list.
+func (t *TenantDB) SaveSnapshots(updates []pb.Update) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	partitions, err := t.physicalUpdates(updates)
+	if err != nil {
+		return err
+	}
+	for _, uds := range partitions {
+		if err := t.s.SaveSnapshots(uds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSnapshot returns the most recent snapshot associated with the specified
+// cluster.
+func (t *TenantDB) GetSnapshot(clusterID uint64,
+	nodeID uint64) (pb.Snapshot, error) {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	ss, err := t.s.GetSnapshot(cid, nodeID)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		ss.ClusterId = t.logical(ss.ClusterId)
+	}
+	return ss, nil
+}
+
+// RemoveNodeData deletes all node data that belongs to the specified node of
+// the tenant.
+func (t *TenantDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	cid, err := t.physical(clusterID)
+	if err != nil {
+		return err
+	}
+	return t.s.RemoveNodeData(cid, nodeID)
+}
+
+// ImportSnapshot imports the snapshot record and other metadata records to the
+// system.
+func (t *TenantDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	cid, err := t.physical(ss.ClusterId)
+	if err != nil {
+		return err
+	}
+	ss.ClusterId = cid
+	return t.s.ImportSnapshot(ss, nodeID)
+}
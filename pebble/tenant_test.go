@@ -0,0 +1,116 @@
+package pebble
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func saveTenantNode(t *testing.T,
+	db *TenantDB, clusterID uint64, nodeID uint64, count uint64) {
+	require.NoError(t, db.SaveBootstrapInfo(clusterID, nodeID, pb.Bootstrap{Join: true}))
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= count; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 16)})
+	}
+	ud := pb.Update{
+		ClusterID:     clusterID,
+		NodeID:        nodeID,
+		State:         pb.State{Term: 1, Vote: 2, Commit: count},
+		EntriesToSave: ents,
+	}
+	require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		t1, err := sdb.Tenant(1)
+		require.NoError(t, err)
+		t2, err := sdb.Tenant(2)
+		require.NoError(t, err)
+		saveTenantNode(t, t1, 1, 2, 10)
+		saveTenantNode(t, t2, 1, 2, 20)
+		saveTenantNode(t, t2, 3, 4, 20)
+		saveTestNode(t, sdb, 1, 2, 30)
+		ni, err := t1.ListNodeInfo()
+		require.NoError(t, err)
+		require.Equal(t, []raftio.NodeInfo{{ClusterID: 1, NodeID: 2}}, ni)
+		ni, err = t2.ListNodeInfo()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []raftio.NodeInfo{
+			{ClusterID: 1, NodeID: 2}, {ClusterID: 3, NodeID: 4}}, ni)
+		ni, err = sdb.ListNodeInfo()
+		require.NoError(t, err)
+		require.Len(t, ni, 4)
+		t0, err := sdb.Tenant(0)
+		require.NoError(t, err)
+		rs, err := t0.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), rs.EntryCount)
+		rs, err = t1.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), rs.EntryCount)
+		ents, _, err := t2.IterateEntries(nil, 0, 1, 2, 1, 21, math.MaxUint64)
+		require.NoError(t, err)
+		require.Len(t, ents, 20)
+		require.NoError(t, t1.RemoveNodeData(1, 2))
+		ni, err = t1.ListNodeInfo()
+		require.NoError(t, err)
+		require.Empty(t, ni)
+		rs, err = t2.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(20), rs.EntryCount)
+		rs, err = t0.ReadRaftState(1, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), rs.EntryCount)
+		require.NoError(t, t2.Close())
+		_, err = t2.GetBootstrapInfo(3, 4)
+		require.NoError(t, err)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestTenantSnapshotsUseLogicalClusterID(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		tenant, err := sdb.Tenant(3)
+		require.NoError(t, err)
+		saveTenantNode(t, tenant, 1, 2, 10)
+		ss := pb.Snapshot{ClusterId: 1, Index: 5, Term: 1, Filepath: "f"}
+		require.NoError(t, tenant.SaveSnapshots([]pb.Update{{
+			ClusterID: 1, NodeID: 2, Snapshot: ss}}))
+		got, err := tenant.GetSnapshot(1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), got.ClusterId)
+		require.Equal(t, uint64(5), got.Index)
+		_, err = sdb.GetSnapshot(1, 2)
+		require.True(t, errors.Is(err, raftio.ErrNoSavedLog) || err == nil)
+		got, err = sdb.GetSnapshot(3<<tenantShift|1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), got.Index)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestTenantLimits(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		_, err := sdb.Tenant(MaxTenantID + 1)
+		require.True(t, errors.Is(err, ErrInvalidTenant))
+		tenant, err := sdb.Tenant(MaxTenantID)
+		require.NoError(t, err)
+		err = tenant.SaveBootstrapInfo(MaxTenantClusterID+1, 1, pb.Bootstrap{})
+		require.True(t, errors.Is(err, ErrInvalidTenantClusterID))
+		require.NoError(t, tenant.SaveBootstrapInfo(MaxTenantClusterID, 1, pb.Bootstrap{}))
+		ni, err := tenant.ListNodeInfo()
+		require.NoError(t, err)
+		require.Equal(t, []raftio.NodeInfo{{ClusterID: MaxTenantClusterID, NodeID: 1}}, ni)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
@@ -0,0 +1,203 @@
+package testutil
+
+import (
+	"sync/atomic"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat-logdb/pebble/fileutil"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// CrashTestDB is a LogDB running on top of a strict in-memory FS, it is used
+// to write deterministic power failure tests. Crash simulates a power failure
+// by dropping all data that was not synced to the FS, Restart reopens the
+// LogDB on top of whatever survived the crash.
+type CrashTestDB struct {
+	fs     *vfs.MemFS
+	syncs  *syncFS
+	db     *pebble.ShardedDB
+	config pebble.LogDBConfig
+	dirs   []string
+	lldirs []string
+}
+
+// NewCrashTestDB creates a CrashTestDB instance and opens its LogDB in the
+// specified directories. The FS field of the config is replaced by the strict
+// in-memory FS.
+func NewCrashTestDB(config pebble.LogDBConfig,
+	dirs []string, lldirs []string) (*CrashTestDB, error) {
+	fs := vfs.NewStrictMem()
+	c := &CrashTestDB{
+		fs:     fs,
+		syncs:  newSyncFS(fs),
+		config: config,
+		dirs:   dirs,
+		lldirs: lldirs,
+	}
+	c.config.FS = c.syncs
+	if err := c.Restart(); err != nil {
+		return nil, err
+	}
+	// the LogDB never syncs the working directory, it is synced here so
+	// directories specified using relative paths survive crashes the same way
+	// they do on a real file system where the working directory already exists
+	if err := fileutil.SyncDir("/", c.fs); err != nil {
+		return nil, firstError(err, c.Close())
+	}
+	return c, nil
+}
+
+// DB returns the currently opened LogDB, nil is returned when the LogDB was
+// crashed or closed and hasn't been restarted yet.
+func (c *CrashTestDB) DB() *pebble.ShardedDB {
+	return c.db
+}
+
+// FS returns the strict in-memory FS used by the LogDB.
+func (c *CrashTestDB) FS() *vfs.MemFS {
+	return c.fs
+}
+
+// Crash simulates a power failure. The LogDB is closed with all syncs ignored
+// so nothing written during the close is persisted, all unsynced data is then
+// discarded. The error returned by closing the LogDB is ignored as the LogDB
+// is not expected to shutdown cleanly. Any power failure armed by KillAtSync
+// is disarmed.
+func (c *CrashTestDB) Crash() {
+	c.fs.SetIgnoreSyncs(true)
+	if c.db != nil {
+		_ = c.db.Close()
+		c.db = nil
+	}
+	c.fs.ResetToSyncedState()
+	c.syncs.disarm()
+	c.fs.SetIgnoreSyncs(false)
+}
+
+// KillAtSync arms a power failure happening at the n-th sync from now, n
+// starts from 1. The n-th and all following syncs are silently dropped as if
+// the machine lost power right before the n-th sync, so nothing written since
+// the previous sync survives the next Crash. Operations can not observe the
+// power failure, use Killed to find out whether it happened.
+func (c *CrashTestDB) KillAtSync(n int) {
+	if n <= 0 {
+		panic("invalid sync number")
+	}
+	c.syncs.arm(int64(n))
+}
+
+// Killed returns a boolean value indicating whether the power failure armed by
+// KillAtSync happened.
+func (c *CrashTestDB) Killed() bool {
+	return c.syncs.killed()
+}
+
+// Restart opens the LogDB on top of the current state of the FS. The LogDB is
+// crashed first when it is still open.
+func (c *CrashTestDB) Restart() error {
+	if c.db != nil {
+		c.Crash()
+	}
+	db, err := pebble.NewLogDB(c.config, nil, c.dirs, c.lldirs, pebble.CheckNone)
+	if err != nil {
+		return errors.Wrap(err, "failed to open LogDB")
+	}
+	c.db = db
+	return nil
+}
+
+// Close closes the LogDB cleanly.
+func (c *CrashTestDB) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	err := c.db.Close()
+	c.db = nil
+	return err
+}
+
+func firstError(err1 error, err2 error) error {
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// syncFS counts the syncs issued to the strict in-memory FS so a power failure
+// can be simulated at a selected sync.
+type syncFS struct {
+	vfs.FS
+	mem *vfs.MemFS
+	// remaining is the number of syncs before the power failure, it is
+	// negative when no power failure is armed.
+	remaining int64
+	dead      int32
+}
+
+func newSyncFS(mem *vfs.MemFS) *syncFS {
+	return &syncFS{FS: mem, mem: mem, remaining: -1}
+}
+
+func (s *syncFS) arm(n int64) {
+	atomic.StoreInt32(&s.dead, 0)
+	atomic.StoreInt64(&s.remaining, n)
+}
+
+func (s *syncFS) disarm() {
+	atomic.StoreInt64(&s.remaining, -1)
+	atomic.StoreInt32(&s.dead, 0)
+}
+
+func (s *syncFS) killed() bool {
+	return atomic.LoadInt32(&s.dead) == 1
+}
+
+func (s *syncFS) sync(f vfs.File) error {
+	if atomic.AddInt64(&s.remaining, -1) == 0 {
+		s.mem.SetIgnoreSyncs(true)
+		atomic.StoreInt32(&s.dead, 1)
+	}
+	return f.Sync()
+}
+
+func (s *syncFS) wrap(f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &syncFile{File: f, fs: s}, nil
+}
+
+// Create ...
+func (s *syncFS) Create(name string) (vfs.File, error) {
+	return s.wrap(s.FS.Create(name))
+}
+
+// Open ...
+func (s *syncFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	return s.wrap(s.FS.Open(name, opts...))
+}
+
+// OpenDir ...
+func (s *syncFS) OpenDir(name string) (vfs.File, error) {
+	return s.wrap(s.FS.OpenDir(name))
+}
+
+// OpenForAppend ...
+func (s *syncFS) OpenForAppend(name string) (vfs.File, error) {
+	return s.wrap(s.FS.OpenForAppend(name))
+}
+
+// ReuseForWrite ...
+func (s *syncFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	return s.wrap(s.FS.ReuseForWrite(oldname, newname))
+}
+
+type syncFile struct {
+	vfs.File
+	fs *syncFS
+}
+
+func (f *syncFile) Sync() error {
+	return f.fs.sync(f.File)
+}
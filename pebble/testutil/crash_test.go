@@ -0,0 +1,111 @@
+package testutil
+
+import (
+	"math"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashTestDBKeepsSyncedData(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	c, err := NewCrashTestDB(pebble.GetTinyMemLogDBConfig(), []string{"db"}, nil)
+	require.NoError(t, err)
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= 10; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1})
+	}
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Vote: 2, Commit: 10},
+		EntriesToSave: ents,
+	}
+	require.NoError(t, c.DB().SaveRaftState([]pb.Update{ud}, 1))
+	f, err := c.FS().Create("unsynced")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c.Crash()
+	require.Nil(t, c.DB())
+	_, err = c.FS().Stat("unsynced")
+	require.Error(t, err)
+	require.NoError(t, c.Restart())
+	rs, err := c.DB().ReadRaftState(1, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	require.Equal(t, ud.State, rs.State)
+	require.NoError(t, c.Restart())
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+}
+
+func TestCrashTestDBKillAtSync(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	c, err := NewCrashTestDB(pebble.GetTinyMemLogDBConfig(), []string{"db"}, nil)
+	require.NoError(t, err)
+	c.KillAtSync(1)
+	require.False(t, c.Killed())
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Vote: 2, Commit: 1},
+		EntriesToSave: []pb.Entry{{Index: 1, Term: 1}},
+	}
+	require.NoError(t, c.DB().SaveRaftState([]pb.Update{ud}, 1))
+	require.True(t, c.Killed())
+	require.NoError(t, c.Restart())
+	require.False(t, c.Killed())
+	_, err = c.DB().ReadRaftState(1, 2, 1)
+	require.Equal(t, raftio.ErrNoSavedLog, errors.Cause(err))
+	require.NoError(t, c.Close())
+}
+
+func TestNodeDataRemovalIsAtomic(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	for n := 1; n <= 3; n++ {
+		c, err := NewCrashTestDB(pebble.GetTinyMemLogDBConfig(), []string{"db"}, nil)
+		require.NoError(t, err)
+		db := c.DB()
+		require.NoError(t, db.SaveBootstrapInfo(1, 2, pb.Bootstrap{Join: true}))
+		ents := make([]pb.Entry, 0)
+		for i := uint64(1); i <= 100; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1})
+		}
+		ud := pb.Update{
+			ClusterID:     1,
+			NodeID:        2,
+			State:         pb.State{Term: 1, Vote: 2, Commit: 100},
+			EntriesToSave: ents,
+		}
+		require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+		c.KillAtSync(n)
+		require.NoError(t, db.RemoveNodeData(1, 2))
+		c.Crash()
+		require.NoError(t, c.Restart())
+		_, err = c.DB().GetBootstrapInfo(1, 2)
+		bootstrapped := err == nil
+		ents, _, err = c.DB().IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+		require.NoError(t, err)
+		if bootstrapped {
+			require.Len(t, ents, 100)
+		} else {
+			require.Empty(t, ents)
+		}
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestPowerFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	for seed := int64(1); seed <= 3; seed++ {
+		require.NoError(t, RunPowerFailureTest(DefaultPowerFailureConfig(seed)))
+	}
+}
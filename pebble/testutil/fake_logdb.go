@@ -0,0 +1,259 @@
+package testutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/logdb"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+type fakeNode struct {
+	bootstrap *pb.Bootstrap
+	state     pb.State
+	hasState  bool
+	maxIndex  uint64
+	entries   map[uint64]pb.Entry
+	snapshot  pb.Snapshot
+}
+
+// FakeLogDB is an in-memory pebble.ILogDB implementation mimicking the
+// behavior of the ShardedDB, it is intended to be used in unit tests of
+// components holding a LogDB reference. Nothing survives closing it.
+type FakeLogDB struct {
+	mu    sync.Mutex
+	nodes map[raftio.NodeInfo]*fakeNode
+}
+
+var _ pebble.ILogDB = (*FakeLogDB)(nil)
+
+// NewFakeLogDB creates an empty FakeLogDB instance.
+func NewFakeLogDB() *FakeLogDB {
+	return &FakeLogDB{nodes: make(map[raftio.NodeInfo]*fakeNode)}
+}
+
+func (f *FakeLogDB) node(clusterID uint64, nodeID uint64) *fakeNode {
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	n, ok := f.nodes[ni]
+	if !ok {
+		n = &fakeNode{entries: make(map[uint64]pb.Entry)}
+		f.nodes[ni] = n
+	}
+	return n
+}
+
+// Name ...
+func (f *FakeLogDB) Name() string {
+	return "fake"
+}
+
+// Close ...
+func (f *FakeLogDB) Close() error {
+	return nil
+}
+
+// BinaryFormat ...
+func (f *FakeLogDB) BinaryFormat() uint32 {
+	return raftio.PlainLogDBBinVersion
+}
+
+// ListNodeInfo ...
+func (f *FakeLogDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]raftio.NodeInfo, 0)
+	for ni, n := range f.nodes {
+		if n.bootstrap != nil {
+			result = append(result, ni)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ClusterID != result[j].ClusterID {
+			return result[i].ClusterID < result[j].ClusterID
+		}
+		return result[i].NodeID < result[j].NodeID
+	})
+	return result, nil
+}
+
+// SaveBootstrapInfo ...
+func (f *FakeLogDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.node(clusterID, nodeID).bootstrap = &bootstrap
+	return nil
+}
+
+// GetBootstrapInfo ...
+func (f *FakeLogDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.node(clusterID, nodeID)
+	if n.bootstrap == nil {
+		return pb.Bootstrap{}, errors.WithStack(raftio.ErrNoBootstrapInfo)
+	}
+	return *n.bootstrap, nil
+}
+
+// SaveRaftState ...
+func (f *FakeLogDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ud := range updates {
+		n := f.node(ud.ClusterID, ud.NodeID)
+		if !pb.IsEmptyState(ud.State) {
+			n.state = ud.State
+			n.hasState = true
+		}
+		if !pb.IsEmptySnapshot(ud.Snapshot) && ud.Snapshot.Index > n.snapshot.Index {
+			n.snapshot = ud.Snapshot
+			n.maxIndex = ud.Snapshot.Index
+		}
+		for _, e := range ud.EntriesToSave {
+			n.entries[e.Index] = e
+		}
+		if len(ud.EntriesToSave) > 0 {
+			n.maxIndex = ud.EntriesToSave[len(ud.EntriesToSave)-1].Index
+		}
+	}
+	return nil
+}
+
+// IterateEntries ...
+func (f *FakeLogDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.node(clusterID, nodeID)
+	if high > n.maxIndex+1 {
+		high = n.maxIndex + 1
+	}
+	for i := low; i < high; i++ {
+		e, ok := n.entries[i]
+		if !ok {
+			break
+		}
+		size += uint64(e.SizeUpperLimit())
+		ents = append(ents, e)
+		if size > maxSize {
+			break
+		}
+	}
+	return ents, size, nil
+}
+
+// ReadRaftState ...
+func (f *FakeLogDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.node(clusterID, nodeID)
+	if !n.hasState {
+		return raftio.RaftState{}, errors.WithStack(raftio.ErrNoSavedLog)
+	}
+	rs := raftio.RaftState{State: n.state, FirstIndex: lastIndex}
+	if n.maxIndex <= lastIndex {
+		return rs, nil
+	}
+	for i := lastIndex; i <= n.maxIndex; i++ {
+		if _, ok := n.entries[i]; ok {
+			rs.FirstIndex = i
+			rs.EntryCount = n.maxIndex - i + 1
+			break
+		}
+	}
+	return rs, nil
+}
+
+// RemoveEntriesTo ...
+func (f *FakeLogDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.node(clusterID, nodeID)
+	for i := range n.entries {
+		if i < index {
+			delete(n.entries, i)
+		}
+	}
+	return nil
+}
+
+// CompactEntriesTo ...
+func (f *FakeLogDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	close(done)
+	return done, nil
+}
+
+// SaveSnapshots ...
+func (f *FakeLogDB) SaveSnapshots(updates []pb.Update) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ud := range updates {
+		n := f.node(ud.ClusterID, ud.NodeID)
+		if !pb.IsEmptySnapshot(ud.Snapshot) && ud.Snapshot.Index > n.snapshot.Index {
+			n.snapshot = ud.Snapshot
+		}
+	}
+	return nil
+}
+
+// GetSnapshot ...
+func (f *FakeLogDB) GetSnapshot(clusterID uint64,
+	nodeID uint64) (pb.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.node(clusterID, nodeID).snapshot, nil
+}
+
+// RemoveNodeData ...
+func (f *FakeLogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.nodes, raftio.GetNodeInfo(clusterID, nodeID))
+	return nil
+}
+
+// ImportSnapshot ...
+func (f *FakeLogDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	if ss.Type == pb.UnknownStateMachine {
+		panic("Unknown state machine type")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.node(ss.ClusterId, nodeID)
+	n.bootstrap = &pb.Bootstrap{Join: true, Type: ss.Type}
+	n.state = pb.State{Term: ss.Term, Commit: ss.Index}
+	n.hasState = true
+	n.snapshot = ss
+	n.maxIndex = ss.Index
+	return nil
+}
+
+// MemoryEngine is the name of the storage engine creating FakeLogDB
+// instances, it is registered with pebble.RegisterEngine when this package
+// is imported so tests can select it using LogDBConfig.Engine.
+const MemoryEngine = "memory"
+
+func init() {
+	pebble.RegisterEngine(memoryFactory{})
+}
+
+type memoryFactory struct{}
+
+func (memoryFactory) Create(config pebble.LogDBConfig, callback logdb.LogDBCallback,
+	dirs []string, lldirs []string) (pebble.ILogDB, error) {
+	return NewFakeLogDB(), nil
+}
+
+func (memoryFactory) Name() string {
+	return MemoryEngine
+}
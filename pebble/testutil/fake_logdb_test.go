@@ -0,0 +1,123 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLogDBResult struct {
+	nodes     []raftio.NodeInfo
+	bootstrap pb.Bootstrap
+	state     raftio.RaftState
+	trimmed   raftio.RaftState
+	entries   []pb.Entry
+	snapshot  pb.Snapshot
+	imported  raftio.RaftState
+}
+
+func runFakeLogDBScenario(t *testing.T, db pebble.ILogDB) fakeLogDBResult {
+	r := fakeLogDBResult{}
+	_, err := db.GetBootstrapInfo(1, 1)
+	require.Equal(t, raftio.ErrNoBootstrapInfo, errors.Cause(err))
+	_, err = db.ReadRaftState(1, 1, 0)
+	require.Equal(t, raftio.ErrNoSavedLog, errors.Cause(err))
+	require.NoError(t, db.SaveBootstrapInfo(1, 1, pb.Bootstrap{Type: pb.RegularStateMachine}))
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= 20; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 2, Cmd: []byte("data")})
+	}
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        1,
+		State:         pb.State{Term: 2, Vote: 1, Commit: 20},
+		EntriesToSave: ents,
+	}
+	require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+	// overwrite the tail of the log
+	ud = pb.Update{
+		ClusterID:     1,
+		NodeID:        1,
+		State:         pb.State{Term: 3, Vote: 1, Commit: 15},
+		EntriesToSave: []pb.Entry{{Index: 15, Term: 3}, {Index: 16, Term: 3}},
+	}
+	require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+	ud = pb.Update{
+		ClusterID: 1,
+		NodeID:    1,
+		Snapshot:  pb.Snapshot{Index: 10, Term: 2, Type: pb.RegularStateMachine},
+	}
+	require.NoError(t, db.SaveSnapshots([]pb.Update{ud}))
+	r.nodes, err = db.ListNodeInfo()
+	require.NoError(t, err)
+	r.bootstrap, err = db.GetBootstrapInfo(1, 1)
+	require.NoError(t, err)
+	r.state, err = db.ReadRaftState(1, 1, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.RemoveEntriesTo(1, 1, 10))
+	done, err := db.CompactEntriesTo(1, 1, 10)
+	require.NoError(t, err)
+	<-done
+	r.trimmed, err = db.ReadRaftState(1, 1, 5)
+	require.NoError(t, err)
+	r.entries, _, err = db.IterateEntries(nil, 0, 1, 1, 10, 30, ^uint64(0))
+	require.NoError(t, err)
+	r.snapshot, err = db.GetSnapshot(1, 1)
+	require.NoError(t, err)
+	require.NoError(t, db.RemoveNodeData(1, 1))
+	ss := pb.Snapshot{
+		ClusterId: 1,
+		Index:     100,
+		Term:      5,
+		Type:      pb.OnDiskStateMachine,
+		Membership: pb.Membership{
+			Addresses: map[uint64]string{2: "a2"},
+		},
+	}
+	require.NoError(t, db.ImportSnapshot(ss, 2))
+	r.imported, err = db.ReadRaftState(1, 2, 100)
+	require.NoError(t, err)
+	return r
+}
+
+func TestFakeLogDBMatchesShardedDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	c, err := NewCrashTestDB(pebble.GetTinyMemLogDBConfig(), []string{"db"}, nil)
+	require.NoError(t, err)
+	expected := runFakeLogDBScenario(t, c.DB())
+	require.NoError(t, c.Close())
+	fake := NewFakeLogDB()
+	result := runFakeLogDBScenario(t, fake)
+	require.Equal(t, expected, result)
+	require.NoError(t, fake.Close())
+}
+
+func TestMockLogDB(t *testing.T) {
+	m := &MockLogDB{
+		GetSnapshotFunc: func(clusterID uint64, nodeID uint64) (pb.Snapshot, error) {
+			return pb.Snapshot{Index: clusterID + nodeID}, nil
+		},
+	}
+	var db pebble.ILogDB = m
+	ss, err := db.GetSnapshot(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ss.Index)
+	calls := m.GetSnapshotCalls()
+	require.Len(t, calls, 1)
+	require.Equal(t, uint64(2), calls[0].NodeID)
+}
+
+func TestMemoryEngineIsRegistered(t *testing.T) {
+	cfg := pebble.GetDefaultLogDBConfig()
+	cfg.Engine = MemoryEngine
+	db, err := pebble.OpenLogDB(cfg, nil, []string{"unused"}, nil)
+	require.NoError(t, err)
+	_, ok := db.(*FakeLogDB)
+	require.True(t, ok)
+	require.NoError(t, db.Close())
+}
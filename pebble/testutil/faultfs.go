@@ -0,0 +1,358 @@
+/*
+Package testutil provides helpers for testing applications built on top of
+the pebble based LogDB against storage failures.
+*/
+package testutil
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the error returned by operations failed by a FaultFS.
+var ErrInjected = errors.New("injected fault")
+
+// Op is the type of a file system operation faults can be injected into.
+type Op int
+
+const (
+	// OpOpen covers creating and opening files and directories.
+	OpOpen Op = iota
+	// OpRead covers reading files and listing directories.
+	OpRead
+	// OpWrite covers writing files.
+	OpWrite
+	// OpSync covers syncing files and directories.
+	OpSync
+	// OpRemove covers removing files and directories.
+	OpRemove
+	// OpRename covers renaming and linking files.
+	OpRename
+)
+
+// Fault is the type of the failure injected into an operation.
+type Fault int
+
+const (
+	// FaultError fails the operation with ErrInjected.
+	FaultError Fault = iota
+	// FaultShortWrite writes only a part of the data and returns
+	// io.ErrShortWrite. It can only be used with OpWrite.
+	FaultShortWrite
+	// FaultDropSync reports success without syncing the file, the unsynced
+	// data is lost when the underlying strict MemFS is reset to the synced
+	// state. It can only be used with OpSync.
+	FaultDropSync
+)
+
+// Rule describes when and which fault is injected.
+type Rule struct {
+	// Pattern is matched against the base name of the file using
+	// filepath.Match, an empty pattern matches all files.
+	Pattern string
+	// Op is the operation the fault is injected into.
+	Op Op
+	// Fault is the type of the injected fault.
+	Fault Fault
+	// Probability is the probability of injecting the fault into a matching
+	// operation, in the range of [0, 1].
+	Probability float64
+}
+
+func (r Rule) validate() error {
+	if _, err := filepath.Match(r.Pattern, ""); err != nil {
+		return errors.Wrapf(err, "invalid pattern %s", r.Pattern)
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return errors.Errorf("invalid probability %f", r.Probability)
+	}
+	if r.Fault == FaultShortWrite && r.Op != OpWrite {
+		return errors.New("short writes can only be injected into writes")
+	}
+	if r.Fault == FaultDropSync && r.Op != OpSync {
+		return errors.New("dropped syncs can only be injected into syncs")
+	}
+	return nil
+}
+
+func (r Rule) matches(name string, op Op) bool {
+	if r.Op != op {
+		return false
+	}
+	if r.Pattern == "" {
+		return true
+	}
+	matched, _ := filepath.Match(r.Pattern, filepath.Base(name))
+	return matched
+}
+
+// FaultFS is a vfs.FS wrapper injecting faults into the operations of the
+// wrapped FS according to its rules. It can be set as LogDBConfig.FS.
+type FaultFS struct {
+	fs       vfs.FS
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	rules    []Rule
+	injected uint64
+}
+
+var _ vfs.FS = (*FaultFS)(nil)
+
+// NewFaultFS creates a FaultFS instance wrapping fs. The seed makes the
+// probabilistic fault injection reproducible.
+func NewFaultFS(fs vfs.FS, seed int64, rules ...Rule) (*FaultFS, error) {
+	f := &FaultFS{
+		fs:  fs,
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+	for _, r := range rules {
+		if err := f.AddRule(r); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// AddRule adds a fault injection rule.
+func (f *FaultFS) AddRule(r Rule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// ClearRules removes all rules, no more faults are injected afterwards.
+func (f *FaultFS) ClearRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = nil
+}
+
+// Injected returns the number of faults injected so far.
+func (f *FaultFS) Injected() uint64 {
+	return atomic.LoadUint64(&f.injected)
+}
+
+// Unwrap returns the wrapped FS.
+func (f *FaultFS) Unwrap() vfs.FS {
+	return f.fs
+}
+
+// fault returns the fault to be injected into the operation, ok is false when
+// the operation should be executed normally.
+func (f *FaultFS) fault(name string, op Op) (Fault, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.rules {
+		if r.matches(name, op) && f.rnd.Float64() < r.Probability {
+			atomic.AddUint64(&f.injected, 1)
+			return r.Fault, true
+		}
+	}
+	return 0, false
+}
+
+func (f *FaultFS) maybeError(name string, op Op) error {
+	if _, ok := f.fault(name, op); ok {
+		return errors.Wrapf(ErrInjected, "%s", name)
+	}
+	return nil
+}
+
+func (f *FaultFS) wrap(name string, file vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+// Create ...
+func (f *FaultFS) Create(name string) (vfs.File, error) {
+	if err := f.maybeError(name, OpOpen); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Create(name)
+	return f.wrap(name, file, err)
+}
+
+// Link ...
+func (f *FaultFS) Link(oldname, newname string) error {
+	if err := f.maybeError(newname, OpRename); err != nil {
+		return err
+	}
+	return f.fs.Link(oldname, newname)
+}
+
+// Open ...
+func (f *FaultFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	if err := f.maybeError(name, OpOpen); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.Open(name, opts...)
+	return f.wrap(name, file, err)
+}
+
+// OpenDir ...
+func (f *FaultFS) OpenDir(name string) (vfs.File, error) {
+	if err := f.maybeError(name, OpOpen); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenDir(name)
+	return f.wrap(name, file, err)
+}
+
+// OpenForAppend ...
+func (f *FaultFS) OpenForAppend(name string) (vfs.File, error) {
+	if err := f.maybeError(name, OpOpen); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenForAppend(name)
+	return f.wrap(name, file, err)
+}
+
+// Remove ...
+func (f *FaultFS) Remove(name string) error {
+	if err := f.maybeError(name, OpRemove); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+// RemoveAll ...
+func (f *FaultFS) RemoveAll(name string) error {
+	if err := f.maybeError(name, OpRemove); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(name)
+}
+
+// Rename ...
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if err := f.maybeError(newname, OpRename); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldname, newname)
+}
+
+// ReuseForWrite ...
+func (f *FaultFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	if err := f.maybeError(newname, OpOpen); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.ReuseForWrite(oldname, newname)
+	return f.wrap(newname, file, err)
+}
+
+// MkdirAll ...
+func (f *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := f.maybeError(dir, OpOpen); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(dir, perm)
+}
+
+// Lock ...
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	return f.fs.Lock(name)
+}
+
+// List ...
+func (f *FaultFS) List(dir string) ([]string, error) {
+	if err := f.maybeError(dir, OpRead); err != nil {
+		return nil, err
+	}
+	return f.fs.List(dir)
+}
+
+// Stat ...
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+// PathBase ...
+func (f *FaultFS) PathBase(path string) string {
+	return f.fs.PathBase(path)
+}
+
+// PathJoin ...
+func (f *FaultFS) PathJoin(elem ...string) string {
+	return f.fs.PathJoin(elem...)
+}
+
+// PathDir ...
+func (f *FaultFS) PathDir(path string) string {
+	return f.fs.PathDir(path)
+}
+
+// GetFreeSpace ...
+func (f *FaultFS) GetFreeSpace(path string) (uint64, error) {
+	return f.fs.GetFreeSpace(path)
+}
+
+type faultFile struct {
+	vfs.File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.maybeError(f.name, OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.maybeError(f.name, OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if fault, ok := f.fs.fault(f.name, OpWrite); ok {
+		if fault == FaultShortWrite {
+			n, err := f.File.Write(p[:len(p)/2])
+			if err != nil {
+				return n, err
+			}
+			return n, io.ErrShortWrite
+		}
+		return 0, errors.Wrapf(ErrInjected, "%s", f.name)
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if fault, ok := f.fs.fault(f.name, OpWrite); ok {
+		if fault == FaultShortWrite {
+			n, err := f.File.WriteAt(p[:len(p)/2], off)
+			if err != nil {
+				return n, err
+			}
+			return n, io.ErrShortWrite
+		}
+		return 0, errors.Wrapf(ErrInjected, "%s", f.name)
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *faultFile) Sync() error {
+	if fault, ok := f.fs.fault(f.name, OpSync); ok {
+		if fault == FaultDropSync {
+			return nil
+		}
+		return errors.Wrapf(ErrInjected, "%s", f.name)
+	}
+	return f.File.Sync()
+}
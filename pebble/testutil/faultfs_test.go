@@ -0,0 +1,97 @@
+package testutil
+
+import (
+	"io"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultFSRejectsInvalidRules(t *testing.T) {
+	_, err := NewFaultFS(vfs.NewMem(), 1, Rule{Op: OpRead, Fault: FaultShortWrite, Probability: 1})
+	require.Error(t, err)
+	_, err = NewFaultFS(vfs.NewMem(), 1, Rule{Op: OpWrite, Fault: FaultDropSync, Probability: 1})
+	require.Error(t, err)
+	_, err = NewFaultFS(vfs.NewMem(), 1, Rule{Pattern: "[", Op: OpRead, Probability: 1})
+	require.Error(t, err)
+	_, err = NewFaultFS(vfs.NewMem(), 1, Rule{Op: OpRead, Probability: 2})
+	require.Error(t, err)
+}
+
+func TestFaultFSInjectsErrorsByPattern(t *testing.T) {
+	fs, err := NewFaultFS(vfs.NewMem(), 1, Rule{Pattern: "*.log", Op: OpWrite, Probability: 1})
+	require.NoError(t, err)
+	f, err := fs.Create("000001.log")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.True(t, errors.Is(err, ErrInjected))
+	require.NoError(t, f.Close())
+	f, err = fs.Create("000001.sst")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, uint64(1), fs.Injected())
+	fs.ClearRules()
+	f, err = fs.Create("000002.log")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestFaultFSShortWrite(t *testing.T) {
+	mem := vfs.NewMem()
+	fs, err := NewFaultFS(mem, 1, Rule{Op: OpWrite, Fault: FaultShortWrite, Probability: 1})
+	require.NoError(t, err)
+	f, err := fs.Create("file")
+	require.NoError(t, err)
+	n, err := f.Write([]byte("data"))
+	require.Equal(t, io.ErrShortWrite, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, f.Close())
+	fi, err := mem.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), fi.Size())
+}
+
+func TestFaultFSDropSync(t *testing.T) {
+	mem := vfs.NewStrictMem()
+	fs, err := NewFaultFS(mem, 1, Rule{Pattern: "dropped", Op: OpSync, Fault: FaultDropSync, Probability: 1})
+	require.NoError(t, err)
+	for _, name := range []string{"dropped", "synced"} {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, f.Sync())
+		require.NoError(t, f.Close())
+	}
+	dir, err := mem.OpenDir("/")
+	require.NoError(t, err)
+	require.NoError(t, dir.Sync())
+	require.NoError(t, dir.Close())
+	mem.ResetToSyncedState()
+	fi, err := mem.Stat("dropped")
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+	fi, err = mem.Stat("synced")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), fi.Size())
+}
+
+func TestFaultFSCanBeUsedByLogDB(t *testing.T) {
+	fs, err := NewFaultFS(vfs.NewMem(), 1, Rule{Pattern: "MANIFEST-*", Op: OpOpen, Probability: 1})
+	require.NoError(t, err)
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = fs
+	_, err = pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.True(t, errors.Is(err, ErrInjected))
+	fs.ClearRules()
+	db, err := pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,779 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package testutil
+
+import (
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"sync"
+)
+
+// Ensure, that MockLogDB does implement pebble.ILogDB.
+// If this is not the case, regenerate this file with moq.
+var _ pebble.ILogDB = &MockLogDB{}
+
+// MockLogDB is a mock implementation of pebble.ILogDB.
+//
+//	func TestSomethingThatUsesILogDB(t *testing.T) {
+//
+//		// make and configure a mocked pebble.ILogDB
+//		mockedILogDB := &MockLogDB{
+//			BinaryFormatFunc: func() uint32 {
+//				panic("mock out the BinaryFormat method")
+//			},
+//			CloseFunc: func() error {
+//				panic("mock out the Close method")
+//			},
+//			CompactEntriesToFunc: func(clusterID uint64, nodeID uint64, index uint64) (<-chan struct{}, error) {
+//				panic("mock out the CompactEntriesTo method")
+//			},
+//			GetBootstrapInfoFunc: func(clusterID uint64, nodeID uint64) (pb.Bootstrap, error) {
+//				panic("mock out the GetBootstrapInfo method")
+//			},
+//			GetSnapshotFunc: func(clusterID uint64, nodeID uint64) (pb.Snapshot, error) {
+//				panic("mock out the GetSnapshot method")
+//			},
+//			ImportSnapshotFunc: func(snapshot pb.Snapshot, nodeID uint64) error {
+//				panic("mock out the ImportSnapshot method")
+//			},
+//			IterateEntriesFunc: func(ents []pb.Entry, size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
+//				panic("mock out the IterateEntries method")
+//			},
+//			ListNodeInfoFunc: func() ([]raftio.NodeInfo, error) {
+//				panic("mock out the ListNodeInfo method")
+//			},
+//			NameFunc: func() string {
+//				panic("mock out the Name method")
+//			},
+//			ReadRaftStateFunc: func(clusterID uint64, nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+//				panic("mock out the ReadRaftState method")
+//			},
+//			RemoveEntriesToFunc: func(clusterID uint64, nodeID uint64, index uint64) error {
+//				panic("mock out the RemoveEntriesTo method")
+//			},
+//			RemoveNodeDataFunc: func(clusterID uint64, nodeID uint64) error {
+//				panic("mock out the RemoveNodeData method")
+//			},
+//			SaveBootstrapInfoFunc: func(clusterID uint64, nodeID uint64, bootstrap pb.Bootstrap) error {
+//				panic("mock out the SaveBootstrapInfo method")
+//			},
+//			SaveRaftStateFunc: func(updates []pb.Update, shardID uint64) error {
+//				panic("mock out the SaveRaftState method")
+//			},
+//			SaveSnapshotsFunc: func(updates []pb.Update) error {
+//				panic("mock out the SaveSnapshots method")
+//			},
+//		}
+//
+//		// use mockedILogDB in code that requires pebble.ILogDB
+//		// and then make assertions.
+//
+//	}
+type MockLogDB struct {
+	// BinaryFormatFunc mocks the BinaryFormat method.
+	BinaryFormatFunc func() uint32
+
+	// CloseFunc mocks the Close method.
+	CloseFunc func() error
+
+	// CompactEntriesToFunc mocks the CompactEntriesTo method.
+	CompactEntriesToFunc func(clusterID uint64, nodeID uint64, index uint64) (<-chan struct{}, error)
+
+	// GetBootstrapInfoFunc mocks the GetBootstrapInfo method.
+	GetBootstrapInfoFunc func(clusterID uint64, nodeID uint64) (pb.Bootstrap, error)
+
+	// GetSnapshotFunc mocks the GetSnapshot method.
+	GetSnapshotFunc func(clusterID uint64, nodeID uint64) (pb.Snapshot, error)
+
+	// ImportSnapshotFunc mocks the ImportSnapshot method.
+	ImportSnapshotFunc func(snapshot pb.Snapshot, nodeID uint64) error
+
+	// IterateEntriesFunc mocks the IterateEntries method.
+	IterateEntriesFunc func(ents []pb.Entry, size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error)
+
+	// ListNodeInfoFunc mocks the ListNodeInfo method.
+	ListNodeInfoFunc func() ([]raftio.NodeInfo, error)
+
+	// NameFunc mocks the Name method.
+	NameFunc func() string
+
+	// ReadRaftStateFunc mocks the ReadRaftState method.
+	ReadRaftStateFunc func(clusterID uint64, nodeID uint64, lastIndex uint64) (raftio.RaftState, error)
+
+	// RemoveEntriesToFunc mocks the RemoveEntriesTo method.
+	RemoveEntriesToFunc func(clusterID uint64, nodeID uint64, index uint64) error
+
+	// RemoveNodeDataFunc mocks the RemoveNodeData method.
+	RemoveNodeDataFunc func(clusterID uint64, nodeID uint64) error
+
+	// SaveBootstrapInfoFunc mocks the SaveBootstrapInfo method.
+	SaveBootstrapInfoFunc func(clusterID uint64, nodeID uint64, bootstrap pb.Bootstrap) error
+
+	// SaveRaftStateFunc mocks the SaveRaftState method.
+	SaveRaftStateFunc func(updates []pb.Update, shardID uint64) error
+
+	// SaveSnapshotsFunc mocks the SaveSnapshots method.
+	SaveSnapshotsFunc func(updates []pb.Update) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// BinaryFormat holds details about calls to the BinaryFormat method.
+		BinaryFormat []struct {
+		}
+		// Close holds details about calls to the Close method.
+		Close []struct {
+		}
+		// CompactEntriesTo holds details about calls to the CompactEntriesTo method.
+		CompactEntriesTo []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+			// Index is the index argument value.
+			Index uint64
+		}
+		// GetBootstrapInfo holds details about calls to the GetBootstrapInfo method.
+		GetBootstrapInfo []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+		}
+		// GetSnapshot holds details about calls to the GetSnapshot method.
+		GetSnapshot []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+		}
+		// ImportSnapshot holds details about calls to the ImportSnapshot method.
+		ImportSnapshot []struct {
+			// Snapshot is the snapshot argument value.
+			Snapshot pb.Snapshot
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+		}
+		// IterateEntries holds details about calls to the IterateEntries method.
+		IterateEntries []struct {
+			// Ents is the ents argument value.
+			Ents []pb.Entry
+			// Size is the size argument value.
+			Size uint64
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+			// Low is the low argument value.
+			Low uint64
+			// High is the high argument value.
+			High uint64
+			// MaxSize is the maxSize argument value.
+			MaxSize uint64
+		}
+		// ListNodeInfo holds details about calls to the ListNodeInfo method.
+		ListNodeInfo []struct {
+		}
+		// Name holds details about calls to the Name method.
+		Name []struct {
+		}
+		// ReadRaftState holds details about calls to the ReadRaftState method.
+		ReadRaftState []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+			// LastIndex is the lastIndex argument value.
+			LastIndex uint64
+		}
+		// RemoveEntriesTo holds details about calls to the RemoveEntriesTo method.
+		RemoveEntriesTo []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+			// Index is the index argument value.
+			Index uint64
+		}
+		// RemoveNodeData holds details about calls to the RemoveNodeData method.
+		RemoveNodeData []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+		}
+		// SaveBootstrapInfo holds details about calls to the SaveBootstrapInfo method.
+		SaveBootstrapInfo []struct {
+			// ClusterID is the clusterID argument value.
+			ClusterID uint64
+			// NodeID is the nodeID argument value.
+			NodeID uint64
+			// Bootstrap is the bootstrap argument value.
+			Bootstrap pb.Bootstrap
+		}
+		// SaveRaftState holds details about calls to the SaveRaftState method.
+		SaveRaftState []struct {
+			// Updates is the updates argument value.
+			Updates []pb.Update
+			// ShardID is the shardID argument value.
+			ShardID uint64
+		}
+		// SaveSnapshots holds details about calls to the SaveSnapshots method.
+		SaveSnapshots []struct {
+			// Updates is the updates argument value.
+			Updates []pb.Update
+		}
+	}
+	lockBinaryFormat      sync.RWMutex
+	lockClose             sync.RWMutex
+	lockCompactEntriesTo  sync.RWMutex
+	lockGetBootstrapInfo  sync.RWMutex
+	lockGetSnapshot       sync.RWMutex
+	lockImportSnapshot    sync.RWMutex
+	lockIterateEntries    sync.RWMutex
+	lockListNodeInfo      sync.RWMutex
+	lockName              sync.RWMutex
+	lockReadRaftState     sync.RWMutex
+	lockRemoveEntriesTo   sync.RWMutex
+	lockRemoveNodeData    sync.RWMutex
+	lockSaveBootstrapInfo sync.RWMutex
+	lockSaveRaftState     sync.RWMutex
+	lockSaveSnapshots     sync.RWMutex
+}
+
+// BinaryFormat calls BinaryFormatFunc.
+func (mock *MockLogDB) BinaryFormat() uint32 {
+	if mock.BinaryFormatFunc == nil {
+		panic("MockLogDB.BinaryFormatFunc: method is nil but ILogDB.BinaryFormat was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockBinaryFormat.Lock()
+	mock.calls.BinaryFormat = append(mock.calls.BinaryFormat, callInfo)
+	mock.lockBinaryFormat.Unlock()
+	return mock.BinaryFormatFunc()
+}
+
+// BinaryFormatCalls gets all the calls that were made to BinaryFormat.
+// Check the length with:
+//
+//	len(mockedILogDB.BinaryFormatCalls())
+func (mock *MockLogDB) BinaryFormatCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockBinaryFormat.RLock()
+	calls = mock.calls.BinaryFormat
+	mock.lockBinaryFormat.RUnlock()
+	return calls
+}
+
+// Close calls CloseFunc.
+func (mock *MockLogDB) Close() error {
+	if mock.CloseFunc == nil {
+		panic("MockLogDB.CloseFunc: method is nil but ILogDB.Close was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockClose.Lock()
+	mock.calls.Close = append(mock.calls.Close, callInfo)
+	mock.lockClose.Unlock()
+	return mock.CloseFunc()
+}
+
+// CloseCalls gets all the calls that were made to Close.
+// Check the length with:
+//
+//	len(mockedILogDB.CloseCalls())
+func (mock *MockLogDB) CloseCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockClose.RLock()
+	calls = mock.calls.Close
+	mock.lockClose.RUnlock()
+	return calls
+}
+
+// CompactEntriesTo calls CompactEntriesToFunc.
+func (mock *MockLogDB) CompactEntriesTo(clusterID uint64, nodeID uint64, index uint64) (<-chan struct{}, error) {
+	if mock.CompactEntriesToFunc == nil {
+		panic("MockLogDB.CompactEntriesToFunc: method is nil but ILogDB.CompactEntriesTo was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+		Index     uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		Index:     index,
+	}
+	mock.lockCompactEntriesTo.Lock()
+	mock.calls.CompactEntriesTo = append(mock.calls.CompactEntriesTo, callInfo)
+	mock.lockCompactEntriesTo.Unlock()
+	return mock.CompactEntriesToFunc(clusterID, nodeID, index)
+}
+
+// CompactEntriesToCalls gets all the calls that were made to CompactEntriesTo.
+// Check the length with:
+//
+//	len(mockedILogDB.CompactEntriesToCalls())
+func (mock *MockLogDB) CompactEntriesToCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+	Index     uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+		Index     uint64
+	}
+	mock.lockCompactEntriesTo.RLock()
+	calls = mock.calls.CompactEntriesTo
+	mock.lockCompactEntriesTo.RUnlock()
+	return calls
+}
+
+// GetBootstrapInfo calls GetBootstrapInfoFunc.
+func (mock *MockLogDB) GetBootstrapInfo(clusterID uint64, nodeID uint64) (pb.Bootstrap, error) {
+	if mock.GetBootstrapInfoFunc == nil {
+		panic("MockLogDB.GetBootstrapInfoFunc: method is nil but ILogDB.GetBootstrapInfo was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+	}
+	mock.lockGetBootstrapInfo.Lock()
+	mock.calls.GetBootstrapInfo = append(mock.calls.GetBootstrapInfo, callInfo)
+	mock.lockGetBootstrapInfo.Unlock()
+	return mock.GetBootstrapInfoFunc(clusterID, nodeID)
+}
+
+// GetBootstrapInfoCalls gets all the calls that were made to GetBootstrapInfo.
+// Check the length with:
+//
+//	len(mockedILogDB.GetBootstrapInfoCalls())
+func (mock *MockLogDB) GetBootstrapInfoCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+	}
+	mock.lockGetBootstrapInfo.RLock()
+	calls = mock.calls.GetBootstrapInfo
+	mock.lockGetBootstrapInfo.RUnlock()
+	return calls
+}
+
+// GetSnapshot calls GetSnapshotFunc.
+func (mock *MockLogDB) GetSnapshot(clusterID uint64, nodeID uint64) (pb.Snapshot, error) {
+	if mock.GetSnapshotFunc == nil {
+		panic("MockLogDB.GetSnapshotFunc: method is nil but ILogDB.GetSnapshot was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+	}
+	mock.lockGetSnapshot.Lock()
+	mock.calls.GetSnapshot = append(mock.calls.GetSnapshot, callInfo)
+	mock.lockGetSnapshot.Unlock()
+	return mock.GetSnapshotFunc(clusterID, nodeID)
+}
+
+// GetSnapshotCalls gets all the calls that were made to GetSnapshot.
+// Check the length with:
+//
+//	len(mockedILogDB.GetSnapshotCalls())
+func (mock *MockLogDB) GetSnapshotCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+	}
+	mock.lockGetSnapshot.RLock()
+	calls = mock.calls.GetSnapshot
+	mock.lockGetSnapshot.RUnlock()
+	return calls
+}
+
+// ImportSnapshot calls ImportSnapshotFunc.
+func (mock *MockLogDB) ImportSnapshot(snapshot pb.Snapshot, nodeID uint64) error {
+	if mock.ImportSnapshotFunc == nil {
+		panic("MockLogDB.ImportSnapshotFunc: method is nil but ILogDB.ImportSnapshot was just called")
+	}
+	callInfo := struct {
+		Snapshot pb.Snapshot
+		NodeID   uint64
+	}{
+		Snapshot: snapshot,
+		NodeID:   nodeID,
+	}
+	mock.lockImportSnapshot.Lock()
+	mock.calls.ImportSnapshot = append(mock.calls.ImportSnapshot, callInfo)
+	mock.lockImportSnapshot.Unlock()
+	return mock.ImportSnapshotFunc(snapshot, nodeID)
+}
+
+// ImportSnapshotCalls gets all the calls that were made to ImportSnapshot.
+// Check the length with:
+//
+//	len(mockedILogDB.ImportSnapshotCalls())
+func (mock *MockLogDB) ImportSnapshotCalls() []struct {
+	Snapshot pb.Snapshot
+	NodeID   uint64
+} {
+	var calls []struct {
+		Snapshot pb.Snapshot
+		NodeID   uint64
+	}
+	mock.lockImportSnapshot.RLock()
+	calls = mock.calls.ImportSnapshot
+	mock.lockImportSnapshot.RUnlock()
+	return calls
+}
+
+// IterateEntries calls IterateEntriesFunc.
+func (mock *MockLogDB) IterateEntries(ents []pb.Entry, size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
+	if mock.IterateEntriesFunc == nil {
+		panic("MockLogDB.IterateEntriesFunc: method is nil but ILogDB.IterateEntries was just called")
+	}
+	callInfo := struct {
+		Ents      []pb.Entry
+		Size      uint64
+		ClusterID uint64
+		NodeID    uint64
+		Low       uint64
+		High      uint64
+		MaxSize   uint64
+	}{
+		Ents:      ents,
+		Size:      size,
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		Low:       low,
+		High:      high,
+		MaxSize:   maxSize,
+	}
+	mock.lockIterateEntries.Lock()
+	mock.calls.IterateEntries = append(mock.calls.IterateEntries, callInfo)
+	mock.lockIterateEntries.Unlock()
+	return mock.IterateEntriesFunc(ents, size, clusterID, nodeID, low, high, maxSize)
+}
+
+// IterateEntriesCalls gets all the calls that were made to IterateEntries.
+// Check the length with:
+//
+//	len(mockedILogDB.IterateEntriesCalls())
+func (mock *MockLogDB) IterateEntriesCalls() []struct {
+	Ents      []pb.Entry
+	Size      uint64
+	ClusterID uint64
+	NodeID    uint64
+	Low       uint64
+	High      uint64
+	MaxSize   uint64
+} {
+	var calls []struct {
+		Ents      []pb.Entry
+		Size      uint64
+		ClusterID uint64
+		NodeID    uint64
+		Low       uint64
+		High      uint64
+		MaxSize   uint64
+	}
+	mock.lockIterateEntries.RLock()
+	calls = mock.calls.IterateEntries
+	mock.lockIterateEntries.RUnlock()
+	return calls
+}
+
+// ListNodeInfo calls ListNodeInfoFunc.
+func (mock *MockLogDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	if mock.ListNodeInfoFunc == nil {
+		panic("MockLogDB.ListNodeInfoFunc: method is nil but ILogDB.ListNodeInfo was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockListNodeInfo.Lock()
+	mock.calls.ListNodeInfo = append(mock.calls.ListNodeInfo, callInfo)
+	mock.lockListNodeInfo.Unlock()
+	return mock.ListNodeInfoFunc()
+}
+
+// ListNodeInfoCalls gets all the calls that were made to ListNodeInfo.
+// Check the length with:
+//
+//	len(mockedILogDB.ListNodeInfoCalls())
+func (mock *MockLogDB) ListNodeInfoCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockListNodeInfo.RLock()
+	calls = mock.calls.ListNodeInfo
+	mock.lockListNodeInfo.RUnlock()
+	return calls
+}
+
+// Name calls NameFunc.
+func (mock *MockLogDB) Name() string {
+	if mock.NameFunc == nil {
+		panic("MockLogDB.NameFunc: method is nil but ILogDB.Name was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockName.Lock()
+	mock.calls.Name = append(mock.calls.Name, callInfo)
+	mock.lockName.Unlock()
+	return mock.NameFunc()
+}
+
+// NameCalls gets all the calls that were made to Name.
+// Check the length with:
+//
+//	len(mockedILogDB.NameCalls())
+func (mock *MockLogDB) NameCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockName.RLock()
+	calls = mock.calls.Name
+	mock.lockName.RUnlock()
+	return calls
+}
+
+// ReadRaftState calls ReadRaftStateFunc.
+func (mock *MockLogDB) ReadRaftState(clusterID uint64, nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	if mock.ReadRaftStateFunc == nil {
+		panic("MockLogDB.ReadRaftStateFunc: method is nil but ILogDB.ReadRaftState was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+		LastIndex uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		LastIndex: lastIndex,
+	}
+	mock.lockReadRaftState.Lock()
+	mock.calls.ReadRaftState = append(mock.calls.ReadRaftState, callInfo)
+	mock.lockReadRaftState.Unlock()
+	return mock.ReadRaftStateFunc(clusterID, nodeID, lastIndex)
+}
+
+// ReadRaftStateCalls gets all the calls that were made to ReadRaftState.
+// Check the length with:
+//
+//	len(mockedILogDB.ReadRaftStateCalls())
+func (mock *MockLogDB) ReadRaftStateCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+	LastIndex uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+		LastIndex uint64
+	}
+	mock.lockReadRaftState.RLock()
+	calls = mock.calls.ReadRaftState
+	mock.lockReadRaftState.RUnlock()
+	return calls
+}
+
+// RemoveEntriesTo calls RemoveEntriesToFunc.
+func (mock *MockLogDB) RemoveEntriesTo(clusterID uint64, nodeID uint64, index uint64) error {
+	if mock.RemoveEntriesToFunc == nil {
+		panic("MockLogDB.RemoveEntriesToFunc: method is nil but ILogDB.RemoveEntriesTo was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+		Index     uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		Index:     index,
+	}
+	mock.lockRemoveEntriesTo.Lock()
+	mock.calls.RemoveEntriesTo = append(mock.calls.RemoveEntriesTo, callInfo)
+	mock.lockRemoveEntriesTo.Unlock()
+	return mock.RemoveEntriesToFunc(clusterID, nodeID, index)
+}
+
+// RemoveEntriesToCalls gets all the calls that were made to RemoveEntriesTo.
+// Check the length with:
+//
+//	len(mockedILogDB.RemoveEntriesToCalls())
+func (mock *MockLogDB) RemoveEntriesToCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+	Index     uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+		Index     uint64
+	}
+	mock.lockRemoveEntriesTo.RLock()
+	calls = mock.calls.RemoveEntriesTo
+	mock.lockRemoveEntriesTo.RUnlock()
+	return calls
+}
+
+// RemoveNodeData calls RemoveNodeDataFunc.
+func (mock *MockLogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	if mock.RemoveNodeDataFunc == nil {
+		panic("MockLogDB.RemoveNodeDataFunc: method is nil but ILogDB.RemoveNodeData was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+	}
+	mock.lockRemoveNodeData.Lock()
+	mock.calls.RemoveNodeData = append(mock.calls.RemoveNodeData, callInfo)
+	mock.lockRemoveNodeData.Unlock()
+	return mock.RemoveNodeDataFunc(clusterID, nodeID)
+}
+
+// RemoveNodeDataCalls gets all the calls that were made to RemoveNodeData.
+// Check the length with:
+//
+//	len(mockedILogDB.RemoveNodeDataCalls())
+func (mock *MockLogDB) RemoveNodeDataCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+	}
+	mock.lockRemoveNodeData.RLock()
+	calls = mock.calls.RemoveNodeData
+	mock.lockRemoveNodeData.RUnlock()
+	return calls
+}
+
+// SaveBootstrapInfo calls SaveBootstrapInfoFunc.
+func (mock *MockLogDB) SaveBootstrapInfo(clusterID uint64, nodeID uint64, bootstrap pb.Bootstrap) error {
+	if mock.SaveBootstrapInfoFunc == nil {
+		panic("MockLogDB.SaveBootstrapInfoFunc: method is nil but ILogDB.SaveBootstrapInfo was just called")
+	}
+	callInfo := struct {
+		ClusterID uint64
+		NodeID    uint64
+		Bootstrap pb.Bootstrap
+	}{
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+		Bootstrap: bootstrap,
+	}
+	mock.lockSaveBootstrapInfo.Lock()
+	mock.calls.SaveBootstrapInfo = append(mock.calls.SaveBootstrapInfo, callInfo)
+	mock.lockSaveBootstrapInfo.Unlock()
+	return mock.SaveBootstrapInfoFunc(clusterID, nodeID, bootstrap)
+}
+
+// SaveBootstrapInfoCalls gets all the calls that were made to SaveBootstrapInfo.
+// Check the length with:
+//
+//	len(mockedILogDB.SaveBootstrapInfoCalls())
+func (mock *MockLogDB) SaveBootstrapInfoCalls() []struct {
+	ClusterID uint64
+	NodeID    uint64
+	Bootstrap pb.Bootstrap
+} {
+	var calls []struct {
+		ClusterID uint64
+		NodeID    uint64
+		Bootstrap pb.Bootstrap
+	}
+	mock.lockSaveBootstrapInfo.RLock()
+	calls = mock.calls.SaveBootstrapInfo
+	mock.lockSaveBootstrapInfo.RUnlock()
+	return calls
+}
+
+// SaveRaftState calls SaveRaftStateFunc.
+func (mock *MockLogDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	if mock.SaveRaftStateFunc == nil {
+		panic("MockLogDB.SaveRaftStateFunc: method is nil but ILogDB.SaveRaftState was just called")
+	}
+	callInfo := struct {
+		Updates []pb.Update
+		ShardID uint64
+	}{
+		Updates: updates,
+		ShardID: shardID,
+	}
+	mock.lockSaveRaftState.Lock()
+	mock.calls.SaveRaftState = append(mock.calls.SaveRaftState, callInfo)
+	mock.lockSaveRaftState.Unlock()
+	return mock.SaveRaftStateFunc(updates, shardID)
+}
+
+// SaveRaftStateCalls gets all the calls that were made to SaveRaftState.
+// Check the length with:
+//
+//	len(mockedILogDB.SaveRaftStateCalls())
+func (mock *MockLogDB) SaveRaftStateCalls() []struct {
+	Updates []pb.Update
+	ShardID uint64
+} {
+	var calls []struct {
+		Updates []pb.Update
+		ShardID uint64
+	}
+	mock.lockSaveRaftState.RLock()
+	calls = mock.calls.SaveRaftState
+	mock.lockSaveRaftState.RUnlock()
+	return calls
+}
+
+// SaveSnapshots calls SaveSnapshotsFunc.
+func (mock *MockLogDB) SaveSnapshots(updates []pb.Update) error {
+	if mock.SaveSnapshotsFunc == nil {
+		panic("MockLogDB.SaveSnapshotsFunc: method is nil but ILogDB.SaveSnapshots was just called")
+	}
+	callInfo := struct {
+		Updates []pb.Update
+	}{
+		Updates: updates,
+	}
+	mock.lockSaveSnapshots.Lock()
+	mock.calls.SaveSnapshots = append(mock.calls.SaveSnapshots, callInfo)
+	mock.lockSaveSnapshots.Unlock()
+	return mock.SaveSnapshotsFunc(updates)
+}
+
+// SaveSnapshotsCalls gets all the calls that were made to SaveSnapshots.
+// Check the length with:
+//
+//	len(mockedILogDB.SaveSnapshotsCalls())
+func (mock *MockLogDB) SaveSnapshotsCalls() []struct {
+	Updates []pb.Update
+} {
+	var calls []struct {
+		Updates []pb.Update
+	}
+	mock.lockSaveSnapshots.RLock()
+	calls = mock.calls.SaveSnapshots
+	mock.lockSaveSnapshots.RUnlock()
+	return calls
+}
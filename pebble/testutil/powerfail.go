@@ -0,0 +1,239 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// maxSavesPerIteration bounds the number of saves waiting for an armed power
+// failure, each save syncs the WAL at least once so it is never reached when
+// the write pipeline works as expected.
+const maxSavesPerIteration = 100000
+
+// PowerFailureConfig is the configuration of a power failure test.
+type PowerFailureConfig struct {
+	// Seed is the seed of the random number generator.
+	Seed int64
+	// Iterations is the number of simulated power failures.
+	Iterations int
+	// MaxSyncs is the max number of syncs before each power failure.
+	MaxSyncs int
+	// Clusters is the number of raft clusters, each cluster has 3 nodes.
+	Clusters int
+	// LogDB is the configuration of the tested LogDB.
+	LogDB pebble.LogDBConfig
+}
+
+// DefaultPowerFailureConfig returns a power failure test config using the
+// specified seed.
+func DefaultPowerFailureConfig(seed int64) PowerFailureConfig {
+	return PowerFailureConfig{
+		Seed:       seed,
+		Iterations: 20,
+		MaxSyncs:   32,
+		Clusters:   4,
+		LogDB:      pebble.GetTinyMemLogDBConfig(),
+	}
+}
+
+// RunPowerFailureTest repeatedly saves batches of updates to a LogDB until a
+// power failure strikes at a random sync, the LogDB is then crashed and
+// reopened. It returns an error when an acknowledged update is missing after
+// the reopen or when an unacknowledged batch is only partially present.
+func RunPowerFailureTest(cfg PowerFailureConfig) (err error) {
+	if cfg.Iterations <= 0 || cfg.MaxSyncs <= 0 || cfg.Clusters <= 0 {
+		return errors.New("invalid power failure test config")
+	}
+	db, err := NewCrashTestDB(cfg.LogDB, []string{"db"}, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, db.Close())
+	}()
+	p := &powerFailureTest{
+		db:    db,
+		rnd:   rand.New(rand.NewSource(cfg.Seed)),
+		nodes: make(map[raftio.NodeInfo]*pfNode),
+	}
+	for i := 0; i < cfg.Iterations; i++ {
+		db.KillAtSync(1 + p.rnd.Intn(cfg.MaxSyncs))
+		if err := p.saveUntilKilled(uint64(i+1), uint64(cfg.Clusters)); err != nil {
+			return errors.Wrapf(err, "seed %d, iteration %d", cfg.Seed, i)
+		}
+		db.Crash()
+		if err := db.Restart(); err != nil {
+			return errors.Wrapf(err, "seed %d, iteration %d", cfg.Seed, i)
+		}
+		if err := p.check(); err != nil {
+			return errors.Wrapf(err, "seed %d, iteration %d", cfg.Seed, i)
+		}
+	}
+	return nil
+}
+
+// pfNode is the model of the data saved for a node.
+type pfNode struct {
+	ni    raftio.NodeInfo
+	state pb.State
+	last  uint64
+	// pending is the update saved without being acknowledged before the
+	// power failure.
+	pending *pb.Update
+}
+
+type powerFailureTest struct {
+	db    *CrashTestDB
+	rnd   *rand.Rand
+	nodes map[raftio.NodeInfo]*pfNode
+}
+
+func (p *powerFailureTest) node(clusterID uint64, nodeID uint64) *pfNode {
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	n, ok := p.nodes[ni]
+	if !ok {
+		n = &pfNode{ni: ni}
+		p.nodes[ni] = n
+	}
+	return n
+}
+
+func payload(term uint64, index uint64) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, term)
+	binary.BigEndian.PutUint64(data[8:], index)
+	return data
+}
+
+// batch returns updates appending entries to some of the nodes of a randomly
+// selected cluster, all updates are saved in a single write batch.
+func (p *powerFailureTest) batch(term uint64, clusters uint64) []pb.Update {
+	clusterID := 1 + uint64(p.rnd.Int63n(int64(clusters)))
+	updates := make([]pb.Update, 0)
+	for nodeID := uint64(1); nodeID <= 3; nodeID++ {
+		if len(updates) > 0 && p.rnd.Intn(2) == 0 {
+			continue
+		}
+		n := p.node(clusterID, nodeID)
+		count := uint64(1 + p.rnd.Intn(16))
+		ents := make([]pb.Entry, 0, count)
+		for i := n.last + 1; i <= n.last+count; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: term, Cmd: payload(term, i)})
+		}
+		updates = append(updates, pb.Update{
+			ClusterID:     clusterID,
+			NodeID:        nodeID,
+			State:         pb.State{Term: term, Vote: nodeID, Commit: n.last + count},
+			EntriesToSave: ents,
+		})
+	}
+	return updates
+}
+
+func (p *powerFailureTest) saveUntilKilled(term uint64, clusters uint64) error {
+	for i := 0; i < maxSavesPerIteration; i++ {
+		updates := p.batch(term, clusters)
+		sdb := p.db.DB()
+		if err := sdb.SaveRaftStateCtx(updates, sdb.GetLogDBThreadContext()); err != nil {
+			return err
+		}
+		// the power failure might have happened while saving, such batch is
+		// not considered as acknowledged
+		killed := p.db.Killed()
+		for idx := range updates {
+			ud := updates[idx]
+			n := p.node(ud.ClusterID, ud.NodeID)
+			if killed {
+				n.pending = &ud
+			} else {
+				n.state = ud.State
+				n.last = ud.EntriesToSave[len(ud.EntriesToSave)-1].Index
+			}
+		}
+		if killed {
+			return nil
+		}
+	}
+	return errors.New("power failure not triggered")
+}
+
+// check checks the data of all nodes after the reopen, pending batches must
+// be either entirely present or entirely absent.
+func (p *powerFailureTest) check() error {
+	pendingPresent := -1
+	for _, n := range p.nodes {
+		present, err := p.checkNode(n)
+		if err != nil {
+			return err
+		}
+		if n.pending == nil {
+			continue
+		}
+		v := 0
+		if present {
+			v = 1
+			n.state = n.pending.State
+			n.last = n.pending.EntriesToSave[len(n.pending.EntriesToSave)-1].Index
+		}
+		if pendingPresent >= 0 && pendingPresent != v {
+			return errors.New("unacknowledged batch partially present")
+		}
+		pendingPresent = v
+		n.pending = nil
+	}
+	return nil
+}
+
+// checkNode checks the data of the node and returns a boolean value
+// indicating whether its pending update is present.
+func (p *powerFailureTest) checkNode(n *pfNode) (bool, error) {
+	db := p.db.DB()
+	state := pb.State{}
+	last := uint64(0)
+	rs, err := db.ReadRaftState(n.ni.ClusterID, n.ni.NodeID, 0)
+	if err == nil {
+		state = rs.State
+		if rs.EntryCount > 0 {
+			last = rs.FirstIndex + rs.EntryCount - 1
+		}
+	} else if errors.Cause(err) != raftio.ErrNoSavedLog {
+		return false, err
+	}
+	present := false
+	switch {
+	case last == n.last && pb.IsStateEqual(state, n.state):
+	case n.pending != nil &&
+		last == n.pending.EntriesToSave[len(n.pending.EntriesToSave)-1].Index &&
+		pb.IsStateEqual(state, n.pending.State):
+		present = true
+	case last < n.last:
+		return false, errors.Errorf("%v acknowledged entries lost, last %d, want %d",
+			n.ni, last, n.last)
+	default:
+		return false, errors.Errorf("%v unexpected state %v, last %d, want %v, %d",
+			n.ni, state, last, n.state, n.last)
+	}
+	if last == 0 {
+		return present, nil
+	}
+	ents, _, err := db.IterateEntries(nil, 0,
+		n.ni.ClusterID, n.ni.NodeID, 1, last+1, ^uint64(0))
+	if err != nil {
+		return false, err
+	}
+	if uint64(len(ents)) != last {
+		return false, errors.Errorf("%v got %d entries, want %d", n.ni, len(ents), last)
+	}
+	for _, e := range ents {
+		if !bytes.Equal(e.Cmd, payload(e.Term, e.Index)) {
+			return false, errors.Errorf("%v entry %d corrupted", n.ni, e.Index)
+		}
+	}
+	return present, nil
+}
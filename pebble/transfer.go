@@ -0,0 +1,302 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidNodeExport indicates that the node export being imported is
+	// corrupted or has unsupported format.
+	ErrInvalidNodeExport = errors.New("invalid node export")
+	// ErrNodeNotFound indicates that the node to be exported has no data in
+	// the LogDB.
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrNodeExists indicates that the node to be imported already has data
+	// in the target LogDB.
+	ErrNodeExists = errors.New("node already exists")
+)
+
+var nodeExportFormat = streamFormat{
+	magic:   [8]byte{'T', 'G', 'B', 'N', 'O', 'D', 'E', 0},
+	version: 1,
+	invalid: ErrInvalidNodeExport,
+}
+
+// importBatchSize is the number of records written in a single write batch
+// when importing a node.
+const importBatchSize = 1024
+
+// TransferNode copies all data of the specified node from src to dst. The
+// node must not exist in dst, its data in src is left untouched.
+func TransferNode(dst *ShardedDB, src *ShardedDB, clusterID uint64, nodeID uint64) error {
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go withLabels("transfer", func() {
+		_, err := src.ExportNode(pw, clusterID, nodeID)
+		pw.CloseWithError(err)
+		exported <- err
+	})
+	_, err := dst.ImportNode(pr)
+	// unblock the exporting goroutine when the import failed early
+	pr.CloseWithError(err)
+	// export errors caused by closing the pipe are not interesting
+	eerr := <-exported
+	if eerr != nil && !errors.Is(eerr, io.ErrClosedPipe) &&
+		(err == nil || !errors.Is(eerr, err)) {
+		return eerr
+	}
+	return err
+}
+
+// ExportNode writes the bootstrap, raft state, max index, node metadata,
+// snapshot and entry records of the specified node to w, it returns the number
+// of exported records. The output can be imported into another LogDB using
+// ImportNode.
+func (s *ShardedDB) ExportNode(w io.Writer, clusterID uint64, nodeID uint64) (uint64, error) {
+	if s.hasSegmentedEntries() {
+		return 0, errors.WithStack(ErrSegmentedEntries)
+	}
+	shard, err := s.shard(s.partitioner.GetPartitionID(clusterID))
+	if err != nil {
+		return 0, err
+	}
+	found, err := shard.hasNodeData(clusterID, nodeID)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if !found {
+		return 0, errors.Wrapf(ErrNodeNotFound, "%s", dn(clusterID, nodeID))
+	}
+	rw, err := newRecordWriter(w, nodeExportFormat)
+	if err != nil {
+		return 0, err
+	}
+	count := uint64(0)
+	op := func(key []byte, data []byte) (bool, error) {
+		if err := rw.write(key, data); err != nil {
+			return false, err
+		}
+		count++
+		return true, nil
+	}
+	if err := shard.iterateNode(clusterID, nodeID, op); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return count, rw.finish()
+}
+
+// ImportNode imports the node exported by ExportNode and returns its
+// identity. The imported node must not exist in the LogDB. Records are written
+// as they are read, all imported records are removed again when the import
+// fails. When LogDBConfig.IngestImports is set, entries are written into
+// external sstables ingested into the shard once all records have been read.
+func (s *ShardedDB) ImportNode(r io.Reader) (raftio.NodeInfo, error) {
+	rr, err := newRecordReader(r, nodeExportFormat)
+	if err != nil {
+		return raftio.NodeInfo{}, err
+	}
+	key, data, ok, err := rr.next()
+	if err != nil {
+		return raftio.NodeInfo{}, err
+	}
+	if !ok {
+		return raftio.NodeInfo{}, errors.Wrap(ErrInvalidNodeExport, "no record")
+	}
+	if !isNodeKey(key) {
+		return raftio.NodeInfo{}, errors.Wrapf(ErrInvalidNodeExport, "unexpected key %x", key)
+	}
+	ni := raftio.GetNodeInfo(parseNodeInfoKey(key[:persistentStateKeySize]))
+	shard, err := s.shard(s.partitioner.GetPartitionID(ni.ClusterID))
+	if err != nil {
+		return raftio.NodeInfo{}, err
+	}
+	found, err := shard.hasNodeData(ni.ClusterID, ni.NodeID)
+	if err != nil {
+		return raftio.NodeInfo{}, errors.WithStack(err)
+	}
+	if found {
+		return raftio.NodeInfo{}, errors.Wrapf(ErrNodeExists, "%s", dn(ni.ClusterID, ni.NodeID))
+	}
+	next := func() ([]byte, []byte, bool, error) {
+		if key != nil {
+			k, d := key, data
+			key, data = nil, nil
+			return k, d, true, nil
+		}
+		return rr.next()
+	}
+	if err := shard.importNode(ni, next); err != nil {
+		if rerr := shard.removeNodeData(ni.ClusterID, ni.NodeID); rerr != nil {
+			plog.Errorf("%s failed to remove partially imported data, %v",
+				dn(ni.ClusterID, ni.NodeID), rerr)
+		}
+		return raftio.NodeInfo{}, err
+	}
+	return ni, nil
+}
+
+func isNodeKey(key []byte) bool {
+	if len(key) < 2 {
+		return false
+	}
+	h := [2]byte{key[0], key[1]}
+	switch h {
+	case entryKeyHeader, snapshotKeyHeader:
+		return uint64(len(key)) == entryKeySize
+	case bootstrapKeyHeader, persistentStateKeyHeader, maxIndexKeyHeader,
+		nodeMetadataKeyHeader:
+		return uint64(len(key)) == persistentStateKeySize
+	}
+	return false
+}
+
+func (r *db) hasNodeData(clusterID uint64, nodeID uint64) (bool, error) {
+	if _, err := r.getBootstrapInfo(clusterID, nodeID); err == nil {
+		return true, nil
+	} else if err != raftio.ErrNoBootstrapInfo {
+		return false, err
+	}
+	if _, err := r.getState(clusterID, nodeID); err == nil {
+		return true, nil
+	} else if err != raftio.ErrNoSavedLog {
+		return false, err
+	}
+	// the cached max index is reset to 0 when the node data is removed
+	maxIndex, err := r.getMaxIndex(clusterID, nodeID)
+	if err != nil && err != raftio.ErrNoSavedLog {
+		return false, err
+	}
+	return maxIndex > 0, nil
+}
+
+func (r *db) iterateNode(clusterID uint64, nodeID uint64,
+	op func(key []byte, data []byte) (bool, error)) error {
+	r.reads.acquire()
+	defer r.reads.release()
+	k := newKey(maxKeySize, nil)
+	single := []func(){
+		func() { k.setBootstrapKey(clusterID, nodeID) },
+		func() { k.SetStateKey(clusterID, nodeID) },
+		func() { k.SetMaxIndexKey(clusterID, nodeID) },
+		func() { k.setNodeMetadataKey(clusterID, nodeID) },
+	}
+	for _, set := range single {
+		set()
+		var err error
+		if gerr := r.kvs.GetValue(k.Key(), func(data []byte) error {
+			if len(data) > 0 {
+				_, err = op(k.Key(), data)
+			}
+			return nil
+		}); gerr != nil {
+			return gerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	fk.setSnapshotKey(clusterID, nodeID, 0)
+	lk.setSnapshotKey(clusterID, nodeID, math.MaxUint64)
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return err
+	}
+	return r.entries.rangedOp(clusterID, nodeID, math.MaxUint64,
+		func(fk *Key, lk *Key) error {
+			return r.kvs.IterateValue(fk.Key(), lk.Key(), true, op)
+		})
+}
+
+func (r *db) importNode(ni raftio.NodeInfo,
+	next func() ([]byte, []byte, bool, error)) error {
+	r.cs.dropSparseIndex(ni.ClusterID, ni.NodeID)
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	var in *ingester
+	if r.kvs.canIngest() {
+		in = r.kvs.newIngester()
+		defer func() {
+			if err := in.cleanup(); err != nil {
+				plog.Errorf("failed to remove sstables built for ingestion, %v", err)
+			}
+		}()
+	}
+	var state *pb.State
+	var maxIndex, snapshotIndex uint64
+	for {
+		key, data, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if !isNodeKey(key) {
+			return errors.Wrapf(ErrInvalidNodeExport, "unexpected key %x", key)
+		}
+		if raftio.GetNodeInfo(parseNodeInfoKey(key[:persistentStateKeySize])) != ni {
+			return errors.Wrapf(ErrInvalidNodeExport, "key %x of another node", key)
+		}
+		switch {
+		case bytes.HasPrefix(key, persistentStateKeyHeader[:]):
+			st := pb.State{}
+			if err := st.Unmarshal(data); err != nil {
+				return errors.Wrapf(ErrInvalidNodeExport, "%v", err)
+			}
+			state = &st
+		case bytes.HasPrefix(key, maxIndexKeyHeader[:]):
+			if len(data) != 8 {
+				return errors.Wrap(ErrInvalidNodeExport, "invalid max index")
+			}
+			maxIndex = binary.BigEndian.Uint64(data)
+		case bytes.HasPrefix(key, snapshotKeyHeader[:]):
+			if _, _, index := parseEntryKey(key); index > snapshotIndex {
+				snapshotIndex = index
+			}
+		}
+		if in != nil && bytes.HasPrefix(key, entryKeyHeader[:]) {
+			if err := in.add(key, data); err != nil {
+				if errors.Is(err, errUnorderedIngestion) {
+					return errors.Wrapf(ErrInvalidNodeExport, "%v", err)
+				}
+				return err
+			}
+			continue
+		}
+		wb.Put(key, data)
+		if wb.Count() >= importBatchSize {
+			if err := r.kvs.CommitWriteBatch(wb); err != nil {
+				return err
+			}
+			wb.Clear()
+		}
+	}
+	if wb.Count() > 0 {
+		if err := r.kvs.CommitWriteBatch(wb); err != nil {
+			return err
+		}
+	}
+	if in != nil {
+		if err := in.ingest(); err != nil {
+			return err
+		}
+	}
+	if state != nil {
+		r.cs.setState(ni.ClusterID, ni.NodeID, *state)
+	}
+	if maxIndex > 0 {
+		r.cs.setMaxIndex(ni.ClusterID, ni.NodeID, maxIndex)
+	}
+	if snapshotIndex > 0 {
+		r.cs.setSnapshotIndex(ni.ClusterID, ni.NodeID, snapshotIndex)
+	}
+	return nil
+}
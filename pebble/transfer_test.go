@@ -0,0 +1,119 @@
+package pebble
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func runTransferTest(t *testing.T, tf func(t *testing.T, src *ShardedDB, dst *ShardedDB)) {
+	runTransferTestWithIngestion(t, false, tf)
+}
+
+func runTransferTestWithIngestion(t *testing.T, ingest bool,
+	tf func(t *testing.T, src *ShardedDB, dst *ShardedDB)) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	src, err := NewLogDB(cfg, nil, []string{fs.PathJoin(RDBTestDirectory, "src")}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, src.Close())
+	}()
+	cfg.IngestImports = ingest
+	dst, err := NewLogDB(cfg, nil, []string{fs.PathJoin(RDBTestDirectory, "dst")}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, dst.Close())
+	}()
+	tf(t, src, dst)
+}
+
+func TestTransferNode(t *testing.T) {
+	runTransferTest(t, testTransferNode)
+}
+
+func TestTransferNodeUsingIngestion(t *testing.T) {
+	runTransferTestWithIngestion(t, true, func(t *testing.T, src *ShardedDB, dst *ShardedDB) {
+		testTransferNode(t, src, dst)
+		kvs := dst.shards[dst.partitioner.GetPartitionID(1)].kvs
+		levels, err := kvs.db.SSTables()
+		require.NoError(t, err)
+		tables := 0
+		for _, l := range levels {
+			tables += len(l)
+		}
+		require.True(t, tables > 0)
+		requireNoIngestionLeftovers(t, kvs)
+	})
+}
+
+func requireNoIngestionLeftovers(t *testing.T, kvs *KV) {
+	files, err := kvs.config.FS.List(kvs.dir)
+	require.NoError(t, err)
+	for _, f := range files {
+		require.NotContains(t, f, "ingest-")
+	}
+}
+
+func testTransferNode(t *testing.T, src *ShardedDB, dst *ShardedDB) {
+	saveTestNode(t, src, 1, 2, 3000)
+	saveTestNode(t, src, 1, 3, 10)
+	require.NoError(t, src.SaveSnapshots([]pb.Update{{
+		ClusterID: 1,
+		NodeID:    2,
+		Snapshot:  pb.Snapshot{Index: 100, Term: 1},
+	}}))
+	require.NoError(t, TransferNode(dst, src, 1, 2))
+	ss, err := dst.GetSnapshot(1, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), ss.Index)
+	rs, err := dst.ReadRaftState(1, 2, ss.Index)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rs.State.Vote)
+	require.Equal(t, uint64(3000), rs.State.Commit)
+	require.Equal(t, uint64(2901), rs.EntryCount)
+	ents, _, err := dst.IterateEntries(nil, 0, 1, 2, 2990, 3001, 1<<30)
+	require.NoError(t, err)
+	require.Len(t, ents, 11)
+	nodes, err := dst.ListNodeInfo()
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	rs, err = src.ReadRaftState(1, 2, ss.Index)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2901), rs.EntryCount)
+	err = TransferNode(dst, src, 1, 2)
+	require.True(t, errors.Is(err, ErrNodeExists))
+	err = TransferNode(dst, src, 5, 6)
+	require.True(t, errors.Is(err, ErrNodeNotFound))
+}
+
+func TestImportNodeRemovesPartiallyImportedData(t *testing.T) {
+	tf := func(t *testing.T, src *ShardedDB, dst *ShardedDB) {
+		saveTestNode(t, src, 1, 2, 3000)
+		var buf bytes.Buffer
+		count, err := src.ExportNode(&buf, 1, 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3003), count)
+		data := buf.Bytes()
+		data[len(data)-3] ^= 0xFF
+		_, err = dst.ImportNode(bytes.NewReader(data))
+		require.True(t, errors.Is(err, ErrInvalidNodeExport))
+		found, err := dst.shards[dst.partitioner.GetPartitionID(1)].hasNodeData(1, 2)
+		require.NoError(t, err)
+		require.False(t, found)
+		_, err = dst.ReadRaftState(1, 2, 0)
+		require.Equal(t, raftio.ErrNoSavedLog, errors.Cause(err))
+		requireNoIngestionLeftovers(t, dst.shards[dst.partitioner.GetPartitionID(1)].kvs)
+	}
+	runTransferTest(t, tf)
+	runTransferTestWithIngestion(t, true, tf)
+}
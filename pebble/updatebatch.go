@@ -0,0 +1,105 @@
+package pebble
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// EncodeUpdateBatch returns the pebble write batch representation holding
+// the records saved by the LogDB for the update, i.e. its raft state, its
+// snapshot and its entries, using the keys and the plain binary format of
+// the LogDB. The returned batch is carried by replication stream frames, see
+// StreamFrame, and decoded by DecodeUpdateBatch.
+func EncodeUpdateBatch(ud pb.Update) ([]byte, error) {
+	wb := new(pebble.Batch)
+	k := newKey(maxKeySize, nil)
+	if !pb.IsEmptyState(ud.State) {
+		k.SetStateKey(ud.ClusterID, ud.NodeID)
+		if err := wb.Set(k.Key(), pb.MustMarshal(&ud.State), nil); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if !pb.IsEmptySnapshot(ud.Snapshot) {
+		k.setSnapshotKey(ud.ClusterID, ud.NodeID, ud.Snapshot.Index)
+		if err := wb.Set(k.Key(), pb.MustMarshal(&ud.Snapshot), nil); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	for i := range ud.EntriesToSave {
+		e := &ud.EntriesToSave[i]
+		k.SetEntryKey(ud.ClusterID, ud.NodeID, e.Index)
+		if err := wb.Set(k.Key(), pb.MustMarshal(e), nil); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if wb.Count() == 0 {
+		return nil, errors.Errorf("empty update of %s", dn(ud.ClusterID, ud.NodeID))
+	}
+	return wb.Repr(), nil
+}
+
+// DecodeUpdateBatch decodes the update encoded by EncodeUpdateBatch,
+// ErrInvalidStream is returned when the batch contains records other than
+// the raft state, the snapshot and the entries of a single node.
+func DecodeUpdateBatch(data []byte) (pb.Update, error) {
+	r, count := pebble.ReadBatch(data)
+	if count == 0 {
+		return pb.Update{}, errors.Wrap(ErrInvalidStream, "empty update")
+	}
+	var ud pb.Update
+	for i := uint32(0); i < count; i++ {
+		kind, key, value, ok := r.Next()
+		if !ok || kind != pebble.InternalKeyKindSet {
+			return pb.Update{}, errors.Wrapf(ErrInvalidStream, "invalid record %d", i)
+		}
+		cid, nid, err := decodeUpdateKey(key)
+		if err != nil {
+			return pb.Update{}, err
+		}
+		if i == 0 {
+			ud.ClusterID, ud.NodeID = cid, nid
+		} else if cid != ud.ClusterID || nid != ud.NodeID {
+			return pb.Update{}, errors.Wrapf(ErrInvalidStream,
+				"records of %s and %s", dn(ud.ClusterID, ud.NodeID), dn(cid, nid))
+		}
+		switch {
+		case bytes.HasPrefix(key, persistentStateKeyHeader[:]):
+			err = unmarshal(&ud.State, value)
+		case bytes.HasPrefix(key, snapshotKeyHeader[:]):
+			err = unmarshal(&ud.Snapshot, value)
+		default:
+			var e pb.Entry
+			if err = unmarshal(&e, value); err == nil {
+				err = checkEntry(key, e, cid, nid)
+			}
+			ud.EntriesToSave = append(ud.EntriesToSave, e)
+		}
+		if err != nil {
+			return pb.Update{}, errors.Wrapf(ErrInvalidStream, "%v", err)
+		}
+	}
+	return ud, nil
+}
+
+// decodeUpdateKey returns the cluster and node IDs of a key written by
+// EncodeUpdateBatch.
+func decodeUpdateKey(key []byte) (uint64, uint64, error) {
+	var cid, nid uint64
+	var err error
+	switch {
+	case bytes.HasPrefix(key, persistentStateKeyHeader[:]):
+		cid, nid, err = decodeNodeInfoKey(key)
+	case bytes.HasPrefix(key, snapshotKeyHeader[:]),
+		bytes.HasPrefix(key, entryKeyHeader[:]):
+		cid, nid, _, err = decodeEntryKey(key)
+	default:
+		err = errors.Errorf("unexpected key %x", key)
+	}
+	if err != nil {
+		return 0, 0, errors.Wrapf(ErrInvalidStream, "%v", err)
+	}
+	return cid, nid, nil
+}
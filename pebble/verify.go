@@ -0,0 +1,255 @@
+package pebble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/coufalja/tugboat-logdb/pebble/invariants"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// Violation describes a single corruption or invariant violation found by
+// the Verify method.
+type Violation struct {
+	Shard     uint64
+	ClusterID uint64
+	NodeID    uint64
+	// Key is the hex encoded key of the offending record, it is empty when the
+	// violation is not related to a single record.
+	Key     string `json:",omitempty"`
+	Message string
+}
+
+func (v Violation) String() string {
+	if len(v.Key) > 0 {
+		return fmt.Sprintf("shard %d %s key %s: %s",
+			v.Shard, dn(v.ClusterID, v.NodeID), v.Key, v.Message)
+	}
+	return fmt.Sprintf("shard %d %s: %s",
+		v.Shard, dn(v.ClusterID, v.NodeID), v.Message)
+}
+
+// VerifyReport is the result of a Verify run.
+type VerifyReport struct {
+	Shards     uint64
+	Nodes      uint64
+	Records    uint64
+	Entries    uint64
+	Violations []Violation
+}
+
+// OK returns a boolean value indicating whether no violation was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// Verify scans all records stored in all shards to check that they can be
+// decoded and that the invariants between the records of each node hold. It
+// returns an error only when the scan itself fails, corruptions are reported
+// as violations in the returned report.
+func (s *ShardedDB) Verify() (VerifyReport, error) {
+	if s.hasSegmentedEntries() {
+		return VerifyReport{}, errors.WithStack(ErrSegmentedEntries)
+	}
+	shards, err := s.allShards()
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	report := VerifyReport{Shards: uint64(len(shards))}
+	for i, shard := range shards {
+		if err := shard.verify(uint64(i), &report); err != nil {
+			return VerifyReport{}, err
+		}
+	}
+	return report, nil
+}
+
+func (r *db) verify(shard uint64, report *VerifyReport) error {
+	_, err := r.verifyFrom(shard, nil,
+		make(map[raftio.NodeInfo]*invariants.Records), report, nil)
+	return err
+}
+
+// verifyMetadata verifies all records of the shard except entries, only the
+// invariants not involving entries are checked.
+func (r *db) verifyMetadata(shard uint64, report *VerifyReport) error {
+	// entry keys are ordered before the keys of all other records
+	_, err := r.verifyRange(shard, persistentStateKeyHeader[:],
+		make(map[raftio.NodeInfo]*invariants.Records), report, nil,
+		invariants.CheckMetadata)
+	return err
+}
+
+// verifyFrom verifies the records of the shard starting from the start key,
+// or from the first key when start is nil. The scan stops once the budget is
+// exhausted and the key to continue from is returned, the invariants of the
+// nodes are only checked once the scan reaches the end of the shard.
+func (r *db) verifyFrom(shard uint64, start []byte,
+	nodes map[raftio.NodeInfo]*invariants.Records,
+	report *VerifyReport, b *scanBudget) ([]byte, error) {
+	return r.verifyRange(shard, start, nodes, report, b,
+		func(n *invariants.Records) []string { return n.Check() })
+}
+
+// verifyRange is verifyFrom checking the invariants of the nodes using the
+// specified checks.
+func (r *db) verifyRange(shard uint64, start []byte,
+	nodes map[raftio.NodeInfo]*invariants.Records, report *VerifyReport,
+	b *scanBudget, checks func(*invariants.Records) []string) ([]byte, error) {
+	r.reads.acquire()
+	defer r.reads.release()
+	get := func(clusterID uint64, nodeID uint64) *invariants.Records {
+		key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+		n, ok := nodes[key]
+		if !ok {
+			n = &invariants.Records{}
+			nodes[key] = n
+		}
+		return n
+	}
+	violate := func(key []byte, clusterID uint64, nodeID uint64, format string, args ...interface{}) {
+		v := Violation{
+			Shard:     shard,
+			ClusterID: clusterID,
+			NodeID:    nodeID,
+			Message:   fmt.Sprintf(format, args...),
+		}
+		if key != nil {
+			v.Key = hex.EncodeToString(key)
+		}
+		report.Violations = append(report.Violations, v)
+	}
+	check := func(key []byte, data []byte) (bool, error) {
+		report.Records++
+		if len(key) >= appRecordKeyPrefixSize &&
+			key[0] == appRecordKeyHeader[0] && key[1] == appRecordKeyHeader[1] {
+			// application records are opaque
+			return true, nil
+		}
+		if bytes.Equal(key, stateCommitKey) || bytes.Equal(key, stateAppliedKey) {
+			// recovery markers of the state store, see commitSplitBatch
+			return true, nil
+		}
+		if uint64(len(key)) < persistentStateKeySize {
+			violate(key, 0, 0, "unexpected key size %d", len(key))
+			return true, nil
+		}
+		clusterID := binary.BigEndian.Uint64(key[4:])
+		nodeID := binary.BigEndian.Uint64(key[12:])
+		header := [2]byte{key[0], key[1]}
+		expected := persistentStateKeySize
+		if header == entryKeyHeader || header == snapshotKeyHeader ||
+			header == sinkOffsetKeyHeader {
+			expected = entryKeySize
+		}
+		if uint64(len(key)) != expected {
+			violate(key, clusterID, nodeID, "unexpected key size %d", len(key))
+			return true, nil
+		}
+		n := get(clusterID, nodeID)
+		switch header {
+		case entryKeyHeader:
+			index := binary.BigEndian.Uint64(key[20:])
+			report.Entries++
+			var e pb.Entry
+			if err := e.Unmarshal(data); err != nil {
+				n.AddEntry(index, n.LastTerm)
+				violate(key, clusterID, nodeID, "failed to decode entry: %v", err)
+				return true, nil
+			}
+			n.AddEntry(index, e.Term)
+			if e.Index != index {
+				violate(key, clusterID, nodeID, "entry index %d stored as index %d", e.Index, index)
+			}
+		case persistentStateKeyHeader:
+			var st pb.State
+			if err := st.Unmarshal(data); err != nil {
+				violate(key, clusterID, nodeID, "failed to decode state: %v", err)
+			}
+		case maxIndexKeyHeader:
+			if len(data) != 8 {
+				violate(key, clusterID, nodeID, "unexpected max index size %d", len(data))
+				return true, nil
+			}
+			n.SetMaxIndex(binary.BigEndian.Uint64(data))
+		case snapshotKeyHeader:
+			index := binary.BigEndian.Uint64(key[20:])
+			var ss pb.Snapshot
+			if err := ss.Unmarshal(data); err != nil {
+				violate(key, clusterID, nodeID, "failed to decode snapshot: %v", err)
+				return true, nil
+			}
+			if ss.Index != index {
+				violate(key, clusterID, nodeID, "snapshot index %d stored as index %d", ss.Index, index)
+			}
+			n.AddSnapshot(ss.Index, ss.Term)
+		case bootstrapKeyHeader:
+			var bs pb.Bootstrap
+			if err := bs.Unmarshal(data); err != nil {
+				violate(key, clusterID, nodeID, "failed to decode bootstrap: %v", err)
+			}
+			n.HasBootstrap = true
+		case sinkOffsetKeyHeader:
+			if len(data) < 8 {
+				violate(key, clusterID, nodeID, "unexpected sink offset size %d", len(data))
+			}
+		case nodeMetadataKeyHeader:
+			if uint64(len(data)) > MaxNodeMetadataSize {
+				violate(key, clusterID, nodeID, "unexpected node metadata size %d", len(data))
+			}
+		case appliedIndexKeyHeader:
+			if len(data) != 8 {
+				violate(key, clusterID, nodeID, "unexpected applied index size %d", len(data))
+			}
+		case nodeInfoKeyHeader:
+		default:
+			violate(key, clusterID, nodeID, "unknown key header %x", header)
+		}
+		return true, nil
+	}
+	var next []byte
+	op := func(key []byte, data []byte) (bool, error) {
+		if _, err := check(key, data); err != nil {
+			return false, err
+		}
+		if b.consume(uint64(len(key) + len(data))) {
+			next = keySuccessor(key)
+			return false, nil
+		}
+		return true, nil
+	}
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	fk.SetMinimumKey()
+	lk.SetMaximumKey()
+	first := fk.Key()
+	if start != nil {
+		first = start
+	}
+	if err := r.kvs.IterateValue(first, lk.Key(), true, op); err != nil {
+		return nil, err
+	}
+	if next != nil {
+		return next, nil
+	}
+	keys := make([]raftio.NodeInfo, 0, len(nodes))
+	for k := range nodes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return nodeInfoLess(keys[i], keys[j])
+	})
+	for _, k := range keys {
+		n := nodes[k]
+		report.Nodes++
+		for _, msg := range checks(n) {
+			violate(nil, k.ClusterID, k.NodeID, "%s", msg)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package pebble
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble/invariants"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReportsNoViolationForHealthyDB(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 3, 4, 20)
+		require.NoError(t, db.RemoveEntriesTo(3, 4, 5))
+		report, err := sdb.Verify()
+		require.NoError(t, err)
+		require.True(t, report.OK(), "%v", report.Violations)
+		require.Equal(t, uint64(2), report.Nodes)
+		require.Equal(t, uint64(10+16), report.Entries)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestVerifyReportsCorruptedEntry(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		k := newKey(entryKeySize, nil)
+		k.SetEntryKey(1, 2, 5)
+		shard := sdb.shards[sdb.partitioner.GetPartitionID(1)]
+		require.NoError(t, shard.kvs.SaveValue(k.Key(), []byte{0xFF, 0xFF, 0xFF}))
+		report, err := sdb.Verify()
+		require.NoError(t, err)
+		require.False(t, report.OK())
+		require.Len(t, report.Violations, 1)
+		require.Contains(t, report.Violations[0].Message, "failed to decode entry")
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestVerifyReportsMissingEntries(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		shard := sdb.shards[sdb.partitioner.GetPartitionID(1)]
+		for _, index := range []uint64{5, 10} {
+			k := newKey(entryKeySize, nil)
+			k.SetEntryKey(1, 2, index)
+			require.NoError(t, shard.kvs.DeleteValue(k.Key()))
+		}
+		report, err := sdb.Verify()
+		require.NoError(t, err)
+		require.Len(t, report.Violations, 2)
+		messages := report.Violations[0].Message + report.Violations[1].Message
+		require.True(t, strings.Contains(messages, "entries [5, 5] missing"), messages)
+		require.True(t, strings.Contains(messages, "missing, last index 9"), messages)
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestInvariantsCheckLogDB(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveTestNode(t, sdb, 1, 2, 10)
+		saveTestNode(t, sdb, 3, 4, 20)
+		ss := pb.Snapshot{Index: 10, Term: 1}
+		require.NoError(t, db.SaveSnapshots([]pb.Update{{ClusterID: 3, NodeID: 4, Snapshot: ss}}))
+		require.NoError(t, db.RemoveEntriesTo(3, 4, 10))
+		violations, err := invariants.CheckLogDB(db)
+		require.NoError(t, err)
+		require.Empty(t, violations)
+		k := newKey(entryKeySize, nil)
+		k.SetEntryKey(3, 4, 15)
+		shard := sdb.shards[sdb.partitioner.GetPartitionID(3)]
+		require.NoError(t, shard.kvs.DeleteValue(k.Key()))
+		violations, err = invariants.CheckLogDB(db)
+		require.NoError(t, err)
+		require.Len(t, violations, 1)
+		require.Equal(t, uint64(3), violations[0].ClusterID)
+		require.Contains(t, violations[0].Message, "entries up to max index 20 missing")
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestVerifyReadsDetectsMisplacedEntries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	cfg.VerifyReads = true
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, []string{}, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	saveTestNode(t, db, 1, 2, 10)
+	shard := db.shards[db.partitioner.GetPartitionID(1)]
+	k := newKey(entryKeySize, nil)
+	k.SetEntryKey(1, 2, 5)
+	e := pb.Entry{Index: 6, Term: 1}
+	require.NoError(t, shard.kvs.SaveValue(k.Key(), pb.MustMarshal(&e)))
+	_, _, err = db.IterateEntries(nil, 0, 1, 2, 1, 11, math.MaxUint64)
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+	require.Contains(t, err.Error(), "entry 6 read under the key of entry 5")
+	_, _, err = db.IterateEntries(nil, 0, 1, 2, 5, 6, math.MaxUint64)
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+
+	require.NoError(t, shard.kvs.DeleteValue(k.Key()))
+	_, _, err = db.IterateEntries(nil, 0, 1, 2, 1, 11, math.MaxUint64)
+	require.ErrorIs(t, err, ErrCorruptedRecord)
+	require.Contains(t, err.Error(), "entry 6 follows entry 4")
+	ents, _, err := db.IterateEntries(nil, 0, 1, 2, 6, 11, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, ents, 5)
+}
@@ -5,19 +5,56 @@ import (
 	"os"
 
 	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
 	"github.com/lni/vfs"
 )
 
 // PebbleFS is a wrapper struct that implements the pebble/vfs.FS interface.
 type PebbleFS struct {
 	fs vfs.FS
+	// readAhead replaces random read hints with sequential read hints.
+	readAhead bool
+	// walDSync and tableDSync open WAL and sstable files for writing with
+	// O_DSYNC when the underlying FS is the OS file system.
+	walDSync   bool
+	tableDSync bool
+}
+
+func newPebbleFS(fs vfs.FS, config LogDBConfig) *PebbleFS {
+	return &PebbleFS{
+		fs:         fs,
+		readAhead:  config.ReadAhead,
+		walDSync:   config.WALDSync,
+		tableDSync: config.TableDSync,
+	}
+}
+
+// customized returns a boolean value indicating whether the PebbleFS changes
+// the behavior of the wrapped FS.
+func (p *PebbleFS) customized() bool {
+	return p.readAhead || p.walDSync || p.tableDSync
+}
+
+// dsync returns a boolean value indicating whether the specified file should
+// be opened with O_DSYNC.
+func (p *PebbleFS) dsync(name string) bool {
+	if p.fs != vfs.Default || !dsyncSupported {
+		return false
+	}
+	switch vfsutil.GetFileType(name) {
+	case vfsutil.FileTypeWAL:
+		return p.walDSync
+	case vfsutil.FileTypeTable:
+		return p.tableDSync
+	}
+	return false
 }
 
 var _ pvfs.FS = (*PebbleFS)(nil)
 
 // NewPebbleFS creates a new pebble/vfs.FS instance.
 func NewPebbleFS(fs vfs.FS) pvfs.FS {
-	return &PebbleFS{fs}
+	return &PebbleFS{fs: fs}
 }
 
 func (p *PebbleFS) GetDiskUsage(path string) (pvfs.DiskUsage, error) {
@@ -34,6 +71,9 @@ func (p *PebbleFS) GetFreeSpace(path string) (uint64, error) {
 
 // Create ...
 func (p *PebbleFS) Create(name string) (pvfs.File, error) {
+	if p.dsync(name) {
+		return openDSync(name, os.O_TRUNC)
+	}
 	return p.fs.Create(name)
 }
 
@@ -44,16 +84,41 @@ func (p *PebbleFS) Link(oldname, newname string) error {
 
 // Open ...
 func (p *PebbleFS) Open(name string, opts ...pvfs.OpenOption) (pvfs.File, error) {
-	f, err := p.fs.Open(name)
+	hints, others := p.openOptions(opts)
+	f, err := p.fs.Open(name, hints...)
 	if err != nil {
 		return nil, err
 	}
-	for _, opt := range opts {
+	for _, opt := range others {
 		opt.Apply(f)
 	}
 	return f, nil
 }
 
+// openOptions translates the read hints used by pebble into their vfs
+// counterparts, so they are honored by the underlying FS and by all FS
+// wrappers passing options down to the FS they wrap. Other options are
+// returned as they are to be applied to the opened file.
+func (p *PebbleFS) openOptions(opts []pvfs.OpenOption) ([]vfs.OpenOption, []pvfs.OpenOption) {
+	hints := make([]vfs.OpenOption, 0, len(opts))
+	others := make([]pvfs.OpenOption, 0)
+	for _, opt := range opts {
+		switch opt {
+		case pvfs.SequentialReadsOption:
+			hints = append(hints, vfs.SequentialReadsOption)
+		case pvfs.RandomReadsOption:
+			if p.readAhead {
+				hints = append(hints, vfs.SequentialReadsOption)
+			} else {
+				hints = append(hints, vfs.RandomReadsOption)
+			}
+		default:
+			others = append(others, opt)
+		}
+	}
+	return hints, others
+}
+
 // OpenDir ...
 func (p *PebbleFS) OpenDir(name string) (pvfs.File, error) {
 	return p.fs.OpenDir(name)
@@ -76,6 +141,12 @@ func (p *PebbleFS) Rename(oldname, newname string) error {
 
 // ReuseForWrite ...
 func (p *PebbleFS) ReuseForWrite(oldname, newname string) (pvfs.File, error) {
+	if p.dsync(newname) {
+		if err := p.fs.Rename(oldname, newname); err != nil {
+			return nil, err
+		}
+		return openDSync(newname, 0)
+	}
 	return p.fs.ReuseForWrite(oldname, newname)
 }
 
@@ -0,0 +1,84 @@
+package pebble
+
+import (
+	"bytes"
+	"testing"
+
+	pvfs "github.com/cockroachdb/pebble/vfs"
+	"github.com/coufalja/tugboat-logdb/pebble/vfsutil"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+type optionRecorderFS struct {
+	vfs.FS
+	opts []vfs.OpenOption
+}
+
+func (fs *optionRecorderFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	fs.opts = append(fs.opts, opts...)
+	return fs.FS.Open(name, opts...)
+}
+
+type applyCounter struct {
+	applied int
+}
+
+func (c *applyCounter) Apply(pvfs.File) {
+	c.applied++
+}
+
+func TestPebbleFSPassesReadHintsToFS(t *testing.T) {
+	fs := &optionRecorderFS{FS: vfs.NewMem()}
+	f, err := fs.Create("file")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	counter := &applyCounter{}
+	pfs := NewPebbleFS(fs)
+	f2, err := pfs.Open("file", pvfs.SequentialReadsOption, pvfs.RandomReadsOption, counter)
+	require.NoError(t, err)
+	require.NoError(t, f2.Close())
+	require.Len(t, fs.opts, 2)
+	require.Equal(t, vfs.SequentialReadsOption, fs.opts[0])
+	require.Equal(t, vfs.RandomReadsOption, fs.opts[1])
+	require.Equal(t, 1, counter.applied)
+}
+
+func TestPebbleFSReadAhead(t *testing.T) {
+	fs := &optionRecorderFS{FS: vfs.NewMem()}
+	f, err := fs.Create("file")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	pfs := &PebbleFS{fs: fs, readAhead: true}
+	f2, err := pfs.Open("file", pvfs.RandomReadsOption)
+	require.NoError(t, err)
+	require.NoError(t, f2.Close())
+	require.Equal(t, []vfs.OpenOption{vfs.SequentialReadsOption}, fs.opts)
+}
+
+func TestLogDBOnEncryptedFS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	mem := vfs.NewMem()
+	fs, err := vfsutil.NewEncryptedFS(mem, bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	cfg := getDefaultLogDBConfig()
+	cfg.FS = fs
+	db, err := NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.NoError(t, err)
+	saveTestNode(t, db, 1, 2, 100)
+	require.NoError(t, db.Close())
+	// the raw files are not readable without the encryption layer
+	raw := cfg
+	raw.FS = mem
+	_, err = NewLogDB(raw, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.Error(t, err)
+	db, err = NewLogDB(cfg, nil, []string{RDBTestDirectory}, nil, CheckNone)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	rs, err := db.ReadRaftState(1, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), rs.EntryCount)
+}
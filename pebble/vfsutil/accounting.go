@@ -0,0 +1,329 @@
+/*
+Package vfsutil provides vfs.FS decorators for observing and transforming the
+file system operations of the LogDB. All decorators can be set as
+LogDBConfig.FS or be used independently.
+*/
+package vfsutil
+
+import (
+	"math"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/vfs"
+)
+
+// FileType is the type of a file as seen by the storage engine.
+type FileType int
+
+const (
+	// FileTypeOther covers all files of other types and directories.
+	FileTypeOther FileType = iota
+	// FileTypeWAL is the type of write ahead log files.
+	FileTypeWAL
+	// FileTypeTable is the type of sstable files.
+	FileTypeTable
+	// FileTypeManifest is the type of manifest files.
+	FileTypeManifest
+	numOfFileTypes
+)
+
+func (t FileType) String() string {
+	switch t {
+	case FileTypeWAL:
+		return "wal"
+	case FileTypeTable:
+		return "sst"
+	case FileTypeManifest:
+		return "manifest"
+	}
+	return "other"
+}
+
+// GetFileType returns the type of the specified file based on its name.
+func GetFileType(name string) FileType {
+	switch {
+	case strings.HasSuffix(name, ".log"):
+		return FileTypeWAL
+	case strings.HasSuffix(name, ".sst"):
+		return FileTypeTable
+	case strings.HasPrefix(baseName(name), "MANIFEST-"):
+		return FileTypeManifest
+	}
+	return FileTypeOther
+}
+
+func baseName(name string) string {
+	if idx := strings.LastIndexAny(name, `/\`); idx >= 0 {
+		return name[idx+1:]
+	}
+	return name
+}
+
+// numOfLatencyBuckets is the number of buckets of a LatencyHistogram. The
+// first bucket counts latencies below 1 microsecond, bucket i counts latencies
+// in the range of [2^(i-1), 2^i) microseconds and the last bucket counts all
+// latencies above that.
+const numOfLatencyBuckets = 32
+
+func latencyBucket(latency time.Duration) int {
+	us := uint64(latency / time.Microsecond)
+	b := bits.Len64(us)
+	if b >= numOfLatencyBuckets {
+		return numOfLatencyBuckets - 1
+	}
+	return b
+}
+
+// LatencyHistogram is a histogram of operation latencies using exponentially
+// sized buckets.
+type LatencyHistogram struct {
+	Buckets [numOfLatencyBuckets]uint64
+}
+
+// Count returns the number of recorded latencies.
+func (h LatencyHistogram) Count() uint64 {
+	count := uint64(0)
+	for _, v := range h.Buckets {
+		count += v
+	}
+	return count
+}
+
+// Percentile returns the upper bound of the bucket containing the p-th
+// percentile of the recorded latencies, p is in the range of [0, 1]. Zero is
+// returned when no latency has been recorded.
+func (h LatencyHistogram) Percentile(p float64) time.Duration {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(count)))
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for i, v := range h.Buckets {
+		seen += v
+		if seen >= rank {
+			return time.Duration(uint64(1)<<uint(i)) * time.Microsecond
+		}
+	}
+	panic("not suppose to reach here")
+}
+
+// OpStats contains the statistics of a single type of file operations.
+type OpStats struct {
+	Count        uint64
+	Bytes        uint64
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+	Latency      LatencyHistogram
+}
+
+// PercentileLatency returns the p-th percentile latency of the operations, it
+// is estimated using the latency histogram and capped at MaxLatency.
+func (s OpStats) PercentileLatency(p float64) time.Duration {
+	if v := s.Latency.Percentile(p); v < s.MaxLatency {
+		return v
+	}
+	return s.MaxLatency
+}
+
+// AverageLatency returns the average latency of the operations.
+func (s OpStats) AverageLatency() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Count)
+}
+
+// FileIOStats contains the IO statistics of files of the same type.
+type FileIOStats struct {
+	Reads  OpStats
+	Writes OpStats
+	Syncs  OpStats
+}
+
+// IOStats contains the IO statistics of all file types.
+type IOStats struct {
+	WAL      FileIOStats
+	Table    FileIOStats
+	Manifest FileIOStats
+	Other    FileIOStats
+}
+
+// Get returns the statistics of the specified file type.
+func (s IOStats) Get(t FileType) FileIOStats {
+	switch t {
+	case FileTypeWAL:
+		return s.WAL
+	case FileTypeTable:
+		return s.Table
+	case FileTypeManifest:
+		return s.Manifest
+	}
+	return s.Other
+}
+
+type opCounter struct {
+	count        uint64
+	bytes        uint64
+	totalLatency int64
+	maxLatency   int64
+	latency      [numOfLatencyBuckets]uint64
+}
+
+func (c *opCounter) record(bytes int, latency time.Duration) {
+	atomic.AddUint64(&c.count, 1)
+	atomic.AddUint64(&c.bytes, uint64(bytes))
+	atomic.AddInt64(&c.totalLatency, int64(latency))
+	atomic.AddUint64(&c.latency[latencyBucket(latency)], 1)
+	for {
+		v := atomic.LoadInt64(&c.maxLatency)
+		if int64(latency) <= v ||
+			atomic.CompareAndSwapInt64(&c.maxLatency, v, int64(latency)) {
+			return
+		}
+	}
+}
+
+func (c *opCounter) stats() OpStats {
+	st := OpStats{
+		Count:        atomic.LoadUint64(&c.count),
+		Bytes:        atomic.LoadUint64(&c.bytes),
+		TotalLatency: time.Duration(atomic.LoadInt64(&c.totalLatency)),
+		MaxLatency:   time.Duration(atomic.LoadInt64(&c.maxLatency)),
+	}
+	for i := range c.latency {
+		st.Latency.Buckets[i] = atomic.LoadUint64(&c.latency[i])
+	}
+	return st
+}
+
+type fileCounters struct {
+	reads  opCounter
+	writes opCounter
+	syncs  opCounter
+}
+
+func (c *fileCounters) stats() FileIOStats {
+	return FileIOStats{
+		Reads:  c.reads.stats(),
+		Writes: c.writes.stats(),
+		Syncs:  c.syncs.stats(),
+	}
+}
+
+// AccountingFS is a vfs.FS decorator counting the reads, writes and syncs of
+// each file type along with the number of transferred bytes and the latency
+// of the operations. The latency histogram of WAL syncs tells slow fsync of
+// the underlying disk apart from a busy storage engine.
+type AccountingFS struct {
+	vfs.FS
+	counters [numOfFileTypes]fileCounters
+}
+
+var _ vfs.FS = (*AccountingFS)(nil)
+
+// NewAccountingFS creates an AccountingFS instance wrapping fs.
+func NewAccountingFS(fs vfs.FS) *AccountingFS {
+	return &AccountingFS{FS: fs}
+}
+
+// Stats returns the IO statistics collected so far.
+func (a *AccountingFS) Stats() IOStats {
+	return IOStats{
+		WAL:      a.counters[FileTypeWAL].stats(),
+		Table:    a.counters[FileTypeTable].stats(),
+		Manifest: a.counters[FileTypeManifest].stats(),
+		Other:    a.counters[FileTypeOther].stats(),
+	}
+}
+
+// Unwrap returns the wrapped FS.
+func (a *AccountingFS) Unwrap() vfs.FS {
+	return a.FS
+}
+
+func (a *AccountingFS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &accountingFile{File: f, counters: &a.counters[GetFileType(name)]}, nil
+}
+
+// Create ...
+func (a *AccountingFS) Create(name string) (vfs.File, error) {
+	f, err := a.FS.Create(name)
+	return a.wrap(name, f, err)
+}
+
+// Open ...
+func (a *AccountingFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := a.FS.Open(name, opts...)
+	return a.wrap(name, f, err)
+}
+
+// OpenDir ...
+func (a *AccountingFS) OpenDir(name string) (vfs.File, error) {
+	f, err := a.FS.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &accountingFile{File: f, counters: &a.counters[FileTypeOther]}, nil
+}
+
+// OpenForAppend ...
+func (a *AccountingFS) OpenForAppend(name string) (vfs.File, error) {
+	f, err := a.FS.OpenForAppend(name)
+	return a.wrap(name, f, err)
+}
+
+// ReuseForWrite ...
+func (a *AccountingFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := a.FS.ReuseForWrite(oldname, newname)
+	return a.wrap(newname, f, err)
+}
+
+type accountingFile struct {
+	vfs.File
+	counters *fileCounters
+}
+
+func (f *accountingFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Read(p)
+	f.counters.reads.record(n, time.Since(start))
+	return n, err
+}
+
+func (f *accountingFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.ReadAt(p, off)
+	f.counters.reads.record(n, time.Since(start))
+	return n, err
+}
+
+func (f *accountingFile) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.File.Write(p)
+	f.counters.writes.record(n, time.Since(start))
+	return n, err
+}
+
+func (f *accountingFile) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.WriteAt(p, off)
+	f.counters.writes.record(n, time.Since(start))
+	return n, err
+}
+
+func (f *accountingFile) Sync() error {
+	start := time.Now()
+	err := f.File.Sync()
+	f.counters.syncs.record(0, time.Since(start))
+	return err
+}
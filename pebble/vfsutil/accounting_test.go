@@ -0,0 +1,69 @@
+package vfsutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFileType(t *testing.T) {
+	tests := []struct {
+		name string
+		ft   FileType
+	}{
+		{"db/000001.log", FileTypeWAL},
+		{"db/000002.sst", FileTypeTable},
+		{"db/MANIFEST-000001", FileTypeManifest},
+		{"db/OPTIONS-000003", FileTypeOther},
+		{"db/CURRENT", FileTypeOther},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.ft, GetFileType(tt.name), tt.name)
+	}
+}
+
+func TestAccountingFSCountsOperations(t *testing.T) {
+	fs := NewAccountingFS(vfs.NewMem())
+	f, err := fs.Create("000001.log")
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 100))
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 10), 100)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+	f, err = fs.Open("000001.log")
+	require.NoError(t, err)
+	_, err = f.ReadAt(make([]byte, 50), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	st := fs.Stats()
+	require.Equal(t, uint64(2), st.WAL.Writes.Count)
+	require.Equal(t, uint64(110), st.WAL.Writes.Bytes)
+	require.Equal(t, uint64(1), st.WAL.Syncs.Count)
+	require.Equal(t, uint64(1), st.WAL.Reads.Count)
+	require.Equal(t, uint64(50), st.WAL.Reads.Bytes)
+	require.GreaterOrEqual(t, st.WAL.Writes.TotalLatency, st.WAL.Writes.MaxLatency)
+	require.Zero(t, st.Table.Writes.Count)
+	require.Equal(t, st.WAL, st.Get(FileTypeWAL))
+}
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	c := &opCounter{}
+	require.Zero(t, c.stats().PercentileLatency(0.99))
+	for i := 0; i < 98; i++ {
+		c.record(0, 100*time.Microsecond)
+	}
+	c.record(0, 3*time.Millisecond)
+	c.record(0, 10*time.Second)
+	st := c.stats()
+	require.Equal(t, uint64(100), st.Latency.Count())
+	require.Equal(t, 128*time.Microsecond, st.PercentileLatency(0.5))
+	require.Equal(t, 4096*time.Microsecond, st.PercentileLatency(0.99))
+	require.Equal(t, 10*time.Second, st.PercentileLatency(1))
+	require.Equal(t, 10*time.Second, st.MaxLatency)
+	c.record(0, 0)
+	require.Equal(t, uint64(1), c.stats().Latency.Buckets[0])
+}
@@ -0,0 +1,286 @@
+package vfsutil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidKey indicates that the file was encrypted using another key.
+	ErrInvalidKey = errors.New("invalid encryption key")
+	// ErrNotEncrypted indicates that the file doesn't have a valid encryption
+	// header.
+	ErrNotEncrypted = errors.New("file not encrypted")
+)
+
+var encryptedMagic = [8]byte{'T', 'G', 'B', 'E', 'N', 'C', 0, 1}
+
+const (
+	ivSize       = aes.BlockSize
+	keyCheckSize = 8
+	// encryptedHeaderSize is the size of the header stored at the beginning
+	// of each encrypted file, it contains the magic, the per file IV and a
+	// key check value.
+	encryptedHeaderSize = len(encryptedMagic) + ivSize + keyCheckSize
+)
+
+// EncryptedFS is a vfs.FS decorator encrypting the content of all files using
+// AES in CTR mode. Each file has its own random IV stored in a header at the
+// beginning of the file, so identical content is never encrypted into
+// identical ciphertext. The counter is derived from the offset within the
+// file, so files can be read and written at arbitrary offsets.
+//
+// File names, sizes and directory structure are not encrypted and the content
+// is not authenticated, corruptions are expected to be detected by the
+// checksums of the storage engine.
+type EncryptedFS struct {
+	vfs.FS
+	block  cipher.Block
+	keyMAC []byte
+}
+
+var _ vfs.FS = (*EncryptedFS)(nil)
+
+// NewEncryptedFS creates an EncryptedFS instance wrapping fs. The key must be
+// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewEncryptedFS(fs vfs.FS, key []byte) (*EncryptedFS, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// the key check uses a key derived from the encryption key rather than
+	// the encryption key itself
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("key check"))
+	return &EncryptedFS{
+		FS:     fs,
+		block:  block,
+		keyMAC: h.Sum(nil),
+	}, nil
+}
+
+// Unwrap returns the wrapped FS.
+func (e *EncryptedFS) Unwrap() vfs.FS {
+	return e.FS
+}
+
+func (e *EncryptedFS) keyCheck(iv []byte) []byte {
+	h := hmac.New(sha256.New, e.keyMAC)
+	h.Write(iv)
+	return h.Sum(nil)[:keyCheckSize]
+}
+
+func (e *EncryptedFS) newHeader() ([]byte, []byte, error) {
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic[:])
+	iv := header[len(encryptedMagic) : len(encryptedMagic)+ivSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	copy(header[len(encryptedMagic)+ivSize:], e.keyCheck(iv))
+	return header, iv, nil
+}
+
+func (e *EncryptedFS) parseHeader(header []byte) ([]byte, error) {
+	if len(header) != encryptedHeaderSize ||
+		!hmac.Equal(header[:len(encryptedMagic)], encryptedMagic[:]) {
+		return nil, ErrNotEncrypted
+	}
+	iv := header[len(encryptedMagic) : len(encryptedMagic)+ivSize]
+	if !hmac.Equal(header[len(encryptedMagic)+ivSize:], e.keyCheck(iv)) {
+		return nil, ErrInvalidKey
+	}
+	return append([]byte{}, iv...), nil
+}
+
+// create writes a new header to the file and returns the encrypted file.
+func (e *EncryptedFS) create(f vfs.File) (vfs.File, error) {
+	header, iv, err := e.newHeader()
+	if err != nil {
+		return nil, firstError(err, f.Close())
+	}
+	if _, err := f.Write(header); err != nil {
+		return nil, firstError(errors.WithStack(err), f.Close())
+	}
+	return &encryptedFile{File: f, fs: e, iv: iv}, nil
+}
+
+func (e *EncryptedFS) open(name string, f vfs.File) (*encryptedFile, error) {
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrNotEncrypted
+		}
+		return nil, firstError(errors.Wrapf(err, "%s", name), f.Close())
+	}
+	iv, err := e.parseHeader(header)
+	if err != nil {
+		return nil, firstError(errors.Wrapf(err, "%s", name), f.Close())
+	}
+	return &encryptedFile{File: f, fs: e, iv: iv}, nil
+}
+
+func firstError(err1 error, err2 error) error {
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// Create ...
+func (e *EncryptedFS) Create(name string) (vfs.File, error) {
+	f, err := e.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.create(f)
+}
+
+// Open ...
+func (e *EncryptedFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	f, err := e.FS.Open(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(name, f)
+}
+
+// OpenForAppend ...
+func (e *EncryptedFS) OpenForAppend(name string) (vfs.File, error) {
+	// files opened for appending are write only, the header is read using a
+	// separate read only handle
+	r, err := e.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	iv := r.(*encryptedFile).iv
+	if err := r.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f, err := e.FS.OpenForAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, firstError(errors.WithStack(err), f.Close())
+	}
+	return &encryptedFile{
+		File:   f,
+		fs:     e,
+		iv:     iv,
+		offset: fi.Size() - int64(encryptedHeaderSize),
+	}, nil
+}
+
+// ReuseForWrite ...
+func (e *EncryptedFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := e.FS.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	// the reused file gets a new IV as its content is overwritten, reusing
+	// the old one would encrypt different data using the same key stream
+	return e.create(f)
+}
+
+// Stat ...
+func (e *EncryptedFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := e.FS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedFileInfo(fi), nil
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func newEncryptedFileInfo(fi os.FileInfo) os.FileInfo {
+	if fi.IsDir() {
+		return fi
+	}
+	return &encryptedFileInfo{fi}
+}
+
+func (fi *encryptedFileInfo) Size() int64 {
+	if sz := fi.FileInfo.Size() - int64(encryptedHeaderSize); sz > 0 {
+		return sz
+	}
+	return 0
+}
+
+type encryptedFile struct {
+	vfs.File
+	fs *EncryptedFS
+	iv []byte
+	// offset is the position of sequential reads and writes in plaintext.
+	offset int64
+}
+
+// xor applies the key stream at the plaintext offset off to src.
+func (f *encryptedFile) xor(dst []byte, src []byte, off int64) {
+	iv := make([]byte, ivSize)
+	copy(iv, f.iv)
+	// add the block number to the IV treated as a 128 bit big endian counter
+	block := uint64(off / aes.BlockSize)
+	lo := binary.BigEndian.Uint64(iv[8:])
+	hi := binary.BigEndian.Uint64(iv[:8])
+	sum := lo + block
+	if sum < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(iv[:8], hi)
+	binary.BigEndian.PutUint64(iv[8:], sum)
+	stream := cipher.NewCTR(f.fs.block, iv)
+	if skip := int(off % aes.BlockSize); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	stream.XORKeyStream(dst, src)
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.xor(p[:n], p[:n], f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off+int64(encryptedHeaderSize))
+	f.xor(p[:n], p[:n], off)
+	return n, err
+}
+
+func (f *encryptedFile) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	f.xor(buf, p, f.offset)
+	n, err := f.File.Write(buf)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	buf := make([]byte, len(p))
+	f.xor(buf, p, off)
+	return f.File.WriteAt(buf, off+int64(encryptedHeaderSize))
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedFileInfo(fi), nil
+}
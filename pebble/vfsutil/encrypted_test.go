@@ -0,0 +1,100 @@
+package vfsutil
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEncryptedFS(t *testing.T, fs vfs.FS, key byte) *EncryptedFS {
+	efs, err := NewEncryptedFS(fs, bytes.Repeat([]byte{key}, 32))
+	require.NoError(t, err)
+	return efs
+}
+
+func TestEncryptedFSRoundTrip(t *testing.T) {
+	mem := vfs.NewMem()
+	fs := newTestEncryptedFS(t, mem, 1)
+	data := bytes.Repeat([]byte("plaintext"), 100)
+	for _, name := range []string{"a", "b"} {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data[:333])
+		require.NoError(t, err)
+		_, err = f.Write(data[333:])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	raw := make([][]byte, 0)
+	for _, name := range []string{"a", "b"} {
+		f, err := mem.Open(name)
+		require.NoError(t, err)
+		v, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.False(t, bytes.Contains(v, []byte("plaintext")))
+		raw = append(raw, v)
+	}
+	require.NotEqual(t, raw[0], raw[1])
+	f, err := fs.Open("a")
+	require.NoError(t, err)
+	v, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, data, v)
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 17)
+	require.NoError(t, err)
+	require.Equal(t, data[17:117], buf)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+	require.NoError(t, f.Close())
+	fi, err = fs.Stat("a")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+}
+
+func TestEncryptedFSWriteAtAndAppend(t *testing.T) {
+	fs := newTestEncryptedFS(t, vfs.NewMem(), 1)
+	f, err := fs.Create("file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("ab"), 3)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = fs.OpenForAppend("file")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("xyz"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = fs.Open("file")
+	require.NoError(t, err)
+	v, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, []byte("012ab56789xyz"), v)
+}
+
+func TestEncryptedFSRejectsInvalidKey(t *testing.T) {
+	mem := vfs.NewMem()
+	fs := newTestEncryptedFS(t, mem, 1)
+	f, err := fs.Create("file")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = newTestEncryptedFS(t, mem, 2).Open("file")
+	require.True(t, errors.Is(err, ErrInvalidKey))
+	f, err = mem.Create("plain")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("plain"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = fs.Open("plain")
+	require.True(t, errors.Is(err, ErrNotEncrypted))
+	_, err = NewEncryptedFS(mem, []byte("short"))
+	require.Error(t, err)
+}
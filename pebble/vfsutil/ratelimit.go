@@ -0,0 +1,156 @@
+package vfsutil
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/vfs"
+)
+
+// RateLimiter limits the rate of bytes written through the RateLimitedFS
+// instances sharing it. Up to one second worth of bytes can be written in a
+// burst after a period of inactivity. The rate can be changed at runtime.
+type RateLimiter struct {
+	rate  uint64
+	mu    sync.Mutex
+	avail float64
+	last  time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing the specified number of
+// bytes per second, writes are not limited when it is 0.
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	return &RateLimiter{
+		rate:  bytesPerSecond,
+		avail: float64(bytesPerSecond),
+		last:  time.Now(),
+	}
+}
+
+// Rate returns the number of bytes allowed per second, 0 means unlimited.
+func (l *RateLimiter) Rate() uint64 {
+	return atomic.LoadUint64(&l.rate)
+}
+
+// SetRate sets the number of bytes allowed per second, writes are no longer
+// limited when it is 0. Writes already waiting are not affected.
+func (l *RateLimiter) SetRate(bytesPerSecond uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	atomic.StoreUint64(&l.rate, bytesPerSecond)
+	if l.avail > float64(bytesPerSecond) {
+		l.avail = float64(bytesPerSecond)
+	}
+}
+
+// refill adds the bytes allowed since the last refill, it must be called
+// with mu held.
+func (l *RateLimiter) refill(now time.Time) {
+	rate := float64(atomic.LoadUint64(&l.rate))
+	l.avail += now.Sub(l.last).Seconds() * rate
+	if l.avail > rate {
+		l.avail = rate
+	}
+	l.last = now
+}
+
+// Wait blocks until writing n bytes is allowed.
+func (l *RateLimiter) Wait(n int) {
+	if n <= 0 || l.Rate() == 0 {
+		return
+	}
+	l.mu.Lock()
+	rate := atomic.LoadUint64(&l.rate)
+	if rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.avail -= float64(n)
+	var wait time.Duration
+	if l.avail < 0 {
+		wait = time.Duration(-l.avail / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// RateLimitedFS is a vfs.FS decorator limiting the rate of writes to the
+// selected files using a RateLimiter, writes to other files are passed
+// through, e.g. so background writes can be limited without delaying WAL
+// writes.
+type RateLimitedFS struct {
+	vfs.FS
+	limiter *RateLimiter
+	filter  func(name string) bool
+}
+
+var _ vfs.FS = (*RateLimitedFS)(nil)
+
+// NewRateLimitedFS creates a RateLimitedFS instance wrapping fs. Writes to
+// files for which filter returns true are limited by limiter, filter is
+// called with the name of the file on each write so files can be selected
+// after they were created. All writes are limited when filter is nil.
+func NewRateLimitedFS(fs vfs.FS,
+	limiter *RateLimiter, filter func(name string) bool) *RateLimitedFS {
+	return &RateLimitedFS{FS: fs, limiter: limiter, filter: filter}
+}
+
+// Unwrap returns the wrapped FS.
+func (r *RateLimitedFS) Unwrap() vfs.FS {
+	return r.FS
+}
+
+func (r *RateLimitedFS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitedFile{File: f, fs: r, name: name}, nil
+}
+
+// Create ...
+func (r *RateLimitedFS) Create(name string) (vfs.File, error) {
+	f, err := r.FS.Create(name)
+	return r.wrap(name, f, err)
+}
+
+// OpenForAppend ...
+func (r *RateLimitedFS) OpenForAppend(name string) (vfs.File, error) {
+	f, err := r.FS.OpenForAppend(name)
+	return r.wrap(name, f, err)
+}
+
+// ReuseForWrite ...
+func (r *RateLimitedFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := r.FS.ReuseForWrite(oldname, newname)
+	return r.wrap(newname, f, err)
+}
+
+func (r *RateLimitedFS) wait(name string, n int) {
+	if r.limiter.Rate() == 0 {
+		return
+	}
+	if r.filter == nil || r.filter(name) {
+		r.limiter.Wait(n)
+	}
+}
+
+type rateLimitedFile struct {
+	vfs.File
+	fs   *RateLimitedFS
+	name string
+}
+
+func (f *rateLimitedFile) Write(p []byte) (int, error) {
+	f.fs.wait(f.name, len(p))
+	return f.File.Write(p)
+}
+
+func (f *rateLimitedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.wait(f.name, len(p))
+	return f.File.WriteAt(p, off)
+}
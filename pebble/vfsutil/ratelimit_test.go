@@ -0,0 +1,51 @@
+package vfsutil
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterAllowsOneSecondBurst(t *testing.T) {
+	l := NewRateLimiter(1000)
+	start := time.Now()
+	l.Wait(1000)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	start = time.Now()
+	l.Wait(200)
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	l.SetRate(0)
+	start = time.Now()
+	l.Wait(1 << 30)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	require.Zero(t, l.Rate())
+}
+
+func TestRateLimitedFSOnlyLimitsSelectedFiles(t *testing.T) {
+	l := NewRateLimiter(1000)
+	fs := NewRateLimitedFS(vfs.NewMem(), l, func(name string) bool {
+		return strings.HasSuffix(name, ".sst")
+	})
+	wal, err := fs.Create("000001.log")
+	require.NoError(t, err)
+	defer wal.Close()
+	sst, err := fs.Create("000002.sst")
+	require.NoError(t, err)
+	defer sst.Close()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := wal.Write(make([]byte, 1000))
+		require.NoError(t, err)
+	}
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	start = time.Now()
+	_, err = sst.Write(make([]byte, 1200))
+	require.NoError(t, err)
+	_, err = sst.WriteAt(make([]byte, 100), 1200)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	require.Equal(t, vfs.FS(fs.FS), fs.Unwrap())
+}
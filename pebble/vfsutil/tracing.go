@@ -0,0 +1,243 @@
+package vfsutil
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coufalja/tugboat/logger"
+	"github.com/lni/vfs"
+)
+
+var plog = logger.GetLogger("vfs")
+
+// Trace describes a single slow file system operation.
+type Trace struct {
+	Op       string
+	Name     string
+	Bytes    int
+	Duration time.Duration
+	Err      error
+}
+
+// TraceFunc is called by TracingFS for each traced operation.
+type TraceFunc func(t Trace)
+
+func logTrace(t Trace) {
+	plog.Warningf("slow %s on %s, %d bytes, took %s, err: %v",
+		t.Op, t.Name, t.Bytes, t.Duration, t.Err)
+}
+
+// TracingFS is a vfs.FS decorator reporting each file system operation which
+// took longer than the configured threshold. Tracing can be enabled, disabled
+// or have its threshold changed at runtime.
+type TracingFS struct {
+	vfs.FS
+	f         TraceFunc
+	threshold int64
+	enabled   int32
+}
+
+var _ vfs.FS = (*TracingFS)(nil)
+
+// NewTracingFS creates an enabled TracingFS instance wrapping fs, reporting
+// operations slower than threshold to f. Slow operations are logged when f is
+// nil.
+func NewTracingFS(fs vfs.FS, threshold time.Duration, f TraceFunc) *TracingFS {
+	if f == nil {
+		f = logTrace
+	}
+	return &TracingFS{
+		FS:        fs,
+		f:         f,
+		threshold: int64(threshold),
+		enabled:   1,
+	}
+}
+
+// Enable enables tracing.
+func (t *TracingFS) Enable() {
+	atomic.StoreInt32(&t.enabled, 1)
+}
+
+// Disable disables tracing.
+func (t *TracingFS) Disable() {
+	atomic.StoreInt32(&t.enabled, 0)
+}
+
+// Enabled returns a boolean value indicating whether tracing is enabled.
+func (t *TracingFS) Enabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+// SetThreshold sets the duration above which operations are reported.
+func (t *TracingFS) SetThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&t.threshold, int64(threshold))
+}
+
+// Unwrap returns the wrapped FS.
+func (t *TracingFS) Unwrap() vfs.FS {
+	return t.FS
+}
+
+// start returns the start time of an operation, the zero time is returned
+// when tracing is disabled so no clock is read.
+func (t *TracingFS) start() time.Time {
+	if !t.Enabled() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (t *TracingFS) done(start time.Time, op string, name string, bytes int, err error) {
+	if start.IsZero() {
+		return
+	}
+	d := time.Since(start)
+	if int64(d) >= atomic.LoadInt64(&t.threshold) {
+		t.f(Trace{Op: op, Name: name, Bytes: bytes, Duration: d, Err: err})
+	}
+}
+
+func (t *TracingFS) wrap(name string, f vfs.File, err error) (vfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &tracingFile{File: f, fs: t, name: name}, nil
+}
+
+// Create ...
+func (t *TracingFS) Create(name string) (vfs.File, error) {
+	start := t.start()
+	f, err := t.FS.Create(name)
+	t.done(start, "create", name, 0, err)
+	return t.wrap(name, f, err)
+}
+
+// Link ...
+func (t *TracingFS) Link(oldname, newname string) error {
+	start := t.start()
+	err := t.FS.Link(oldname, newname)
+	t.done(start, "link", newname, 0, err)
+	return err
+}
+
+// Open ...
+func (t *TracingFS) Open(name string, opts ...vfs.OpenOption) (vfs.File, error) {
+	start := t.start()
+	f, err := t.FS.Open(name, opts...)
+	t.done(start, "open", name, 0, err)
+	return t.wrap(name, f, err)
+}
+
+// OpenDir ...
+func (t *TracingFS) OpenDir(name string) (vfs.File, error) {
+	start := t.start()
+	f, err := t.FS.OpenDir(name)
+	t.done(start, "opendir", name, 0, err)
+	return t.wrap(name, f, err)
+}
+
+// OpenForAppend ...
+func (t *TracingFS) OpenForAppend(name string) (vfs.File, error) {
+	start := t.start()
+	f, err := t.FS.OpenForAppend(name)
+	t.done(start, "open", name, 0, err)
+	return t.wrap(name, f, err)
+}
+
+// Remove ...
+func (t *TracingFS) Remove(name string) error {
+	start := t.start()
+	err := t.FS.Remove(name)
+	t.done(start, "remove", name, 0, err)
+	return err
+}
+
+// RemoveAll ...
+func (t *TracingFS) RemoveAll(name string) error {
+	start := t.start()
+	err := t.FS.RemoveAll(name)
+	t.done(start, "removeall", name, 0, err)
+	return err
+}
+
+// Rename ...
+func (t *TracingFS) Rename(oldname, newname string) error {
+	start := t.start()
+	err := t.FS.Rename(oldname, newname)
+	t.done(start, "rename", newname, 0, err)
+	return err
+}
+
+// ReuseForWrite ...
+func (t *TracingFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	start := t.start()
+	f, err := t.FS.ReuseForWrite(oldname, newname)
+	t.done(start, "reuse", newname, 0, err)
+	return t.wrap(newname, f, err)
+}
+
+// MkdirAll ...
+func (t *TracingFS) MkdirAll(dir string, perm os.FileMode) error {
+	start := t.start()
+	err := t.FS.MkdirAll(dir, perm)
+	t.done(start, "mkdir", dir, 0, err)
+	return err
+}
+
+// List ...
+func (t *TracingFS) List(dir string) ([]string, error) {
+	start := t.start()
+	names, err := t.FS.List(dir)
+	t.done(start, "list", dir, 0, err)
+	return names, err
+}
+
+type tracingFile struct {
+	vfs.File
+	fs   *TracingFS
+	name string
+}
+
+func (f *tracingFile) Read(p []byte) (int, error) {
+	start := f.fs.start()
+	n, err := f.File.Read(p)
+	f.fs.done(start, "read", f.name, n, err)
+	return n, err
+}
+
+func (f *tracingFile) ReadAt(p []byte, off int64) (int, error) {
+	start := f.fs.start()
+	n, err := f.File.ReadAt(p, off)
+	f.fs.done(start, "read", f.name, n, err)
+	return n, err
+}
+
+func (f *tracingFile) Write(p []byte) (int, error) {
+	start := f.fs.start()
+	n, err := f.File.Write(p)
+	f.fs.done(start, "write", f.name, n, err)
+	return n, err
+}
+
+func (f *tracingFile) WriteAt(p []byte, off int64) (int, error) {
+	start := f.fs.start()
+	n, err := f.File.WriteAt(p, off)
+	f.fs.done(start, "write", f.name, n, err)
+	return n, err
+}
+
+func (f *tracingFile) Sync() error {
+	start := f.fs.start()
+	err := f.File.Sync()
+	f.fs.done(start, "sync", f.name, 0, err)
+	return err
+}
+
+func (f *tracingFile) Close() error {
+	start := f.fs.start()
+	err := f.File.Close()
+	f.fs.done(start, "close", f.name, 0, err)
+	return err
+}
@@ -0,0 +1,52 @@
+package vfsutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracingFSReportsOperationsAboveThreshold(t *testing.T) {
+	var mu sync.Mutex
+	traces := make([]Trace, 0)
+	f := func(t Trace) {
+		mu.Lock()
+		defer mu.Unlock()
+		traces = append(traces, t)
+	}
+	fs := NewTracingFS(vfs.NewMem(), 0, f)
+	file, err := fs.Create("000001.log")
+	require.NoError(t, err)
+	_, err = file.Write(make([]byte, 16))
+	require.NoError(t, err)
+	require.NoError(t, file.Sync())
+	require.NoError(t, file.Close())
+	ops := make([]string, 0)
+	for _, tr := range traces {
+		require.Equal(t, "000001.log", tr.Name)
+		ops = append(ops, tr.Op)
+	}
+	require.Equal(t, []string{"create", "write", "sync", "close"}, ops)
+	require.Equal(t, 16, traces[1].Bytes)
+
+	traces = traces[:0]
+	fs.SetThreshold(time.Hour)
+	_, err = fs.Create("000002.log")
+	require.NoError(t, err)
+	require.Empty(t, traces)
+
+	fs.SetThreshold(0)
+	fs.Disable()
+	require.False(t, fs.Enabled())
+	_, err = fs.Create("000003.log")
+	require.NoError(t, err)
+	require.Empty(t, traces)
+	fs.Enable()
+	_, err = fs.Open("000003.log")
+	require.NoError(t, err)
+	require.Len(t, traces, 1)
+	require.Equal(t, "open", traces[0].Op)
+}
@@ -0,0 +1,197 @@
+package pebble
+
+import (
+	"sync"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrSubscriptionClosed is returned by Subscription.Next once the
+	// subscription or the LogDB is closed.
+	ErrSubscriptionClosed = errors.New("subscription closed")
+	// ErrEntriesUnavailable indicates that committed entries expected by a
+	// subscription have been removed from the LogDB before being delivered.
+	ErrEntriesUnavailable = errors.New("entries unavailable")
+)
+
+// Subscription delivers committed entries of a single node in index order, it
+// is created by the ShardedDB.Subscribe method. A Subscription is not
+// expected to be used from multiple goroutines concurrently.
+type Subscription struct {
+	db        *ShardedDB
+	ni        raftio.NodeInfo
+	next      uint64
+	mu        sync.Mutex
+	committed uint64
+	closed    bool
+	notifyC   chan struct{}
+}
+
+// Subscribe returns a Subscription delivering committed entries of the
+// specified node starting from the entry with index from. Entries already
+// committed are delivered first, newly committed entries are delivered once
+// saved.
+func (s *ShardedDB) Subscribe(clusterID uint64,
+	nodeID uint64, from uint64) (*Subscription, error) {
+	if from == 0 {
+		from = 1
+	}
+	sub := &Subscription{
+		db:      s,
+		ni:      raftio.GetNodeInfo(clusterID, nodeID),
+		next:    from,
+		notifyC: make(chan struct{}, 1),
+	}
+	// registered before reading the state so no commit can be missed
+	s.watches.add(sub)
+	rs, err := s.ReadRaftState(clusterID, nodeID, 0)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		s.watches.remove(sub)
+		return nil, err
+	}
+	sub.commit(rs.State.Commit)
+	return sub, nil
+}
+
+// Next returns the next batch of committed entries with a total size of up to
+// maxSize bytes, at least one entry is returned when available. It blocks
+// until at least one entry is committed, the stopc channel is closed or the
+// subscription is closed. Nil entries and nil error are returned when stopc
+// is closed.
+func (sub *Subscription) Next(stopc <-chan struct{},
+	maxSize uint64) ([]pb.Entry, error) {
+	for {
+		sub.mu.Lock()
+		committed, closed := sub.committed, sub.closed
+		sub.mu.Unlock()
+		if closed {
+			return nil, ErrSubscriptionClosed
+		}
+		if sub.next <= committed {
+			ents, _, err := sub.db.IterateEntries(nil, 0,
+				sub.ni.ClusterID, sub.ni.NodeID, sub.next, committed+1, maxSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(ents) == 0 || ents[0].Index != sub.next {
+				return nil, errors.Wrapf(ErrEntriesUnavailable,
+					"%s index %d", dn(sub.ni.ClusterID, sub.ni.NodeID), sub.next)
+			}
+			sub.next = ents[len(ents)-1].Index + 1
+			return ents, nil
+		}
+		select {
+		case <-sub.notifyC:
+		case <-stopc:
+			return nil, nil
+		}
+	}
+}
+
+// NextIndex returns the index of the next entry to be delivered.
+func (sub *Subscription) NextIndex() uint64 {
+	return sub.next
+}
+
+// Close closes the subscription.
+func (sub *Subscription) Close() {
+	sub.db.watches.remove(sub)
+	sub.close()
+}
+
+func (sub *Subscription) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	sub.notify()
+}
+
+func (sub *Subscription) commit(index uint64) {
+	sub.mu.Lock()
+	if index <= sub.committed {
+		sub.mu.Unlock()
+		return
+	}
+	sub.committed = index
+	sub.mu.Unlock()
+	sub.notify()
+}
+
+func (sub *Subscription) notify() {
+	select {
+	case sub.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+// watches is the registry of subscriptions of a ShardedDB.
+type watches struct {
+	mu   sync.Mutex
+	subs map[raftio.NodeInfo]map[*Subscription]struct{}
+}
+
+func newWatches() *watches {
+	return &watches{subs: make(map[raftio.NodeInfo]map[*Subscription]struct{})}
+}
+
+func (w *watches) add(sub *Subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	subs, ok := w.subs[sub.ni]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		w.subs[sub.ni] = subs
+	}
+	subs[sub] = struct{}{}
+}
+
+func (w *watches) remove(sub *Subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if subs, ok := w.subs[sub.ni]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(w.subs, sub.ni)
+		}
+	}
+}
+
+// committed notifies subscriptions of the nodes updated by the saved updates.
+func (w *watches) committed(updates []pb.Update) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.subs) == 0 {
+		return
+	}
+	for _, ud := range updates {
+		if pb.IsEmptyState(ud.State) {
+			continue
+		}
+		for sub := range w.subs[raftio.GetNodeInfo(ud.ClusterID, ud.NodeID)] {
+			sub.commit(ud.State.Commit)
+		}
+	}
+}
+
+// imported notifies subscriptions of the node the snapshot was imported to.
+func (w *watches) imported(ss pb.Snapshot, nodeID uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for sub := range w.subs[raftio.GetNodeInfo(ss.ClusterId, nodeID)] {
+		sub.commit(ss.Index)
+	}
+}
+
+func (w *watches) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, subs := range w.subs {
+		for sub := range subs {
+			sub.close()
+		}
+	}
+	w.subs = make(map[raftio.NodeInfo]map[*Subscription]struct{})
+}
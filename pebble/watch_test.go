@@ -0,0 +1,106 @@
+package pebble
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func saveWatchTestEntries(t *testing.T,
+	db *ShardedDB, first uint64, last uint64, commit uint64) {
+	ud := pb.Update{
+		ClusterID: 1,
+		NodeID:    2,
+		State:     pb.State{Term: 1, Vote: 2, Commit: commit},
+	}
+	for i := first; i <= last; i++ {
+		ud.EntriesToSave = append(ud.EntriesToSave, pb.Entry{Index: i, Term: 1})
+	}
+	require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+}
+
+func TestSubscriptionBackfillsAndTailsCommittedEntries(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveWatchTestEntries(t, sdb, 1, 10, 8)
+		sub, err := sdb.Subscribe(1, 2, 5)
+		require.NoError(t, err)
+		defer sub.Close()
+		ents, err := sub.Next(nil, ^uint64(0))
+		require.NoError(t, err)
+		require.Len(t, ents, 4)
+		require.Equal(t, uint64(5), ents[0].Index)
+		require.Equal(t, uint64(9), sub.NextIndex())
+		// nothing committed yet
+		stopc := make(chan struct{})
+		close(stopc)
+		ents, err = sub.Next(stopc, ^uint64(0))
+		require.NoError(t, err)
+		require.Nil(t, ents)
+		done := make(chan []pb.Entry)
+		go func() {
+			ents, err := sub.Next(nil, ^uint64(0))
+			if err != nil {
+				panic(err)
+			}
+			done <- ents
+		}()
+		time.Sleep(10 * time.Millisecond)
+		saveWatchTestEntries(t, sdb, 11, 12, 12)
+		select {
+		case ents := <-done:
+			require.Len(t, ents, 4)
+			require.Equal(t, uint64(9), ents[0].Index)
+			require.Equal(t, uint64(12), ents[3].Index)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("committed entries not delivered")
+		}
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestSubscriptionReportsRemovedEntries(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb := db.(*ShardedDB)
+		saveWatchTestEntries(t, sdb, 1, 10, 10)
+		require.NoError(t, db.RemoveEntriesTo(1, 2, 6))
+		sub, err := sdb.Subscribe(1, 2, 0)
+		require.NoError(t, err)
+		defer sub.Close()
+		_, err = sub.Next(nil, ^uint64(0))
+		require.True(t, errors.Is(err, ErrEntriesUnavailable))
+	}
+	runLogDBTest(t, tf, vfs.NewMem())
+}
+
+func TestSubscriptionIsClosedWithLogDB(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewMem()
+	defer deleteTestDB(fs)
+	sdb := getNewTestDB("db-dir", "wal-db-dir", fs).(*ShardedDB)
+	sub, err := sdb.Subscribe(1, 2, 1)
+	require.NoError(t, err)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sub.Next(nil, ^uint64(0))
+		errc <- err
+	}()
+	sub.Close()
+	select {
+	case err := <-errc:
+		require.Equal(t, ErrSubscriptionClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("subscription not closed")
+	}
+	sub, err = sdb.Subscribe(1, 2, 1)
+	require.NoError(t, err)
+	require.NoError(t, sdb.Close())
+	_, err = sub.Next(nil, ^uint64(0))
+	require.Equal(t, ErrSubscriptionClosed, err)
+}
@@ -0,0 +1,362 @@
+package replication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+const (
+	nonceSize = 32
+	// maxBatchSize is the max total size of entries sent in a single
+	// message regardless of the size requested, it keeps encoded messages
+	// below maxMessageSize.
+	maxBatchSize = 16 * 1024 * 1024
+	// maxPeerDigests is the max number of range digests computed for a
+	// single request.
+	maxPeerDigests = 64 * 1024
+)
+
+var (
+	// ErrAuthenticationFailed indicates that the client of a PeerServer or of
+	// a Receiver did not prove the knowledge of the shared secret.
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	// ErrNodeExists indicates that the node to be rebuilt still has data in
+	// the local LogDB.
+	ErrNodeExists = errors.New("node data exists")
+)
+
+// PeerServer serves entries and snapshot metadata of the local LogDB to peers
+// so the log of a destroyed replica can be rebuilt using RebuildFromPeer
+// without going through the full raft snapshot path. Clients are
+// authenticated using a challenge response based on a shared secret, the
+// secret itself is never sent. The served data is not encrypted, connections
+// should be protected using TLS unless the network is trusted.
+type PeerServer struct {
+	db     *pebble.ShardedDB
+	secret []byte
+	server *server
+	arena  bool
+}
+
+// NewPeerServer returns a PeerServer serving data of db to clients knowing
+// the specified secret.
+func NewPeerServer(db *pebble.ShardedDB, secret []byte) (*PeerServer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty peer secret")
+	}
+	p := &PeerServer{db: db, secret: append([]byte(nil), secret...)}
+	p.server = newServer("peer", p.handle)
+	return p, nil
+}
+
+// UseEntryArena makes the PeerServer decode served entries into a pooled
+// pebble.EntryArena owned by each connection, the arena is released at once
+// after each response is sent rather than leaving decoded entries to the GC.
+// It must be called before Serve.
+func (p *PeerServer) UseEntryArena() {
+	p.arena = true
+}
+
+// Serve accepts connections from peers until the listener is closed or the
+// PeerServer is closed.
+func (p *PeerServer) Serve(l net.Listener) error {
+	return p.server.serve(l)
+}
+
+// Close stops accepting connections, closes all connections and waits for
+// all sessions to end. It must be called before the LogDB is closed.
+func (p *PeerServer) Close() error {
+	return p.server.close()
+}
+
+func authCode(secret []byte, nonce []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+func (p *PeerServer) handle(c *conn) error {
+	if err := challenge(c, p.secret); err != nil {
+		return err
+	}
+	var arena *pebble.EntryArena
+	if p.arena {
+		arena = pebble.AcquireEntryArena()
+		defer arena.Free()
+	}
+	for {
+		m, err := c.receive()
+		if err != nil {
+			return err
+		}
+		var resp message
+		switch m.Type {
+		case fetchNodeMessage:
+			resp, err = p.getNode(m.ClusterID, m.NodeID)
+		case fetchEntriesMessage:
+			resp, err = p.getEntries(m, arena)
+		case fetchDigestsMessage:
+			resp, err = p.getDigests(m)
+		default:
+			err = errors.Errorf("unexpected message type %d", m.Type)
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.send(resp); err != nil {
+			return err
+		}
+		if arena != nil {
+			arena.Release()
+		}
+	}
+}
+
+func (p *PeerServer) getNode(clusterID uint64, nodeID uint64) (message, error) {
+	resp := message{Type: nodeMessage, ClusterID: clusterID, NodeID: nodeID}
+	bs, err := p.db.GetBootstrapInfo(clusterID, nodeID)
+	if err == nil {
+		resp.Bootstrap = &bs
+	} else if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return message{}, err
+	}
+	ss, err := p.db.GetSnapshot(clusterID, nodeID)
+	if err != nil {
+		return message{}, err
+	}
+	if !pb.IsEmptySnapshot(ss) {
+		resp.Snapshot = &ss
+	}
+	rs, err := p.db.ReadRaftState(clusterID, nodeID, ss.Index)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		if resp.Bootstrap == nil {
+			return message{}, errors.Errorf("%d:%d not found", clusterID, nodeID)
+		}
+		return resp, nil
+	} else if err != nil {
+		return message{}, err
+	}
+	resp.State = rs.State
+	resp.Index = rs.FirstIndex
+	resp.High = rs.FirstIndex + rs.EntryCount
+	return resp, nil
+}
+
+func (p *PeerServer) getEntries(m message,
+	arena *pebble.EntryArena) (message, error) {
+	maxSize := m.MaxSize
+	if maxSize == 0 || maxSize > maxBatchSize {
+		maxSize = maxBatchSize
+	}
+	var ents []pb.Entry
+	var err error
+	if arena != nil {
+		ents, _, err = p.db.IterateEntriesWithArena(arena, 0,
+			m.ClusterID, m.NodeID, m.Index, m.High, maxSize)
+	} else {
+		ents, _, err = p.db.IterateEntries(nil, 0,
+			m.ClusterID, m.NodeID, m.Index, m.High, maxSize)
+	}
+	if err != nil {
+		return message{}, err
+	}
+	return message{Type: entriesMessage,
+		ClusterID: m.ClusterID, NodeID: m.NodeID, Entries: ents}, nil
+}
+
+func (p *PeerServer) getDigests(m message) (message, error) {
+	if m.High > m.Index && m.Step > 0 && (m.High-m.Index)/m.Step > maxPeerDigests {
+		return message{}, errors.Errorf("too many digests requested, step %d", m.Step)
+	}
+	digests, err := p.db.GetRangeDigests(m.ClusterID, m.NodeID, m.Index, m.High, m.Step)
+	if err != nil {
+		return message{}, err
+	}
+	return message{Type: digestsMessage,
+		ClusterID: m.ClusterID, NodeID: m.NodeID, Digests: digests}, nil
+}
+
+// RebuildReport describes the data of a node rebuilt from a peer.
+type RebuildReport struct {
+	Bootstrap     bool
+	SnapshotIndex uint64
+	FirstIndex    uint64
+	LastIndex     uint64
+	Entries       uint64
+}
+
+// RebuildFromPeer rebuilds the log of the specified node in db using the data
+// served by the PeerServer reached over nc, the connection is not closed. The
+// bootstrap record, the snapshot record, the raft state and all entries are
+// copied, snapshot files are not. The node must not have any data in db, use
+// ShardedDB.RemoveNodeData to remove the data of a damaged replica first.
+func RebuildFromPeer(db *pebble.ShardedDB, nc net.Conn,
+	secret []byte, clusterID uint64, nodeID uint64,
+	maxBatchSize uint64) (RebuildReport, error) {
+	if err := checkNoNodeData(db, clusterID, nodeID); err != nil {
+		return RebuildReport{}, err
+	}
+	c := newConn(nc)
+	if err := authenticate(c, secret); err != nil {
+		return RebuildReport{}, err
+	}
+	if err := c.send(message{Type: fetchNodeMessage,
+		ClusterID: clusterID, NodeID: nodeID}); err != nil {
+		return RebuildReport{}, err
+	}
+	node, err := c.receive()
+	if err != nil {
+		return RebuildReport{}, err
+	}
+	if node.Type != nodeMessage {
+		return RebuildReport{}, errors.Errorf("unexpected message type %d", node.Type)
+	}
+	report := RebuildReport{FirstIndex: node.Index}
+	if node.Bootstrap != nil {
+		if err := db.SaveBootstrapInfo(clusterID, nodeID, *node.Bootstrap); err != nil {
+			return RebuildReport{}, err
+		}
+		report.Bootstrap = true
+	}
+	ctx := db.GetLogDBThreadContext()
+	defer ctx.Destroy()
+	if node.Snapshot != nil {
+		report.SnapshotIndex = node.Snapshot.Index
+		ud := pb.Update{
+			ClusterID: clusterID,
+			NodeID:    nodeID,
+			Snapshot:  *node.Snapshot,
+			State:     capCommit(node.State, node.Snapshot.Index),
+		}
+		if err := db.SaveRaftStateCtx([]pb.Update{ud}, ctx); err != nil {
+			return RebuildReport{}, err
+		}
+	}
+	for next := node.Index; next < node.High; {
+		if err := c.send(message{Type: fetchEntriesMessage, ClusterID: clusterID,
+			NodeID: nodeID, Index: next, High: node.High, MaxSize: maxBatchSize}); err != nil {
+			return RebuildReport{}, err
+		}
+		m, err := c.receive()
+		if err != nil {
+			return RebuildReport{}, err
+		}
+		if m.Type != entriesMessage {
+			return RebuildReport{}, errors.Errorf("unexpected message type %d", m.Type)
+		}
+		if len(m.Entries) == 0 || m.Entries[0].Index != next {
+			return RebuildReport{}, errors.Wrapf(pebble.ErrEntriesUnavailable,
+				"%d:%d index %d on peer", clusterID, nodeID, next)
+		}
+		next = m.Entries[len(m.Entries)-1].Index + 1
+		ud := pb.Update{
+			ClusterID:     clusterID,
+			NodeID:        nodeID,
+			State:         capCommit(node.State, next-1),
+			EntriesToSave: m.Entries,
+		}
+		ctx.Reset()
+		if err := db.SaveRaftStateCtx([]pb.Update{ud}, ctx); err != nil {
+			return RebuildReport{}, err
+		}
+		report.Entries += uint64(len(m.Entries))
+		report.LastIndex = next - 1
+	}
+	return report, nil
+}
+
+// GetPeerRangeDigests returns range digests of the specified node computed by
+// the PeerServer reached over nc, see ShardedDB.GetRangeDigests for details.
+// The connection is not closed.
+func GetPeerRangeDigests(nc net.Conn, secret []byte,
+	clusterID uint64, nodeID uint64, low uint64, high uint64,
+	step uint64) ([]pebble.RangeDigest, error) {
+	c := newConn(nc)
+	if err := authenticate(c, secret); err != nil {
+		return nil, err
+	}
+	if err := c.send(message{Type: fetchDigestsMessage, ClusterID: clusterID,
+		NodeID: nodeID, Index: low, High: high, Step: step}); err != nil {
+		return nil, err
+	}
+	m, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != digestsMessage {
+		return nil, errors.Errorf("unexpected message type %d", m.Type)
+	}
+	return m.Digests, nil
+}
+
+// authenticate answers the challenge sent by the PeerServer or the Receiver.
+func authenticate(c *conn, secret []byte) error {
+	m, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if m.Type != challengeMessage {
+		return errors.Errorf("unexpected message type %d", m.Type)
+	}
+	return c.send(message{Type: authMessage, Nonce: authCode(secret, m.Nonce)})
+}
+
+// challenge authenticates the remote side of c using a challenge response
+// based on the secret. Only small messages are accepted and the handshake
+// must complete within handshakeTimeout.
+func challenge(c *conn, secret []byte) error {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := c.c.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return errors.WithStack(err)
+	}
+	c.limit = maxHandshakeMessageSize
+	if err := c.send(message{Type: challengeMessage, Nonce: nonce}); err != nil {
+		return err
+	}
+	m, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if m.Type != authMessage || !hmac.Equal(m.Nonce, authCode(secret, nonce)) {
+		plog.Warningf("%s failed to authenticate", c.c.RemoteAddr())
+		return ErrAuthenticationFailed
+	}
+	c.limit = maxMessageSize
+	return errors.WithStack(c.c.SetDeadline(time.Time{}))
+}
+
+func checkNoNodeData(db *pebble.ShardedDB, clusterID uint64, nodeID uint64) error {
+	_, err := db.GetBootstrapInfo(clusterID, nodeID)
+	if err == nil {
+		return errors.Wrapf(ErrNodeExists, "%d:%d bootstrap record", clusterID, nodeID)
+	} else if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return err
+	}
+	_, err = db.ReadRaftState(clusterID, nodeID, 0)
+	if err == nil {
+		return errors.Wrapf(ErrNodeExists, "%d:%d raft state", clusterID, nodeID)
+	} else if !errors.Is(err, raftio.ErrNoSavedLog) {
+		return err
+	}
+	return nil
+}
+
+// capCommit returns the state with the commit index limited to the last
+// index saved locally.
+func capCommit(st pb.State, index uint64) pb.State {
+	if st.Commit > index {
+		st.Commit = index
+	}
+	return st
+}
@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeCanBeRebuiltFromPeer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	healthy := openTestDB(t)
+	defer func() {
+		require.NoError(t, healthy.Close())
+	}()
+	rebuilt := openTestDB(t)
+	defer func() {
+		require.NoError(t, rebuilt.Close())
+	}()
+	require.NoError(t, healthy.SaveBootstrapInfo(1, 1, pb.Bootstrap{Join: true}))
+	saveTestEntries(t, healthy, 1, 100, 1, pb.Snapshot{Index: 50, Term: 1})
+	require.NoError(t, healthy.RemoveEntriesTo(1, 1, 40))
+	_, err := NewPeerServer(healthy, nil)
+	require.Error(t, err)
+	p, err := NewPeerServer(healthy, []byte("secret"))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		require.NoError(t, p.Serve(l))
+	}()
+	defer func() {
+		require.NoError(t, p.Close())
+		<-donec
+	}()
+	rebuild := func(secret string) (RebuildReport, error) {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, nc.Close())
+		}()
+		return RebuildFromPeer(rebuilt, nc, []byte(secret), 1, 1, 256)
+	}
+
+	_, err = rebuild("wrong")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ErrAuthenticationFailed.Error())
+	report, err := rebuild("secret")
+	require.NoError(t, err)
+	require.True(t, report.Bootstrap)
+	require.Equal(t, uint64(50), report.SnapshotIndex)
+	require.Equal(t, uint64(100), report.LastIndex)
+	require.Equal(t, report.LastIndex-report.FirstIndex+1, report.Entries)
+	expected, _, err := healthy.IterateEntries(nil, 0, 1, 1, report.FirstIndex, 101, 0)
+	require.NoError(t, err)
+	ents, _, err := rebuilt.IterateEntries(nil, 0, 1, 1, report.FirstIndex, 101, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, ents)
+	rs, err := rebuilt.ReadRaftState(1, 1, 50)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), rs.State.Commit)
+	vr, err := rebuilt.Verify()
+	require.NoError(t, err)
+	require.Empty(t, vr.Violations)
+	_, err = rebuild("secret")
+	require.True(t, errors.Is(err, ErrNodeExists))
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, nc.Close())
+	}()
+	digests, err := GetPeerRangeDigests(nc, []byte("secret"), 1, 1, 50, 101, 10)
+	require.NoError(t, err)
+	local, err := rebuilt.GetRangeDigests(1, 1, 50, 101, 10)
+	require.NoError(t, err)
+	require.Len(t, digests, 6)
+	_, diverged := pebble.FirstDivergence(digests, local)
+	require.False(t, diverged)
+}
+
+func TestNodeCanBeRebuiltFromPeerUsingEntryArena(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	healthy := openTestDB(t)
+	defer func() {
+		require.NoError(t, healthy.Close())
+	}()
+	rebuilt := openTestDB(t)
+	defer func() {
+		require.NoError(t, rebuilt.Close())
+	}()
+	saveTestEntries(t, healthy, 1, 100, 1, pb.Snapshot{})
+	p, err := NewPeerServer(healthy, []byte("secret"))
+	require.NoError(t, err)
+	p.UseEntryArena()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		require.NoError(t, p.Serve(l))
+	}()
+	defer func() {
+		require.NoError(t, p.Close())
+		<-donec
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, nc.Close())
+	}()
+	report, err := RebuildFromPeer(rebuilt, nc, []byte("secret"), 1, 1, 256)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), report.Entries)
+	expected, _, err := healthy.IterateEntries(nil, 0, 1, 1, 1, 101, math.MaxUint64)
+	require.NoError(t, err)
+	require.Len(t, expected, 100)
+	ents, _, err := rebuilt.IterateEntries(nil, 0, 1, 1, 1, 101, math.MaxUint64)
+	require.NoError(t, err)
+	require.Equal(t, expected, ents)
+}
+
+func TestOversizedMessagesAreRejectedBeforeAuthentication(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	db := openTestDB(t)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	p, err := NewPeerServer(db, []byte("secret"))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		require.NoError(t, p.Serve(l))
+	}()
+	defer func() {
+		require.NoError(t, p.Close())
+		<-donec
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, nc.Close())
+	}()
+	c := newConn(nc)
+	m, err := c.receive()
+	require.NoError(t, err)
+	require.Equal(t, challengeMessage, m.Type)
+	// only the size of the message is sent, it is rejected without reading
+	// the rest of the message
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, maxHandshakeMessageSize+1)
+	_, err = nc.Write(header)
+	require.NoError(t, err)
+	_, err = c.receive()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds limit")
+}
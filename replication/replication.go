@@ -0,0 +1,710 @@
+/*
+Package replication asynchronously replicates nodes of a primary LogDB to a
+remote LogDB, e.g. in a disaster recovery site which can not participate in the
+raft quorum because of the latency.
+
+An Agent running next to the primary tails committed entries of each
+replicated node using the ShardedDB.Subscribe API and sends them in batches to
+a Receiver running next to the remote LogDB. The Agent and the Receiver talk
+over plain stream connections provided by the user, e.g. TCP or TLS
+connections, rather than gRPC, which keeps the package free of RPC framework
+and code generation dependencies. Agents are authenticated by the Receiver
+using a challenge response based on a shared secret, as done by the
+PeerServer. Once the session is set up using length prefixed JSON messages,
+the Agent sends batches as a replication stream, see pebble.StreamFrame, each
+frame holds a batch encoded by pebble.EncodeUpdateBatch. Entries larger than
+64MB can not be replicated.
+
+Each session starts with the Receiver sending a resume token, the index and
+term of the last entry held by the remote LogDB. The Agent checks that the
+token matches its own log and continues from the following entry, so no
+position needs to be persisted on either side. Flow control limits the number
+of batches sent but not yet acknowledged by the Receiver. Once the entries to
+be replicated have been compacted on the primary, the snapshot record is
+replicated instead and replication continues after the snapshot. Snapshot files
+are not replicated.
+*/
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	"github.com/coufalja/tugboat/logger"
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+var plog = logger.GetLogger("replication")
+
+var (
+	// ErrDiverged indicates that the remote LogDB holds entries not found in
+	// the primary LogDB, the node is no longer replicated.
+	ErrDiverged = errors.New("replica diverged from primary")
+	// ErrEntryTooLarge indicates that an entry is too large to be sent in a
+	// single frame, the node is no longer replicated.
+	ErrEntryTooLarge = errors.New("entry too large to be replicated")
+)
+
+type messageType uint8
+
+const (
+	helloMessage messageType = iota + 1
+	resumeMessage
+	ackMessage
+	errorMessage
+	challengeMessage
+	authMessage
+	fetchNodeMessage
+	nodeMessage
+	fetchEntriesMessage
+	entriesMessage
+	fetchDigestsMessage
+	digestsMessage
+)
+
+// message is the unit of the replication protocol, messages are JSON encoded
+// and framed by their size, see conn.
+type message struct {
+	Type      messageType
+	ClusterID uint64
+	NodeID    uint64
+	// Index and Term are the resume token in resume messages and the last
+	// replicated index in ack messages. Index and High are the range of
+	// entries in node and fetch entries messages.
+	Index     uint64        `json:",omitempty"`
+	Term      uint64        `json:",omitempty"`
+	High      uint64        `json:",omitempty"`
+	MaxSize   uint64        `json:",omitempty"`
+	Step      uint64        `json:",omitempty"`
+	Nonce     []byte        `json:",omitempty"`
+	Bootstrap *pb.Bootstrap `json:",omitempty"`
+	Snapshot  *pb.Snapshot  `json:",omitempty"`
+	State     pb.State
+	Entries   []pb.Entry           `json:",omitempty"`
+	Digests   []pebble.RangeDigest `json:",omitempty"`
+	Error     string               `json:",omitempty"`
+}
+
+const (
+	// maxMessageSize is the max size of an encoded message, larger messages
+	// are rejected before being read so a remote side can not exhaust the
+	// memory by sending a single huge message.
+	maxMessageSize = 64 * 1024 * 1024
+	// maxHandshakeMessageSize is the max size of an encoded message accepted
+	// before the remote side is authenticated.
+	maxHandshakeMessageSize = 4 * 1024
+	// handshakeTimeout is the max time allowed for the remote side to
+	// complete the handshake.
+	handshakeTimeout = 10 * time.Second
+	// maxFrameSize is the max size of the payload of accepted frames, it
+	// covers the batch and the fixed part of the payload.
+	maxFrameSize = maxMessageSize + 1024
+)
+
+// maxFrameBatchSize is the max size of the batch carried by a single frame of
+// the replication stream.
+var maxFrameBatchSize = maxMessageSize
+
+// conn sends and receives messages over a stream connection. Each message is
+// framed by its size encoded as a 4 byte big endian integer followed by the
+// JSON encoded message.
+type conn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	limit uint32
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{
+		c:     c,
+		r:     bufio.NewReader(c),
+		limit: maxMessageSize,
+	}
+}
+
+func (c *conn) send(m message) error {
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(data) > maxMessageSize {
+		return errors.Errorf("message size %d exceeds limit %d", len(data), maxMessageSize)
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = c.c.Write(buf)
+	return errors.WithStack(err)
+}
+
+func (c *conn) receive() (message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return message{}, errors.WithStack(err)
+	}
+	sz := binary.BigEndian.Uint32(header[:])
+	if sz > c.limit {
+		return message{}, errors.Errorf("message size %d exceeds limit %d", sz, c.limit)
+	}
+	data := make([]byte, sz)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return message{}, errors.WithStack(err)
+	}
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return message{}, errors.WithStack(err)
+	}
+	if m.Type == errorMessage {
+		return message{}, errors.Errorf("remote error: %s", m.Error)
+	}
+	return m, nil
+}
+
+// Options are the options of an Agent.
+type Options struct {
+	// MaxBatchSize is the max total size in bytes of entries sent in a single
+	// batch, at least one entry is always sent. It is limited to 16MB.
+	// Entries too large to be sent in a single frame stop the replication of
+	// the node with ErrEntryTooLarge.
+	MaxBatchSize uint64
+	// Window is the max number of batches sent but not yet acknowledged.
+	Window int
+	// RetryInterval is the interval between reconnection attempts.
+	RetryInterval time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.MaxBatchSize == 0 {
+		o.MaxBatchSize = 4 * 1024 * 1024
+	} else if o.MaxBatchSize > maxBatchSize {
+		o.MaxBatchSize = maxBatchSize
+	}
+	if o.Window <= 0 {
+		o.Window = 8
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = time.Second
+	}
+}
+
+// NodeStats contains the replication statistics of a node.
+type NodeStats struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Sent is the index of the last entry sent to the Receiver.
+	Sent uint64
+	// Acked is the index of the last entry acknowledged by the Receiver.
+	Acked     uint64
+	Batches   uint64
+	Snapshots uint64
+	Sessions  uint64
+	// Error is the error which ended the last session.
+	Error string `json:",omitempty"`
+}
+
+type node struct {
+	mu    sync.Mutex
+	stats NodeStats
+}
+
+func (n *node) update(f func(st *NodeStats)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f(&n.stats)
+}
+
+// Agent replicates nodes of the primary LogDB to a Receiver.
+type Agent struct {
+	db     *pebble.ShardedDB
+	dial   func() (net.Conn, error)
+	secret []byte
+	opts   Options
+	stopc  chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	nodes  map[raftio.NodeInfo]*node
+}
+
+// NewAgent returns an Agent replicating nodes of db to the Receiver reached
+// by the dial function, the Agent authenticates using the specified secret
+// shared with the Receiver.
+func NewAgent(db *pebble.ShardedDB,
+	dial func() (net.Conn, error), secret []byte, opts Options) *Agent {
+	opts.setDefaults()
+	return &Agent{
+		db:     db,
+		dial:   dial,
+		secret: append([]byte(nil), secret...),
+		opts:   opts,
+		stopc:  make(chan struct{}),
+		nodes:  make(map[raftio.NodeInfo]*node),
+	}
+}
+
+// Replicate starts replicating the specified node, a dedicated connection is
+// used for each node.
+func (a *Agent) Replicate(clusterID uint64, nodeID uint64) error {
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.nodes[ni]; ok {
+		return errors.Errorf("node %v already replicated", ni)
+	}
+	n := &node{stats: NodeStats{ClusterID: clusterID, NodeID: nodeID}}
+	a.nodes[ni] = n
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.replicate(ni, n)
+	}()
+	return nil
+}
+
+// Stats returns the replication statistics of all replicated nodes.
+func (a *Agent) Stats() []NodeStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]NodeStats, 0, len(a.nodes))
+	for _, n := range a.nodes {
+		n.mu.Lock()
+		result = append(result, n.stats)
+		n.mu.Unlock()
+	}
+	return result
+}
+
+// Close stops replicating all nodes. It must be called before the primary
+// LogDB is closed.
+func (a *Agent) Close() {
+	close(a.stopc)
+	a.wg.Wait()
+}
+
+func (a *Agent) stopped() bool {
+	select {
+	case <-a.stopc:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *Agent) replicate(ni raftio.NodeInfo, n *node) {
+	for {
+		err := a.session(ni, n)
+		if a.stopped() {
+			return
+		}
+		if err != nil {
+			plog.Warningf("replication of %v interrupted, %v", ni, err)
+			n.update(func(st *NodeStats) { st.Error = err.Error() })
+			if errors.Is(err, ErrDiverged) || errors.Is(err, ErrEntryTooLarge) {
+				return
+			}
+		}
+		select {
+		case <-a.stopc:
+			return
+		case <-time.After(a.opts.RetryInterval):
+		}
+	}
+}
+
+// session replicates the node over a single connection until the connection
+// fails or the agent is closed.
+func (a *Agent) session(ni raftio.NodeInfo, n *node) error {
+	nc, err := a.dial()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c := newConn(nc)
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			if err := nc.Close(); err != nil {
+				plog.Debugf("failed to close connection, %v", err)
+			}
+		})
+	}
+	defer closeConn()
+	// closing the connection unblocks the session once the agent is closed
+	sessionc := make(chan struct{})
+	defer close(sessionc)
+	go func() {
+		select {
+		case <-a.stopc:
+			closeConn()
+		case <-sessionc:
+		}
+	}()
+	n.update(func(st *NodeStats) { st.Sessions++ })
+	if err := authenticate(c, a.secret); err != nil {
+		return err
+	}
+	hello := message{Type: helloMessage, ClusterID: ni.ClusterID, NodeID: ni.NodeID}
+	bs, err := a.db.GetBootstrapInfo(ni.ClusterID, ni.NodeID)
+	if err == nil {
+		hello.Bootstrap = &bs
+	} else if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return err
+	}
+	if err := c.send(hello); err != nil {
+		return err
+	}
+	resume, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if resume.Type != resumeMessage {
+		return errors.Errorf("unexpected message type %d", resume.Type)
+	}
+	if err := a.checkResumeToken(ni, resume); err != nil {
+		return err
+	}
+	n.update(func(st *NodeStats) { st.Acked, st.Sent = resume.Index, resume.Index })
+	// acks are received in the background, receiving fails once the
+	// connection is closed
+	window := make(chan struct{}, a.opts.Window)
+	failedc := make(chan struct{})
+	var failure error
+	go func() {
+		defer close(failedc)
+		for {
+			m, err := c.receive()
+			if err != nil {
+				failure = err
+				return
+			}
+			if m.Type != ackMessage {
+				failure = errors.Errorf("unexpected message type %d", m.Type)
+				return
+			}
+			<-window
+			n.update(func(st *NodeStats) { st.Acked = m.Index })
+		}
+	}()
+	err = a.send(ni, n, nc, resume.Index+1, window, failedc)
+	if err != nil {
+		closeConn()
+	}
+	<-failedc
+	if err != nil || a.stopped() {
+		return err
+	}
+	return failure
+}
+
+// checkResumeToken checks that the last entry held by the remote LogDB is
+// also found in the primary LogDB.
+func (a *Agent) checkResumeToken(ni raftio.NodeInfo, resume message) error {
+	if resume.Index == 0 {
+		return nil
+	}
+	ents, _, err := a.db.IterateEntries(nil, 0,
+		ni.ClusterID, ni.NodeID, resume.Index, resume.Index+1, 0)
+	if err != nil {
+		return err
+	}
+	if len(ents) == 1 && ents[0].Index == resume.Index {
+		if ents[0].Term != resume.Term {
+			return errors.Wrapf(ErrDiverged, "%v entry %d term %d, remote term %d",
+				ni, resume.Index, ents[0].Term, resume.Term)
+		}
+		return nil
+	}
+	ss, err := a.db.GetSnapshot(ni.ClusterID, ni.NodeID)
+	if err != nil {
+		return err
+	}
+	if ss.Index == resume.Index && ss.Term != resume.Term {
+		return errors.Wrapf(ErrDiverged, "%v snapshot %d term %d, remote term %d",
+			ni, resume.Index, ss.Term, resume.Term)
+	}
+	// entries beyond the primary log can not be verified
+	rs, err := a.db.ReadRaftState(ni.ClusterID, ni.NodeID, ss.Index)
+	if err != nil && !errors.Is(err, raftio.ErrNoSavedLog) {
+		return err
+	}
+	if resume.Index > ss.Index && resume.Index >= rs.FirstIndex+rs.EntryCount {
+		return errors.Wrapf(ErrDiverged, "%v remote index %d beyond primary log",
+			ni, resume.Index)
+	}
+	return nil
+}
+
+// send sends batches of entries from the specified index as a replication
+// stream until the connection fails or the agent is closed.
+func (a *Agent) send(ni raftio.NodeInfo, n *node, nc net.Conn,
+	from uint64, window chan struct{}, failedc chan struct{}) error {
+	enc, err := pebble.NewStreamEncoder(nc)
+	if err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	sub, err := a.db.Subscribe(ni.ClusterID, ni.NodeID, from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sub.Close()
+	}()
+	for {
+		ents, err := sub.Next(failedc, a.opts.MaxBatchSize)
+		ud := pb.Update{ClusterID: ni.ClusterID, NodeID: ni.NodeID}
+		if errors.Is(err, pebble.ErrEntriesUnavailable) {
+			ss, err := a.db.GetSnapshot(ni.ClusterID, ni.NodeID)
+			if err != nil {
+				return err
+			}
+			if ss.Index < sub.NextIndex() {
+				return errors.Errorf("%v entries from %d unavailable, snapshot %d",
+					ni, sub.NextIndex(), ss.Index)
+			}
+			next, err := a.db.Subscribe(ni.ClusterID, ni.NodeID, ss.Index+1)
+			if err != nil {
+				return err
+			}
+			sub.Close()
+			sub = next
+			ud.Snapshot = ss
+			n.update(func(st *NodeStats) { st.Snapshots++ })
+		} else if err != nil {
+			return err
+		} else if ents == nil {
+			return nil
+		} else {
+			ud.EntriesToSave = ents
+		}
+		rs, err := a.db.ReadRaftState(ni.ClusterID, ni.NodeID, 0)
+		if err != nil {
+			return err
+		}
+		frames, ferr := encodeUpdate(ud, rs.State)
+		if ferr != nil && !errors.Is(ferr, ErrEntryTooLarge) {
+			return ferr
+		}
+		for _, f := range frames {
+			select {
+			case window <- struct{}{}:
+			case <-failedc:
+				return nil
+			}
+			f.Shard = a.db.ShardOf(ni.ClusterID)
+			f.Committed = time.Now()
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+			n.update(func(st *NodeStats) {
+				st.Sent = f.Seq
+				st.Batches++
+			})
+		}
+		if ferr != nil {
+			// entries sent before the oversized entry are still replicated,
+			// all slots are available once all frames are acknowledged
+			for i := 0; i < cap(window); i++ {
+				select {
+				case window <- struct{}{}:
+				case <-failedc:
+					return ferr
+				}
+			}
+			return ferr
+		}
+	}
+}
+
+// encodeUpdate returns the frames carrying the update, entries are split
+// across frames when they do not fit in a single frame. The seq of each frame
+// is the index of its last entry or of the snapshot. ErrEntryTooLarge is
+// returned along with the frames of entries preceding the oversized entry.
+func encodeUpdate(ud pb.Update, st pb.State) ([]pebble.StreamFrame, error) {
+	index := ud.Snapshot.Index
+	if len(ud.EntriesToSave) > 0 {
+		index = ud.EntriesToSave[len(ud.EntriesToSave)-1].Index
+	}
+	// only entries up to the batch are committed on the remote LogDB
+	ud.State = capCommit(st, index)
+	data, err := pebble.EncodeUpdateBatch(ud)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= maxFrameBatchSize {
+		return []pebble.StreamFrame{{Seq: index, Data: data}}, nil
+	}
+	if len(ud.EntriesToSave) <= 1 {
+		return nil, errors.Wrapf(ErrEntryTooLarge, "%d:%d index %d, %d bytes",
+			ud.ClusterID, ud.NodeID, index, len(data))
+	}
+	half := len(ud.EntriesToSave) / 2
+	first, second := ud, ud
+	first.EntriesToSave = ud.EntriesToSave[:half]
+	second.EntriesToSave = ud.EntriesToSave[half:]
+	frames, err := encodeUpdate(first, st)
+	if err != nil {
+		return frames, err
+	}
+	rest, err := encodeUpdate(second, st)
+	return append(frames, rest...), err
+}
+
+// Receiver applies batches sent by Agents to the remote LogDB. Agents are
+// authenticated using a challenge response based on a shared secret, the
+// secret itself is never sent. Replicated data is not encrypted, connections
+// should be protected using TLS unless the network is trusted.
+type Receiver struct {
+	db     *pebble.ShardedDB
+	secret []byte
+	server *server
+}
+
+// NewReceiver returns a Receiver applying batches sent by Agents knowing the
+// specified secret to db.
+func NewReceiver(db *pebble.ShardedDB, secret []byte) (*Receiver, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty replication secret")
+	}
+	r := &Receiver{db: db, secret: append([]byte(nil), secret...)}
+	r.server = newServer("replication", r.handle)
+	return r, nil
+}
+
+// Serve accepts connections from Agents until the listener is closed or the
+// Receiver is closed.
+func (r *Receiver) Serve(l net.Listener) error {
+	return r.server.serve(l)
+}
+
+// Close stops accepting connections, closes all connections and waits for
+// all sessions to end.
+func (r *Receiver) Close() error {
+	return r.server.close()
+}
+
+func (r *Receiver) handle(c *conn) error {
+	if err := challenge(c, r.secret); err != nil {
+		return err
+	}
+	hello, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if hello.Type != helloMessage {
+		return errors.Errorf("unexpected message type %d", hello.Type)
+	}
+	return r.session(c, hello)
+}
+
+func (r *Receiver) session(c *conn, hello message) error {
+	cid, nid := hello.ClusterID, hello.NodeID
+	if hello.Bootstrap != nil {
+		if _, err := r.db.GetBootstrapInfo(cid, nid); errors.Is(err, raftio.ErrNoBootstrapInfo) {
+			if err := r.db.SaveBootstrapInfo(cid, nid, *hello.Bootstrap); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	index, term, err := r.lastEntry(cid, nid)
+	if err != nil {
+		return err
+	}
+	if err := c.send(message{Type: resumeMessage,
+		ClusterID: cid, NodeID: nid, Index: index, Term: term}); err != nil {
+		return err
+	}
+	dec, err := pebble.NewStreamDecoder(c.r)
+	if err != nil {
+		return err
+	}
+	dec.MaxFrameSize = maxFrameSize
+	ctx := r.db.GetLogDBThreadContext()
+	defer ctx.Destroy()
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return err
+		}
+		ud, err := pebble.DecodeUpdateBatch(f.Data)
+		if err != nil {
+			return err
+		}
+		if ud.ClusterID != cid || ud.NodeID != nid {
+			return errors.Errorf("unexpected batch of %d:%d for %d:%d",
+				ud.ClusterID, ud.NodeID, cid, nid)
+		}
+		ctx.Reset()
+		if err := r.db.SaveRaftStateCtx([]pb.Update{ud}, ctx); err != nil {
+			return err
+		}
+		if !pb.IsEmptySnapshot(ud.Snapshot) {
+			// entries before the snapshot are no longer replicated
+			if err := r.db.RemoveEntriesTo(cid, nid, ud.Snapshot.Index); err != nil {
+				return err
+			}
+		}
+		if err := c.send(message{Type: ackMessage,
+			ClusterID: cid, NodeID: nid, Index: f.Seq}); err != nil {
+			return err
+		}
+	}
+}
+
+// lastEntry returns the index and term of the last entry of the node held by
+// the remote LogDB, which are used as the resume token.
+func (r *Receiver) lastEntry(clusterID uint64, nodeID uint64) (uint64, uint64, error) {
+	ss, err := r.db.GetSnapshot(clusterID, nodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	rs, err := r.db.ReadRaftState(clusterID, nodeID, ss.Index)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return ss.Index, ss.Term, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if rs.EntryCount == 0 {
+		return ss.Index, ss.Term, nil
+	}
+	last := rs.FirstIndex + rs.EntryCount - 1
+	ents, _, err := r.db.IterateEntries(nil, 0, clusterID, nodeID, last, last+1, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(ents) != 1 {
+		return 0, 0, errors.Errorf("last entry %d not found", last)
+	}
+	return last, ents[0].Term, nil
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF)
+}
+
+func ignoreClosed(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func firstError(err1 error, err2 error) error {
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -0,0 +1,210 @@
+package replication
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T) *pebble.ShardedDB {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	cfg.Shards = 2
+	db, err := pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	return db
+}
+
+func saveTestEntries(t *testing.T, db *pebble.ShardedDB,
+	first uint64, last uint64, term uint64, ss pb.Snapshot) {
+	ents := make([]pb.Entry, 0)
+	for i := first; i <= last; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: term, Cmd: make([]byte, 16)})
+	}
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        1,
+		State:         pb.State{Term: term, Commit: last},
+		EntriesToSave: ents,
+		Snapshot:      ss,
+	}
+	require.NoError(t, db.SaveRaftStateCtx([]pb.Update{ud}, db.GetLogDBThreadContext()))
+}
+
+func startReceiver(t *testing.T,
+	db *pebble.ShardedDB) (func() (net.Conn, error), func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	r, err := NewReceiver(db, []byte("secret"))
+	require.NoError(t, err)
+	donec := make(chan struct{})
+	go func() {
+		defer close(donec)
+		require.NoError(t, r.Serve(l))
+	}()
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	return dial, func() {
+		require.NoError(t, r.Close())
+		<-donec
+	}
+}
+
+func lastIndexOf(t *testing.T, db *pebble.ShardedDB) uint64 {
+	r := &Receiver{db: db}
+	index, _, err := r.lastEntry(1, 1)
+	require.NoError(t, err)
+	return index
+}
+
+func TestNodeIsReplicated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	primary := openTestDB(t)
+	defer func() {
+		require.NoError(t, primary.Close())
+	}()
+	replica := openTestDB(t)
+	defer func() {
+		require.NoError(t, replica.Close())
+	}()
+	require.NoError(t, primary.SaveBootstrapInfo(1, 1, pb.Bootstrap{Join: true}))
+	saveTestEntries(t, primary, 1, 100, 1, pb.Snapshot{Index: 50, Term: 1})
+	require.NoError(t, primary.RemoveEntriesTo(1, 1, 50))
+	dial, stop := startReceiver(t, replica)
+	defer stop()
+
+	// entries compacted on the primary are replaced by the snapshot
+	agent := NewAgent(primary, dial, []byte("secret"), Options{MaxBatchSize: 256, Window: 2})
+	require.NoError(t, agent.Replicate(1, 1))
+	require.Error(t, agent.Replicate(1, 1))
+	// entries are acked once saved, the replica is not read before as reads
+	// must not race with writes of the same node
+	require.Eventually(t, func() bool {
+		return agent.Stats()[0].Acked == 100
+	}, 5*time.Second, time.Millisecond)
+	agent.Close()
+	require.Equal(t, uint64(100), lastIndexOf(t, replica))
+	stats := agent.Stats()
+	require.Len(t, stats, 1)
+	require.Equal(t, uint64(1), stats[0].Snapshots)
+	require.True(t, stats[0].Batches > 1)
+	ss, err := replica.GetSnapshot(1, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), ss.Index)
+	_, err = replica.GetBootstrapInfo(1, 1)
+	require.NoError(t, err)
+
+	// replication resumes from the last replicated entry
+	saveTestEntries(t, primary, 101, 120, 2, pb.Snapshot{})
+	agent = NewAgent(primary, dial, []byte("secret"), Options{})
+	require.NoError(t, agent.Replicate(1, 1))
+	require.Eventually(t, func() bool {
+		return agent.Stats()[0].Acked == 120
+	}, 5*time.Second, time.Millisecond)
+	saveTestEntries(t, primary, 121, 130, 2, pb.Snapshot{})
+	require.Eventually(t, func() bool {
+		return agent.Stats()[0].Acked == 130
+	}, 5*time.Second, time.Millisecond)
+	agent.Close()
+	require.Equal(t, uint64(130), lastIndexOf(t, replica))
+	stats = agent.Stats()
+	require.Equal(t, uint64(0), stats[0].Snapshots)
+	rs, err := replica.ReadRaftState(1, 1, 50)
+	require.NoError(t, err)
+	require.Equal(t, uint64(130), rs.State.Commit)
+	require.Equal(t, uint64(2), rs.State.Term)
+	report, err := replica.Verify()
+	require.NoError(t, err)
+	require.Empty(t, report.Violations)
+}
+
+func TestDivergedReplicaIsDetected(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	primary := openTestDB(t)
+	defer func() {
+		require.NoError(t, primary.Close())
+	}()
+	replica := openTestDB(t)
+	defer func() {
+		require.NoError(t, replica.Close())
+	}()
+	saveTestEntries(t, primary, 1, 10, 1, pb.Snapshot{})
+	saveTestEntries(t, replica, 1, 5, 2, pb.Snapshot{})
+	dial, stop := startReceiver(t, replica)
+	defer stop()
+	agent := NewAgent(primary, dial, []byte("secret"), Options{RetryInterval: time.Millisecond})
+	defer agent.Close()
+	require.NoError(t, agent.Replicate(1, 1))
+	require.Eventually(t, func() bool {
+		return strings.Contains(agent.Stats()[0].Error, ErrDiverged.Error())
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, uint64(1), agent.Stats()[0].Sessions)
+	require.Equal(t, uint64(5), lastIndexOf(t, replica))
+}
+
+func TestAgentsMustAuthenticate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	primary := openTestDB(t)
+	defer func() {
+		require.NoError(t, primary.Close())
+	}()
+	replica := openTestDB(t)
+	defer func() {
+		require.NoError(t, replica.Close())
+	}()
+	_, err := NewReceiver(replica, nil)
+	require.Error(t, err)
+	saveTestEntries(t, primary, 1, 10, 1, pb.Snapshot{})
+	dial, stop := startReceiver(t, replica)
+	defer stop()
+	agent := NewAgent(primary, dial, []byte("wrong"), Options{RetryInterval: time.Millisecond})
+	defer agent.Close()
+	require.NoError(t, agent.Replicate(1, 1))
+	require.Eventually(t, func() bool {
+		return strings.Contains(agent.Stats()[0].Error, ErrAuthenticationFailed.Error())
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, uint64(0), lastIndexOf(t, replica))
+}
+
+func TestOversizedEntriesStopReplication(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer func(size int) { maxFrameBatchSize = size }(maxFrameBatchSize)
+	maxFrameBatchSize = 1024
+	primary := openTestDB(t)
+	defer func() {
+		require.NoError(t, primary.Close())
+	}()
+	replica := openTestDB(t)
+	defer func() {
+		require.NoError(t, replica.Close())
+	}()
+	saveTestEntries(t, primary, 1, 100, 1, pb.Snapshot{})
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        1,
+		State:         pb.State{Term: 1, Commit: 101},
+		EntriesToSave: []pb.Entry{{Index: 101, Term: 1, Cmd: make([]byte, 2048)}},
+	}
+	require.NoError(t, primary.SaveRaftStateCtx([]pb.Update{ud}, primary.GetLogDBThreadContext()))
+	dial, stop := startReceiver(t, replica)
+	defer stop()
+	agent := NewAgent(primary, dial, []byte("secret"), Options{RetryInterval: time.Millisecond})
+	require.NoError(t, agent.Replicate(1, 1))
+	require.Eventually(t, func() bool {
+		return strings.Contains(agent.Stats()[0].Error, ErrEntryTooLarge.Error())
+	}, 5*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return agent.Stats()[0].Acked == 100
+	}, 5*time.Second, time.Millisecond)
+	st := agent.Stats()[0]
+	require.Equal(t, uint64(1), st.Sessions)
+	require.Greater(t, st.Batches, uint64(1))
+	agent.Close()
+	require.Equal(t, uint64(100), lastIndexOf(t, replica))
+}
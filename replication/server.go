@@ -0,0 +1,101 @@
+package replication
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// server accepts connections and serves each of them using the handler in a
+// dedicated goroutine.
+type server struct {
+	name      string
+	handler   func(c *conn) error
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+func newServer(name string, handler func(c *conn) error) *server {
+	return &server{
+		name:      name,
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *server) serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.Errorf("%s server closed", s.name)
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return errors.WithStack(nc.Close())
+		}
+		s.conns[nc] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			if err := s.handle(nc); err != nil && !isClosedError(err) {
+				plog.Warningf("%s session failed, %v", s.name, err)
+			}
+		}()
+	}
+}
+
+// handle serves a single connection, the connection is closed once done.
+// Errors are reported to the remote side before closing the connection.
+func (s *server) handle(nc net.Conn) (err error) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		err = firstError(err, ignoreClosed(nc.Close()))
+	}()
+	c := newConn(nc)
+	err = s.handler(c)
+	if err != nil && !isClosedError(err) {
+		if serr := c.send(message{Type: errorMessage, Error: err.Error()}); serr != nil {
+			plog.Debugf("failed to report error, %v", serr)
+		}
+	}
+	return err
+}
+
+// close stops accepting connections, closes all connections and waits for all
+// sessions to end.
+func (s *server) close() (err error) {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		err = firstError(err, ignoreClosed(l.Close()))
+	}
+	for c := range s.conns {
+		err = firstError(err, ignoreClosed(c.Close()))
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.WithStack(err)
+}
@@ -0,0 +1,274 @@
+/*
+Package workload provides a raftio.ILogDB decorator recording the stream of
+saved raft state batches and a replayer driving a LogDB with the recorded
+workload, so performance problems observed in production can be reproduced
+outside of the production environment.
+
+Recordings only contain the structure of the workload, i.e. node IDs, raft
+states, entry indexes, terms, types and sizes, timings and snapshot indexes.
+Entry payloads are never recorded, they are replaced by zero filled payloads
+of the same size when replayed.
+*/
+package workload
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coufalja/tugboat/raftio"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/pkg/errors"
+)
+
+// recordingVersion is the version of the recording format.
+const recordingVersion uint32 = 1
+
+// ErrInvalidRecording indicates that the recording can not be replayed.
+var ErrInvalidRecording = errors.New("invalid workload recording")
+
+// Header is the first record of a recording.
+type Header struct {
+	Version uint32
+	Start   time.Time
+}
+
+// Entry is the anonymized entry, only the size of its payload is recorded.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  pb.EntryType
+	Size  int
+}
+
+// Update is the anonymized pb.Update instance.
+type Update struct {
+	ClusterID     uint64
+	NodeID        uint64
+	State         pb.State
+	SnapshotIndex uint64 `json:",omitempty"`
+	SnapshotTerm  uint64 `json:",omitempty"`
+	Entries       []Entry
+}
+
+// Batch is the recorded SaveRaftState call.
+type Batch struct {
+	// Offset is the time elapsed between the start of the recording and the
+	// start of the call.
+	Offset time.Duration
+	// Duration is the time taken by the recorded LogDB to complete the call.
+	Duration time.Duration
+	ShardID  uint64
+	Updates  []Update
+	// Failed indicates whether the call returned an error.
+	Failed bool `json:",omitempty"`
+}
+
+func newBatch(updates []pb.Update, shardID uint64) Batch {
+	b := Batch{ShardID: shardID, Updates: make([]Update, 0, len(updates))}
+	for _, ud := range updates {
+		u := Update{
+			ClusterID:     ud.ClusterID,
+			NodeID:        ud.NodeID,
+			State:         ud.State,
+			SnapshotIndex: ud.Snapshot.Index,
+			SnapshotTerm:  ud.Snapshot.Term,
+			Entries:       make([]Entry, 0, len(ud.EntriesToSave)),
+		}
+		for _, e := range ud.EntriesToSave {
+			u.Entries = append(u.Entries, Entry{
+				Index: e.Index,
+				Term:  e.Term,
+				Type:  e.Type,
+				Size:  len(e.Cmd),
+			})
+		}
+		b.Updates = append(b.Updates, u)
+	}
+	return b
+}
+
+// updates returns the pb.Update instances to be replayed and the total size
+// of their payloads.
+func (b *Batch) updates() ([]pb.Update, uint64) {
+	updates := make([]pb.Update, 0, len(b.Updates))
+	bytes := uint64(0)
+	for _, u := range b.Updates {
+		ud := pb.Update{
+			ClusterID:     u.ClusterID,
+			NodeID:        u.NodeID,
+			State:         u.State,
+			EntriesToSave: make([]pb.Entry, 0, len(u.Entries)),
+		}
+		if u.SnapshotIndex > 0 {
+			ud.Snapshot = pb.Snapshot{
+				ClusterId: u.ClusterID,
+				Index:     u.SnapshotIndex,
+				Term:      u.SnapshotTerm,
+			}
+		}
+		for _, e := range u.Entries {
+			ud.EntriesToSave = append(ud.EntriesToSave, pb.Entry{
+				Index: e.Index,
+				Term:  e.Term,
+				Type:  e.Type,
+				Cmd:   make([]byte, e.Size),
+			})
+			bytes += uint64(e.Size)
+		}
+		updates = append(updates, ud)
+	}
+	return updates, bytes
+}
+
+// Recorder is a raftio.ILogDB decorator recording all SaveRaftState calls.
+// Recording errors never fail the recorded calls, the first one is reported
+// by the Err method and stops the recording.
+type Recorder struct {
+	raftio.ILogDB
+	mu    sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+	err   error
+}
+
+var _ raftio.ILogDB = (*Recorder)(nil)
+
+// NewRecorder creates a Recorder wrapping db, the recording is written to w.
+func NewRecorder(db raftio.ILogDB, w io.Writer) *Recorder {
+	r := &Recorder{
+		ILogDB: db,
+		enc:    json.NewEncoder(w),
+		start:  time.Now(),
+	}
+	if err := r.enc.Encode(Header{Version: recordingVersion, Start: r.start}); err != nil {
+		r.err = errors.WithStack(err)
+	}
+	return r
+}
+
+// Err returns the first error encountered when writing the recording.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Unwrap returns the wrapped LogDB.
+func (r *Recorder) Unwrap() raftio.ILogDB {
+	return r.ILogDB
+}
+
+// SaveRaftState ...
+func (r *Recorder) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	b := newBatch(updates, shardID)
+	start := time.Now()
+	err := r.ILogDB.SaveRaftState(updates, shardID)
+	b.Duration = time.Since(start)
+	b.Offset = start.Sub(r.start)
+	b.Failed = err != nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		if werr := r.enc.Encode(&b); werr != nil {
+			r.err = errors.WithStack(werr)
+		}
+	}
+	return err
+}
+
+// ReplayOptions are the options of a replay.
+type ReplayOptions struct {
+	// Speed is the replay speed relative to the recorded pace, e.g. 2 replays
+	// the workload twice as fast as recorded. Batches are replayed back to
+	// back when Speed is 0.
+	Speed float64
+	// SkipFailed skips batches failed when recorded.
+	SkipFailed bool
+}
+
+// ReplayReport is the result of a replay.
+type ReplayReport struct {
+	Batches int
+	Updates int
+	Entries int
+	// Bytes is the size of all replayed entry payloads.
+	Bytes uint64
+	// Duration is the time taken to replay the workload.
+	Duration time.Duration
+	// Recorded is the total duration of the recorded SaveRaftState calls.
+	Recorded time.Duration
+	// Replayed is the total duration of the replayed SaveRaftState calls.
+	Replayed time.Duration
+	P50      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Replay reads the recording from r and replays it against db. The db is
+// expected to be empty and to have the same number of shards as the recorded
+// LogDB, recorded shard IDs are passed to db as is.
+func Replay(db raftio.ILogDB, r io.Reader, opts ReplayOptions) (ReplayReport, error) {
+	if opts.Speed < 0 {
+		return ReplayReport{}, errors.Errorf("invalid speed %f", opts.Speed)
+	}
+	dec := json.NewDecoder(r)
+	h := Header{}
+	if err := dec.Decode(&h); err != nil {
+		return ReplayReport{}, errors.Wrapf(ErrInvalidRecording, "%v", err)
+	}
+	if h.Version != recordingVersion {
+		return ReplayReport{}, errors.Wrapf(ErrInvalidRecording,
+			"unsupported version %d", h.Version)
+	}
+	report := ReplayReport{}
+	latencies := make([]time.Duration, 0)
+	start := time.Now()
+	for {
+		b := Batch{}
+		if err := dec.Decode(&b); err == io.EOF {
+			break
+		} else if err != nil {
+			return ReplayReport{}, errors.Wrapf(ErrInvalidRecording, "%v", err)
+		}
+		if len(b.Updates) == 0 || (b.Failed && opts.SkipFailed) {
+			continue
+		}
+		if opts.Speed > 0 {
+			due := time.Duration(float64(b.Offset) / opts.Speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		updates, bytes := b.updates()
+		callStart := time.Now()
+		if err := db.SaveRaftState(updates, b.ShardID); err != nil {
+			return ReplayReport{}, errors.Wrapf(err, "batch %d", report.Batches)
+		}
+		d := time.Since(callStart)
+		latencies = append(latencies, d)
+		report.Batches++
+		report.Updates += len(updates)
+		for _, ud := range updates {
+			report.Entries += len(ud.EntriesToSave)
+		}
+		report.Bytes += bytes
+		report.Recorded += b.Duration
+		report.Replayed += d
+	}
+	report.Duration = time.Since(start)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		report.P50 = percentile(0.5)
+		report.P99 = percentile(0.99)
+		report.Max = latencies[len(latencies)-1]
+	}
+	return report, nil
+}
@@ -0,0 +1,120 @@
+package workload
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coufalja/tugboat-logdb/pebble"
+	pb "github.com/coufalja/tugboat/raftpb"
+	"github.com/coufalja/tugboat/server"
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/vfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogDB(t *testing.T) *pebble.ShardedDB {
+	cfg := pebble.GetTinyMemLogDBConfig()
+	cfg.FS = vfs.NewMem()
+	db, err := pebble.NewLogDB(cfg, nil, []string{"db"}, nil, pebble.CheckNone)
+	require.NoError(t, err)
+	return db
+}
+
+func testUpdate(clusterID uint64, first uint64, last uint64) pb.Update {
+	ud := pb.Update{
+		ClusterID: clusterID,
+		NodeID:    1,
+		State:     pb.State{Term: 2, Vote: 1, Commit: last},
+	}
+	for i := first; i <= last; i++ {
+		ud.EntriesToSave = append(ud.EntriesToSave,
+			pb.Entry{Index: i, Term: 2, Cmd: []byte("secret payload")})
+	}
+	return ud
+}
+
+func TestRecordedWorkloadCanBeReplayed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	shards := pebble.GetTinyMemLogDBConfig().Shards
+	p := server.NewDoubleFixedPartitioner(shards, shards)
+	db := newTestLogDB(t)
+	buf := &bytes.Buffer{}
+	rec := NewRecorder(db, buf)
+	for i := uint64(0); i < 10; i++ {
+		for cid := uint64(1); cid <= 3; cid++ {
+			ud := testUpdate(cid, i*10+1, i*10+10)
+			if i == 5 {
+				ud.Snapshot = pb.Snapshot{ClusterId: cid, Index: 40, Term: 2}
+			}
+			shardID := p.GetPartitionID(cid) + 1
+			require.NoError(t, rec.SaveRaftState([]pb.Update{ud}, shardID))
+		}
+	}
+	require.NoError(t, rec.Err())
+	require.NoError(t, rec.Close())
+	require.False(t, strings.Contains(buf.String(), "secret"))
+
+	replayed := newTestLogDB(t)
+	defer func() {
+		require.NoError(t, replayed.Close())
+	}()
+	report, err := Replay(replayed, bytes.NewReader(buf.Bytes()), ReplayOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 30, report.Batches)
+	require.Equal(t, 30, report.Updates)
+	require.Equal(t, 300, report.Entries)
+	require.Equal(t, uint64(300*len("secret payload")), report.Bytes)
+	require.True(t, report.Max >= report.P99 && report.P99 >= report.P50)
+	for cid := uint64(1); cid <= 3; cid++ {
+		ss, err := replayed.GetSnapshot(cid, 1)
+		require.NoError(t, err)
+		require.Equal(t, uint64(40), ss.Index)
+		rs, err := replayed.ReadRaftState(cid, 1, ss.Index)
+		require.NoError(t, err)
+		require.Equal(t, pb.State{Term: 2, Vote: 1, Commit: 100}, rs.State)
+		require.Equal(t, uint64(40), rs.FirstIndex)
+		require.Equal(t, uint64(61), rs.EntryCount)
+		ents, _, err := replayed.IterateEntries(nil, 0, cid, 1, 41, 42, ^uint64(0))
+		require.NoError(t, err)
+		require.Len(t, ents, 1)
+		require.Equal(t, make([]byte, len("secret payload")), ents[0].Cmd)
+	}
+}
+
+func TestReplayFollowsRecordedPace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	recording := `{"Version":1}
+{"Offset":0,"ShardID":1,"Updates":[{"ClusterID":16,"NodeID":1,"State":{"Term":1,"Vote":1,"Commit":1},"Entries":[{"Index":1,"Term":1,"Type":0,"Size":8}]}]}
+{"Offset":100000000,"ShardID":1,"Updates":[{"ClusterID":16,"NodeID":1,"State":{"Term":1,"Vote":1,"Commit":2},"Entries":[{"Index":2,"Term":1,"Type":0,"Size":8}]}]}
+{"Offset":200000000,"ShardID":1,"Failed":true,"Updates":[{"ClusterID":16,"NodeID":1,"State":{"Term":1,"Vote":1,"Commit":3},"Entries":[{"Index":3,"Term":1,"Type":0,"Size":8}]}]}
+`
+	db := newTestLogDB(t)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	report, err := Replay(db, strings.NewReader(recording),
+		ReplayOptions{Speed: 2, SkipFailed: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Batches)
+	require.True(t, report.Duration >= 50*time.Millisecond)
+	rs, err := db.ReadRaftState(16, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rs.EntryCount)
+}
+
+func TestReplayRejectsInvalidRecording(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	db := newTestLogDB(t)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	for _, r := range []string{"", `{"Version":2}`, "{\"Version\":1}\n{"} {
+		_, err := Replay(db, strings.NewReader(r), ReplayOptions{})
+		require.True(t, errors.Is(err, ErrInvalidRecording), r)
+	}
+	_, err := Replay(db, strings.NewReader(""), ReplayOptions{Speed: -1})
+	require.Error(t, err)
+}